@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// change mirrors data-service's RecordChange.
+type change struct {
+	Sequence  uint64    `json:"seq"`
+	Operation string    `json:"op"`
+	RecordID  string    `json:"record_id"`
+	Record    *record   `json:"record,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type changeFilter struct {
+	op         string
+	recordType string
+}
+
+func (f changeFilter) match(c change) bool {
+	if f.op != "" && c.Operation != f.op {
+		return false
+	}
+	if f.recordType != "" && (c.Record == nil || c.Record.Type != f.recordType) {
+		return false
+	}
+	return true
+}
+
+func newChangesCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "changes",
+		Short: "Read the data-service change stream",
+	}
+
+	var since int64
+	var follow bool
+	var filter changeFilter
+	tail := &cobra.Command{
+		Use:   "tail",
+		Short: "Print record changes, optionally following new ones",
+		Long: "Print record changes after --since. Without --since only changes made\n" +
+			"from now on are shown, so use it with --follow or give a sequence\n" +
+			"number (0 for the whole log). --follow keeps the stream open and\n" +
+			"resumes from the last sequence seen when the connection drops.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var from uint64
+			if since >= 0 {
+				from = uint64(since)
+			} else {
+				var err error
+				if from, err = lastSequence(cfg); err != nil {
+					return err
+				}
+			}
+			if follow {
+				return followChanges(cfg, from, filter)
+			}
+			return readChanges(cfg, from, filter)
+		},
+	}
+	tail.Flags().Int64Var(&since, "since", -1, "start after this sequence number")
+	tail.Flags().BoolVarP(&follow, "follow", "f", false, "keep streaming new changes")
+	tail.Flags().StringVar(&filter.op, "op", "", "only show create, update or delete changes")
+	tail.Flags().StringVar(&filter.recordType, "type", "", "only show changes to records of this type")
+
+	cmd.AddCommand(tail)
+	return cmd
+}
+
+type changesPage struct {
+	Changes []change `json:"changes"`
+	Next    uint64   `json:"next"`
+	LastSeq uint64   `json:"last_seq"`
+}
+
+func lastSequence(cfg *config) (uint64, error) {
+	var page changesPage
+	if err := cfg.call("GET", cfg.DataURL, "/api/v1/changes?limit=1", nil, &page); err != nil {
+		return 0, err
+	}
+	return page.LastSeq, nil
+}
+
+// readChanges pages through the log from since to its current end.
+func readChanges(cfg *config, since uint64, filter changeFilter) error {
+	for {
+		var page changesPage
+		path := "/api/v1/changes?since=" + strconv.FormatUint(since, 10)
+		if err := cfg.call("GET", cfg.DataURL, path, nil, &page); err != nil {
+			return err
+		}
+		for _, c := range page.Changes {
+			if filter.match(c) {
+				if err := printChange(cfg, c); err != nil {
+					return err
+				}
+			}
+		}
+		if len(page.Changes) == 0 || page.Next >= page.LastSeq {
+			return nil
+		}
+		since = page.Next
+	}
+}
+
+// followChanges reads /api/v1/changes/stream until interrupted, reconnecting
+// with Last-Event-ID after errors.
+func followChanges(cfg *config, since uint64, filter changeFilter) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backoff := time.Second
+	for {
+		last, err := streamChanges(ctx, cfg, since, filter)
+		if last > since {
+			since = last
+			backoff = time.Second
+		}
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "change stream: %v; reconnecting in %s\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// streamChanges returns the last sequence printed and a nil error only when
+// ctx is cancelled.
+func streamChanges(ctx context.Context, cfg *config, since uint64, filter changeFilter) (uint64, error) {
+	req, err := cfg.newRequest("GET", strings.TrimRight(cfg.DataURL, "/")+"/api/v1/changes/stream", nil)
+	if err != nil {
+		return since, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(since, 10))
+
+	// No client timeout: the stream is expected to stay open.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return since, nil
+		}
+		return since, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return since, fmt.Errorf("%s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var c change
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return since, fmt.Errorf("invalid change event: %w", err)
+		}
+		since = c.Sequence
+		if filter.match(c) {
+			if err := printChange(cfg, c); err != nil {
+				return since, err
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return since, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return since, err
+	}
+	return since, fmt.Errorf("stream closed by server")
+}
+
+func printChange(cfg *config, c change) error {
+	if cfg.jsonOutput() {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(data))
+		return err
+	}
+	recordType := "-"
+	if c.Record != nil {
+		recordType = c.Record.Type
+	}
+	_, err := fmt.Printf("%d\t%s\t%-6s\t%s\t%s\n", c.Sequence, c.Timestamp.Local().Format("15:04:05.000"), c.Operation, recordType, c.RecordID)
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type config struct {
+	GatewayURL  string
+	BusinessURL string
+	DataURL     string
+	RollupURL   string
+	Token       string
+	BasicAuth   string
+	Priority    string
+	Timeout     time.Duration
+	Output      string
+}
+
+// client returns an HTTP client for one-shot requests; streams use their own
+// client without a timeout.
+func (c *config) client() *http.Client {
+	return &http.Client{Timeout: c.Timeout}
+}
+
+func (c *config) newRequest(method, url string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "pipelinectl/"+version)
+	if c.Priority != "" {
+		req.Header.Set("X-Request-Priority", c.Priority)
+	}
+	c.authorize(req)
+	return req, nil
+}
+
+func (c *config) authorize(req *http.Request) {
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.BasicAuth != "":
+		user, password, _ := strings.Cut(c.BasicAuth, ":")
+		req.SetBasicAuth(user, password)
+	}
+}
+
+// call sends body as JSON to base+path and decodes the response into out,
+// which may be nil. Non-2xx responses are returned as errors carrying the
+// response text.
+func (c *config) call(method, base, path string, body, out interface{}) error {
+	url := strings.TrimRight(base, "/") + path
+	req, err := c.newRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(text)))
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// resource is call for the services' resource endpoints, which wrap the
+// resource in a response envelope: it decodes the envelope's data into out.
+func (c *config) resource(method, base, path string, body, out interface{}) error {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := c.call(method, base, path, body, &envelope); err != nil {
+		return err
+	}
+	if out == nil || len(envelope.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// listAll fetches every page of a collection, following the envelope's
+// pagination.next links, and returns the items of all pages.
+func listAll[T any](c *config, base, path string) ([]T, error) {
+	// Links are absolute paths, which already include the gateway's proxy
+	// prefix when base points at it.
+	origin := base
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	var items []T
+	for path != "" {
+		var page struct {
+			Data       []T `json:"data"`
+			Pagination struct {
+				Next string `json:"next"`
+			} `json:"pagination"`
+		}
+		if err := c.call("GET", base, path, nil, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page.Data...)
+		base, path = origin, page.Pagination.Next
+	}
+	return items, nil
+}
+
+func (c *config) jsonOutput() bool {
+	return c.Output == "json"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printTable writes tab-separated rows under header, aligned.
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type healthResult struct {
+	Service   string  `json:"service"`
+	URL       string  `json:"url"`
+	Healthy   bool    `json:"healthy"`
+	Ready     bool    `json:"ready"`
+	LatencyMs float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+func newHealthCommand(cfg *config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "health",
+		Short: "Check /health and /ready of the gateway and every service",
+		Long: "Check /health and /ready of the gateway and every service. Exits\n" +
+			"non-zero when any service is unhealthy or not ready.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := []struct{ name, url string }{
+				{"api-gateway", cfg.GatewayURL},
+				{"business-service", cfg.BusinessURL},
+				{"data-service", cfg.DataURL},
+				{"rollup-service", cfg.RollupURL},
+			}
+
+			results := make([]healthResult, len(targets))
+			done := make(chan struct{})
+			for i, t := range targets {
+				go func(i int, name, url string) {
+					results[i] = checkService(cfg, name, url)
+					done <- struct{}{}
+				}(i, t.name, t.url)
+			}
+			for range targets {
+				<-done
+			}
+
+			failed := 0
+			for _, r := range results {
+				if !r.Healthy || !r.Ready {
+					failed++
+				}
+			}
+
+			if cfg.jsonOutput() {
+				if err := printJSON(results); err != nil {
+					return err
+				}
+			} else {
+				rows := make([][]string, 0, len(results))
+				for _, r := range results {
+					rows = append(rows, []string{
+						r.Service,
+						r.URL,
+						yesNo(r.Healthy),
+						yesNo(r.Ready),
+						fmt.Sprintf("%.1f ms", r.LatencyMs),
+						r.Detail,
+					})
+				}
+				if err := printTable([]string{"SERVICE", "URL", "HEALTHY", "READY", "LATENCY", "DETAIL"}, rows); err != nil {
+					return err
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d services unhealthy or not ready", failed, len(results))
+			}
+			return nil
+		},
+	}
+}
+
+func checkService(cfg *config, name, url string) healthResult {
+	result := healthResult{Service: name, URL: url}
+	base := strings.TrimRight(url, "/")
+
+	start := time.Now()
+	status, _, err := probe(cfg, base+"/health")
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	result.Healthy = status == http.StatusOK
+
+	status, body, err := probe(cfg, base+"/ready")
+	switch {
+	case err != nil:
+		result.Detail = err.Error()
+	case status == http.StatusOK:
+		result.Ready = true
+	default:
+		result.Detail = strings.TrimSpace(body)
+	}
+	return result
+}
+
+func probe(cfg *config, url string) (int, string, error) {
+	req, err := cfg.newRequest("GET", url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	resp, err := cfg.client().Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp.StatusCode, string(body), nil
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// job mirrors data-service's ProcessingJob.
+type job struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	Records   int        `json:"records_processed"`
+	Error     string     `json:"error,omitempty"`
+
+	// Deleted and Generated are the progress of deletion and generation
+	// jobs, which process no records.
+	Deleted   int `json:"records_deleted,omitempty"`
+	Generated int `json:"records_generated,omitempty"`
+}
+
+func (j job) finished() bool {
+	return j.EndTime != nil || j.Status == "completed" || j.Status == "failed" || j.Status == "cancelled"
+}
+
+func newJobsCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "jobs",
+		Aliases: []string{"job"},
+		Short:   "Trigger and inspect data-service processing jobs",
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List jobs, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jobs, err := listAll[job](cfg, cfg.DataURL, "/api/v2/jobs?limit=1000")
+			if err != nil {
+				return err
+			}
+			sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartTime.After(jobs[j].StartTime) })
+			if cfg.jsonOutput() {
+				return printJSON(jobs)
+			}
+			return printJobs(jobs...)
+		},
+	}
+
+	get := &cobra.Command{
+		Use:   "get ID",
+		Short: "Show one job",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var j job
+			if err := cfg.resource("GET", cfg.DataURL, "/api/v2/jobs/"+args[0], nil, &j); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(j)
+			}
+			return printJobs(j)
+		},
+	}
+
+	var wait bool
+	var waitTimeout time.Duration
+	var callbackURL string
+	var notify []string
+	var priority int
+	run := &cobra.Command{
+		Use:   "run",
+		Short: "Start a job that processes a batch of pending records",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var body interface{}
+			if callbackURL != "" || len(notify) > 0 || priority != 0 {
+				body = map[string]interface{}{"callback_url": callbackURL, "notify": notify, "priority": priority}
+			}
+			var j job
+			if err := cfg.resource("POST", cfg.DataURL, "/api/v2/jobs", body, &j); err != nil {
+				return err
+			}
+			if wait {
+				if err := waitForJob(cfg, &j, waitTimeout); err != nil {
+					return err
+				}
+			}
+			if cfg.jsonOutput() {
+				return printJSON(j)
+			}
+			return printJobs(j)
+		},
+	}
+	run.Flags().BoolVar(&wait, "wait", false, "wait for the job to finish")
+	run.Flags().DurationVar(&waitTimeout, "wait-timeout", 5*time.Minute, "how long --wait waits")
+	run.Flags().StringVar(&callbackURL, "callback-url", "", "URL the data service POSTs the job's result to when it finishes")
+	run.Flags().StringSliceVar(&notify, "notify", nil, "notification channels (jobs.notifications.channels) to tell when the job finishes")
+	run.Flags().IntVar(&priority, "priority", 0, "run before queued jobs of lower priority when the data service is at jobs.max_concurrent")
+
+	cancel := &cobra.Command{
+		Use:   "cancel ID",
+		Short: "Cancel a queued or running job",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var j job
+			if err := cfg.resource("POST", cfg.DataURL, "/api/v2/jobs/"+args[0]+"/cancel", nil, &j); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(j)
+			}
+			return printJobs(j)
+		},
+	}
+
+	cmd.AddCommand(list, get, run, cancel)
+	return cmd
+}
+
+// waitForJob polls j until it finishes or timeout passes.
+func waitForJob(cfg *config, j *job, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !j.finished() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("job %s still %s after %s", j.ID, j.Status, timeout)
+		}
+		time.Sleep(time.Second)
+		if err := cfg.resource("GET", cfg.DataURL, "/api/v2/jobs/"+j.ID, nil, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printJobs(jobs ...job) error {
+	rows := make([][]string, 0, len(jobs))
+	for _, j := range jobs {
+		duration := "-"
+		if j.EndTime != nil {
+			duration = j.EndTime.Sub(j.StartTime).Round(time.Millisecond).String()
+		}
+		records := j.Records
+		switch {
+		case j.Deleted > 0:
+			records = j.Deleted
+		case j.Generated > 0:
+			records = j.Generated
+		}
+		rows = append(rows, []string{j.ID, j.Status, strconv.Itoa(records), formatTime(j.StartTime), duration, j.Error})
+	}
+	return printTable([]string{"ID", "STATUS", "RECORDS", "STARTED", "DURATION", "ERROR"}, rows)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The services authenticate protected endpoints (/metrics, /admin/config,
+// simulations, audit) against the static endpoint_protection settings, so
+// keys are managed in config: generate one, roll it out, then verify it.
+func newKeysCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "keys",
+		Aliases: []string{"key"},
+		Short:   "Generate and verify API keys for protected endpoints",
+	}
+
+	var size int
+	generate := &cobra.Command{
+		Use:   "generate",
+		Short: "Print a random bearer token and the config to install it",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if size < 16 {
+				return fmt.Errorf("--bytes must be at least 16")
+			}
+			buf := make([]byte, size)
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			token := base64.RawURLEncoding.EncodeToString(buf)
+			if cfg.jsonOutput() {
+				return printJSON(map[string]string{"token": token})
+			}
+			fmt.Println(token)
+			fmt.Println()
+			fmt.Println("Set it on every service, e.g. in docker-compose.yml:")
+			fmt.Println()
+			fmt.Println("  ENDPOINT_PROTECTION_BEARER_TOKEN=" + token)
+			fmt.Println()
+			fmt.Println("or under endpoint_protection.bearer_token in config.yaml, then run")
+			fmt.Println("'pipelinectl keys verify --token <token>' once the services restarted.")
+			return nil
+		},
+	}
+	generate.Flags().IntVar(&size, "bytes", 32, "random bytes in the token")
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that --token (or --basic-auth) is accepted by every service",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := []struct{ name, url string }{
+				{"api-gateway", cfg.GatewayURL},
+				{"business-service", cfg.BusinessURL},
+				{"data-service", cfg.DataURL},
+				{"rollup-service", cfg.RollupURL},
+			}
+
+			type result struct {
+				Service  string `json:"service"`
+				Accepted bool   `json:"accepted"`
+				Detail   string `json:"detail"`
+			}
+			results := make([]result, 0, len(targets))
+			rejected := 0
+			for _, t := range targets {
+				r := result{Service: t.name}
+				status, _, err := probe(cfg, strings.TrimRight(t.url, "/")+"/metrics")
+				switch {
+				case err != nil:
+					r.Detail = err.Error()
+				case status == http.StatusOK:
+					r.Accepted = true
+					r.Detail = "accepted"
+				default:
+					r.Detail = fmt.Sprintf("%d %s", status, http.StatusText(status))
+				}
+				if !r.Accepted {
+					rejected++
+				}
+				results = append(results, r)
+			}
+
+			if cfg.jsonOutput() {
+				if err := printJSON(results); err != nil {
+					return err
+				}
+			} else {
+				rows := make([][]string, 0, len(results))
+				for _, r := range results {
+					rows = append(rows, []string{r.Service, yesNo(r.Accepted), r.Detail})
+				}
+				if err := printTable([]string{"SERVICE", "ACCEPTED", "DETAIL"}, rows); err != nil {
+					return err
+				}
+			}
+			if rejected > 0 {
+				return fmt.Errorf("credentials not accepted by %d of %d services", rejected, len(results))
+			}
+			return nil
+		},
+	}
+
+	cmd.AddCommand(generate, verify)
+	return cmd
+}
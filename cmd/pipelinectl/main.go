@@ -0,0 +1,69 @@
+// Command pipelinectl is an operator CLI for the monitoring pipeline. It talks
+// to the gateway and services over their HTTP APIs, so anything it does can
+// also be done with curl.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// version is set at build time via -ldflags "-X main.version=...".
+var version = "1.0.0"
+
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	cfg := &config{}
+
+	root := &cobra.Command{
+		Use:          "pipelinectl",
+		Short:        "Operate the microservice monitoring pipeline",
+		Version:      version,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if cfg.Output != "table" && cfg.Output != "json" {
+				return fmt.Errorf("--output must be table or json")
+			}
+			return nil
+		},
+	}
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&cfg.GatewayURL, "gateway", envOr("PIPELINE_GATEWAY_URL", "http://localhost:8090"), "API gateway base URL")
+	flags.StringVar(&cfg.BusinessURL, "business", envOr("PIPELINE_BUSINESS_URL", "http://localhost:8081"), "business-service base URL")
+	flags.StringVar(&cfg.DataURL, "data", envOr("PIPELINE_DATA_URL", "http://localhost:8082"), "data-service base URL")
+	flags.StringVar(&cfg.RollupURL, "rollup", envOr("PIPELINE_ROLLUP_URL", "http://localhost:8085"), "rollup-service base URL")
+	flags.StringVar(&cfg.Token, "token", os.Getenv("PIPELINE_TOKEN"), "bearer token for protected endpoints (endpoint_protection.bearer_token)")
+	flags.StringVar(&cfg.BasicAuth, "basic-auth", os.Getenv("PIPELINE_BASIC_AUTH"), "user:password for protected endpoints (endpoint_protection.basic_auth)")
+	flags.StringVar(&cfg.Priority, "priority", os.Getenv("PIPELINE_PRIORITY"), "X-Request-Priority to send: high, normal or low")
+	flags.DurationVar(&cfg.Timeout, "timeout", 30*time.Second, "per-request timeout")
+	flags.StringVarP(&cfg.Output, "output", "o", "table", "output format: table or json")
+
+	root.AddCommand(
+		newOrdersCommand(cfg),
+		newRecordsCommand(cfg),
+		newJobsCommand(cfg),
+		newHealthCommand(cfg),
+		newStatusCommand(cfg),
+		newChangesCommand(cfg),
+		newKeysCommand(cfg),
+		newSimulateCommand(cfg),
+		newSnapshotsCommand(cfg),
+	)
+	return root
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// order mirrors business-service's OrderV2.
+type order struct {
+	ID         string    `json:"id"`
+	Product    string    `json:"product"`
+	Quantity   int       `json:"quantity"`
+	PriceCents int64     `json:"price_cents"`
+	TotalCents int64     `json:"total_cents,omitempty"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func newOrdersCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "orders",
+		Aliases: []string{"order"},
+		Short:   "List, create and manage business-service orders",
+	}
+
+	var status string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List orders, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{"limit": {"1000"}}
+			if status != "" {
+				query.Set("status", status)
+			}
+			orders, err := listAll[order](cfg, cfg.BusinessURL, "/api/v2/orders?"+query.Encode())
+			if err != nil {
+				return err
+			}
+			sort.Slice(orders, func(i, j int) bool { return orders[i].CreatedAt.After(orders[j].CreatedAt) })
+			if cfg.jsonOutput() {
+				return printJSON(orders)
+			}
+			return printOrders(orders...)
+		},
+	}
+	list.Flags().StringVar(&status, "status", "", "only show orders with this status")
+
+	get := &cobra.Command{
+		Use:   "get ID",
+		Short: "Show one order",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var o order
+			if err := cfg.resource("GET", cfg.BusinessURL, "/api/v2/orders/"+args[0], nil, &o); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(o)
+			}
+			return printOrders(o)
+		},
+	}
+
+	var product string
+	var quantity int
+	var price float64
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Create an order; waits while the service processes it",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var o order
+			body := order{Product: product, Quantity: quantity, PriceCents: int64(math.Round(price * 100))}
+			if err := cfg.resource("POST", cfg.BusinessURL, "/api/v2/orders", body, &o); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(o)
+			}
+			return printOrders(o)
+		},
+	}
+	create.Flags().StringVar(&product, "product", "", "product name")
+	create.Flags().IntVar(&quantity, "quantity", 1, "quantity")
+	create.Flags().Float64Var(&price, "price", 0, "unit price")
+	create.MarkFlagRequired("product")
+	create.MarkFlagRequired("price")
+
+	update := &cobra.Command{
+		Use:   "set-status ID STATUS",
+		Short: "Change an order's status",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var o order
+			body := map[string]string{"status": args[1]}
+			if err := cfg.resource("PUT", cfg.BusinessURL, "/api/v2/orders/"+args[0], body, &o); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(o)
+			}
+			return printOrders(o)
+		},
+	}
+
+	del := &cobra.Command{
+		Use:   "delete ID",
+		Short: "Delete an order",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.call("DELETE", cfg.BusinessURL, "/api/v2/orders/"+args[0], nil, nil); err != nil {
+				return err
+			}
+			fmt.Printf("Order %s deleted\n", args[0])
+			return nil
+		},
+	}
+
+	cmd.AddCommand(list, get, create, update, del)
+	return cmd
+}
+
+func printOrders(orders ...order) error {
+	rows := make([][]string, 0, len(orders))
+	for _, o := range orders {
+		rows = append(rows, []string{
+			o.ID,
+			o.Product,
+			strconv.Itoa(o.Quantity),
+			strconv.FormatFloat(float64(o.PriceCents)/100, 'f', 2, 64),
+			o.Status,
+			formatTime(o.CreatedAt),
+		})
+	}
+	return printTable([]string{"ID", "PRODUCT", "QTY", "PRICE", "STATUS", "CREATED"}, rows)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// record mirrors data-service's DataRecord.
+type record struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	Data        map[string]string `json:"data"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Processed   bool              `json:"processed"`
+	ProcessedAt *time.Time        `json:"processed_at,omitempty"`
+	Sequence    uint64            `json:"seq,omitempty"`
+	TraceID     string            `json:"trace_id,omitempty"`
+	JobID       string            `json:"job_id,omitempty"`
+}
+
+type recordTypeStats struct {
+	Type                  string  `json:"type"`
+	Total                 int64   `json:"total"`
+	Pending               int64   `json:"pending"`
+	Processed             int64   `json:"processed"`
+	ProcessingRate        float64 `json:"processing_rate_per_second"`
+	AvgProcessingDuration float64 `json:"avg_processing_duration_seconds"`
+	OldestPendingAge      string  `json:"oldest_pending_age"`
+}
+
+func newRecordsCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "records",
+		Aliases: []string{"record"},
+		Short:   "List, create and inspect data-service records",
+	}
+
+	var recordType string
+	var pending bool
+	var limit int
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List records, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{"limit": {"1000"}}
+			if recordType != "" {
+				query.Set("type", recordType)
+			}
+			if pending {
+				query.Set("processed", "false")
+			}
+			records, err := listAll[record](cfg, cfg.DataURL, "/api/v2/records?"+query.Encode())
+			if err != nil {
+				return err
+			}
+			sort.Slice(records, func(i, j int) bool { return records[i].Timestamp.After(records[j].Timestamp) })
+			if limit > 0 && len(records) > limit {
+				records = records[:limit]
+			}
+			if cfg.jsonOutput() {
+				return printJSON(records)
+			}
+			return printRecords(records...)
+		},
+	}
+	list.Flags().StringVar(&recordType, "type", "", "only show records of this type")
+	list.Flags().BoolVar(&pending, "pending", false, "only show unprocessed records")
+	list.Flags().IntVar(&limit, "limit", 50, "maximum records to show, 0 for all")
+
+	get := &cobra.Command{
+		Use:   "get ID",
+		Short: "Show one record with its data",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var r record
+			if err := cfg.resource("GET", cfg.DataURL, "/api/v2/records/"+args[0], nil, &r); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(r)
+			}
+			if err := printRecords(r); err != nil {
+				return err
+			}
+			return printData(r.Data)
+		},
+	}
+
+	var createType string
+	var data []string
+	create := &cobra.Command{
+		Use:   "create",
+		Short: "Create a record",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body := record{Type: createType, Data: make(map[string]string)}
+			for _, kv := range data {
+				key, value, ok := strings.Cut(kv, "=")
+				if !ok {
+					return fmt.Errorf("invalid --data %q, use key=value", kv)
+				}
+				body.Data[key] = value
+			}
+			var r record
+			if err := cfg.resource("POST", cfg.DataURL, "/api/v2/records", body, &r); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(r)
+			}
+			return printRecords(r)
+		},
+	}
+	create.Flags().StringVar(&createType, "type", "", "record type, e.g. user_event")
+	create.Flags().StringArrayVar(&data, "data", nil, "data field as key=value; repeatable")
+	create.MarkFlagRequired("type")
+
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "Show per-type totals, backlog and processing rates",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp struct {
+				Types []recordTypeStats `json:"types"`
+			}
+			if err := cfg.call("GET", cfg.DataURL, "/api/v2/records/stats", nil, &resp); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(resp.Types)
+			}
+			rows := make([][]string, 0, len(resp.Types))
+			for _, s := range resp.Types {
+				oldest := s.OldestPendingAge
+				if oldest == "" {
+					oldest = "-"
+				}
+				rows = append(rows, []string{
+					s.Type,
+					strconv.FormatInt(s.Total, 10),
+					strconv.FormatInt(s.Pending, 10),
+					strconv.FormatInt(s.Processed, 10),
+					strconv.FormatFloat(s.ProcessingRate, 'f', 2, 64),
+					oldest,
+				})
+			}
+			return printTable([]string{"TYPE", "TOTAL", "PENDING", "PROCESSED", "RATE/S", "OLDEST PENDING"}, rows)
+		},
+	}
+
+	var selector struct {
+		Type       string `json:"type,omitempty"`
+		From       string `json:"from,omitempty"`
+		To         string `json:"to,omitempty"`
+		FailedOnly bool   `json:"failed_only,omitempty"`
+		Priority   int    `json:"priority,omitempty"`
+	}
+	var wait bool
+	var waitTimeout time.Duration
+	reprocess := &cobra.Command{
+		Use:   "reprocess",
+		Short: "Reset matching records to pending and process them again in a job",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var j job
+			if err := cfg.resource("POST", cfg.DataURL, "/api/v1/records/reprocess", selector, &j); err != nil {
+				return err
+			}
+			if wait {
+				if err := waitForJob(cfg, &j, waitTimeout); err != nil {
+					return err
+				}
+			}
+			if cfg.jsonOutput() {
+				return printJSON(j)
+			}
+			return printJobs(j)
+		},
+	}
+	reprocess.Flags().StringVar(&selector.Type, "type", "", "only reprocess records of this type")
+	reprocess.Flags().StringVar(&selector.From, "from", "", "only reprocess records from this RFC 3339 time on")
+	reprocess.Flags().StringVar(&selector.To, "to", "", "only reprocess records up to this RFC 3339 time")
+	reprocess.Flags().BoolVar(&selector.FailedOnly, "failed-only", false, "only reprocess records whose processing failed")
+	reprocess.Flags().IntVar(&selector.Priority, "priority", 0, "job priority, see jobs run --priority")
+	reprocess.Flags().BoolVar(&wait, "wait", false, "wait for the job to finish")
+	reprocess.Flags().DurationVar(&waitTimeout, "wait-timeout", 30*time.Minute, "how long --wait waits")
+
+	var spec struct {
+		Count        int            `json:"count,omitempty"`
+		Rate         float64        `json:"rate,omitempty"`
+		Types        map[string]int `json:"types,omitempty"`
+		PayloadBytes int            `json:"payload_bytes,omitempty"`
+		TimeSkew     string         `json:"time_skew,omitempty"`
+		Profile      string         `json:"profile,omitempty"`
+		Seed         *int64         `json:"seed,omitempty"`
+		Priority     int            `json:"priority,omitempty"`
+	}
+	var generateSeed int64
+	var generateWait bool
+	var generateWaitTimeout time.Duration
+	generate := &cobra.Command{
+		Use:   "generate",
+		Short: "Create test records in a job",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed("seed") {
+				spec.Seed = &generateSeed
+			}
+			var j job
+			if err := cfg.resource("POST", cfg.DataURL, "/api/v1/generate", spec, &j); err != nil {
+				return err
+			}
+			if generateWait {
+				if err := waitForJob(cfg, &j, generateWaitTimeout); err != nil {
+					return err
+				}
+			}
+			if cfg.jsonOutput() {
+				return printJSON(j)
+			}
+			return printJobs(j)
+		},
+	}
+	generate.Flags().IntVar(&spec.Count, "count", 0, "records to create (default 50)")
+	generate.Flags().Float64Var(&spec.Rate, "rate", 0, "records per second (default 10)")
+	generate.Flags().StringToIntVar(&spec.Types, "type", nil, "record type and its relative weight, repeatable, e.g. --type metric=3")
+	generate.Flags().IntVar(&spec.PayloadBytes, "payload-bytes", 0, "size of a random payload field")
+	generate.Flags().StringVar(&spec.TimeSkew, "time-skew", "", "spread record timestamps over this period before their creation (default 1h)")
+	generate.Flags().StringVar(&spec.Profile, "profile", "", "workload profile shaping the rate over time, e.g. diurnal, bursty or error-storm")
+	generate.Flags().Int64Var(&generateSeed, "seed", 0, "create the same records as an earlier job with this seed (default random, shown in the job's generate field)")
+	generate.Flags().IntVar(&spec.Priority, "priority", 0, "job priority, see jobs run --priority")
+	generate.Flags().BoolVar(&generateWait, "wait", false, "wait for the job to finish")
+	generate.Flags().DurationVar(&generateWaitTimeout, "wait-timeout", 30*time.Minute, "how long --wait waits")
+
+	cmd.AddCommand(list, get, create, stats, reprocess, generate)
+	return cmd
+}
+
+func printRecords(records ...record) error {
+	rows := make([][]string, 0, len(records))
+	for _, r := range records {
+		status := "pending"
+		if r.Processed {
+			status = "processed"
+		}
+		rows = append(rows, []string{r.ID, r.Type, status, formatTime(r.Timestamp)})
+	}
+	return printTable([]string{"ID", "TYPE", "STATUS", "TIMESTAMP"}, rows)
+}
+
+func printData(data map[string]string) error {
+	if len(data) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []string{k, data[k]})
+	}
+	fmt.Println()
+	return printTable([]string{"FIELD", "VALUE"}, rows)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newSimulateCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Generate demo load (protected endpoints; pass --token if configured)",
+	}
+
+	var orderRuns, orderCount int
+	var orderRate float64
+	var orderSeed int64
+	var orderProfile string
+	orders := &cobra.Command{
+		Use:   "orders",
+		Short: "Start business-service simulations of 10 orders each",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			body := simulationBody(cmd, orderSeed, orderProfile)
+			if orderCount > 0 {
+				body["count"] = orderCount
+			}
+			if orderRate > 0 {
+				body["rate"] = orderRate
+			}
+			return simulate(cfg, cfg.BusinessURL, "/api/v1/simulate", orderRuns, body)
+		},
+	}
+	orders.Flags().IntVar(&orderRuns, "runs", 1, "number of simulations to start")
+	orders.Flags().IntVar(&orderCount, "count", 0, "orders per simulation (default 10)")
+	orders.Flags().Float64Var(&orderRate, "rate", 0, "orders per second (default 1)")
+	orders.Flags().StringVar(&orderProfile, "profile", "", "workload profile shaping the rate over time, e.g. diurnal, bursty or error-storm")
+	orders.Flags().Int64Var(&orderSeed, "seed", 0, "create the same orders as an earlier simulation with this seed")
+
+	var dataRuns int
+	var dataSeed int64
+	var dataProfile string
+	records := &cobra.Command{
+		Use:   "records",
+		Short: "Start data-service generators of 50 test records each",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jobs := make([]job, 0, dataRuns)
+			for i := 0; i < dataRuns; i++ {
+				var j job
+				if err := cfg.resource("POST", cfg.DataURL, "/api/v1/generate", simulationBody(cmd, dataSeed, dataProfile), &j); err != nil {
+					return err
+				}
+				jobs = append(jobs, j)
+			}
+			if cfg.jsonOutput() {
+				return printJSON(jobs)
+			}
+			return printJobs(jobs...)
+		},
+	}
+	records.Flags().IntVar(&dataRuns, "runs", 1, "number of generators to start")
+	records.Flags().StringVar(&dataProfile, "profile", "", "workload profile shaping the rate over time, e.g. diurnal, bursty or error-storm")
+	records.Flags().Int64Var(&dataSeed, "seed", 0, "create the same records as an earlier generator with this seed")
+
+	cmd.AddCommand(orders, records)
+	return cmd
+}
+
+// simulationBody is the request body that passes --seed and --profile on,
+// if they were given.
+func simulationBody(cmd *cobra.Command, seed int64, profile string) map[string]interface{} {
+	body := map[string]interface{}{}
+	if cmd.Flags().Changed("seed") {
+		body["seed"] = seed
+	}
+	if profile != "" {
+		body["profile"] = profile
+	}
+	return body
+}
+
+func simulate(cfg *config, base, path string, runs int, body map[string]interface{}) error {
+	results := make([]map[string]string, 0, runs)
+	for i := 0; i < runs; i++ {
+		var resp map[string]string
+		if err := cfg.call("POST", base, path, body, &resp); err != nil {
+			return err
+		}
+		results = append(results, resp)
+	}
+	if cfg.jsonOutput() {
+		return printJSON(results)
+	}
+	for _, r := range results {
+		switch {
+		case r["profile"] != "":
+			fmt.Printf("%s (simulation %s, seed %s, profile %s)\n", r["message"], r["simulation_id"], r["seed"], r["profile"])
+		case r["seed"] != "":
+			fmt.Printf("%s (simulation %s, seed %s)\n", r["message"], r["simulation_id"], r["seed"])
+		case r["simulation_id"] != "":
+			fmt.Printf("%s (simulation %s)\n", r["message"], r["simulation_id"])
+		default:
+			fmt.Println(r["message"])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// snapshotInfo holds the fields the services' snapshot descriptions share.
+type snapshotInfo struct {
+	CreatedAt time.Time `json:"created_at"`
+	Orders    *int      `json:"orders,omitempty"`
+	Records   *int      `json:"records,omitempty"`
+	Jobs      *int      `json:"jobs,omitempty"`
+}
+
+// pipelineSnapshot mirrors an entry of the gateway's GET /admin/snapshots.
+type pipelineSnapshot struct {
+	Name     string                  `json:"name"`
+	Complete bool                    `json:"complete"`
+	Services map[string]snapshotInfo `json:"services"`
+}
+
+// snapshotResult mirrors the gateway's answer to a snapshot operation.
+type snapshotResult struct {
+	Name     string `json:"name"`
+	Services map[string]struct {
+		Status int             `json:"status"`
+		Result json.RawMessage `json:"result,omitempty"`
+		Error  string          `json:"error,omitempty"`
+	} `json:"services"`
+}
+
+func newSnapshotsCommand(cfg *config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "snapshots",
+		Aliases: []string{"snapshot"},
+		Short:   "Save and restore the state of every service through the gateway",
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List snapshots",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var snapshots []pipelineSnapshot
+			if err := cfg.call("GET", cfg.GatewayURL, "/admin/snapshots", nil, &snapshots); err != nil {
+				return err
+			}
+			if cfg.jsonOutput() {
+				return printJSON(snapshots)
+			}
+			return printSnapshots(snapshots)
+		},
+	}
+
+	operation := func(use, short, method, suffix string) *cobra.Command {
+		return &cobra.Command{
+			Use:   use + " NAME",
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				var result snapshotResult
+				if err := cfg.call(method, cfg.GatewayURL, "/admin/snapshots/"+args[0]+suffix, nil, &result); err != nil {
+					return err
+				}
+				if cfg.jsonOutput() {
+					return printJSON(result)
+				}
+				rows := [][]string{}
+				for service, res := range result.Services {
+					rows = append(rows, []string{service, strconv.Itoa(res.Status), string(res.Result)})
+				}
+				sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+				return printTable([]string{"SERVICE", "STATUS", "RESULT"}, rows)
+			},
+		}
+	}
+
+	cmd.AddCommand(
+		list,
+		operation("save", "Save the current state under NAME, replacing an older snapshot", "PUT", ""),
+		operation("restore", "Reset every service to snapshot NAME", "POST", "/restore"),
+		operation("delete", "Delete snapshot NAME", "DELETE", ""),
+	)
+	return cmd
+}
+
+func printSnapshots(snapshots []pipelineSnapshot) error {
+	rows := make([][]string, 0, len(snapshots))
+	for _, s := range snapshots {
+		var created time.Time
+		var contents []string
+		services := make([]string, 0, len(s.Services))
+		for service := range s.Services {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		for _, service := range services {
+			info := s.Services[service]
+			if created.IsZero() || info.CreatedAt.Before(created) {
+				created = info.CreatedAt
+			}
+			for _, count := range []struct {
+				n    *int
+				name string
+			}{{info.Orders, "orders"}, {info.Records, "records"}, {info.Jobs, "jobs"}} {
+				if count.n != nil {
+					contents = append(contents, fmt.Sprintf("%d %s", *count.n, count.name))
+				}
+			}
+		}
+		rows = append(rows, []string{s.Name, strconv.FormatBool(s.Complete), formatTime(created), strings.Join(contents, ", ")})
+	}
+	return printTable([]string{"NAME", "COMPLETE", "CREATED", "CONTENTS"}, rows)
+}
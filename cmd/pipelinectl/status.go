@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// pipelineStatus mirrors the gateway's GET /api/v1/pipeline/status.
+type pipelineStatus struct {
+	Status     string   `json:"status"`
+	Reasons    []string `json:"reasons"`
+	Components []struct {
+		Name    string   `json:"name"`
+		Status  string   `json:"status"`
+		Reasons []string `json:"reasons"`
+	} `json:"components"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+func newStatusCommand(cfg *config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the gateway's green, yellow or red summary of the pipeline",
+		Long: "Show the gateway's green, yellow or red summary of the pipeline, by\n" +
+			"component with the reasons. Exits non-zero when the pipeline is red.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var status pipelineStatus
+			if err := cfg.resource("GET", cfg.GatewayURL, "/api/v1/pipeline/status", nil, &status); err != nil {
+				return err
+			}
+
+			if cfg.jsonOutput() {
+				if err := printJSON(status); err != nil {
+					return err
+				}
+			} else {
+				fmt.Printf("Pipeline is %s (as of %s)\n\n", strings.ToUpper(status.Status), status.GeneratedAt.Local().Format(time.RFC3339))
+				rows := make([][]string, 0, len(status.Components))
+				for _, c := range status.Components {
+					rows = append(rows, []string{c.Name, c.Status, strings.Join(c.Reasons, "; ")})
+				}
+				if err := printTable([]string{"COMPONENT", "STATUS", "REASONS"}, rows); err != nil {
+					return err
+				}
+			}
+			if status.Status == "red" {
+				return fmt.Errorf("pipeline is red")
+			}
+			return nil
+		},
+	}
+}
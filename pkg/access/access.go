@@ -0,0 +1,173 @@
+// Package access protects operational endpoints (metrics, admin APIs) with
+// optional credentials and an IP allowlist.
+package access
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Config describes how protected endpoints are guarded. Any combination of
+// the options may be set; with none set the middleware lets requests through.
+type Config struct {
+	BasicUsername string
+	BasicPassword string
+	BearerToken   string
+	// AllowedIPs accepts single addresses and CIDR ranges.
+	AllowedIPs []string
+	// TrustedProxies are the proxies, single addresses or CIDR ranges, whose
+	// X-Forwarded-For entries are believed; see ClientIP.
+	TrustedProxies []string
+}
+
+// Guard enforces a Config on wrapped handlers.
+type Guard struct {
+	cfg      Config
+	networks []*net.IPNet
+	proxies  []*net.IPNet
+}
+
+func NewGuard(cfg Config) (*Guard, error) {
+	networks, err := ParseNetworks(cfg.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed ip: %w", err)
+	}
+	proxies, err := ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &Guard{cfg: cfg, networks: networks, proxies: proxies}, nil
+}
+
+// ParseNetworks parses single addresses and CIDR ranges, skipping blanks.
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains reports whether ip is in one of networks.
+func Contains(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether any protection is configured.
+func (g *Guard) Enabled() bool {
+	return len(g.networks) > 0 || g.cfg.BearerToken != "" || g.cfg.BasicUsername != ""
+}
+
+// Wrap returns next guarded by the configured checks. The IP allowlist is
+// checked first; when both credential types are configured either is accepted.
+func (g *Guard) Wrap(next http.Handler) http.Handler {
+	if !g.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(g.networks) > 0 && !g.ipAllowed(ClientIP(r, g.proxies)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !g.authorized(r) {
+			if g.cfg.BasicUsername != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WrapFunc is Wrap for plain handler functions.
+func (g *Guard) WrapFunc(next http.HandlerFunc) http.Handler {
+	return g.Wrap(next)
+}
+
+func (g *Guard) authorized(r *http.Request) bool {
+	if g.cfg.BearerToken == "" && g.cfg.BasicUsername == "" {
+		return true
+	}
+
+	if g.cfg.BearerToken != "" {
+		auth := r.Header.Get("Authorization")
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok && secureEqual(token, g.cfg.BearerToken) {
+			return true
+		}
+	}
+
+	if g.cfg.BasicUsername != "" {
+		if user, pass, ok := r.BasicAuth(); ok &&
+			secureEqual(user, g.cfg.BasicUsername) && secureEqual(pass, g.cfg.BasicPassword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Guard) ipAllowed(ip net.IP) bool {
+	return Contains(g.networks, ip)
+}
+
+// ClientIP returns the caller's IP. When the request comes from one of
+// trustedProxies, X-Forwarded-For is walked from the right, since each proxy
+// appends the address it received the request from, and the first address
+// that is not a trusted proxy is the client. Entries further left were sent
+// by the client and are never believed.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !Contains(trustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A malformed entry was not written by a trusted proxy.
+			return ip
+		}
+		ip = hop
+		if !Contains(trustedProxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,100 @@
+package access
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", " 192.168.1.7 ", "", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.20.30.40": true,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+		"::1":         true,
+		"11.0.0.1":    false,
+	} {
+		if got := Contains(networks, net.ParseIP(ip)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	if Contains(networks, nil) {
+		t.Error("Contains matched a nil IP")
+	}
+	if _, err := ParseNetworks([]string{"not-an-ip"}); err == nil {
+		t.Error("ParseNetworks accepted an invalid entry")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote, xff string
+		proxies     []*net.IPNet
+		want        string
+	}{
+		{"10.1.2.3:4000", "203.0.113.9", nil, "10.1.2.3"},
+		{"10.1.2.3:4000", "203.0.113.9", proxies, "203.0.113.9"},
+		// Through two trusted proxies.
+		{"10.1.2.3:4000", "203.0.113.9, 10.4.5.6", proxies, "203.0.113.9"},
+		// A spoofed left-most entry: the proxy appended the real address.
+		{"10.1.2.3:4000", "192.168.1.7, 198.51.100.20", proxies, "198.51.100.20"},
+		// A client that is not a trusted proxy cannot set the header.
+		{"198.51.100.20:4000", "192.168.1.7", proxies, "198.51.100.20"},
+		{"10.1.2.3:4000", "", proxies, "10.1.2.3"},
+		{"10.1.2.3:4000", "203.0.113.9, garbage", proxies, "10.1.2.3"},
+		// Only proxies in the chain: the left-most of them.
+		{"10.1.2.3:4000", "10.9.9.9, 10.4.5.6", proxies, "10.9.9.9"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := ClientIP(r, tc.proxies).String(); got != tc.want {
+			t.Errorf("ClientIP(%s, %q, %d proxies) = %s, want %s", tc.remote, tc.xff, len(tc.proxies), got, tc.want)
+		}
+	}
+
+	// Several X-Forwarded-For headers count as one list.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Add("X-Forwarded-For", "192.168.1.7")
+	r.Header.Add("X-Forwarded-For", "198.51.100.20")
+	if got := ClientIP(r, proxies).String(); got != "198.51.100.20" {
+		t.Errorf("ClientIP over two headers = %s", got)
+	}
+}
+
+func TestGuardIgnoresSpoofedForwardedFor(t *testing.T) {
+	g, err := NewGuard(Config{AllowedIPs: []string{"192.168.1.7"}, TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := g.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Set("X-Forwarded-For", "192.168.1.7, 198.51.100.20")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("spoofed allowlisted address got %d", w.Code)
+	}
+
+	r.Header.Set("X-Forwarded-For", "192.168.1.7")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("allowlisted address behind the proxy got %d", w.Code)
+	}
+}
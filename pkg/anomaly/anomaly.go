@@ -0,0 +1,225 @@
+// Package anomaly flags unusual values of a sampled signal, such as a sudden
+// drop in order throughput or a spike in pending records, by comparing each
+// sample with an exponentially weighted moving average (EWMA) of the signal
+// and its variance. The z-score of the sample in the watched direction is
+// exported as pipeline_anomaly_score{signal} and Notifiers are told when a
+// signal becomes and stops being anomalous.
+package anomaly
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scoreGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_anomaly_score",
+			Help: "Deviation of the latest sample from the signal's moving average in standard deviations, in the watched direction",
+		},
+		[]string{"signal"},
+	)
+	valueGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_anomaly_signal_value",
+			Help: "Latest sampled value of each anomaly signal",
+		},
+		[]string{"signal"},
+	)
+	anomaliesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_anomalies_total",
+			Help: "Times a signal became anomalous",
+		},
+		[]string{"signal"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(scoreGauge, valueGauge, anomaliesTotal)
+}
+
+// Direction selects which deviations count as anomalous.
+type Direction string
+
+const (
+	// Up flags spikes, e.g. a growing backlog.
+	Up Direction = "up"
+	// Down flags drops, e.g. falling throughput.
+	Down Direction = "down"
+	// Both flags either.
+	Both Direction = "both"
+)
+
+// Config configures a Detector.
+type Config struct {
+	// Signal names the series in metrics and notifications.
+	Signal    string
+	Direction Direction
+	// Alpha is the EWMA smoothing factor in (0, 1]; smaller values remember
+	// more history.
+	Alpha float64
+	// Threshold is the score at which a sample is anomalous.
+	Threshold float64
+	// MinSamples is how many samples are needed before anything is flagged.
+	MinSamples int
+	// MinStdDev keeps a flat signal from making every small change look
+	// anomalous.
+	MinStdDev float64
+}
+
+// Anomaly describes a state change of a signal.
+type Anomaly struct {
+	Signal    string    `json:"signal"`
+	Direction Direction `json:"direction"`
+	Value     float64   `json:"value"`
+	Mean      float64   `json:"mean"`
+	StdDev    float64   `json:"stddev"`
+	Score     float64   `json:"score"`
+	Threshold float64   `json:"threshold"`
+	// Resolved is set when the signal returns to normal.
+	Resolved bool      `json:"resolved"`
+	Since    time.Time `json:"since"`
+	At       time.Time `json:"at"`
+}
+
+// Detector keeps the moving statistics of one signal.
+type Detector struct {
+	cfg Config
+
+	mu        sync.Mutex
+	samples   int
+	mean      float64
+	variance  float64
+	anomalous bool
+	since     time.Time
+}
+
+func NewDetector(cfg Config) *Detector {
+	if cfg.Direction == "" {
+		cfg.Direction = Both
+	}
+	if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+		cfg.Alpha = 0.1
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = 10
+	}
+	scoreGauge.WithLabelValues(cfg.Signal).Set(0)
+	return &Detector{cfg: cfg}
+}
+
+// Observe scores value against the history, then folds it in. It returns a
+// non-nil Anomaly when the signal becomes anomalous or recovers.
+func (d *Detector) Observe(value float64, at time.Time) *Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	valueGauge.WithLabelValues(d.cfg.Signal).Set(value)
+
+	if d.samples == 0 {
+		d.mean = value
+	}
+	stddev := math.Max(math.Sqrt(d.variance), d.cfg.MinStdDev)
+
+	score := 0.0
+	if d.samples >= d.cfg.MinSamples && stddev > 0 {
+		z := (value - d.mean) / stddev
+		switch d.cfg.Direction {
+		case Up:
+			score = math.Max(z, 0)
+		case Down:
+			score = math.Max(-z, 0)
+		default:
+			score = math.Abs(z)
+		}
+	}
+	scoreGauge.WithLabelValues(d.cfg.Signal).Set(score)
+
+	result := Anomaly{
+		Signal:    d.cfg.Signal,
+		Direction: d.cfg.Direction,
+		Value:     value,
+		Mean:      d.mean,
+		StdDev:    stddev,
+		Score:     score,
+		Threshold: d.cfg.Threshold,
+		At:        at,
+	}
+
+	// EWMA of mean and variance (Welford-style incremental form).
+	diff := value - d.mean
+	incr := d.cfg.Alpha * diff
+	d.mean += incr
+	d.variance = (1 - d.cfg.Alpha) * (d.variance + diff*incr)
+	d.samples++
+
+	anomalous := score >= d.cfg.Threshold
+	if anomalous == d.anomalous {
+		return nil
+	}
+	d.anomalous = anomalous
+	if anomalous {
+		d.since = at
+		anomaliesTotal.WithLabelValues(d.cfg.Signal).Inc()
+	}
+	result.Resolved = !anomalous
+	result.Since = d.since
+	return &result
+}
+
+// Anomalous reports whether the last sample was anomalous.
+func (d *Detector) Anomalous() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.anomalous
+}
+
+// Notifier is told about anomaly state changes.
+type Notifier interface {
+	Notify(ctx context.Context, a Anomaly) error
+}
+
+// DefaultInterval is used by Run when no positive interval is given.
+const DefaultInterval = time.Minute
+
+// Run samples the signal every interval until ctx is done and passes state
+// changes to the notifiers. Sample errors skip the tick.
+func (d *Detector) Run(ctx context.Context, interval time.Duration, sample func() (float64, error), notifiers []Notifier, onError func(error)) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			value, err := sample()
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			a := d.Observe(value, now)
+			if a == nil {
+				continue
+			}
+			for _, n := range notifiers {
+				if err := n.Notify(ctx, *a); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestObserveFlagsAndResolves(t *testing.T) {
+	d := NewDetector(Config{Signal: "test_observe", Direction: Up, Threshold: 3, MinSamples: 5, MinStdDev: 1})
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if a := d.Observe(10, at.Add(time.Duration(i)*time.Minute)); a != nil {
+			t.Fatalf("steady sample %d flagged: %+v", i, a)
+		}
+	}
+	if a := d.Observe(2, at.Add(5*time.Minute)); a != nil {
+		t.Errorf("drop flagged while watching for spikes: %+v", a)
+	}
+	a := d.Observe(50, at.Add(6*time.Minute))
+	if a == nil || a.Resolved || a.Score < 3 || !d.Anomalous() {
+		t.Fatalf("spike not flagged: %+v", a)
+	}
+	if again := d.Observe(60, at.Add(7*time.Minute)); again != nil {
+		t.Errorf("ongoing anomaly reported twice: %+v", again)
+	}
+	resolved := d.Observe(d.mean, at.Add(8*time.Minute))
+	if resolved == nil || !resolved.Resolved || !resolved.Since.Equal(at.Add(6*time.Minute)) {
+		t.Errorf("recovery = %+v", resolved)
+	}
+}
+
+func TestObserveWaitsForMinSamples(t *testing.T) {
+	d := NewDetector(Config{Signal: "test_min_samples", MinSamples: 3})
+	for i, v := range []float64{1, 100, 1} {
+		if a := d.Observe(v, time.Now()); a != nil {
+			t.Errorf("sample %d flagged before min_samples: %+v", i, a)
+		}
+	}
+}
+
+func TestRunDefaultsNonPositiveInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewDetector(Config{Signal: "test_interval"}).Run(ctx, 0, func() (float64, error) { return 0, nil }, nil, nil)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+func TestStartNotifiesWebhook(t *testing.T) {
+	received := make(chan Anomaly, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Service string  `json:"service"`
+			Anomaly Anomaly `json:"anomaly"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Service != "test-service" {
+			t.Errorf("webhook body for %q: %v", body.Service, err)
+		}
+		received <- body.Anomaly
+	}))
+	defer server.Close()
+
+	v := viper.New()
+	v.Set("anomaly.interval", "5ms")
+	v.Set("anomaly.min_samples", 3)
+	v.Set("anomaly.min_stddev", 1)
+	v.Set("anomaly.notify.webhook_url", server.URL)
+
+	var calls atomic.Int64
+	stop := Start(v, "test-service", "test_start", Up, func() (float64, error) {
+		if calls.Add(1) > 5 {
+			return 1000, nil
+		}
+		return 10, nil
+	})
+	defer stop()
+
+	select {
+	case a := <-received:
+		if a.Signal != "test_start" || a.Resolved || a.Value != 1000 {
+			t.Errorf("notified %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not notified")
+	}
+}
+
+func TestRateOf(t *testing.T) {
+	var n atomic.Int64
+	sample := RateOf(n.Load)
+	n.Add(50)
+	time.Sleep(10 * time.Millisecond)
+	rate, err := sample()
+	if err != nil || rate <= 0 || rate > 5000 {
+		t.Errorf("rate = %v, %v", rate, err)
+	}
+	if rate, _ := sample(); rate != 0 {
+		t.Errorf("rate without new events = %v", rate)
+	}
+}
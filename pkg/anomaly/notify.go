@@ -0,0 +1,96 @@
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AlertmanagerNotifier posts anomalies to the Alertmanager v2 API, so they are
+// routed and silenced like the Prometheus alerts. Recoveries are sent with
+// endsAt set, which resolves the alert.
+type AlertmanagerNotifier struct {
+	URL     string
+	Service string
+	// Severity labels the alert; "warning" by default.
+	Severity string
+	Client   *http.Client
+}
+
+func (n AlertmanagerNotifier) Notify(ctx context.Context, a Anomaly) error {
+	severity := n.Severity
+	if severity == "" {
+		severity = "warning"
+	}
+	alert := map[string]interface{}{
+		"labels": map[string]string{
+			"alertname": "PipelineAnomaly",
+			"signal":    a.Signal,
+			"service":   n.Service,
+			"severity":  severity,
+		},
+		"annotations": map[string]string{
+			"summary":     fmt.Sprintf("Anomalous %s on %s", a.Signal, n.Service),
+			"description": description(a),
+		},
+		"startsAt": a.Since.UTC().Format(time.RFC3339),
+	}
+	if a.Resolved {
+		alert["endsAt"] = a.At.UTC().Format(time.RFC3339)
+	}
+	return postJSON(ctx, n.Client, strings.TrimRight(n.URL, "/")+"/api/v2/alerts", []interface{}{alert})
+}
+
+// WebhookNotifier posts the Anomaly as JSON to URL, e.g. a chat or paging
+// integration.
+type WebhookNotifier struct {
+	URL     string
+	Service string
+	Client  *http.Client
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, a Anomaly) error {
+	return postJSON(ctx, n.Client, n.URL, map[string]interface{}{
+		"service": n.Service,
+		"anomaly": a,
+		"text":    description(a),
+	})
+}
+
+func description(a Anomaly) string {
+	if a.Resolved {
+		return fmt.Sprintf("%s is back to normal: %.2f (moving average %.2f)", a.Signal, a.Value, a.Mean)
+	}
+	return fmt.Sprintf("%s is %.2f, %.1f standard deviations from its moving average %.2f (threshold %.1f, direction %s)",
+		a.Signal, a.Value, a.Score, a.Mean, a.Threshold, a.Direction)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
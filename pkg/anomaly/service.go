@@ -0,0 +1,78 @@
+package anomaly
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Start runs a Detector for signal configured from the anomaly.* settings of
+// v: alpha, threshold, min_samples, min_stddev, interval and the notify
+// section. State changes are logged and sent to Alertmanager and the webhook
+// when their URLs are set. The returned func stops sampling.
+func Start(v *viper.Viper, service, signal string, direction Direction, sample func() (float64, error)) context.CancelFunc {
+	detector := NewDetector(Config{
+		Signal:     signal,
+		Direction:  direction,
+		Alpha:      v.GetFloat64("anomaly.alpha"),
+		Threshold:  v.GetFloat64("anomaly.threshold"),
+		MinSamples: v.GetInt("anomaly.min_samples"),
+		MinStdDev:  v.GetFloat64("anomaly.min_stddev"),
+	})
+
+	notifiers := []Notifier{LogNotifier{}}
+	if url := v.GetString("anomaly.notify.alertmanager_url"); url != "" {
+		notifiers = append(notifiers, AlertmanagerNotifier{
+			URL:      url,
+			Service:  service,
+			Severity: v.GetString("anomaly.notify.severity"),
+		})
+	}
+	if url := v.GetString("anomaly.notify.webhook_url"); url != "" {
+		notifiers = append(notifiers, WebhookNotifier{URL: url, Service: service})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go detector.Run(ctx, v.GetDuration("anomaly.interval"), sample, notifiers, func(err error) {
+		logrus.WithError(err).WithField("signal", signal).Warn("Anomaly notification failed")
+	})
+	logrus.WithFields(logrus.Fields{"signal": signal, "direction": direction}).Info("Anomaly detection enabled")
+	return cancel
+}
+
+// RateOf turns a counter into a per-second sample of its increase since the
+// previous call, measured over the time that actually passed.
+func RateOf(counter func() int64) func() (float64, error) {
+	last, at := counter(), time.Now()
+	return func() (float64, error) {
+		current, now := counter(), time.Now()
+		elapsed := now.Sub(at).Seconds()
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(current-last) / elapsed
+		}
+		last, at = current, now
+		return rate, nil
+	}
+}
+
+// LogNotifier records anomaly state changes in the service log.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, a Anomaly) error {
+	entry := logrus.WithFields(logrus.Fields{
+		"signal":    a.Signal,
+		"value":     a.Value,
+		"mean":      a.Mean,
+		"score":     a.Score,
+		"threshold": a.Threshold,
+	})
+	if a.Resolved {
+		entry.WithField("duration", a.At.Sub(a.Since).Round(time.Second).String()).Info("Anomaly resolved")
+	} else {
+		entry.Warn("Anomaly detected")
+	}
+	return nil
+}
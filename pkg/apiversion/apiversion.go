@@ -0,0 +1,94 @@
+// Package apiversion serves several versions of an HTTP API side by side. It
+// tags each request with its version, counts requests per version so
+// migration off an old version can be followed, and marks responses of a
+// deprecated version with the Deprecation (RFC 9745), Sunset (RFC 8594) and
+// Link headers.
+package apiversion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_api_requests_by_version_total",
+		Help: "API requests by API version and route; deprecated is true for responses that carried a Deprecation header",
+	},
+	[]string{"version", "route", "deprecated"},
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+}
+
+// Version is one version of an API, served under its own path prefix.
+type Version struct {
+	// Name labels the version, e.g. "v1".
+	Name string
+	// Prefix is the path the version is served under, e.g. "/api/v1".
+	Prefix string
+
+	// Deprecated is when the version was deprecated; zero if it is not.
+	Deprecated time.Time
+	// Sunset is when the version stops being served; zero if not planned.
+	Sunset time.Time
+	// DocsURL, if set, is linked from deprecated responses as
+	// rel="deprecation": the migration guide.
+	DocsURL string
+
+	// Successor returns the path of the successor version's equivalent of
+	// r, or "" if it has none. Only requests with a successor are marked
+	// deprecated: endpoints that were not carried over keep working
+	// unannounced.
+	Successor func(r *http.Request) string
+	// RouteFunc names the route of a request for the metrics, e.g. its
+	// path template. Requests are counted under "" without it.
+	RouteFunc func(r *http.Request) string
+}
+
+type contextKey struct{}
+
+// Wrap tags requests to next with v and counts them, adding the
+// deprecation headers when v is deprecated.
+func (v *Version) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, v.Name))
+
+		deprecated := false
+		if !v.Deprecated.IsZero() && v.Successor != nil {
+			if successor := v.Successor(r); successor != "" {
+				deprecated = true
+				h := w.Header()
+				h.Set("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+				if !v.Sunset.IsZero() {
+					h.Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+				}
+				h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+				if v.DocsURL != "" {
+					h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"; type="text/html"`, v.DocsURL))
+				}
+			}
+		}
+
+		route := ""
+		if v.RouteFunc != nil {
+			route = v.RouteFunc(r)
+		}
+		requestsTotal.WithLabelValues(v.Name, route, strconv.FormatBool(deprecated)).Inc()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FromRequest returns the name of the version r was served by, or "" for
+// requests outside a Version.
+func FromRequest(r *http.Request) string {
+	name, _ := r.Context().Value(contextKey{}).(string)
+	return name
+}
@@ -0,0 +1,464 @@
+// Package audit records mutating API calls (POST, PUT, PATCH, DELETE) into an
+// append-only store that can be queried for compliance and incident review.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pipeline/pkg/access"
+)
+
+// RequestIDHeader carries the request ID; one is generated when absent.
+const RequestIDHeader = "X-Request-ID"
+
+// ForwardedUserHeader names the caller an authenticating proxy verified.
+const ForwardedUserHeader = "X-Forwarded-User"
+
+// Anonymous is the actor of callers without a verified identity.
+const Anonymous = "anonymous"
+
+// Event is a single audited API call. Before and After are short summaries of
+// the resource state, not full copies.
+type Event struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Service    string    `json:"service"`
+	RequestID  string    `json:"request_id"`
+	Actor      string    `json:"actor"`
+	Method     string    `json:"method"`
+	Resource   string    `json:"resource"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status"`
+	RemoteAddr string    `json:"remote_addr"`
+	Before     string    `json:"before,omitempty"`
+	After      string    `json:"after,omitempty"`
+}
+
+// Filter narrows a Query. Zero values match everything.
+type Filter struct {
+	Actor    string
+	Method   string
+	Resource string // prefix match
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (f Filter) matches(e Event) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(e.Method, f.Method) {
+		return false
+	}
+	if f.Resource != "" && !strings.HasPrefix(e.Resource, f.Resource) {
+		return false
+	}
+	if !f.From.IsZero() && e.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Timestamp.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// Store persists audit events. Implementations must never modify or remove
+// events once appended.
+type Store interface {
+	Append(Event) error
+	// Query returns matching events, newest first.
+	Query(Filter) ([]Event, error)
+}
+
+// FileStore appends events as JSON lines to a file opened in append-only mode.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &FileStore{path: path, file: f}, nil
+}
+
+func (s *FileStore) Append(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileStore) Query(f Filter) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if f.matches(e) {
+			events = append(events, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[:f.Limit]
+	}
+	return events, nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Config configures a Recorder.
+type Config struct {
+	Service string
+	// MaxSummaryBytes caps the before/after summaries.
+	MaxSummaryBytes int
+	// Actors names the caller of each event.
+	Actors *Actors
+	// RouteFunc, when set, names the matched route for Event.Route.
+	RouteFunc func(*http.Request) string
+	// OnError is called when an event cannot be stored.
+	OnError func(error)
+}
+
+// Recorder is the middleware that turns mutating requests into events.
+type Recorder struct {
+	cfg   Config
+	store Store
+}
+
+func NewRecorder(store Store, cfg Config) *Recorder {
+	if cfg.MaxSummaryBytes <= 0 {
+		cfg.MaxSummaryBytes = 1024
+	}
+	return &Recorder{cfg: cfg, store: store}
+}
+
+type contextKey struct{}
+
+// annotation lets handlers contribute state summaries to the current event.
+type annotation struct {
+	mu     sync.Mutex
+	before string
+	after  string
+}
+
+// SetBefore records the resource state before a mutation. It is a no-op
+// outside an audited request.
+func SetBefore(ctx context.Context, v interface{}) {
+	if a, ok := ctx.Value(contextKey{}).(*annotation); ok {
+		a.mu.Lock()
+		a.before = summarize(v)
+		a.mu.Unlock()
+	}
+}
+
+// SetAfter overrides the default after summary, which is the response body.
+func SetAfter(ctx context.Context, v interface{}) {
+	if a, ok := ctx.Value(contextKey{}).(*annotation); ok {
+		a.mu.Lock()
+		a.after = summarize(v)
+		a.mu.Unlock()
+	}
+}
+
+func summarize(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Wrap records POST, PUT, PATCH and DELETE requests handled by next. Every
+// request gets a request ID, echoed in the response headers.
+func (rec *Recorder) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = newID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ann := &annotation{}
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, ann))
+
+		var reqBody bytes.Buffer
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, &limitWriter{buf: &reqBody, limit: rec.cfg.MaxSummaryBytes}), r.Body}
+		}
+		wrapped := &recorderWriter{ResponseWriter: w, statusCode: http.StatusOK, limit: rec.cfg.MaxSummaryBytes}
+
+		next.ServeHTTP(wrapped, r)
+
+		event := Event{
+			ID:         newID(),
+			Timestamp:  time.Now().UTC(),
+			Service:    rec.cfg.Service,
+			RequestID:  requestID,
+			Actor:      rec.cfg.Actors.Actor(r),
+			Method:     r.Method,
+			Resource:   r.URL.Path,
+			Status:     wrapped.statusCode,
+			RemoteAddr: r.RemoteAddr,
+		}
+		if rec.cfg.RouteFunc != nil {
+			event.Route = rec.cfg.RouteFunc(r)
+		}
+
+		ann.mu.Lock()
+		event.Before = truncate(ann.before, rec.cfg.MaxSummaryBytes)
+		event.After = ann.after
+		ann.mu.Unlock()
+		if event.After == "" {
+			if wrapped.statusCode < 400 {
+				event.After = wrapped.body.String()
+			} else {
+				event.After = reqBody.String()
+			}
+		}
+		event.After = truncate(compact(event.After), rec.cfg.MaxSummaryBytes)
+
+		if err := rec.store.Append(event); err != nil && rec.cfg.OnError != nil {
+			rec.cfg.OnError(err)
+		}
+	})
+}
+
+// Record stores an event for r outside of Wrap, for requests that are
+// rejected before reaching it (whatever their method). summary is kept as
+// the event's after state.
+func (rec *Recorder) Record(r *http.Request, status int, summary string) {
+	event := Event{
+		ID:         newID(),
+		Timestamp:  time.Now().UTC(),
+		Service:    rec.cfg.Service,
+		RequestID:  r.Header.Get(RequestIDHeader),
+		Actor:      rec.cfg.Actors.Actor(r),
+		Method:     r.Method,
+		Resource:   r.URL.Path,
+		Status:     status,
+		RemoteAddr: r.RemoteAddr,
+		After:      truncate(summary, rec.cfg.MaxSummaryBytes),
+	}
+	if rec.cfg.RouteFunc != nil {
+		event.Route = rec.cfg.RouteFunc(r)
+	}
+	if err := rec.store.Append(event); err != nil && rec.cfg.OnError != nil {
+		rec.cfg.OnError(err)
+	}
+}
+
+// Handler serves GET queries over the store with the actor, method, resource,
+// from, to (RFC 3339) and limit query parameters.
+func (rec *Recorder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		filter := Filter{
+			Actor:    q.Get("actor"),
+			Method:   q.Get("method"),
+			Resource: q.Get("resource"),
+			Limit:    100,
+		}
+		for name, dst := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if v := q.Get(name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+					return
+				}
+				*dst = t
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			filter.Limit = limit
+		}
+
+		events, err := rec.store.Query(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if events == nil {
+			events = []Event{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"events": events,
+			"count":  len(events),
+		})
+	})
+}
+
+// Actors names the callers of requests from verified sources only: the
+// identity the service authenticated itself, else the X-Forwarded-User
+// header of a trusted authenticating proxy. Everyone else is Anonymous;
+// unverified credentials never name the actor. A nil Actors names every
+// caller Anonymous.
+type Actors struct {
+	verified func(*http.Request) string
+	proxies  []*net.IPNet
+}
+
+// NewActors returns Actors trusting verified, which returns the caller a
+// service authenticated (empty when it did not; may be nil), and the
+// X-Forwarded-User header of requests from trustedProxies, single addresses
+// or CIDR ranges such as the API gateway's network.
+func NewActors(verified func(*http.Request) string, trustedProxies []string) (*Actors, error) {
+	proxies, err := access.ParseNetworks(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &Actors{verified: verified, proxies: proxies}, nil
+}
+
+// Actor names the caller of r.
+func (a *Actors) Actor(r *http.Request) string {
+	if a == nil {
+		return Anonymous
+	}
+	if a.verified != nil {
+		if actor := a.verified(r); actor != "" {
+			return actor
+		}
+	}
+	if user := r.Header.Get(ForwardedUserHeader); user != "" && access.Contains(a.proxies, access.ClientIP(r, nil)) {
+		return user
+	}
+	return Anonymous
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+func compact(s string) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, []byte(s)) == nil {
+		return buf.String()
+	}
+	return strings.TrimSpace(s)
+}
+
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "...(truncated)"
+}
+
+// limitWriter keeps the first limit bytes written to it; it never fails so
+// the request body can still be read in full.
+type limitWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	// Keep one byte past the limit so truncate can tell the body was cut.
+	if room := lw.limit + 1 - lw.buf.Len(); room > 0 {
+		if len(p) > room {
+			lw.buf.Write(p[:room])
+		} else {
+			lw.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+type recorderWriter struct {
+	http.ResponseWriter
+	statusCode int
+	limit      int
+	body       bytes.Buffer
+}
+
+func (rw *recorderWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recorderWriter) Write(p []byte) (int, error) {
+	(&limitWriter{buf: &rw.body, limit: rw.limit}).Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recorderWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
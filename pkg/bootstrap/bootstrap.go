@@ -0,0 +1,247 @@
+// Package bootstrap builds the shared pkg components every service sets up
+// from its viper settings: metrics and log sinks, profiling, the shutdown
+// audit, secrets and the endpoint guards. Each service passes its own viper,
+// so the same keys are read the same way everywhere.
+package bootstrap
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/httplog"
+	"pipeline/pkg/logship"
+	"pipeline/pkg/profiling"
+	"pipeline/pkg/shutdown"
+	"pipeline/pkg/telemetry"
+)
+
+// HistogramSettings reads metrics.buckets.<name> and the native histogram
+// options. Invalid bucket lists are logged and the built-in buckets are kept.
+func HistogramSettings(v *viper.Viper, name string) telemetry.HistogramSettings {
+	buckets, err := telemetry.ParseBuckets(v.Get("metrics.buckets." + name))
+	if err != nil {
+		logrus.WithError(err).WithField("histogram", name).Warn("Invalid histogram buckets, using defaults")
+		buckets = nil
+	}
+
+	return telemetry.HistogramSettings{
+		Buckets:      buckets,
+		Native:       v.GetBool("metrics.native_histograms.enabled"),
+		BucketFactor: v.GetFloat64("metrics.native_histograms.bucket_factor"),
+		MaxBuckets:   v.GetUint32("metrics.native_histograms.max_buckets"),
+	}
+}
+
+// NewApdex reads metrics.apdex.threshold and the per-route overrides in
+// metrics.apdex.routes (route template -> duration).
+func NewApdex(v *viper.Viper, subsystem string) *telemetry.Apdex {
+	routes := make(map[string]time.Duration)
+	for route, value := range v.GetStringMapString("metrics.apdex.routes") {
+		threshold, err := time.ParseDuration(value)
+		if err != nil {
+			logrus.WithError(err).WithField("route", route).Warn("Invalid Apdex threshold, using default")
+			continue
+		}
+		routes[route] = threshold
+	}
+	return telemetry.NewApdex(subsystem, v.GetDuration("metrics.apdex.threshold"), routes)
+}
+
+// NewRequestLogger reads the logging.* sampling, slow request and body
+// capture options.
+func NewRequestLogger(v *viper.Viper, message string, fields func(r *http.Request) logrus.Fields) *httplog.Logger {
+	return httplog.New(httplog.Config{
+		Message:       message,
+		SampleRate:    v.GetFloat64("logging.sample_rate"),
+		SlowThreshold: v.GetDuration("logging.slow_threshold"),
+		CaptureBodies: v.GetBool("logging.capture_bodies"),
+		MaxBodyBytes:  v.GetInt("logging.max_body_bytes"),
+		Fields:        fields,
+	})
+}
+
+// StartLogShipping installs the Loki/Elasticsearch hook when log_shipping is
+// enabled. The returned func flushes buffered entries on shutdown.
+func StartLogShipping(v *viper.Viper, serviceName string) func() {
+	if !v.GetBool("log_shipping.enabled") {
+		return func() {}
+	}
+
+	hook, err := logship.NewHook(logship.Config{
+		Backend:       v.GetString("log_shipping.backend"),
+		URL:           v.GetString("log_shipping.url"),
+		Index:         v.GetString("log_shipping.index"),
+		Labels:        v.GetStringMapString("log_shipping.labels"),
+		ServiceName:   serviceName,
+		Headers:       v.GetStringMapString("log_shipping.headers"),
+		BatchSize:     v.GetInt("log_shipping.batch_size"),
+		FlushInterval: v.GetDuration("log_shipping.flush_interval"),
+		BufferSize:    v.GetInt("log_shipping.buffer_size"),
+		MaxRetries:    v.GetInt("log_shipping.max_retries"),
+		Timeout:       v.GetDuration("log_shipping.timeout"),
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("Log shipping disabled")
+		return func() {}
+	}
+	logrus.AddHook(hook)
+	logrus.WithFields(logrus.Fields{
+		"backend": v.GetString("log_shipping.backend"),
+		"url":     v.GetString("log_shipping.url"),
+	}).Info("Log shipping enabled")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hook.Close(ctx)
+	}
+}
+
+// StartMetricSinks starts the optional push-based metric sinks. They run next
+// to the Prometheus /metrics endpoint and stop when the returned func is called.
+func StartMetricSinks(v *viper.Viper, serviceName string) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if v.GetBool("otlp.enabled") {
+		exporter := telemetry.NewOTLPExporter(telemetry.OTLPConfig{
+			Endpoint:    v.GetString("otlp.endpoint"),
+			Interval:    v.GetDuration("otlp.interval"),
+			Timeout:     v.GetDuration("otlp.timeout"),
+			ServiceName: serviceName,
+			Headers:     v.GetStringMapString("otlp.headers"),
+		})
+		go exporter.Run(ctx, func(err error) {
+			logrus.WithError(err).Warn("OTLP metrics export failed")
+		})
+		logrus.WithField("endpoint", v.GetString("otlp.endpoint")).Info("OTLP metrics export enabled")
+	}
+
+	if v.GetBool("statsd.enabled") {
+		sink := telemetry.NewStatsDSink(telemetry.StatsDConfig{
+			Address:   v.GetString("statsd.address"),
+			Prefix:    v.GetString("statsd.prefix"),
+			Tags:      append(v.GetStringSlice("statsd.tags"), "service:"+serviceName),
+			DogStatsD: v.GetBool("statsd.dogstatsd"),
+			Interval:  v.GetDuration("statsd.interval"),
+			Metrics:   v.GetStringSlice("statsd.metrics"),
+		})
+		go sink.Run(ctx, func(err error) {
+			logrus.WithError(err).Warn("StatsD flush failed")
+		})
+		logrus.WithField("address", v.GetString("statsd.address")).Info("StatsD metrics emission enabled")
+	}
+
+	return cancel
+}
+
+// PushJobResult sends the metrics of a finished short-lived job to the
+// Pushgateway, if configured, so they are not lost between scrapes.
+func PushJobResult(v *viper.Viper, serviceName string, result telemetry.JobResult) {
+	if !v.GetBool("pushgateway.enabled") {
+		return
+	}
+
+	err := telemetry.PushJobMetrics(telemetry.PushgatewayConfig{
+		URL:         v.GetString("pushgateway.url"),
+		Job:         v.GetString("pushgateway.job"),
+		ServiceName: serviceName,
+	}, result)
+	if err != nil {
+		logrus.WithError(err).WithField("job_id", result.ID).Warn("Failed to push job metrics")
+	}
+}
+
+// StartRuntimeMetrics samples the Go runtime's saturation signals every
+// runtime.interval; above runtime.thresholds they degrade /health.
+func StartRuntimeMetrics(v *viper.Viper) func() {
+	if !v.GetBool("runtime.enabled") {
+		return func() {}
+	}
+	var thresholds telemetry.RuntimeThresholds
+	if err := v.UnmarshalKey("runtime.thresholds", &thresholds); err != nil {
+		logrus.WithError(err).Fatal("Invalid runtime config")
+	}
+	return telemetry.StartRuntimeMetrics(telemetry.RuntimeConfig{
+		Interval:   v.GetDuration("runtime.interval"),
+		Window:     v.GetDuration("runtime.window"),
+		Thresholds: thresholds,
+	})
+}
+
+// StartShutdownAudit begins auditing this run's shutdown, warning when the
+// previous run did not shut down cleanly.
+func StartShutdownAudit(v *viper.Viper) *shutdown.Auditor {
+	auditor := shutdown.Start(shutdown.Config{
+		Path:   v.GetString("shutdown.report_path"),
+		Settle: v.GetDuration("shutdown.settle"),
+	})
+	if previous, ok := auditor.Previous(); ok {
+		switch {
+		case previous.StoppedAt == nil:
+			logrus.WithField("started_at", previous.StartedAt).Warn("Previous run did not finish shutting down")
+		case !previous.Clean:
+			logrus.WithField("leaked_goroutines", previous.LeakedGoroutines).Warn("Previous run did not shut down cleanly")
+		}
+	}
+	return auditor
+}
+
+// FinishShutdownAudit reports what the shutdown left running once the
+// server has drained and the background loops have been stopped.
+func FinishShutdownAudit(auditor *shutdown.Auditor, drainErr error, boltTx int) {
+	report := auditor.Finish(drainErr, boltTx)
+	if report.Clean {
+		logrus.Info("Shutdown clean")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"drain_timed_out":    report.DrainTimedOut,
+		"in_flight_requests": report.InFlightRequests,
+		"bolt_transactions":  report.BoltTransactions,
+		"leaked_goroutines":  report.LeakedGoroutines,
+		"goroutines":         report.Goroutines,
+	}).Warn("Shutdown left resources behind")
+}
+
+// StartProfiling continuously uploads CPU and heap profiles to Pyroscope or
+// Parca, tagged with the service and its version, until the returned func is
+// called.
+func StartProfiling(v *viper.Viper, serviceName, version string) func() {
+	if !v.GetBool("profiling.enabled") {
+		return func() {}
+	}
+	uploader, err := profiling.New(profiling.Config{
+		Backend:  v.GetString("profiling.backend"),
+		URL:      v.GetString("profiling.url"),
+		Service:  serviceName,
+		Version:  version,
+		Tags:     v.GetStringMapString("profiling.tags"),
+		Profiles: v.GetStringSlice("profiling.profiles"),
+		Interval: v.GetDuration("profiling.interval"),
+		Timeout:  v.GetDuration("profiling.timeout"),
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid profiling config")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		uploader.Run(ctx, func(err error) {
+			logrus.WithError(err).Warn("Profile upload failed")
+		})
+	}()
+	logrus.WithFields(logrus.Fields{
+		"backend": v.GetString("profiling.backend"),
+		"url":     v.GetString("profiling.url"),
+	}).Info("Continuous profiling enabled")
+	return func() {
+		cancel()
+		<-done
+	}
+}
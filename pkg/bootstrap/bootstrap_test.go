@@ -0,0 +1,74 @@
+package bootstrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestHistogramSettings(t *testing.T) {
+	v := viper.New()
+	v.Set("metrics.buckets.latency", []interface{}{0.1, 0.5, 1})
+	v.Set("metrics.buckets.broken", "fast")
+	v.Set("metrics.native_histograms.enabled", true)
+	v.Set("metrics.native_histograms.max_buckets", 100)
+
+	if s := HistogramSettings(v, "latency"); !reflect.DeepEqual(s.Buckets, []float64{0.1, 0.5, 1}) || !s.Native || s.MaxBuckets != 100 {
+		t.Errorf("latency settings = %+v", s)
+	}
+	if s := HistogramSettings(v, "broken"); s.Buckets != nil {
+		t.Errorf("invalid buckets kept: %v", s.Buckets)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "s3cret")
+	v := viper.New()
+	v.Set("database.password", "vault:db#password")
+	v.Set("database.user", "pipeline")
+
+	store := ResolveSecrets(v, nil)
+	if got := v.GetString("database.password"); got != "s3cret" {
+		t.Errorf("database.password = %q", got)
+	}
+	if value, ok := store.Get("database.password"); !ok || value != "s3cret" {
+		t.Errorf("store has %q, %v", value, ok)
+	}
+	if v.GetString("database.user") != "pipeline" {
+		t.Error("plain setting changed")
+	}
+
+	if ResolveSecrets(viper.New(), nil) != nil {
+		t.Error("store returned without references")
+	}
+}
+
+func TestExemptPathsAreNotShared(t *testing.T) {
+	v := viper.New()
+	v.Set("load_shedding.enabled", true)
+	v.Set("load_shedding.exempt_paths", []string{"/shed-exempt"})
+	v.Set("request_signing.enabled", true)
+	v.Set("request_signing.secret", "k")
+	v.Set("request_signing.exempt_paths", []string{"/unsigned"})
+
+	NewLoadShedder(v)
+	verifier, err := NewSignatureVerifier(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exemptPaths, []string{"/health", "/ready", "/metrics"}) {
+		t.Fatalf("exempt paths modified: %v", exemptPaths)
+	}
+
+	handler := verifier.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{"/unsigned": http.StatusOK, "/health": http.StatusOK, "/shed-exempt": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("unsigned GET %s = %d, want %d", path, w.Code, want)
+		}
+	}
+}
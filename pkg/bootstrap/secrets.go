@@ -0,0 +1,79 @@
+package bootstrap
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/secrets"
+)
+
+// ResolveSecrets replaces every vault:<path>#<field> value in v with the
+// secret it references. A reference that cannot be resolved is fatal so it is
+// never used as a literal credential. With secrets.refresh_interval set the
+// secrets are refreshed in the background and onRotate is called with the
+// key of each one that changed; v keeps the startup values. The returned
+// store is nil when nothing is referenced.
+func ResolveSecrets(v *viper.Viper, onRotate func(key string)) *secrets.Store {
+	refs := make(map[string]string)
+	for _, key := range v.AllKeys() {
+		if value, ok := v.Get(key).(string); ok && secrets.IsRef(value) {
+			refs[key] = value
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	provider, err := newSecretsProvider(ctx, v)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to set up secrets provider")
+	}
+
+	store := secrets.NewStore(provider, refs)
+	if err := store.Resolve(ctx); err != nil {
+		logrus.WithError(err).Fatal("Failed to resolve secret")
+	}
+	// Only done at startup: viper must not be written while it is being read.
+	for _, key := range store.Keys() {
+		value, _ := store.Get(key)
+		v.Set(key, value)
+	}
+	logrus.WithFields(logrus.Fields{
+		"provider": v.GetString("secrets.provider"),
+		"count":    len(refs),
+	}).Info("Secrets resolved")
+
+	if interval := v.GetDuration("secrets.refresh_interval"); interval > 0 {
+		go store.Refresh(ctx, interval, onRotate, func(key string, err error) {
+			logrus.WithError(err).WithField("key", key).Warn("Failed to refresh secret")
+		})
+	}
+	return store
+}
+
+func newSecretsProvider(ctx context.Context, v *viper.Viper) (secrets.Provider, error) {
+	if v.GetString("secrets.provider") != "vault" {
+		return secrets.EnvProvider{}, nil
+	}
+
+	vault, err := secrets.NewVault(ctx, secrets.VaultConfig{
+		Address:         v.GetString("secrets.vault.address"),
+		Mount:           v.GetString("secrets.vault.mount"),
+		Namespace:       v.GetString("secrets.vault.namespace"),
+		Token:           v.GetString("secrets.vault.token"),
+		RoleID:          v.GetString("secrets.vault.approle.role_id"),
+		SecretID:        v.GetString("secrets.vault.approle.secret_id"),
+		KubernetesRole:  v.GetString("secrets.vault.kubernetes.role"),
+		KubernetesMount: v.GetString("secrets.vault.kubernetes.mount"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	go vault.RenewLoop(ctx, func(err error) {
+		logrus.WithError(err).Warn("Vault token renewal failed")
+	})
+	return vault, nil
+}
@@ -0,0 +1,44 @@
+// Package changefeed fetches pages of the data service change feed and the
+// business service order event log, which replicas and the rollup service
+// follow by sequence number.
+package changefeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// TruncatedError is returned when the feed no longer keeps the entries
+// after the requested sequence. FirstSeq is the oldest one it still has.
+type TruncatedError struct {
+	FirstSeq uint64
+}
+
+func (e TruncatedError) Error() string {
+	return fmt.Sprintf("change feed truncated before %d", e.FirstSeq)
+}
+
+// FetchJSON gets url and decodes the JSON response into out. A 410 Gone
+// carrying the feed's first_seq is returned as a TruncatedError; any other
+// status but 200 is an error.
+func FetchJSON(client *http.Client, url string, out interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		var body struct {
+			FirstSeq uint64 `json:"first_seq"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.FirstSeq > 0 {
+			return TruncatedError{FirstSeq: body.FirstSeq}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
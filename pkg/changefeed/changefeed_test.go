@@ -0,0 +1,37 @@
+package changefeed
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchJSONReportsTruncatedFeed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("since") {
+		case "0":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"error": "change log truncated", "first_seq": 120}`))
+		case "bad":
+			http.Error(w, "invalid since", http.StatusBadRequest)
+		default:
+			w.Write([]byte(`{"changes": [], "last_seq": 130}`))
+		}
+	}))
+	defer server.Close()
+
+	var batch struct {
+		LastSeq uint64 `json:"last_seq"`
+	}
+	var truncated TruncatedError
+	if err := FetchJSON(server.Client(), server.URL+"/api/v1/changes?since=0", &batch); !errors.As(err, &truncated) || truncated.FirstSeq != 120 {
+		t.Fatalf("FetchJSON = %v, want the feed truncated before 120", err)
+	}
+	if err := FetchJSON(server.Client(), server.URL+"/api/v1/changes?since=bad", &batch); err == nil || errors.As(err, &truncated) {
+		t.Errorf("FetchJSON on a 400 = %v", err)
+	}
+	if err := FetchJSON(server.Client(), server.URL+"/api/v1/changes?since=119", &batch); err != nil || batch.LastSeq != 130 {
+		t.Errorf("FetchJSON = %v, last_seq %d", err, batch.LastSeq)
+	}
+}
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		accept   string
+		protobuf bool
+		want     string
+	}{
+		{"", false, JSON},
+		{"application/json", true, JSON},
+		{"application/x-msgpack", false, MsgPack},
+		{"application/x-protobuf", true, Protobuf},
+		{"application/x-protobuf", false, ""},
+		{"application/x-protobuf, application/msgpack;q=0.5", false, MsgPack},
+		{"application/json;q=0.8, application/msgpack", true, MsgPack},
+		{"application/msgpack, application/json", true, MsgPack},
+		{"text/html, */*;q=0.1", false, JSON},
+		{"text/html", true, ""},
+		{"application/msgpack;q=bad, application/json;q=0.2", false, JSON},
+	}
+	for _, tc := range cases {
+		if got := Negotiate(tc.accept, tc.protobuf); got != tc.want {
+			t.Errorf("Negotiate(%q, %v) = %q, want %q", tc.accept, tc.protobuf, got, tc.want)
+		}
+	}
+}
+
+type protoValue struct {
+	ID string `json:"id"`
+}
+
+func (v protoValue) MarshalProto() []byte { return AppendString(nil, 1, v.ID) }
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		accept      string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{"", http.StatusCreated, JSON, []byte("{\"id\":\"7\"}\n")},
+		{MsgPack, http.StatusCreated, MsgPack, []byte{0x81, 0xa2, 'i', 'd', 0xa1, '7'}},
+		{Protobuf, http.StatusCreated, Protobuf, []byte{0x0a, 0x01, '7'}},
+		{"text/csv", http.StatusNotAcceptable, "text/plain; charset=utf-8", nil},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/orders/7", nil)
+		r.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		Write(w, r, http.StatusCreated, protoValue{ID: "7"})
+
+		if w.Code != tc.status || w.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("Accept %q: %d %s", tc.accept, w.Code, w.Header().Get("Content-Type"))
+		}
+		if tc.body != nil && !bytes.Equal(w.Body.Bytes(), tc.body) {
+			t.Errorf("Accept %q: body % x", tc.accept, w.Body.Bytes())
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: Vary %q", tc.accept, w.Header().Get("Vary"))
+		}
+	}
+
+	// Values without a Protobuf encoding are not offered as Protobuf.
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/metrics", nil)
+	r.Header.Set("Accept", Protobuf)
+	w := httptest.NewRecorder()
+	Write(w, r, http.StatusOK, map[string]int{"orders": 3})
+	if w.Code != http.StatusNotAcceptable || !bytes.Contains(w.Body.Bytes(), []byte(MsgPack)) || bytes.Contains(w.Body.Bytes(), []byte(Protobuf)) {
+		t.Errorf("Protobuf for a plain value: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var notModifiedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pipeline_not_modified_responses_total",
+		Help: "Conditional GETs answered with 304 Not Modified",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(notModifiedTotal)
+}
+
+// WriteResource is Write for a single resource clients poll. It sets an
+// ETag, and Last-Modified unless modified is zero, and answers a request
+// whose If-None-Match (or, without one, If-Modified-Since) shows the client
+// has the current version with 304 Not Modified.
+func WriteResource(w http.ResponseWriter, r *http.Request, v interface{}, modified time.Time) {
+	_, protobuf := v.(ProtoMessage)
+	mediaType := Negotiate(r.Header.Get("Accept"), protobuf)
+	if mediaType == "" {
+		Write(w, r, http.StatusOK, v)
+		return
+	}
+
+	tag, err := ETag(v, mediaType)
+	if err == nil {
+		w.Header().Set("ETag", tag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, tag, modified) {
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(http.StatusNotModified)
+		notModifiedTotal.Inc()
+		return
+	}
+	Write(w, r, http.StatusOK, v)
+}
+
+// Versioned is implemented by responses that carry per-request fields, such
+// as a request ID, which must not change their ETag. Version returns the
+// part of the value that identifies the resource's state.
+type Versioned interface {
+	Version() interface{}
+}
+
+// ETag returns a strong entity tag for v encoded as mediaType: a hash of
+// its JSON encoding (of its Version, if it is Versioned), suffixed with the
+// encoding for the binary ones so each representation has its own tag.
+func ETag(v interface{}, mediaType string) (string, error) {
+	if versioned, ok := v.(Versioned); ok {
+		v = versioned.Version()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	tag := hex.EncodeToString(sum[:10])
+	if mediaType != JSON {
+		tag += "-" + encodingLabel(mediaType)
+	}
+	return `"` + tag + `"`, nil
+}
+
+func notModified(r *http.Request, tag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return tag != "" && etagMatches(match, tag)
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !modified.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagMatches compares If-None-Match with weak comparison, as RFC 9110
+// requires for it.
+func etagMatches(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMarshalMsgPack(t *testing.T) {
+	cases := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"bools", []bool{true, false}, []byte{0x92, 0xc3, 0xc2}},
+		{"positive fixint", 127, []byte{0x7f}},
+		{"negative fixint", -32, []byte{0xe0}},
+		{"uint8", 128, []byte{0xcc, 0x80}},
+		{"uint16", 256, []byte{0xcd, 0x01, 0x00}},
+		{"uint32", 65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{"uint64", int64(math.MaxUint32) + 1, []byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{"int8", -33, []byte{0xd0, 0xdf}},
+		{"int16", -129, []byte{0xd1, 0xff, 0x7f}},
+		{"int32", -32769, []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{"int64", int64(math.MinInt32) - 1, []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff}},
+		{"float", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixstr", "hi", []byte{0xa2, 'h', 'i'}},
+		{"sorted map", map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+		{"struct", struct {
+			ID   string `json:"id"`
+			Note string `json:"note,omitempty"`
+		}{ID: "7"}, []byte{0x81, 0xa2, 'i', 'd', 0xa1, '7'}},
+	}
+	for _, tc := range cases {
+		got, err := MarshalMsgPack(tc.v)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got % x, want % x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMarshalMsgPackLengths(t *testing.T) {
+	cases := []struct {
+		name   string
+		v      interface{}
+		header []byte
+	}{
+		{"str8", strings.Repeat("x", 32), []byte{0xd9, 32}},
+		{"str16", strings.Repeat("x", 256), []byte{0xda, 0x01, 0x00}},
+		{"str32", strings.Repeat("x", 65536), []byte{0xdb, 0, 1, 0, 0}},
+		{"array16", make([]int, 16), []byte{0xdc, 0, 16}},
+		{"array32", make([]int, 65536), []byte{0xdd, 0, 1, 0, 0}},
+	}
+	for _, tc := range cases {
+		got, err := MarshalMsgPack(tc.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.HasPrefix(got, tc.header) {
+			t.Errorf("%s: header % x, want % x", tc.name, got[:len(tc.header)], tc.header)
+		}
+	}
+
+	m := make(map[string]int, 16)
+	for i := 0; i < 16; i++ {
+		m[string(rune('a'+i))] = i
+	}
+	if got, _ := MarshalMsgPack(m); !bytes.HasPrefix(got, []byte{0xde, 0, 16}) {
+		t.Errorf("map16 header % x", got[:3])
+	}
+}
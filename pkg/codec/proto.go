@@ -0,0 +1,149 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The Append helpers encode proto3 fields for MarshalProto implementations.
+// Like proto3 itself they skip zero values.
+
+// AppendString appends a string field.
+func AppendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// AppendInt64 appends an int64 field.
+func AppendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// AppendUint64 appends a uint64 field.
+func AppendUint64(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// AppendDouble appends a double field.
+func AppendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// AppendBool appends a bool field.
+func AppendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// AppendMessage appends an embedded message, e.g. one element of a
+// repeated field. Unlike the scalar helpers it writes empty messages.
+func AppendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+// AppendTimestamp appends a google.protobuf.Timestamp field; zero times are
+// skipped.
+func AppendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = AppendInt64(ts, 1, t.Unix())
+	ts = AppendInt64(ts, 2, int64(t.Nanosecond()))
+	return AppendMessage(b, num, ts)
+}
+
+// AppendStringMap appends a map<string, string> field, sorted by key so the
+// encoding is deterministic.
+func AppendStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = AppendString(entry, 1, k)
+		entry = AppendString(entry, 2, m[k])
+		b = AppendMessage(b, num, entry)
+	}
+	return b
+}
+
+// DecodeFields calls fn for each field of the encoded message b, in order.
+// v holds the value of varint and fixed-size fields, data the contents of
+// length-delimited ones. Groups, deprecated since proto3, are rejected.
+func DecodeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, typ)
+		}
+		if n < 0 {
+			return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeStringMapEntry decodes one entry of a map<string, string> field.
+func DecodeStringMapEntry(b []byte) (key, value string, err error) {
+	err = DecodeFields(b, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	return key, value, err
+}
@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAppendHelpersRoundTrip(t *testing.T) {
+	var b []byte
+	b = AppendString(b, 1, "order-7")
+	b = AppendInt64(b, 2, -3)
+	b = AppendUint64(b, 3, 1<<40)
+	b = AppendDouble(b, 4, 2.5)
+	b = AppendBool(b, 5, true)
+	b = AppendMessage(b, 6, nil)
+	b = AppendStringMap(b, 7, map[string]string{"region": "eu", "env": "prod"})
+	// Zero values are skipped.
+	b = AppendString(b, 8, "")
+	b = AppendInt64(b, 9, 0)
+	b = AppendBool(b, 10, false)
+	b = AppendTimestamp(b, 11, time.Time{})
+
+	var nums []protowire.Number
+	var labels [][2]string
+	err := DecodeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		nums = append(nums, num)
+		switch num {
+		case 1:
+			if string(data) != "order-7" {
+				t.Errorf("field 1 = %q", data)
+			}
+		case 2:
+			if int64(v) != -3 {
+				t.Errorf("field 2 = %d", int64(v))
+			}
+		case 3:
+			if v != 1<<40 {
+				t.Errorf("field 3 = %d", v)
+			}
+		case 4:
+			if typ != protowire.Fixed64Type || math.Float64frombits(v) != 2.5 {
+				t.Errorf("field 4 = %v", math.Float64frombits(v))
+			}
+		case 5:
+			if v != 1 {
+				t.Errorf("field 5 = %d", v)
+			}
+		case 6:
+			if typ != protowire.BytesType || len(data) != 0 {
+				t.Errorf("field 6 = %q", data)
+			}
+		case 7:
+			k, v, err := DecodeStringMapEntry(data)
+			if err != nil {
+				return err
+			}
+			labels = append(labels, [2]string{k, v})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nums) != 8 {
+		t.Errorf("decoded fields %v, want 1-7 with two map entries", nums)
+	}
+	if len(labels) != 2 || labels[0] != [2]string{"env", "prod"} || labels[1] != [2]string{"region", "eu"} {
+		t.Errorf("map entries = %v, want them sorted by key", labels)
+	}
+}
+
+func TestAppendTimestampMatchesWellKnownType(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 250000000, time.UTC)
+	b := AppendTimestamp(nil, 1, ts)
+
+	var msg []byte
+	if err := DecodeFields(b, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+		msg = data
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var got timestamppb.Timestamp
+	if err := proto.Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.AsTime().Equal(ts) {
+		t.Errorf("timestamp = %v, want %v", got.AsTime(), ts)
+	}
+}
+
+func TestDecodeFieldsRejectsMalformedInput(t *testing.T) {
+	noop := func(protowire.Number, protowire.Type, uint64, []byte) error { return nil }
+	truncated := AppendString(nil, 1, "hello")
+	cases := map[string][]byte{
+		"truncated bytes":  truncated[:len(truncated)-1],
+		"truncated varint": {0x08, 0x80},
+		"group":            protowire.AppendTag(nil, 1, protowire.StartGroupType),
+		"bad tag":          {0x80},
+	}
+	for name, b := range cases {
+		if err := DecodeFields(b, noop); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSnappy(t *testing.T) {
+	literal := bytes.Repeat([]byte("0123456789"), 60)
+	cases := []struct {
+		name string
+		src  []byte
+		want []byte
+	}{
+		{"empty", []byte{0x00}, []byte{}},
+		{"literal", []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'}, []byte("hello")},
+		// A one-byte-offset copy longer than its offset repeats the run.
+		{"overlapping copy", []byte{0x0c, 0x04, 'a', 'b', 0x19, 0x02}, []byte("abababababab")},
+		{"two-byte offset", []byte{0x06, 0x08, 'a', 'b', 'c', 0x0a, 0x03, 0x00}, []byte("abcabc")},
+		{"four-byte offset", []byte{0x06, 0x08, 'a', 'b', 'c', 0x0b, 0x03, 0x00, 0x00, 0x00}, []byte("abcabc")},
+		{"one-byte literal length", append([]byte{0x64, 0xf0, 99}, literal[:100]...), literal[:100]},
+		// 600 bytes of literal, then 4 bytes copied from 511 back, which
+		// needs the offset's high bits from the tag.
+		{"long offset", append(append([]byte{0xdc, 0x04, 0xf4, 0x57, 0x02}, literal...), 0x21, 0xff), append(append([]byte{}, literal...), literal[89:93]...)},
+	}
+	for _, tc := range cases {
+		got, err := DecodeSnappy(tc.src, 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeSnappyRejectsCorruptInput(t *testing.T) {
+	cases := map[string][]byte{
+		"no length":             {},
+		"truncated literal":     {0x05, 0x10, 'h', 'e'},
+		"literal past length":   {0x02, 0x10, 'h', 'e', 'l', 'l', 'o'},
+		"copy before any data":  {0x04, 0x01, 0x01},
+		"offset past the start": {0x06, 0x04, 'a', 'b', 0x01, 0x03},
+		"zero offset":           {0x06, 0x04, 'a', 'b', 0x01, 0x00},
+		"truncated copy":        {0x06, 0x04, 'a', 'b', 0x0a, 0x02},
+		"short output":          {0x06, 0x04, 'a', 'b'},
+	}
+	for name, src := range cases {
+		if _, err := DecodeSnappy(src, 1<<20); err != errCorruptSnappy {
+			t.Errorf("%s: err %v", name, err)
+		}
+	}
+
+	// The declared length is checked before anything is allocated.
+	_, err := DecodeSnappy([]byte{0x80, 0x80, 0x80, 0x80, 0x08}, 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 1048576 byte limit") {
+		t.Errorf("oversized input: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Package concurrency provides an adaptive limit on in-flight requests to an
+// upstream. The limit follows AIMD: it grows by about one per limit's worth
+// of fast, successful responses while the limit is being used, and shrinks
+// multiplicatively when a response fails or is slower than Tolerance times
+// the upstream's baseline latency. Requests over the limit are rejected
+// immediately instead of piling up behind a slow upstream.
+package concurrency
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	limitGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_concurrency_limit",
+			Help: "Current adaptive concurrency limit",
+		},
+		[]string{"limiter"},
+	)
+	inFlightGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_concurrency_inflight",
+			Help: "Requests currently holding a concurrency slot",
+		},
+		[]string{"limiter"},
+	)
+	baselineGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_concurrency_baseline_latency_seconds",
+			Help: "Slow-moving average latency the limiter compares samples against",
+		},
+		[]string{"limiter"},
+	)
+	rejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_concurrency_rejected_total",
+			Help: "Requests rejected because the concurrency limit was reached",
+		},
+		[]string{"limiter"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(limitGauge, inFlightGauge, baselineGauge, rejectedTotal)
+}
+
+// Config configures a Limiter.
+type Config struct {
+	// Name labels the limiter's metrics, e.g. the upstream name.
+	Name string
+	// InitialLimit, MinLimit and MaxLimit bound the limit; 20, 1 and 1000
+	// by default.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Tolerance is how many times the baseline latency a response may take
+	// before it counts as congestion; 2 by default.
+	Tolerance float64
+	// Backoff multiplies the limit on congestion; 0.9 by default.
+	Backoff float64
+	// BaselineAlpha is the weight of each sample in the baseline latency's
+	// moving average; 0.01 by default so the baseline only drifts slowly.
+	BaselineAlpha float64
+}
+
+// Limiter is an adaptive concurrency limit. It is safe for concurrent use.
+type Limiter struct {
+	cfg Config
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	baseline float64 // seconds
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = cfg.MinLimit
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	if cfg.Tolerance <= 1 {
+		cfg.Tolerance = 2
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	if cfg.BaselineAlpha <= 0 || cfg.BaselineAlpha > 1 {
+		cfg.BaselineAlpha = 0.01
+	}
+
+	l := &Limiter{cfg: cfg}
+	l.limit = l.clamp(float64(cfg.InitialLimit))
+	limitGauge.WithLabelValues(cfg.Name).Set(l.limit)
+	inFlightGauge.WithLabelValues(cfg.Name).Set(0)
+	return l
+}
+
+// Acquire takes a slot. When ok is false the limit is reached and the request
+// should be rejected; otherwise done must be called exactly once with the
+// observed latency and whether the request failed (connection error,
+// timeout or 5xx), which shrinks the limit.
+func (l *Limiter) Acquire() (done func(latency time.Duration, failed bool), ok bool) {
+	l.mu.Lock()
+	if l.inFlight >= int(l.limit) {
+		l.mu.Unlock()
+		rejectedTotal.WithLabelValues(l.cfg.Name).Inc()
+		return nil, false
+	}
+	l.inFlight++
+	inFlight := l.inFlight
+	l.mu.Unlock()
+	inFlightGauge.WithLabelValues(l.cfg.Name).Set(float64(inFlight))
+
+	var once sync.Once
+	return func(latency time.Duration, failed bool) {
+		once.Do(func() { l.release(latency, failed) })
+	}, true
+}
+
+func (l *Limiter) release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	// Whether the limit was in use when this request ran; an idle limiter
+	// must not grow without bound.
+	utilized := float64(l.inFlight) >= l.limit/2
+	l.inFlight--
+
+	sample := latency.Seconds()
+	switch {
+	case failed:
+		l.limit = l.clamp(l.limit * l.cfg.Backoff)
+	case l.baseline > 0 && sample > l.baseline*l.cfg.Tolerance:
+		l.limit = l.clamp(l.limit * l.cfg.Backoff)
+	case utilized:
+		l.limit = l.clamp(l.limit + 1/l.limit)
+	}
+	if !failed {
+		if l.baseline == 0 {
+			l.baseline = sample
+		} else {
+			l.baseline += l.cfg.BaselineAlpha * (sample - l.baseline)
+		}
+	}
+
+	limit, inFlight, baseline := l.limit, l.inFlight, l.baseline
+	l.mu.Unlock()
+
+	limitGauge.WithLabelValues(l.cfg.Name).Set(math.Floor(limit))
+	inFlightGauge.WithLabelValues(l.cfg.Name).Set(float64(inFlight))
+	baselineGauge.WithLabelValues(l.cfg.Name).Set(baseline)
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *Limiter) clamp(limit float64) float64 {
+	return math.Max(float64(l.cfg.MinLimit), math.Min(float64(l.cfg.MaxLimit), limit))
+}
@@ -0,0 +1,396 @@
+// Package correlate gathers the evidence around an incident: deploys and
+// restarts, slow requests found through their trace exemplars, error log
+// spikes and growth of the processing backlog in the window before it
+// opened. Metrics and exemplars are read from Prometheus, logs from Loki;
+// a source left unset is skipped.
+package correlate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pipeline/pkg/incident"
+)
+
+var (
+	reports = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_correlation_reports_total",
+			Help: "Correlation reports built for incidents, by result: complete, or partial when a source failed",
+		},
+		[]string{"result"},
+	)
+	evidenceFound = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_correlation_evidence_total",
+			Help: "Evidence attached to incidents, by kind",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reports, evidenceFound)
+}
+
+// Evidence kinds.
+const (
+	KindDeploy    = "deploy"
+	KindSlowTrace = "slow_trace"
+	KindErrorLogs = "error_logs"
+	KindBacklog   = "backlog"
+)
+
+// Config configures a Correlator.
+type Config struct {
+	// PrometheusURL is queried for restarts, new builds, exemplars and the
+	// backlog.
+	PrometheusURL string
+	// LokiURL is queried for error log counts.
+	LokiURL string
+	// Lookback is the window before an incident opened that is searched;
+	// 30 minutes by default.
+	Lookback time.Duration
+	// Timeout bounds each query; 10 seconds by default.
+	Timeout time.Duration
+
+	// SlowTraceMin is the shortest request reported as a slow trace, and
+	// MaxTraces how many of the slowest are reported.
+	SlowTraceMin time.Duration
+	MaxTraces    int
+	// ErrorSpikeFactor is how many times more errors than in the window
+	// before make a spike, once there are at least MinErrors.
+	ErrorSpikeFactor float64
+	MinErrors        int
+	// BacklogQuery is the PromQL of the pending records, and
+	// MinBacklogGrowth the growth over Lookback reported.
+	BacklogQuery     string
+	MinBacklogGrowth float64
+
+	// Deploys lists deploys the caller knows of in [from, to), such as
+	// blue/green switches.
+	Deploys func(from, to time.Time) []incident.Evidence
+}
+
+// Correlator builds correlation reports.
+type Correlator struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New returns a Correlator, filling in the defaults.
+func New(cfg Config) *Correlator {
+	if cfg.Lookback <= 0 {
+		cfg.Lookback = 30 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxTraces <= 0 {
+		cfg.MaxTraces = 5
+	}
+	if cfg.ErrorSpikeFactor <= 0 {
+		cfg.ErrorSpikeFactor = 3
+	}
+	cfg.PrometheusURL = strings.TrimRight(cfg.PrometheusURL, "/")
+	cfg.LokiURL = strings.TrimRight(cfg.LokiURL, "/")
+	return &Correlator{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Correlate gathers the evidence of the Lookback window before in opened.
+// Sources are queried concurrently; those that fail are listed in the
+// report's Errors.
+func (c *Correlator) Correlate(ctx context.Context, in incident.Incident) incident.Correlation {
+	to := in.OpenedAt
+	from := to.Add(-c.cfg.Lookback)
+
+	type source struct {
+		name string
+		run  func(context.Context, time.Time, time.Time, incident.Incident) ([]incident.Evidence, error)
+		skip bool
+	}
+	sources := []source{
+		{name: "deploys", run: c.deploys},
+		{name: "slow traces", run: c.slowTraces, skip: c.cfg.PrometheusURL == ""},
+		{name: "error logs", run: c.errorLogs, skip: c.cfg.LokiURL == ""},
+		{name: "backlog", run: c.backlog, skip: c.cfg.PrometheusURL == "" || c.cfg.BacklogQuery == ""},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := incident.Correlation{From: from.UTC(), To: to.UTC(), Evidence: []incident.Evidence{}}
+	for _, s := range sources {
+		if s.skip {
+			continue
+		}
+		wg.Add(1)
+		go func(s source) {
+			defer wg.Done()
+			found, err := s.run(ctx, from, to, in)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", s.name, err))
+				return
+			}
+			report.Evidence = append(report.Evidence, found...)
+		}(s)
+	}
+	wg.Wait()
+
+	sort.SliceStable(report.Evidence, func(i, j int) bool {
+		if report.Evidence[i].Kind != report.Evidence[j].Kind {
+			return report.Evidence[i].Kind < report.Evidence[j].Kind
+		}
+		return report.Evidence[i].At.After(report.Evidence[j].At)
+	})
+	sort.Strings(report.Errors)
+	for _, e := range report.Evidence {
+		evidenceFound.WithLabelValues(e.Kind).Inc()
+	}
+	if len(report.Errors) > 0 {
+		reports.WithLabelValues("partial").Inc()
+	} else {
+		reports.WithLabelValues("complete").Inc()
+	}
+	report.GeneratedAt = time.Now().UTC()
+	return report
+}
+
+// deploys reports restarts and new builds seen by Prometheus, and the
+// deploys of Config.Deploys.
+func (c *Correlator) deploys(ctx context.Context, from, to time.Time, _ incident.Incident) ([]incident.Evidence, error) {
+	var found []incident.Evidence
+	if c.cfg.Deploys != nil {
+		found = append(found, c.cfg.Deploys(from, to)...)
+	}
+	if c.cfg.PrometheusURL == "" {
+		return found, nil
+	}
+	window := promDuration(to.Sub(from))
+
+	restarts, err := c.query(ctx, c.cfg.PrometheusURL+"/api/v1/query", fmt.Sprintf("changes(process_start_time_seconds[%s]) > 0", window), to)
+	if err != nil {
+		return found, err
+	}
+	for _, s := range restarts {
+		found = append(found, incident.Evidence{
+			Kind:    KindDeploy,
+			Service: s.Metric["job"],
+			At:      to,
+			Summary: fmt.Sprintf("%s restarted %.0f times in the %s before", s.Metric["job"], s.Value, window),
+			Value:   s.Value,
+		})
+	}
+
+	// Builds running at the end of the window that were not at its start.
+	builds, err := c.query(ctx, c.cfg.PrometheusURL+"/api/v1/query", fmt.Sprintf("service_build_info unless service_build_info offset %s", window), to)
+	if err != nil {
+		return found, err
+	}
+	for _, s := range builds {
+		found = append(found, incident.Evidence{
+			Kind:    KindDeploy,
+			Service: s.Metric["job"],
+			At:      to,
+			Summary: fmt.Sprintf("%s started running version %s (commit %s) in the %s before", s.Metric["job"], s.Metric["version"], s.Metric["commit"], window),
+		})
+	}
+	return found, nil
+}
+
+// slowTraces reports the slowest requests of the window whose latency
+// histograms carry trace exemplars, for the incident's service if it has
+// one.
+func (c *Correlator) slowTraces(ctx context.Context, from, to time.Time, in incident.Incident) ([]incident.Evidence, error) {
+	selector := `{__name__=~".+_duration_seconds_bucket"}`
+	if in.Service != "" {
+		selector = fmt.Sprintf(`{__name__=~".+_duration_seconds_bucket",job=%q}`, in.Service)
+	}
+	q := url.Values{}
+	q.Set("query", selector)
+	q.Set("start", strconv.FormatInt(from.Unix(), 10))
+	q.Set("end", strconv.FormatInt(to.Unix(), 10))
+	var series []struct {
+		SeriesLabels map[string]string `json:"seriesLabels"`
+		Exemplars    []struct {
+			Labels    map[string]string `json:"labels"`
+			Value     string            `json:"value"`
+			Timestamp float64           `json:"timestamp"`
+		} `json:"exemplars"`
+	}
+	if err := c.get(ctx, c.cfg.PrometheusURL+"/api/v1/query_exemplars?"+q.Encode(), &series); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var found []incident.Evidence
+	for _, s := range series {
+		for _, e := range s.Exemplars {
+			traceID := e.Labels["trace_id"]
+			seconds, err := strconv.ParseFloat(e.Value, 64)
+			if traceID == "" || err != nil || seconds < c.cfg.SlowTraceMin.Seconds() || seen[traceID] {
+				continue
+			}
+			seen[traceID] = true
+			at := time.Unix(0, int64(e.Timestamp*float64(time.Second))).UTC()
+			found = append(found, incident.Evidence{
+				Kind:    KindSlowTrace,
+				Service: s.SeriesLabels["job"],
+				At:      at,
+				Summary: fmt.Sprintf("%s took %s (%s)", s.SeriesLabels["job"], time.Duration(seconds*float64(time.Second)).Round(time.Millisecond), strings.TrimSuffix(s.SeriesLabels["__name__"], "_bucket")),
+				TraceID: traceID,
+				Value:   seconds,
+			})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Value > found[j].Value })
+	if len(found) > c.cfg.MaxTraces {
+		found = found[:c.cfg.MaxTraces]
+	}
+	return found, nil
+}
+
+// errorLogs reports the services that logged at least ErrorSpikeFactor
+// times more errors in the window than in the window before it.
+func (c *Correlator) errorLogs(ctx context.Context, from, to time.Time, _ incident.Incident) ([]incident.Evidence, error) {
+	window := promDuration(to.Sub(from))
+	selector := `{level=~"error|fatal|panic"}`
+	current, err := c.query(ctx, c.cfg.LokiURL+"/loki/api/v1/query", fmt.Sprintf("sum by (service) (count_over_time(%s[%s]))", selector, window), to)
+	if err != nil {
+		return nil, err
+	}
+	before, err := c.query(ctx, c.cfg.LokiURL+"/loki/api/v1/query", fmt.Sprintf("sum by (service) (count_over_time(%s[%s] offset %s))", selector, window, window), to)
+	if err != nil {
+		return nil, err
+	}
+	baseline := make(map[string]float64, len(before))
+	for _, s := range before {
+		baseline[s.Metric["service"]] = s.Value
+	}
+
+	var found []incident.Evidence
+	for _, s := range current {
+		service, count := s.Metric["service"], s.Value
+		if count < float64(c.cfg.MinErrors) || count < c.cfg.ErrorSpikeFactor*baseline[service] {
+			continue
+		}
+		found = append(found, incident.Evidence{
+			Kind:    KindErrorLogs,
+			Service: service,
+			At:      to,
+			Summary: fmt.Sprintf("%s logged %.0f errors in the %s before, against %.0f in the %s before that", service, count, window, baseline[service], window),
+			Value:   count,
+		})
+	}
+	return found, nil
+}
+
+// backlog reports growth of BacklogQuery over the window of at least
+// MinBacklogGrowth.
+func (c *Correlator) backlog(ctx context.Context, from, to time.Time, _ incident.Incident) ([]incident.Evidence, error) {
+	window := promDuration(to.Sub(from))
+	growth, err := c.query(ctx, c.cfg.PrometheusURL+"/api/v1/query", fmt.Sprintf("sum by (job) (delta((%s)[%s:1m]))", c.cfg.BacklogQuery, window), to)
+	if err != nil {
+		return nil, err
+	}
+	var found []incident.Evidence
+	for _, s := range growth {
+		if s.Value < c.cfg.MinBacklogGrowth || s.Value <= 0 {
+			continue
+		}
+		found = append(found, incident.Evidence{
+			Kind:    KindBacklog,
+			Service: s.Metric["job"],
+			At:      to,
+			Summary: fmt.Sprintf("The backlog of %s grew by %.0f in the %s before", s.Metric["job"], s.Value, window),
+			Value:   s.Value,
+		})
+	}
+	return found, nil
+}
+
+// sample is an entry of an instant query's vector result.
+type sample struct {
+	Metric map[string]string
+	Value  float64
+}
+
+// query runs an instant PromQL or LogQL query at at against the query
+// endpoint of Prometheus or Loki, which answer alike.
+func (c *Correlator) query(ctx context.Context, endpoint, query string, at time.Time) ([]sample, error) {
+	q := url.Values{}
+	q.Set("query", query)
+	q.Set("time", strconv.FormatInt(at.Unix(), 10))
+	var data struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		} `json:"result"`
+	}
+	if err := c.get(ctx, endpoint+"?"+q.Encode(), &data); err != nil {
+		return nil, err
+	}
+	if data.ResultType != "vector" {
+		return nil, fmt.Errorf("query %q returned a %s, not a vector", query, data.ResultType)
+	}
+	samples := make([]sample, 0, len(data.Result))
+	for _, r := range data.Result {
+		v, _ := r.Value[1].(string)
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, sample{Metric: r.Metric, Value: f})
+	}
+	return samples, nil
+}
+
+// get decodes the data of a Prometheus-style {"status", "data"} response.
+func (c *Correlator) get(ctx context.Context, u string, data interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Status string          `json:"status"`
+		Error  string          `json:"error"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	if body.Status != "success" {
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, body.Error)
+	}
+	return json.Unmarshal(body.Data, data)
+}
+
+// promDuration writes d as a PromQL and LogQL duration, such as 30m.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
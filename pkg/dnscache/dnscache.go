@@ -0,0 +1,161 @@
+// Package dnscache caches host lookups for outbound connections. Entries live
+// for TTL; a failed lookup falls back to the expired entry so a DNS blip does
+// not take an upstream down. Callers invalidate a host when connections to it
+// fail, so a service whose pods moved to new IPs is re-resolved on the next
+// dial instead of after the TTL.
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_dns_lookups_total",
+			Help: "Cached host lookups by result: hit, miss (resolved), stale (expired entry used after an error) or error",
+		},
+		[]string{"host", "result"},
+	)
+	lookupDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_dns_lookup_duration_seconds",
+			Help:    "Time taken by DNS lookups that missed the cache",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"host"},
+	)
+	invalidationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_dns_invalidations_total",
+			Help: "Cache entries dropped to force re-resolution after connection errors",
+		},
+		[]string{"host"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(lookupsTotal, lookupDuration, invalidationsTotal)
+}
+
+type entry struct {
+	addrs   []string
+	expires time.Time
+	next    int // round-robin start for Dial
+}
+
+// Resolver is a caching resolver. The zero value is not usable; use New.
+type Resolver struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// New returns a Resolver caching lookups for ttl.
+func New(ttl time.Duration) *Resolver {
+	return &Resolver{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		entries: make(map[string]*entry),
+	}
+}
+
+// LookupHost returns the cached addresses of host, resolving it when the
+// entry is missing or expired.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	if ok && time.Now().Before(e.expires) {
+		addrs := e.addrs
+		r.mu.Unlock()
+		lookupsTotal.WithLabelValues(host, "hit").Inc()
+		return addrs, nil
+	}
+	r.mu.Unlock()
+
+	start := time.Now()
+	addrs, err := r.lookup(ctx, host)
+	lookupDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses for " + host)
+	}
+	if err != nil {
+		if ok {
+			lookupsTotal.WithLabelValues(host, "stale").Inc()
+			return e.addrs, nil
+		}
+		lookupsTotal.WithLabelValues(host, "error").Inc()
+		return nil, err
+	}
+	lookupsTotal.WithLabelValues(host, "miss").Inc()
+
+	r.mu.Lock()
+	r.entries[host] = &entry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// Invalidate forces the next lookup of host to resolve it again.
+func (r *Resolver) Invalidate(host string) {
+	r.mu.Lock()
+	_, ok := r.entries[host]
+	delete(r.entries, host)
+	r.mu.Unlock()
+	if ok {
+		invalidationsTotal.WithLabelValues(host).Inc()
+	}
+}
+
+// DialContext wraps dial to connect to the cached addresses of the host in
+// addr, trying each in turn starting from a rotating offset. When every
+// address fails the host is invalidated.
+func (r *Resolver) DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		start := r.rotate(host, len(addrs))
+		var firstErr error
+		for i := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(addrs[(start+i)%len(addrs)], port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		r.Invalidate(host)
+		return nil, firstErr
+	}
+}
+
+func (r *Resolver) rotate(host string, n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[host]
+	if !ok {
+		return 0
+	}
+	start := e.next % n
+	e.next++
+	return start
+}
@@ -0,0 +1,224 @@
+// Package evict keeps the in-memory stores of the services within a size.
+// A Policy tracks when each entry of a store was last used and picks the
+// entries to move to archive storage: first those unused for longer than
+// the TTL, then the least recently used while the store holds more than
+// MaxEntries. The store does the moving; the policy exports its occupancy
+// and counts the evictions.
+package evict
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Eviction reasons, as given in Victim.Reason and the reason label of
+// pipeline_store_evictions_total.
+const (
+	ReasonTTL      = "ttl"
+	ReasonCapacity = "capacity"
+)
+
+var (
+	entries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_store_entries",
+			Help: "Entries held in memory by a bounded store",
+		},
+		[]string{"store"},
+	)
+	capacity = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_store_capacity",
+			Help: "Entries a bounded store holds in memory before evicting the least recently used (0 for no limit)",
+		},
+		[]string{"store"},
+	)
+	archived = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_store_archived_entries",
+			Help: "Entries a bounded store has moved to archive storage",
+		},
+		[]string{"store"},
+	)
+	evictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_store_evictions_total",
+			Help: "Entries moved from memory to archive storage, by store and reason (ttl or capacity)",
+		},
+		[]string{"store", "reason"},
+	)
+	restores = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_store_restores_total",
+			Help: "Archived entries brought back into memory to be changed",
+		},
+		[]string{"store"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(entries, capacity, archived, evictions, restores)
+}
+
+// Config configures a Policy.
+type Config struct {
+	// MaxEntries is how many entries the store holds in memory; zero is no
+	// limit.
+	MaxEntries int `mapstructure:"max_entries" json:"max_entries"`
+	// TTL is how long an entry may go unused before it is archived; zero
+	// keeps entries until the store is full.
+	TTL time.Duration `mapstructure:"ttl" json:"ttl"`
+}
+
+// Victim is an entry to archive.
+type Victim struct {
+	ID     string
+	Reason string
+}
+
+// Occupancy is the size of a store, as reported by the services' health
+// endpoints.
+type Occupancy struct {
+	Entries    int  `json:"entries"`
+	MaxEntries int  `json:"max_entries,omitempty"`
+	Archived   int  `json:"archived"`
+	Full       bool `json:"full,omitempty"`
+}
+
+// Policy tracks the entries in memory of one store.
+type Policy struct {
+	store string
+	cfg   Config
+
+	mu       sync.Mutex
+	used     map[string]time.Time
+	archived int
+}
+
+// New returns the policy of the store named store.
+func New(store string, cfg Config) *Policy {
+	capacity.WithLabelValues(store).Set(float64(cfg.MaxEntries))
+	entries.WithLabelValues(store).Set(0)
+	archived.WithLabelValues(store).Set(0)
+	for _, reason := range []string{ReasonTTL, ReasonCapacity} {
+		evictions.WithLabelValues(store, reason)
+	}
+	return &Policy{store: store, cfg: cfg, used: make(map[string]time.Time)}
+}
+
+// Touch marks id as in memory and used now.
+func (p *Policy) Touch(id string) {
+	p.TouchAt(id, time.Now())
+}
+
+// TouchAt marks id as in memory and last used at, such as an entry loaded
+// at startup with the time it was last changed.
+func (p *Policy) TouchAt(id string, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if last, ok := p.used[id]; !ok || at.After(last) {
+		p.used[id] = at
+	}
+	entries.WithLabelValues(p.store).Set(float64(len(p.used)))
+}
+
+// Forget drops id, an entry deleted from the store.
+func (p *Policy) Forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, id)
+	entries.WithLabelValues(p.store).Set(float64(len(p.used)))
+}
+
+// Evicted records that id was moved to archive storage for reason.
+func (p *Policy) Evicted(id, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, id)
+	p.archived++
+	entries.WithLabelValues(p.store).Set(float64(len(p.used)))
+	archived.WithLabelValues(p.store).Set(float64(p.archived))
+	evictions.WithLabelValues(p.store, reason).Inc()
+}
+
+// Restored records that id was brought back from archive storage.
+func (p *Policy) Restored(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used[id] = time.Now()
+	if p.archived > 0 {
+		p.archived--
+	}
+	entries.WithLabelValues(p.store).Set(float64(len(p.used)))
+	archived.WithLabelValues(p.store).Set(float64(p.archived))
+	restores.WithLabelValues(p.store).Inc()
+}
+
+// SetArchived sets the number of archived entries, as counted in archive
+// storage at startup or after it was replaced.
+func (p *Policy) SetArchived(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.archived = n
+	archived.WithLabelValues(p.store).Set(float64(n))
+}
+
+// Victims returns the entries to archive at now, oldest first: those unused
+// for longer than the TTL, then the least recently used beyond MaxEntries.
+// Entries evictable reports false for, such as jobs still running, are
+// never returned; the store may hold more than MaxEntries because of them.
+func (p *Policy) Victims(now time.Time, evictable func(id string) bool) []Victim {
+	type use struct {
+		id string
+		at time.Time
+	}
+	p.mu.Lock()
+	list := make([]use, 0, len(p.used))
+	for id, at := range p.used {
+		list = append(list, use{id, at})
+	}
+	p.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].at.Equal(list[j].at) {
+			return list[i].at.Before(list[j].at)
+		}
+		return list[i].id < list[j].id
+	})
+
+	var victims []Victim
+	over := 0
+	if p.cfg.MaxEntries > 0 {
+		over = len(list) - p.cfg.MaxEntries
+	}
+	for _, u := range list {
+		expired := p.cfg.TTL > 0 && now.Sub(u.at) > p.cfg.TTL
+		if !expired && over <= 0 {
+			break
+		}
+		if evictable != nil && !evictable(u.id) {
+			continue
+		}
+		reason := ReasonCapacity
+		if expired {
+			reason = ReasonTTL
+		}
+		victims = append(victims, Victim{ID: u.id, Reason: reason})
+		over--
+	}
+	return victims
+}
+
+// Occupancy returns the size of the store.
+func (p *Policy) Occupancy() Occupancy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Occupancy{
+		Entries:    len(p.used),
+		MaxEntries: p.cfg.MaxEntries,
+		Archived:   p.archived,
+		Full:       p.cfg.MaxEntries > 0 && len(p.used) > p.cfg.MaxEntries,
+	}
+}
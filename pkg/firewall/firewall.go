@@ -0,0 +1,238 @@
+// Package firewall blocks unwanted requests before they reach the handlers:
+// client IPs outside an allowlist or inside a denylist, disallowed methods,
+// requests with too many query parameters and requests whose path, query,
+// headers or body match a blocking rule.
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pipeline/pkg/access"
+)
+
+var blockedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_firewall_blocked_total",
+		Help: "Requests blocked by the firewall, by reason and rule",
+	},
+	[]string{"reason", "rule"},
+)
+
+func init() {
+	prometheus.MustRegister(blockedTotal)
+}
+
+// Block reasons.
+const (
+	ReasonIPDenied     = "ip_denied"
+	ReasonIPNotAllowed = "ip_not_allowed"
+	ReasonMethod       = "method"
+	ReasonQueryParams  = "query_params"
+	ReasonRule         = "rule"
+)
+
+// Parts of a request a rule can inspect.
+const (
+	InPath    = "path"
+	InQuery   = "query"
+	InHeaders = "headers"
+	InBody    = "body"
+)
+
+// Rule blocks requests whose inspected parts match Pattern.
+type Rule struct {
+	Name    string `mapstructure:"name"`
+	Pattern string `mapstructure:"pattern"`
+	// In lists the parts inspected; path, query and body by default.
+	In []string `mapstructure:"in"`
+
+	re *regexp.Regexp
+}
+
+// Config configures a Firewall.
+type Config struct {
+	// AllowCIDRs, when set, is the only networks served. Single addresses
+	// are accepted too.
+	AllowCIDRs []string
+	// DenyCIDRs are never served, even when allowed.
+	DenyCIDRs []string
+	// TrustedProxies are the proxies whose X-Forwarded-For entries are
+	// believed, see access.ClientIP.
+	TrustedProxies []string
+	// DisallowedMethods are answered with 405.
+	DisallowedMethods []string
+	// MaxQueryParams caps the number of query values; zero is unlimited.
+	MaxQueryParams int
+	// MaxBodyBytes is how much of a body rules inspect; 64 KiB by default.
+	MaxBodyBytes int64
+	Rules        []Rule
+	// ExemptPaths skip all checks, e.g. health probes.
+	ExemptPaths []string
+	// OnBlock is called for every blocked request.
+	OnBlock func(r *http.Request, status int, reason, rule string)
+}
+
+// Firewall is the middleware enforcing a Config.
+type Firewall struct {
+	cfg     Config
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	proxies []*net.IPNet
+	methods map[string]bool
+	exempt  map[string]bool
+	rules   []Rule
+}
+
+// New compiles cfg, failing on invalid networks or patterns.
+func New(cfg Config) (*Firewall, error) {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 64 << 10
+	}
+	f := &Firewall{cfg: cfg, methods: make(map[string]bool), exempt: make(map[string]bool)}
+
+	var err error
+	if f.allow, err = access.ParseNetworks(cfg.AllowCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid network: %w", err)
+	}
+	if f.deny, err = access.ParseNetworks(cfg.DenyCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid network: %w", err)
+	}
+	if f.proxies, err = access.ParseNetworks(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid network: %w", err)
+	}
+	for _, m := range cfg.DisallowedMethods {
+		f.methods[strings.ToUpper(m)] = true
+	}
+	for _, p := range cfg.ExemptPaths {
+		f.exempt[p] = true
+	}
+	for i, rule := range cfg.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i)
+		}
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("firewall rule %s: %w", rule.Name, err)
+		}
+		if len(rule.In) == 0 {
+			rule.In = []string{InPath, InQuery, InBody}
+		}
+		for _, in := range rule.In {
+			switch in {
+			case InPath, InQuery, InHeaders, InBody:
+			default:
+				return nil, fmt.Errorf("firewall rule %s: unknown part %q", rule.Name, in)
+			}
+		}
+		f.rules = append(f.rules, rule)
+	}
+	return f, nil
+}
+
+// Wrap returns next behind the firewall.
+func (f *Firewall) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		status, reason, rule := f.check(r)
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		blockedTotal.WithLabelValues(reason, rule).Inc()
+		if f.cfg.OnBlock != nil {
+			f.cfg.OnBlock(r, status, reason, rule)
+		}
+		http.Error(w, http.StatusText(status), status)
+	})
+}
+
+// check returns the status and reason to block r with, or an empty reason.
+func (f *Firewall) check(r *http.Request) (int, string, string) {
+	if len(f.allow) > 0 || len(f.deny) > 0 {
+		ip := access.ClientIP(r, f.proxies)
+		if ip != nil && access.Contains(f.deny, ip) {
+			return http.StatusForbidden, ReasonIPDenied, ""
+		}
+		if len(f.allow) > 0 && (ip == nil || !access.Contains(f.allow, ip)) {
+			return http.StatusForbidden, ReasonIPNotAllowed, ""
+		}
+	}
+	if f.methods[r.Method] {
+		return http.StatusMethodNotAllowed, ReasonMethod, ""
+	}
+	query := r.URL.Query()
+	if f.cfg.MaxQueryParams > 0 {
+		n := 0
+		for _, values := range query {
+			n += len(values)
+		}
+		if n > f.cfg.MaxQueryParams {
+			return http.StatusBadRequest, ReasonQueryParams, ""
+		}
+	}
+	if len(f.rules) == 0 {
+		return 0, "", ""
+	}
+
+	parts := map[string]string{
+		InPath: r.URL.Path,
+	}
+	if q, err := url.QueryUnescape(r.URL.RawQuery); err == nil {
+		parts[InQuery] = q
+	} else {
+		parts[InQuery] = r.URL.RawQuery
+	}
+	for _, rule := range f.rules {
+		for _, in := range rule.In {
+			text, ok := parts[in]
+			if !ok {
+				text = f.part(r, in)
+				parts[in] = text
+			}
+			if rule.re.MatchString(text) {
+				return http.StatusForbidden, ReasonRule, rule.Name
+			}
+		}
+	}
+	return 0, "", ""
+}
+
+// part reads the headers or body of r for inspection. The body is put back
+// so it can still be read by the handler.
+func (f *Firewall) part(r *http.Request, in string) string {
+	switch in {
+	case InHeaders:
+		var b strings.Builder
+		for name, values := range r.Header {
+			for _, v := range values {
+				b.WriteString(name + ": " + v + "\n")
+			}
+		}
+		return b.String()
+	case InBody:
+		if r.Body == nil || r.Body == http.NoBody {
+			return ""
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, f.cfg.MaxBodyBytes))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil {
+			return ""
+		}
+		return string(body)
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFirewallFiltersClientIPs(t *testing.T) {
+	f, err := New(Config{
+		AllowCIDRs:     []string{"192.168.0.0/16"},
+		DenyCIDRs:      []string{"192.168.66.0/24"},
+		TrustedProxies: []string{"10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := f.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		remote, xff string
+		want        int
+	}{
+		{"192.168.1.7:4000", "", http.StatusOK},
+		{"192.168.66.7:4000", "", http.StatusForbidden},
+		{"198.51.100.20:4000", "", http.StatusForbidden},
+		{"10.0.0.1:4000", "192.168.1.7", http.StatusOK},
+		{"10.0.0.1:4000", "192.168.66.7", http.StatusForbidden},
+		// The client put an allowed address in front of the proxy's entry.
+		{"10.0.0.1:4000", "192.168.1.7, 198.51.100.20", http.StatusForbidden},
+		// Only the trusted proxy's header is believed.
+		{"198.51.100.20:4000", "192.168.1.7", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/api/v1/records", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s with X-Forwarded-For %q: status %d, want %d", tc.remote, tc.xff, w.Code, tc.want)
+		}
+	}
+
+	if _, err := New(Config{TrustedProxies: []string{"not-an-ip"}}); err == nil {
+		t.Error("New accepted an invalid trusted proxy")
+	}
+}
@@ -0,0 +1,330 @@
+// Package geoip looks up IP addresses in MaxMind DB (.mmdb) files such as
+// GeoLite2-City or GeoIP2-Country. The whole file is read into memory; a
+// lookup walks the binary search tree to the address's network and decodes
+// the record found there into maps, slices and scalars, as the format's
+// specification (https://maxmind.github.io/MaxMind-DB/) describes.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// ErrInvalidDatabase is wrapped by the errors of malformed files.
+var ErrInvalidDatabase = errors.New("geoip: invalid MaxMind DB")
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    int
+	BuildEpoch   uint64
+	NodeCount    uint32
+	RecordSize   int
+}
+
+// Reader is an opened database. It is safe for concurrent use.
+type Reader struct {
+	meta       Metadata
+	tree       []byte
+	data       []byte
+	ipv4Start  uint32
+	ipv4Depth  int
+	nodeLength int
+}
+
+// Open reads the database at path.
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+// FromBytes opens a database held in b, which must not be modified after.
+func FromBytes(b []byte) (*Reader, error) {
+	at := bytes.LastIndex(b, metadataMarker)
+	if at < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	metaSection := b[at+len(metadataMarker):]
+	v, _, err := (decoder{metaSection}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrInvalidDatabase, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+	uintOf := func(key string) uint64 {
+		n, _ := m[key].(uint64)
+		return n
+	}
+	meta := Metadata{
+		IPVersion:  int(uintOf("ip_version")),
+		BuildEpoch: uintOf("build_epoch"),
+		NodeCount:  uint32(uintOf("node_count")),
+		RecordSize: int(uintOf("record_size")),
+	}
+	meta.DatabaseType, _ = m["database_type"].(string)
+	if meta.RecordSize != 24 && meta.RecordSize != 28 && meta.RecordSize != 32 {
+		return nil, fmt.Errorf("%w: record size %d", ErrInvalidDatabase, meta.RecordSize)
+	}
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: IP version %d", ErrInvalidDatabase, meta.IPVersion)
+	}
+
+	r := &Reader{meta: meta, nodeLength: meta.RecordSize / 4}
+	treeSize := int(meta.NodeCount) * r.nodeLength
+	// The tree is followed by 16 zero bytes, then the data section.
+	if treeSize+16 > at {
+		return nil, fmt.Errorf("%w: search tree exceeds file", ErrInvalidDatabase)
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+16 : at]
+
+	// IPv4 addresses in an IPv6 tree live under ::/96.
+	if meta.IPVersion == 6 {
+		node := uint32(0)
+		for i := 0; i < 96 && node < meta.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start, r.ipv4Depth = node, 96
+	}
+	return r, nil
+}
+
+// Metadata returns the database's metadata.
+func (r *Reader) Metadata() Metadata {
+	return r.meta
+}
+
+func (r *Reader) record(node uint32, bit int) uint32 {
+	b := r.tree[int(node)*r.nodeLength:]
+	switch r.meta.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xF0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0F)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		return binary.BigEndian.Uint32(b[bit*4:])
+	}
+}
+
+// Lookup returns the record of the network containing ip, or nil when the
+// database has none. IPv6 addresses in an IPv4 database have none either.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	addr := ip.To4()
+	node := uint32(0)
+	if addr != nil && r.meta.IPVersion == 6 {
+		node = r.ipv4Start
+	} else if addr == nil {
+		if addr = ip.To16(); addr == nil || r.meta.IPVersion == 4 {
+			return nil, nil
+		}
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.meta.NodeCount; i++ {
+		bit := int(addr[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	switch {
+	case node == r.meta.NodeCount:
+		return nil, nil
+	case node < r.meta.NodeCount:
+		return nil, fmt.Errorf("%w: search tree deeper than the address", ErrInvalidDatabase)
+	}
+	offset := int(node-r.meta.NodeCount) - 16
+	if offset < 0 || offset >= len(r.data) {
+		return nil, fmt.Errorf("%w: record pointer out of range", ErrInvalidDatabase)
+	}
+	v, _, err := (decoder{r.data}).decode(offset, 0)
+	return v, err
+}
+
+// decoder decodes the data section format, in which pointers are offsets
+// into data.
+type decoder struct {
+	data []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth bounds nesting, including pointer chains, in malformed files.
+const maxDepth = 64
+
+func (d decoder) take(offset, n int) ([]byte, error) {
+	if n < 0 || offset+n > len(d.data) {
+		return nil, fmt.Errorf("%w: value exceeds data section", ErrInvalidDatabase)
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// decode decodes the value at offset and returns it with the offset after
+// it.
+func (d decoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("%w: nesting too deep", ErrInvalidDatabase)
+	}
+	b, err := d.take(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := int(ctrl >> 5)
+
+	if typ == typePointer {
+		ss, vvv := int(ctrl>>3)&3, int(ctrl&7)
+		b, err := d.take(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p int
+		switch ss {
+		case 0:
+			p = vvv<<8 | int(b[0])
+		case 1:
+			p = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			p = int(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, offset + ss + 1, err
+	}
+	if typ == typeExtended {
+		b, err := d.take(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(b[0])
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		extra := 0
+		for _, c := range b {
+			extra = extra<<8 | int(c)
+		}
+		size = []int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", ErrInvalidDatabase)
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err = d.take(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double of %d bytes", ErrInvalidDatabase, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float of %d bytes", ErrInvalidDatabase, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: integer of %d bytes", ErrInvalidDatabase, size)
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: int32 of %d bytes", ErrInvalidDatabase, size)
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case typeUint128:
+		n := new(big.Int).SetBytes(b)
+		if n.IsUint64() {
+			return n.Uint64(), offset, nil
+		}
+		return n.String(), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown type %d", ErrInvalidDatabase, typ)
+	}
+}
@@ -0,0 +1,109 @@
+package graphql
+
+// coster estimates the cost of a query as the number of values it resolves.
+// Every field costs 1. The selections of a field with a limit or first
+// argument count once per item it asks for; those of a list field without
+// one count listSize times, unless a field above already asked for a number
+// of items. Sums stop at limit+1 so that nested lists cannot overflow.
+type coster struct {
+	*executor
+	listSize  int
+	limit     int
+	fragments map[costKey]int
+}
+
+type costKey struct {
+	fragment string
+	counted  bool
+}
+
+// cost returns the cost of set on an object of type t. counted is set below
+// a field whose size argument already covers the next list.
+func (c *coster) cost(t *Object, set []Selection, counted bool) int {
+	n := 0
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *Field:
+			if c.included(sel.Directives) {
+				n = c.add(n, c.field(t, sel, counted))
+			}
+		case *InlineFragment:
+			if c.included(sel.Directives) {
+				n = c.add(n, c.cost(c.condition(t, sel.TypeCondition), sel.SelectionSet, counted))
+			}
+		case *FragmentSpread:
+			f := c.doc.Fragments[sel.Name]
+			if f == nil || !c.included(sel.Directives) {
+				continue
+			}
+			key := costKey{sel.Name, counted}
+			cost, ok := c.fragments[key]
+			if !ok {
+				cost = c.cost(c.condition(t, f.TypeCondition), f.SelectionSet, counted)
+				c.fragments[key] = cost
+			}
+			n = c.add(n, cost)
+		}
+	}
+	return n
+}
+
+func (c *coster) field(t *Object, f *Field, counted bool) int {
+	def := c.fieldDefinition(t, f.Name)
+	if def == nil || len(f.SelectionSet) == 0 {
+		return 1
+	}
+	child, _ := named(def.Type).(*Object)
+	if child == nil {
+		return 1
+	}
+
+	items, sized := 1, false
+	if args, err := c.arguments(def, f); err == nil {
+		for _, name := range []string{"limit", "first"} {
+			if size, ok := args[name].(int); ok {
+				items, sized = max(size, 0), true
+				break
+			}
+		}
+	}
+	list := isList(def.Type)
+	childCounted := counted
+	switch {
+	case sized:
+		childCounted = !list
+	case list && counted:
+		childCounted = false
+	case list:
+		items = c.listSize
+	}
+	return c.add(1, c.mul(items, c.cost(child, f.SelectionSet, childCounted)))
+}
+
+// condition returns the type a fragment applies to, t when it names none.
+func (c *coster) condition(t *Object, name string) *Object {
+	if o, ok := c.schema.types[name].(*Object); ok {
+		return o
+	}
+	return t
+}
+
+func (c *coster) add(a, b int) int {
+	return min(a+b, c.limit+1)
+}
+
+func (c *coster) mul(a, b int) int {
+	if a != 0 && b > (c.limit+1)/a {
+		return c.limit + 1
+	}
+	return min(a*b, c.limit+1)
+}
+
+// isList reports whether t is a list, possibly non-null.
+func isList(t Type) bool {
+	if nn, ok := t.(*NonNull); ok {
+		t = nn.Of
+	}
+	_, ok := t.(*List)
+	return ok
+}
@@ -0,0 +1,611 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Request is a GraphQL request as sent in a POST body or GET query.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Response is the result of a request. Data is absent when the request
+// failed before execution, e.g. on a syntax or validation error, and null
+// when a non-null root field failed.
+type Response struct {
+	Data   interface{} `json:"-"`
+	Errors []*Error    `json:"-"`
+
+	executed bool
+}
+
+// MarshalJSON writes {"errors": [...], "data": ...}, with data only for
+// executed requests.
+func (r *Response) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if len(r.Errors) > 0 {
+		errs, err := json.Marshal(r.Errors)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(`"errors":`)
+		buf.Write(errs)
+		if r.executed {
+			buf.WriteByte(',')
+		}
+	}
+	if r.executed {
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(`"data":`)
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Executed reports whether the request got past parsing and validation.
+func (r *Response) Executed() bool {
+	return r.executed
+}
+
+// Error is an entry of a response's errors.
+type Error struct {
+	Message    string                 `json:"message"`
+	Locations  []Location             `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ExtendedError is implemented by resolver errors that carry extensions,
+// e.g. an error code.
+type ExtendedError interface {
+	error
+	Extensions() map[string]interface{}
+}
+
+// Limits bound the work a request may cause.
+type Limits struct {
+	// MaxDepth is how deeply selection sets may nest; 0 for no limit.
+	MaxDepth int
+	// MaxFields is how many fields a query may select, counting every alias
+	// and every spread of a fragment; 0 for no limit.
+	MaxFields int
+	// MaxCost bounds the estimated number of values a query resolves; 0 for
+	// no limit. See cost.
+	MaxCost int
+	// ListSize is the number of items expected from a list field that has
+	// no limit or first argument; DefaultListSize when 0.
+	ListSize int
+}
+
+// DefaultListSize is the ListSize used when Limits leaves it 0.
+const DefaultListSize = 10
+
+// Execute runs the query of req against s.
+func (s *Schema) Execute(ctx context.Context, req Request, limits Limits) *Response {
+	doc, err := Parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{asError(err)}}
+	}
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return &Response{Errors: []*Error{asError(err)}}
+	}
+	if errs := s.validate(doc, limits); len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+	if op.Type != "query" {
+		return &Response{Errors: []*Error{{
+			Message:   fmt.Sprintf("Only queries are supported, not %ss.", op.Type),
+			Locations: []Location{op.Loc},
+		}}}
+	}
+	vars, errs := s.coerceVariables(op, req.Variables)
+	if len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+
+	e := &executor{schema: s, doc: doc, vars: vars}
+	if limits.MaxCost > 0 {
+		listSize := limits.ListSize
+		if listSize <= 0 {
+			listSize = DefaultListSize
+		}
+		c := &coster{executor: e, listSize: listSize, limit: limits.MaxCost, fragments: make(map[costKey]int)}
+		if c.cost(s.Query, op.SelectionSet, false) > limits.MaxCost {
+			return &Response{Errors: []*Error{{
+				Message:   fmt.Sprintf("Query is estimated to resolve more than %d values.", limits.MaxCost),
+				Locations: []Location{op.Loc},
+			}}}
+		}
+	}
+	data, ok := e.executeFields(ctx, s.Query, nil, e.collectFields(s.Query, op.SelectionSet, nil), nil)
+	// Fields resolve concurrently; errors are listed in path order so
+	// responses are stable.
+	sort.SliceStable(e.errors, func(i, j int) bool {
+		return fmt.Sprint(e.errors[i].Path...) < fmt.Sprint(e.errors[j].Path...)
+	})
+	resp := &Response{executed: true, Errors: e.errors}
+	if ok {
+		resp.Data = data
+	}
+	return resp
+}
+
+func asError(err error) *Error {
+	var gqlErr *Error
+	if errors.As(err, &gqlErr) {
+		return gqlErr
+	}
+	return &Error{Message: err.Error()}
+}
+
+func selectOperation(doc *Document, name string) (*Operation, error) {
+	if name == "" {
+		if len(doc.Operations) != 1 {
+			return nil, &Error{Message: "Must provide operationName when the document holds several operations."}
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: fmt.Sprintf("Unknown operation named %q.", name)}
+}
+
+// coerceVariables applies the variable definitions of op to values.
+func (s *Schema) coerceVariables(op *Operation, values map[string]interface{}) (map[string]interface{}, []*Error) {
+	vars := make(map[string]interface{}, len(op.Variables))
+	var errs []*Error
+	for _, def := range op.Variables {
+		t := s.typeOf(def.Type)
+		if t == nil || !isInput(t) {
+			errs = append(errs, &Error{
+				Message:   fmt.Sprintf("Variable \"$%s\" cannot be of type %q.", def.Name, def.Type),
+				Locations: []Location{def.Loc},
+			})
+			continue
+		}
+		v, given := values[def.Name]
+		if !given && def.Default != nil {
+			d, err := literal(t, def.Default, nil)
+			if err == nil {
+				v, err = coerceInput(t, d)
+			}
+			if err != nil {
+				errs = append(errs, &Error{
+					Message:   fmt.Sprintf("Variable \"$%s\" has an invalid default value: %v.", def.Name, err),
+					Locations: []Location{def.Loc},
+				})
+				continue
+			}
+			vars[def.Name] = v
+			continue
+		}
+		if !given {
+			if _, nonNull := t.(*NonNull); nonNull {
+				errs = append(errs, &Error{
+					Message:   fmt.Sprintf("Variable \"$%s\" of required type %q was not provided.", def.Name, def.Type),
+					Locations: []Location{def.Loc},
+				})
+			}
+			continue
+		}
+		c, err := coerceInput(t, v)
+		if err != nil {
+			errs = append(errs, &Error{
+				Message:   fmt.Sprintf("Variable \"$%s\" got an invalid value: %v.", def.Name, err),
+				Locations: []Location{def.Loc},
+			})
+			continue
+		}
+		vars[def.Name] = c
+	}
+	return vars, errs
+}
+
+// typeOf returns the schema type a variable's TypeRef names, or nil.
+func (s *Schema) typeOf(ref *TypeRef) Type {
+	var t Type
+	if ref.Elem != nil {
+		elem := s.typeOf(ref.Elem)
+		if elem == nil {
+			return nil
+		}
+		t = &List{Of: elem}
+	} else {
+		t = s.types[ref.Name]
+		if t == nil {
+			switch ref.Name {
+			case "Int":
+				t = Int
+			case "Float":
+				t = Float
+			case "ID":
+				t = ID
+			default:
+				return nil
+			}
+		}
+	}
+	if ref.NonNull {
+		t = &NonNull{Of: t}
+	}
+	return t
+}
+
+type executor struct {
+	schema *Schema
+	doc    *Document
+	vars   map[string]interface{}
+
+	mu     sync.Mutex
+	errors []*Error
+}
+
+func (e *executor) fail(err error, field *Field, path []interface{}) {
+	gqlErr := &Error{Message: err.Error(), Locations: []Location{field.Loc}, Path: path}
+	var extended ExtendedError
+	if errors.As(err, &extended) {
+		gqlErr.Extensions = extended.Extensions()
+	}
+	e.mu.Lock()
+	e.errors = append(e.errors, gqlErr)
+	e.mu.Unlock()
+}
+
+// fieldGroup is the fields of a selection set under one response key.
+type fieldGroup struct {
+	key    string
+	fields []*Field
+}
+
+// collectFields flattens the fragments of set for objects of type t and
+// groups the fields by response key, in order of first appearance.
+func (e *executor) collectFields(t *Object, set []Selection, visited map[string]bool) []*fieldGroup {
+	var groups []*fieldGroup
+	index := make(map[string]*fieldGroup)
+	var collect func(set []Selection)
+	collect = func(set []Selection) {
+		for _, sel := range set {
+			switch sel := sel.(type) {
+			case *Field:
+				if !e.included(sel.Directives) {
+					continue
+				}
+				g, ok := index[sel.ResponseKey()]
+				if !ok {
+					g = &fieldGroup{key: sel.ResponseKey()}
+					index[g.key] = g
+					groups = append(groups, g)
+				}
+				g.fields = append(g.fields, sel)
+			case *FragmentSpread:
+				if !e.included(sel.Directives) || visited[sel.Name] {
+					continue
+				}
+				if visited == nil {
+					visited = make(map[string]bool)
+				}
+				visited[sel.Name] = true
+				f := e.doc.Fragments[sel.Name]
+				if f == nil || f.TypeCondition != t.Name {
+					continue
+				}
+				collect(f.SelectionSet)
+			case *InlineFragment:
+				if !e.included(sel.Directives) || (sel.TypeCondition != "" && sel.TypeCondition != t.Name) {
+					continue
+				}
+				collect(sel.SelectionSet)
+			}
+		}
+	}
+	collect(set)
+	return groups
+}
+
+// included applies @skip and @include.
+func (e *executor) included(directives []*Directive) bool {
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			continue
+		}
+		cond := false
+		for _, arg := range d.Arguments {
+			if arg.Name == "if" {
+				v, _ := literal(&NonNull{Of: Boolean}, arg.Value, e.vars)
+				cond, _ = v.(bool)
+			}
+		}
+		if (d.Name == "skip") == cond {
+			return false
+		}
+	}
+	return true
+}
+
+// result is an object in the response, with its keys in selection order.
+type result struct {
+	keys   []string
+	values []interface{}
+}
+
+func (r *result) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(r.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// executeFields resolves the field groups of an object concurrently. ok is
+// false when a non-null field failed, so the object itself becomes null.
+func (e *executor) executeFields(ctx context.Context, t *Object, source interface{}, groups []*fieldGroup, path []interface{}) (*result, bool) {
+	res := &result{keys: make([]string, len(groups)), values: make([]interface{}, len(groups))}
+	valid := make([]bool, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		res.keys[i] = g.key
+		fieldPath := appendPath(path, g.key)
+		if g.fields[0].Name == "__typename" {
+			res.values[i], valid[i] = t.Name, true
+			continue
+		}
+		if t == e.schema.Query && (g.fields[0].Name == "__schema" || g.fields[0].Name == "__type") {
+			res.values[i], valid[i] = e.executeField(ctx, t, e.schema.intro.fields[g.fields[0].Name], source, g, fieldPath)
+			continue
+		}
+		def := t.Field(g.fields[0].Name)
+		wg.Add(1)
+		go func(i int, g *fieldGroup) {
+			defer wg.Done()
+			res.values[i], valid[i] = e.executeField(ctx, t, def, source, g, fieldPath)
+		}(i, g)
+	}
+	wg.Wait()
+
+	for i, g := range groups {
+		if valid[i] {
+			continue
+		}
+		if def := e.fieldDefinition(t, g.fields[0].Name); def != nil {
+			if _, nonNull := def.Type.(*NonNull); nonNull {
+				return nil, false
+			}
+		}
+		res.values[i] = nil
+	}
+	return res, true
+}
+
+func (e *executor) fieldDefinition(t *Object, name string) *FieldDefinition {
+	if t == e.schema.Query && (name == "__schema" || name == "__type") {
+		return e.schema.intro.fields[name]
+	}
+	return t.Field(name)
+}
+
+func appendPath(path []interface{}, elem interface{}) []interface{} {
+	p := make([]interface{}, len(path)+1)
+	copy(p, path)
+	p[len(path)] = elem
+	return p
+}
+
+// executeField resolves and completes one field group. ok is false when the
+// field failed and must be null.
+func (e *executor) executeField(ctx context.Context, parent *Object, def *FieldDefinition, source interface{}, g *fieldGroup, path []interface{}) (v interface{}, ok bool) {
+	field := g.fields[0]
+	defer func() {
+		if r := recover(); r != nil {
+			e.fail(fmt.Errorf("internal error resolving %s.%s: %v", parent.Name, def.Name, r), field, path)
+			v, ok = nil, false
+		}
+	}()
+
+	args, err := e.arguments(def, field)
+	if err != nil {
+		e.fail(err, field, path)
+		return nil, false
+	}
+	var resolved interface{}
+	if def.Resolve != nil {
+		resolved, err = def.Resolve(ctx, ResolveParams{Source: source, Args: args, Path: path})
+	} else {
+		resolved, err = defaultResolve(source, def.Name)
+	}
+	if err != nil {
+		e.fail(err, field, path)
+		return nil, false
+	}
+	return e.complete(ctx, def.Type, g, resolved, path)
+}
+
+// arguments coerces the arguments of field to def's, applying defaults.
+func (e *executor) arguments(def *FieldDefinition, field *Field) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(def.Args))
+	for _, argDef := range def.Args {
+		var given *Argument
+		for _, arg := range field.Arguments {
+			if arg.Name == argDef.Name {
+				given = arg
+			}
+		}
+		if given == nil || (given.Value.Kind == VariableValue && !e.hasVar(given.Value.Raw)) {
+			if argDef.Default != nil {
+				args[argDef.Name] = argDef.Default
+			} else if _, nonNull := argDef.Type.(*NonNull); nonNull {
+				return nil, fmt.Errorf("Argument %q of required type %q was not provided.", argDef.Name, argDef.Type)
+			}
+			continue
+		}
+		v, err := literal(argDef.Type, given.Value, e.vars)
+		if err == nil {
+			v, err = coerceInput(argDef.Type, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q has an invalid value: %v.", argDef.Name, err)
+		}
+		args[argDef.Name] = v
+	}
+	return args, nil
+}
+
+func (e *executor) hasVar(name string) bool {
+	_, ok := e.vars[name]
+	return ok
+}
+
+// complete turns a resolved value into its result for type t, resolving the
+// sub-selections of objects. ok is false when the value must be null because
+// of an error that was recorded.
+func (e *executor) complete(ctx context.Context, t Type, g *fieldGroup, v interface{}, path []interface{}) (interface{}, bool) {
+	if nn, isNonNull := t.(*NonNull); isNonNull {
+		c, ok := e.complete(ctx, nn.Of, g, v, path)
+		if !ok {
+			return nil, false
+		}
+		if c == nil {
+			e.fail(fmt.Errorf("Cannot return null for non-nullable field of type %s.", t), g.fields[0], path)
+			return nil, false
+		}
+		return c, true
+	}
+	if isNil(v) {
+		return nil, true
+	}
+
+	switch t := t.(type) {
+	case *List:
+		items := reflect.ValueOf(v)
+		if items.Kind() != reflect.Slice && items.Kind() != reflect.Array {
+			e.fail(fmt.Errorf("Expected a list for field of type %s, got %T.", t, v), g.fields[0], path)
+			return nil, false
+		}
+		out := make([]interface{}, items.Len())
+		valid := make([]bool, items.Len())
+		var wg sync.WaitGroup
+		for i := range out {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				out[i], valid[i] = e.complete(ctx, t.Of, g, items.Index(i).Interface(), appendPath(path, i))
+			}(i)
+		}
+		wg.Wait()
+		_, nonNullItems := t.Of.(*NonNull)
+		for i := range out {
+			if !valid[i] {
+				if nonNullItems {
+					return nil, false
+				}
+				out[i] = nil
+			}
+		}
+		return out, true
+	case *Scalar:
+		c, err := t.Serialize(v)
+		if err != nil {
+			e.fail(err, g.fields[0], path)
+			return nil, false
+		}
+		return c, true
+	case *Enum:
+		s, ok := v.(string)
+		if !ok || !t.has(s) {
+			e.fail(fmt.Errorf("Enum %s cannot represent %v.", t.Name, v), g.fields[0], path)
+			return nil, false
+		}
+		return s, true
+	case *Object:
+		var set []Selection
+		for _, f := range g.fields {
+			set = append(set, f.SelectionSet...)
+		}
+		res, ok := e.executeFields(ctx, t, v, e.collectFields(t, set, nil), path)
+		if !ok {
+			return nil, false
+		}
+		return res, true
+	}
+	e.fail(fmt.Errorf("Unsupported type %s.", t), g.fields[0], path)
+	return nil, false
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// defaultResolve reads field name from a map or from the struct field with
+// that json tag name.
+func defaultResolve(source interface{}, name string) (interface{}, error) {
+	if m, ok := source.(map[string]interface{}); ok {
+		return m[name], nil
+	}
+	rv := reflect.ValueOf(source)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+		v := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !v.IsValid() {
+			return nil, nil
+		}
+		return v.Interface(), nil
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot read field %q of %T", name, source)
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == name || (tag == "" && strings.EqualFold(f.Name, name)) {
+			return rv.Field(i).Interface(), nil
+		}
+	}
+	return nil, nil
+}
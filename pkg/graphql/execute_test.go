@@ -0,0 +1,165 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testSchema serves orders, each with two lines, and a page of them.
+func testSchema(t *testing.T) *Schema {
+	t.Helper()
+	nonNull := func(t Type) Type { return &NonNull{Of: t} }
+	line := &Object{Name: "Line", Fields: []*FieldDefinition{
+		{Name: "sku", Type: String},
+		{Name: "quantity", Type: Int},
+	}}
+	order := &Object{Name: "Order", Fields: []*FieldDefinition{
+		{Name: "id", Type: nonNull(ID)},
+		{Name: "status", Type: String},
+		{Name: "lines", Type: nonNull(&List{Of: nonNull(line)})},
+	}}
+	page := &Object{Name: "OrderPage", Fields: []*FieldDefinition{
+		{Name: "total", Type: nonNull(Int)},
+		{Name: "items", Type: nonNull(&List{Of: nonNull(order)})},
+	}}
+	makeOrder := func(i int) map[string]interface{} {
+		return map[string]interface{}{
+			"id":     fmt.Sprint(i),
+			"status": "pending",
+			"lines":  []interface{}{map[string]interface{}{"sku": "a", "quantity": 1}, map[string]interface{}{"sku": "b", "quantity": 2}},
+		}
+	}
+	query := &Object{Name: "Query", Fields: []*FieldDefinition{
+		{
+			Name: "order",
+			Type: order,
+			Args: []*ArgumentDefinition{{Name: "id", Type: nonNull(ID)}},
+			Resolve: func(_ context.Context, p ResolveParams) (interface{}, error) {
+				var i int
+				fmt.Sscan(p.Args["id"].(string), &i)
+				return makeOrder(i), nil
+			},
+		},
+		{
+			Name: "orders",
+			Type: nonNull(page),
+			Args: []*ArgumentDefinition{{Name: "limit", Type: Int, Default: 10}},
+			Resolve: func(_ context.Context, p ResolveParams) (interface{}, error) {
+				items := []interface{}{}
+				for i := 0; i < p.Args["limit"].(int); i++ {
+					items = append(items, makeOrder(i))
+				}
+				return map[string]interface{}{"total": len(items), "items": items}, nil
+			},
+		},
+		{
+			Name: "recent",
+			Type: nonNull(&List{Of: nonNull(order)}),
+			Resolve: func(_ context.Context, p ResolveParams) (interface{}, error) {
+				return []interface{}{makeOrder(1)}, nil
+			},
+		},
+	}}
+	s, err := NewSchema(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func marshal(t *testing.T, resp *Response) string {
+	t.Helper()
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestExecute(t *testing.T) {
+	s := testSchema(t)
+	resp := s.Execute(context.Background(), Request{
+		Query: `query($n: Int) { orders(limit: $n) { total items { id ...lines } } o: order(id: "7") { status } }
+			fragment lines on Order { lines { sku } }`,
+		Variables: map[string]interface{}{"n": 1},
+	}, Limits{})
+	want := `{"data":{"orders":{"total":1,"items":[{"id":"0","lines":[{"sku":"a"},{"sku":"b"}]}]},"o":{"status":"pending"}}}`
+	if got := marshal(t, resp); got != want {
+		t.Errorf("response = %s\nwant       %s", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := testSchema(t)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`{ orders { nope } }`, `Cannot query field "nope" on type "OrderPage".`},
+		{`{ orders }`, `must have a selection of subfields`},
+		{`{ order(id: "1") { id { x } } }`, `must not have a selection`},
+		{`{ order { id } }`, `"id"`},
+		{`{ orders(limit: "ten") { total } }`, `limit`},
+		{`{ a: order(id: "1") { id } a: recent { id } }`, `Fields "a" conflict`},
+		{`query($x: Int) { recent { id } }`, `Variable "$x" is never used`},
+		{`{ orders(limit: $n) { total } }`, `Variable "$n" is not defined`},
+		{`{ recent { ...a } } fragment a on Order { ...b } fragment b on Order { ...a }`, `fragment`},
+		{`{ recent { id } } fragment unused on Order { id }`, `Fragment "unused" is never used.`},
+		{`{ recent { ... on OrderPage { total } } }`, `can never be of type "OrderPage"`},
+		{`{ recent { id @unknown } }`, `unknown`},
+	}
+	for _, tt := range tests {
+		resp := s.Execute(context.Background(), Request{Query: tt.query}, Limits{})
+		if resp.Executed() || len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, tt.want) {
+			t.Errorf("%s: errors %s, want %q", tt.query, marshal(t, resp), tt.want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s := testSchema(t)
+	aliases := make([]string, 30)
+	for i := range aliases {
+		aliases[i] = fmt.Sprintf("o%d: order(id: \"%d\") { id status }", i, i)
+	}
+	// Each level spreads the one below twice, doubling the fields selected.
+	nested := "{ recent { ...f0 } }\n"
+	for i := 0; i < 30; i++ {
+		nested += fmt.Sprintf("fragment f%d on Order { ...f%d ...f%d }\n", i, i+1, i+1)
+	}
+	nested += "fragment f30 on Order { id }"
+
+	tests := []struct {
+		name   string
+		query  string
+		limits Limits
+		want   string
+	}{
+		{"depth", `{ orders { items { lines { sku } } } }`, Limits{MaxDepth: 3}, "nested 4 levels deep"},
+		{"depth within limit", `{ orders { items { lines { sku } } } }`, Limits{MaxDepth: 4}, ""},
+		{"aliases", "{" + strings.Join(aliases, " ") + "}", Limits{MaxFields: 50}, "more than 50 fields"},
+		{"aliases within limit", "{" + strings.Join(aliases, " ") + "}", Limits{MaxFields: 90}, ""},
+		{"fragment spreads", nested, Limits{MaxFields: 1000}, "more than 1000 fields"},
+		{"limit argument", `{ orders(limit: 100) { items { id lines { sku } } } }`, Limits{MaxCost: 500}, "more than 500 values"},
+		// orders 1 + 20 × (items 1 + id 1 + lines 1 + 10 × sku 1) = 261
+		{"limit argument within cost", `{ orders(limit: 20) { items { id lines { sku } } } }`, Limits{MaxCost: 261}, ""},
+		{"limit variable", `query($n: Int) { orders(limit: $n) { items { id } } }`, Limits{MaxCost: 100}, "more than 100 values"},
+		{"default limit", `{ orders { items { id } } }`, Limits{MaxCost: 30}, ""},
+		// recent 1 + 3 × (id 1 + lines 1 + 3 × sku 1) = 16
+		{"list size", `{ recent { id lines { sku } } }`, Limits{MaxCost: 15, ListSize: 3}, "more than 15 values"},
+		{"skipped fields", `{ recent { id lines @skip(if: true) { sku } } }`, Limits{MaxCost: 21}, ""},
+		{"nested fragments", nested, Limits{MaxCost: 1 << 20}, "more than 1048576 values"},
+	}
+	for _, tt := range tests {
+		resp := s.Execute(context.Background(), Request{Query: tt.query, Variables: map[string]interface{}{"n": 500}}, tt.limits)
+		switch {
+		case tt.want == "" && len(resp.Errors) > 0:
+			t.Errorf("%s: rejected: %s", tt.name, resp.Errors[0].Message)
+		case tt.want != "" && (resp.Executed() || len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, tt.want)):
+			t.Errorf("%s: response %s, want an error containing %q", tt.name, marshal(t, resp), tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// introspection holds the __schema and __type fields of the query type and
+// the introspection types they return.
+type introspection struct {
+	fields map[string]*FieldDefinition
+}
+
+type directiveDefinition struct {
+	Name        string
+	Description string
+	Locations   []string
+	Args        []*ArgumentDefinition
+}
+
+var directives = []*directiveDefinition{
+	{
+		Name:        "include",
+		Description: "Includes this field or fragment only when the if argument is true.",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*ArgumentDefinition{{Name: "if", Description: "Included when true.", Type: &NonNull{Of: Boolean}}},
+	},
+	{
+		Name:        "skip",
+		Description: "Skips this field or fragment when the if argument is true.",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*ArgumentDefinition{{Name: "if", Description: "Skipped when true.", Type: &NonNull{Of: Boolean}}},
+	},
+}
+
+// resolver adapts a function of the source to a ResolveFunc.
+func resolver[S any](fn func(source S, args map[string]interface{}) interface{}) ResolveFunc {
+	return func(ctx context.Context, p ResolveParams) (interface{}, error) {
+		return fn(p.Source.(S), p.Args), nil
+	}
+}
+
+func nonNull(t Type) Type       { return &NonNull{Of: t} }
+func listOf(t Type) Type        { return &List{Of: t} }
+func nonNullListOf(t Type) Type { return nonNull(listOf(nonNull(t))) }
+
+func newIntrospection(s *Schema) *introspection {
+	typeKind := &Enum{
+		Name:        "__TypeKind",
+		Description: "The kind of a __Type.",
+		Values: []*EnumValueDefinition{
+			{Name: "SCALAR"}, {Name: "OBJECT"}, {Name: "INTERFACE"}, {Name: "UNION"},
+			{Name: "ENUM"}, {Name: "INPUT_OBJECT"}, {Name: "LIST"}, {Name: "NON_NULL"},
+		},
+	}
+	directiveLocation := &Enum{
+		Name:        "__DirectiveLocation",
+		Description: "Where a directive may be used.",
+		Values: []*EnumValueDefinition{
+			{Name: "QUERY"}, {Name: "MUTATION"}, {Name: "SUBSCRIPTION"}, {Name: "FIELD"},
+			{Name: "FRAGMENT_DEFINITION"}, {Name: "FRAGMENT_SPREAD"}, {Name: "INLINE_FRAGMENT"},
+			{Name: "VARIABLE_DEFINITION"},
+		},
+	}
+	schemaType := &Object{Name: "__Schema", Description: "The types, root operation types and directives of the schema."}
+	typeType := &Object{Name: "__Type", Description: "A type of the schema, or a list or non-null wrapper of one."}
+	fieldType := &Object{Name: "__Field", Description: "A field of an object type."}
+	inputValueType := &Object{Name: "__InputValue", Description: "An argument of a field or directive."}
+	enumValueType := &Object{Name: "__EnumValue", Description: "A value of an enum type."}
+	directiveType := &Object{Name: "__Directive", Description: "A directive queries may use."}
+
+	includeDeprecated := []*ArgumentDefinition{{Name: "includeDeprecated", Type: Boolean, Default: false}}
+
+	schemaType.Fields = []*FieldDefinition{
+		{Name: "description", Type: String, Resolve: resolver(func(s *Schema, _ map[string]interface{}) interface{} {
+			return nullable(s.Description)
+		})},
+		{Name: "types", Type: nonNullListOf(typeType), Resolve: resolver(func(s *Schema, _ map[string]interface{}) interface{} {
+			types := make([]Type, len(s.names))
+			for i, name := range s.names {
+				types[i] = s.types[name]
+			}
+			return types
+		})},
+		{Name: "queryType", Type: nonNull(typeType), Resolve: resolver(func(s *Schema, _ map[string]interface{}) interface{} {
+			return s.Query
+		})},
+		{Name: "mutationType", Type: typeType, Resolve: resolver(func(*Schema, map[string]interface{}) interface{} {
+			return nil
+		})},
+		{Name: "subscriptionType", Type: typeType, Resolve: resolver(func(*Schema, map[string]interface{}) interface{} {
+			return nil
+		})},
+		{Name: "directives", Type: nonNullListOf(directiveType), Resolve: resolver(func(*Schema, map[string]interface{}) interface{} {
+			return directives
+		})},
+	}
+
+	typeType.Fields = []*FieldDefinition{
+		{Name: "kind", Type: nonNull(typeKind), Resolve: resolver(func(t Type, _ map[string]interface{}) interface{} {
+			switch t.(type) {
+			case *Scalar:
+				return "SCALAR"
+			case *Object:
+				return "OBJECT"
+			case *Enum:
+				return "ENUM"
+			case *List:
+				return "LIST"
+			}
+			return "NON_NULL"
+		})},
+		{Name: "name", Type: String, Resolve: resolver(func(t Type, _ map[string]interface{}) interface{} {
+			switch t.(type) {
+			case *List, *NonNull:
+				return nil
+			}
+			return t.String()
+		})},
+		{Name: "description", Type: String, Resolve: resolver(func(t Type, _ map[string]interface{}) interface{} {
+			switch t := t.(type) {
+			case *Scalar:
+				return nullable(t.Description)
+			case *Object:
+				return nullable(t.Description)
+			case *Enum:
+				return nullable(t.Description)
+			}
+			return nil
+		})},
+		{Name: "specifiedByURL", Type: String, Resolve: resolver(func(Type, map[string]interface{}) interface{} {
+			return nil
+		})},
+		{Name: "fields", Type: listOf(nonNull(fieldType)), Args: includeDeprecated, Resolve: resolver(func(t Type, args map[string]interface{}) interface{} {
+			o, ok := t.(*Object)
+			if !ok {
+				return nil
+			}
+			fields := []*FieldDefinition{}
+			for _, f := range o.Fields {
+				if f.Deprecation == "" || args["includeDeprecated"] == true {
+					fields = append(fields, f)
+				}
+			}
+			return fields
+		})},
+		{Name: "interfaces", Type: listOf(nonNull(typeType)), Resolve: resolver(func(t Type, _ map[string]interface{}) interface{} {
+			if _, ok := t.(*Object); ok {
+				return []Type{}
+			}
+			return nil
+		})},
+		{Name: "possibleTypes", Type: listOf(nonNull(typeType)), Resolve: resolver(func(Type, map[string]interface{}) interface{} {
+			return nil
+		})},
+		{Name: "enumValues", Type: listOf(nonNull(enumValueType)), Args: includeDeprecated, Resolve: resolver(func(t Type, args map[string]interface{}) interface{} {
+			e, ok := t.(*Enum)
+			if !ok {
+				return nil
+			}
+			values := []*EnumValueDefinition{}
+			for _, v := range e.Values {
+				if v.Deprecation == "" || args["includeDeprecated"] == true {
+					values = append(values, v)
+				}
+			}
+			return values
+		})},
+		{Name: "inputFields", Type: listOf(nonNull(inputValueType)), Resolve: resolver(func(Type, map[string]interface{}) interface{} {
+			return nil
+		})},
+		{Name: "ofType", Type: typeType, Resolve: resolver(func(t Type, _ map[string]interface{}) interface{} {
+			switch t := t.(type) {
+			case *List:
+				return t.Of
+			case *NonNull:
+				return t.Of
+			}
+			return nil
+		})},
+	}
+
+	fieldType.Fields = []*FieldDefinition{
+		{Name: "name", Type: nonNull(String)},
+		{Name: "description", Type: String, Resolve: resolver(func(f *FieldDefinition, _ map[string]interface{}) interface{} {
+			return nullable(f.Description)
+		})},
+		{Name: "args", Type: nonNullListOf(inputValueType), Resolve: resolver(func(f *FieldDefinition, _ map[string]interface{}) interface{} {
+			if f.Args == nil {
+				return []*ArgumentDefinition{}
+			}
+			return f.Args
+		})},
+		{Name: "type", Type: nonNull(typeType), Resolve: resolver(func(f *FieldDefinition, _ map[string]interface{}) interface{} {
+			return f.Type
+		})},
+		{Name: "isDeprecated", Type: nonNull(Boolean), Resolve: resolver(func(f *FieldDefinition, _ map[string]interface{}) interface{} {
+			return f.Deprecation != ""
+		})},
+		{Name: "deprecationReason", Type: String, Resolve: resolver(func(f *FieldDefinition, _ map[string]interface{}) interface{} {
+			return nullable(f.Deprecation)
+		})},
+	}
+
+	inputValueType.Fields = []*FieldDefinition{
+		{Name: "name", Type: nonNull(String)},
+		{Name: "description", Type: String, Resolve: resolver(func(a *ArgumentDefinition, _ map[string]interface{}) interface{} {
+			return nullable(a.Description)
+		})},
+		{Name: "type", Type: nonNull(typeType), Resolve: resolver(func(a *ArgumentDefinition, _ map[string]interface{}) interface{} {
+			return a.Type
+		})},
+		{Name: "defaultValue", Type: String, Resolve: resolver(func(a *ArgumentDefinition, _ map[string]interface{}) interface{} {
+			if a.Default == nil {
+				return nil
+			}
+			return printDefault(a.Type, a.Default)
+		})},
+		{Name: "isDeprecated", Type: nonNull(Boolean), Resolve: resolver(func(*ArgumentDefinition, map[string]interface{}) interface{} {
+			return false
+		})},
+		{Name: "deprecationReason", Type: String, Resolve: resolver(func(*ArgumentDefinition, map[string]interface{}) interface{} {
+			return nil
+		})},
+	}
+
+	enumValueType.Fields = []*FieldDefinition{
+		{Name: "name", Type: nonNull(String)},
+		{Name: "description", Type: String, Resolve: resolver(func(v *EnumValueDefinition, _ map[string]interface{}) interface{} {
+			return nullable(v.Description)
+		})},
+		{Name: "isDeprecated", Type: nonNull(Boolean), Resolve: resolver(func(v *EnumValueDefinition, _ map[string]interface{}) interface{} {
+			return v.Deprecation != ""
+		})},
+		{Name: "deprecationReason", Type: String, Resolve: resolver(func(v *EnumValueDefinition, _ map[string]interface{}) interface{} {
+			return nullable(v.Deprecation)
+		})},
+	}
+
+	directiveType.Fields = []*FieldDefinition{
+		{Name: "name", Type: nonNull(String)},
+		{Name: "description", Type: String, Resolve: resolver(func(d *directiveDefinition, _ map[string]interface{}) interface{} {
+			return nullable(d.Description)
+		})},
+		{Name: "locations", Type: nonNullListOf(directiveLocation), Resolve: resolver(func(d *directiveDefinition, _ map[string]interface{}) interface{} {
+			return d.Locations
+		})},
+		{Name: "args", Type: nonNullListOf(inputValueType), Resolve: resolver(func(d *directiveDefinition, _ map[string]interface{}) interface{} {
+			return d.Args
+		})},
+		{Name: "isRepeatable", Type: nonNull(Boolean), Resolve: resolver(func(*directiveDefinition, map[string]interface{}) interface{} {
+			return false
+		})},
+	}
+
+	for _, t := range []Type{schemaType, typeKind, directiveLocation} {
+		if err := s.add(t); err != nil {
+			panic(err)
+		}
+	}
+
+	return &introspection{fields: map[string]*FieldDefinition{
+		"__schema": {
+			Name:    "__schema",
+			Type:    nonNull(schemaType),
+			Resolve: func(context.Context, ResolveParams) (interface{}, error) { return s, nil },
+		},
+		"__type": {
+			Name: "__type",
+			Type: typeType,
+			Args: []*ArgumentDefinition{{Name: "name", Type: nonNull(String)}},
+			Resolve: func(_ context.Context, p ResolveParams) (interface{}, error) {
+				if t := s.types[p.Args["name"].(string)]; t != nil {
+					return t, nil
+				}
+				return nil, nil
+			},
+		},
+	}}
+}
+
+// nullable returns nil for "" so empty descriptions are null.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// printDefault prints a default value in query syntax, as
+// __InputValue.defaultValue is.
+func printDefault(t Type, v interface{}) string {
+	if nn, ok := t.(*NonNull); ok {
+		t = nn.Of
+	}
+	switch t := t.(type) {
+	case *Enum:
+		return fmt.Sprint(v)
+	case *List:
+		items, ok := v.([]interface{})
+		if !ok {
+			return printDefault(t.Of, v)
+		}
+		printed := make([]string, len(items))
+		for i, item := range items {
+			printed[i] = printDefault(t.Of, item)
+		}
+		return "[" + strings.Join(printed, ", ") + "]"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,99 @@
+package graphql
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchFunc fetches the values of keys in one call. Keys missing from the
+// returned map load the zero value; an error fails every key of the batch.
+type BatchFunc[K comparable, V any] func(ctx context.Context, keys []K) (map[K]V, error)
+
+// Loader batches and caches loads of one kind of value, dataloader style.
+// Loads made within Wait of the first one of a batch are fetched with a
+// single call to the batch function, so resolving a field of every item of
+// a list costs one upstream request rather than one per item. Every key is
+// fetched at most once; Loaders are meant to live for one request.
+type Loader[K comparable, V any] struct {
+	fetch    BatchFunc[K, V]
+	wait     time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	cache   map[K]*load[V]
+	pending *batch[K, V]
+}
+
+// load is the result of one key, ready once done is closed.
+type load[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+type batch[K comparable, V any] struct {
+	keys  []K
+	loads []*load[V]
+	timer *time.Timer
+}
+
+// NewLoader returns a Loader that fetches batches of up to maxBatch keys (0
+// for no limit), waiting up to wait for a batch to fill.
+func NewLoader[K comparable, V any](fetch BatchFunc[K, V], wait time.Duration, maxBatch int) *Loader[K, V] {
+	return &Loader[K, V]{fetch: fetch, wait: wait, maxBatch: maxBatch, cache: make(map[K]*load[V])}
+}
+
+// Load returns the value of key. The batch it joins is fetched with the ctx
+// of the batch's first Load.
+func (l *Loader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	l.mu.Lock()
+	ld, cached := l.cache[key]
+	if !cached {
+		ld = &load[V]{done: make(chan struct{})}
+		l.cache[key] = ld
+		if l.pending == nil {
+			b := &batch[K, V]{}
+			l.pending = b
+			b.timer = time.AfterFunc(l.wait, func() { l.dispatch(ctx, b) })
+		}
+		b := l.pending
+		b.keys = append(b.keys, key)
+		b.loads = append(b.loads, ld)
+		if l.maxBatch > 0 && len(b.keys) >= l.maxBatch {
+			b.timer.Stop()
+			l.pending = nil
+			go l.run(ctx, b)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-ld.done:
+		return ld.value, ld.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// dispatch runs b when its wait is over, unless it already ran full.
+func (l *Loader[K, V]) dispatch(ctx context.Context, b *batch[K, V]) {
+	l.mu.Lock()
+	if l.pending != b {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = nil
+	l.mu.Unlock()
+	l.run(ctx, b)
+}
+
+func (l *Loader[K, V]) run(ctx context.Context, b *batch[K, V]) {
+	values, err := l.fetch(ctx, b.keys)
+	for i, key := range b.keys {
+		ld := b.loads[i]
+		ld.value, ld.err = values[key], err
+		close(ld.done)
+	}
+}
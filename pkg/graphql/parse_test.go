@@ -0,0 +1,100 @@
+package graphql
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		# comment
+		query Orders($status: String = "pending", $ids: [ID!]!) @cached {
+			first: orders(limit: 5, filter: {status: $status, tags: ["a", "b"]}) {
+				...orderFields
+				... on Order @include(if: true) { id }
+			}
+		}
+		fragment orderFields on Order { id status note: comment(text: """
+			block
+			  string
+		""") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Operations) != 1 || len(doc.Fragments) != 1 {
+		t.Fatalf("%d operations, %d fragments", len(doc.Operations), len(doc.Fragments))
+	}
+	op := doc.Operations[0]
+	if op.Type != "query" || op.Name != "Orders" || len(op.Directives) != 1 || op.Loc != (Location{Line: 3, Column: 3}) {
+		t.Errorf("operation = %+v", op)
+	}
+	if len(op.Variables) != 2 || op.Variables[0].Default.Raw != "pending" || op.Variables[1].Type.String() != "[ID!]!" {
+		t.Errorf("variables = %+v, %+v", op.Variables[0], op.Variables[1])
+	}
+
+	field := op.SelectionSet[0].(*Field)
+	if field.Alias != "first" || field.Name != "orders" || field.ResponseKey() != "first" || len(field.Arguments) != 2 {
+		t.Fatalf("field = %+v", field)
+	}
+	filter := field.Arguments[1].Value
+	if filter.Kind != ObjectValue || filter.Fields[0].Value.Kind != VariableValue || filter.Fields[0].Value.Raw != "status" || len(filter.Fields[1].Value.List) != 2 {
+		t.Errorf("filter = %+v", filter)
+	}
+	if spread, ok := field.SelectionSet[0].(*FragmentSpread); !ok || spread.Name != "orderFields" {
+		t.Errorf("first selection = %+v", field.SelectionSet[0])
+	}
+	if inline, ok := field.SelectionSet[1].(*InlineFragment); !ok || inline.TypeCondition != "Order" || inline.Directives[0].Name != "include" {
+		t.Errorf("second selection = %+v", field.SelectionSet[1])
+	}
+
+	note := doc.Fragments["orderFields"].SelectionSet[2].(*Field)
+	if got := note.Arguments[0].Value.Raw; got != "block\n  string" {
+		t.Errorf("block string = %q", got)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	doc, err := Parse(`{ f(a: -12, b: 1.5e3, c: "tab\tq\"é", d: null, e: RED, f: false) }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		kind int
+		raw  string
+	}{{IntValue, "-12"}, {FloatValue, "1.5e3"}, {StringValue, "tab\tq\"é"}, {NullValue, "null"}, {EnumValue, "RED"}, {BooleanValue, "false"}}
+	args := doc.Operations[0].SelectionSet[0].(*Field).Arguments
+	for i, w := range want {
+		if args[i].Value.Kind != w.kind || args[i].Value.Raw != w.raw {
+			t.Errorf("argument %s = kind %d %q, want kind %d %q", args[i].Name, args[i].Value.Kind, args[i].Value.Raw, w.kind, w.raw)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		loc   Location
+	}{
+		{"", "no operations", Location{1, 1}},
+		{"{ orders { id }", "expected a name, found <EOF>", Location{1, 16}},
+		{"{ orders(limit: ) { id } }", `unexpected ")"`, Location{1, 17}},
+		{"query ($a: ) { a }", "expected a name", Location{1, 12}},
+		{`{ a(s: "unterminated) }`, "unterminated string", Location{1, 24}},
+		{"{ a }\nfragment f on A { a }\nfragment f on A { a }", `only one fragment named "f"`, Location{3, 1}},
+		{"{ a(n: 01) }", "unexpected digit after 0", Location{1, 9}},
+		{"type Order { id: ID }", `unexpected "type"`, Location{1, 1}},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.query)
+		var gqlErr *Error
+		if !errors.As(err, &gqlErr) {
+			t.Errorf("Parse(%q) = %v, want a syntax error", tt.query, err)
+			continue
+		}
+		if !strings.Contains(gqlErr.Message, tt.want) || len(gqlErr.Locations) != 1 || gqlErr.Locations[0] != tt.loc {
+			t.Errorf("Parse(%q) = %q at %v, want %q at %v", tt.query, gqlErr.Message, gqlErr.Locations, tt.want, tt.loc)
+		}
+	}
+}
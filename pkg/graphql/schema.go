@@ -0,0 +1,485 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Type is a GraphQL output or input type: *Scalar, *Enum, *Object, *List or
+// *NonNull.
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type. Serialize converts a resolved value to its result
+// value; ParseValue coerces an argument or variable value, which arrives as
+// decoded JSON (with numbers as json.Number) or as a literal converted by
+// the parser (int64, float64, string, bool).
+type Scalar struct {
+	Name        string
+	Description string
+	Serialize   func(v interface{}) (interface{}, error)
+	ParseValue  func(v interface{}) (interface{}, error)
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// Enum is a leaf type whose values are a fixed set of names; they resolve
+// from and coerce to strings.
+type Enum struct {
+	Name        string
+	Description string
+	Values      []*EnumValueDefinition
+}
+
+func (e *Enum) String() string { return e.Name }
+
+// EnumValueDefinition is a value of an Enum.
+type EnumValueDefinition struct {
+	Name        string
+	Description string
+	// Deprecation, if set, is the reason the value is deprecated.
+	Deprecation string
+}
+
+func (e *Enum) has(name string) bool {
+	for _, v := range e.Values {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Object is an object type. Its fields are resolved concurrently.
+type Object struct {
+	Name        string
+	Description string
+	Fields      []*FieldDefinition
+}
+
+func (o *Object) String() string { return o.Name }
+
+// Field returns the field named name, or nil.
+func (o *Object) Field(name string) *FieldDefinition {
+	for _, f := range o.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// List is a list of Of.
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+// NonNull is Of without null.
+type NonNull struct {
+	Of Type
+}
+
+func (n *NonNull) String() string { return n.Of.String() + "!" }
+
+// ResolveFunc resolves a field of p.Source.
+type ResolveFunc func(ctx context.Context, p ResolveParams) (interface{}, error)
+
+// ResolveParams are the inputs of a ResolveFunc.
+type ResolveParams struct {
+	// Source is the resolved value of the object the field belongs to; nil
+	// for the fields of the query type.
+	Source interface{}
+	// Args are the coerced arguments, with defaults applied. Arguments that
+	// were omitted and have no default are absent.
+	Args map[string]interface{}
+	// Path is the response path of the field, e.g. ["orders", "items", 0].
+	Path []interface{}
+}
+
+// FieldDefinition is a field of an Object.
+type FieldDefinition struct {
+	Name        string
+	Description string
+	Type        Type
+	Args        []*ArgumentDefinition
+	// Resolve resolves the field. Without it the field is read from the
+	// source: a map key or the struct field with that json tag name.
+	Resolve ResolveFunc
+	// Deprecation, if set, is the reason the field is deprecated.
+	Deprecation string
+}
+
+// ArgumentDefinition is an argument of a field or directive.
+type ArgumentDefinition struct {
+	Name        string
+	Description string
+	Type        Type
+	// Default is the value used when the argument is omitted; nil for
+	// none.
+	Default interface{}
+}
+
+// Built-in scalars.
+var (
+	Int = &Scalar{
+		Name:        "Int",
+		Description: "A signed 32-bit integer.",
+		Serialize:   coerceInt,
+		ParseValue:  coerceInt,
+	}
+	Float = &Scalar{
+		Name:        "Float",
+		Description: "A double-precision floating point number.",
+		Serialize:   coerceFloat,
+		ParseValue:  coerceFloat,
+	}
+	String = &Scalar{
+		Name:        "String",
+		Description: "UTF-8 text.",
+		Serialize:   serializeString,
+		ParseValue:  parseString,
+	}
+	Boolean = &Scalar{
+		Name:        "Boolean",
+		Description: "true or false.",
+		Serialize:   coerceBoolean,
+		ParseValue:  coerceBoolean,
+	}
+	ID = &Scalar{
+		Name:        "ID",
+		Description: "A unique identifier, serialized as a string.",
+		Serialize:   serializeString,
+		ParseValue:  parseID,
+	}
+)
+
+func coerceInt(v interface{}) (interface{}, error) {
+	var n float64
+	switch v := v.(type) {
+	case int:
+		n = float64(v)
+	case int32:
+		n = float64(v)
+	case int64:
+		n = float64(v)
+	case float64:
+		n = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("Int cannot represent %q", v.String())
+		}
+		n = f
+	default:
+		return nil, fmt.Errorf("Int cannot represent a non-integer value: %v", v)
+	}
+	if n != math.Trunc(n) || n > math.MaxInt32 || n < math.MinInt32 {
+		return nil, fmt.Errorf("Int cannot represent %v: not a 32-bit integer", n)
+	}
+	return int(n), nil
+}
+
+func coerceFloat(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("Float cannot represent %v", v)
+		}
+		return v, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("Float cannot represent %q", v.String())
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("Float cannot represent a non-numeric value: %v", v)
+}
+
+func serializeString(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case fmt.Stringer:
+		return v.String(), nil
+	case bool, int, int32, int64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return nil, fmt.Errorf("String cannot represent %T", v)
+}
+
+func parseString(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("String cannot represent a non-string value: %v", v)
+}
+
+func parseID(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int, int64:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String(), nil
+		}
+	}
+	return nil, fmt.Errorf("ID cannot represent %v", v)
+}
+
+func coerceBoolean(v interface{}) (interface{}, error) {
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("Boolean cannot represent a non-boolean value: %v", v)
+}
+
+// Schema is an executable schema: a query type and the types reachable from
+// it. Mutations and subscriptions are not supported.
+type Schema struct {
+	Query       *Object
+	Description string
+
+	types map[string]Type
+	// names lists the types in the order they were found, for
+	// introspection.
+	names []string
+	intro *introspection
+}
+
+var nameRE = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// NewSchema checks the types reachable from query and returns the schema of
+// queries against it.
+func NewSchema(query *Object) (*Schema, error) {
+	s := &Schema{Query: query, types: make(map[string]Type)}
+	for _, t := range []Type{String, Boolean} {
+		if err := s.add(t); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.add(query); err != nil {
+		return nil, err
+	}
+	for _, name := range s.names {
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("graphql: type name %q is reserved for introspection", name)
+		}
+	}
+	s.intro = newIntrospection(s)
+	return s, nil
+}
+
+// add registers t and the types it references.
+func (s *Schema) add(t Type) error {
+	switch t := t.(type) {
+	case *List:
+		return s.add(t.Of)
+	case *NonNull:
+		if _, ok := t.Of.(*NonNull); ok {
+			return fmt.Errorf("graphql: %s: non-null of a non-null type", t)
+		}
+		return s.add(t.Of)
+	}
+
+	name := t.String()
+	if !nameRE.MatchString(name) {
+		return fmt.Errorf("graphql: invalid type name %q", name)
+	}
+	if existing, ok := s.types[name]; ok {
+		if existing != t {
+			return fmt.Errorf("graphql: two types are named %q", name)
+		}
+		return nil
+	}
+	s.types[name] = t
+	s.names = append(s.names, name)
+
+	switch t := t.(type) {
+	case *Object:
+		if len(t.Fields) == 0 {
+			return fmt.Errorf("graphql: %s has no fields", name)
+		}
+		seen := make(map[string]bool)
+		for _, f := range t.Fields {
+			if !nameRE.MatchString(f.Name) || seen[f.Name] {
+				return fmt.Errorf("graphql: %s: invalid or duplicate field name %q", name, f.Name)
+			}
+			seen[f.Name] = true
+			if err := s.add(f.Type); err != nil {
+				return err
+			}
+			for _, arg := range f.Args {
+				if !isInput(arg.Type) {
+					return fmt.Errorf("graphql: %s.%s(%s:): %s is not an input type", name, f.Name, arg.Name, arg.Type)
+				}
+				if err := s.add(arg.Type); err != nil {
+					return err
+				}
+			}
+		}
+	case *Enum:
+		if len(t.Values) == 0 {
+			return fmt.Errorf("graphql: enum %s has no values", name)
+		}
+		for _, v := range t.Values {
+			if !nameRE.MatchString(v.Name) || v.Name == "true" || v.Name == "false" || v.Name == "null" {
+				return fmt.Errorf("graphql: enum %s: invalid value %q", name, v.Name)
+			}
+		}
+	case *Scalar:
+		if t.Serialize == nil || t.ParseValue == nil {
+			return fmt.Errorf("graphql: scalar %s needs Serialize and ParseValue", name)
+		}
+	}
+	return nil
+}
+
+// Type returns the named type, or nil.
+func (s *Schema) Type(name string) Type {
+	return s.types[name]
+}
+
+// named strips the List and NonNull wrappers of t.
+func named(t Type) Type {
+	for {
+		switch w := t.(type) {
+		case *List:
+			t = w.Of
+		case *NonNull:
+			t = w.Of
+		default:
+			return t
+		}
+	}
+}
+
+func isLeaf(t Type) bool {
+	switch named(t).(type) {
+	case *Scalar, *Enum:
+		return true
+	}
+	return false
+}
+
+// isInput reports whether t may be used for arguments and variables: only
+// leaf types, since input objects are not supported.
+func isInput(t Type) bool {
+	return isLeaf(t)
+}
+
+// coerceInput coerces v, a variable value or converted literal, to the input
+// type t.
+func coerceInput(t Type, v interface{}) (interface{}, error) {
+	if nn, ok := t.(*NonNull); ok {
+		if v == nil {
+			return nil, fmt.Errorf("expected a non-null %s", nn.Of)
+		}
+		return coerceInput(nn.Of, v)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch t := t.(type) {
+	case *List:
+		items, ok := v.([]interface{})
+		if !ok {
+			// A single value is coerced to a list of one.
+			item, err := coerceInput(t.Of, v)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			c, err := coerceInput(t.Of, item)
+			if err != nil {
+				return nil, fmt.Errorf("at index %d: %w", i, err)
+			}
+			out[i] = c
+		}
+		return out, nil
+	case *Enum:
+		if s, ok := v.(string); ok && t.has(s) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("value %v does not exist in enum %s", v, t.Name)
+	case *Scalar:
+		return t.ParseValue(v)
+	}
+	return nil, fmt.Errorf("%s is not an input type", t)
+}
+
+// literal converts an AST value to the Go value coerceInput takes, reading
+// variables from vars. Enum literals must be used for enum types and only
+// there.
+func literal(t Type, v *Value, vars map[string]interface{}) (interface{}, error) {
+	if v.Kind == VariableValue {
+		return vars[v.Raw], nil
+	}
+	if nn, ok := t.(*NonNull); ok {
+		t = nn.Of
+	}
+	switch v.Kind {
+	case NullValue:
+		return nil, nil
+	case IntValue:
+		n, err := strconv.ParseInt(v.Raw, 10, 64)
+		if err != nil {
+			f, _ := strconv.ParseFloat(v.Raw, 64)
+			return f, nil
+		}
+		return n, nil
+	case FloatValue:
+		if _, isScalar := t.(*Scalar); !isScalar || t == Int {
+			return nil, fmt.Errorf("%s cannot represent %s", t, v.Raw)
+		}
+		return strconv.ParseFloat(v.Raw, 64)
+	case StringValue:
+		if _, isEnum := t.(*Enum); isEnum {
+			return nil, fmt.Errorf("enum %s takes unquoted values, not %q", t, v.Raw)
+		}
+		return v.Raw, nil
+	case BooleanValue:
+		return v.Raw == "true", nil
+	case EnumValue:
+		if _, isEnum := t.(*Enum); !isEnum {
+			return nil, fmt.Errorf("%s cannot represent %s", t, v.Raw)
+		}
+		return v.Raw, nil
+	case ListValue:
+		var elem Type = t
+		if l, ok := t.(*List); ok {
+			elem = l.Of
+		}
+		items := make([]interface{}, len(v.List))
+		for i, item := range v.List {
+			c, err := literal(elem, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = c
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%s cannot represent an object", t)
+}
@@ -0,0 +1,482 @@
+package graphql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// validate checks doc against the schema as the specification's validation
+// rules do for the features supported here: known fields, arguments,
+// fragments, directives and variables; leaf and composite selections;
+// fragment cycles; mergeable fields; and limits.MaxDepth and MaxFields.
+func (s *Schema) validate(doc *Document, limits Limits) []*Error {
+	v := &validator{schema: s, doc: doc}
+
+	names := make(map[string]bool)
+	for _, op := range doc.Operations {
+		if op.Name == "" && len(doc.Operations) > 1 {
+			v.errorf(op.Loc, "This anonymous operation must be the only defined operation.")
+		}
+		if op.Name != "" && names[op.Name] {
+			v.errorf(op.Loc, "There can be only one operation named %q.", op.Name)
+		}
+		names[op.Name] = true
+	}
+
+	// Fragments are checked against their type condition once; cycles are
+	// reported first since the other checks expand spreads.
+	v.checkFragmentCycles()
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	fragmentNames := make([]string, 0, len(doc.Fragments))
+	for name := range doc.Fragments {
+		fragmentNames = append(fragmentNames, name)
+	}
+	sort.Strings(fragmentNames)
+	for _, name := range fragmentNames {
+		f := doc.Fragments[name]
+		t, ok := s.types[f.TypeCondition].(*Object)
+		if !ok {
+			v.errorf(f.Loc, "Fragment %q cannot condition on non-object type %q.", f.Name, f.TypeCondition)
+			continue
+		}
+		v.checkDirectives(f.Directives, "FRAGMENT_DEFINITION")
+		v.checkSelectionSet(t, f.SelectionSet)
+	}
+
+	used := make(map[string]bool)
+	for _, op := range doc.Operations {
+		v.checkDirectives(op.Directives, "QUERY")
+		if op.Type == "query" {
+			v.checkSelectionSet(s.Query, op.SelectionSet)
+		}
+
+		defined := make(map[string]bool)
+		for _, def := range op.Variables {
+			if defined[def.Name] {
+				v.errorf(def.Loc, "There can be only one variable named \"$%s\".", def.Name)
+			}
+			defined[def.Name] = true
+			if t := s.typeOf(def.Type); t == nil || !isInput(t) {
+				v.errorf(def.Loc, "Variable \"$%s\" cannot be of type %q.", def.Name, def.Type)
+			}
+		}
+		usages := make(map[string]Location)
+		v.walk(op.SelectionSet, make(map[string]bool), used, func(value *Value) {
+			collectVariables(value, usages)
+		})
+		for _, d := range op.Directives {
+			for _, arg := range d.Arguments {
+				collectVariables(arg.Value, usages)
+			}
+		}
+		usedNames := make([]string, 0, len(usages))
+		for name := range usages {
+			usedNames = append(usedNames, name)
+		}
+		sort.Strings(usedNames)
+		for _, name := range usedNames {
+			if !defined[name] {
+				v.errorf(usages[name], "Variable \"$%s\" is not defined by operation %q.", name, op.Name)
+			}
+		}
+		for _, def := range op.Variables {
+			if _, ok := usages[def.Name]; !ok {
+				v.errorf(def.Loc, "Variable \"$%s\" is never used in operation %q.", def.Name, op.Name)
+			}
+		}
+
+		if limits.MaxDepth > 0 {
+			if depth := v.depth(op.SelectionSet, make(map[string]bool)); depth > limits.MaxDepth {
+				v.errorf(op.Loc, "Query is nested %d levels deep, more than the limit of %d.", depth, limits.MaxDepth)
+			}
+		}
+		if limits.MaxFields > 0 {
+			if v.fields(op.SelectionSet, make(map[string]int), limits.MaxFields) > limits.MaxFields {
+				v.errorf(op.Loc, "Query selects more than %d fields.", limits.MaxFields)
+			}
+		}
+	}
+	for _, name := range fragmentNames {
+		if !used[name] {
+			v.errorf(doc.Fragments[name].Loc, "Fragment %q is never used.", name)
+		}
+	}
+	return v.errors
+}
+
+type validator struct {
+	schema *Schema
+	doc    *Document
+	errors []*Error
+}
+
+func (v *validator) errorf(loc Location, format string, args ...interface{}) {
+	v.errors = append(v.errors, &Error{Message: fmt.Sprintf(format, args...), Locations: []Location{loc}})
+}
+
+// field returns the definition of field name of t, including the
+// introspection fields of the query type.
+func (v *validator) field(t *Object, name string) *FieldDefinition {
+	if t == v.schema.Query {
+		if f := v.schema.intro.fields[name]; f != nil {
+			return f
+		}
+	}
+	return t.Field(name)
+}
+
+func (v *validator) checkSelectionSet(t *Object, set []Selection) {
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *Field:
+			v.checkDirectives(sel.Directives, "FIELD")
+			if sel.Name == "__typename" {
+				if len(sel.SelectionSet) > 0 {
+					v.errorf(sel.Loc, "Field \"__typename\" must not have a selection since type \"String!\" has no subfields.")
+				}
+				continue
+			}
+			def := v.field(t, sel.Name)
+			if def == nil {
+				v.errorf(sel.Loc, "Cannot query field %q on type %q.", sel.Name, t.Name)
+				continue
+			}
+			v.checkArguments(fmt.Sprintf("field \"%s.%s\"", t.Name, def.Name), def.Args, sel.Arguments, sel.Loc)
+			if obj, ok := named(def.Type).(*Object); ok {
+				if len(sel.SelectionSet) == 0 {
+					v.errorf(sel.Loc, "Field %q of type %q must have a selection of subfields.", sel.Name, def.Type)
+					continue
+				}
+				v.checkSelectionSet(obj, sel.SelectionSet)
+			} else if len(sel.SelectionSet) > 0 {
+				v.errorf(sel.Loc, "Field %q must not have a selection since type %q has no subfields.", sel.Name, def.Type)
+			}
+		case *FragmentSpread:
+			v.checkDirectives(sel.Directives, "FRAGMENT_SPREAD")
+			f := v.doc.Fragments[sel.Name]
+			if f == nil {
+				v.errorf(sel.Loc, "Unknown fragment %q.", sel.Name)
+			} else if f.TypeCondition != t.Name {
+				v.errorf(sel.Loc, "Fragment %q cannot be spread here as objects of type %q can never be of type %q.", sel.Name, t.Name, f.TypeCondition)
+			}
+		case *InlineFragment:
+			v.checkDirectives(sel.Directives, "INLINE_FRAGMENT")
+			if sel.TypeCondition != "" && sel.TypeCondition != t.Name {
+				if _, ok := v.schema.types[sel.TypeCondition].(*Object); !ok {
+					v.errorf(sel.Loc, "Unknown type %q.", sel.TypeCondition)
+				} else {
+					v.errorf(sel.Loc, "Fragment cannot be spread here as objects of type %q can never be of type %q.", t.Name, sel.TypeCondition)
+				}
+				continue
+			}
+			v.checkSelectionSet(t, sel.SelectionSet)
+		}
+	}
+	v.checkMergeable(t, set)
+}
+
+// checkMergeable reports fields of set under the same response key that
+// select different fields or arguments.
+func (v *validator) checkMergeable(t *Object, set []Selection) {
+	seen := make(map[string]*Field)
+	var check func(set []Selection, visited map[string]bool)
+	check = func(set []Selection, visited map[string]bool) {
+		for _, sel := range set {
+			switch sel := sel.(type) {
+			case *Field:
+				other, ok := seen[sel.ResponseKey()]
+				if !ok {
+					seen[sel.ResponseKey()] = sel
+					continue
+				}
+				if other.Name != sel.Name {
+					v.errorf(sel.Loc, "Fields %q conflict because %q and %q are different fields.", sel.ResponseKey(), other.Name, sel.Name)
+				} else if printArguments(other.Arguments) != printArguments(sel.Arguments) {
+					v.errorf(sel.Loc, "Fields %q conflict because they have differing arguments.", sel.ResponseKey())
+				}
+			case *FragmentSpread:
+				if f := v.doc.Fragments[sel.Name]; f != nil && f.TypeCondition == t.Name && !visited[sel.Name] {
+					visited[sel.Name] = true
+					check(f.SelectionSet, visited)
+				}
+			case *InlineFragment:
+				if sel.TypeCondition == "" || sel.TypeCondition == t.Name {
+					check(sel.SelectionSet, visited)
+				}
+			}
+		}
+	}
+	check(set, make(map[string]bool))
+}
+
+func printArguments(args []*Argument) string {
+	printed := make([]string, len(args))
+	for i, arg := range args {
+		printed[i] = arg.Name + ":" + printValue(arg.Value)
+	}
+	sort.Strings(printed)
+	return strings.Join(printed, ",")
+}
+
+func printValue(v *Value) string {
+	switch v.Kind {
+	case VariableValue:
+		return "$" + v.Raw
+	case StringValue:
+		return fmt.Sprintf("%q", v.Raw)
+	case ListValue:
+		items := make([]string, len(v.List))
+		for i, item := range v.List {
+			items[i] = printValue(item)
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case ObjectValue:
+		fields := make([]string, len(v.Fields))
+		for i, f := range v.Fields {
+			fields[i] = f.Name + ":" + printValue(f.Value)
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	}
+	return v.Raw
+}
+
+// checkArguments checks the arguments given to a field or directive
+// against its definitions. Literal values are coerced; variables are
+// checked when the request's variables are.
+func (v *validator) checkArguments(of string, defs []*ArgumentDefinition, args []*Argument, loc Location) {
+	given := make(map[string]bool)
+	for _, arg := range args {
+		if given[arg.Name] {
+			v.errorf(arg.Loc, "There can be only one argument named %q.", arg.Name)
+			continue
+		}
+		given[arg.Name] = true
+		var def *ArgumentDefinition
+		for _, d := range defs {
+			if d.Name == arg.Name {
+				def = d
+			}
+		}
+		if def == nil {
+			v.errorf(arg.Loc, "Unknown argument %q on %s.", arg.Name, of)
+			continue
+		}
+		if hasVariables(arg.Value) {
+			continue
+		}
+		value, err := literal(def.Type, arg.Value, nil)
+		if err == nil {
+			_, err = coerceInput(def.Type, value)
+		}
+		if err != nil {
+			v.errorf(arg.Loc, "Argument %q on %s has an invalid value: %v.", arg.Name, of, err)
+		}
+	}
+	for _, def := range defs {
+		if _, nonNull := def.Type.(*NonNull); nonNull && def.Default == nil && !given[def.Name] {
+			v.errorf(loc, "Argument %q of type %q is required on %s, but it was not provided.", def.Name, def.Type, of)
+		}
+	}
+}
+
+var directiveIf = []*ArgumentDefinition{{Name: "if", Type: &NonNull{Of: Boolean}}}
+
+// checkDirectives allows @skip and @include on fields and fragments.
+func (v *validator) checkDirectives(directives []*Directive, location string) {
+	seen := make(map[string]bool)
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			v.errorf(d.Loc, "Unknown directive \"@%s\".", d.Name)
+			continue
+		}
+		switch location {
+		case "FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT":
+		default:
+			v.errorf(d.Loc, "Directive \"@%s\" may not be used on %s.", d.Name, location)
+			continue
+		}
+		if seen[d.Name] {
+			v.errorf(d.Loc, "The directive \"@%s\" can only be used once at this location.", d.Name)
+		}
+		seen[d.Name] = true
+		v.checkArguments("directive \"@"+d.Name+"\"", directiveIf, d.Arguments, d.Loc)
+	}
+}
+
+// checkFragmentCycles reports fragments that spread themselves, directly
+// or through others.
+func (v *validator) checkFragmentCycles() {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var visit func(f *Fragment) bool
+	var spreads func(set []Selection) bool
+	spreads = func(set []Selection) bool {
+		for _, sel := range set {
+			switch sel := sel.(type) {
+			case *Field:
+				if spreads(sel.SelectionSet) {
+					return true
+				}
+			case *InlineFragment:
+				if spreads(sel.SelectionSet) {
+					return true
+				}
+			case *FragmentSpread:
+				if f := v.doc.Fragments[sel.Name]; f != nil && visit(f) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	visit = func(f *Fragment) bool {
+		switch state[f.Name] {
+		case visiting:
+			v.errorf(f.Loc, "Cannot spread fragment %q within itself.", f.Name)
+			return true
+		case done:
+			return false
+		}
+		state[f.Name] = visiting
+		cyclic := spreads(f.SelectionSet)
+		state[f.Name] = done
+		return cyclic
+	}
+	names := make([]string, 0, len(v.doc.Fragments))
+	for name := range v.doc.Fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if visit(v.doc.Fragments[name]) {
+			return
+		}
+	}
+}
+
+// walk calls fn for every argument value in set, following fragment spreads
+// and marking them in used.
+func (v *validator) walk(set []Selection, visited, used map[string]bool, fn func(*Value)) {
+	directives := func(ds []*Directive) {
+		for _, d := range ds {
+			for _, arg := range d.Arguments {
+				fn(arg.Value)
+			}
+		}
+	}
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *Field:
+			for _, arg := range sel.Arguments {
+				fn(arg.Value)
+			}
+			directives(sel.Directives)
+			v.walk(sel.SelectionSet, visited, used, fn)
+		case *InlineFragment:
+			directives(sel.Directives)
+			v.walk(sel.SelectionSet, visited, used, fn)
+		case *FragmentSpread:
+			directives(sel.Directives)
+			used[sel.Name] = true
+			if f := v.doc.Fragments[sel.Name]; f != nil && !visited[sel.Name] {
+				visited[sel.Name] = true
+				v.walk(f.SelectionSet, visited, used, fn)
+			}
+		}
+	}
+}
+
+// depth returns how deeply set nests, counting fields inside fragments at
+// the level they are spread.
+func (v *validator) depth(set []Selection, expanding map[string]bool) int {
+	max := 0
+	for _, sel := range set {
+		d := 0
+		switch sel := sel.(type) {
+		case *Field:
+			d = 1 + v.depth(sel.SelectionSet, expanding)
+		case *InlineFragment:
+			d = v.depth(sel.SelectionSet, expanding)
+		case *FragmentSpread:
+			if f := v.doc.Fragments[sel.Name]; f != nil && !expanding[sel.Name] {
+				expanding[sel.Name] = true
+				d = v.depth(f.SelectionSet, expanding)
+				delete(expanding, sel.Name)
+			}
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// fields counts the fields set selects, each alias and each spread of a
+// fragment separately. Counts stop at limit+1, so fragments spread inside
+// each other cannot make the count overflow.
+func (v *validator) fields(set []Selection, counts map[string]int, limit int) int {
+	n := 0
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *Field:
+			n += 1 + v.fields(sel.SelectionSet, counts, limit)
+		case *InlineFragment:
+			n += v.fields(sel.SelectionSet, counts, limit)
+		case *FragmentSpread:
+			count, ok := counts[sel.Name]
+			if f := v.doc.Fragments[sel.Name]; !ok && f != nil {
+				count = v.fields(f.SelectionSet, counts, limit)
+				counts[sel.Name] = count
+			}
+			n += count
+		}
+		if n > limit {
+			return limit + 1
+		}
+	}
+	return n
+}
+
+func hasVariables(v *Value) bool {
+	switch v.Kind {
+	case VariableValue:
+		return true
+	case ListValue:
+		for _, item := range v.List {
+			if hasVariables(item) {
+				return true
+			}
+		}
+	case ObjectValue:
+		for _, f := range v.Fields {
+			if hasVariables(f.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func collectVariables(v *Value, usages map[string]Location) {
+	switch v.Kind {
+	case VariableValue:
+		if _, ok := usages[v.Raw]; !ok {
+			usages[v.Raw] = v.Loc
+		}
+	case ListValue:
+		for _, item := range v.List {
+			collectVariables(item, usages)
+		}
+	case ObjectValue:
+		for _, f := range v.Fields {
+			collectVariables(f.Value, usages)
+		}
+	}
+}
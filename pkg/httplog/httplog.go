@@ -0,0 +1,172 @@
+// Package httplog provides the structured request logging middleware shared
+// by the pipeline services.
+package httplog
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config controls request logging volume and detail.
+type Config struct {
+	// Message is the log message used for every request entry.
+	Message string
+	// SampleRate is the fraction (0-1) of successful, fast requests that are
+	// logged. Errors and slow requests are always logged.
+	SampleRate float64
+	// SlowThreshold flags requests at or above this duration with
+	// slow_request=true. Zero disables the flag.
+	SlowThreshold time.Duration
+	// CaptureBodies adds request and response bodies (truncated to
+	// MaxBodyBytes) to entries for responses with status >= 400.
+	CaptureBodies bool
+	MaxBodyBytes  int
+	// Fields, when set, adds request-derived fields such as propagated
+	// tenant or priority headers to every entry.
+	Fields func(r *http.Request) logrus.Fields
+}
+
+// Logger logs one entry per request according to its Config.
+type Logger struct {
+	cfg Config
+}
+
+func New(cfg Config) *Logger {
+	if cfg.Message == "" {
+		cfg.Message = "HTTP request"
+	}
+	if cfg.SampleRate < 0 {
+		cfg.SampleRate = 0
+	}
+	if cfg.SampleRate > 1 {
+		cfg.SampleRate = 1
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 2048
+	}
+	return &Logger{cfg: cfg}
+}
+
+// Wrap logs requests served by next.
+func (l *Logger) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		var reqBody *cappedBuffer
+		if l.cfg.CaptureBodies && r.Body != nil {
+			reqBody = &cappedBuffer{limit: l.cfg.MaxBodyBytes}
+			r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, reqBody), Closer: r.Body}
+		}
+
+		wrapped := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		if l.cfg.CaptureBodies {
+			wrapped.body = &cappedBuffer{limit: l.cfg.MaxBodyBytes}
+		}
+
+		next.ServeHTTP(wrapped, r)
+
+		duration := time.Since(start)
+		isError := wrapped.statusCode >= 400
+		isSlow := l.cfg.SlowThreshold > 0 && duration >= l.cfg.SlowThreshold
+
+		if !isError && !isSlow && l.cfg.SampleRate < 1 && rand.Float64() >= l.cfg.SampleRate {
+			return
+		}
+
+		fields := logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      wrapped.statusCode,
+			"duration":    duration.String(),
+			"user_agent":  r.UserAgent(),
+			"remote_addr": r.RemoteAddr,
+		}
+		if l.cfg.Fields != nil {
+			for k, v := range l.cfg.Fields(r) {
+				fields[k] = v
+			}
+		}
+		if isSlow {
+			fields["slow_request"] = true
+		}
+		if isError && l.cfg.CaptureBodies {
+			if reqBody != nil && reqBody.Len() > 0 {
+				fields["request_body"] = reqBody.String()
+			}
+			if wrapped.body.Len() > 0 {
+				fields["response_body"] = wrapped.body.String()
+			}
+		}
+
+		entry := logrus.WithFields(fields)
+		switch {
+		case wrapped.statusCode >= 500:
+			entry.Error(l.cfg.Message)
+		case isError || isSlow:
+			entry.Warn(l.cfg.Message)
+		default:
+			entry.Info(l.cfg.Message)
+		}
+	})
+}
+
+// cappedBuffer keeps at most limit bytes and marks truncation.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Buffer.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+			b.truncated = true
+		} else {
+			b.Buffer.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + "...(truncated)"
+	}
+	return b.Buffer.String()
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       *cappedBuffer
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	if rw.body != nil && rw.statusCode >= 400 {
+		rw.body.Write(p)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,558 @@
+// Package incident tracks incidents from the moment they are opened, by hand
+// or by a firing alert, through acknowledgement to resolution, so the time
+// to acknowledge (MTTA) and to resolve (MTTR) can be measured. Alerts with
+// the fingerprint of an unresolved incident are added to it rather than
+// opening another. Incidents are kept in a JSON file so they survive
+// restarts; resolved ones are dropped after the retention.
+package incident
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	openIncidents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_incidents_open",
+			Help: "Incidents not yet resolved, by severity",
+		},
+		[]string{"severity"},
+	)
+	openedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_incidents_opened_total",
+			Help: "Incidents opened, by severity and source: manual or alert",
+		},
+		[]string{"severity", "source"},
+	)
+	timeToAcknowledge = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_incident_time_to_acknowledge_seconds",
+			Help:    "Time from opening an incident to acknowledging it, by severity; its mean is the MTTA",
+			Buckets: []float64{60, 300, 600, 1800, 3600, 7200, 14400, 43200, 86400},
+		},
+		[]string{"severity"},
+	)
+	timeToResolve = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_incident_time_to_resolve_seconds",
+			Help:    "Time from opening an incident to resolving it, by severity; its mean is the MTTR",
+			Buckets: []float64{300, 900, 1800, 3600, 7200, 14400, 43200, 86400, 259200},
+		},
+		[]string{"severity"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(openIncidents, openedTotal, timeToAcknowledge, timeToResolve)
+}
+
+// Incident states.
+const (
+	StatusOpen         = "open"
+	StatusAcknowledged = "acknowledged"
+	StatusResolved     = "resolved"
+)
+
+// Sources of incidents.
+const (
+	SourceManual = "manual"
+	SourceAlert  = "alert"
+)
+
+// DefaultSeverity is given to incidents opened without one.
+const DefaultSeverity = "warning"
+
+var (
+	// ErrNotFound is returned for an unknown incident ID.
+	ErrNotFound = errors.New("incident not found")
+	// ErrResolved is returned when acknowledging or resolving an incident
+	// that is already resolved.
+	ErrResolved = errors.New("incident is already resolved")
+	// ErrInvalid wraps the errors of invalid incidents and updates.
+	ErrInvalid = errors.New("invalid incident")
+)
+
+// Event is an entry of an incident's timeline.
+type Event struct {
+	At time.Time `json:"at"`
+	// Type is opened, alert, acknowledged, resolved, updated, notified or
+	// correlated.
+	Type  string `json:"type"`
+	Actor string `json:"actor,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+// Incident is a disruption being tracked.
+type Incident struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Summary  string `json:"summary,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Severity string `json:"severity"`
+	Status   string `json:"status"`
+	Source   string `json:"source"`
+	// Fingerprint identifies the alert that opened the incident; later
+	// notifications of it are added to the incident.
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Alerts counts the firing notifications received for the incident.
+	Alerts         int        `json:"alerts,omitempty"`
+	OpenedAt       time.Time  `json:"opened_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy     string     `json:"resolved_by,omitempty"`
+	PostmortemURL  string     `json:"postmortem_url,omitempty"`
+	Timeline       []Event    `json:"timeline"`
+	// Correlation is the evidence gathered around the time the incident
+	// opened, such as recent deploys and error log spikes.
+	Correlation *Correlation `json:"correlation,omitempty"`
+}
+
+// Correlation is a report of what else happened in the window before an
+// incident opened.
+type Correlation struct {
+	GeneratedAt time.Time  `json:"generated_at"`
+	From        time.Time  `json:"from"`
+	To          time.Time  `json:"to"`
+	Evidence    []Evidence `json:"evidence"`
+	// Errors lists the sources that could not be queried, so an empty
+	// report is not mistaken for a quiet one.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Evidence is one finding of a correlation report.
+type Evidence struct {
+	// Kind is deploy, slow_trace, error_logs or backlog.
+	Kind    string    `json:"kind"`
+	Service string    `json:"service,omitempty"`
+	At      time.Time `json:"at,omitempty"`
+	Summary string    `json:"summary"`
+	// TraceID is set on slow traces.
+	TraceID string  `json:"trace_id,omitempty"`
+	Value   float64 `json:"value,omitempty"`
+}
+
+// Alert is a firing or resolved alert, such as an Alertmanager webhook
+// reports.
+type Alert struct {
+	Fingerprint string
+	Name        string
+	Service     string
+	Severity    string
+	Summary     string
+	Labels      map[string]string
+	Firing      bool
+	At          time.Time
+}
+
+// Update holds the fields of an incident to change; nil fields are kept.
+type Update struct {
+	Title         *string `json:"title"`
+	Summary       *string `json:"summary"`
+	Severity      *string `json:"severity"`
+	PostmortemURL *string `json:"postmortem_url"`
+}
+
+// Filter selects incidents; empty fields match all.
+type Filter struct {
+	Status   string
+	Service  string
+	Severity string
+}
+
+// Config configures a Store.
+type Config struct {
+	// Path is the JSON file incidents are saved to.
+	Path string
+	// Retention is how long resolved incidents are kept; 90 days by
+	// default.
+	Retention time.Duration
+	// AutoResolve resolves an incident when the alert that opened it
+	// resolves.
+	AutoResolve bool
+}
+
+// Store holds the incidents.
+type Store struct {
+	cfg Config
+
+	mu        sync.Mutex
+	incidents map[string]*Incident
+}
+
+// NewStore loads the incidents saved at cfg.Path.
+func NewStore(cfg Config) (*Store, error) {
+	if cfg.Retention <= 0 {
+		cfg.Retention = 90 * 24 * time.Hour
+	}
+	s := &Store{cfg: cfg, incidents: make(map[string]*Incident)}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open incident store: %w", err)
+	}
+	if len(data) > 0 {
+		var incidents []*Incident
+		if err := json.Unmarshal(data, &incidents); err != nil {
+			return nil, fmt.Errorf("parse incident store: %w", err)
+		}
+		for _, in := range incidents {
+			s.incidents[in.ID] = in
+		}
+	}
+	s.updateGauges()
+	return s, nil
+}
+
+// Open opens an incident by hand. It needs a title; the severity defaults
+// to DefaultSeverity.
+func (s *Store) Open(in Incident, actor string) (Incident, error) {
+	in.Title = strings.TrimSpace(in.Title)
+	if in.Title == "" {
+		return Incident{}, fmt.Errorf("%w: title is required", ErrInvalid)
+	}
+	in.Source = SourceManual
+	in.Fingerprint, in.Alerts = "", 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created := s.open(in, actor, time.Now().UTC())
+	return created, s.save()
+}
+
+// open adds in as a new incident. Callers hold mu.
+func (s *Store) open(in Incident, actor string, at time.Time) Incident {
+	if in.Severity == "" {
+		in.Severity = DefaultSeverity
+	}
+	in.ID = newID()
+	in.Status = StatusOpen
+	in.OpenedAt = at
+	in.AcknowledgedAt, in.AcknowledgedBy, in.ResolvedAt, in.ResolvedBy = nil, "", nil, ""
+	in.Timeline = []Event{{At: at, Type: "opened", Actor: actor, Note: in.Summary}}
+	s.incidents[in.ID] = &in
+	openedTotal.WithLabelValues(in.Severity, in.Source).Inc()
+	s.updateGauges()
+	return clone(&in)
+}
+
+// Alert records an alert notification. A firing alert is added to the
+// unresolved incident with its fingerprint, or opens one; the returned
+// bool reports whether it did. A resolved alert is noted on its incident,
+// and resolves it with Config.AutoResolve. It returns ErrNotFound for a
+// resolved alert without an unresolved incident.
+func (s *Store) Alert(a Alert) (Incident, bool, error) {
+	if a.At.IsZero() {
+		a.At = time.Now()
+	}
+	a.At = a.At.UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current *Incident
+	for _, in := range s.incidents {
+		if in.Fingerprint == a.Fingerprint && in.Status != StatusResolved {
+			current = in
+			break
+		}
+	}
+
+	switch {
+	case a.Firing && current == nil:
+		title := a.Summary
+		if title == "" {
+			title = a.Name
+		}
+		opened := s.open(Incident{
+			Title:       title,
+			Summary:     a.Summary,
+			Service:     a.Service,
+			Severity:    a.Severity,
+			Source:      SourceAlert,
+			Fingerprint: a.Fingerprint,
+			Labels:      a.Labels,
+			Alerts:      1,
+		}, a.Name, a.At)
+		return opened, true, s.save()
+	case current == nil:
+		return Incident{}, false, ErrNotFound
+	case a.Firing:
+		current.Alerts++
+		current.Timeline = append(current.Timeline, Event{At: a.At, Type: "alert", Actor: a.Name, Note: "firing again"})
+	case s.cfg.AutoResolve:
+		s.resolve(current, a.Name, "alert resolved", a.At)
+	default:
+		current.Timeline = append(current.Timeline, Event{At: a.At, Type: "alert", Actor: a.Name, Note: "alert resolved"})
+	}
+	return clone(current), false, s.save()
+}
+
+// Acknowledge marks an incident as being worked on. Acknowledging it again
+// only adds the note to its timeline.
+func (s *Store) Acknowledge(id, actor, note string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return Incident{}, ErrNotFound
+	}
+	if in.Status == StatusResolved {
+		return Incident{}, ErrResolved
+	}
+	now := time.Now().UTC()
+	if in.AcknowledgedAt == nil {
+		in.Status = StatusAcknowledged
+		in.AcknowledgedAt, in.AcknowledgedBy = &now, actor
+		timeToAcknowledge.WithLabelValues(in.Severity).Observe(now.Sub(in.OpenedAt).Seconds())
+		s.updateGauges()
+	}
+	in.Timeline = append(in.Timeline, Event{At: now, Type: "acknowledged", Actor: actor, Note: note})
+	return clone(in), s.save()
+}
+
+// Resolve closes an incident.
+func (s *Store) Resolve(id, actor, note string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return Incident{}, ErrNotFound
+	}
+	if in.Status == StatusResolved {
+		return Incident{}, ErrResolved
+	}
+	s.resolve(in, actor, note, time.Now().UTC())
+	return clone(in), s.save()
+}
+
+// resolve closes in at the given time. Callers hold mu.
+func (s *Store) resolve(in *Incident, actor, note string, at time.Time) {
+	in.Status = StatusResolved
+	in.ResolvedAt, in.ResolvedBy = &at, actor
+	in.Timeline = append(in.Timeline, Event{At: at, Type: "resolved", Actor: actor, Note: note})
+	timeToResolve.WithLabelValues(in.Severity).Observe(at.Sub(in.OpenedAt).Seconds())
+	s.updateGauges()
+}
+
+// Update changes an incident's title, summary, severity or postmortem link.
+func (s *Store) Update(id string, u Update, actor string) (Incident, error) {
+	if u.Title != nil && strings.TrimSpace(*u.Title) == "" {
+		return Incident{}, fmt.Errorf("%w: title must not be empty", ErrInvalid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return Incident{}, ErrNotFound
+	}
+	var changed []string
+	if u.Title != nil {
+		in.Title = strings.TrimSpace(*u.Title)
+		changed = append(changed, "title")
+	}
+	if u.Summary != nil {
+		in.Summary = *u.Summary
+		changed = append(changed, "summary")
+	}
+	if u.Severity != nil && *u.Severity != "" {
+		in.Severity = *u.Severity
+		changed = append(changed, "severity")
+		s.updateGauges()
+	}
+	if u.PostmortemURL != nil {
+		in.PostmortemURL = *u.PostmortemURL
+		changed = append(changed, "postmortem_url")
+	}
+	if len(changed) > 0 {
+		in.Timeline = append(in.Timeline, Event{At: time.Now().UTC(), Type: "updated", Actor: actor, Note: strings.Join(changed, ", ")})
+	}
+	return clone(in), s.save()
+}
+
+// Note adds an event, such as a notification sent about it, to an
+// incident's timeline.
+func (s *Store) Note(id string, e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	in.Timeline = append(in.Timeline, e)
+	return s.save()
+}
+
+// Correlate attaches a correlation report to an incident, replacing any
+// earlier one, and notes it on the timeline.
+func (s *Store) Correlate(id string, c Correlation, actor string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return Incident{}, ErrNotFound
+	}
+	in.Correlation = &c
+	note := fmt.Sprintf("%d pieces of evidence", len(c.Evidence))
+	if len(c.Errors) > 0 {
+		note += fmt.Sprintf(", %d sources failed", len(c.Errors))
+	}
+	in.Timeline = append(in.Timeline, Event{At: c.GeneratedAt, Type: "correlated", Actor: actor, Note: note})
+	return clone(in), s.save()
+}
+
+// Delete removes an incident, such as one opened by mistake.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.incidents[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.incidents, id)
+	s.updateGauges()
+	return s.save()
+}
+
+// Get returns an incident by ID.
+func (s *Store) Get(id string) (Incident, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	in, ok := s.incidents[id]
+	if !ok {
+		return Incident{}, false
+	}
+	return clone(in), true
+}
+
+// List returns the incidents matching f, newest first.
+func (s *Store) List(f Filter) []Incident {
+	s.mu.Lock()
+	list := []Incident{}
+	for _, in := range s.incidents {
+		if (f.Status == "" || in.Status == f.Status) && (f.Service == "" || in.Service == f.Service) && (f.Severity == "" || in.Severity == f.Severity) {
+			list = append(list, clone(in))
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].OpenedAt.Equal(list[j].OpenedAt) {
+			return list[i].OpenedAt.After(list[j].OpenedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Stats summarizes the incidents opened since a time.
+type Stats struct {
+	Since        time.Time `json:"since"`
+	Opened       int       `json:"opened"`
+	Open         int       `json:"open"`
+	Acknowledged int       `json:"acknowledged"`
+	Resolved     int       `json:"resolved"`
+	// MTTA and MTTR are the mean seconds from opening to acknowledging
+	// and to resolving, over the incidents that were; nil without any.
+	MTTA *float64 `json:"mtta_seconds"`
+	MTTR *float64 `json:"mttr_seconds"`
+}
+
+// Stats computes the counts and mean times of the incidents opened since
+// since from their timestamps.
+func (s *Store) Stats(since time.Time) Stats {
+	st := Stats{Since: since.UTC()}
+	var ackSeconds, resolveSeconds float64
+	s.mu.Lock()
+	for _, in := range s.incidents {
+		if in.OpenedAt.Before(since) {
+			continue
+		}
+		st.Opened++
+		if in.Status == StatusOpen {
+			st.Open++
+		}
+		if in.AcknowledgedAt != nil {
+			st.Acknowledged++
+			ackSeconds += in.AcknowledgedAt.Sub(in.OpenedAt).Seconds()
+		}
+		if in.ResolvedAt != nil {
+			st.Resolved++
+			resolveSeconds += in.ResolvedAt.Sub(in.OpenedAt).Seconds()
+		}
+	}
+	s.mu.Unlock()
+	if st.Acknowledged > 0 {
+		mtta := ackSeconds / float64(st.Acknowledged)
+		st.MTTA = &mtta
+	}
+	if st.Resolved > 0 {
+		mttr := resolveSeconds / float64(st.Resolved)
+		st.MTTR = &mttr
+	}
+	return st
+}
+
+// save drops resolved incidents past the retention and writes the file.
+// Callers hold mu.
+func (s *Store) save() error {
+	cutoff := time.Now().Add(-s.cfg.Retention)
+	incidents := make([]*Incident, 0, len(s.incidents))
+	for id, in := range s.incidents {
+		if in.ResolvedAt != nil && in.ResolvedAt.Before(cutoff) {
+			delete(s.incidents, id)
+			continue
+		}
+		incidents = append(incidents, in)
+	}
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].OpenedAt.Before(incidents[j].OpenedAt) })
+
+	data, err := json.Marshal(incidents)
+	if err != nil {
+		return err
+	}
+	tmp := s.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save incident store: %w", err)
+	}
+	if err := os.Rename(tmp, s.cfg.Path); err != nil {
+		return fmt.Errorf("save incident store: %w", err)
+	}
+	return nil
+}
+
+// updateGauges recounts the unresolved incidents. Callers hold mu or own s
+// exclusively.
+func (s *Store) updateGauges() {
+	openIncidents.Reset()
+	for _, in := range s.incidents {
+		if in.Status != StatusResolved {
+			openIncidents.WithLabelValues(in.Severity).Inc()
+		}
+	}
+}
+
+func clone(in *Incident) Incident {
+	c := *in
+	c.Timeline = append([]Event(nil), in.Timeline...)
+	return c
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,285 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxResponseBytes bounds a response, so a corrupt size cannot make the
+// consumer allocate without limit.
+const maxResponseBytes = 256 << 20
+
+// brokerConn is a connection to one broker. Requests on it are serialized.
+type brokerConn struct {
+	mu            sync.Mutex
+	nc            net.Conn
+	r             *bufio.Reader
+	clientID      string
+	correlationID int32
+}
+
+func (c *Consumer) dial(ctx context.Context, addr string) (*brokerConn, error) {
+	dialer := &net.Dialer{Timeout: c.cfg.DialTimeout}
+	var nc net.Conn
+	var err error
+	if c.cfg.TLS != nil {
+		cfg := c.cfg.TLS
+		if cfg.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			cfg = cfg.Clone()
+			cfg.ServerName = host
+		}
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, "tcp", addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bc := &brokerConn{nc: nc, r: bufio.NewReader(nc), clientID: c.cfg.ClientID}
+	if c.cfg.Username != "" {
+		if err := bc.saslPlain(c.cfg.Username, c.cfg.Password, c.cfg.RequestTimeout); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("kafka: authenticate to %s: %w", addr, err)
+		}
+	}
+	return bc, nil
+}
+
+func (bc *brokerConn) close() {
+	bc.nc.Close()
+}
+
+// request sends a request and reads its response body, failing if it takes
+// longer than timeout.
+func (bc *brokerConn) request(apiKey int16, body []byte, timeout time.Duration) (*decoder, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.correlationID++
+	e := &encoder{b: make([]byte, 4, 64+len(body))}
+	e.int16(apiKey)
+	e.int16(apiVersions[apiKey])
+	e.int32(bc.correlationID)
+	e.string(bc.clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	bc.nc.SetDeadline(time.Now().Add(timeout))
+	if _, err := bc.nc.Write(e.b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(bc.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseBytes {
+		return nil, fmt.Errorf("kafka: invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(bc.r, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != bc.correlationID {
+		return nil, fmt.Errorf("kafka: response %d does not match request %d", id, bc.correlationID)
+	}
+	return &decoder{b: resp[4:]}, nil
+}
+
+// saslPlain authenticates with the PLAIN mechanism.
+func (bc *brokerConn) saslPlain(username, password string, timeout time.Duration) error {
+	e := &encoder{}
+	e.string("PLAIN")
+	d, err := bc.request(apiSaslHandshake, e.b, timeout)
+	if err != nil {
+		return err
+	}
+	if err := errorCode(d.int16()); err != nil {
+		return err
+	}
+
+	e = &encoder{}
+	e.bytes([]byte("\x00" + username + "\x00" + password))
+	if d, err = bc.request(apiSaslAuthenticate, e.b, timeout); err != nil {
+		return err
+	}
+	code, message := d.int16(), d.string()
+	if code != 0 {
+		if message != "" {
+			return fmt.Errorf("%w: %s", Error(code), message)
+		}
+		return Error(code)
+	}
+	return d.err
+}
+
+// partitionMeta is a partition and its leader.
+type partitionMeta struct {
+	id     int32
+	leader int32
+}
+
+// cluster is the consumer's view of the brokers during one session: the
+// broker addresses and partition leaders from the last metadata request, and
+// a fetch connection per broker.
+type cluster struct {
+	c       *Consumer
+	brokers map[int32]string
+	topics  map[string][]partitionMeta
+	conns   map[int32]*brokerConn
+}
+
+func (cl *cluster) close() {
+	for _, bc := range cl.conns {
+		bc.close()
+	}
+}
+
+// conn returns the connection to broker id, dialling it if needed.
+func (cl *cluster) conn(ctx context.Context, id int32) (*brokerConn, error) {
+	if bc, ok := cl.conns[id]; ok {
+		return bc, nil
+	}
+	addr, ok := cl.brokers[id]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown broker %d", id)
+	}
+	bc, err := cl.c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	cl.conns[id] = bc
+	return bc, nil
+}
+
+// drop closes the connection to broker id after a failure.
+func (cl *cluster) drop(id int32) {
+	if bc, ok := cl.conns[id]; ok {
+		bc.close()
+		delete(cl.conns, id)
+	}
+}
+
+// anyConn returns a connection to some broker: a known one, or a bootstrap
+// broker.
+func (cl *cluster) anyConn(ctx context.Context) (*brokerConn, error) {
+	for _, bc := range cl.conns {
+		return bc, nil
+	}
+	var errs []error
+	for id := range cl.brokers {
+		bc, err := cl.conn(ctx, id)
+		if err == nil {
+			return bc, nil
+		}
+		errs = append(errs, err)
+	}
+	for _, addr := range cl.c.cfg.Brokers {
+		bc, err := cl.c.dial(ctx, addr)
+		if err == nil {
+			// Not cached: its broker ID is unknown.
+			return bc, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("kafka: no broker reachable: %w", errors.Join(errs...))
+}
+
+// refresh loads the brokers and the partitions of topics.
+func (cl *cluster) refresh(ctx context.Context, topics []string) error {
+	bc, err := cl.anyConn(ctx)
+	if err != nil {
+		return err
+	}
+	if _, cached := cl.idOf(bc); !cached {
+		defer bc.close()
+	}
+
+	e := &encoder{}
+	e.arrayLen(len(topics))
+	for _, t := range topics {
+		e.string(t)
+	}
+	e.bool(false) // allow_auto_topic_creation
+	d, err := bc.request(apiMetadata, e.b, cl.c.cfg.RequestTimeout)
+	if err != nil {
+		if id, cached := cl.idOf(bc); cached {
+			cl.drop(id)
+		}
+		return err
+	}
+
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for n := d.arrayLen(); n > 0; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+	meta := make(map[string][]partitionMeta)
+	for n := d.arrayLen(); n > 0; n-- {
+		code, name := d.int16(), d.string()
+		d.bool() // is_internal
+		var partitions []partitionMeta
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int16() // partition error; the leader tells
+			pm := partitionMeta{id: d.int32(), leader: d.int32()}
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			partitions = append(partitions, pm)
+		}
+		if err := errorCode(code); err != nil {
+			return fmt.Errorf("kafka: metadata for topic %q: %w", name, err)
+		}
+		meta[name] = partitions
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	for id, addr := range brokers {
+		if old, ok := cl.brokers[id]; ok && old != addr {
+			cl.drop(id)
+		}
+	}
+	cl.brokers = brokers
+	for t, partitions := range meta {
+		cl.topics[t] = partitions
+	}
+	return nil
+}
+
+func (cl *cluster) idOf(bc *brokerConn) (int32, bool) {
+	for id, c := range cl.conns {
+		if c == bc {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// leader returns the leader of a partition, -1 if it has none.
+func (cl *cluster) leader(topic string, partition int32) int32 {
+	for _, p := range cl.topics[topic] {
+		if p.id == partition {
+			return p.leader
+		}
+	}
+	return -1
+}
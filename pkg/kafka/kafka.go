@@ -0,0 +1,825 @@
+// Package kafka is a minimal Kafka consumer-group client for ingesting
+// topics into the pipeline. It joins a group, consumes the partitions the
+// group assigns it and commits offsets once the caller has handled the
+// messages; it does not produce.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the cluster and the consumer group.
+type Config struct {
+	// Brokers are the host:port bootstrap addresses.
+	Brokers  []string
+	ClientID string
+	GroupID  string
+	Topics   []string
+	// StartOffset is where a partition without a committed offset starts:
+	// "earliest" or "latest".
+	StartOffset string
+	// Username and Password authenticate with SASL/PLAIN when Username is
+	// set; use it with TLS.
+	Username string
+	Password string
+	TLS      *tls.Config
+
+	// SessionTimeout is how long the group waits for a heartbeat before it
+	// evicts the consumer, and RebalanceTimeout how long it waits for members
+	// to rejoin during a rebalance.
+	SessionTimeout    time.Duration
+	RebalanceTimeout  time.Duration
+	HeartbeatInterval time.Duration
+	DialTimeout       time.Duration
+	RequestTimeout    time.Duration
+	// MaxWait is how long a fetch waits for new messages.
+	MaxWait           time.Duration
+	MaxBytes          int32
+	MaxPartitionBytes int32
+	// MaxReconnectDelay caps the exponential backoff between sessions.
+	MaxReconnectDelay time.Duration
+}
+
+// PartitionLag is how far a consumer is behind on a partition.
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+	// Offset is the next offset to consume; HighWatermark is the offset after
+	// the last committed message of the partition.
+	Offset        int64
+	HighWatermark int64
+}
+
+// Lag is the number of messages not consumed yet.
+func (l PartitionLag) Lag() int64 {
+	return max(l.HighWatermark-l.Offset, 0)
+}
+
+// Batch is the result of one fetch round.
+type Batch struct {
+	// Messages are in offset order within each partition.
+	Messages []Message
+	// Lag covers every assigned partition, as it will be once Messages are
+	// committed.
+	Lag []PartitionLag
+}
+
+// Consumer is a member of a consumer group.
+type Consumer struct {
+	cfg      Config
+	memberID string
+	joined   atomic.Bool
+}
+
+func NewConsumer(cfg Config) *Consumer {
+	if cfg.ClientID == "" {
+		cfg.ClientID = "pipeline"
+	}
+	if cfg.StartOffset == "" {
+		cfg.StartOffset = "latest"
+	}
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = 30 * time.Second
+	}
+	if cfg.RebalanceTimeout <= 0 {
+		cfg.RebalanceTimeout = time.Minute
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.SessionTimeout / 10
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 30 * time.Second
+	}
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = 500 * time.Millisecond
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 16 << 20
+	}
+	if cfg.MaxPartitionBytes <= 0 {
+		cfg.MaxPartitionBytes = 1 << 20
+	}
+	if cfg.MaxReconnectDelay <= 0 {
+		cfg.MaxReconnectDelay = time.Minute
+	}
+	return &Consumer{cfg: cfg}
+}
+
+// Joined reports whether the consumer is a member of the group's current
+// generation.
+func (c *Consumer) Joined() bool {
+	return c.joined.Load()
+}
+
+// Run consumes until ctx is cancelled. handle is called after every fetch
+// round, with no messages when nothing arrived, and the offsets of its
+// messages are committed only once it returns nil. When handle fails, or
+// the connection does, the consumer rejoins the group and resumes from the
+// committed offsets, so messages are delivered at least once. A rebalance
+// rejoins at once; other failures back off exponentially and are passed to
+// onError.
+func (c *Consumer) Run(ctx context.Context, handle func(Batch) error, onError func(error)) {
+	delay := time.Second
+	for {
+		consumed, err := c.session(ctx, handle)
+		c.joined.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		var kerr Error
+		if errors.As(err, &kerr) && kerr.rebalance() {
+			if kerr == errUnknownMemberID {
+				c.memberID = ""
+			}
+			continue
+		}
+		if onError != nil {
+			onError(err)
+		}
+		if consumed {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > c.cfg.MaxReconnectDelay {
+			delay = c.cfg.MaxReconnectDelay
+		}
+	}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// generation is the consumer's membership in one generation of the group.
+type generation struct {
+	id       int32
+	coord    *brokerConn
+	assigned map[string][]int32
+}
+
+// session joins the group and consumes until the generation ends, the
+// connection fails or ctx is cancelled. consumed reports whether any
+// messages were committed.
+func (c *Consumer) session(ctx context.Context, handle func(Batch) error) (consumed bool, err error) {
+	cl := &cluster{
+		c:       c,
+		brokers: make(map[int32]string),
+		topics:  make(map[string][]partitionMeta),
+		conns:   make(map[int32]*brokerConn),
+	}
+	defer cl.close()
+	if err := cl.refresh(ctx, c.cfg.Topics); err != nil {
+		return false, err
+	}
+
+	coord, err := c.coordinator(ctx, cl)
+	if err != nil {
+		return false, err
+	}
+	defer coord.close()
+	g, err := c.join(ctx, cl, coord)
+	if err != nil {
+		return false, err
+	}
+	positions, err := c.committedOffsets(ctx, cl, g)
+	if err != nil {
+		return false, err
+	}
+	c.joined.Store(true)
+
+	stop := make(chan struct{})
+	heartbeatErr := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.heartbeat(g, stop, heartbeatErr)
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	highWatermarks := make(map[topicPartition]int64)
+	for {
+		if ctx.Err() != nil {
+			c.leave(coord)
+			return consumed, nil
+		}
+		select {
+		case err := <-heartbeatErr:
+			return consumed, err
+		default:
+		}
+
+		msgs, next, err := c.fetch(ctx, cl, positions, highWatermarks)
+		if err != nil {
+			return consumed, err
+		}
+		batch := Batch{Messages: msgs}
+		for tp, offset := range next {
+			if hw, ok := highWatermarks[tp]; ok {
+				batch.Lag = append(batch.Lag, PartitionLag{Topic: tp.topic, Partition: tp.partition, Offset: offset, HighWatermark: hw})
+			}
+		}
+		if err := handle(batch); err != nil {
+			if ctx.Err() != nil {
+				c.leave(coord)
+			}
+			return consumed, err
+		}
+
+		commit := make(map[topicPartition]int64)
+		for tp, offset := range next {
+			if offset != positions[tp] {
+				commit[tp] = offset
+			}
+		}
+		if len(commit) > 0 {
+			if err := c.commit(g, commit); err != nil {
+				return consumed, err
+			}
+			consumed = consumed || len(msgs) > 0
+		}
+		positions = next
+	}
+}
+
+// coordinator finds the group coordinator and connects to it. The
+// coordinator gets its own connection, so heartbeats do not queue behind
+// long-polling fetches.
+func (c *Consumer) coordinator(ctx context.Context, cl *cluster) (*brokerConn, error) {
+	bc, err := cl.anyConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, cached := cl.idOf(bc); !cached {
+		defer bc.close()
+	}
+
+	e := &encoder{}
+	e.string(c.cfg.GroupID)
+	e.int8(0) // key_type: group
+	d, err := bc.request(apiFindCoordinator, e.b, c.cfg.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d.int32() // throttle_time_ms
+	code, message := d.int16(), d.string()
+	id, host, port := d.int32(), d.string(), d.int32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if code != 0 {
+		if message != "" {
+			return nil, fmt.Errorf("kafka: find coordinator: %w: %s", Error(code), message)
+		}
+		return nil, fmt.Errorf("kafka: find coordinator: %w", Error(code))
+	}
+	addr := fmt.Sprintf("%s:%d", host, port)
+	if host == "" {
+		addr = cl.brokers[id]
+	}
+	return c.dial(ctx, addr)
+}
+
+// join joins the group and syncs the assignment of the new generation,
+// assigning the partitions when this member is elected leader.
+func (c *Consumer) join(ctx context.Context, cl *cluster, coord *brokerConn) (*generation, error) {
+	subscription := &encoder{}
+	subscription.int16(0)
+	subscription.arrayLen(len(c.cfg.Topics))
+	for _, t := range c.cfg.Topics {
+		subscription.string(t)
+	}
+	subscription.bytes(nil) // user_data
+
+	e := &encoder{}
+	e.string(c.cfg.GroupID)
+	e.int32(int32(c.cfg.SessionTimeout.Milliseconds()))
+	e.int32(int32(c.cfg.RebalanceTimeout.Milliseconds()))
+	e.string(c.memberID)
+	e.string("consumer")
+	e.arrayLen(1)
+	e.string("range")
+	e.bytes(subscription.b)
+	// The coordinator answers once every member has rejoined.
+	d, err := coord.request(apiJoinGroup, e.b, c.cfg.RebalanceTimeout+c.cfg.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d.int32() // throttle_time_ms
+	code := d.int16()
+	generationID := d.int32()
+	d.string() // protocol_name
+	leader, memberID := d.string(), d.string()
+	members := make(map[string][]string)
+	for n := d.arrayLen(); n > 0; n-- {
+		id := d.string()
+		md := &decoder{b: d.bytes()}
+		md.int16() // version
+		var topics []string
+		for t := md.arrayLen(); t > 0; t-- {
+			topics = append(topics, md.string())
+		}
+		if md.err != nil {
+			return nil, fmt.Errorf("kafka: member %s has malformed metadata: %w", id, md.err)
+		}
+		members[id] = topics
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := errorCode(code); err != nil {
+		return nil, err
+	}
+	c.memberID = memberID
+
+	var assignments map[string]map[string][]int32
+	if leader == memberID {
+		if assignments, err = c.assign(ctx, cl, members); err != nil {
+			return nil, err
+		}
+	}
+
+	e = &encoder{}
+	e.string(c.cfg.GroupID)
+	e.int32(generationID)
+	e.string(c.memberID)
+	e.arrayLen(len(assignments))
+	for member, topics := range assignments {
+		a := &encoder{}
+		a.int16(0)
+		a.arrayLen(len(topics))
+		for t, partitions := range topics {
+			a.string(t)
+			a.arrayLen(len(partitions))
+			for _, p := range partitions {
+				a.int32(p)
+			}
+		}
+		a.bytes(nil) // user_data
+		e.string(member)
+		e.bytes(a.b)
+	}
+	if d, err = coord.request(apiSyncGroup, e.b, c.cfg.RebalanceTimeout+c.cfg.RequestTimeout); err != nil {
+		return nil, err
+	}
+	d.int32() // throttle_time_ms
+	code = d.int16()
+	assignment := d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := errorCode(code); err != nil {
+		return nil, err
+	}
+
+	g := &generation{id: generationID, coord: coord, assigned: make(map[string][]int32)}
+	if len(assignment) > 0 {
+		ad := &decoder{b: assignment}
+		ad.int16() // version
+		for n := ad.arrayLen(); n > 0; n-- {
+			t := ad.string()
+			for p := ad.arrayLen(); p > 0; p-- {
+				g.assigned[t] = append(g.assigned[t], ad.int32())
+			}
+		}
+		if ad.err != nil {
+			return nil, fmt.Errorf("kafka: malformed assignment: %w", ad.err)
+		}
+	}
+	return g, nil
+}
+
+// assign spreads the partitions of each topic over the members subscribed
+// to it with Kafka's range strategy: members in ID order get consecutive
+// partitions, the first ones one more when they do not divide evenly.
+func (c *Consumer) assign(ctx context.Context, cl *cluster, members map[string][]string) (map[string]map[string][]int32, error) {
+	subscribers := make(map[string][]string)
+	for member, topics := range members {
+		for _, t := range topics {
+			subscribers[t] = append(subscribers[t], member)
+		}
+	}
+	topics := make([]string, 0, len(subscribers))
+	for t := range subscribers {
+		topics = append(topics, t)
+	}
+	if err := cl.refresh(ctx, topics); err != nil {
+		return nil, err
+	}
+
+	assignments := make(map[string]map[string][]int32, len(members))
+	for member := range members {
+		assignments[member] = make(map[string][]int32)
+	}
+	for t, subs := range subscribers {
+		sort.Strings(subs)
+		partitions := make([]int32, 0, len(cl.topics[t]))
+		for _, p := range cl.topics[t] {
+			partitions = append(partitions, p.id)
+		}
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		per, extra := len(partitions)/len(subs), len(partitions)%len(subs)
+		start := 0
+		for i, member := range subs {
+			n := per
+			if i < extra {
+				n++
+			}
+			if n > 0 {
+				assignments[member][t] = partitions[start : start+n]
+			}
+			start += n
+		}
+	}
+	return assignments, nil
+}
+
+// committedOffsets returns the offsets to resume the assigned partitions
+// from: the group's committed offsets, or StartOffset for partitions the
+// group has not committed yet.
+func (c *Consumer) committedOffsets(ctx context.Context, cl *cluster, g *generation) (map[topicPartition]int64, error) {
+	positions := make(map[topicPartition]int64)
+	if len(g.assigned) == 0 {
+		return positions, nil
+	}
+
+	e := &encoder{}
+	e.string(c.cfg.GroupID)
+	e.arrayLen(len(g.assigned))
+	for t, partitions := range g.assigned {
+		e.string(t)
+		e.arrayLen(len(partitions))
+		for _, p := range partitions {
+			e.int32(p)
+		}
+	}
+	d, err := g.coord.request(apiOffsetFetch, e.b, c.cfg.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var unset []topicPartition
+	for n := d.arrayLen(); n > 0; n-- {
+		t := d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			tp := topicPartition{topic: t, partition: d.int32()}
+			offset := d.int64()
+			d.string() // metadata
+			if err := errorCode(d.int16()); err != nil {
+				return nil, fmt.Errorf("kafka: committed offset of %s/%d: %w", tp.topic, tp.partition, err)
+			}
+			if offset < 0 {
+				unset = append(unset, tp)
+			} else {
+				positions[tp] = offset
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	reset, err := c.startOffsets(ctx, cl, unset)
+	if err != nil {
+		return nil, err
+	}
+	for tp, offset := range reset {
+		positions[tp] = offset
+	}
+	return positions, nil
+}
+
+// startOffsets looks up the StartOffset of partitions at their leaders.
+func (c *Consumer) startOffsets(ctx context.Context, cl *cluster, partitions []topicPartition) (map[topicPartition]int64, error) {
+	timestamp := int64(-1) // latest
+	if c.cfg.StartOffset == "earliest" {
+		timestamp = -2
+	}
+
+	byLeader := make(map[int32][]topicPartition)
+	for _, tp := range partitions {
+		leader := cl.leader(tp.topic, tp.partition)
+		if leader < 0 {
+			return nil, fmt.Errorf("kafka: %s/%d: %w", tp.topic, tp.partition, errLeaderNotAvailable)
+		}
+		byLeader[leader] = append(byLeader[leader], tp)
+	}
+
+	offsets := make(map[topicPartition]int64, len(partitions))
+	for leader, tps := range byLeader {
+		e := &encoder{}
+		e.int32(-1) // replica_id
+		byTopic := groupByTopic(tps)
+		e.arrayLen(len(byTopic))
+		for t, ps := range byTopic {
+			e.string(t)
+			e.arrayLen(len(ps))
+			for _, p := range ps {
+				e.int32(p)
+				e.int64(timestamp)
+			}
+		}
+		bc, err := cl.conn(ctx, leader)
+		if err != nil {
+			return nil, err
+		}
+		d, err := bc.request(apiListOffsets, e.b, c.cfg.RequestTimeout)
+		if err != nil {
+			cl.drop(leader)
+			return nil, err
+		}
+		for n := d.arrayLen(); n > 0; n-- {
+			t := d.string()
+			for p := d.arrayLen(); p > 0; p-- {
+				tp := topicPartition{topic: t, partition: d.int32()}
+				code := d.int16()
+				d.int64() // timestamp
+				offset := d.int64()
+				if err := errorCode(code); err != nil {
+					return nil, fmt.Errorf("kafka: %s offset of %s/%d: %w", c.cfg.StartOffset, tp.topic, tp.partition, err)
+				}
+				offsets[tp] = offset
+			}
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+	return offsets, nil
+}
+
+func groupByTopic(tps []topicPartition) map[string][]int32 {
+	byTopic := make(map[string][]int32)
+	for _, tp := range tps {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp.partition)
+	}
+	return byTopic
+}
+
+// fetchResult is what one leader returned for its partitions.
+type fetchResult struct {
+	msgs           []Message
+	next           map[topicPartition]int64
+	highWatermarks map[topicPartition]int64
+	outOfRange     []topicPartition
+	leaderMoved    bool
+	err            error
+}
+
+// fetch fetches from the leaders of the positions concurrently and returns
+// the messages with the offsets that follow them. Partitions whose leader
+// moved are fetched again after a metadata refresh, and partitions whose
+// position fell out of the log restart from StartOffset.
+func (c *Consumer) fetch(ctx context.Context, cl *cluster, positions map[topicPartition]int64, highWatermarks map[topicPartition]int64) ([]Message, map[topicPartition]int64, error) {
+	next := make(map[topicPartition]int64, len(positions))
+	byLeader := make(map[int32][]topicPartition)
+	for tp, offset := range positions {
+		next[tp] = offset
+		if leader := cl.leader(tp.topic, tp.partition); leader >= 0 {
+			byLeader[leader] = append(byLeader[leader], tp)
+		}
+	}
+	if len(byLeader) == 0 {
+		// Nothing assigned or no leader known: wait as a fetch would.
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.cfg.MaxWait):
+		}
+		if len(positions) > 0 {
+			return nil, next, cl.refresh(ctx, c.cfg.Topics)
+		}
+		return nil, next, nil
+	}
+
+	conns := make(map[int32]*brokerConn, len(byLeader))
+	for leader := range byLeader {
+		bc, err := cl.conn(ctx, leader)
+		if err != nil {
+			return nil, nil, err
+		}
+		conns[leader] = bc
+	}
+	results := make(map[int32]*fetchResult, len(byLeader))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for leader, tps := range byLeader {
+		wg.Add(1)
+		go func(leader int32, tps []topicPartition) {
+			defer wg.Done()
+			r := c.fetchFrom(conns[leader], tps, positions)
+			mu.Lock()
+			results[leader] = r
+			mu.Unlock()
+		}(leader, tps)
+	}
+	wg.Wait()
+
+	var msgs []Message
+	var outOfRange []topicPartition
+	refresh := false
+	for leader, r := range results {
+		if r.err != nil {
+			cl.drop(leader)
+			return nil, nil, r.err
+		}
+		msgs = append(msgs, r.msgs...)
+		for tp, offset := range r.next {
+			next[tp] = offset
+		}
+		for tp, hw := range r.highWatermarks {
+			highWatermarks[tp] = hw
+		}
+		outOfRange = append(outOfRange, r.outOfRange...)
+		refresh = refresh || r.leaderMoved
+	}
+	if refresh {
+		if err := cl.refresh(ctx, c.cfg.Topics); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(outOfRange) > 0 {
+		reset, err := c.startOffsets(ctx, cl, outOfRange)
+		if err != nil {
+			return nil, nil, err
+		}
+		for tp, offset := range reset {
+			next[tp] = offset
+		}
+	}
+	return msgs, next, nil
+}
+
+func (c *Consumer) fetchFrom(bc *brokerConn, tps []topicPartition, positions map[topicPartition]int64) *fetchResult {
+	e := &encoder{}
+	e.int32(-1) // replica_id
+	e.int32(int32(c.cfg.MaxWait.Milliseconds()))
+	e.int32(1) // min_bytes
+	e.int32(c.cfg.MaxBytes)
+	e.int8(1) // isolation_level: read_committed
+	byTopic := groupByTopic(tps)
+	e.arrayLen(len(byTopic))
+	for t, ps := range byTopic {
+		e.string(t)
+		e.arrayLen(len(ps))
+		for _, p := range ps {
+			e.int32(p)
+			e.int64(positions[topicPartition{topic: t, partition: p}])
+			e.int32(c.cfg.MaxPartitionBytes)
+		}
+	}
+
+	r := &fetchResult{next: make(map[topicPartition]int64), highWatermarks: make(map[topicPartition]int64)}
+	d, err := bc.request(apiFetch, e.b, c.cfg.MaxWait+c.cfg.RequestTimeout)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	d.int32() // throttle_time_ms
+	for n := d.arrayLen(); n > 0; n-- {
+		t := d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			tp := topicPartition{topic: t, partition: d.int32()}
+			code := d.int16()
+			highWatermark := d.int64()
+			lastStable := d.int64()
+			var aborted []abortedTxn
+			for a := d.int32(); a > 0; a-- {
+				aborted = append(aborted, abortedTxn{producerID: d.int64(), firstOffset: d.int64()})
+			}
+			records := d.bytes()
+			if d.err != nil {
+				r.err = d.err
+				return r
+			}
+
+			switch err := errorCode(code); {
+			case err == nil:
+			case err == errOffsetOutOfRange:
+				r.outOfRange = append(r.outOfRange, tp)
+				continue
+			case err.(Error).leaderMoved():
+				r.leaderMoved = true
+				continue
+			default:
+				r.err = fmt.Errorf("kafka: fetch %s/%d: %w", tp.topic, tp.partition, err)
+				return r
+			}
+
+			// Read-committed consumers only see up to the last stable offset.
+			if lastStable >= 0 {
+				highWatermark = lastStable
+			}
+			r.highWatermarks[tp] = highWatermark
+			sort.Slice(aborted, func(i, j int) bool { return aborted[i].firstOffset < aborted[j].firstOffset })
+			msgs, next, err := decodeRecords(tp.topic, tp.partition, positions[tp], records, aborted)
+			if err != nil {
+				r.err = err
+				return r
+			}
+			r.msgs = append(r.msgs, msgs...)
+			r.next[tp] = next
+		}
+	}
+	if d.err != nil {
+		r.err = d.err
+	}
+	return r
+}
+
+// commit commits offsets for the generation.
+func (c *Consumer) commit(g *generation, offsets map[topicPartition]int64) error {
+	byTopic := make(map[string][]topicPartition)
+	for tp := range offsets {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+	}
+
+	e := &encoder{}
+	e.string(c.cfg.GroupID)
+	e.int32(g.id)
+	e.string(c.memberID)
+	e.int64(-1) // retention_time_ms: the broker's default
+	e.arrayLen(len(byTopic))
+	for t, tps := range byTopic {
+		e.string(t)
+		e.arrayLen(len(tps))
+		for _, tp := range tps {
+			e.int32(tp.partition)
+			e.int64(offsets[tp])
+			e.string("")
+		}
+	}
+	d, err := g.coord.request(apiOffsetCommit, e.b, c.cfg.RequestTimeout)
+	if err != nil {
+		return err
+	}
+	for n := d.arrayLen(); n > 0; n-- {
+		t := d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			partition, code := d.int32(), d.int16()
+			if err := errorCode(code); err != nil {
+				var kerr Error
+				if errors.As(err, &kerr) && kerr.rebalance() {
+					return err
+				}
+				return fmt.Errorf("kafka: commit %s/%d: %w", t, partition, err)
+			}
+		}
+	}
+	return d.err
+}
+
+// heartbeat keeps the membership alive until stop is closed, reporting on
+// errs why it ended otherwise.
+func (c *Consumer) heartbeat(g *generation, stop <-chan struct{}, errs chan<- error) {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		e := &encoder{}
+		e.string(c.cfg.GroupID)
+		e.int32(g.id)
+		e.string(c.memberID)
+		d, err := g.coord.request(apiHeartbeat, e.b, c.cfg.RequestTimeout)
+		if err == nil {
+			d.int32() // throttle_time_ms
+			if err = errorCode(d.int16()); err == nil {
+				err = d.err
+			}
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
+	}
+}
+
+// leave leaves the group, so it rebalances at once instead of after the
+// session timeout.
+func (c *Consumer) leave(coord *brokerConn) {
+	e := &encoder{}
+	e.string(c.cfg.GroupID)
+	e.string(c.memberID)
+	coord.request(apiLeaveGroup, e.b, c.cfg.RequestTimeout)
+	c.memberID = ""
+}
@@ -0,0 +1,421 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is a single-broker cluster speaking the subset of the protocol
+// the consumer uses. It hosts one topic and one consumer group.
+type fakeBroker struct {
+	t     *testing.T
+	ln    net.Listener
+	topic string
+
+	mu        sync.Mutex
+	logs      map[int32][][]byte // values by partition
+	committed map[int32]int64
+	joins     int
+}
+
+func newFakeBroker(t *testing.T, topic string, partitions int) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, topic: topic, logs: make(map[int32][][]byte), committed: make(map[int32]int64)}
+	for p := 0; p < partitions; p++ {
+		b.logs[int32(p)] = nil
+	}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *fakeBroker) produce(partition int32, values ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, v := range values {
+		b.logs[partition] = append(b.logs[partition], []byte(v))
+	}
+}
+
+func (b *fakeBroker) commits() map[int32]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[int32]int64, len(b.committed))
+	for p, offset := range b.committed {
+		out[p] = offset
+	}
+	return out
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		nc, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handleConn(nc)
+	}
+}
+
+func (b *fakeBroker) handleConn(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+		d := &decoder{b: req}
+		apiKey, version, correlationID := d.int16(), d.int16(), d.int32()
+		d.string() // client_id
+		if version != apiVersions[apiKey] {
+			b.t.Errorf("api %d sent at version %d", apiKey, version)
+		}
+
+		e := &encoder{b: make([]byte, 4)}
+		e.int32(correlationID)
+		b.respond(apiKey, d, e)
+		if d.err != nil {
+			b.t.Errorf("api %d: malformed request: %v", apiKey, d.err)
+			return
+		}
+		binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+		if _, err := nc.Write(e.b); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) respond(apiKey int16, d *decoder, e *encoder) {
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch apiKey {
+	case apiMetadata:
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+		}
+		d.bool()
+		e.int32(0) // throttle_time_ms
+		e.arrayLen(1)
+		e.int32(1)
+		e.string(host)
+		e.int32(int32(portNum))
+		e.int16(-1) // rack
+		e.string("cluster")
+		e.int32(1) // controller_id
+		e.arrayLen(1)
+		e.int16(0)
+		e.string(b.topic)
+		e.bool(false)
+		e.arrayLen(len(b.logs))
+		for p := range b.logs {
+			e.int16(0)
+			e.int32(p)
+			e.int32(1) // leader
+			e.arrayLen(1)
+			e.int32(1)
+			e.arrayLen(1)
+			e.int32(1)
+		}
+
+	case apiFindCoordinator:
+		d.string()
+		d.int8()
+		e.int32(0)
+		e.int16(0)
+		e.int16(-1) // error_message
+		e.int32(1)
+		e.string(host)
+		e.int32(int32(portNum))
+
+	case apiJoinGroup:
+		d.string()
+		d.int32()
+		d.int32()
+		d.string() // member_id
+		d.string() // protocol_type
+		var metadata []byte
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			metadata = d.bytes()
+		}
+		b.joins++
+		e.int32(0)
+		e.int16(0)
+		e.int32(int32(b.joins)) // generation_id
+		e.string("range")
+		e.string("member-1") // leader
+		e.string("member-1")
+		e.arrayLen(1)
+		e.string("member-1")
+		e.bytes(metadata)
+
+	case apiSyncGroup:
+		d.string()
+		d.int32()
+		d.string()
+		var assignment []byte
+		for n := d.arrayLen(); n > 0; n-- {
+			if d.string() == "member-1" {
+				assignment = d.bytes()
+			} else {
+				d.bytes()
+			}
+		}
+		e.int32(0)
+		e.int16(0)
+		e.bytes(assignment)
+
+	case apiOffsetFetch:
+		d.string()
+		e.arrayLen(1)
+		e.string(b.topic)
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			ps := d.arrayLen()
+			e.arrayLen(ps)
+			for ; ps > 0; ps-- {
+				p := d.int32()
+				offset, ok := b.committed[p]
+				if !ok {
+					offset = -1
+				}
+				e.int32(p)
+				e.int64(offset)
+				e.string("")
+				e.int16(0)
+			}
+		}
+
+	case apiListOffsets:
+		d.int32()
+		e.arrayLen(1)
+		e.string(b.topic)
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			ps := d.arrayLen()
+			e.arrayLen(ps)
+			for ; ps > 0; ps-- {
+				p, timestamp := d.int32(), d.int64()
+				offset := int64(0)
+				if timestamp == -1 {
+					offset = int64(len(b.logs[p]))
+				}
+				e.int32(p)
+				e.int16(0)
+				e.int64(-1)
+				e.int64(offset)
+			}
+		}
+
+	case apiFetch:
+		d.int32()
+		maxWait := time.Duration(d.int32()) * time.Millisecond
+		d.int32()
+		d.int32()
+		d.int8()
+		e.int32(0)
+		e.arrayLen(1)
+		e.string(b.topic)
+		empty := true
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			ps := d.arrayLen()
+			e.arrayLen(ps)
+			for ; ps > 0; ps-- {
+				p, offset := d.int32(), d.int64()
+				d.int32() // partition_max_bytes
+				log := b.logs[p]
+				var records []testRecord
+				for i := offset; i < int64(len(log)); i++ {
+					records = append(records, testRecord{offsetDelta: i - offset, value: log[i]})
+				}
+				e.int32(p)
+				e.int16(0)
+				e.int64(int64(len(log))) // high_watermark
+				e.int64(int64(len(log))) // last_stable_offset
+				e.int32(0)               // aborted_transactions
+				if len(records) == 0 {
+					e.bytes([]byte{})
+					continue
+				}
+				empty = false
+				e.bytes(encodeBatch(offset, 0, -1, records))
+			}
+		}
+		if empty {
+			// Long-poll as a broker would, without holding the lock.
+			b.mu.Unlock()
+			time.Sleep(maxWait)
+			b.mu.Lock()
+		}
+
+	case apiOffsetCommit:
+		d.string()
+		d.int32()
+		d.string()
+		d.int64()
+		e.arrayLen(1)
+		e.string(b.topic)
+		for n := d.arrayLen(); n > 0; n-- {
+			d.string()
+			ps := d.arrayLen()
+			e.arrayLen(ps)
+			for ; ps > 0; ps-- {
+				p, offset := d.int32(), d.int64()
+				d.string()
+				b.committed[p] = offset
+				e.int32(p)
+				e.int16(0)
+			}
+		}
+
+	case apiHeartbeat, apiLeaveGroup:
+		d.b = nil
+		e.int32(0)
+		e.int16(0)
+
+	default:
+		b.t.Errorf("unexpected api %d", apiKey)
+		d.b = nil
+	}
+}
+
+func testConsumer(b *fakeBroker) *Consumer {
+	return NewConsumer(Config{
+		Brokers:     []string{b.ln.Addr().String()},
+		GroupID:     "ingest",
+		Topics:      []string{b.topic},
+		StartOffset: "earliest",
+		MaxWait:     20 * time.Millisecond,
+	})
+}
+
+// consume runs c until the group has committed want, and returns the values
+// handled by partition.
+func consume(t *testing.T, b *fakeBroker, c *Consumer, want map[int32]int64, handle func(Batch) error) map[int32][]string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	got := make(map[int32][]string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, func(batch Batch) error {
+			if err := handle(batch); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range batch.Messages {
+				got[m.Partition] = append(got[m.Partition], string(m.Value))
+			}
+			return nil
+		}, func(err error) { t.Logf("consumer error: %v", err) })
+	}()
+
+	for ctx.Err() == nil {
+		committed := b.commits()
+		caughtUp := true
+		for p, offset := range want {
+			caughtUp = caughtUp && committed[p] == offset
+		}
+		if caughtUp {
+			cancel()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-done
+	if ctx.Err() == context.DeadlineExceeded {
+		t.Fatalf("timed out with %v committed, want %v", b.commits(), want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return got
+}
+
+func TestConsumerConsumesAndCommits(t *testing.T) {
+	b := newFakeBroker(t, "events", 2)
+	b.produce(0, "a", "b", "c")
+	b.produce(1, "x")
+
+	got := consume(t, b, testConsumer(b), map[int32]int64{0: 3, 1: 1}, func(Batch) error { return nil })
+	if len(got[0]) != 3 || got[0][0] != "a" || got[0][2] != "c" || len(got[1]) != 1 || got[1][0] != "x" {
+		t.Errorf("consumed %v", got)
+	}
+
+	// A new member resumes from the committed offsets.
+	b.produce(0, "d")
+	got = consume(t, b, testConsumer(b), map[int32]int64{0: 4, 1: 1}, func(Batch) error { return nil })
+	if len(got[0]) != 1 || got[0][0] != "d" || len(got[1]) != 0 {
+		t.Errorf("after restart consumed %v, want only d", got)
+	}
+}
+
+func TestConsumerRedeliversAfterHandlerError(t *testing.T) {
+	b := newFakeBroker(t, "events", 1)
+	b.produce(0, "a", "b")
+
+	failed := false
+	var lags []PartitionLag
+	got := consume(t, b, testConsumer(b), map[int32]int64{0: 2}, func(batch Batch) error {
+		if len(batch.Messages) > 0 && !failed {
+			failed = true
+			return errors.New("store unavailable")
+		}
+		lags = append(lags, batch.Lag...)
+		return nil
+	})
+	if len(got[0]) != 2 || got[0][0] != "a" {
+		t.Errorf("consumed %v, want a and b once after the retry", got)
+	}
+	b.mu.Lock()
+	joins := b.joins
+	b.mu.Unlock()
+	if joins < 2 {
+		t.Errorf("joined %d times, want a rejoin after the failure", joins)
+	}
+	if len(lags) == 0 || lags[0].HighWatermark != 2 || lags[0].Lag() != 0 {
+		t.Errorf("lag = %+v", lags)
+	}
+}
+
+func TestRangeAssignment(t *testing.T) {
+	b := newFakeBroker(t, "events", 5)
+	c := testConsumer(b)
+	cl := &cluster{c: c, brokers: make(map[int32]string), topics: make(map[string][]partitionMeta), conns: make(map[int32]*brokerConn)}
+	defer cl.close()
+
+	assignments, err := c.assign(context.Background(), cl, map[string][]string{
+		"member-b": {"events"},
+		"member-a": {"events"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, bb := assignments["member-a"]["events"], assignments["member-b"]["events"]
+	if len(a) != 3 || a[0] != 0 || a[2] != 2 || len(bb) != 2 || bb[0] != 3 || bb[1] != 4 {
+		t.Errorf("assigned %v and %v, want 0-2 and 3-4", a, bb)
+	}
+}
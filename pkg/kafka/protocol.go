@@ -0,0 +1,376 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// API keys of the requests the consumer sends. Each is sent at a fixed,
+// non-flexible version that Kafka 1.0 through 4.x accept.
+const (
+	apiFetch            = 1
+	apiListOffsets      = 2
+	apiMetadata         = 3
+	apiOffsetCommit     = 8
+	apiOffsetFetch      = 9
+	apiFindCoordinator  = 10
+	apiJoinGroup        = 11
+	apiHeartbeat        = 12
+	apiLeaveGroup       = 13
+	apiSyncGroup        = 14
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+)
+
+var apiVersions = map[int16]int16{
+	apiFetch:            4,
+	apiListOffsets:      1,
+	apiMetadata:         4,
+	apiOffsetCommit:     2,
+	apiOffsetFetch:      1,
+	apiFindCoordinator:  1,
+	apiJoinGroup:        2,
+	apiHeartbeat:        1,
+	apiLeaveGroup:       1,
+	apiSyncGroup:        1,
+	apiSaslHandshake:    1,
+	apiSaslAuthenticate: 0,
+}
+
+// Error is a Kafka protocol error code.
+type Error int16
+
+const (
+	errOffsetOutOfRange        Error = 1
+	errUnknownTopicOrPartition Error = 3
+	errLeaderNotAvailable      Error = 5
+	errNotLeaderForPartition   Error = 6
+	errIllegalGeneration       Error = 22
+	errUnknownMemberID         Error = 25
+	errRebalanceInProgress     Error = 27
+)
+
+var errorNames = map[Error]string{
+	1:  "offset out of range",
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	14: "coordinator load in progress",
+	15: "coordinator not available",
+	16: "not coordinator",
+	22: "illegal generation",
+	23: "inconsistent group protocol",
+	24: "invalid group id",
+	25: "unknown member id",
+	26: "invalid session timeout",
+	27: "rebalance in progress",
+	29: "topic authorization failed",
+	30: "group authorization failed",
+	33: "unsupported SASL mechanism",
+	58: "SASL authentication failed",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// rebalance reports whether e means the group moved to a new generation.
+func (e Error) rebalance() bool {
+	return e == errRebalanceInProgress || e == errIllegalGeneration || e == errUnknownMemberID
+}
+
+// leaderMoved reports whether e means partition leadership changed.
+func (e Error) leaderMoved() bool {
+	return e == errNotLeaderForPartition || e == errLeaderNotAvailable || e == errUnknownTopicOrPartition
+}
+
+func errorCode(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return Error(code)
+}
+
+// encoder builds a request body.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *encoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *encoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *encoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// bytes writes b, or a null for nil.
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *encoder) arrayLen(n int) { e.int32(int32(n)) }
+
+// decoder reads a response body. The first error sticks: later reads return
+// zero values and err reports it.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.int8() != 0 }
+
+// string reads a string; a null string reads as "".
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// bytes reads a byte array; a null array reads as nil.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen reads an array length; a null array reads as empty.
+func (d *decoder) arrayLen() int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if n > len(d.b) {
+		// Every element takes at least a byte.
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	return n
+}
+
+// varint reads a zigzag-encoded varint of the record format.
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.New("kafka: malformed varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// varBytes reads a varint-length byte array; a length of -1 reads as nil.
+func (d *decoder) varBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// Message is a record consumed from a topic partition.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Header is a record header.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// abortedTxn is a transaction in a fetched range that was aborted.
+type abortedTxn struct {
+	producerID  int64
+	firstOffset int64
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Batch attribute bits of the v2 record format.
+const (
+	attrCompression   = 0x07
+	attrTransactional = 0x10
+	attrControl       = 0x20
+)
+
+// decodeRecords decodes the record batches of a fetched partition, skipping
+// records below offset, control records and records of aborted
+// transactions. next is the offset to fetch from afterwards. A batch cut
+// off at the end of the response is left for the next fetch.
+func decodeRecords(topic string, partition int32, offset int64, data []byte, aborted []abortedTxn) (msgs []Message, next int64, err error) {
+	next = offset
+	abortedProducers := make(map[int64]bool)
+	for len(data) >= 12 {
+		baseOffset := int64(binary.BigEndian.Uint64(data))
+		length := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if length < 49 || len(data) < 12+length {
+			break
+		}
+		batch := data[12 : 12+length]
+		data = data[12+length:]
+
+		if magic := batch[4]; magic != 2 {
+			return msgs, next, fmt.Errorf("kafka: unsupported message format v%d in %s/%d", magic, topic, partition)
+		}
+		if crc32.Checksum(batch[9:], crc32c) != binary.BigEndian.Uint32(batch[5:]) {
+			return msgs, next, fmt.Errorf("kafka: record batch at %s/%d offset %d failed its checksum", topic, partition, baseOffset)
+		}
+		d := &decoder{b: batch[9:]}
+		attributes := d.int16()
+		lastOffsetDelta := d.int32()
+		baseTimestamp := d.int64()
+		d.int64() // max timestamp
+		producerID := d.int64()
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		count := int(d.int32())
+		if d.err != nil {
+			return msgs, next, d.err
+		}
+		end := baseOffset + int64(lastOffsetDelta) + 1
+		if end <= offset {
+			continue
+		}
+
+		// Transactions aborted at or before this batch.
+		for len(aborted) > 0 && aborted[0].firstOffset <= end-1 {
+			abortedProducers[aborted[0].producerID] = true
+			aborted = aborted[1:]
+		}
+		if attributes&attrControl != 0 {
+			// A commit or abort marker ends the producer's transaction.
+			delete(abortedProducers, producerID)
+			next = end
+			continue
+		}
+		if attributes&attrTransactional != 0 && abortedProducers[producerID] {
+			next = end
+			continue
+		}
+
+		records := d.b
+		switch codec := attributes & attrCompression; codec {
+		case 0:
+		case 1:
+			zr, err := gzip.NewReader(bytes.NewReader(records))
+			if err != nil {
+				return msgs, next, fmt.Errorf("kafka: gzip batch in %s/%d: %w", topic, partition, err)
+			}
+			if records, err = io.ReadAll(zr); err != nil {
+				return msgs, next, fmt.Errorf("kafka: gzip batch in %s/%d: %w", topic, partition, err)
+			}
+		default:
+			return msgs, next, fmt.Errorf("kafka: unsupported compression codec %d in %s/%d", codec, topic, partition)
+		}
+
+		d = &decoder{b: records}
+		for i := 0; i < count; i++ {
+			rd := &decoder{b: d.take(int(d.varint()))}
+			rd.int8() // attributes
+			timestampDelta := rd.varint()
+			offsetDelta := rd.varint()
+			m := Message{
+				Topic:     topic,
+				Partition: partition,
+				Offset:    baseOffset + offsetDelta,
+				Key:       rd.varBytes(),
+				Value:     rd.varBytes(),
+				Timestamp: time.UnixMilli(baseTimestamp + timestampDelta),
+			}
+			for n := rd.varint(); n > 0; n-- {
+				h := Header{Key: string(rd.varBytes())}
+				h.Value = rd.varBytes()
+				m.Headers = append(m.Headers, h)
+			}
+			if err := errors.Join(d.err, rd.err); err != nil {
+				return msgs, next, fmt.Errorf("kafka: malformed record in %s/%d: %w", topic, partition, err)
+			}
+			if m.Offset >= offset {
+				msgs = append(msgs, m)
+			}
+		}
+		next = end
+	}
+	return msgs, next, nil
+}
@@ -0,0 +1,232 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecord is a record of a test batch; its offset is relative to the
+// batch's base offset.
+type testRecord struct {
+	offsetDelta int64
+	key, value  []byte
+	headers     []Header
+}
+
+var testBaseTime = time.UnixMilli(1700000000000)
+
+// encodeBatch encodes a v2 record batch, gzipping the records when attrs
+// asks for it.
+func encodeBatch(baseOffset int64, attrs int16, producerID int64, records []testRecord) []byte {
+	var recs []byte
+	for i, r := range records {
+		var rec []byte
+		rec = append(rec, 0) // attributes
+		rec = binary.AppendVarint(rec, int64(i)*10)
+		rec = binary.AppendVarint(rec, r.offsetDelta)
+		rec = appendVarBytes(rec, r.key)
+		rec = appendVarBytes(rec, r.value)
+		rec = binary.AppendVarint(rec, int64(len(r.headers)))
+		for _, h := range r.headers {
+			rec = appendVarBytes(rec, []byte(h.Key))
+			rec = appendVarBytes(rec, h.Value)
+		}
+		recs = binary.AppendVarint(recs, int64(len(rec)))
+		recs = append(recs, rec...)
+	}
+	if attrs&attrCompression == 1 {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(recs)
+		zw.Close()
+		recs = buf.Bytes()
+	}
+	var lastOffsetDelta int32
+	if len(records) > 0 {
+		lastOffsetDelta = int32(records[len(records)-1].offsetDelta)
+	}
+
+	body := &encoder{}
+	body.int16(attrs)
+	body.int32(lastOffsetDelta)
+	body.int64(testBaseTime.UnixMilli())
+	body.int64(testBaseTime.UnixMilli())
+	body.int64(producerID)
+	body.int16(0)  // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(records)))
+	body.b = append(body.b, recs...)
+
+	e := &encoder{}
+	e.int64(baseOffset)
+	e.int32(int32(4 + 1 + 4 + len(body.b)))
+	e.int32(0) // partition leader epoch
+	e.int8(2)  // magic
+	e.b = binary.BigEndian.AppendUint32(e.b, crc32.Checksum(body.b, crc32c))
+	e.b = append(e.b, body.b...)
+	return e.b
+}
+
+func appendVarBytes(b, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
+
+func TestDecoderStopsAtFirstError(t *testing.T) {
+	e := &encoder{}
+	e.string("topic")
+	e.int16(-1) // null string
+	e.bytes(nil)
+	e.int32(7)
+	d := &decoder{b: e.b}
+	if s := d.string(); s != "topic" {
+		t.Errorf("string = %q", s)
+	}
+	if s := d.string(); s != "" {
+		t.Errorf("null string = %q", s)
+	}
+	if b := d.bytes(); b != nil {
+		t.Errorf("null bytes = %q", b)
+	}
+	if v := d.int32(); v != 7 || d.err != nil {
+		t.Fatalf("int32 = %d, %v", v, d.err)
+	}
+
+	if v := d.int64(); v != 0 || d.err != io.ErrUnexpectedEOF {
+		t.Errorf("int64 past the end = %d, %v", v, d.err)
+	}
+	d = &decoder{b: []byte{0, 0, 0, 1, 0, 5, 'a'}}
+	if d.int32(); d.string() != "" || d.err != io.ErrUnexpectedEOF {
+		t.Errorf("short string: err %v", d.err)
+	}
+	if v := d.int32(); v != 0 {
+		t.Errorf("read after an error = %d", v)
+	}
+
+	// An array cannot have more elements than bytes left.
+	d = &decoder{b: []byte{0x7f, 0xff, 0xff, 0xff, 0}}
+	if n := d.arrayLen(); n != 0 || d.err == nil {
+		t.Errorf("arrayLen = %d, %v", n, d.err)
+	}
+}
+
+func TestDecodeRecords(t *testing.T) {
+	data := append(
+		encodeBatch(10, 0, -1, []testRecord{
+			{offsetDelta: 0, key: []byte("k0"), value: []byte("v0")},
+			{offsetDelta: 1, value: []byte("v1"), headers: []Header{{Key: "trace", Value: []byte("abc")}}},
+		}),
+		encodeBatch(12, 1, -1, []testRecord{
+			{offsetDelta: 0, value: []byte("v2")},
+			{offsetDelta: 1, value: []byte("v3")},
+		})...,
+	)
+
+	msgs, next, err := decodeRecords("events", 3, 11, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 14 {
+		t.Errorf("next = %d, want 14", next)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Value))
+		if m.Topic != "events" || m.Partition != 3 {
+			t.Errorf("message at %d is from %s/%d", m.Offset, m.Topic, m.Partition)
+		}
+	}
+	// Offset 10 is below the fetch position; the second batch is gzipped.
+	if strings.Join(got, ",") != "v1,v2,v3" {
+		t.Fatalf("values = %v", got)
+	}
+	m := msgs[0]
+	if m.Offset != 11 || m.Key != nil || len(m.Headers) != 1 || m.Headers[0].Key != "trace" || string(m.Headers[0].Value) != "abc" {
+		t.Errorf("first message = %+v", m)
+	}
+	if !m.Timestamp.Equal(testBaseTime.Add(10 * time.Millisecond)) {
+		t.Errorf("timestamp = %v", m.Timestamp)
+	}
+}
+
+func TestDecodeRecordsLeavesPartialBatch(t *testing.T) {
+	first := encodeBatch(0, 0, -1, []testRecord{{value: []byte("a")}})
+	second := encodeBatch(1, 0, -1, []testRecord{{value: []byte("b")}})
+	data := append(first, second[:len(second)-3]...)
+
+	msgs, next, err := decodeRecords("events", 0, 0, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || next != 1 {
+		t.Errorf("got %d messages, next %d; want the complete batch only", len(msgs), next)
+	}
+}
+
+func TestDecodeRecordsRejectsCorruptBatch(t *testing.T) {
+	data := encodeBatch(0, 0, -1, []testRecord{{value: []byte("payload")}})
+	data[len(data)-1] ^= 0xff
+	if _, _, err := decodeRecords("events", 0, 0, data, nil); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("corrupt batch: %v", err)
+	}
+
+	data = encodeBatch(0, 0, -1, []testRecord{{value: []byte("payload")}})
+	data[16] = 1 // magic
+	if _, _, err := decodeRecords("events", 0, 0, data, nil); err == nil || !strings.Contains(err.Error(), "message format v1") {
+		t.Errorf("v1 batch: %v", err)
+	}
+
+	data = encodeBatch(0, 2, -1, []testRecord{{value: []byte("payload")}})
+	if _, _, err := decodeRecords("events", 0, 0, data, nil); err == nil || !strings.Contains(err.Error(), "compression codec 2") {
+		t.Errorf("snappy batch: %v", err)
+	}
+}
+
+func TestDecodeRecordsSkipsAbortedTransactions(t *testing.T) {
+	const aborting, committing = 7, 8
+	var data []byte
+	data = append(data, encodeBatch(0, attrTransactional, aborting, []testRecord{{value: []byte("aborted")}})...)
+	data = append(data, encodeBatch(1, attrTransactional, committing, []testRecord{{value: []byte("committed")}})...)
+	data = append(data, encodeBatch(2, attrTransactional|attrControl, aborting, []testRecord{{}})...)
+	// After its abort marker the producer's records count again.
+	data = append(data, encodeBatch(3, attrTransactional, aborting, []testRecord{{value: []byte("retried")}})...)
+
+	msgs, next, err := decodeRecords("events", 0, 0, data, []abortedTxn{{producerID: aborting, firstOffset: 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Value))
+	}
+	if strings.Join(got, ",") != "committed,retried" || next != 4 {
+		t.Errorf("values = %v, next %d", got, next)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	err := error(Error(27))
+	var kerr Error
+	if !errors.As(err, &kerr) || !kerr.rebalance() || kerr.leaderMoved() {
+		t.Errorf("%v should mean a rebalance", err)
+	}
+	if !errNotLeaderForPartition.leaderMoved() {
+		t.Errorf("%v should mean the leader moved", errNotLeaderForPartition)
+	}
+	if got := Error(99).Error(); got != "kafka: error code 99" {
+		t.Errorf("unknown code = %q", got)
+	}
+	if errorCode(0) != nil {
+		t.Error("code 0 is not an error")
+	}
+}
@@ -0,0 +1,190 @@
+// Package kpi evaluates threshold rules over business KPIs: a revenue drop
+// against the same window the day before, an order failure rate above a
+// threshold, and no orders at all for a while. Rules are evaluated over the
+// order totals of a window, which callers sum from the rollup service's
+// order rollups.
+package kpi
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ruleValue = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_kpi_rule_value",
+			Help: "Last value a KPI rule compared to its threshold: the revenue drop or failure rate in percent, or the orders created",
+		},
+		[]string{"rule", "type"},
+	)
+	ruleFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pipeline_kpi_rule_firing",
+			Help: "Whether a KPI rule is firing (1) or not (0)",
+		},
+		[]string{"rule", "type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ruleValue, ruleFiring)
+}
+
+// Rule types.
+const (
+	// TypeRevenueDrop fires when the revenue of the window has dropped by
+	// more than Threshold percent from the same window 24 hours earlier.
+	TypeRevenueDrop = "revenue_drop"
+	// TypeFailureRate fires when more than Threshold percent of the orders
+	// finished within the window failed.
+	TypeFailureRate = "failure_rate"
+	// TypeZeroOrders fires when no order was created within the window.
+	TypeZeroOrders = "zero_orders"
+)
+
+// Baseline is how far back a revenue_drop rule looks for the window it
+// compares to.
+const Baseline = 24 * time.Hour
+
+// ErrInvalid wraps the errors of an invalid rule.
+var ErrInvalid = errors.New("invalid KPI rule")
+
+var namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Rule is one KPI threshold.
+type Rule struct {
+	// Name identifies the rule and is the alertname of its incidents.
+	Name string `mapstructure:"name" json:"name"`
+	// Type is revenue_drop, failure_rate or zero_orders.
+	Type string `mapstructure:"type" json:"type"`
+	// Window is the period evaluated, such as 1h, ending at the last
+	// complete rollup.
+	Window string `mapstructure:"window" json:"window"`
+	// Threshold is the drop or failure rate in percent the rule fires
+	// above; zero_orders rules have none.
+	Threshold float64 `mapstructure:"threshold" json:"threshold,omitempty"`
+	// MinOrders is the number of finished orders a failure_rate rule needs
+	// in the window before it fires, so a single failure is not 100%.
+	MinOrders int64 `mapstructure:"min_orders" json:"min_orders,omitempty"`
+	// MinRevenue is the revenue the baseline window of a revenue_drop rule
+	// needs before a drop is measured against it.
+	MinRevenue float64 `mapstructure:"min_revenue" json:"min_revenue,omitempty"`
+	// Severity is given to the rule's incidents.
+	Severity string `mapstructure:"severity" json:"severity"`
+	// Summary describes the incident; it defaults to one naming the value.
+	Summary string `mapstructure:"summary" json:"summary,omitempty"`
+}
+
+// Duration is the parsed Window.
+func (r Rule) Duration() time.Duration {
+	d, _ := time.ParseDuration(r.Window)
+	return d
+}
+
+// Validate checks the rule's name, type, window and threshold.
+func (r Rule) Validate() error {
+	if !namePattern.MatchString(r.Name) {
+		return fmt.Errorf("%w: name %q must be a letter followed by letters, digits or underscores", ErrInvalid, r.Name)
+	}
+	switch r.Type {
+	case TypeRevenueDrop, TypeFailureRate:
+		if r.Threshold <= 0 || r.Threshold > 100 {
+			return fmt.Errorf("%w %s: threshold must be a percentage above 0", ErrInvalid, r.Name)
+		}
+	case TypeZeroOrders:
+	default:
+		return fmt.Errorf("%w %s: type must be revenue_drop, failure_rate or zero_orders", ErrInvalid, r.Name)
+	}
+	if d, err := time.ParseDuration(r.Window); err != nil || d < time.Minute || d%time.Minute != 0 {
+		return fmt.Errorf("%w %s: window must be a whole number of minutes such as 30m", ErrInvalid, r.Name)
+	}
+	if r.MinOrders < 0 || r.MinRevenue < 0 {
+		return fmt.Errorf("%w %s: min_orders and min_revenue may not be negative", ErrInvalid, r.Name)
+	}
+	if r.Severity == "" {
+		return fmt.Errorf("%w %s: severity is required", ErrInvalid, r.Name)
+	}
+	return nil
+}
+
+// Validate checks every rule and that their names are unique.
+func Validate(rules []Rule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("%w: duplicate rule %s", ErrInvalid, r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// Totals are the orders of a window.
+type Totals struct {
+	Created   int64   `json:"created"`
+	Completed int64   `json:"completed"`
+	Failed    int64   `json:"failed"`
+	Revenue   float64 `json:"revenue"`
+}
+
+// Result is the outcome of evaluating a rule.
+type Result struct {
+	Firing bool `json:"firing"`
+	// Value is what was compared to the threshold: the revenue drop or
+	// failure rate in percent, or the orders created.
+	Value float64 `json:"value"`
+	// Skipped is set when the window had too little to go on, such as a
+	// baseline below min_revenue; a skipped rule does not fire.
+	Skipped string `json:"skipped,omitempty"`
+	// Summary describes the result for the rule's incident.
+	Summary string `json:"summary"`
+}
+
+// Evaluate applies r to the totals of its window; baseline is the same
+// window Baseline earlier and is only used by revenue_drop rules.
+func Evaluate(r Rule, current, baseline Totals) Result {
+	var res Result
+	switch r.Type {
+	case TypeRevenueDrop:
+		switch {
+		case baseline.Revenue <= 0 || baseline.Revenue < r.MinRevenue:
+			res.Skipped = fmt.Sprintf("baseline revenue %.2f below min_revenue", baseline.Revenue)
+		case current.Revenue < baseline.Revenue:
+			res.Value = (baseline.Revenue - current.Revenue) / baseline.Revenue * 100
+		}
+		res.Firing = res.Skipped == "" && res.Value > r.Threshold
+		res.Summary = fmt.Sprintf("Revenue over the last %s is %.2f, down %.1f%% from %.2f the day before", r.Window, current.Revenue, res.Value, baseline.Revenue)
+	case TypeFailureRate:
+		finished := current.Completed + current.Failed
+		if finished == 0 || finished < r.MinOrders {
+			res.Skipped = fmt.Sprintf("%d orders finished, fewer than min_orders", finished)
+		} else {
+			res.Value = float64(current.Failed) / float64(finished) * 100
+		}
+		res.Firing = res.Skipped == "" && res.Value > r.Threshold
+		res.Summary = fmt.Sprintf("%.1f%% of the orders finished in the last %s failed (%d of %d)", res.Value, r.Window, current.Failed, finished)
+	case TypeZeroOrders:
+		res.Value = float64(current.Created)
+		res.Firing = current.Created == 0
+		res.Summary = fmt.Sprintf("No orders were created in the last %s", r.Window)
+	}
+	if r.Summary != "" {
+		res.Summary = r.Summary
+	}
+
+	ruleValue.WithLabelValues(r.Name, r.Type).Set(res.Value)
+	firing := 0.0
+	if res.Firing {
+		firing = 1
+	}
+	ruleFiring.WithLabelValues(r.Name, r.Type).Set(firing)
+	return res
+}
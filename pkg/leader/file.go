@@ -0,0 +1,132 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileLock keeps the lease as a small JSON file on storage shared by all
+// replicas (e.g. the volume holding the database). Replicas take an
+// exclusive flock on Path+".lock" around reading and writing the lease, so
+// the storage must support flock across hosts (a local or NFSv4 volume).
+//
+// Every change of holder increments the lease's term. Term returns the term
+// of the lease this instance last held, for use as a fencing token.
+type FileLock struct {
+	Path string
+
+	mu   sync.Mutex
+	term uint64
+}
+
+type fileLease struct {
+	Holder        string    `json:"holder"`
+	RenewTime     time.Time `json:"renew_time"`
+	LeaseDuration float64   `json:"lease_duration_seconds"`
+	Term          uint64    `json:"term"`
+}
+
+func (l *FileLock) read() (*fileLease, error) {
+	data, err := os.ReadFile(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lease fileLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, fmt.Errorf("corrupt lease: %w", err)
+	}
+	return &lease, nil
+}
+
+func (l *FileLock) write(lease fileLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.Path), filepath.Base(l.Path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (l *FileLock) TryAcquireOrRenew(ctx context.Context, identity string, leaseDuration time.Duration) (bool, error) {
+	unlock, err := lockFile(l.Path + ".lock")
+	if err != nil {
+		return false, fmt.Errorf("lock lease %s: %w", l.Path, err)
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return false, fmt.Errorf("read lease %s: %w", l.Path, err)
+	}
+	if current != nil && current.Holder != identity &&
+		time.Since(current.RenewTime) < time.Duration(current.LeaseDuration*float64(time.Second)) {
+		return false, nil
+	}
+
+	lease := fileLease{Holder: identity, RenewTime: time.Now().UTC(), LeaseDuration: leaseDuration.Seconds(), Term: 1}
+	if current != nil {
+		lease.Term = current.Term
+		if current.Holder != identity {
+			lease.Term++
+		}
+	}
+	if err := l.write(lease); err != nil {
+		return false, fmt.Errorf("write lease %s: %w", l.Path, err)
+	}
+	l.mu.Lock()
+	l.term = lease.Term
+	l.mu.Unlock()
+	return true, nil
+}
+
+func (l *FileLock) Release(ctx context.Context, identity string) error {
+	unlock, err := lockFile(l.Path + ".lock")
+	if err != nil {
+		return fmt.Errorf("lock lease %s: %w", l.Path, err)
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil || current == nil || current.Holder != identity {
+		return err
+	}
+	// Keep the term so the next holder's is higher; an empty holder with
+	// a zero duration is a free lease.
+	current.Holder = ""
+	current.LeaseDuration = 0
+	return l.write(*current)
+}
+
+// Term returns the term of the lease last acquired or renewed by this
+// instance, or 0 if it never held it. A write carrying a lower term than
+// the latest one comes from a holder that lost the lease.
+func (l *FileLock) Term() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.term
+}
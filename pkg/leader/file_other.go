@@ -0,0 +1,9 @@
+//go:build !unix
+
+package leader
+
+import "errors"
+
+func lockFile(path string) (func(), error) {
+	return nil, errors.New("file leases need flock, which this platform lacks")
+}
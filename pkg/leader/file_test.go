@@ -0,0 +1,89 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileLockOneHolderAtATime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		// Every replica races on a lease that expired as it was taken.
+		var holders atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(identity string) {
+				defer wg.Done()
+				lock := &FileLock{Path: path}
+				held, err := lock.TryAcquireOrRenew(ctx, identity, time.Hour)
+				if err != nil {
+					t.Error(err)
+				}
+				if held {
+					holders.Add(1)
+				}
+			}(fmt.Sprintf("replica-%d-%d", round, i))
+		}
+		wg.Wait()
+		if n := holders.Load(); n != 1 {
+			t.Fatalf("round %d: %d replicas hold the lease", round, n)
+		}
+		expire(t, path)
+	}
+}
+
+func TestFileLockTerms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease.json")
+	ctx := context.Background()
+	a, b := &FileLock{Path: path}, &FileLock{Path: path}
+
+	if held, err := a.TryAcquireOrRenew(ctx, "a", time.Hour); !held || err != nil || a.Term() != 1 {
+		t.Fatalf("a: held %v, term %d, %v", held, a.Term(), err)
+	}
+	if held, _ := b.TryAcquireOrRenew(ctx, "b", time.Hour); held || b.Term() != 0 {
+		t.Fatalf("b took a held lease, term %d", b.Term())
+	}
+	if held, _ := a.TryAcquireOrRenew(ctx, "a", time.Hour); !held || a.Term() != 1 {
+		t.Errorf("renewal: held %v, term %d; want the same term", held, a.Term())
+	}
+
+	if err := b.Release(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := b.TryAcquireOrRenew(ctx, "b", time.Hour); held {
+		t.Fatal("release by a non-holder freed the lease")
+	}
+	if err := a.Release(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := b.TryAcquireOrRenew(ctx, "b", time.Hour); !held || b.Term() != 2 {
+		t.Errorf("after release: b held %v, term %d; want term 2", held, b.Term())
+	}
+
+	expire(t, path)
+	if held, _ := a.TryAcquireOrRenew(ctx, "a", time.Hour); !held || a.Term() != 3 {
+		t.Errorf("after expiry: a held %v, term %d; want term 3", held, a.Term())
+	}
+}
+
+// expire backdates the lease at path past its duration.
+func expire(t *testing.T, path string) {
+	t.Helper()
+	l := &FileLock{Path: path}
+	lease, err := l.read()
+	if err != nil || lease == nil {
+		t.Fatalf("read lease: %+v, %v", lease, err)
+	}
+	lease.RenewTime = time.Now().Add(-2 * time.Hour)
+	if err := l.write(*lease); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,206 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the Kubernetes MicroTime wire format.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// KubernetesLock uses a coordination.k8s.io/v1 Lease through the API server,
+// authenticating with the pod's service account. The service account needs
+// get, create and update on leases in the namespace.
+type KubernetesLock struct {
+	Name      string
+	Namespace string
+
+	apiServer string
+	token     string
+	client    *http.Client
+}
+
+// NewKubernetesLock reads the in-cluster configuration. An empty namespace
+// defaults to the pod's own namespace.
+func NewKubernetesLock(name, namespace string) (*KubernetesLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid cluster CA")
+	}
+
+	return &KubernetesLock{
+		Name:      name,
+		Namespace: namespace,
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type lease struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Spec       leaseSpec              `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+func (l *KubernetesLock) TryAcquireOrRenew(ctx context.Context, identity string, leaseDuration time.Duration) (bool, error) {
+	now := time.Now().UTC().Format(microTime)
+	seconds := int(leaseDuration.Seconds())
+
+	current, status, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		created := lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   map[string]interface{}{"name": l.Name, "namespace": l.Namespace},
+			Spec:       leaseSpec{HolderIdentity: identity, LeaseDurationSeconds: seconds, AcquireTime: now, RenewTime: now},
+		}
+		status, err := l.write(ctx, http.MethodPost, l.collectionURL(), created)
+		if err != nil {
+			return false, err
+		}
+		return status == http.StatusCreated || status == http.StatusOK, nil
+	}
+
+	spec := current.Spec
+	if spec.HolderIdentity != identity && spec.HolderIdentity != "" {
+		renewed, err := time.Parse(microTime, spec.RenewTime)
+		if err == nil && time.Since(renewed) < time.Duration(spec.LeaseDurationSeconds)*time.Second {
+			return false, nil
+		}
+	}
+
+	if spec.HolderIdentity != identity {
+		spec.HolderIdentity = identity
+		spec.AcquireTime = now
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = seconds
+	spec.RenewTime = now
+	current.Spec = spec
+
+	// resourceVersion in the metadata makes the update fail with 409 if
+	// another replica changed the lease in between.
+	status, err = l.write(ctx, http.MethodPut, l.collectionURL()+"/"+l.Name, *current)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("update lease %s/%s: status %d", l.Namespace, l.Name, status)
+	}
+}
+
+func (l *KubernetesLock) Release(ctx context.Context, identity string) error {
+	current, status, err := l.get(ctx)
+	if err != nil || status == http.StatusNotFound || current.Spec.HolderIdentity != identity {
+		return err
+	}
+	current.Spec.HolderIdentity = ""
+	current.Spec.RenewTime = ""
+	if _, err := l.write(ctx, http.MethodPut, l.collectionURL()+"/"+l.Name, *current); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *KubernetesLock) collectionURL() string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.apiServer, l.Namespace)
+}
+
+func (l *KubernetesLock) get(ctx context.Context) (*lease, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.collectionURL()+"/"+l.Name, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.StatusCode, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("get lease %s/%s: %s", l.Namespace, l.Name, resp.Status)
+	}
+	var current lease
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &current, resp.StatusCode, nil
+}
+
+func (l *KubernetesLock) write(ctx context.Context, method, url string, body lease) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,155 @@
+// Package leader elects a single replica to run background work such as the
+// data-service processing loop. Leadership is a lease that the holder keeps
+// renewing; when it stops, another replica takes over after the lease expires.
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	isLeaderGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "leader_election_is_leader",
+			Help: "Whether this instance currently holds the lease (1) or not (0)",
+		},
+		[]string{"lease"},
+	)
+	transitionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "leader_election_transitions_total",
+			Help: "Leadership changes observed by this instance",
+		},
+		[]string{"lease", "state"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(isLeaderGauge, transitionsTotal)
+}
+
+// Lock is a lease shared between replicas.
+type Lock interface {
+	// TryAcquireOrRenew takes the lease if it is free or expired and renews it
+	// if already held by identity. It reports whether identity holds it.
+	TryAcquireOrRenew(ctx context.Context, identity string, leaseDuration time.Duration) (bool, error)
+	// Release gives the lease up if identity holds it.
+	Release(ctx context.Context, identity string) error
+}
+
+// Config configures an Elector.
+type Config struct {
+	// Name identifies the lease in metrics and logs.
+	Name     string
+	Identity string
+	// LeaseDuration is how long a lease stays valid without renewal.
+	LeaseDuration time.Duration
+	// RenewPeriod is how often the lease is acquired or renewed.
+	RenewPeriod time.Duration
+	// OnChange is called with the new state whenever leadership changes.
+	OnChange func(isLeader bool)
+}
+
+// Elector keeps trying to hold the lease and tracks whether it does.
+type Elector struct {
+	cfg  Config
+	lock Lock
+
+	mu          sync.RWMutex
+	leader      bool
+	lastRenewal time.Time
+}
+
+func NewElector(lock Lock, cfg Config) *Elector {
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 15 * time.Second
+	}
+	if cfg.RenewPeriod <= 0 || cfg.RenewPeriod >= cfg.LeaseDuration {
+		cfg.RenewPeriod = cfg.LeaseDuration / 3
+	}
+	isLeaderGauge.WithLabelValues(cfg.Name).Set(0)
+	return &Elector{cfg: cfg, lock: lock}
+}
+
+// IsLeader reports whether this instance holds the lease.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// Run campaigns until ctx is done, then releases the lease so another replica
+// can take over without waiting for it to expire.
+func (e *Elector) Run(ctx context.Context, onError func(error)) {
+	ticker := time.NewTicker(e.cfg.RenewPeriod)
+	defer ticker.Stop()
+
+	for {
+		e.tick(ctx, onError)
+
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				e.setLeader(false)
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.lock.Release(releaseCtx, e.cfg.Identity); err != nil && onError != nil {
+					onError(err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) tick(ctx context.Context, onError func(error)) {
+	held, err := e.lock.TryAcquireOrRenew(ctx, e.cfg.Identity, e.cfg.LeaseDuration)
+	if err != nil {
+		if onError != nil {
+			onError(err)
+		}
+		// Keep leading while the last renewal is still within the lease; step
+		// down before another replica may legitimately take over.
+		e.mu.RLock()
+		expired := time.Since(e.lastRenewal) >= e.cfg.LeaseDuration-e.cfg.RenewPeriod
+		e.mu.RUnlock()
+		if expired {
+			e.setLeader(false)
+		}
+		return
+	}
+
+	if held {
+		e.mu.Lock()
+		e.lastRenewal = time.Now()
+		e.mu.Unlock()
+	}
+	e.setLeader(held)
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	state := "follower"
+	value := 0.0
+	if leader {
+		state, value = "leader", 1
+	}
+	isLeaderGauge.WithLabelValues(e.cfg.Name).Set(value)
+	transitionsTotal.WithLabelValues(e.cfg.Name, state).Inc()
+	if e.cfg.OnChange != nil {
+		e.cfg.OnChange(leader)
+	}
+}
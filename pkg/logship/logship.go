@@ -0,0 +1,335 @@
+// Package logship ships structured logrus entries straight to Loki or
+// Elasticsearch for environments without a node-level log collector.
+package logship
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported backends.
+const (
+	BackendLoki          = "loki"
+	BackendElasticsearch = "elasticsearch"
+)
+
+var (
+	shippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "log_shipper_entries_sent_total",
+			Help: "Log entries delivered to the log backend",
+		},
+		[]string{"backend"},
+	)
+	droppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "log_shipper_entries_dropped_total",
+			Help: "Log entries dropped because the buffer was full or delivery failed",
+		},
+		[]string{"backend", "reason"},
+	)
+	retriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "log_shipper_retries_total",
+			Help: "Batch delivery retries",
+		},
+		[]string{"backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shippedTotal, droppedTotal, retriesTotal)
+}
+
+// Config describes where and how logs are shipped.
+type Config struct {
+	Backend string
+	// URL is the Loki base URL (the push path is appended) or the
+	// Elasticsearch base URL (/_bulk is appended).
+	URL string
+	// Index is the Elasticsearch index; ignored for Loki.
+	Index string
+	// Labels are attached to every Loki stream together with service and level.
+	Labels      map[string]string
+	ServiceName string
+	Headers     map[string]string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	BufferSize    int
+	MaxRetries    int
+	Timeout       time.Duration
+}
+
+type record struct {
+	time  time.Time
+	level string
+	line  []byte
+}
+
+// Hook is a logrus hook that buffers entries and ships them in batches from a
+// background goroutine. Entries are dropped, never blocked on, when the buffer
+// is full.
+type Hook struct {
+	cfg       Config
+	client    *http.Client
+	formatter logrus.Formatter
+	entries   chan record
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewHook(cfg Config) (*Hook, error) {
+	switch cfg.Backend {
+	case BackendLoki, BackendElasticsearch:
+	default:
+		return nil, fmt.Errorf("unsupported log shipping backend %q", cfg.Backend)
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("log shipping url is required")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 2 * time.Second
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 10000
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Index == "" {
+		cfg.Index = "logs"
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+
+	formatter := &logrus.JSONFormatter{}
+	if cfg.Backend == BackendElasticsearch {
+		formatter.FieldMap = logrus.FieldMap{logrus.FieldKeyTime: "@timestamp"}
+	}
+
+	h := &Hook{
+		cfg:       cfg,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		formatter: formatter,
+		entries:   make(chan record, cfg.BufferSize),
+		done:      make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues the entry. It never logs, to avoid recursing into the hook.
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	fields := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	if _, ok := fields["service"]; !ok && h.cfg.ServiceName != "" {
+		fields["service"] = h.cfg.ServiceName
+	}
+	line, err := h.formatter.Format(&logrus.Entry{
+		Logger:  entry.Logger,
+		Data:    fields,
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: entry.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return nil
+	}
+
+	select {
+	case h.entries <- record{time: entry.Time, level: entry.Level.String(), line: bytes.TrimRight(line, "\n")}:
+	default:
+		droppedTotal.WithLabelValues(h.cfg.Backend, "buffer_full").Inc()
+	}
+	return nil
+}
+
+// Close stops accepting entries and flushes what is buffered, giving up when
+// ctx is done.
+func (h *Hook) Close(ctx context.Context) {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.entries)
+	}
+	h.mu.Unlock()
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+	}
+}
+
+func (h *Hook) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]record, 0, h.cfg.BatchSize)
+	for {
+		select {
+		case rec, ok := <-h.entries:
+			if !ok {
+				h.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= h.cfg.BatchSize {
+				h.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			h.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (h *Hook) flush(batch []record) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var (
+		body        []byte
+		path        string
+		contentType string
+		err         error
+	)
+	if h.cfg.Backend == BackendLoki {
+		body, err = h.lokiPayload(batch)
+		path, contentType = "/loki/api/v1/push", "application/json"
+	} else {
+		body = h.bulkPayload(batch)
+		path, contentType = "/_bulk", "application/x-ndjson"
+	}
+	if err != nil {
+		droppedTotal.WithLabelValues(h.cfg.Backend, "encode_failed").Add(float64(len(batch)))
+		return
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if err = h.send(path, contentType, body); err == nil {
+			shippedTotal.WithLabelValues(h.cfg.Backend).Add(float64(len(batch)))
+			return
+		}
+		if attempt >= h.cfg.MaxRetries {
+			break
+		}
+		retriesTotal.WithLabelValues(h.cfg.Backend).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	droppedTotal.WithLabelValues(h.cfg.Backend, "send_failed").Add(float64(len(batch)))
+}
+
+func (h *Hook) send(path, contentType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.cfg.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("log backend returned %s", resp.Status)
+	}
+	if h.cfg.Backend == BackendElasticsearch {
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.Errors {
+			return fmt.Errorf("elasticsearch bulk request reported item errors")
+		}
+	}
+	return nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiPayload groups the batch into one stream per level.
+func (h *Hook) lokiPayload(batch []record) ([]byte, error) {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, rec := range batch {
+		s, ok := streams[rec.level]
+		if !ok {
+			labels := make(map[string]string, len(h.cfg.Labels)+2)
+			for k, v := range h.cfg.Labels {
+				labels[k] = v
+			}
+			if h.cfg.ServiceName != "" {
+				labels["service"] = h.cfg.ServiceName
+			}
+			labels["level"] = rec.level
+			s = &lokiStream{Stream: labels}
+			streams[rec.level] = s
+			order = append(order, rec.level)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(rec.time.UnixNano(), 10), string(rec.line)})
+	}
+
+	payload := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, level := range order {
+		payload.Streams = append(payload.Streams, streams[level])
+	}
+	return json.Marshal(payload)
+}
+
+func (h *Hook) bulkPayload(batch []record) []byte {
+	action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": h.cfg.Index}})
+
+	var buf bytes.Buffer
+	for _, rec := range batch {
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(rec.line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,372 @@
+// Package mqtt is a minimal MQTT 3.1.1 subscriber for feeding device and
+// edge telemetry into the pipeline. It connects, subscribes and delivers
+// PUBLISH messages at QoS 0, 1 and 2; it does not publish.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the broker connection.
+type Config struct {
+	// Broker is tcp://host:port, or ssl://, tls:// or mqtts:// for TLS.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// CleanSession discards the broker's session on connect. Without it the
+	// broker keeps the subscriptions and queues QoS 1 and 2 messages while
+	// the client is away, and redelivers the ones it did not acknowledge.
+	CleanSession bool
+	KeepAlive    time.Duration
+	// ConnectTimeout bounds dialling and the CONNECT/SUBSCRIBE handshake.
+	ConnectTimeout time.Duration
+	// MaxReconnectDelay caps the exponential backoff between reconnects.
+	MaxReconnectDelay time.Duration
+	// MaxPacketSize rejects larger packets, closing the connection.
+	MaxPacketSize int
+	TLS           *tls.Config
+	Subscriptions []Subscription
+}
+
+// Subscription is a topic filter and the QoS to receive it at.
+type Subscription struct {
+	Topic string
+	QoS   byte
+}
+
+// Message is a received PUBLISH.
+type Message struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Retained  bool
+	Duplicate bool
+
+	ack func()
+}
+
+// Ack acknowledges a QoS 1 or 2 message, so the broker does not redeliver
+// it. Acks must be given in the order the messages were delivered. After a
+// reconnect, acks for messages of the old connection are dropped and the
+// broker redelivers those messages.
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// Subscriber keeps a subscription to the broker open.
+type Subscriber struct {
+	cfg       Config
+	connected atomic.Bool
+}
+
+func NewSubscriber(cfg Config) *Subscriber {
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 10 * time.Second
+	}
+	if cfg.MaxReconnectDelay <= 0 {
+		cfg.MaxReconnectDelay = time.Minute
+	}
+	if cfg.MaxPacketSize <= 0 {
+		cfg.MaxPacketSize = 1 << 20
+	}
+	return &Subscriber{cfg: cfg}
+}
+
+// Connected reports whether the subscriber is connected and subscribed.
+func (s *Subscriber) Connected() bool {
+	return s.connected.Load()
+}
+
+// Run delivers messages until ctx is cancelled, reconnecting with backoff
+// when the connection fails. deliver is called with one message at a time,
+// in order; while it blocks no more messages are read, so a slow consumer
+// holds the broker back instead of losing QoS 1 and 2 messages. onError is
+// told why each connection ended.
+func (s *Subscriber) Run(ctx context.Context, deliver func(Message), onError func(error)) {
+	delay := time.Second
+	for {
+		subscribed, err := s.session(ctx, deliver)
+		s.connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if onError != nil {
+			onError(err)
+		}
+		if subscribed {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > s.cfg.MaxReconnectDelay {
+			delay = s.cfg.MaxReconnectDelay
+		}
+	}
+}
+
+// conn is one connection to the broker.
+type conn struct {
+	net.Conn
+	writeMu  sync.Mutex
+	lastSent atomic.Int64
+	closed   atomic.Bool
+}
+
+func (c *conn) send(p packet) error {
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Write(p.encode())
+	c.lastSent.Store(time.Now().UnixNano())
+	return err
+}
+
+func (s *Subscriber) dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(s.cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: s.cfg.ConnectTimeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		cfg := s.cfg.TLS
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+		d := &tls.Dialer{NetDialer: dialer, Config: cfg}
+		return d.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	}
+	return nil, fmt.Errorf("mqtt: unsupported broker scheme %q", u.Scheme)
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// session runs one connection: connect, subscribe and read until it fails
+// or ctx is cancelled. subscribed reports whether it got that far.
+func (s *Subscriber) session(ctx context.Context, deliver func(Message)) (subscribed bool, err error) {
+	nc, err := s.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	c := &conn{Conn: nc}
+	defer func() {
+		c.closed.Store(true)
+		nc.Close()
+	}()
+	reader := bufio.NewReader(c)
+
+	c.SetDeadline(time.Now().Add(s.cfg.ConnectTimeout))
+	if err := c.send(connectPacket(s.cfg)); err != nil {
+		return false, err
+	}
+	p, err := readPacket(reader, s.cfg.MaxPacketSize)
+	if err != nil {
+		return false, fmt.Errorf("mqtt: read CONNACK: %w", err)
+	}
+	if p.kind != packetConnack || len(p.body) < 2 {
+		return false, fmt.Errorf("mqtt: expected CONNACK, got packet type %d", p.kind)
+	}
+	if code := p.body[1]; code != 0 {
+		return false, fmt.Errorf("mqtt: connection refused: %s", connackReason(code))
+	}
+
+	if err := c.send(subscribePacket(1, s.cfg.Subscriptions)); err != nil {
+		return false, err
+	}
+	// Retained and queued messages may arrive before the SUBACK.
+	var early []packet
+	for {
+		p, err := readPacket(reader, s.cfg.MaxPacketSize)
+		if err != nil {
+			return false, fmt.Errorf("mqtt: read SUBACK: %w", err)
+		}
+		if p.kind != packetSuback {
+			early = append(early, p)
+			continue
+		}
+		if len(p.body) != 2+len(s.cfg.Subscriptions) {
+			return false, errors.New("mqtt: malformed SUBACK")
+		}
+		for i, code := range p.body[2:] {
+			if code == 0x80 {
+				return false, fmt.Errorf("mqtt: subscription to %q refused", s.cfg.Subscriptions[i].Topic)
+			}
+		}
+		break
+	}
+	c.SetDeadline(time.Time{})
+	s.connected.Store(true)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.send(packet{kind: packetDisconnect})
+			c.closed.Store(true)
+			nc.Close()
+		case <-stop:
+		}
+	}()
+	go s.keepAlive(c, stop)
+
+	// received holds the QoS 2 packet IDs delivered and awaiting PUBREL,
+	// true once acknowledged with PUBREC, so a redelivered PUBLISH is not
+	// delivered twice.
+	var receivedMu sync.Mutex
+	received := make(map[uint16]bool)
+	handle := func(p packet) error {
+		switch p.kind {
+		case packetPublish:
+			m, id, err := parsePublish(p)
+			if err != nil {
+				return err
+			}
+			switch m.QoS {
+			case 1:
+				m.ack = func() { c.send(ackPacket(packetPuback, id)) }
+			case 2:
+				receivedMu.Lock()
+				acked, seen := received[id]
+				if !seen {
+					received[id] = false
+				}
+				receivedMu.Unlock()
+				if acked {
+					return c.send(ackPacket(packetPubrec, id))
+				}
+				if seen {
+					// The PUBREC follows when the first delivery is acked.
+					return nil
+				}
+				m.ack = func() {
+					receivedMu.Lock()
+					received[id] = true
+					receivedMu.Unlock()
+					c.send(ackPacket(packetPubrec, id))
+				}
+			}
+			deliver(m)
+		case packetPubrel:
+			id, err := packetID(p.body)
+			if err != nil {
+				return err
+			}
+			receivedMu.Lock()
+			delete(received, id)
+			receivedMu.Unlock()
+			return c.send(ackPacket(packetPubcomp, id))
+		}
+		return nil
+	}
+
+	for _, p := range early {
+		if err := handle(p); err != nil {
+			return true, err
+		}
+	}
+	for {
+		// The broker answers every PINGREQ, so silence for two keep-alive
+		// periods means the connection is dead.
+		c.SetReadDeadline(time.Now().Add(2 * s.cfg.KeepAlive))
+		p, err := readPacket(reader, s.cfg.MaxPacketSize)
+		if err != nil {
+			return true, err
+		}
+		if err := handle(p); err != nil {
+			return true, err
+		}
+	}
+}
+
+// keepAlive sends a PINGREQ whenever nothing was sent for half the
+// keep-alive period.
+func (s *Subscriber) keepAlive(c *conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.cfg.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastSent.Load())) >= s.cfg.KeepAlive/2 {
+				c.send(packet{kind: packetPingreq})
+			}
+		}
+	}
+}
+
+func connackReason(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	}
+	return fmt.Sprintf("return code %d", code)
+}
+
+// Match reports whether topic matches filter, with MQTT's + (one level) and
+// # (all remaining levels) wildcards. A $share/<group>/ prefix of a shared
+// subscription is ignored, and wildcards at the first level do not match
+// topics starting with $.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
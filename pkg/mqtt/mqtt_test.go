@@ -0,0 +1,198 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts one connection and runs script against it.
+func fakeBroker(t *testing.T, script func(c net.Conn, r *bufio.Reader) error) (url string, done <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		errs <- script(c, bufio.NewReader(c))
+	}()
+	return "tcp://" + ln.Addr().String(), errs
+}
+
+// expect reads the next packet and checks its type and, for acks, its
+// packet identifier.
+func expect(r *bufio.Reader, kind byte, id uint16) (packet, error) {
+	p, err := readPacket(r, maxRemainingBytes)
+	if err != nil {
+		return p, fmt.Errorf("waiting for packet type %d: %w", kind, err)
+	}
+	if p.kind != kind {
+		return p, fmt.Errorf("got packet type %d, want %d", p.kind, kind)
+	}
+	if id != 0 {
+		if got, err := packetID(p.body); err != nil || got != id {
+			return p, fmt.Errorf("packet type %d for id %d, want %d", kind, got, id)
+		}
+	}
+	return p, nil
+}
+
+func publish(topic string, qos byte, id uint16, dup bool, payload string) []byte {
+	flags := qos << 1
+	if dup {
+		flags |= 0x08
+	}
+	b := appendString(nil, topic)
+	if qos > 0 {
+		b = binary.BigEndian.AppendUint16(b, id)
+	}
+	return packet{kind: packetPublish, flags: flags, body: append(b, payload...)}.encode()
+}
+
+func TestSubscriberDeliversAndAcknowledges(t *testing.T) {
+	url, done := fakeBroker(t, func(c net.Conn, r *bufio.Reader) error {
+		p, err := expect(r, packetConnect, 0)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(p.body), "edge-1") {
+			return fmt.Errorf("CONNECT without the client ID: %q", p.body)
+		}
+		c.Write(packet{kind: packetConnack, body: []byte{0, 0}}.encode())
+		if _, err = expect(r, packetSubscribe, 1); err != nil {
+			return err
+		}
+		// A queued message arrives before the SUBACK.
+		c.Write(publish("devices/a/temp", 1, 7, false, "early"))
+		c.Write(packet{kind: packetSuback, body: []byte{0, 1, 1}}.encode())
+		if _, err := expect(r, packetPuback, 7); err != nil {
+			return err
+		}
+
+		// QoS 2, with the PUBLISH redelivered before the PUBREL.
+		c.Write(publish("devices/b/temp", 2, 8, false, "exactly-once"))
+		if _, err := expect(r, packetPubrec, 8); err != nil {
+			return err
+		}
+		c.Write(publish("devices/b/temp", 2, 8, true, "exactly-once"))
+		if _, err := expect(r, packetPubrec, 8); err != nil {
+			return err
+		}
+		c.Write(ackPacket(packetPubrel, 8).encode())
+		if _, err := expect(r, packetPubcomp, 8); err != nil {
+			return err
+		}
+
+		c.Write(publish("devices/c/temp", 0, 0, false, "last"))
+		_, err = expect(r, packetDisconnect, 0)
+		return err
+	})
+
+	s := NewSubscriber(Config{
+		Broker:        url,
+		ClientID:      "edge-1",
+		Subscriptions: []Subscription{{Topic: "devices/+/temp", QoS: 2}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var got []string
+	s.Run(ctx, func(m Message) {
+		if !s.Connected() {
+			t.Error("delivered while not connected")
+		}
+		m.Ack()
+		mu.Lock()
+		got = append(got, string(m.Payload))
+		n := len(got)
+		mu.Unlock()
+		if string(m.Payload) == "last" || n > 3 {
+			cancel()
+		}
+	}, func(err error) { t.Errorf("connection ended: %v", err) })
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "early,exactly-once,last" {
+		t.Errorf("delivered %v", got)
+	}
+}
+
+func TestSubscriberReportsRefusals(t *testing.T) {
+	cases := map[string]struct {
+		connack, suback []byte
+		want            string
+	}{
+		"bad credentials":      {[]byte{0, 4}, nil, "bad user name or password"},
+		"refused subscription": {[]byte{0, 0}, []byte{0, 1, 0x80}, `subscription to "devices/#" refused`},
+	}
+	for name, tc := range cases {
+		url, done := fakeBroker(t, func(c net.Conn, r *bufio.Reader) error {
+			if _, err := expect(r, packetConnect, 0); err != nil {
+				return err
+			}
+			c.Write(packet{kind: packetConnack, body: tc.connack}.encode())
+			if tc.suback == nil {
+				return nil
+			}
+			if _, err := expect(r, packetSubscribe, 1); err != nil {
+				return err
+			}
+			c.Write(packet{kind: packetSuback, body: tc.suback}.encode())
+			return nil
+		})
+
+		s := NewSubscriber(Config{Broker: url, ClientID: "edge-1", Username: "u", Password: "p", Subscriptions: []Subscription{{Topic: "devices/#"}}})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var got error
+		s.Run(ctx, func(Message) { t.Errorf("%s: delivered a message", name) }, func(err error) {
+			got = err
+			cancel()
+		})
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got == nil || !strings.Contains(got.Error(), tc.want) {
+			t.Errorf("%s: error %v, want %q", name, got, tc.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"devices/+/temp", "devices/a/temp", true},
+		{"devices/+/temp", "devices/a/b/temp", false},
+		{"devices/#", "devices", true},
+		{"devices/#", "devices/a/b", true},
+		{"devices/a", "devices/a/b", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$share/ingest/devices/+", "devices/a", true},
+		{"$share/ingest", "ingest", false},
+	}
+	for _, tc := range cases {
+		if got := Match(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v", tc.filter, tc.topic, got)
+		}
+	}
+}
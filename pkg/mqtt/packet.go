@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+	maxRemainingBytes = 268435455
+)
+
+// packet is a control packet: its fixed header flags and the bytes after the
+// remaining length.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads one control packet of at most maxSize bytes.
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > maxSize {
+		return packet{}, fmt.Errorf("mqtt: packet of %d bytes exceeds the %d byte limit", length, maxSize)
+	}
+	p := packet{kind: header >> 4, flags: header & 0x0f, body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+// encode returns p with its fixed header.
+func (p packet) encode() []byte {
+	b := []byte{p.kind<<4 | p.flags}
+	n := len(p.body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, p.body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a length-prefixed string from the front of b.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func connectPacket(cfg Config) packet {
+	var flags byte
+	if cfg.CleanSession {
+		flags |= 0x02
+	}
+	if cfg.Username != "" {
+		flags |= 0x80
+		if cfg.Password != "" {
+			flags |= 0x40
+		}
+	}
+	b := appendString(nil, "MQTT")
+	b = append(b, 4, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(cfg.KeepAlive.Seconds()))
+	b = appendString(b, cfg.ClientID)
+	if cfg.Username != "" {
+		b = appendString(b, cfg.Username)
+		if cfg.Password != "" {
+			b = appendString(b, cfg.Password)
+		}
+	}
+	return packet{kind: packetConnect, body: b}
+}
+
+func subscribePacket(id uint16, subs []Subscription) packet {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	for _, s := range subs {
+		b = appendString(b, s.Topic)
+		b = append(b, s.QoS)
+	}
+	return packet{kind: packetSubscribe, flags: 0x02, body: b}
+}
+
+// ackPacket is a PUBACK, PUBREC, PUBREL or PUBCOMP for packet id.
+func ackPacket(kind byte, id uint16) packet {
+	var flags byte
+	if kind == packetPubrel {
+		flags = 0x02
+	}
+	return packet{kind: kind, flags: flags, body: binary.BigEndian.AppendUint16(nil, id)}
+}
+
+// packetID reads the packet identifier at the front of b.
+func packetID(b []byte) (uint16, error) {
+	if len(b) < 2 {
+		return 0, errors.New("mqtt: truncated packet identifier")
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// parsePublish decodes a PUBLISH packet.
+func parsePublish(p packet) (Message, uint16, error) {
+	m := Message{
+		QoS:       (p.flags >> 1) & 0x03,
+		Retained:  p.flags&0x01 != 0,
+		Duplicate: p.flags&0x08 != 0,
+	}
+	if m.QoS > 2 {
+		return m, 0, errors.New("mqtt: invalid QoS 3")
+	}
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return m, 0, err
+	}
+	m.Topic = topic
+	var id uint16
+	if m.QoS > 0 {
+		if id, err = packetID(rest); err != nil {
+			return m, 0, err
+		}
+		rest = rest[2:]
+	}
+	m.Payload = rest
+	return m, id, nil
+}
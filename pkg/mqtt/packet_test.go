@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	// Sizes at the edges of the one to four byte remaining lengths.
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, 2097151, 2097152} {
+		p := packet{kind: packetPublish, flags: 0x0b, body: bytes.Repeat([]byte{0xa5}, size)}
+		encoded := p.encode()
+		got, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)), maxRemainingBytes)
+		if err != nil {
+			t.Fatalf("%d byte body: %v", size, err)
+		}
+		if got.kind != p.kind || got.flags != p.flags || !bytes.Equal(got.body, p.body) {
+			t.Errorf("%d byte body: got kind %d flags %#x and %d bytes", size, got.kind, got.flags, len(got.body))
+		}
+	}
+
+	// 321 = 0xc1 0x02
+	if b := (packet{kind: packetPuback, body: make([]byte, 321)}).encode(); !bytes.Equal(b[:3], []byte{0x40, 0xc1, 0x02}) {
+		t.Errorf("fixed header = % x", b[:3])
+	}
+}
+
+func TestReadPacketRejectsBadInput(t *testing.T) {
+	cases := map[string]struct {
+		in   []byte
+		want string
+	}{
+		"five length bytes": {[]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, "malformed remaining length"},
+		"over the limit":    {[]byte{0x30, 0x80, 0x01}, "exceeds the 100 byte limit"},
+		"truncated body":    {[]byte{0x30, 0x05, 'a', 'b'}, "unexpected EOF"},
+	}
+	for name, tc := range cases {
+		_, err := readPacket(bufio.NewReader(bytes.NewReader(tc.in)), 100)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestConnectPacket(t *testing.T) {
+	p := connectPacket(Config{ClientID: "edge-1", Username: "u", Password: "p", CleanSession: true, KeepAlive: 30 * time.Second})
+	want := []byte{
+		0, 4, 'M', 'Q', 'T', 'T', 4,
+		0xc2,  // user name, password, clean session
+		0, 30, // keep alive
+		0, 6, 'e', 'd', 'g', 'e', '-', '1',
+		0, 1, 'u',
+		0, 1, 'p',
+	}
+	if p.kind != packetConnect || !bytes.Equal(p.body, want) {
+		t.Errorf("CONNECT body = % x", p.body)
+	}
+
+	p = connectPacket(Config{ClientID: "edge-1", KeepAlive: time.Minute})
+	if flags := p.body[7]; flags != 0 {
+		t.Errorf("anonymous CONNECT flags = %#x", flags)
+	}
+}
+
+func TestSubscribeAndAckPackets(t *testing.T) {
+	p := subscribePacket(9, []Subscription{{Topic: "a/+", QoS: 1}, {Topic: "b/#", QoS: 2}})
+	want := []byte{0, 9, 0, 3, 'a', '/', '+', 1, 0, 3, 'b', '/', '#', 2}
+	if p.kind != packetSubscribe || p.flags != 0x02 || !bytes.Equal(p.body, want) {
+		t.Errorf("SUBSCRIBE = flags %#x body % x", p.flags, p.body)
+	}
+	if p := ackPacket(packetPubrel, 0x1234); p.flags != 0x02 || !bytes.Equal(p.body, []byte{0x12, 0x34}) {
+		t.Errorf("PUBREL = %+v", p)
+	}
+	if p := ackPacket(packetPuback, 1); p.flags != 0 {
+		t.Errorf("PUBACK flags = %#x", p.flags)
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	body := appendString(nil, "sensors/t1")
+	m, id, err := parsePublish(packet{kind: packetPublish, flags: 0x01, body: append(body, "21.5"...)})
+	if err != nil || m.Topic != "sensors/t1" || string(m.Payload) != "21.5" || m.QoS != 0 || !m.Retained || id != 0 {
+		t.Errorf("QoS 0 = %+v, id %d, %v", m, id, err)
+	}
+
+	body = append(appendString(nil, "sensors/t1"), 0x00, 0x2a)
+	m, id, err = parsePublish(packet{kind: packetPublish, flags: 0x0c, body: append(body, "x"...)})
+	if err != nil || m.QoS != 2 || !m.Duplicate || m.Retained || id != 42 || string(m.Payload) != "x" {
+		t.Errorf("QoS 2 = %+v, id %d, %v", m, id, err)
+	}
+
+	if _, _, err := parsePublish(packet{kind: packetPublish, flags: 0x06, body: body}); err == nil {
+		t.Error("QoS 3 was accepted")
+	}
+	if _, _, err := parsePublish(packet{kind: packetPublish, flags: 0x02, body: appendString(nil, "t")}); err == nil {
+		t.Error("QoS 1 without a packet identifier was accepted")
+	}
+	if _, _, err := parsePublish(packet{kind: packetPublish, body: []byte{0, 9, 'a'}}); err == nil {
+		t.Error("truncated topic was accepted")
+	}
+}
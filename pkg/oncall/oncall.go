@@ -0,0 +1,573 @@
+// Package oncall pages the people on call for incidents. Routes pick an
+// escalation policy by an incident's severity and service; a policy is a
+// chain of steps, each notifying channels (Slack, PagerDuty or a webhook)
+// once the incident has been open and unacknowledged for the step's delay.
+// Acknowledging an incident stops its escalation, and the channels already
+// notified hear of the acknowledgement and the resolution.
+//
+// The routing comes from the config and can be replaced through the API;
+// the replacement and the escalations in progress are kept in a JSON file
+// so they survive restarts.
+package oncall
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pipeline/pkg/incident"
+)
+
+var (
+	notifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_oncall_notifications_total",
+			Help: "On-call notifications by channel, event (triggered, escalated, acknowledged or resolved) and result: delivered or failed",
+		},
+		[]string{"channel", "event", "result"},
+	)
+	activePages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_oncall_pages_active",
+		Help: "Unresolved incidents being paged",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(notifications, activePages)
+}
+
+// Channel types.
+const (
+	TypeSlack     = "slack"
+	TypePagerDuty = "pagerduty"
+	TypeWebhook   = "webhook"
+)
+
+// Notification events.
+const (
+	EventTriggered    = "triggered"
+	EventEscalated    = "escalated"
+	EventAcknowledged = "acknowledged"
+	EventResolved     = "resolved"
+)
+
+// PagerDutyURL is the PagerDuty Events API v2 endpoint, used for pagerduty
+// channels without a URL.
+const PagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// redacted replaces secrets in the routing shown by the API. Setting a
+// routing with redacted or empty secrets keeps the channel's current ones.
+const redacted = "***"
+
+// ErrInvalid wraps the errors of an invalid routing set through the API.
+var ErrInvalid = errors.New("invalid routing")
+
+// Channel is where notifications are sent.
+type Channel struct {
+	// Type is slack, pagerduty or webhook.
+	Type string `mapstructure:"type" json:"type"`
+	// URL is the Slack incoming webhook or the webhook to POST to; for
+	// PagerDuty it defaults to PagerDutyURL.
+	URL string `mapstructure:"url" json:"url,omitempty"`
+	// RoutingKey is the PagerDuty integration key.
+	RoutingKey string `mapstructure:"routing_key" json:"routing_key,omitempty"`
+}
+
+// Step is one link of an escalation chain.
+type Step struct {
+	// After is how long an incident must have been open and unacknowledged
+	// before the step notifies its channels, such as 15m; empty for at
+	// once.
+	After    string   `mapstructure:"after" json:"after,omitempty"`
+	Channels []string `mapstructure:"channels" json:"channels"`
+}
+
+func (s Step) delay() time.Duration {
+	d, _ := time.ParseDuration(s.After)
+	return d
+}
+
+// Route sends the incidents it matches to an escalation policy. Empty
+// fields match all incidents.
+type Route struct {
+	Severity string `mapstructure:"severity" json:"severity,omitempty"`
+	Service  string `mapstructure:"service" json:"service,omitempty"`
+	Policy   string `mapstructure:"policy" json:"policy"`
+}
+
+// Routing is the on-call setup: channels by name, escalation policies by
+// name and the routes, of which the first matching an incident wins.
+// Incidents no route matches are not paged.
+type Routing struct {
+	Channels map[string]Channel `mapstructure:"channels" json:"channels"`
+	Policies map[string][]Step  `mapstructure:"policies" json:"policies"`
+	Routes   []Route            `mapstructure:"routes" json:"routes"`
+}
+
+// Validate checks the channels and that policies and routes name existing
+// ones, with steps in order of their delays.
+func (r Routing) Validate() error {
+	for name, c := range r.Channels {
+		switch c.Type {
+		case TypeSlack, TypeWebhook:
+			if c.URL == "" {
+				return fmt.Errorf("channel %q: url is required", name)
+			}
+		case TypePagerDuty:
+			if c.RoutingKey == "" {
+				return fmt.Errorf("channel %q: routing_key is required", name)
+			}
+		default:
+			return fmt.Errorf("channel %q: type must be slack, pagerduty or webhook", name)
+		}
+		if c.URL != "" {
+			if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("channel %q: url must be an absolute http or https URL", name)
+			}
+		}
+	}
+	for name, steps := range r.Policies {
+		if len(steps) == 0 {
+			return fmt.Errorf("policy %q: no steps", name)
+		}
+		var last time.Duration
+		for i, step := range steps {
+			d, err := time.ParseDuration(step.After)
+			if step.After == "" {
+				d, err = 0, nil
+			}
+			switch {
+			case err != nil || d < 0:
+				return fmt.Errorf("policy %q step %d: after must be a duration such as 15m", name, i+1)
+			case d < last:
+				return fmt.Errorf("policy %q step %d: steps must be in order of their delays", name, i+1)
+			case len(step.Channels) == 0:
+				return fmt.Errorf("policy %q step %d: no channels", name, i+1)
+			}
+			for _, channel := range step.Channels {
+				if _, ok := r.Channels[channel]; !ok {
+					return fmt.Errorf("policy %q step %d: unknown channel %q", name, i+1, channel)
+				}
+			}
+			last = d
+		}
+	}
+	for i, route := range r.Routes {
+		if _, ok := r.Policies[route.Policy]; !ok {
+			return fmt.Errorf("route %d: unknown policy %q", i+1, route.Policy)
+		}
+	}
+	return nil
+}
+
+// Route returns the policy of the first route matching an incident.
+func (r Routing) Route(in incident.Incident) (string, bool) {
+	for _, route := range r.Routes {
+		if (route.Severity == "" || route.Severity == in.Severity) && (route.Service == "" || route.Service == in.Service) {
+			return route.Policy, true
+		}
+	}
+	return "", false
+}
+
+// Redacted returns the routing with the channels' secrets replaced: URLs
+// keep their scheme and host, routing keys are dropped.
+func (r Routing) Redacted() Routing {
+	out := r
+	out.Channels = make(map[string]Channel, len(r.Channels))
+	for name, c := range r.Channels {
+		if u, err := url.Parse(c.URL); err == nil && c.URL != "" {
+			c.URL = u.Scheme + "://" + u.Host + "/" + redacted
+		}
+		if c.RoutingKey != "" {
+			c.RoutingKey = redacted
+		}
+		out.Channels[name] = c
+	}
+	return out
+}
+
+// Page is the escalation of one unresolved incident.
+type Page struct {
+	IncidentID string `json:"incident_id"`
+	Policy     string `json:"policy"`
+	// Steps counts the policy's steps notified so far.
+	Steps int `json:"steps"`
+	// Channels are those notified, which hear of the acknowledgement and
+	// the resolution.
+	Channels     []string  `json:"channels"`
+	Acknowledged bool      `json:"acknowledged,omitempty"`
+	OpenedAt     time.Time `json:"opened_at"`
+}
+
+// Notification is the outcome of notifying a channel of an incident.
+type Notification struct {
+	IncidentID string
+	Event      string
+	// Step is the policy step, from 1, of triggered and escalated events.
+	Step    int
+	Channel string
+	Err     error
+}
+
+// Config configures a Pager.
+type Config struct {
+	// Path is the JSON file the routing set through the API and the pages
+	// are saved to.
+	Path string
+	// Routing is used until one is set through the API.
+	Routing Routing
+	// Timeout bounds each notification; 10s by default.
+	Timeout time.Duration
+	// Link, if set, returns the URL of an incident for the notifications.
+	Link func(id string) string
+	// Muted, if set, reports incidents that are silenced: they are not
+	// paged, and their escalation waits until they no longer are.
+	Muted func(in incident.Incident) bool
+}
+
+// Pager escalates incidents along their policies.
+type Pager struct {
+	cfg    Config
+	client *http.Client
+
+	mu       sync.Mutex
+	override *Routing
+	pages    map[string]*Page
+}
+
+// state is what a Pager saves.
+type state struct {
+	Routing *Routing         `json:"routing,omitempty"`
+	Pages   map[string]*Page `json:"pages"`
+}
+
+// NewPager validates the configured routing and loads the state saved at
+// cfg.Path.
+func NewPager(cfg Config) (*Pager, error) {
+	if err := cfg.Routing.Validate(); err != nil {
+		return nil, fmt.Errorf("oncall routing: %w", err)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	p := &Pager{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}, pages: make(map[string]*Page)}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open oncall state: %w", err)
+	}
+	if len(data) > 0 {
+		var st state
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("parse oncall state: %w", err)
+		}
+		p.override = st.Routing
+		if st.Pages != nil {
+			p.pages = st.Pages
+		}
+	}
+	activePages.Set(float64(len(p.pages)))
+	return p, nil
+}
+
+// Routing returns the routing in use and where it comes from: config or
+// api.
+func (p *Pager) Routing() (Routing, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.override != nil {
+		return *p.override, "api"
+	}
+	return p.cfg.Routing, "config"
+}
+
+// SetRouting replaces the routing. Channels given without their URL or
+// routing key, or with the redacted ones, keep those of the channel of the
+// same name.
+func (p *Pager) SetRouting(r Routing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.cfg.Routing
+	if p.override != nil {
+		current = *p.override
+	}
+	for name, c := range r.Channels {
+		old, ok := current.Channels[name]
+		if !ok || old.Type != c.Type {
+			continue
+		}
+		if c.URL == "" || strings.HasSuffix(c.URL, "/"+redacted) {
+			c.URL = old.URL
+		}
+		if c.RoutingKey == "" || c.RoutingKey == redacted {
+			c.RoutingKey = old.RoutingKey
+		}
+		r.Channels[name] = c
+	}
+	if err := r.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	p.override = &r
+	return p.save()
+}
+
+// ResetRouting goes back to the configured routing.
+func (p *Pager) ResetRouting() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.override = nil
+	return p.save()
+}
+
+// Pages returns the escalations in progress, oldest first.
+func (p *Pager) Pages() []Page {
+	p.mu.Lock()
+	pages := make([]Page, 0, len(p.pages))
+	for _, pg := range p.pages {
+		c := *pg
+		c.Channels = append([]string(nil), pg.Channels...)
+		pages = append(pages, c)
+	}
+	p.mu.Unlock()
+	sort.Slice(pages, func(i, j int) bool { return pages[i].OpenedAt.Before(pages[j].OpenedAt) })
+	return pages
+}
+
+// delivery is a notification to send.
+type delivery struct {
+	incident incident.Incident
+	event    string
+	step     int
+	name     string
+	channel  Channel
+}
+
+// Tick brings the pages up to date with incidents, the current state of
+// all of them: it starts paging newly routed incidents, escalates those
+// whose next step is due and tells the notified channels of
+// acknowledgements and resolutions. It returns the notifications it sent,
+// and the error of saving the pages.
+func (p *Pager) Tick(incidents []incident.Incident, now time.Time) ([]Notification, error) {
+	p.mu.Lock()
+	routing := p.cfg.Routing
+	if p.override != nil {
+		routing = *p.override
+	}
+	var deliveries []delivery
+	notify := func(in incident.Incident, event string, step int, names []string) {
+		for _, name := range names {
+			if c, ok := routing.Channels[name]; ok {
+				deliveries = append(deliveries, delivery{incident: in, event: event, step: step, name: name, channel: c})
+			}
+		}
+	}
+
+	changed := false
+	seen := make(map[string]bool, len(incidents))
+	for _, in := range incidents {
+		seen[in.ID] = true
+		pg := p.pages[in.ID]
+		switch {
+		case in.Status == incident.StatusResolved:
+			if pg != nil {
+				notify(in, EventResolved, 0, pg.Channels)
+				delete(p.pages, in.ID)
+				changed = true
+			}
+		case in.Status == incident.StatusAcknowledged:
+			if pg != nil && !pg.Acknowledged {
+				notify(in, EventAcknowledged, 0, pg.Channels)
+				pg.Acknowledged = true
+				changed = true
+			}
+		case p.cfg.Muted != nil && p.cfg.Muted(in):
+		default:
+			if pg == nil {
+				policy, ok := routing.Route(in)
+				if !ok {
+					continue
+				}
+				pg = &Page{IncidentID: in.ID, Policy: policy, Channels: []string{}, OpenedAt: in.OpenedAt}
+				p.pages[in.ID] = pg
+				changed = true
+			}
+			steps := routing.Policies[pg.Policy]
+			for pg.Steps < len(steps) && now.Sub(in.OpenedAt) >= steps[pg.Steps].delay() {
+				event := EventEscalated
+				if pg.Steps == 0 {
+					event = EventTriggered
+				}
+				step := steps[pg.Steps]
+				notify(in, event, pg.Steps+1, step.Channels)
+				for _, name := range step.Channels {
+					if !slices.Contains(pg.Channels, name) {
+						pg.Channels = append(pg.Channels, name)
+					}
+				}
+				pg.Steps++
+				changed = true
+			}
+		}
+	}
+	for id := range p.pages {
+		if !seen[id] {
+			delete(p.pages, id)
+			changed = true
+		}
+	}
+	var err error
+	if changed {
+		err = p.save()
+	}
+	activePages.Set(float64(len(p.pages)))
+	p.mu.Unlock()
+
+	sent := make([]Notification, len(deliveries))
+	var wg sync.WaitGroup
+	for i, d := range deliveries {
+		wg.Add(1)
+		go func(i int, d delivery) {
+			defer wg.Done()
+			sent[i] = Notification{IncidentID: d.incident.ID, Event: d.event, Step: d.step, Channel: d.name, Err: p.send(d)}
+			result := "delivered"
+			if sent[i].Err != nil {
+				result = "failed"
+			}
+			notifications.WithLabelValues(d.name, d.event, result).Inc()
+		}(i, d)
+	}
+	wg.Wait()
+	return sent, err
+}
+
+// send delivers one notification in the channel's format.
+func (p *Pager) send(d delivery) error {
+	in := d.incident
+	link := ""
+	if p.cfg.Link != nil {
+		link = p.cfg.Link(in.ID)
+	}
+
+	var body interface{}
+	target := d.channel.URL
+	switch d.channel.Type {
+	case TypeSlack:
+		body = map[string]string{"text": message(in, d.event, link)}
+	case TypePagerDuty:
+		if target == "" {
+			target = PagerDutyURL
+		}
+		action := "trigger"
+		switch d.event {
+		case EventAcknowledged:
+			action = "acknowledge"
+		case EventResolved:
+			action = "resolve"
+		}
+		source := in.Service
+		if source == "" {
+			source = "pipeline"
+		}
+		event := map[string]interface{}{
+			"routing_key":  d.channel.RoutingKey,
+			"event_action": action,
+			"dedup_key":    in.ID,
+		}
+		if action == "trigger" {
+			event["payload"] = map[string]string{"summary": in.Title, "source": source, "severity": pagerDutySeverity(in.Severity)}
+			if link != "" {
+				event["links"] = []map[string]string{{"href": link, "text": "Incident " + in.ID}}
+			}
+		}
+		body = event
+	default:
+		body = map[string]interface{}{"event": "incident." + d.event, "step": d.step, "text": message(in, d.event, link), "incident": in}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// The URL may hold a token; the error without it is enough.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", d.channel.Type, resp.Status)
+	}
+	return nil
+}
+
+// message is the chat text of a notification.
+func message(in incident.Incident, event, link string) string {
+	var text string
+	switch event {
+	case EventAcknowledged:
+		text = fmt.Sprintf("[ACKNOWLEDGED] %s, by %s", in.Title, in.AcknowledgedBy)
+	case EventResolved:
+		text = fmt.Sprintf("[RESOLVED] %s", in.Title)
+		if in.ResolvedAt != nil {
+			text += fmt.Sprintf(" after %s", in.ResolvedAt.Sub(in.OpenedAt).Round(time.Second))
+		}
+	default:
+		text = fmt.Sprintf("[%s] %s", strings.ToUpper(in.Severity), in.Title)
+		if event == EventEscalated {
+			text += fmt.Sprintf(", unacknowledged for %s", time.Since(in.OpenedAt).Round(time.Minute))
+		}
+	}
+	if in.Service != "" {
+		text += " (" + in.Service + ")"
+	}
+	if link != "" {
+		text += " " + link
+	}
+	return text
+}
+
+// pagerDutySeverity maps an incident severity onto PagerDuty's critical,
+// error, warning and info.
+func pagerDutySeverity(severity string) string {
+	switch severity {
+	case "critical", "error", "warning", "info":
+		return severity
+	}
+	return "warning"
+}
+
+// save writes the routing override and pages. Callers hold mu.
+func (p *Pager) save() error {
+	data, err := json.Marshal(state{Routing: p.override, Pages: p.pages})
+	if err != nil {
+		return err
+	}
+	tmp := p.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save oncall state: %w", err)
+	}
+	if err := os.Rename(tmp, p.cfg.Path); err != nil {
+		return fmt.Errorf("save oncall state: %w", err)
+	}
+	return nil
+}
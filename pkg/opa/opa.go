@@ -0,0 +1,179 @@
+// Package opa delegates authorization decisions to an Open Policy Agent
+// server, usually a sidecar. Each request is described as the policy input
+// and POSTed to OPA's Data API; the request proceeds only if the policy
+// allows it.
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	decisionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_opa_decision_duration_seconds",
+			Help:    "Time taken to get an authorization decision from OPA, by decision",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"decision"},
+	)
+
+	decisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_opa_decisions_total",
+			Help: "Authorization decisions by OPA, by decision (allow, deny, error)",
+		},
+		[]string{"decision"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(decisionDuration, decisionsTotal)
+}
+
+// Config configures a Client.
+type Config struct {
+	// URL is the OPA server, e.g. http://localhost:8181.
+	URL string
+	// Policy is the rule queried, as a slash-separated data path such as
+	// pipeline/authz/allow. It may evaluate to a boolean or to an object
+	// with an allow boolean and an optional reason string.
+	Policy string
+	// Timeout bounds each decision; 500ms by default.
+	Timeout time.Duration
+	// FailOpen lets requests through when OPA cannot be reached or returns
+	// no decision. By default they are denied with 503.
+	FailOpen bool
+	// Input describes a request as the policy input.
+	Input func(*http.Request) map[string]interface{}
+	// OnDeny is called for every denied request; err is set when OPA failed.
+	OnDeny func(r *http.Request, status int, reason string, err error)
+}
+
+// Client asks OPA for decisions.
+type Client struct {
+	cfg      Config
+	endpoint string
+	client   *http.Client
+}
+
+// New validates cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" || cfg.Policy == "" {
+		return nil, errors.New("opa url and policy are required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 500 * time.Millisecond
+	}
+	return &Client{
+		cfg:      cfg,
+		endpoint: strings.TrimRight(cfg.URL, "/") + "/v1/data/" + strings.Trim(strings.ReplaceAll(cfg.Policy, ".", "/"), "/"),
+		client:   &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// Decision is the outcome of a policy evaluation.
+type Decision struct {
+	Allow  bool
+	Reason string
+}
+
+// Decide evaluates the policy for input.
+func (c *Client) Decide(ctx context.Context, input map[string]interface{}) (Decision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("opa returned %s", resp.Status)
+	}
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Decision{}, fmt.Errorf("decode opa response: %w", err)
+	}
+	if len(out.Result) == 0 {
+		// An undefined rule: the policy is missing or did not match.
+		return Decision{}, errors.New("policy result is undefined")
+	}
+	var allow bool
+	if err := json.Unmarshal(out.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(out.Result, &result); err != nil {
+		return Decision{}, fmt.Errorf("policy result is neither a boolean nor an object: %s", out.Result)
+	}
+	return Decision{Allow: result.Allow, Reason: result.Reason}, nil
+}
+
+// Wrap enforces the policy on next. Denied requests get 403 with the
+// policy's reason; when OPA fails they get 503 unless FailOpen is set.
+func (c *Client) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		d, err := c.Decide(r.Context(), c.cfg.Input(r))
+
+		label := "deny"
+		switch {
+		case err != nil:
+			label = "error"
+		case d.Allow:
+			label = "allow"
+		}
+		decisionDuration.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		decisionsTotal.WithLabelValues(label).Inc()
+
+		if err != nil {
+			if c.cfg.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c.deny(w, r, http.StatusServiceUnavailable, "policy evaluation failed", err)
+			return
+		}
+		if !d.Allow {
+			reason := d.Reason
+			if reason == "" {
+				reason = "denied by policy"
+			}
+			c.deny(w, r, http.StatusForbidden, reason, nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Client) deny(w http.ResponseWriter, r *http.Request, status int, reason string, err error) {
+	if c.cfg.OnDeny != nil {
+		c.cfg.OnDeny(r, status, reason, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
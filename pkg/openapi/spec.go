@@ -0,0 +1,394 @@
+// Package openapi validates HTTP requests and responses against an OpenAPI
+// 3.0 document. It reads the parts of the document that describe what a
+// request may contain: paths, parameters, request bodies, responses and the
+// schemas they reference. Schemas support the common keywords (type,
+// format, enum, required, properties, additionalProperties, items, the
+// length, size and range limits, pattern, nullable, allOf, anyOf and oneOf).
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is an OpenAPI schema object.
+type Schema struct {
+	Ref                  string             `yaml:"$ref"`
+	Type                 string             `yaml:"type"`
+	Format               string             `yaml:"format"`
+	Nullable             bool               `yaml:"nullable"`
+	Enum                 []interface{}      `yaml:"enum"`
+	Required             []string           `yaml:"required"`
+	Properties           map[string]*Schema `yaml:"properties"`
+	AdditionalProperties *Additional        `yaml:"additionalProperties"`
+	Items                *Schema            `yaml:"items"`
+	MinLength            *int               `yaml:"minLength"`
+	MaxLength            *int               `yaml:"maxLength"`
+	Pattern              string             `yaml:"pattern"`
+	Minimum              *float64           `yaml:"minimum"`
+	Maximum              *float64           `yaml:"maximum"`
+	ExclusiveMinimum     bool               `yaml:"exclusiveMinimum"`
+	ExclusiveMaximum     bool               `yaml:"exclusiveMaximum"`
+	MinItems             *int               `yaml:"minItems"`
+	MaxItems             *int               `yaml:"maxItems"`
+	AllOf                []*Schema          `yaml:"allOf"`
+	AnyOf                []*Schema          `yaml:"anyOf"`
+	OneOf                []*Schema          `yaml:"oneOf"`
+
+	pattern *regexp.Regexp
+}
+
+// Additional is additionalProperties: either a boolean or a schema for the
+// properties not listed.
+type Additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *Additional) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&a.Allowed)
+	}
+	a.Allowed = true
+	a.Schema = new(Schema)
+	return node.Decode(a.Schema)
+}
+
+// Parameter is a path, query, header or cookie parameter.
+type Parameter struct {
+	Ref      string  `yaml:"$ref"`
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *Schema `yaml:"schema"`
+}
+
+// MediaType is the schema of one content type.
+type MediaType struct {
+	Schema *Schema `yaml:"schema"`
+}
+
+// RequestBody describes the body an operation accepts.
+type RequestBody struct {
+	Ref      string               `yaml:"$ref"`
+	Required bool                 `yaml:"required"`
+	Content  map[string]MediaType `yaml:"content"`
+}
+
+// Response describes one response of an operation.
+type Response struct {
+	Ref     string               `yaml:"$ref"`
+	Content map[string]MediaType `yaml:"content"`
+}
+
+// Operation is one method of a path.
+type Operation struct {
+	OperationID string               `yaml:"operationId"`
+	Parameters  []*Parameter         `yaml:"parameters"`
+	RequestBody *RequestBody         `yaml:"requestBody"`
+	Responses   map[string]*Response `yaml:"responses"`
+
+	// Path is the templated path the operation belongs to.
+	Path string `yaml:"-"`
+}
+
+type pathItem struct {
+	Parameters []*Parameter `yaml:"parameters"`
+	Get        *Operation   `yaml:"get"`
+	Put        *Operation   `yaml:"put"`
+	Post       *Operation   `yaml:"post"`
+	Delete     *Operation   `yaml:"delete"`
+	Patch      *Operation   `yaml:"patch"`
+	Head       *Operation   `yaml:"head"`
+	Options    *Operation   `yaml:"options"`
+}
+
+type document struct {
+	OpenAPI    string               `yaml:"openapi"`
+	Paths      map[string]*pathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*Schema      `yaml:"schemas"`
+		Parameters    map[string]*Parameter   `yaml:"parameters"`
+		RequestBodies map[string]*RequestBody `yaml:"requestBodies"`
+		Responses     map[string]*Response    `yaml:"responses"`
+	} `yaml:"components"`
+}
+
+type route struct {
+	segments   []string
+	literals   int
+	operations map[string]*Operation
+}
+
+// Spec is a loaded OpenAPI document.
+type Spec struct {
+	schemas map[string]*Schema
+	routes  []route
+}
+
+// Load reads an OpenAPI document in YAML or JSON.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Parse parses an OpenAPI document in YAML or JSON. Component references
+// of parameters, request bodies and responses are resolved and schema
+// patterns compiled, so errors in either surface here.
+func Parse(data []byte) (*Spec, error) {
+	var doc document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", doc.OpenAPI)
+	}
+
+	spec := &Spec{schemas: doc.Components.Schemas}
+	for _, s := range doc.Components.Schemas {
+		if err := spec.compile(s, make(map[*Schema]bool)); err != nil {
+			return nil, err
+		}
+	}
+
+	for template, item := range doc.Paths {
+		if item == nil {
+			continue
+		}
+		r := route{operations: make(map[string]*Operation)}
+		for _, segment := range splitPath(template) {
+			if !strings.HasPrefix(segment, "{") {
+				r.literals++
+			}
+			r.segments = append(r.segments, segment)
+		}
+		shared, err := resolveParameters(&doc, item.Parameters)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", template, err)
+		}
+		for method, op := range map[string]*Operation{
+			http.MethodGet: item.Get, http.MethodPut: item.Put, http.MethodPost: item.Post,
+			http.MethodDelete: item.Delete, http.MethodPatch: item.Patch,
+			http.MethodHead: item.Head, http.MethodOptions: item.Options,
+		} {
+			if op == nil {
+				continue
+			}
+			if err := spec.prepare(&doc, op, shared); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, template, err)
+			}
+			op.Path = template
+			r.operations[method] = op
+		}
+		spec.routes = append(spec.routes, r)
+	}
+	return spec, nil
+}
+
+// prepare resolves the references of op, merges in the path's shared
+// parameters and compiles its schemas.
+func (s *Spec) prepare(doc *document, op *Operation, shared []*Parameter) error {
+	own, err := resolveParameters(doc, op.Parameters)
+	if err != nil {
+		return err
+	}
+	params := own
+	for _, p := range shared {
+		overridden := false
+		for _, o := range own {
+			if o.Name == p.Name && o.In == p.In {
+				overridden = true
+			}
+		}
+		if !overridden {
+			params = append(params, p)
+		}
+	}
+	op.Parameters = params
+
+	if body := op.RequestBody; body != nil && body.Ref != "" {
+		name, err := refName(body.Ref, "requestBodies")
+		if err != nil {
+			return err
+		}
+		if op.RequestBody = doc.Components.RequestBodies[name]; op.RequestBody == nil {
+			return fmt.Errorf("unresolved reference %s", body.Ref)
+		}
+	}
+	for code, resp := range op.Responses {
+		if resp != nil && resp.Ref != "" {
+			name, err := refName(resp.Ref, "responses")
+			if err != nil {
+				return err
+			}
+			if op.Responses[code] = doc.Components.Responses[name]; op.Responses[code] == nil {
+				return fmt.Errorf("unresolved reference %s", resp.Ref)
+			}
+		}
+	}
+
+	var schemas []*Schema
+	for _, p := range op.Parameters {
+		schemas = append(schemas, p.Schema)
+	}
+	if op.RequestBody != nil {
+		for _, media := range op.RequestBody.Content {
+			schemas = append(schemas, media.Schema)
+		}
+	}
+	for _, resp := range op.Responses {
+		if resp != nil {
+			for _, media := range resp.Content {
+				schemas = append(schemas, media.Schema)
+			}
+		}
+	}
+	for _, schema := range schemas {
+		if err := s.compile(schema, make(map[*Schema]bool)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveParameters(doc *document, params []*Parameter) ([]*Parameter, error) {
+	resolved := make([]*Parameter, 0, len(params))
+	for _, p := range params {
+		if ref := p.Ref; ref != "" {
+			name, err := refName(ref, "parameters")
+			if err != nil {
+				return nil, err
+			}
+			if p = doc.Components.Parameters[name]; p == nil {
+				return nil, fmt.Errorf("unresolved reference %s", ref)
+			}
+		}
+		if p.Name == "" || p.In == "" {
+			return nil, fmt.Errorf("parameter without name or in")
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved, nil
+}
+
+// compile checks the schema's references and compiles its patterns.
+func (s *Spec) compile(schema *Schema, seen map[*Schema]bool) error {
+	if schema == nil || seen[schema] {
+		return nil
+	}
+	seen[schema] = true
+	if schema.Ref != "" {
+		target, err := s.resolve(schema)
+		if err != nil {
+			return err
+		}
+		return s.compile(target, seen)
+	}
+	if schema.Pattern != "" && schema.pattern == nil {
+		re, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", schema.Pattern, err)
+		}
+		schema.pattern = re
+	}
+	children := append([]*Schema{schema.Items}, schema.AllOf...)
+	children = append(children, schema.AnyOf...)
+	children = append(children, schema.OneOf...)
+	for _, p := range schema.Properties {
+		children = append(children, p)
+	}
+	if schema.AdditionalProperties != nil {
+		children = append(children, schema.AdditionalProperties.Schema)
+	}
+	for _, child := range children {
+		if err := s.compile(child, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve follows a schema's $ref to the component schema.
+func (s *Spec) resolve(schema *Schema) (*Schema, error) {
+	for depth := 0; schema.Ref != ""; depth++ {
+		if depth > 32 {
+			return nil, fmt.Errorf("reference cycle at %s", schema.Ref)
+		}
+		name, err := refName(schema.Ref, "schemas")
+		if err != nil {
+			return nil, err
+		}
+		target, ok := s.schemas[name]
+		if !ok || target == nil {
+			return nil, fmt.Errorf("unresolved reference %s", schema.Ref)
+		}
+		schema = target
+	}
+	return schema, nil
+}
+
+// refName returns the component name of a local reference like
+// "#/components/schemas/Order".
+func refName(ref, kind string) (string, error) {
+	name, ok := strings.CutPrefix(ref, "#/components/"+kind+"/")
+	if !ok || name == "" {
+		return "", fmt.Errorf("unsupported reference %s", ref)
+	}
+	return name, nil
+}
+
+// Find returns the operation for method and path with its path parameters,
+// or nil if the document does not describe it. Literal segments win over
+// templated ones, so /orders/stats matches before /orders/{id}.
+func (s *Spec) Find(method, path string) (*Operation, map[string]string) {
+	segments := splitPath(path)
+	var best *route
+	var bestParams map[string]string
+	for i := range s.routes {
+		r := &s.routes[i]
+		if len(r.segments) != len(segments) || r.operations[method] == nil {
+			continue
+		}
+		params, ok := r.match(segments)
+		if ok && (best == nil || r.literals > best.literals) {
+			best, bestParams = r, params
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.operations[method], bestParams
+}
+
+func (r *route) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, segment := range r.segments {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[strings.TrimSuffix(name, "}")] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
@@ -0,0 +1,192 @@
+package openapi
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDocument = `
+openapi: 3.0.3
+paths:
+  /orders:
+    get:
+      operationId: listOrders
+      parameters:
+        - $ref: '#/components/parameters/Limit'
+        - name: status
+          in: query
+          schema: {type: array, items: {type: string, enum: [pending, shipped]}}
+      responses:
+        '200':
+          content:
+            application/json:
+              schema: {type: array, items: {$ref: '#/components/schemas/Order'}}
+        default:
+          $ref: '#/components/responses/Error'
+    post:
+      operationId: createOrder
+      requestBody:
+        $ref: '#/components/requestBodies/NewOrder'
+      responses:
+        '201':
+          content:
+            application/json:
+              schema: {$ref: '#/components/schemas/Order'}
+        4XX:
+          $ref: '#/components/responses/Error'
+  /orders/stats:
+    get:
+      operationId: orderStats
+      responses:
+        '200': {}
+  /orders/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema: {type: string, pattern: '^o-[0-9]+$'}
+    get:
+      operationId: getOrder
+      parameters:
+        - name: X-Request-ID
+          in: header
+          schema: {type: string, format: uuid}
+        - name: expand
+          in: query
+          schema: {type: boolean}
+      responses:
+        '200':
+          content:
+            application/json:
+              schema: {$ref: '#/components/schemas/Order'}
+components:
+  parameters:
+    Limit:
+      name: limit
+      in: query
+      schema: {type: integer, minimum: 1, maximum: 100}
+  requestBodies:
+    NewOrder:
+      required: true
+      content:
+        application/json:
+          schema:
+            allOf:
+              - $ref: '#/components/schemas/OrderFields'
+              - required: [customer_id, items]
+  responses:
+    Error:
+      content:
+        application/json:
+          schema:
+            type: object
+            required: [error]
+            properties: {error: {type: string}}
+  schemas:
+    Order:
+      allOf:
+        - $ref: '#/components/schemas/OrderFields'
+        - type: object
+          required: [id, status, created_at]
+          properties:
+            id: {type: string}
+            status: {type: string, enum: [pending, shipped]}
+            created_at: {type: string, format: date-time}
+    OrderFields:
+      type: object
+      properties:
+        customer_id: {type: string, minLength: 1, maxLength: 8}
+        email: {type: string, format: email, nullable: true}
+        total: {type: number, minimum: 0, exclusiveMinimum: true}
+        priority: {type: integer, enum: [1, 2, 3]}
+        items:
+          type: array
+          minItems: 1
+          maxItems: 2
+          items: {$ref: '#/components/schemas/Item'}
+        tags:
+          type: object
+          additionalProperties: {type: string, maxLength: 3}
+        payment:
+          oneOf:
+            - {type: object, required: [card], properties: {card: {type: string}}, additionalProperties: false}
+            - {type: object, required: [iban], properties: {iban: {type: string}}, additionalProperties: false}
+    Item:
+      type: object
+      required: [sku, quantity]
+      additionalProperties: false
+      properties:
+        sku: {type: string}
+        quantity: {type: integer, minimum: 1}
+`
+
+func testSpec(t *testing.T) *Spec {
+	t.Helper()
+	spec, err := Parse([]byte(testDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestFind(t *testing.T) {
+	spec := testSpec(t)
+	cases := []struct {
+		method, path string
+		want         string
+		params       map[string]string
+	}{
+		{"GET", "/orders", "listOrders", nil},
+		{"POST", "/orders/", "createOrder", nil},
+		{"GET", "/orders/o-7", "getOrder", map[string]string{"id": "o-7"}},
+		// Literal segments win over templated ones.
+		{"GET", "/orders/stats", "orderStats", nil},
+		{"DELETE", "/orders/o-7", "", nil},
+		{"GET", "/orders/o-7/lines", "", nil},
+	}
+	for _, tc := range cases {
+		op, params := spec.Find(tc.method, tc.path)
+		got := ""
+		if op != nil {
+			got = op.OperationID
+		}
+		if got != tc.want {
+			t.Errorf("Find(%s %s) = %q, want %q", tc.method, tc.path, got, tc.want)
+			continue
+		}
+		for name, v := range tc.params {
+			if params[name] != v {
+				t.Errorf("Find(%s %s) params %v", tc.method, tc.path, params)
+			}
+		}
+	}
+
+	op, _ := spec.Find("GET", "/orders/o-7")
+	if len(op.Parameters) != 3 || op.Path != "/orders/{id}" {
+		t.Errorf("getOrder has %d parameters at %s, want its own and the path's", len(op.Parameters), op.Path)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"swagger 2":            "swagger: '2.0'\npaths: {}",
+		"missing schema":       "openapi: 3.0.0\ncomponents:\n  schemas:\n    A: {$ref: '#/components/schemas/B'}",
+		"remote reference":     "openapi: 3.0.0\ncomponents:\n  schemas:\n    A: {$ref: 'other.yaml#/A'}",
+		"bad pattern":          "openapi: 3.0.0\ncomponents:\n  schemas:\n    A: {type: string, pattern: '('}",
+		"missing parameter":    "openapi: 3.0.0\npaths:\n  /a:\n    get:\n      parameters: [{$ref: '#/components/parameters/P'}]",
+		"unnamed parameter":    "openapi: 3.0.0\npaths:\n  /a:\n    get:\n      parameters: [{in: query}]",
+		"missing request body": "openapi: 3.0.0\npaths:\n  /a:\n    post:\n      requestBody: {$ref: '#/components/requestBodies/B'}",
+		"reference cycle":      "openapi: 3.0.0\ncomponents:\n  schemas:\n    A: {$ref: '#/components/schemas/B'}\n    B: {$ref: '#/components/schemas/A'}",
+		"not YAML":             "openapi: [3",
+	}
+	for name, doc := range cases {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	_, err := Parse([]byte("openapi: 3.0.0\npaths:\n  /a:\n    get:\n      responses:\n        '200': {$ref: '#/components/responses/R'}"))
+	if err == nil || !strings.Contains(err.Error(), "GET /a") {
+		t.Errorf("missing response: %v, want the operation named", err)
+	}
+}
@@ -0,0 +1,461 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError describes one way a request or response differs from the
+// document. In is "path", "query", "header", "cookie" or "body"; Name is
+// the parameter or a dotted location in the body, e.g. "items[2].price".
+type ValidationError struct {
+	In      string `json:"in"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Name == "" {
+		return e.In + ": " + e.Message
+	}
+	return e.In + " " + e.Name + ": " + e.Message
+}
+
+// ValidateRequest checks r's parameters and body against the operation for
+// its method and path (the path the upstream serves, not the gateway's).
+// Bodies are read up to maxBody bytes and restored for the next handler.
+// The operation is nil when the document does not describe the request.
+func (s *Spec) ValidateRequest(r *http.Request, path string, maxBody int64) (*Operation, []ValidationError) {
+	op, pathParams := s.Find(r.Method, path)
+	if op == nil {
+		return nil, nil
+	}
+
+	var errs []ValidationError
+	query := r.URL.Query()
+	for _, p := range op.Parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			if v, ok := pathParams[p.Name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		case "cookie":
+			if c, err := r.Cookie(p.Name); err == nil {
+				values = []string{c.Value}
+			}
+		}
+		errs = append(errs, s.validateParameter(p, values)...)
+	}
+
+	if op.RequestBody != nil {
+		errs = append(errs, s.validateRequestBody(r, op.RequestBody, maxBody)...)
+	}
+	return op, errs
+}
+
+func (s *Spec) validateParameter(p *Parameter, values []string) []ValidationError {
+	if len(values) == 0 {
+		if p.Required || p.In == "path" {
+			return []ValidationError{{In: p.In, Name: p.Name, Message: "is required"}}
+		}
+		return nil
+	}
+	if p.Schema == nil {
+		return nil
+	}
+	schema, err := s.resolve(p.Schema)
+	if err != nil {
+		return []ValidationError{{In: p.In, Name: p.Name, Message: err.Error()}}
+	}
+
+	var value interface{}
+	if schema.Type == "array" {
+		if len(values) == 1 && p.In != "query" {
+			values = strings.Split(values[0], ",")
+		}
+		items := make([]interface{}, len(values))
+		for i, v := range values {
+			items[i] = coerce(schema.Items, s, v)
+		}
+		value = items
+	} else {
+		value = coerce(schema, s, values[0])
+	}
+
+	var errs []ValidationError
+	s.validate(schema, value, p.Name, func(name, message string) {
+		errs = append(errs, ValidationError{In: p.In, Name: name, Message: message})
+	})
+	return errs
+}
+
+// coerce converts a parameter string to the JSON type its schema expects,
+// leaving it a string when it does not parse so the type check reports it.
+func coerce(schema *Schema, s *Spec, v string) interface{} {
+	if schema == nil {
+		return v
+	}
+	if resolved, err := s.resolve(schema); err == nil {
+		schema = resolved
+	}
+	switch schema.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
+
+func (s *Spec) validateRequestBody(r *http.Request, body *RequestBody, maxBody int64) []ValidationError {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil {
+		return []ValidationError{{In: "body", Message: "unreadable: " + err.Error()}}
+	}
+	if len(data) == 0 {
+		if body.Required {
+			return []ValidationError{{In: "body", Message: "is required"}}
+		}
+		return nil
+	}
+	if int64(len(data)) > maxBody {
+		return []ValidationError{{In: "body", Message: fmt.Sprintf("larger than the %d byte validation limit", maxBody)}}
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	media, ok := mediaFor(body.Content, contentType)
+	if !ok {
+		return []ValidationError{{In: "header", Name: "Content-Type", Message: "must be one of " + strings.Join(contentTypes(body.Content), ", ")}}
+	}
+	return s.validateJSON(media, contentType, data)
+}
+
+// ValidateResponse checks a response body against the operation's response
+// for status, falling back to its range ("2XX") and then "default". The
+// operation is nil when the document does not describe the request.
+func (s *Spec) ValidateResponse(method, path string, status int, header http.Header, body []byte) (*Operation, []ValidationError) {
+	op, _ := s.Find(method, path)
+	if op == nil {
+		return nil, nil
+	}
+	return op, s.validateResponse(op, status, header, body)
+}
+
+func (s *Spec) validateResponse(op *Operation, status int, header http.Header, body []byte) []ValidationError {
+	resp := op.Responses[strconv.Itoa(status)]
+	if resp == nil {
+		resp = op.Responses[strconv.Itoa(status/100)+"XX"]
+	}
+	if resp == nil {
+		resp = op.Responses["default"]
+	}
+	if resp == nil {
+		return []ValidationError{{In: "status", Message: fmt.Sprintf("%d is not documented", status)}}
+	}
+	if len(resp.Content) == 0 || len(body) == 0 {
+		return nil
+	}
+	media, ok := mediaFor(resp.Content, header.Get("Content-Type"))
+	if !ok {
+		return []ValidationError{{In: "header", Name: "Content-Type", Message: "must be one of " + strings.Join(contentTypes(resp.Content), ", ")}}
+	}
+	return s.validateJSON(media, header.Get("Content-Type"), body)
+}
+
+// validateJSON validates JSON bodies; other media types are only checked
+// for being listed.
+func (s *Spec) validateJSON(media MediaType, contentType string, data []byte) []ValidationError {
+	if media.Schema == nil || !IsJSON(contentType) {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []ValidationError{{In: "body", Message: "invalid JSON: " + err.Error()}}
+	}
+	var errs []ValidationError
+	s.validate(media.Schema, value, "", func(name, message string) {
+		errs = append(errs, ValidationError{In: "body", Name: name, Message: message})
+	})
+	return errs
+}
+
+// IsJSON reports whether contentType is application/json or a +json type.
+func IsJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// mediaFor picks the content entry for contentType: an exact match, then
+// "type/*", then "*/*".
+func mediaFor(content map[string]MediaType, contentType string) (MediaType, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if media, ok := content[mediaType]; ok {
+		return media, true
+	}
+	if major, _, ok := strings.Cut(mediaType, "/"); ok {
+		if media, ok := content[major+"/*"]; ok {
+			return media, true
+		}
+	}
+	media, ok := content["*/*"]
+	return media, ok
+}
+
+func contentTypes(content map[string]MediaType) []string {
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// validate checks value, decoded with json.Number for numbers, against
+// schema and reports each problem at its dotted location.
+func (s *Spec) validate(schema *Schema, value interface{}, at string, report func(name, message string)) {
+	if schema == nil {
+		return
+	}
+	schema, err := s.resolve(schema)
+	if err != nil {
+		report(at, err.Error())
+		return
+	}
+
+	for _, sub := range schema.AllOf {
+		s.validate(sub, value, at, report)
+	}
+	if len(schema.AnyOf) > 0 && s.matching(schema.AnyOf, value) == 0 {
+		report(at, "does not match any of the allowed schemas")
+	}
+	if len(schema.OneOf) > 0 {
+		if n := s.matching(schema.OneOf, value); n != 1 {
+			report(at, fmt.Sprintf("matches %d of the schemas instead of exactly one", n))
+		}
+	}
+
+	if value == nil {
+		if schema.Type != "" && !schema.Nullable {
+			report(at, "must not be null")
+		}
+		return
+	}
+	if schema.Type != "" && !hasType(value, schema.Type) {
+		report(at, "must be "+article(schema.Type))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		report(at, "must be one of "+formatEnum(schema.Enum))
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(schema, v, at, report)
+	case json.Number:
+		f, _ := v.Float64()
+		validateNumber(schema, f, at, report)
+	case []interface{}:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			report(at, fmt.Sprintf("must have at least %d items", *schema.MinItems))
+		}
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			report(at, fmt.Sprintf("must have at most %d items", *schema.MaxItems))
+		}
+		for i, item := range v {
+			s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i), report)
+		}
+	case map[string]interface{}:
+		s.validateObject(schema, v, at, report)
+	}
+}
+
+func (s *Spec) matching(schemas []*Schema, value interface{}) int {
+	n := 0
+	for _, sub := range schemas {
+		valid := true
+		s.validate(sub, value, "", func(string, string) { valid = false })
+		if valid {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Spec) validateString(schema *Schema, v, at string, report func(name, message string)) {
+	length := utf8.RuneCountInString(v)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		report(at, fmt.Sprintf("must be at least %d characters", *schema.MinLength))
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		report(at, fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+	}
+	if schema.pattern != nil && !schema.pattern.MatchString(v) {
+		report(at, "must match "+schema.Pattern)
+	}
+	var err error
+	switch schema.Format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, v)
+	case "date":
+		_, err = time.Parse("2006-01-02", v)
+	case "email":
+		_, err = mail.ParseAddress(v)
+	case "uuid":
+		if len(v) != 36 || strings.Count(v, "-") != 4 {
+			err = fmt.Errorf("not a UUID")
+		}
+	}
+	if err != nil {
+		report(at, "must be a valid "+schema.Format)
+	}
+}
+
+func validateNumber(schema *Schema, v float64, at string, report func(name, message string)) {
+	if min := schema.Minimum; min != nil {
+		if v < *min || (schema.ExclusiveMinimum && v == *min) {
+			op := ">="
+			if schema.ExclusiveMinimum {
+				op = ">"
+			}
+			report(at, fmt.Sprintf("must be %s %v", op, *min))
+		}
+	}
+	if max := schema.Maximum; max != nil {
+		if v > *max || (schema.ExclusiveMaximum && v == *max) {
+			op := "<="
+			if schema.ExclusiveMaximum {
+				op = "<"
+			}
+			report(at, fmt.Sprintf("must be %s %v", op, *max))
+		}
+	}
+}
+
+func (s *Spec) validateObject(schema *Schema, v map[string]interface{}, at string, report func(name, message string)) {
+	for _, name := range schema.Required {
+		if _, ok := v[name]; !ok {
+			report(join(at, name), "is required")
+		}
+	}
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if prop, ok := schema.Properties[name]; ok {
+			s.validate(prop, v[name], join(at, name), report)
+			continue
+		}
+		if extra := schema.AdditionalProperties; extra != nil {
+			if !extra.Allowed {
+				report(join(at, name), "is not allowed")
+			} else {
+				s.validate(extra.Schema, v[name], join(at, name), report)
+			}
+		}
+	}
+}
+
+func hasType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return typ == "integer" && err == nil && f == math.Trunc(f)
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
+
+// inEnum compares value with the enum's YAML values; numbers compare by
+// value.
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if n, ok := value.(json.Number); ok {
+			f, _ := n.Float64()
+			if ef, ok := toFloat(e); ok && ef == f {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(e, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func formatEnum(enum []interface{}) string {
+	parts := make([]string, len(enum))
+	for i, e := range enum {
+		parts[i] = fmt.Sprint(e)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func article(typ string) string {
+	switch typ {
+	case "array", "integer", "object":
+		return "an " + typ
+	}
+	return "a " + typ
+}
+
+func join(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
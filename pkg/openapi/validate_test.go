@@ -0,0 +1,162 @@
+package openapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// errorStrings formats errs sorted, for comparison.
+func errorStrings(errs []ValidationError) []string {
+	out := make([]string, len(errs))
+	for i, e := range errs {
+		out[i] = e.Error()
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestValidateRequestParameters(t *testing.T) {
+	spec := testSpec(t)
+	cases := []struct {
+		target string
+		header map[string]string
+		want   []string
+	}{
+		{"/orders?limit=10&status=pending&status=shipped", nil, nil},
+		{"/orders?limit=0", nil, []string{"query limit: must be >= 1"}},
+		{"/orders?limit=ten", nil, []string{"query limit: must be an integer"}},
+		{"/orders?limit=2.5", nil, []string{"query limit: must be an integer"}},
+		{"/orders?status=pending&status=lost", nil, []string{"query status[1]: must be one of pending, shipped"}},
+		{"/orders/o-7?expand=true", map[string]string{"X-Request-ID": "123e4567-e89b-12d3-a456-426614174000"}, nil},
+		{"/orders/7?expand=maybe", map[string]string{"X-Request-ID": "nope"}, []string{
+			"header X-Request-ID: must be a valid uuid",
+			"path id: must match ^o-[0-9]+$",
+			"query expand: must be a boolean",
+		}},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		op, errs := spec.ValidateRequest(r, r.URL.Path, 1<<20)
+		if op == nil {
+			t.Errorf("%s: no operation", tc.target)
+			continue
+		}
+		if got := errorStrings(errs); strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s:\n got %q\nwant %q", tc.target, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/customers", nil)
+	if op, errs := spec.ValidateRequest(r, r.URL.Path, 1<<20); op != nil || errs != nil {
+		t.Errorf("undocumented path: %v, %v", op, errs)
+	}
+}
+
+func TestValidateRequestBody(t *testing.T) {
+	spec := testSpec(t)
+	cases := []struct {
+		name, contentType, body string
+		want                    []string
+	}{
+		{"valid", "application/json", `{"customer_id": "c-1", "total": 9.5, "priority": 2, "items": [{"sku": "a", "quantity": 1}], "tags": {"env": "dev"}, "payment": {"card": "4242"}, "email": null}`, nil},
+		{"missing", "application/json", ``, []string{"body: is required"}},
+		{"required fields", "application/json", `{}`, []string{"body customer_id: is required", "body items: is required"}},
+		{"nested", "application/json", `{"customer_id": "", "items": [{"sku": "a", "quantity": 0, "color": "red"}, {"sku": 1, "quantity": 1.0}]}`, []string{
+			"body customer_id: must be at least 1 characters",
+			"body items[0].color: is not allowed",
+			"body items[0].quantity: must be >= 1",
+			"body items[1].sku: must be a string",
+		}},
+		{"limits", "application/json", `{"customer_id": "customer-42", "total": 0, "priority": 4, "items": [], "tags": {"env": "production"}}`, []string{
+			"body customer_id: must be at most 8 characters",
+			"body items: must have at least 1 items",
+			"body priority: must be one of 1, 2, 3",
+			"body tags.env: must be at most 3 characters",
+			"body total: must be > 0",
+		}},
+		{"one of", "application/json", `{"customer_id": "c", "items": [{"sku": "a", "quantity": 1}], "payment": {"card": "1", "iban": "2"}}`, []string{
+			"body payment: matches 0 of the schemas instead of exactly one",
+		}},
+		{"null", "application/json", `{"customer_id": null, "items": [{"sku": "a", "quantity": 1}], "email": "not an address"}`, []string{
+			"body customer_id: must not be null",
+			"body email: must be a valid email",
+		}},
+		{"not JSON", "application/json", `{"customer_id":`, []string{"body: invalid JSON: unexpected EOF"}},
+		{"media type", "text/csv", `a,b`, []string{"header Content-Type: must be one of application/json"}},
+		{"too large", "application/json", `{"customer_id": "` + strings.Repeat("x", 300) + `"}`, []string{"body: larger than the 256 byte validation limit"}},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.contentType)
+		_, errs := spec.ValidateRequest(r, "/orders", 256)
+		if got := errorStrings(errs); strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+		// The body is still there for the upstream.
+		if rest, _ := io.ReadAll(r.Body); string(rest) != tc.body {
+			t.Errorf("%s: body left for the upstream = %q", tc.name, rest)
+		}
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	spec := testSpec(t)
+	json := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	cases := []struct {
+		name   string
+		method string
+		status int
+		header http.Header
+		body   string
+		want   []string
+	}{
+		{"created", "POST", 201, json, `{"id": "o-1", "status": "pending", "created_at": "2024-01-02T03:04:05Z", "items": []}`, []string{
+			"body items: must have at least 1 items",
+		}},
+		{"bad field", "POST", 201, json, `{"id": "o-1", "status": "lost", "created_at": "yesterday"}`, []string{
+			"body created_at: must be a valid date-time",
+			"body status: must be one of pending, shipped",
+		}},
+		{"status range", "POST", 422, json, `{"message": "no error field"}`, []string{"body error: is required"}},
+		{"default", "GET", 503, json, `{"error": "down"}`, nil},
+		{"undocumented", "POST", 500, json, `{}`, []string{"status: 500 is not documented"}},
+		{"list", "GET", 200, json, `[{"id": "o-1", "status": "shipped", "created_at": "2024-01-02T03:04:05Z"}, {"id": 2}]`, []string{
+			"body [1].created_at: is required",
+			"body [1].id: must be a string",
+			"body [1].status: is required",
+		}},
+		{"media type", "GET", 200, http.Header{"Content-Type": {"text/html"}}, `<p>`, []string{"header Content-Type: must be one of application/json"}},
+		{"empty body", "GET", 200, json, ``, nil},
+	}
+	for _, tc := range cases {
+		op, errs := spec.ValidateResponse(tc.method, "/orders", tc.status, tc.header, []byte(tc.body))
+		if op == nil {
+			t.Fatalf("%s: no operation", tc.name)
+		}
+		if got := errorStrings(errs); strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s:\n got %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"application/problem+json":        true,
+		"application/x-protobuf":          false,
+		"text/plain":                      false,
+		"":                                false,
+	} {
+		if IsJSON(contentType) != want {
+			t.Errorf("IsJSON(%q) = %v", contentType, !want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package prober checks the health of a service's dependencies over HTTP,
+// TCP or the gRPC health protocol, once or on an interval with jitter, and
+// turns the raw results into a healthy or unhealthy state only after a
+// configured number of consecutive failures or successes.
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Check kinds.
+const (
+	HTTP = "http"
+	TCP  = "tcp"
+	GRPC = "grpc"
+)
+
+// Config describes one dependency to probe.
+type Config struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Kind is http, tcp or grpc; http when empty.
+	Kind string `mapstructure:"kind" json:"kind"`
+	// Target is the URL checked with GET for http, where any 2xx is
+	// healthy; host:port for tcp; and host:port, or a grpc:// or grpcs://
+	// URL, whose grpc.health.v1.Health/Check is called for grpc.
+	Target string `mapstructure:"target" json:"target"`
+	// Service is the service name sent in a gRPC health check, empty for
+	// the server as a whole.
+	Service string `mapstructure:"service" json:"service,omitempty"`
+
+	Interval time.Duration `mapstructure:"interval" json:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout" json:"timeout"`
+	// Jitter delays each check by a random duration up to it, so probers
+	// started together do not check in lockstep.
+	Jitter time.Duration `mapstructure:"jitter" json:"jitter,omitempty"`
+	// FailureThreshold consecutive failed checks make a healthy
+	// dependency unhealthy, SuccessThreshold consecutive successful ones
+	// make an unhealthy one healthy again. Both are at least 1.
+	FailureThreshold int `mapstructure:"failure_threshold" json:"failure_threshold"`
+	SuccessThreshold int `mapstructure:"success_threshold" json:"success_threshold"`
+}
+
+// withDefaults fills in a 30s interval, 5s timeout and thresholds of 1.
+func (c Config) withDefaults() Config {
+	if c.Kind == "" {
+		c.Kind = HTTP
+	}
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	c.FailureThreshold = max(c.FailureThreshold, 1)
+	c.SuccessThreshold = max(c.SuccessThreshold, 1)
+	return c
+}
+
+// Validate reports a config that cannot be probed.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+	switch {
+	case c.Name == "":
+		return fmt.Errorf("probe needs a name")
+	case c.Target == "":
+		return fmt.Errorf("probe %s needs a target", c.Name)
+	case c.Kind != HTTP && c.Kind != TCP && c.Kind != GRPC:
+		return fmt.Errorf("probe %s: kind must be http, tcp or grpc, got %q", c.Name, c.Kind)
+	}
+	return nil
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Healthy bool
+	At      time.Time
+	Latency time.Duration
+	Err     error
+}
+
+// Check probes the target of c once, within c.Timeout.
+func Check(ctx context.Context, c Config) Result {
+	c = c.withDefaults()
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	switch c.Kind {
+	case TCP:
+		err = checkTCP(ctx, c.Target)
+	case GRPC:
+		err = checkGRPC(ctx, c.Target, c.Service)
+	default:
+		err = checkHTTP(ctx, c.Target)
+	}
+	return Result{Healthy: err == nil, At: start, Latency: time.Since(start), Err: err}
+}
+
+var httpClient = &http.Client{}
+
+func checkHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func checkTCP(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkGRPC calls grpc.health.v1.Health/Check and requires SERVING. Each
+// check dials a connection of its own, so it also proves the target
+// accepts new connections.
+func checkGRPC(ctx context.Context, target, service string) error {
+	creds, addr := insecure.NewCredentials(), target
+	if rest, ok := strings.CutPrefix(target, "grpcs://"); ok {
+		creds, addr = credentials.NewTLS(&tls.Config{}), rest
+	} else if rest, ok := strings.CutPrefix(target, "grpc://"); ok {
+		addr = rest
+	}
+	conn, err := grpc.DialContext(ctx, strings.TrimRight(addr, "/"), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc health status %s, not SERVING", resp.Status)
+	}
+	return nil
+}
+
+// Status is the state of a probed dependency.
+type Status struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	// Known is false until the first check.
+	Known                bool      `json:"known"`
+	LastCheck            time.Time `json:"last_check,omitempty"`
+	LastError            string    `json:"last_error,omitempty"`
+	Latency              float64   `json:"latency_seconds"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+}
+
+// Prober checks one dependency on its interval.
+type Prober struct {
+	config  Config
+	observe func(Result, Status)
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New returns a prober for c. observe, if not nil, is called after every
+// check with its result and the state it led to.
+func New(c Config, observe func(Result, Status)) *Prober {
+	c = c.withDefaults()
+	return &Prober{
+		config:  c,
+		observe: observe,
+		status:  Status{Name: c.Name, Kind: c.Kind, Target: c.Target},
+	}
+}
+
+// Config returns the prober's config with the defaults filled in.
+func (p *Prober) Config() Config {
+	return p.config
+}
+
+// Status returns the current state.
+func (p *Prober) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Record applies the result of a check to the state: the first result sets
+// it, later ones flip it after the configured consecutive failures or
+// successes.
+func (p *Prober) Record(r Result) Status {
+	p.mu.Lock()
+	s := &p.status
+	if r.Healthy {
+		s.ConsecutiveSuccesses++
+		s.ConsecutiveFailures = 0
+		s.LastError = ""
+	} else {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+		if r.Err != nil {
+			s.LastError = r.Err.Error()
+		}
+	}
+	switch {
+	case !s.Known:
+		s.Healthy, s.Known = r.Healthy, true
+	case s.Healthy && s.ConsecutiveFailures >= p.config.FailureThreshold:
+		s.Healthy = false
+	case !s.Healthy && s.ConsecutiveSuccesses >= p.config.SuccessThreshold:
+		s.Healthy = true
+	}
+	s.LastCheck = r.At
+	s.Latency = r.Latency.Seconds()
+	status := *s
+	p.mu.Unlock()
+
+	if p.observe != nil {
+		p.observe(r, status)
+	}
+	return status
+}
+
+// Run checks the dependency right away and then every interval, each check
+// delayed by up to the jitter, until ctx is done.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		if p.config.Jitter > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rand.Int63n(int64(p.config.Jitter)))):
+			}
+		}
+		p.Record(Check(ctx, p.config))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start runs the prober in a goroutine and returns a function that stops it.
+func (p *Prober) Start() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go p.Run(ctx)
+	return cancel
+}
@@ -0,0 +1,50 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestCheckGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("ingest", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(ln)
+	defer srv.Stop()
+	addr := ln.Addr().String()
+
+	cases := []struct {
+		target, service string
+		want            string // error substring, empty for healthy
+	}{
+		{addr, "", ""},
+		{"grpc://" + addr + "/", "", ""},
+		{addr, "ingest", "NOT_SERVING"},
+		{addr, "unknown", "NotFound"},
+	}
+	for _, tc := range cases {
+		r := Check(context.Background(), Config{Name: "ingest", Kind: GRPC, Target: tc.target, Service: tc.service})
+		if tc.want == "" && !r.Healthy {
+			t.Errorf("%s %q: %v", tc.target, tc.service, r.Err)
+		}
+		if tc.want != "" && (r.Healthy || !strings.Contains(r.Err.Error(), tc.want)) {
+			t.Errorf("%s %q: healthy %v, %v; want %s", tc.target, tc.service, r.Healthy, r.Err, tc.want)
+		}
+	}
+
+	srv.Stop()
+	if r := Check(context.Background(), Config{Name: "ingest", Kind: GRPC, Target: addr}); r.Healthy {
+		t.Error("stopped server is healthy")
+	}
+}
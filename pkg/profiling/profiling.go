@@ -0,0 +1,313 @@
+// Package profiling continuously profiles a service and uploads the
+// profiles to Pyroscope or Parca, tagged with the service and its version,
+// so a regression can be traced back to when it started. CPU is profiled
+// for one interval at a time; the heap and goroutines are snapshot at the
+// end of each.
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var uploads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_profile_uploads_total",
+		Help: "Profiles uploaded to the profiling backend, by profile type and result (ok or error)",
+	},
+	[]string{"type", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(uploads)
+}
+
+// Backends.
+const (
+	Pyroscope = "pyroscope"
+	Parca     = "parca"
+)
+
+// Profile types.
+const (
+	CPU        = "cpu"
+	Heap       = "heap"
+	Goroutines = "goroutines"
+)
+
+// ErrCPUBusy is returned for a CPU profile that could not be taken because
+// another one was running in the process.
+var ErrCPUBusy = errors.New("CPU profiler already in use")
+
+// Config configures an Uploader.
+type Config struct {
+	// Backend is pyroscope or parca.
+	Backend string
+	// URL is the backend's HTTP address, such as http://pyroscope:4040.
+	URL     string
+	Service string
+	Version string
+	// Tags are added to service and version on every profile.
+	Tags map[string]string
+	// Profiles lists the types taken: cpu, heap and goroutines.
+	Profiles []string
+	// Interval is how long each CPU profile runs, and how often profiles
+	// are uploaded; 15s by default.
+	Interval time.Duration
+	// Timeout bounds each upload; 10s by default.
+	Timeout time.Duration
+}
+
+// Uploader takes and uploads the profiles.
+type Uploader struct {
+	cfg    Config
+	client *http.Client
+	tags   map[string]string
+}
+
+// New returns an Uploader for cfg.
+func New(cfg Config) (*Uploader, error) {
+	if cfg.Backend != Pyroscope && cfg.Backend != Parca {
+		return nil, fmt.Errorf("profiling backend must be %s or %s, not %q", Pyroscope, Parca, cfg.Backend)
+	}
+	if cfg.URL == "" {
+		return nil, errors.New("profiling URL is required")
+	}
+	for _, p := range cfg.Profiles {
+		if p != CPU && p != Heap && p != Goroutines {
+			return nil, fmt.Errorf("profile type must be cpu, heap or goroutines, not %q", p)
+		}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	tags := map[string]string{"service": cfg.Service, "version": cfg.Version}
+	for k, v := range cfg.Tags {
+		tags[k] = v
+	}
+	return &Uploader{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}, tags: tags}, nil
+}
+
+// Run profiles and uploads every interval until ctx is cancelled, then
+// waits for the upload in progress. Errors are passed to onError and do not
+// stop the loop.
+func (u *Uploader) Run(ctx context.Context, onError func(error)) {
+	var uploading sync.WaitGroup
+	defer uploading.Wait()
+	for {
+		from := time.Now()
+		var cpu []byte
+		var cpuErr error
+		if u.wants(CPU) {
+			cpu, cpuErr = profileCPU(ctx, u.cfg.Interval)
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-time.After(u.cfg.Interval):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		until := time.Now()
+
+		profiles := make(map[string][]byte)
+		if cpuErr != nil {
+			onError(cpuErr)
+		} else if cpu != nil {
+			profiles[CPU] = cpu
+		}
+		for _, p := range []string{Heap, Goroutines} {
+			if u.wants(p) {
+				var buf bytes.Buffer
+				pprof.Lookup(lookupName(p)).WriteTo(&buf, 0)
+				profiles[p] = buf.Bytes()
+			}
+		}
+
+		// Uploaded in the background, so the next CPU profile starts now
+		// and the profiles cover the whole run; one upload at a time.
+		uploading.Wait()
+		uploading.Add(1)
+		go func() {
+			defer uploading.Done()
+			for _, p := range sortedTypes(profiles) {
+				err := u.upload(ctx, p, profiles[p], from, until)
+				result := "ok"
+				if err != nil {
+					result = "error"
+					onError(fmt.Errorf("upload %s profile: %w", p, err))
+				}
+				uploads.WithLabelValues(p, result).Inc()
+			}
+		}()
+	}
+}
+
+func (u *Uploader) wants(profile string) bool {
+	for _, p := range u.cfg.Profiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// profileCPU records a CPU profile for d, or until ctx is cancelled.
+func profileCPU(ctx context.Context, d time.Duration) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		// Waited out, so a busy profiler is not retried in a tight loop.
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+		return nil, ErrCPUBusy
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+	pprof.StopCPUProfile()
+	return buf.Bytes(), nil
+}
+
+func lookupName(profile string) string {
+	if profile == Goroutines {
+		return "goroutine"
+	}
+	return profile
+}
+
+func sortedTypes(profiles map[string][]byte) []string {
+	types := make([]string, 0, len(profiles))
+	for p := range profiles {
+		types = append(types, p)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (u *Uploader) upload(ctx context.Context, profile string, data []byte, from, until time.Time) error {
+	var req *http.Request
+	var err error
+	if u.cfg.Backend == Pyroscope {
+		req, err = u.pyroscopeRequest(ctx, profile, data, from, until)
+	} else {
+		req, err = u.parcaRequest(ctx, profile, data)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", u.cfg.Backend, resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// pyroscopeRequest posts the pprof to Pyroscope's /ingest, with the tags in
+// the application name: <service>{service=...,version=...}. Pyroscope names
+// the series after the profile's sample types, such as cpu or
+// inuse_space.
+func (u *Uploader) pyroscopeRequest(ctx context.Context, profile string, data []byte, from, until time.Time) (*http.Request, error) {
+	keys := make([]string, 0, len(u.tags))
+	for k := range u.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+u.tags[k])
+	}
+
+	q := url.Values{}
+	q.Set("name", u.cfg.Service+"{"+strings.Join(pairs, ",")+"}")
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	if profile == CPU {
+		q.Set("sampleRate", "100")
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(u.cfg.URL, "/")+"/ingest?"+q.Encode(), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+// parcaNames are the __name__ Parca gives the Go profiles it scrapes.
+var parcaNames = map[string]string{CPU: "process_cpu", Heap: "memory", Goroutines: "goroutine"}
+
+// parcaRequest posts the pprof to Parca's WriteRaw over its HTTP gateway,
+// with the tags as series labels.
+func (u *Uploader) parcaRequest(ctx context.Context, profile string, data []byte) (*http.Request, error) {
+	type label struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	labels := []label{{Name: "__name__", Value: parcaNames[profile]}}
+	for k, v := range u.tags {
+		labels = append(labels, label{Name: k, Value: v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	type sample struct {
+		RawProfile []byte `json:"rawProfile"`
+	}
+	type series struct {
+		Labels struct {
+			Labels []label `json:"labels"`
+		} `json:"labels"`
+		Samples []sample `json:"samples"`
+	}
+	s := series{Samples: []sample{{RawProfile: data}}}
+	s.Labels.Labels = labels
+	payload, err := json.Marshal(map[string]interface{}{"series": []series{s}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(u.cfg.URL, "/")+"/profiles/writeraw", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -0,0 +1,192 @@
+// Package propagation carries request context across service hops: the W3C
+// trace context and baggage headers plus the pipeline's own tenant, API key
+// and priority headers. The gateway normalises them on the way in and the
+// services read them into log fields and metric labels.
+package propagation
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Header names. The custom headers take precedence over the baggage members
+// of the same meaning (BaggageTenant, BaggageAPIKeyID, BaggagePriority).
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+	HeaderBaggage     = "baggage"
+	HeaderTenant      = "X-Tenant-ID"
+	HeaderAPIKeyID    = "X-API-Key-ID"
+	HeaderPriority    = "X-Request-Priority"
+)
+
+const (
+	BaggageTenant   = "tenant"
+	BaggageAPIKeyID = "api_key_id"
+	BaggagePriority = "priority"
+)
+
+// Priorities. Anything else is treated as PriorityNormal.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Limits from the W3C baggage specification.
+const (
+	maxBaggageMembers = 180
+	maxBaggageBytes   = 8192
+)
+
+// Values is the propagated context of one request.
+type Values struct {
+	Tenant   string
+	APIKeyID string
+	Priority string
+	// Baggage holds every baggage member, including the ones mirrored into
+	// the fields above.
+	Baggage map[string]string
+}
+
+// FromRequest reads the propagated values of r.
+func FromRequest(r *http.Request) Values {
+	return FromHeader(r.Header)
+}
+
+// FromHeader reads the propagated values from h.
+func FromHeader(h http.Header) Values {
+	v := Values{Baggage: ParseBaggage(h.Values(HeaderBaggage))}
+	v.Tenant = firstNonEmpty(h.Get(HeaderTenant), v.Baggage[BaggageTenant])
+	v.APIKeyID = firstNonEmpty(h.Get(HeaderAPIKeyID), v.Baggage[BaggageAPIKeyID])
+	v.Priority = NormalizePriority(firstNonEmpty(h.Get(HeaderPriority), v.Baggage[BaggagePriority]))
+	return v
+}
+
+// Inject writes v to h, replacing the custom headers and the baggage header.
+// The custom values are mirrored into baggage so hops that only forward W3C
+// headers keep them.
+func (v Values) Inject(h http.Header) {
+	set := func(name, value string) {
+		if value == "" {
+			h.Del(name)
+			return
+		}
+		h.Set(name, value)
+	}
+	set(HeaderTenant, v.Tenant)
+	set(HeaderAPIKeyID, v.APIKeyID)
+	set(HeaderPriority, v.Priority)
+
+	baggage := make(map[string]string, len(v.Baggage)+3)
+	for k, val := range v.Baggage {
+		baggage[k] = val
+	}
+	for k, val := range map[string]string{BaggageTenant: v.Tenant, BaggageAPIKeyID: v.APIKeyID, BaggagePriority: v.Priority} {
+		if val == "" {
+			delete(baggage, k)
+		} else {
+			baggage[k] = val
+		}
+	}
+	set(HeaderBaggage, FormatBaggage(baggage))
+}
+
+// LogFields returns the non-empty values as log fields.
+func (v Values) LogFields() map[string]interface{} {
+	fields := make(map[string]interface{}, 3)
+	if v.Tenant != "" {
+		fields["tenant"] = v.Tenant
+	}
+	if v.APIKeyID != "" {
+		fields["api_key_id"] = v.APIKeyID
+	}
+	if v.Priority != "" {
+		fields["priority"] = v.Priority
+	}
+	return fields
+}
+
+// TenantLabel returns the tenant for metric labels, "none" when unset.
+func (v Values) TenantLabel() string {
+	if v.Tenant == "" {
+		return "none"
+	}
+	return v.Tenant
+}
+
+// PriorityLabel returns the priority for metric labels, defaulting to
+// PriorityNormal.
+func (v Values) PriorityLabel() string {
+	if v.Priority == "" {
+		return PriorityNormal
+	}
+	return v.Priority
+}
+
+// NormalizePriority lower-cases p and maps unknown values to PriorityNormal.
+// An empty p stays empty.
+func NormalizePriority(p string) string {
+	switch p = strings.ToLower(strings.TrimSpace(p)); p {
+	case "":
+		return ""
+	case PriorityHigh, PriorityLow:
+		return p
+	default:
+		return PriorityNormal
+	}
+}
+
+// ParseBaggage parses baggage header values into key/value pairs. Member
+// properties are dropped, invalid members are skipped and parsing stops at
+// the specification's size limits.
+func ParseBaggage(values []string) map[string]string {
+	baggage := make(map[string]string)
+	size := 0
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			size += len(member) + 1
+			if size > maxBaggageBytes || len(baggage) >= maxBaggageMembers {
+				return baggage
+			}
+			member, _, _ = strings.Cut(member, ";")
+			key, val, ok := strings.Cut(member, "=")
+			key = strings.TrimSpace(key)
+			if !ok || key == "" || strings.ContainsAny(key, " \t\"(),/:;<=>?@[\\]{}") {
+				continue
+			}
+			decoded, err := url.PathUnescape(strings.TrimSpace(val))
+			if err != nil {
+				continue
+			}
+			baggage[key] = decoded
+		}
+	}
+	return baggage
+}
+
+// FormatBaggage encodes baggage as a header value with sorted keys.
+func FormatBaggage(baggage map[string]string) string {
+	keys := make([]string, 0, len(baggage))
+	for k := range baggage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	members := make([]string, 0, len(keys))
+	for _, k := range keys {
+		members = append(members, k+"="+url.PathEscape(baggage[k]))
+	}
+	return strings.Join(members, ",")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
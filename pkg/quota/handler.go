@@ -0,0 +1,80 @@
+package quota
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Handler serves the quota admin API:
+//
+//	GET    ?key=   status of key, or of all known keys without key
+//	PUT    ?key=   override limits with a {"daily":N,"monthly":N} body;
+//	               omitted fields keep their current value, 0 is unlimited
+//	DELETE ?key=   drop the override, restoring the configured limits
+func (m *Manager) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" && r.Method != http.MethodGet {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if key == "" {
+				writeJSON(w, m.List(time.Now()))
+				return
+			}
+		case http.MethodPut:
+			var body struct {
+				Daily   *int64 `json:"daily"`
+				Monthly *int64 `json:"monthly"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body", http.StatusBadRequest)
+				return
+			}
+			if (body.Daily != nil && *body.Daily < 0) || (body.Monthly != nil && *body.Monthly < 0) {
+				http.Error(w, "limits must not be negative", http.StatusBadRequest)
+				return
+			}
+			limits := m.Status(key, time.Now()).Limits
+			if body.Daily != nil {
+				limits.Daily = *body.Daily
+			}
+			if body.Monthly != nil {
+				limits.Monthly = *body.Monthly
+			}
+			m.SetLimits(key, limits)
+		case http.MethodDelete:
+			m.ClearLimits(key)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, m.Status(key, time.Now()))
+	})
+}
+
+// ResetHandler zeroes the usage of ?key= in ?window=daily|monthly, or in
+// both windows without window.
+func (m *Manager) ResetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+		if err := m.Reset(key, r.URL.Query().Get("window")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, m.Status(key, time.Now()))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,395 @@
+// Package quota enforces daily and monthly request quotas per API key. Usage
+// counters are kept in a JSON file so restarts do not hand out fresh quota;
+// limits come from config and can be overridden per key at runtime.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var exceededTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_quota_exceeded_total",
+		Help: "Requests rejected because the caller's quota was used up, by window",
+	},
+	[]string{"window"},
+)
+
+func init() {
+	prometheus.MustRegister(exceededTotal)
+}
+
+// Windows a quota can be counted over.
+const (
+	Daily   = "daily"
+	Monthly = "monthly"
+)
+
+// Limits are request quotas; zero means unlimited.
+type Limits struct {
+	Daily   int64 `json:"daily" mapstructure:"daily"`
+	Monthly int64 `json:"monthly" mapstructure:"monthly"`
+}
+
+// counters is the usage of one key in the current day and month.
+type counters struct {
+	Day        string `json:"day"`
+	DayCount   int64  `json:"day_count"`
+	Month      string `json:"month"`
+	MonthCount int64  `json:"month_count"`
+}
+
+// roll starts new windows when the day or month changed.
+func (c *counters) roll(day, month string) {
+	if c.Day != day {
+		c.Day, c.DayCount = day, 0
+	}
+	if c.Month != month {
+		c.Month, c.MonthCount = month, 0
+	}
+}
+
+// file is the on-disk layout.
+type file struct {
+	Counters  map[string]*counters `json:"counters"`
+	Overrides map[string]Limits    `json:"overrides"`
+}
+
+// Config configures a Manager.
+type Config struct {
+	// Path is the JSON file counters and overrides are saved to.
+	Path string
+	// Default applies to keys without their own limits.
+	Default Limits
+	// Keys sets limits per API key ID.
+	Keys map[string]Limits
+	// Location cuts days and months; UTC by default.
+	Location *time.Location
+	// Key identifies the caller of a request. It must only return verified
+	// identities, with all other callers sharing one key: every key counted
+	// is kept in memory and in the store until its month ends.
+	Key func(*http.Request) string
+}
+
+// Manager counts requests against quotas.
+type Manager struct {
+	cfg Config
+
+	mu        sync.Mutex
+	counters  map[string]*counters
+	overrides map[string]Limits
+	dirty     bool
+}
+
+// NewManager loads the state saved at cfg.Path.
+func NewManager(cfg Config) (*Manager, error) {
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	m := &Manager{
+		cfg:       cfg,
+		counters:  make(map[string]*counters),
+		overrides: make(map[string]Limits),
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open quota store: %w", err)
+	}
+	if len(data) > 0 {
+		var f file
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("parse quota store: %w", err)
+		}
+		for key, c := range f.Counters {
+			m.counters[key] = c
+		}
+		for key, l := range f.Overrides {
+			m.overrides[key] = l
+		}
+	}
+	return m, nil
+}
+
+// limits returns the limits of key; m.mu must be held.
+func (m *Manager) limits(key string) (Limits, string) {
+	if l, ok := m.overrides[key]; ok {
+		return l, "override"
+	}
+	if l, ok := m.cfg.Keys[key]; ok {
+		return l, "config"
+	}
+	return m.cfg.Default, "default"
+}
+
+// Decision is the outcome of Allow for the tightest window.
+type Decision struct {
+	Allowed bool
+	// Window is empty when the key has no limits.
+	Window    string
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+// Allow counts a request of key unless a quota is used up.
+func (m *Manager) Allow(key string, now time.Time) Decision {
+	now = now.In(m.cfg.Location)
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limits, _ := m.limits(key)
+	if limits.Daily <= 0 && limits.Monthly <= 0 {
+		return Decision{Allowed: true}
+	}
+	c, ok := m.counters[key]
+	if !ok {
+		c = &counters{}
+		m.counters[key] = c
+	}
+	c.roll(day, month)
+
+	d := tightest(limits, c, now)
+	if d.Remaining <= 0 {
+		return d
+	}
+	c.DayCount++
+	c.MonthCount++
+	m.dirty = true
+	d.Allowed = true
+	d.Remaining--
+	return d
+}
+
+// tightest picks the limited window with the least quota left.
+func tightest(limits Limits, c *counters, now time.Time) Decision {
+	d := Decision{Remaining: math.MaxInt64}
+	if limits.Daily > 0 {
+		d = Decision{
+			Window:    Daily,
+			Limit:     limits.Daily,
+			Remaining: max(limits.Daily-c.DayCount, 0),
+			Reset:     time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()),
+		}
+	}
+	if limits.Monthly > 0 {
+		if remaining := max(limits.Monthly-c.MonthCount, 0); remaining < d.Remaining {
+			d = Decision{
+				Window:    Monthly,
+				Limit:     limits.Monthly,
+				Remaining: remaining,
+				Reset:     time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location()),
+			}
+		}
+	}
+	return d
+}
+
+// Wrap enforces quotas on next. Responses carry X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-Quota-Reset (Unix seconds) for limited keys;
+// requests over quota get 429 with Retry-After.
+func (m *Manager) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		d := m.Allow(m.cfg.Key(r), now)
+		if d.Window != "" {
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(d.Limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(d.Remaining, 10))
+			w.Header().Set("X-Quota-Reset", strconv.FormatInt(d.Reset.Unix(), 10))
+		}
+		if !d.Allowed {
+			exceededTotal.WithLabelValues(d.Window).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Reset.Sub(now).Seconds()))))
+			http.Error(w, fmt.Sprintf("%s quota of %d requests exceeded", d.Window, d.Limit), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Status describes the quota of a key.
+type Status struct {
+	Key    string `json:"key"`
+	Limits Limits `json:"limits"`
+	// Source is where the limits come from: default, config or override.
+	Source  string `json:"source"`
+	Daily   Window `json:"daily"`
+	Monthly Window `json:"monthly"`
+}
+
+// Window is the usage of a key in the current day or month.
+type Window struct {
+	Used int64 `json:"used"`
+	// Remaining is -1 when the window is unlimited.
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// Status returns the quota of key.
+func (m *Manager) Status(key string, now time.Time) Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status(key, now.In(m.cfg.Location))
+}
+
+func (m *Manager) status(key string, now time.Time) Status {
+	c := counters{}
+	if stored, ok := m.counters[key]; ok {
+		c = *stored
+	}
+	c.roll(now.Format("2006-01-02"), now.Format("2006-01"))
+	limits, source := m.limits(key)
+
+	remaining := func(limit, used int64) int64 {
+		if limit <= 0 {
+			return -1
+		}
+		return max(limit-used, 0)
+	}
+	return Status{
+		Key:    key,
+		Limits: limits,
+		Source: source,
+		Daily: Window{
+			Used:      c.DayCount,
+			Remaining: remaining(limits.Daily, c.DayCount),
+			Reset:     time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()),
+		},
+		Monthly: Window{
+			Used:      c.MonthCount,
+			Remaining: remaining(limits.Monthly, c.MonthCount),
+			Reset:     time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location()),
+		},
+	}
+}
+
+// List returns the status of every key that has been counted or has its own
+// limits, ordered by key.
+func (m *Manager) List(now time.Time) []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now = now.In(m.cfg.Location)
+
+	keys := make(map[string]bool)
+	for key := range m.counters {
+		keys[key] = true
+	}
+	for key := range m.cfg.Keys {
+		keys[key] = true
+	}
+	for key := range m.overrides {
+		keys[key] = true
+	}
+	list := make([]Status, 0, len(keys))
+	for key := range keys {
+		list = append(list, m.status(key, now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// SetLimits overrides the configured limits of key.
+func (m *Manager) SetLimits(key string, limits Limits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[key] = limits
+	m.dirty = true
+}
+
+// ClearLimits drops the override of key, restoring its configured limits.
+func (m *Manager) ClearLimits(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, key)
+	m.dirty = true
+}
+
+// Reset zeroes the usage of key in window, or in both windows when window is
+// empty.
+func (m *Manager) Reset(key, window string) error {
+	if window != "" && window != Daily && window != Monthly {
+		return fmt.Errorf("unknown window %q", window)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok {
+		return nil
+	}
+	if window != Monthly {
+		c.DayCount = 0
+	}
+	if window != Daily {
+		c.MonthCount = 0
+	}
+	m.dirty = true
+	return nil
+}
+
+// Save writes counters and overrides if they changed. Counters of past
+// months are dropped.
+func (m *Manager) Save(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	month := now.In(m.cfg.Location).Format("2006-01")
+	for key, c := range m.counters {
+		if c.Month < month {
+			delete(m.counters, key)
+			m.dirty = true
+		}
+	}
+	if !m.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(file{Counters: m.counters, Overrides: m.overrides})
+	if err != nil {
+		return err
+	}
+	tmp := m.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save quota store: %w", err)
+	}
+	if err := os.Rename(tmp, m.cfg.Path); err != nil {
+		return fmt.Errorf("save quota store: %w", err)
+	}
+	m.dirty = false
+	return nil
+}
+
+// Run saves the state every interval until stop is closed, then once more.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	save := func(now time.Time) {
+		if err := m.Save(now); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	for {
+		select {
+		case <-stop:
+			save(time.Now())
+			return
+		case now := <-ticker.C:
+			save(now)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package quota
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, path string) *Manager {
+	t.Helper()
+	m, err := NewManager(Config{
+		Path:    path,
+		Default: Limits{Monthly: 5},
+		Keys:    map[string]Limits{"loadgen": {Daily: 2}, "unlimited": {}},
+		Key:     func(r *http.Request) string { return r.Header.Get("X-Caller") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAllowCountsPerWindow(t *testing.T) {
+	m := newTestManager(t, filepath.Join(t.TempDir(), "quotas.json"))
+	day := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	for i, want := range []bool{true, true, false} {
+		if d := m.Allow("loadgen", day); d.Allowed != want || d.Window != Daily {
+			t.Fatalf("request %d: %+v, want allowed %v in the daily window", i+1, d, want)
+		}
+	}
+	if d := m.Allow("loadgen", day.Add(12*time.Hour)); !d.Allowed || d.Remaining != 1 {
+		t.Errorf("next day: %+v, want allowed with 1 remaining", d)
+	}
+
+	// The default monthly limit applies to keys without their own.
+	for i := 0; i < 5; i++ {
+		m.Allow("anonymous", day)
+	}
+	if d := m.Allow("anonymous", day); d.Allowed || d.Window != Monthly || !d.Reset.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("sixth request of the month: %+v", d)
+	}
+	if d := m.Allow("anonymous", day.Add(24*time.Hour)); !d.Allowed {
+		t.Errorf("first request of June: %+v, want allowed", d)
+	}
+}
+
+func TestUnlimitedKeysAreNotCounted(t *testing.T) {
+	m := newTestManager(t, filepath.Join(t.TempDir(), "quotas.json"))
+	if d := m.Allow("unlimited", time.Now()); !d.Allowed || d.Window != "" {
+		t.Errorf("unlimited key: %+v", d)
+	}
+	if _, ok := m.counters["unlimited"]; ok {
+		t.Error("counters kept for a key without limits")
+	}
+}
+
+func TestOverridesAndReset(t *testing.T) {
+	m := newTestManager(t, filepath.Join(t.TempDir(), "quotas.json"))
+	now := time.Now()
+	m.Allow("loadgen", now)
+	m.Allow("loadgen", now)
+	m.SetLimits("loadgen", Limits{Daily: 3})
+	if s := m.Status("loadgen", now); s.Source != "override" || s.Daily.Remaining != 1 {
+		t.Errorf("after override: %+v", s)
+	}
+	if err := m.Reset("loadgen", "weekly"); err == nil {
+		t.Error("Reset accepted an unknown window")
+	}
+	if err := m.Reset("loadgen", Daily); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Status("loadgen", now); s.Daily.Used != 0 || s.Monthly.Used != 2 {
+		t.Errorf("after daily reset: %+v", s)
+	}
+	m.ClearLimits("loadgen")
+	if s := m.Status("loadgen", now); s.Source != "config" || s.Limits.Daily != 2 {
+		t.Errorf("after clearing the override: %+v", s)
+	}
+}
+
+func TestSaveAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	m := newTestManager(t, path)
+	may := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	m.Allow("loadgen", may)
+	m.Allow("old", may.AddDate(0, -1, 0))
+	m.SetLimits("partner", Limits{Daily: 100})
+	if err := m.Save(may); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestManager(t, path)
+	if s := reloaded.Status("loadgen", may); s.Daily.Used != 1 {
+		t.Errorf("reloaded usage: %+v", s)
+	}
+	if s := reloaded.Status("partner", may); s.Source != "override" {
+		t.Errorf("reloaded override: %+v", s)
+	}
+	if _, ok := reloaded.counters["old"]; ok {
+		t.Error("counters of a past month were saved")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	m := newTestManager(t, filepath.Join(t.TempDir(), "quotas.json"))
+	handler := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/api/v1/proxy/data/records", nil)
+		r.Header.Set("X-Caller", "loadgen")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+		if w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q", i+1, w.Header().Get("X-RateLimit-Limit"))
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("429 without Retry-After")
+		}
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("status codes = %v, want 200 200 429", codes)
+	}
+}
@@ -0,0 +1,178 @@
+package rbac
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JWTConfig describes how bearer JWTs are verified. Set HMACSecret for HS256
+// tokens, PublicKeyPEM for RS256 tokens, or both.
+type JWTConfig struct {
+	HMACSecret   string
+	PublicKeyPEM string
+	// Issuer and Audience, when set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim holding the roles, as a dotted path into
+	// nested objects (e.g. realm_access.roles); "roles" by default. Both
+	// string arrays and space-separated strings are accepted.
+	RolesClaim string
+	// Leeway tolerates clock skew on exp and nbf.
+	Leeway time.Duration
+}
+
+type verifier struct {
+	cfg       JWTConfig
+	publicKey *rsa.PublicKey
+}
+
+func newVerifier(cfg JWTConfig) (*verifier, error) {
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	v := &verifier{cfg: cfg}
+	if cfg.PublicKeyPEM == "" {
+		return v, nil
+	}
+	block, _ := pem.Decode([]byte(cfg.PublicKeyPEM))
+	if block == nil {
+		return nil, errors.New("jwt public key: no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("jwt public key: not an RSA key")
+	}
+	v.publicKey = rsaKey
+	return v, nil
+}
+
+func (v *verifier) enabled() bool {
+	return v.cfg.HMACSecret != "" || v.publicKey != nil
+}
+
+// isJWT reports whether token looks like a JWT rather than an opaque key.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks the signature and time claims of token and returns the
+// caller it identifies.
+func (v *verifier) verify(token string, now time.Time) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	switch header.Alg {
+	case "HS256":
+		if v.cfg.HMACSecret == "" {
+			return Identity{}, errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, []byte(v.cfg.HMACSecret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return Identity{}, errors.New("invalid signature")
+		}
+	case "RS256":
+		if v.publicKey == nil {
+			return Identity{}, errors.New("RS256 tokens are not accepted")
+		}
+		if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return Identity{}, errors.New("invalid signature")
+		}
+	default:
+		return Identity{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("token claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.cfg.Leeway)) {
+		return Identity{}, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Identity{}, errors.New("token not yet valid")
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return Identity{}, errors.New("unexpected issuer")
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return Identity{}, errors.New("unexpected audience")
+	}
+
+	subject, _ := claims["sub"].(string)
+	return Identity{Subject: subject, Roles: stringList(lookup(claims, v.cfg.RolesClaim)), Claims: claims}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	for _, a := range stringList(aud) {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup follows a dotted path through nested claim objects.
+func lookup(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	return value
+}
+
+func stringList(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
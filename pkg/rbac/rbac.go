@@ -0,0 +1,328 @@
+// Package rbac authorizes requests by role. Callers are identified by a
+// verified JWT (roles from a claim) or by an API key whose bearer token or
+// Basic auth password they present (roles from config); route policies name
+// the roles a method and path require.
+package rbac
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deniedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_rbac_denied_total",
+		Help: "Requests denied by role-based access control, by reason",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(deniedTotal)
+}
+
+// Denial reasons.
+const (
+	ReasonInvalidToken    = "invalid_token"
+	ReasonUnauthenticated = "unauthenticated"
+	ReasonForbidden       = "forbidden"
+	ReasonNoPolicy        = "no_policy"
+)
+
+// DefaultInherits makes admin include writer and writer include reader.
+var DefaultInherits = map[string][]string{
+	"admin":  {"writer"},
+	"writer": {"reader"},
+}
+
+// Policy requires one of Roles for requests matching Methods and Path. Path
+// is matched segment by segment with path.Match; a trailing /** matches
+// everything below. No methods matches all; no roles makes the route public.
+type Policy struct {
+	Methods []string `mapstructure:"methods"`
+	Path    string   `mapstructure:"path"`
+	Roles   []string `mapstructure:"roles"`
+}
+
+func (p Policy) matches(r *http.Request) bool {
+	if len(p.Methods) > 0 {
+		ok := false
+		for _, m := range p.Methods {
+			ok = ok || strings.EqualFold(m, r.Method)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return matchPath(p.Path, r.URL.Path)
+}
+
+func matchPath(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if p == prefix {
+			return true
+		}
+		patternSegs := strings.Split(prefix, "/")
+		pathSegs := strings.Split(p, "/")
+		if len(pathSegs) <= len(patternSegs) {
+			return false
+		}
+		p = strings.Join(pathSegs[:len(patternSegs)], "/")
+		pattern = prefix
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// Identity is the authorized caller.
+type Identity struct {
+	Subject string
+	Roles   []string
+	// Claims holds all claims of a verified JWT.
+	Claims map[string]interface{}
+}
+
+type contextKey struct{}
+
+// authentication is the outcome of identify, kept in the context of a
+// request by Authenticate.
+type authentication struct {
+	id    Identity
+	known bool
+	err   error
+}
+
+type authenticationKey struct{}
+
+// FromContext returns the identity of an authorized request.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// Caller returns the verified subject of r as found by Authenticate: the
+// subject of a valid JWT or the ID of the API key whose credentials r
+// carries. It is empty for anonymous callers and invalid credentials.
+func Caller(r *http.Request) string {
+	if auth, ok := r.Context().Value(authenticationKey{}).(authentication); ok && auth.known {
+		return auth.id.Subject
+	}
+	return ""
+}
+
+// APIKey is a caller known by a bearer token or by a Basic auth password.
+type APIKey struct {
+	// TokenSHA256 is the hex SHA-256 of the caller's bearer token, so the
+	// token itself need not be configured.
+	TokenSHA256 string `mapstructure:"token_sha256"`
+	// Password is the Basic auth password of the user named by the key ID.
+	Password string   `mapstructure:"password"`
+	Roles    []string `mapstructure:"roles"`
+}
+
+// Config configures an Authorizer.
+type Config struct {
+	JWT JWTConfig
+	// APIKeys maps caller IDs to their credentials. A bearer token that is
+	// not a JWT must hash to a key's TokenSHA256; a Basic auth user must be
+	// a key ID with that key's Password.
+	APIKeys map[string]APIKey
+	// AnonymousRoles are granted to anonymous callers.
+	AnonymousRoles []string
+	// Inherits lists the roles each role includes; DefaultInherits when nil.
+	Inherits map[string][]string
+	// Policies are checked in order; the first match decides.
+	Policies []Policy
+	// DefaultAllow lets requests matching no policy through.
+	DefaultAllow bool
+	// OnDeny is called for every denied request.
+	OnDeny func(r *http.Request, status int, reason string, id Identity)
+}
+
+// Authorizer enforces a Config.
+type Authorizer struct {
+	cfg      Config
+	verifier *verifier
+	tokens   []keyToken
+}
+
+// keyToken is the token hash of an API key.
+type keyToken struct {
+	id   string
+	hash []byte
+}
+
+// New validates cfg.
+func New(cfg Config) (*Authorizer, error) {
+	if cfg.Inherits == nil {
+		cfg.Inherits = DefaultInherits
+	}
+	for i, p := range cfg.Policies {
+		if _, err := path.Match(strings.TrimSuffix(p.Path, "/**"), ""); err != nil || p.Path == "" {
+			return nil, fmt.Errorf("policy %d: invalid path %q", i, p.Path)
+		}
+	}
+	var tokens []keyToken
+	for id, key := range cfg.APIKeys {
+		if key.TokenSHA256 == "" && key.Password == "" {
+			return nil, fmt.Errorf("api key %s: token_sha256 or password is required", id)
+		}
+		if key.TokenSHA256 == "" {
+			continue
+		}
+		hash, err := hex.DecodeString(key.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %s: token_sha256 must be 64 hex digits", id)
+		}
+		tokens = append(tokens, keyToken{id: id, hash: hash})
+	}
+	v, err := newVerifier(cfg.JWT)
+	if err != nil {
+		return nil, err
+	}
+	return &Authorizer{cfg: cfg, verifier: v, tokens: tokens}, nil
+}
+
+// expand adds the roles included by roles.
+func (a *Authorizer) expand(roles []string) map[string]bool {
+	set := make(map[string]bool)
+	var add func(role string)
+	add = func(role string) {
+		if set[role] {
+			return
+		}
+		set[role] = true
+		for _, included := range a.cfg.Inherits[role] {
+			add(included)
+		}
+	}
+	for _, role := range roles {
+		add(role)
+	}
+	return set
+}
+
+// Allowed reports whether id has one of roles, directly or through
+// inheritance.
+func (a *Authorizer) Allowed(id Identity, roles []string) bool {
+	granted := a.expand(id.Roles)
+	for _, role := range roles {
+		if granted[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// identify returns the caller of r and whether it is known. Credentials
+// that match no API key leave the caller anonymous.
+func (a *Authorizer) identify(r *http.Request, now time.Time) (Identity, bool, error) {
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer && a.verifier.enabled() && isJWT(token) {
+		id, err := a.verifier.verify(token, now)
+		if err != nil {
+			return Identity{}, false, err
+		}
+		return id, true, nil
+	}
+	if bearer && token != "" {
+		if id, ok := a.tokenKey(token); ok {
+			return Identity{Subject: id, Roles: a.cfg.APIKeys[id].Roles}, true, nil
+		}
+	} else if user, password, ok := r.BasicAuth(); ok {
+		if key, ok := a.cfg.APIKeys[user]; ok && key.Password != "" && equalSecret(password, key.Password) {
+			return Identity{Subject: user, Roles: key.Roles}, true, nil
+		}
+	}
+	return Identity{Roles: a.cfg.AnonymousRoles}, false, nil
+}
+
+// tokenKey returns the API key whose TokenSHA256 token hashes to. Every
+// key is compared in constant time, so timing tells nothing of the hashes.
+func (a *Authorizer) tokenKey(token string) (string, bool) {
+	sum := sha256.Sum256([]byte(token))
+	found := ""
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.hash) == 1 {
+			found = t.id
+		}
+	}
+	return found, found != ""
+}
+
+// equalSecret compares secrets in time independent of where they differ.
+func equalSecret(given, want string) bool {
+	g := sha256.Sum256([]byte(given))
+	w := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
+
+// Authenticate identifies the caller of each request for Wrap and Caller.
+// Placed ahead of handlers that account requests to callers, it lets them
+// see who made a request even when Wrap denies it.
+func (a *Authorizer) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, known, err := a.identify(r, time.Now())
+		ctx := context.WithValue(r.Context(), authenticationKey{}, authentication{id: id, known: known, err: err})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Wrap authorizes requests to next. Invalid tokens and anonymous callers
+// lacking a required role get 401; known callers lacking one get 403.
+func (a *Authorizer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := r.Context().Value(authenticationKey{}).(authentication)
+		if !ok {
+			auth.id, auth.known, auth.err = a.identify(r, time.Now())
+		}
+		id, known, err := auth.id, auth.known, auth.err
+		if err != nil {
+			a.deny(w, r, http.StatusUnauthorized, ReasonInvalidToken, id)
+			return
+		}
+
+		var policy *Policy
+		for i := range a.cfg.Policies {
+			if a.cfg.Policies[i].matches(r) {
+				policy = &a.cfg.Policies[i]
+				break
+			}
+		}
+		if policy == nil && !a.cfg.DefaultAllow {
+			a.deny(w, r, http.StatusForbidden, ReasonNoPolicy, id)
+			return
+		}
+		if policy != nil && len(policy.Roles) > 0 {
+			if !a.Allowed(id, policy.Roles) {
+				if known {
+					a.deny(w, r, http.StatusForbidden, ReasonForbidden, id)
+				} else {
+					a.deny(w, r, http.StatusUnauthorized, ReasonUnauthenticated, id)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+	})
+}
+
+func (a *Authorizer) deny(w http.ResponseWriter, r *http.Request, status int, reason string, id Identity) {
+	deniedTotal.WithLabelValues(reason).Inc()
+	if a.cfg.OnDeny != nil {
+		a.cfg.OnDeny(r, status, reason, id)
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, http.StatusText(status), status)
+}
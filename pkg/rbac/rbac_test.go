@@ -0,0 +1,168 @@
+package rbac
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTestAuthorizer(t *testing.T) *Authorizer {
+	t.Helper()
+	a, err := New(Config{
+		JWT: JWTConfig{HMACSecret: "jwt-secret"},
+		APIKeys: map[string]APIKey{
+			"loadgen": {TokenSHA256: tokenHash("s3cret-token"), Roles: []string{"writer"}},
+			"grafana": {Password: "grafana-pass", Roles: []string{"reader"}},
+		},
+		AnonymousRoles: []string{"public"},
+		Policies: []Policy{
+			{Methods: []string{"DELETE"}, Path: "/api/v1/proxy/**", Roles: []string{"admin"}},
+			{Methods: []string{"POST"}, Path: "/api/v1/proxy/**", Roles: []string{"writer"}},
+			{Methods: []string{"GET"}, Path: "/api/v1/proxy/*/health"},
+			{Methods: []string{"GET"}, Path: "/api/v1/proxy/**", Roles: []string{"reader"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestIdentifyVerifiesCredentials(t *testing.T) {
+	a := newTestAuthorizer(t)
+	now := time.Now()
+	jwt := signHS256(t, "jwt-secret", map[string]interface{}{"sub": "alice", "roles": []string{"admin"}, "exp": now.Add(time.Hour).Unix()})
+	forged := signHS256(t, "other-secret", map[string]interface{}{"sub": "mallory", "roles": []string{"admin"}})
+
+	tests := []struct {
+		name    string
+		auth    func(r *http.Request)
+		subject string
+		known   bool
+		invalid bool
+	}{
+		{"anonymous", func(r *http.Request) {}, "", false, false},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret-token") }, "loadgen", true, false},
+		{"unknown token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guessed") }, "", false, false},
+		{"token hash as token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tokenHash("s3cret-token")) }, "", false, false},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("grafana", "grafana-pass") }, "grafana", true, false},
+		{"basic wrong password", func(r *http.Request) { r.SetBasicAuth("grafana", "guess") }, "", false, false},
+		{"basic empty password", func(r *http.Request) { r.SetBasicAuth("loadgen", "") }, "", false, false},
+		{"basic unknown user", func(r *http.Request) { r.SetBasicAuth("root", "grafana-pass") }, "", false, false},
+		{"jwt", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+jwt) }, "alice", true, false},
+		{"forged jwt", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+forged) }, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/proxy/data/records", nil)
+			tt.auth(r)
+			id, known, err := a.identify(r, now)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("err = %v, want invalid %v", err, tt.invalid)
+			}
+			if id.Subject != tt.subject || known != tt.known {
+				t.Errorf("identify = %q known %v, want %q known %v", id.Subject, known, tt.subject, tt.known)
+			}
+			if !known && !tt.invalid && (len(id.Roles) != 1 || id.Roles[0] != "public") {
+				t.Errorf("anonymous roles = %v, want [public]", id.Roles)
+			}
+		})
+	}
+}
+
+func TestNewRejectsKeysWithoutCredentials(t *testing.T) {
+	for name, key := range map[string]APIKey{
+		"no credentials": {Roles: []string{"admin"}},
+		"short hash":     {TokenSHA256: "3f9a1c2b7d4e", Roles: []string{"admin"}},
+		"not hex":        {TokenSHA256: tokenHash("x")[:62] + "zz"},
+	} {
+		if _, err := New(Config{APIKeys: map[string]APIKey{"k": key}}); err == nil {
+			t.Errorf("%s: New accepted %+v", name, key)
+		}
+	}
+}
+
+func TestWrapEnforcesPolicies(t *testing.T) {
+	a := newTestAuthorizer(t)
+	var caller string
+	handler := a.Authenticate(a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller = Caller(r)
+	})))
+
+	tests := []struct {
+		method, path string
+		auth         func(r *http.Request)
+		status       int
+		caller       string
+	}{
+		{"GET", "/api/v1/proxy/data/health", func(r *http.Request) {}, 200, ""},
+		{"GET", "/api/v1/proxy/data/records", func(r *http.Request) {}, 401, ""},
+		{"GET", "/api/v1/proxy/data/records", func(r *http.Request) { r.SetBasicAuth("grafana", "grafana-pass") }, 200, "grafana"},
+		{"GET", "/api/v1/proxy/data/records", func(r *http.Request) { r.SetBasicAuth("grafana", "nope") }, 401, ""},
+		{"POST", "/api/v1/proxy/data/records", func(r *http.Request) { r.SetBasicAuth("grafana", "grafana-pass") }, 403, ""},
+		{"POST", "/api/v1/proxy/data/records", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret-token") }, 200, "loadgen"},
+		{"GET", "/api/v1/proxy/data/records", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret-token") }, 200, "loadgen"},
+		{"DELETE", "/api/v1/proxy/data/records", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret-token") }, 403, ""},
+		{"DELETE", "/api/v1/proxy/data/records", func(r *http.Request) { r.Header.Set("Authorization", "Bearer a.b.c") }, 401, ""},
+	}
+	for _, tt := range tests {
+		caller = ""
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || caller != tt.caller {
+			t.Errorf("%s %s: status %d caller %q, want %d %q", tt.method, tt.path, w.Code, caller, tt.status, tt.caller)
+		}
+	}
+}
+
+func TestCallerWithoutAuthenticate(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer s3cret-token")
+	if got := Caller(r); got != "" {
+		t.Errorf("Caller = %q before Authenticate, want anonymous", got)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/api/v1/proxy/**", "/api/v1/proxy", true},
+		{"/api/v1/proxy/**", "/api/v1/proxy/data/records/1", true},
+		{"/api/v1/proxy/**", "/api/v1/proxyx", false},
+		{"/api/v1/proxy/*/health", "/api/v1/proxy/data/health", true},
+		{"/api/v1/proxy/*/health", "/api/v1/proxy/data/x/health", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
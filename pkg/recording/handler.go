@@ -0,0 +1,63 @@
+package recording
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler serves the recordings:
+//
+//	GET    ?id=        one recording with its body
+//	GET    ?service=   recordings of a service (all without), newest first
+//	DELETE             drop all recordings
+func (rec *Recorder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if id := r.URL.Query().Get("id"); id != "" {
+				recording, ok := rec.Get(id)
+				if !ok {
+					http.Error(w, "recording not found", http.StatusNotFound)
+					return
+				}
+				writeJSON(w, recording)
+				return
+			}
+			writeJSON(w, rec.List(r.URL.Query().Get("service")))
+		case http.MethodDelete:
+			rec.Clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ReplayHandler replays recording ?id= against ?target=. resolve maps the
+// target name to a base URL; it must only allow known upstreams so the
+// endpoint cannot be used to reach arbitrary hosts.
+func (rec *Recorder) ReplayHandler(client *http.Client, resolve func(r *Recording, target string) (string, error), maxBody int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recording, ok := rec.Get(r.URL.Query().Get("id"))
+		if !ok {
+			http.Error(w, "recording not found", http.StatusNotFound)
+			return
+		}
+		base, err := resolve(recording, r.URL.Query().Get("target"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := Replay(client, recording, base, maxBody)
+		if err != nil {
+			http.Error(w, "replay failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, result)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
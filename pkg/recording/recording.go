@@ -0,0 +1,331 @@
+// Package recording keeps sampled copies of proxied requests so production
+// bugs can be reproduced by replaying them against another upstream, such as
+// a staging service. Recordings live in a fixed-size ring buffer and, when a
+// directory is configured, on disk so they survive restarts.
+package recording
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	recordedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pipeline_recorded_requests_total",
+			Help: "Requests recorded for replay",
+		},
+	)
+
+	replaysTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_request_replays_total",
+			Help: "Replays of recorded requests, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recordedTotal, replaysTotal)
+}
+
+// Redacted replaces the values of redacted headers.
+const Redacted = "[REDACTED]"
+
+// DefaultRedactHeaders carry credentials and are never stored.
+var DefaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+// Recording is a captured request and the status it was answered with.
+type Recording struct {
+	ID       string      `json:"id"`
+	Time     time.Time   `json:"time"`
+	Service  string      `json:"service"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Query    string      `json:"query,omitempty"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body,omitempty"`
+	TraceID  string      `json:"trace_id,omitempty"`
+	Status   int         `json:"status"`
+	Duration float64     `json:"duration_ms"`
+	// Truncated is set when the body was longer than the recorder keeps;
+	// replays of such recordings send the truncated body.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Config configures a Recorder.
+type Config struct {
+	// SampleRate is the fraction (0-1) of requests recorded.
+	SampleRate float64
+	// Capacity is the number of recordings kept; 100 by default.
+	Capacity int
+	// MaxBodyBytes caps the stored body; 64 KiB by default.
+	MaxBodyBytes int64
+	// Dir, when set, stores each recording as a JSON file so they survive
+	// restarts.
+	Dir string
+	// RedactHeaders are stored as Redacted; DefaultRedactHeaders when nil.
+	RedactHeaders []string
+}
+
+// Recorder samples and stores requests.
+type Recorder struct {
+	cfg    Config
+	redact map[string]bool
+
+	mu   sync.Mutex
+	ring []*Recording
+	next int
+}
+
+// New creates a Recorder, loading the recordings kept in cfg.Dir.
+func New(cfg Config) (*Recorder, error) {
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = 100
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 64 << 10
+	}
+	if cfg.RedactHeaders == nil {
+		cfg.RedactHeaders = DefaultRedactHeaders
+	}
+	rec := &Recorder{cfg: cfg, redact: make(map[string]bool)}
+	for _, h := range cfg.RedactHeaders {
+		rec.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	if cfg.Dir == "" {
+		return rec, nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("create recording dir: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*Recording
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("read recording: %w", err)
+		}
+		var r Recording
+		if err := json.Unmarshal(data, &r); err != nil {
+			// A half-written file from a crash; drop it.
+			os.Remove(name)
+			continue
+		}
+		loaded = append(loaded, &r)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Time.Before(loaded[j].Time) })
+	for _, r := range loaded {
+		rec.store(r)
+	}
+	return rec, nil
+}
+
+// Sample reports whether the next request should be recorded.
+func (rec *Recorder) Sample() bool {
+	return rec.cfg.SampleRate > 0 && mrand.Float64() < rec.cfg.SampleRate
+}
+
+// Capture copies the method, path, headers and body of r into a new
+// Recording. r.Body is replaced so it can still be sent on. Finish the
+// recording with Add once the response status is known.
+func (rec *Recorder) Capture(r *http.Request, service, path string) (*Recording, error) {
+	recording := &Recording{
+		ID:      newID(),
+		Time:    time.Now(),
+		Service: service,
+		Method:  r.Method,
+		Path:    path,
+		Query:   r.URL.RawQuery,
+		Header:  r.Header.Clone(),
+	}
+	for name := range recording.Header {
+		if rec.redact[name] {
+			recording.Header[name] = []string{Redacted}
+		}
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, rec.cfg.MaxBodyBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("read request body: %w", err)
+		}
+		recording.Body = body
+		if int64(len(body)) > rec.cfg.MaxBodyBytes {
+			recording.Body = body[:rec.cfg.MaxBodyBytes]
+			recording.Truncated = true
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	return recording, nil
+}
+
+// Add stores a finished recording, evicting the oldest one when full.
+func (rec *Recorder) Add(r *Recording) error {
+	recordedTotal.Inc()
+	evicted := rec.store(r)
+	if rec.cfg.Dir == "" {
+		return nil
+	}
+	if evicted != nil {
+		os.Remove(rec.file(evicted.ID))
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp := rec.file(r.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save recording: %w", err)
+	}
+	return os.Rename(tmp, rec.file(r.ID))
+}
+
+func (rec *Recorder) store(r *Recording) (evicted *Recording) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.ring) < rec.cfg.Capacity {
+		rec.ring = append(rec.ring, r)
+		return nil
+	}
+	evicted = rec.ring[rec.next]
+	rec.ring[rec.next] = r
+	rec.next = (rec.next + 1) % rec.cfg.Capacity
+	return evicted
+}
+
+func (rec *Recorder) file(id string) string {
+	return filepath.Join(rec.cfg.Dir, id+".json")
+}
+
+// List returns the recordings of service (all when empty), newest first.
+func (rec *Recorder) List(service string) []*Recording {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	list := make([]*Recording, 0, len(rec.ring))
+	for i := len(rec.ring) - 1; i >= 0; i-- {
+		r := rec.ring[(rec.next+i)%len(rec.ring)]
+		if service == "" || r.Service == service {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// Get returns the recording with id.
+func (rec *Recorder) Get(id string) (*Recording, bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, r := range rec.ring {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Clear drops all recordings.
+func (rec *Recorder) Clear() {
+	rec.mu.Lock()
+	ring := rec.ring
+	rec.ring, rec.next = nil, 0
+	rec.mu.Unlock()
+	if rec.cfg.Dir != "" {
+		for _, r := range ring {
+			os.Remove(rec.file(r.ID))
+		}
+	}
+}
+
+// Result is the outcome of a replay.
+type Result struct {
+	ID             string      `json:"id"`
+	Target         string      `json:"target"`
+	OriginalStatus int         `json:"original_status"`
+	Status         int         `json:"status"`
+	Header         http.Header `json:"header"`
+	Body           string      `json:"body"`
+	Duration       float64     `json:"duration_ms"`
+}
+
+// Replay sends r to the base URL target. Redacted headers, the original
+// trace context and request ID are left out, and X-Replay-Of carries the recording ID so
+// the upstream can tell replays apart. Up to maxBody bytes of the response
+// body are returned.
+func Replay(client *http.Client, r *Recording, target string, maxBody int64) (*Result, error) {
+	url := strings.TrimRight(target, "/") + "/" + strings.TrimLeft(r.Path, "/")
+	if r.Query != "" {
+		url += "?" + r.Query
+	}
+	req, err := http.NewRequest(r.Method, url, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Header {
+		if len(values) == 1 && values[0] == Redacted {
+			continue
+		}
+		switch name {
+		case "Traceparent", "Tracestate", "X-Request-Id", "Content-Length":
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Replay-Of", r.ID)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		replaysTotal.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		replaysTotal.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	result := "same_status"
+	if resp.StatusCode != r.Status {
+		result = "different_status"
+	}
+	replaysTotal.WithLabelValues(result).Inc()
+	return &Result{
+		ID:             r.ID,
+		Target:         url,
+		OriginalStatus: r.Status,
+		Status:         resp.StatusCode,
+		Header:         resp.Header,
+		Body:           string(body),
+		Duration:       float64(time.Since(start).Microseconds()) / 1000,
+	}, nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
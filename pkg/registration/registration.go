@@ -0,0 +1,130 @@
+// Package registration announces a service instance to the API gateway. The
+// instance registers its URL, health path and routes with POST
+// /api/v1/register, renews the registration by registering again every
+// interval, and withdraws it with DELETE when stopped. The gateway stops
+// routing to instances whose registration was not renewed in time.
+package registration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Instance is what a service registers.
+type Instance struct {
+	// Name is the service name, such as data-service; the gateway proxies
+	// /api/v1/proxy/data/... to it.
+	Name string `json:"name"`
+	// URL is the base URL the gateway reaches the instance at.
+	URL string `json:"url"`
+	// HealthPath is checked by the gateway, /health when empty.
+	HealthPath string `json:"health_path,omitempty"`
+	// Routes are the paths the gateway may proxy to the instance, a
+	// trailing * matching any suffix; empty for all.
+	Routes []string `json:"routes,omitempty"`
+}
+
+// Config is where and how often an instance registers.
+type Config struct {
+	GatewayURL string
+	// Token is sent as a bearer token, for gateways that protect their
+	// admin endpoints.
+	Token    string
+	Interval time.Duration
+	Timeout  time.Duration
+	Instance Instance
+	// OnError, if not nil, is called when registering or withdrawing
+	// fails; the next heartbeat tries again.
+	OnError func(error)
+}
+
+// Start registers the instance at once and then every interval until the
+// returned function is called, which withdraws the registration.
+func Start(c Config) func() {
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		for {
+			c.report(Register(ctx, c))
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		c.report(Deregister(ctx, c))
+	}
+}
+
+func (c Config) report(err error) {
+	if err != nil && c.OnError != nil {
+		c.OnError(err)
+	}
+}
+
+// Register registers or renews the instance once.
+func Register(ctx context.Context, c Config) error {
+	body, err := json.Marshal(c.Instance)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, http.MethodPost, c.GatewayURL+"/api/v1/register", body)
+	return err
+}
+
+// Deregister withdraws the instance's registration; one the gateway does
+// not know, such as an expired one, is not an error.
+func Deregister(ctx context.Context, c Config) error {
+	target := fmt.Sprintf("%s/api/v1/register/%s?url=%s", c.GatewayURL, url.PathEscape(c.Instance.Name), url.QueryEscape(c.Instance.URL))
+	status, err := c.do(ctx, http.MethodDelete, target, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// do sends a request to the gateway and returns its status, with an error
+// for anything but a 2xx.
+func (c Config) do(ctx context.Context, method, target string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s: %w", method, target, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", method, target, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
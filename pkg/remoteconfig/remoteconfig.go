@@ -0,0 +1,428 @@
+// Package remoteconfig loads and watches service configuration from Consul KV
+// or etcd through viper's remote provider hook, and reports where each
+// effective setting came from.
+//
+// viper instances are not safe for concurrent writes, so only Load, called
+// at startup, merges into the service's viper. Watch publishes each changed
+// document as a new read-only viper instead, available from Current.
+//
+// The providers talk plain HTTP (Consul KV API, etcd v3 JSON gateway) so no
+// client libraries are needed. Importing the package installs them as
+// viper.RemoteConfig.
+package remoteconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.RemoteConfig = httpProvider{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Config selects the remote backend.
+type Config struct {
+	// Provider is "consul" or "etcd3".
+	Provider string
+	// Endpoint is the backend address, e.g. http://consul:8500.
+	Endpoint string
+	// Path is the KV key holding the config document.
+	Path string
+	// Format is the document format understood by viper (yaml, json, ...).
+	Format string
+	// Interval is how often the key is polled for changes.
+	Interval time.Duration
+}
+
+// Sources tracks which layer supplies each setting of a viper instance.
+type Sources struct {
+	mu         sync.RWMutex
+	v          *viper.Viper
+	current    atomic.Pointer[viper.Viper]
+	remote     Config
+	local      map[string]interface{}
+	fileKeys   map[string]bool
+	remoteKeys map[string]bool
+	remoteSet  map[string]interface{}
+	changed    map[string]bool
+	lastSync   time.Time
+}
+
+// NewSources snapshots the settings and the keys set by the config file.
+// Call it after ReadInConfig and before Load.
+func NewSources(v *viper.Viper) *Sources {
+	s := &Sources{
+		v:          v,
+		local:      flatten("", v.AllSettings()),
+		fileKeys:   make(map[string]bool),
+		remoteKeys: make(map[string]bool),
+		changed:    make(map[string]bool),
+	}
+	for _, key := range v.AllKeys() {
+		if v.InConfig(key) {
+			s.fileKeys[key] = true
+		}
+	}
+	s.current.Store(v)
+	return s
+}
+
+// Load reads the remote document and merges it over the file config, so
+// remote values win over config.yaml while environment variables still win
+// over both. It writes to the service's viper and must be called before
+// anything reads it concurrently.
+func (s *Sources) Load(cfg Config) error {
+	if cfg.Format == "" {
+		cfg.Format = "yaml"
+	}
+
+	settings, err := fetch(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remote = cfg
+	if err := s.v.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("merge remote config: %w", err)
+	}
+	s.record(settings)
+	return nil
+}
+
+// Current returns the effective configuration including remote changes seen
+// by Watch since startup. The returned viper must not be modified; it is
+// replaced, not updated, on every change.
+func (s *Sources) Current() *viper.Viper {
+	return s.current.Load()
+}
+
+// Watch polls the remote key until ctx is done and publishes changes through
+// Current. The service's own viper keeps the values loaded at startup.
+// onChange receives the keys whose values changed.
+func (s *Sources) Watch(ctx context.Context, onChange func(keys []string), onError func(error)) {
+	s.mu.RLock()
+	cfg := s.remote
+	s.mu.RUnlock()
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			settings, err := fetch(cfg)
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+
+			s.mu.Lock()
+			changed := diffKeys(s.remoteSet, settings)
+			if len(changed) > 0 {
+				if err := s.publish(settings, changed); err != nil {
+					changed = nil
+					if onError != nil {
+						onError(err)
+					}
+				}
+			} else {
+				s.lastSync = time.Now()
+			}
+			s.mu.Unlock()
+
+			if len(changed) > 0 && onChange != nil {
+				onChange(changed)
+			}
+		}
+	}
+}
+
+// publish builds a viper holding the startup settings with settings merged
+// over them, environment variables still winning, and makes it Current.
+func (s *Sources) publish(settings map[string]interface{}, changed []string) error {
+	next := viper.New()
+	for key, value := range s.local {
+		next.SetDefault(key, value)
+	}
+	if err := next.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("merge remote config: %w", err)
+	}
+	for key, value := range s.local {
+		if fromEnv(key) {
+			next.Set(key, value)
+		}
+	}
+	s.current.Store(next)
+	for _, key := range changed {
+		s.changed[key] = true
+	}
+	s.record(settings)
+	return nil
+}
+
+func (s *Sources) record(settings map[string]interface{}) {
+	s.remoteSet = settings
+	s.remoteKeys = make(map[string]bool)
+	for key := range flatten("", settings) {
+		s.remoteKeys[key] = true
+	}
+	s.lastSync = time.Now()
+}
+
+func fromEnv(key string) bool {
+	_, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+	return ok
+}
+
+// Source reports the layer providing key: env, remote, file or default.
+func (s *Sources) Source(key string) string {
+	if fromEnv(key) {
+		return "env"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch {
+	case s.remoteKeys[key]:
+		return "remote"
+	case s.fileKeys[key]:
+		return "file"
+	default:
+		return "default"
+	}
+}
+
+// Setting is one entry of the effective configuration. RestartRequired
+// marks remote changes the service has not picked up.
+type Setting struct {
+	Value           interface{} `json:"value"`
+	Source          string      `json:"source"`
+	RestartRequired bool        `json:"restart_required,omitempty"`
+}
+
+// Handler serves the effective configuration with secrets redacted.
+func (s *Sources) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := s.Current()
+		keys := current.AllKeys()
+		sort.Strings(keys)
+
+		s.mu.RLock()
+		changed := make(map[string]bool, len(s.changed))
+		for key := range s.changed {
+			changed[key] = true
+		}
+		s.mu.RUnlock()
+
+		settings := make(map[string]Setting, len(keys))
+		for _, key := range keys {
+			var value interface{} = current.Get(key)
+			if IsSecret(key) {
+				value = redact(value)
+			}
+			settings[key] = Setting{Value: value, Source: s.Source(key), RestartRequired: changed[key]}
+		}
+
+		resp := map[string]interface{}{
+			"settings":    settings,
+			"config_file": s.v.ConfigFileUsed(),
+		}
+
+		s.mu.RLock()
+		if s.remote.Provider != "" {
+			resp["remote"] = map[string]interface{}{
+				"provider":  s.remote.Provider,
+				"endpoint":  s.remote.Endpoint,
+				"path":      s.remote.Path,
+				"last_sync": s.lastSync.UTC().Format(time.RFC3339),
+			}
+		}
+		s.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+var secretMarkers = []string{"password", "secret", "token", "salt", "credential", "private_key", "api_key", "signing_key", "authorization"}
+
+// IsSecret reports whether a config key looks like it holds a secret.
+func IsSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, marker := range secretMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(value interface{}) interface{} {
+	if value == nil || reflect.ValueOf(value).IsZero() {
+		return value
+	}
+	return "[REDACTED]"
+}
+
+func fetch(cfg Config) (map[string]interface{}, error) {
+	rv := viper.New()
+	rv.SetConfigType(cfg.Format)
+	if err := rv.AddRemoteProvider(cfg.Provider, cfg.Endpoint, cfg.Path); err != nil {
+		return nil, err
+	}
+	if err := rv.ReadRemoteConfig(); err != nil {
+		return nil, fmt.Errorf("read remote config from %s %s: %w", cfg.Provider, cfg.Path, err)
+	}
+	return rv.AllSettings(), nil
+}
+
+func flatten(prefix string, m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for k, v := range m {
+		key := strings.ToLower(k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range flatten(key, nested) {
+				out[nk] = nv
+			}
+			continue
+		}
+		out[key] = v
+	}
+	return out
+}
+
+func diffKeys(old, updated map[string]interface{}) []string {
+	a, b := flatten("", old), flatten("", updated)
+	var changed []string
+	for key, value := range b {
+		if prev, ok := a[key]; !ok || !reflect.DeepEqual(prev, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// httpProvider implements viper's remote config factory for Consul and etcd3.
+type httpProvider struct {
+	client *http.Client
+}
+
+func (p httpProvider) Get(rp viper.RemoteProvider) (io.Reader, error) {
+	var (
+		value []byte
+		err   error
+	)
+	switch rp.Provider() {
+	case "consul":
+		value, err = p.consulGet(rp)
+	case "etcd3":
+		value, err = p.etcdGet(rp)
+	default:
+		return nil, fmt.Errorf("remote provider %q is not supported, use consul or etcd3", rp.Provider())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(value), nil
+}
+
+func (p httpProvider) Watch(rp viper.RemoteProvider) (io.Reader, error) {
+	return p.Get(rp)
+}
+
+// WatchChannel is not used; Sources.Watch polls instead.
+func (p httpProvider) WatchChannel(rp viper.RemoteProvider) (<-chan *viper.RemoteResponse, chan bool) {
+	responses := make(chan *viper.RemoteResponse)
+	quit := make(chan bool)
+	close(responses)
+	return responses, quit
+}
+
+func (p httpProvider) consulGet(rp viper.RemoteProvider) ([]byte, error) {
+	url := baseURL(rp.Endpoint()) + "/v1/kv/" + strings.TrimPrefix(rp.Path(), "/") + "?raw"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s for key %s", resp.Status, rp.Path())
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (p httpProvider) etcdGet(rp viper.RemoteProvider) ([]byte, error) {
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(rp.Path()))})
+	resp, err := p.client.Post(baseURL(rp.Endpoint())+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd returned %s for key %s", resp.Status, rp.Path())
+	}
+
+	var result struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key %s not found", rp.Path())
+	}
+	return base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+}
+
+func baseURL(endpoint string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return endpoint
+}
@@ -0,0 +1,137 @@
+package remoteconfig
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// consulKV serves one Consul KV key whose value the test can change.
+type consulKV struct {
+	mu    sync.Mutex
+	value string
+}
+
+func (c *consulKV) set(value string) {
+	c.mu.Lock()
+	c.value = value
+	c.mu.Unlock()
+}
+
+func (c *consulKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/kv/config/test-service" {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Write([]byte(c.value))
+}
+
+func newTestViper(t *testing.T) *viper.Viper {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader("log_level: info\nlimits:\n  max: 10\n  min: 1\nauth:\n  password: hunter2\n")); err != nil {
+		t.Fatal(err)
+	}
+	v.SetDefault("port", "8080")
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	return v
+}
+
+func TestLoadAndWatch(t *testing.T) {
+	t.Setenv("LIMITS_MIN", "5")
+	kv := &consulKV{value: "limits:\n  max: 20\n  min: 2\n"}
+	server := httptest.NewServer(kv)
+	defer server.Close()
+
+	v := newTestViper(t)
+	sources := NewSources(v)
+	cfg := Config{Provider: "consul", Endpoint: server.URL, Path: "config/test-service", Interval: 10 * time.Millisecond}
+	if err := sources.Load(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if v.GetInt("limits.max") != 20 || v.GetInt("limits.min") != 5 || v.GetString("log_level") != "info" {
+		t.Fatalf("after Load: max %d min %d log_level %q", v.GetInt("limits.max"), v.GetInt("limits.min"), v.GetString("log_level"))
+	}
+	for key, want := range map[string]string{"limits.max": "remote", "limits.min": "env", "log_level": "file", "port": "default"} {
+		if got := sources.Source(key); got != want {
+			t.Errorf("Source(%s) = %s, want %s", key, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan []string, 1)
+	go sources.Watch(ctx, func(keys []string) { changes <- keys }, nil)
+
+	kv.set("limits:\n  max: 30\n  min: 3\nlog_level: debug\n")
+	var keys []string
+	select {
+	case keys = <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change reported")
+	}
+	if strings.Join(keys, ",") != "limits.max,limits.min,log_level" {
+		t.Errorf("changed keys = %v", keys)
+	}
+
+	current := sources.Current()
+	if current == v {
+		t.Fatal("Watch did not publish a new viper")
+	}
+	if current.GetInt("limits.max") != 30 || current.GetInt("limits.min") != 5 || current.GetString("log_level") != "debug" || current.GetString("port") != "8080" {
+		t.Errorf("Current: max %d min %d log_level %q port %q", current.GetInt("limits.max"), current.GetInt("limits.min"), current.GetString("log_level"), current.GetString("port"))
+	}
+	if v.GetInt("limits.max") != 20 || v.GetString("log_level") != "info" {
+		t.Errorf("Watch modified the service's viper: max %d log_level %q", v.GetInt("limits.max"), v.GetString("log_level"))
+	}
+
+	w := httptest.NewRecorder()
+	sources.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	var resp struct {
+		Settings map[string]Setting `json:"settings"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if s := resp.Settings["log_level"]; s.Value != "debug" || s.Source != "remote" || !s.RestartRequired {
+		t.Errorf("log_level setting = %+v", s)
+	}
+	if s := resp.Settings["port"]; s.RestartRequired {
+		t.Errorf("unchanged port marked for restart: %+v", s)
+	}
+	if s := resp.Settings["auth.password"]; s.Value != "[REDACTED]" {
+		t.Errorf("password served as %v", s.Value)
+	}
+}
+
+func TestLoadFailure(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	sources := NewSources(newTestViper(t))
+	if err := sources.Load(Config{Provider: "consul", Endpoint: server.URL, Path: "config/missing"}); err == nil {
+		t.Error("Load succeeded for a missing key")
+	}
+	if sources.Source("log_level") != "file" {
+		t.Errorf("Source(log_level) = %s after a failed load", sources.Source("log_level"))
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	old := map[string]interface{}{"a": 1, "nested": map[string]interface{}{"b": "x", "c": true}}
+	updated := map[string]interface{}{"a": 1, "nested": map[string]interface{}{"b": "y"}, "d": 2}
+	if got := strings.Join(diffKeys(old, updated), ","); got != "d,nested.b,nested.c" {
+		t.Errorf("diffKeys = %s", got)
+	}
+}
@@ -0,0 +1,277 @@
+// Package response writes the services' resource responses in one envelope:
+//
+//	{"data": ..., "pagination": {...}, "links": {...}, "request_id": "..."}
+//
+// data holds the resource, or for a collection one page of it, with
+// pagination describing the page. links are hypermedia links from the
+// resource to itself and related resources; items of a collection carry
+// their own. request_id echoes X-Request-ID so a response can be matched to
+// logs and audit events.
+//
+// Links are paths. Behind a proxy that serves a service under another path,
+// such as the gateway's /api/v1/proxy/{service}, the proxy passes that path
+// in X-Forwarded-Prefix and the links include it.
+//
+// Responses are encoded through package codec, so the envelope is available
+// in every encoding the data is; its Protobuf message is documented in
+// response.proto.
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/codec"
+)
+
+// Page sizes of collection requests.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// PrefixHeader carries the path a proxy serves the service under.
+const PrefixHeader = "X-Forwarded-Prefix"
+
+// Links maps link relations, e.g. "self" or "collection", to paths.
+type Links map[string]string
+
+// Pagination describes the page of a collection in data. Next and Prev are
+// links to the neighbouring pages, omitted at either end.
+type Pagination struct {
+	Total  int    `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+	Next   string `json:"next,omitempty"`
+	Prev   string `json:"prev,omitempty"`
+}
+
+// Envelope is the body of every resource response.
+type Envelope struct {
+	Data       interface{} `json:"data"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+	Links      Links       `json:"links,omitempty"`
+	RequestID  string      `json:"request_id"`
+}
+
+// Version leaves the request ID out of the envelope's ETag.
+func (e Envelope) Version() interface{} {
+	return struct {
+		Data  interface{} `json:"data"`
+		Links Links       `json:"links,omitempty"`
+	}{e.Data, e.Links}
+}
+
+// Page is the offset and limit of a collection request.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// ParsePage reads the offset and limit query parameters of r. limit defaults
+// to DefaultLimit and may not exceed MaxLimit.
+func ParsePage(r *http.Request) (Page, error) {
+	page := Page{Limit: DefaultLimit}
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return page, fmt.Errorf("invalid offset %q", v)
+		}
+		page.Offset = offset
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return page, fmt.Errorf("invalid limit %q: must be between 1 and %d", v, MaxLimit)
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+// ParseIDs reads the repeatable id query parameter of r, which narrows a
+// collection to the resources with those IDs. It returns nil when r has none;
+// at most MaxLimit IDs may be given.
+func ParseIDs(r *http.Request) (map[string]bool, error) {
+	values := r.URL.Query()["id"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) > MaxLimit {
+		return nil, fmt.Errorf("too many ids: at most %d", MaxLimit)
+	}
+	ids := make(map[string]bool, len(values))
+	for _, id := range values {
+		if id == "" {
+			return nil, fmt.Errorf("empty id")
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Bounds returns the slice bounds of the page in a collection of total
+// items.
+func (p Page) Bounds(total int) (int, int) {
+	lo := p.Offset
+	if lo > total {
+		lo = total
+	}
+	hi := lo + p.Limit
+	if hi > total {
+		hi = total
+	}
+	return lo, hi
+}
+
+// Link returns path as a link for responses to r, under the proxy prefix if
+// there is one.
+func Link(r *http.Request, path string) string {
+	return prefix(r) + path
+}
+
+// prefix returns r's X-Forwarded-Prefix if it is a plain absolute path, so
+// a client cannot turn links into ones to another host.
+func prefix(r *http.Request) string {
+	p := strings.TrimRight(r.Header.Get(PrefixHeader), "/")
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.ContainsAny(p, "\\?#:") {
+		return ""
+	}
+	for _, c := range p {
+		if c < 0x20 || c == 0x7f {
+			return ""
+		}
+	}
+	return p
+}
+
+// Write writes data with status and links.
+func Write(w http.ResponseWriter, r *http.Request, status int, data interface{}, links Links) {
+	codec.Write(w, r, status, encodable(Envelope{Data: data, Links: links, RequestID: requestID(w, r)}))
+}
+
+// Created writes a resource created by r with 201 Created and its "self"
+// link as Location.
+func Created(w http.ResponseWriter, r *http.Request, data interface{}, links Links) {
+	if self := links["self"]; self != "" {
+		w.Header().Set("Location", self)
+	}
+	Write(w, r, http.StatusCreated, data, links)
+}
+
+// WriteResource is Write for a single resource clients poll, with the ETag
+// and conditional GET handling of codec.WriteResource.
+func WriteResource(w http.ResponseWriter, r *http.Request, data interface{}, links Links, modified time.Time) {
+	codec.WriteResource(w, r, encodable(Envelope{Data: data, Links: links, RequestID: requestID(w, r)}), modified)
+}
+
+// WriteList writes items, the page of a collection of total items, with the
+// links of the collection. items must be a slice.
+func WriteList(w http.ResponseWriter, r *http.Request, items interface{}, page Page, total int, links Links) {
+	pagination := &Pagination{Total: total, Offset: page.Offset, Limit: page.Limit}
+	if page.Offset+page.Limit < total {
+		pagination.Next = pageLink(r, page.Offset+page.Limit, page.Limit)
+	}
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		pagination.Prev = pageLink(r, prev, page.Limit)
+	}
+	if links == nil {
+		links = Links{}
+	}
+	links["self"] = pageLink(r, page.Offset, page.Limit)
+
+	codec.Write(w, r, http.StatusOK, encodable(Envelope{
+		Data:       items,
+		Pagination: pagination,
+		Links:      links,
+		RequestID:  requestID(w, r),
+	}))
+}
+
+// pageLink links to the page at offset of the collection r lists, keeping
+// r's other query parameters.
+func pageLink(r *http.Request, offset, limit int) string {
+	q := r.URL.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	return Link(r, u.String())
+}
+
+// requestID returns r's request ID, generating and echoing one if a
+// middleware such as the audit recorder has not already.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := r.Header.Get(audit.RequestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	id := hex.EncodeToString(b)
+	r.Header.Set(audit.RequestIDHeader, id)
+	w.Header().Set(audit.RequestIDHeader, id)
+	return id
+}
+
+// protoEnvelope is an Envelope whose data has a Protobuf encoding.
+type protoEnvelope struct {
+	Envelope
+}
+
+var protoMessageType = reflect.TypeOf((*codec.ProtoMessage)(nil)).Elem()
+
+// encodable returns e as a codec.ProtoMessage if its data, or each element
+// of it, is one; otherwise the envelope is offered in JSON and MessagePack
+// only.
+func encodable(e Envelope) interface{} {
+	if e.Data == nil {
+		return e
+	}
+	t := reflect.TypeOf(e.Data)
+	if t.Implements(protoMessageType) || (t.Kind() == reflect.Slice && t.Elem().Implements(protoMessageType)) {
+		return protoEnvelope{e}
+	}
+	return e
+}
+
+// MarshalProto encodes e as an envelope message: data as field 1 (repeated
+// for collections), pagination 2, links 3 and request_id 4.
+func (e protoEnvelope) MarshalProto() []byte {
+	var b []byte
+	if message, ok := e.Data.(codec.ProtoMessage); ok {
+		b = codec.AppendMessage(b, 1, message.MarshalProto())
+	} else {
+		items := reflect.ValueOf(e.Data)
+		for i := 0; i < items.Len(); i++ {
+			b = codec.AppendMessage(b, 1, items.Index(i).Interface().(codec.ProtoMessage).MarshalProto())
+		}
+	}
+	if e.Pagination != nil {
+		b = codec.AppendMessage(b, 2, e.Pagination.marshalProto())
+	}
+	b = codec.AppendStringMap(b, 3, e.Links)
+	return codec.AppendString(b, 4, e.RequestID)
+}
+
+func (p *Pagination) marshalProto() []byte {
+	var b []byte
+	b = codec.AppendInt64(b, 1, int64(p.Total))
+	b = codec.AppendInt64(b, 2, int64(p.Offset))
+	b = codec.AppendInt64(b, 3, int64(p.Limit))
+	b = codec.AppendString(b, 4, p.Next)
+	return codec.AppendString(b, 5, p.Prev)
+}
@@ -0,0 +1,73 @@
+// Package secrets resolves secret references in service configuration so
+// credentials, signing keys and TLS material do not live in plaintext config.
+//
+// A config value of the form
+//
+//	vault:<path>#<field>
+//
+// is fetched from the configured Provider; any other value is used as is.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RefPrefix marks a config value as a secret reference.
+const RefPrefix = "vault:"
+
+// Provider fetches a single secret field.
+type Provider interface {
+	Get(ctx context.Context, path, field string) (string, error)
+}
+
+// IsRef reports whether value is a secret reference.
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, RefPrefix)
+}
+
+// ParseRef splits a reference into path and field. The field defaults to
+// "value" when omitted.
+func ParseRef(ref string) (path, field string, err error) {
+	rest, ok := strings.CutPrefix(ref, RefPrefix)
+	if !ok {
+		return "", "", fmt.Errorf("not a secret reference: %q", ref)
+	}
+	path, field, _ = strings.Cut(rest, "#")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", "", fmt.Errorf("secret reference %q has no path", ref)
+	}
+	if field == "" {
+		field = "value"
+	}
+	return path, field, nil
+}
+
+// Resolve returns value unchanged unless it is a reference, in which case the
+// secret is fetched from p.
+func Resolve(ctx context.Context, p Provider, value string) (string, error) {
+	if !IsRef(value) {
+		return value, nil
+	}
+	path, field, err := ParseRef(value)
+	if err != nil {
+		return "", err
+	}
+	return p.Get(ctx, path, field)
+}
+
+// EnvProvider reads references from environment variables, which is handy in
+// development: vault:pipeline/api#token reads PIPELINE_API_TOKEN.
+type EnvProvider struct{}
+
+func (EnvProvider) Get(ctx context.Context, path, field string) (string, error) {
+	name := strings.ToUpper(strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(path + "_" + field))
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("secret %s#%s: environment variable %s not set", path, field, name)
+	}
+	return value, nil
+}
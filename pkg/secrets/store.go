@@ -0,0 +1,95 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store holds the resolved values of a set of config keys that reference
+// secrets, and keeps them current. It is safe for concurrent use, so
+// per-request code can read rotated values while Refresh runs.
+type Store struct {
+	provider Provider
+	refs     map[string]string
+
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// NewStore returns a Store for refs, which maps config keys to secret
+// references. Call Resolve before reading from it.
+func NewStore(p Provider, refs map[string]string) *Store {
+	return &Store{provider: p, refs: refs, values: make(map[string]string, len(refs))}
+}
+
+// Keys returns the config keys of the store, sorted.
+func (s *Store) Keys() []string {
+	keys := make([]string, 0, len(s.refs))
+	for key := range s.refs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Resolve fetches every secret. It stops at the first reference that cannot
+// be resolved.
+func (s *Store) Resolve(ctx context.Context) error {
+	for _, key := range s.Keys() {
+		value, err := Resolve(ctx, s.provider, s.refs[key])
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		s.mu.Lock()
+		s.values[key] = value
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Get returns the current value of key. ok is false when key does not hold a
+// secret reference; a nil Store holds none.
+func (s *Store) Get(key string) (value string, ok bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok = s.values[key]
+	return value, ok
+}
+
+// Refresh re-reads every secret each interval until ctx is done. onRotate is
+// called with the keys whose value changed, onError with those that could not
+// be read, which keep their previous value.
+func (s *Store) Refresh(ctx context.Context, interval time.Duration, onRotate func(key string), onError func(key string, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, key := range s.Keys() {
+			value, err := Resolve(ctx, s.provider, s.refs[key])
+			if err != nil {
+				if onError != nil {
+					onError(key, err)
+				}
+				continue
+			}
+			s.mu.Lock()
+			rotated := s.values[key] != value
+			s.values[key] = value
+			s.mu.Unlock()
+			if rotated && onRotate != nil {
+				onRotate(key)
+			}
+		}
+	}
+}
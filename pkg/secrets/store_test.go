@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapProvider serves secrets from a map the test can change.
+type mapProvider struct {
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+func (p *mapProvider) set(key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if value == "" {
+		delete(p.secrets, key)
+		return
+	}
+	p.secrets[key] = value
+}
+
+func (p *mapProvider) Get(ctx context.Context, path, field string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	value, ok := p.secrets[path+"#"+field]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return value, nil
+}
+
+func TestStoreResolveAndRefresh(t *testing.T) {
+	provider := &mapProvider{secrets: map[string]string{"pipeline/data#salt": "s1", "pipeline/data#token": "t1"}}
+	store := NewStore(provider, map[string]string{
+		"privacy.hash_salt":                "vault:pipeline/data#salt",
+		"endpoint_protection.bearer_token": "vault:pipeline/data#token",
+	})
+	if err := store.Resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := store.Get("privacy.hash_salt"); !ok || v != "s1" {
+		t.Fatalf("Get = %q, %v", v, ok)
+	}
+	if _, ok := store.Get("log_level"); ok {
+		t.Error("Get found a key without a reference")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rotated := make(chan string, 4)
+	failed := make(chan string, 4)
+	go store.Refresh(ctx, 5*time.Millisecond, func(key string) { rotated <- key }, func(key string, err error) { failed <- key })
+
+	provider.set("pipeline/data#salt", "s2")
+	provider.set("pipeline/data#token", "")
+	deadline := time.After(5 * time.Second)
+	var gotRotated, gotFailed string
+	for gotRotated == "" || gotFailed == "" {
+		// Readers run alongside the refresh; go test -race checks the locking.
+		store.Get("privacy.hash_salt")
+		select {
+		case gotRotated = <-rotated:
+		case gotFailed = <-failed:
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatal("no rotation or failure reported")
+		}
+	}
+	if gotRotated != "privacy.hash_salt" || gotFailed != "endpoint_protection.bearer_token" {
+		t.Errorf("rotated %q, failed %q", gotRotated, gotFailed)
+	}
+	if v, _ := store.Get("privacy.hash_salt"); v != "s2" {
+		t.Errorf("rotated value = %q", v)
+	}
+	if v, _ := store.Get("endpoint_protection.bearer_token"); v != "t1" {
+		t.Errorf("value after a failed refresh = %q, want the previous one", v)
+	}
+}
+
+func TestStoreResolveFailure(t *testing.T) {
+	store := NewStore(&mapProvider{secrets: map[string]string{}}, map[string]string{"kafka.password": "vault:pipeline/data#kafka"})
+	if err := store.Resolve(context.Background()); err == nil {
+		t.Error("Resolve succeeded for a missing secret")
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var store *Store
+	if _, ok := store.Get("privacy.hash_salt"); ok {
+		t.Error("nil Store returned a value")
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	tests := []struct {
+		ref, path, field string
+		ok               bool
+	}{
+		{"vault:pipeline/api#token", "pipeline/api", "token", true},
+		{"vault:/pipeline/api/", "pipeline/api", "value", true},
+		{"vault:#token", "", "", false},
+		{"plain", "", "", false},
+	}
+	for _, tt := range tests {
+		path, field, err := ParseRef(tt.ref)
+		if (err == nil) != tt.ok || path != tt.path || field != tt.field {
+			t.Errorf("ParseRef(%q) = %q, %q, %v", tt.ref, path, field, err)
+		}
+	}
+}
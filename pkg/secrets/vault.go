@@ -0,0 +1,251 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig configures the Vault KV v2 provider. Exactly one auth method is
+// used: Token, then AppRole (RoleID/SecretID), then Kubernetes (Role).
+type VaultConfig struct {
+	Address string
+	// Mount is the KV v2 mount point, "secret" by default.
+	Mount     string
+	Namespace string
+	Timeout   time.Duration
+
+	Token string
+
+	AppRoleMount string
+	RoleID       string
+	SecretID     string
+
+	KubernetesMount string
+	KubernetesRole  string
+	// KubernetesJWTPath defaults to the projected service account token.
+	KubernetesJWTPath string
+}
+
+// Vault reads secrets from a KV v2 engine and keeps its token renewed.
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+
+	mu         sync.RWMutex
+	token      string
+	leaseTTL   time.Duration
+	renewable  bool
+	authMethod string
+}
+
+// NewVault authenticates against Vault and returns a ready provider.
+func NewVault(ctx context.Context, cfg VaultConfig) (*Vault, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("vault address is required")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "secret"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.AppRoleMount == "" {
+		cfg.AppRoleMount = "approle"
+	}
+	if cfg.KubernetesMount == "" {
+		cfg.KubernetesMount = "kubernetes"
+	}
+	if cfg.KubernetesJWTPath == "" {
+		cfg.KubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	cfg.Address = strings.TrimRight(cfg.Address, "/")
+
+	v := &Vault{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+	if err := v.login(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Vault) login(ctx context.Context) error {
+	switch {
+	case v.cfg.Token != "":
+		v.mu.Lock()
+		v.token, v.authMethod = v.cfg.Token, "token"
+		v.mu.Unlock()
+		// Look up the token so renewal knows its TTL.
+		var resp struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+			return fmt.Errorf("vault token lookup: %w", err)
+		}
+		v.setLease(time.Duration(resp.Data.TTL)*time.Second, resp.Data.Renewable)
+		return nil
+
+	case v.cfg.RoleID != "":
+		return v.loginWith(ctx, "approle", "auth/"+v.cfg.AppRoleMount+"/login", map[string]string{
+			"role_id":   v.cfg.RoleID,
+			"secret_id": v.cfg.SecretID,
+		})
+
+	case v.cfg.KubernetesRole != "":
+		jwt, err := os.ReadFile(v.cfg.KubernetesJWTPath)
+		if err != nil {
+			return fmt.Errorf("read service account token: %w", err)
+		}
+		return v.loginWith(ctx, "kubernetes", "auth/"+v.cfg.KubernetesMount+"/login", map[string]string{
+			"role": v.cfg.KubernetesRole,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		})
+	}
+	return fmt.Errorf("no vault auth method configured")
+}
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+func (v *Vault) loginWith(ctx context.Context, method, path string, body interface{}) error {
+	var resp authResponse
+	if err := v.do(ctx, http.MethodPost, path, body, &resp); err != nil {
+		return fmt.Errorf("vault %s login: %w", method, err)
+	}
+	v.mu.Lock()
+	v.token, v.authMethod = resp.Auth.ClientToken, method
+	v.mu.Unlock()
+	v.setLease(time.Duration(resp.Auth.LeaseDuration)*time.Second, resp.Auth.Renewable)
+	return nil
+}
+
+func (v *Vault) setLease(ttl time.Duration, renewable bool) {
+	v.mu.Lock()
+	v.leaseTTL, v.renewable = ttl, renewable
+	v.mu.Unlock()
+}
+
+// Get reads field from the KV v2 secret at path.
+func (v *Vault) Get(ctx context.Context, path, field string) (string, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, v.cfg.Mount+"/data/"+path, nil, &resp); err != nil {
+		return "", fmt.Errorf("read secret %s: %w", path, err)
+	}
+	value, ok := resp.Data.Data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no field %q", path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// RenewLoop keeps the token alive until ctx is done: renewable tokens are
+// renewed at half their TTL, others are replaced by logging in again.
+// Static tokens without a TTL are left alone.
+func (v *Vault) RenewLoop(ctx context.Context, onError func(error)) {
+	for {
+		v.mu.RLock()
+		ttl, renewable, method := v.leaseTTL, v.renewable, v.authMethod
+		v.mu.RUnlock()
+
+		if ttl <= 0 {
+			return
+		}
+
+		wait := ttl / 2
+		if wait < 5*time.Second {
+			wait = 5 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		var err error
+		if renewable {
+			var resp authResponse
+			if err = v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &resp); err == nil {
+				v.setLease(time.Duration(resp.Auth.LeaseDuration)*time.Second, resp.Auth.Renewable)
+				continue
+			}
+		}
+		if method != "token" {
+			err = v.login(ctx)
+		} else if err == nil {
+			err = fmt.Errorf("vault token is not renewable and expires in %s", ttl-wait)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		if err != nil && method == "token" {
+			return
+		}
+	}
+}
+
+func (v *Vault) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.cfg.Address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	v.mu.RLock()
+	token := v.token
+	v.mu.RUnlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if len(apiErr.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(apiErr.Errors, "; "))
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,222 @@
+// Package shed rejects requests with 503 when a service is overloaded,
+// lowest priority first. Load is the larger of the in-flight request count
+// relative to MaxInFlight and the process CPU usage relative to CPUThreshold;
+// low-priority requests are shed from LowAt, normal ones from NormalAt and
+// high-priority ones only when MaxInFlight is reached.
+package shed
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pipeline/pkg/propagation"
+)
+
+var (
+	shedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pipeline_shed_requests_total",
+			Help: "Requests rejected with 503 by load shedding",
+		},
+		[]string{"priority", "reason"},
+	)
+	inFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pipeline_inflight_requests",
+			Help: "Requests currently being served, excluding exempt paths",
+		},
+	)
+	loadGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pipeline_load_ratio",
+			Help: "Load used for shedding decisions; 1 means MaxInFlight or CPUThreshold is reached",
+		},
+	)
+	cpuGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pipeline_process_cpu_utilization",
+			Help: "Process CPU time per second divided by GOMAXPROCS, sampled for load shedding",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shedTotal, inFlightGauge, loadGauge, cpuGauge)
+}
+
+// Config configures a Shedder.
+type Config struct {
+	// MaxInFlight is the in-flight request count treated as full load.
+	// Zero disables the queue depth signal.
+	MaxInFlight int
+	// CPUThreshold is the process CPU utilisation (0-1 of GOMAXPROCS)
+	// treated as full load. Zero disables the CPU signal.
+	CPUThreshold float64
+	// LowAt and NormalAt are the load ratios from which low and normal
+	// priority requests are shed; 0.6 and 0.85 by default.
+	LowAt    float64
+	NormalAt float64
+	// RetryAfter is sent with shed responses; 1s by default.
+	RetryAfter time.Duration
+	// ExemptPaths are never shed or counted, e.g. health checks and
+	// /metrics.
+	ExemptPaths []string
+	// CPUSampleInterval is how often CPU usage is sampled; 1s by default.
+	CPUSampleInterval time.Duration
+}
+
+// Shedder is the load shedding middleware.
+type Shedder struct {
+	cfg    Config
+	exempt map[string]bool
+
+	inFlight atomic.Int64
+	cpu      atomic.Uint64 // math.Float64bits of the last sample
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns a Shedder and starts CPU sampling when CPUThreshold is set.
+// Close stops the sampler.
+func New(cfg Config) *Shedder {
+	if cfg.LowAt <= 0 {
+		cfg.LowAt = 0.6
+	}
+	if cfg.NormalAt <= 0 {
+		cfg.NormalAt = 0.85
+	}
+	if cfg.NormalAt < cfg.LowAt {
+		cfg.NormalAt = cfg.LowAt
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = time.Second
+	}
+	if cfg.CPUSampleInterval <= 0 {
+		cfg.CPUSampleInterval = time.Second
+	}
+
+	s := &Shedder{cfg: cfg, exempt: make(map[string]bool), stop: make(chan struct{})}
+	for _, p := range cfg.ExemptPaths {
+		s.exempt[p] = true
+	}
+	if cfg.CPUThreshold > 0 {
+		go s.sampleCPU()
+	}
+	return s
+}
+
+// Enabled reports whether any overload signal is configured.
+func (s *Shedder) Enabled() bool {
+	return s.cfg.MaxInFlight > 0 || s.cfg.CPUThreshold > 0
+}
+
+// Close stops CPU sampling.
+func (s *Shedder) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// Wrap sheds requests to next by their X-Request-Priority (or baggage
+// priority) when the service is overloaded.
+func (s *Shedder) Wrap(next http.Handler) http.Handler {
+	if !s.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		inFlight := s.inFlight.Add(1)
+		defer func() {
+			inFlightGauge.Set(float64(s.inFlight.Add(-1)))
+		}()
+		inFlightGauge.Set(float64(inFlight))
+
+		priority := propagation.FromRequest(r).PriorityLabel()
+		if reason := s.shouldShed(priority, inFlight); reason != "" {
+			shedTotal.WithLabelValues(priority, reason).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.cfg.RetryAfter.Seconds()))))
+			http.Error(w, "Service overloaded, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shouldShed returns the overload signal ("queue_depth" or "cpu") that
+// rejects a request of the given priority, or "" to admit it. inFlight
+// includes the request itself.
+func (s *Shedder) shouldShed(priority string, inFlight int64) string {
+	queue, cpu := 0.0, 0.0
+	if s.cfg.MaxInFlight > 0 {
+		// Measured before this request so the last slot can be used.
+		queue = float64(inFlight-1) / float64(s.cfg.MaxInFlight)
+	}
+	if s.cfg.CPUThreshold > 0 {
+		cpu = math.Float64frombits(s.cpu.Load()) / s.cfg.CPUThreshold
+	}
+	load, reason := queue, "queue_depth"
+	if cpu > load {
+		load, reason = cpu, "cpu"
+	}
+	loadGauge.Set(load)
+
+	switch priority {
+	case propagation.PriorityHigh:
+		// Only the hard in-flight cap applies to interactive traffic.
+		if queue >= 1 {
+			return "queue_depth"
+		}
+		return ""
+	case propagation.PriorityLow:
+		if load >= s.cfg.LowAt {
+			return reason
+		}
+	default:
+		if load >= s.cfg.NormalAt {
+			return reason
+		}
+	}
+	return ""
+}
+
+func (s *Shedder) sampleCPU() {
+	ticker := time.NewTicker(s.cfg.CPUSampleInterval)
+	defer ticker.Stop()
+
+	lastCPU, lastAt := processCPUTime(), time.Now()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			cpuTime := processCPUTime()
+			utilization := 0.0
+			if elapsed := now.Sub(lastAt); elapsed > 0 {
+				utilization = (cpuTime - lastCPU).Seconds() / elapsed.Seconds() / float64(runtime.GOMAXPROCS(0))
+			}
+			lastCPU, lastAt = cpuTime, now
+			s.cpu.Store(math.Float64bits(utilization))
+			cpuGauge.Set(utilization)
+		}
+	}
+}
+
+// processCPUTime returns the user and system CPU time used by the process.
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,261 @@
+// Package shutdown audits how a service stopped. Once its server has
+// drained and its background loops have been told to stop, it reports the
+// goroutines, Bolt transactions and HTTP requests still running, and keeps
+// the outcome so the next start exports it as service_clean_shutdown.
+package shutdown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cleanShutdown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_clean_shutdown",
+		Help: "Whether the previous run of the service shut down cleanly (1), or left goroutines, Bolt transactions or requests behind or never finished shutting down (0)",
+	})
+	leakedGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_shutdown_leaked_goroutines",
+		Help: "Goroutines the previous run of the service left running after shutting down",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cleanShutdown, leakedGoroutines)
+}
+
+// Config configures an Auditor.
+type Config struct {
+	// Path keeps the report of the last run between starts; without it the
+	// previous run is not known and service_clean_shutdown not exported.
+	Path string
+	// Settle is how long Finish gives goroutines that were told to stop to
+	// return before they count as leaked; 2s by default.
+	Settle time.Duration
+}
+
+// Goroutines are the goroutines left running at one place.
+type Goroutines struct {
+	// Function is where they are blocked, the first frame outside the
+	// runtime.
+	Function  string `json:"function"`
+	CreatedBy string `json:"created_by,omitempty"`
+	Count     int    `json:"count"`
+}
+
+// Report is the outcome of one run's shutdown.
+type Report struct {
+	StartedAt time.Time `json:"started_at"`
+	// StoppedAt is nil while the service runs; a report read at start
+	// without it is of a run that crashed or was killed.
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	Clean     bool       `json:"clean"`
+	// DrainTimedOut is set when the server's requests outlasted the drain
+	// deadline.
+	DrainTimedOut    bool         `json:"drain_timed_out,omitempty"`
+	InFlightRequests int64        `json:"in_flight_requests,omitempty"`
+	BoltTransactions int          `json:"bolt_transactions,omitempty"`
+	Goroutines       []Goroutines `json:"goroutines,omitempty"`
+	LeakedGoroutines int          `json:"leaked_goroutines,omitempty"`
+}
+
+// Auditor tracks what a run has to leave behind at shutdown.
+type Auditor struct {
+	cfg       Config
+	startedAt time.Time
+	baseline  map[string]int
+	inFlight  atomic.Int64
+
+	previous    Report
+	hasPrevious bool
+}
+
+// Start begins auditing the run. It reads the previous run's report, exports
+// service_clean_shutdown from it, and records the goroutines already
+// running, such as the runtime's own, as the baseline that does not leak.
+// Call it before starting anything that is stopped at shutdown.
+func Start(cfg Config) *Auditor {
+	if cfg.Settle <= 0 {
+		cfg.Settle = 2 * time.Second
+	}
+	a := &Auditor{cfg: cfg, startedAt: time.Now().UTC(), baseline: make(map[string]int)}
+	for _, g := range goroutines() {
+		a.baseline[g.key()] += g.Count
+	}
+	if cfg.Path == "" {
+		return a
+	}
+
+	if data, err := os.ReadFile(cfg.Path); err == nil && json.Unmarshal(data, &a.previous) == nil {
+		a.hasPrevious = true
+		clean := 0.0
+		if a.previous.StoppedAt != nil && a.previous.Clean {
+			clean = 1
+		}
+		cleanShutdown.Set(clean)
+		leakedGoroutines.Set(float64(a.previous.LeakedGoroutines))
+	}
+	a.save(Report{StartedAt: a.startedAt})
+	return a
+}
+
+// Previous returns the previous run's report, and false when there was none.
+func (a *Auditor) Previous() (Report, bool) {
+	return a.previous, a.hasPrevious
+}
+
+// Wrap counts the requests to next in flight, for the report.
+func (a *Auditor) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.inFlight.Add(1)
+		defer a.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Finish audits the shutdown once the server has been shut down with
+// drainErr as the result and the background loops have been stopped. It
+// waits up to Settle for goroutines on their way out, then saves and returns
+// the report. boltTx is the number of Bolt transactions still open.
+func (a *Auditor) Finish(drainErr error, boltTx int) Report {
+	deadline := time.Now().Add(a.cfg.Settle)
+	leaked, total := a.leaked()
+	for total > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		leaked, total = a.leaked()
+	}
+
+	stopped := time.Now().UTC()
+	r := Report{
+		StartedAt:        a.startedAt,
+		StoppedAt:        &stopped,
+		DrainTimedOut:    errors.Is(drainErr, context.DeadlineExceeded),
+		InFlightRequests: a.inFlight.Load(),
+		BoltTransactions: boltTx,
+		Goroutines:       leaked,
+		LeakedGoroutines: total,
+	}
+	r.Clean = drainErr == nil && r.InFlightRequests == 0 && boltTx == 0 && total == 0
+	a.save(r)
+	return r
+}
+
+// leaked groups the goroutines running beyond the baseline.
+func (a *Auditor) leaked() ([]Goroutines, int) {
+	var leaked []Goroutines
+	total := 0
+	for _, g := range goroutines() {
+		g.Count -= a.baseline[g.key()]
+		if g.Count > 0 {
+			leaked = append(leaked, g)
+			total += g.Count
+		}
+	}
+	sort.Slice(leaked, func(i, j int) bool {
+		if leaked[i].Count != leaked[j].Count {
+			return leaked[i].Count > leaked[j].Count
+		}
+		return leaked[i].key() < leaked[j].key()
+	})
+	return leaked, total
+}
+
+func (a *Auditor) save(r Report) {
+	if a.cfg.Path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+	// Written to a temporary file and renamed, so a crash mid-write does
+	// not lose the report.
+	tmp := filepath.Join(filepath.Dir(a.cfg.Path), "."+filepath.Base(a.cfg.Path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return
+	}
+	os.Rename(tmp, a.cfg.Path)
+}
+
+func (g Goroutines) key() string {
+	return g.Function + "|" + g.CreatedBy
+}
+
+// goroutines groups the running goroutines, other than the caller's, by
+// where they are blocked and what created them.
+func goroutines() []Goroutines {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	groups := make(map[string]*Goroutines)
+	var order []string
+	// The first trace is the caller's own.
+	for _, trace := range bytes.Split(buf, []byte("\n\n"))[1:] {
+		g := parseTrace(string(trace))
+		// os/signal starts its receiving loop with the first Notify, which
+		// is usually the shutdown's own, and never stops it.
+		if g.Function == "" || strings.HasPrefix(g.CreatedBy, "os/signal.") {
+			continue
+		}
+		k := g.key()
+		if existing, ok := groups[k]; ok {
+			existing.Count++
+			continue
+		}
+		g.Count = 1
+		groups[k] = &g
+		order = append(order, k)
+	}
+	list := make([]Goroutines, 0, len(order))
+	for _, k := range order {
+		list = append(list, *groups[k])
+	}
+	return list
+}
+
+// parseTrace reads one goroutine of a runtime.Stack dump: a header line,
+// then a function line and a file line per frame, and a created by line
+// and its file line for all but the main goroutine.
+func parseTrace(trace string) Goroutines {
+	var g Goroutines
+	lines := strings.Split(strings.TrimSpace(trace), "\n")
+	for i := 1; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if created, ok := strings.CutPrefix(line, "created by "); ok {
+			if at := strings.Index(created, " in goroutine "); at >= 0 {
+				created = created[:at]
+			}
+			g.CreatedBy = created
+			continue
+		}
+		if g.Function == "" && !strings.HasPrefix(line, "runtime.") {
+			if args := strings.LastIndex(line, "("); args > 0 {
+				line = line[:args]
+			}
+			g.Function = line
+		}
+	}
+	return g
+}
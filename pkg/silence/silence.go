@@ -0,0 +1,469 @@
+// Package silence keeps time-bounded silences and maintenance windows.
+// A silence mutes the alerts its label matchers select, such as those of
+// one alert name, service or tenant. A maintenance window covers planned
+// work on services: their alerts are muted and their health checks are
+// left out of availability accounting. Both are kept in a JSON file so they
+// survive restarts; expired ones are dropped after the retention.
+package silence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var active = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pipeline_silences_active",
+		Help: "Silences and maintenance windows in effect, by kind: silence or maintenance",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(active)
+}
+
+// States of a silence or maintenance window.
+const (
+	StatePending = "pending"
+	StateActive  = "active"
+	StateExpired = "expired"
+)
+
+var (
+	// ErrNotFound is returned for an unknown ID.
+	ErrNotFound = errors.New("silence not found")
+	// ErrInvalid wraps the errors of invalid silences and windows.
+	ErrInvalid = errors.New("invalid silence or maintenance window")
+)
+
+// Period is when a silence or maintenance window is in effect:
+// [StartsAt, EndsAt).
+type Period struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+// StateAt is pending, active or expired at a time.
+func (p Period) StateAt(at time.Time) string {
+	switch {
+	case at.Before(p.StartsAt):
+		return StatePending
+	case at.Before(p.EndsAt):
+		return StateActive
+	default:
+		return StateExpired
+	}
+}
+
+// validate fills a missing start with now and checks the period ends after
+// it starts and in the future.
+func (p *Period) validate(now time.Time) error {
+	if p.StartsAt.IsZero() {
+		p.StartsAt = now
+	}
+	p.StartsAt, p.EndsAt = p.StartsAt.UTC(), p.EndsAt.UTC()
+	switch {
+	case p.EndsAt.IsZero():
+		return fmt.Errorf("%w: ends_at is required", ErrInvalid)
+	case !p.EndsAt.After(p.StartsAt):
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalid)
+	case !p.EndsAt.After(now):
+		return fmt.Errorf("%w: ends_at is in the past", ErrInvalid)
+	}
+	return nil
+}
+
+// Matcher selects alerts by a label: alertname, service, tenant or any
+// other.
+type Matcher struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Regex matches Value as a regular expression against the whole label.
+	Regex bool `json:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (m *Matcher) compile() error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: matcher without a name", ErrInvalid)
+	}
+	if !m.Regex {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return fmt.Errorf("%w: matcher %s: %v", ErrInvalid, m.Name, err)
+	}
+	m.re = re
+	return nil
+}
+
+func (m Matcher) matches(labels map[string]string) bool {
+	if m.re != nil {
+		return m.re.MatchString(labels[m.Name])
+	}
+	return labels[m.Name] == m.Value
+}
+
+// Silence mutes the alerts all its matchers match.
+type Silence struct {
+	ID string `json:"id"`
+	Period
+	Matchers  []Matcher `json:"matchers"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	State     string    `json:"state"`
+}
+
+// Matches reports whether the silence selects an alert with labels.
+func (s Silence) Matches(labels map[string]string) bool {
+	for _, m := range s.Matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Window is a maintenance window.
+type Window struct {
+	ID string `json:"id"`
+	Period
+	// Services are those under maintenance; empty for all.
+	Services  []string  `json:"services"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	State     string    `json:"state"`
+}
+
+// Covers reports whether service is under the window's maintenance.
+func (w Window) Covers(service string) bool {
+	if len(w.Services) == 0 {
+		return true
+	}
+	for _, s := range w.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Config configures a Store.
+type Config struct {
+	// Path is the JSON file silences and windows are saved to.
+	Path string
+	// Retention is how long expired ones are kept; 7 days by default.
+	Retention time.Duration
+}
+
+// Store holds the silences and maintenance windows.
+type Store struct {
+	cfg Config
+
+	mu       sync.Mutex
+	silences map[string]*Silence
+	windows  map[string]*Window
+}
+
+// state is what a Store saves.
+type state struct {
+	Silences []*Silence `json:"silences"`
+	Windows  []*Window  `json:"maintenance_windows"`
+}
+
+// NewStore loads the silences and windows saved at cfg.Path.
+func NewStore(cfg Config) (*Store, error) {
+	if cfg.Retention <= 0 {
+		cfg.Retention = 7 * 24 * time.Hour
+	}
+	s := &Store{cfg: cfg, silences: make(map[string]*Silence), windows: make(map[string]*Window)}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open silence store: %w", err)
+	}
+	if len(data) > 0 {
+		var st state
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("parse silence store: %w", err)
+		}
+		for _, sil := range st.Silences {
+			for i := range sil.Matchers {
+				if err := sil.Matchers[i].compile(); err != nil {
+					return nil, fmt.Errorf("parse silence store: silence %s: %w", sil.ID, err)
+				}
+			}
+			s.silences[sil.ID] = sil
+		}
+		for _, w := range st.Windows {
+			s.windows[w.ID] = w
+		}
+	}
+	return s, nil
+}
+
+// AddSilence creates a silence with at least one matcher; it starts now
+// unless StartsAt says otherwise.
+func (s *Store) AddSilence(sil Silence, actor string) (Silence, error) {
+	now := time.Now().UTC()
+	if len(sil.Matchers) == 0 {
+		return Silence{}, fmt.Errorf("%w: at least one matcher is required", ErrInvalid)
+	}
+	for i := range sil.Matchers {
+		if err := sil.Matchers[i].compile(); err != nil {
+			return Silence{}, err
+		}
+	}
+	if err := sil.Period.validate(now); err != nil {
+		return Silence{}, err
+	}
+	sil.ID, sil.CreatedBy, sil.CreatedAt = newID(), actor, now
+	sil.Comment = strings.TrimSpace(sil.Comment)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences[sil.ID] = &sil
+	return s.silenceAt(&sil, now), s.save(now)
+}
+
+// AddWindow creates a maintenance window; it starts now unless StartsAt
+// says otherwise.
+func (s *Store) AddWindow(w Window, actor string) (Window, error) {
+	now := time.Now().UTC()
+	if err := w.Period.validate(now); err != nil {
+		return Window{}, err
+	}
+	w.Reason = strings.TrimSpace(w.Reason)
+	if w.Reason == "" {
+		return Window{}, fmt.Errorf("%w: reason is required", ErrInvalid)
+	}
+	w.ID, w.CreatedBy, w.CreatedAt = newID(), actor, now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows[w.ID] = &w
+	return s.windowAt(&w, now), s.save(now)
+}
+
+// ExpireSilence ends a silence now; a pending one never starts.
+func (s *Store) ExpireSilence(id string) (Silence, error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sil, ok := s.silences[id]
+	if !ok {
+		return Silence{}, ErrNotFound
+	}
+	expire(&sil.Period, now)
+	return s.silenceAt(sil, now), s.save(now)
+}
+
+// EndWindow ends a maintenance window now; a pending one never starts.
+func (s *Store) EndWindow(id string) (Window, error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.windows[id]
+	if !ok {
+		return Window{}, ErrNotFound
+	}
+	expire(&w.Period, now)
+	return s.windowAt(w, now), s.save(now)
+}
+
+func expire(p *Period, now time.Time) {
+	if p.EndsAt.After(now) {
+		p.EndsAt = now
+	}
+	if p.StartsAt.After(now) {
+		p.StartsAt = now
+	}
+}
+
+// Silences returns the silences in state, or all for "", newest first.
+func (s *Store) Silences(state string) []Silence {
+	now := time.Now()
+	s.mu.Lock()
+	list := []Silence{}
+	for _, sil := range s.silences {
+		if c := s.silenceAt(sil, now); state == "" || c.State == state {
+			list = append(list, c)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Windows returns the maintenance windows in state, or all for "", by
+// start time, latest first.
+func (s *Store) Windows(state string) []Window {
+	now := time.Now()
+	s.mu.Lock()
+	list := []Window{}
+	for _, w := range s.windows {
+		if c := s.windowAt(w, now); state == "" || c.State == state {
+			list = append(list, c)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].StartsAt.After(list[j].StartsAt) })
+	return list
+}
+
+// Silence returns a silence by ID.
+func (s *Store) Silence(id string) (Silence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sil, ok := s.silences[id]
+	if !ok {
+		return Silence{}, false
+	}
+	return s.silenceAt(sil, time.Now()), true
+}
+
+// Window returns a maintenance window by ID.
+func (s *Store) Window(id string) (Window, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.windows[id]
+	if !ok {
+		return Window{}, false
+	}
+	return s.windowAt(w, time.Now()), true
+}
+
+// Muted reports whether an alert with labels is muted at a time, and the
+// ID of the silence or maintenance window muting it. Maintenance windows
+// match the alert's service label.
+func (s *Store) Muted(labels map[string]string, at time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sil := range s.silences {
+		if sil.StateAt(at) == StateActive && sil.Matches(labels) {
+			return sil.ID, true
+		}
+	}
+	if service := labels["service"]; service != "" {
+		for _, w := range s.windows {
+			if w.StateAt(at) == StateActive && w.Covers(service) {
+				return w.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// InMaintenance returns the active maintenance window covering service at a
+// time.
+func (s *Store) InMaintenance(service string, at time.Time) (Window, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.windows {
+		if w.StateAt(at) == StateActive && w.Covers(service) {
+			return s.windowAt(w, at), true
+		}
+	}
+	return Window{}, false
+}
+
+// UpdateGauges recounts the silences and windows in effect; call it
+// periodically, as they start and end with time.
+func (s *Store) UpdateGauges() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateGauges(time.Now())
+}
+
+// updateGauges recounts the silences and windows in effect. Callers hold
+// mu.
+func (s *Store) updateGauges(now time.Time) {
+	var silences, windows int
+	for _, sil := range s.silences {
+		if sil.StateAt(now) == StateActive {
+			silences++
+		}
+	}
+	for _, w := range s.windows {
+		if w.StateAt(now) == StateActive {
+			windows++
+		}
+	}
+	active.WithLabelValues("silence").Set(float64(silences))
+	active.WithLabelValues("maintenance").Set(float64(windows))
+}
+
+// silenceAt copies a silence with its state at a time. Callers hold mu.
+func (s *Store) silenceAt(sil *Silence, at time.Time) Silence {
+	c := *sil
+	c.Matchers = append([]Matcher(nil), sil.Matchers...)
+	c.State = sil.Period.StateAt(at)
+	return c
+}
+
+// windowAt copies a window with its state at a time. Callers hold mu.
+func (s *Store) windowAt(w *Window, at time.Time) Window {
+	c := *w
+	c.Services = append([]string{}, w.Services...)
+	c.State = w.Period.StateAt(at)
+	return c
+}
+
+// save drops what expired before the retention, updates the gauges and
+// writes the file. Callers hold mu.
+func (s *Store) save(now time.Time) error {
+	cutoff := now.Add(-s.cfg.Retention)
+	st := state{Silences: []*Silence{}, Windows: []*Window{}}
+	for id, sil := range s.silences {
+		if sil.EndsAt.Before(cutoff) {
+			delete(s.silences, id)
+			continue
+		}
+		st.Silences = append(st.Silences, sil)
+	}
+	for id, w := range s.windows {
+		if w.EndsAt.Before(cutoff) {
+			delete(s.windows, id)
+			continue
+		}
+		st.Windows = append(st.Windows, w)
+	}
+	s.updateGauges(now)
+	sort.Slice(st.Silences, func(i, j int) bool { return st.Silences[i].CreatedAt.Before(st.Silences[j].CreatedAt) })
+	sort.Slice(st.Windows, func(i, j int) bool { return st.Windows[i].CreatedAt.Before(st.Windows[j].CreatedAt) })
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save silence store: %w", err)
+	}
+	if err := os.Rename(tmp, s.cfg.Path); err != nil {
+		return fmt.Errorf("save silence store: %w", err)
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
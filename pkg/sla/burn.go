@@ -0,0 +1,108 @@
+package sla
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var burnRate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pipeline_slo_burn_rate",
+		Help: "How fast a service is spending its error budget over a window: the share of failed health checks divided by the share the SLA target allows (1 spends it exactly over the SLO period)",
+	},
+	[]string{"service", "window"},
+)
+
+func init() {
+	prometheus.MustRegister(burnRate)
+}
+
+// BurnRate is how fast a service spent its error budget over one window.
+type BurnRate struct {
+	Service      string  `json:"service"`
+	Window       string  `json:"window"`
+	Checks       int     `json:"checks"`
+	FailedChecks int     `json:"failed_checks"`
+	ErrorRatio   float64 `json:"error_ratio"`
+	// Rate is ErrorRatio divided by the error ratio the target allows. At
+	// 1 the budget lasts exactly the SLO period; at 14.4 a 30 day budget
+	// is gone in just over two days.
+	Rate float64 `json:"burn_rate"`
+}
+
+// BurnRates computes the burn rate of every service over each window
+// ending at now, against target in percent, and exports them as
+// pipeline_slo_burn_rate. Checks made during maintenance are left out, as
+// in the reports; a service without checks in a window burns nothing.
+func (h *History) BurnRates(windows []time.Duration, now time.Time, target float64) []BurnRate {
+	allowed := (100 - target) / 100
+	longest := time.Duration(0)
+	for _, w := range windows {
+		if w > longest {
+			longest = w
+		}
+	}
+
+	type counts struct{ checks, failed []int }
+	byService := make(map[string]*counts)
+	h.mu.Lock()
+	for _, c := range h.checks {
+		age := now.Sub(c.At)
+		if c.Maintenance || age < 0 || age >= longest {
+			continue
+		}
+		n, ok := byService[c.Service]
+		if !ok {
+			n = &counts{checks: make([]int, len(windows)), failed: make([]int, len(windows))}
+			byService[c.Service] = n
+		}
+		for i, w := range windows {
+			if age < w {
+				n.checks[i]++
+				if !c.Healthy {
+					n.failed[i]++
+				}
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	names := make([]string, 0, len(byService))
+	for name := range byService {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rates := make([]BurnRate, 0, len(names)*len(windows))
+	for _, name := range names {
+		n := byService[name]
+		for i, w := range windows {
+			b := BurnRate{Service: name, Window: formatWindow(w), Checks: n.checks[i], FailedChecks: n.failed[i]}
+			if b.Checks > 0 {
+				b.ErrorRatio = float64(b.FailedChecks) / float64(b.Checks)
+			}
+			if allowed > 0 {
+				// Rounded, as 100 - target is rarely exact in binary.
+				b.Rate = math.Round(b.ErrorRatio/allowed*1000) / 1000
+			}
+			burnRate.WithLabelValues(b.Service, b.Window).Set(b.Rate)
+			rates = append(rates, b)
+		}
+	}
+	return rates
+}
+
+// formatWindow writes a window the way Prometheus range selectors do, such
+// as 5m or 6h, so the window label reads like one.
+func formatWindow(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return d.String()
+}
@@ -0,0 +1,135 @@
+package sla
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period returns the bounds of the report containing date in loc: the whole
+// day for "daily", the ISO week (Monday to Sunday) for "weekly".
+func Period(period string, date time.Time, loc *time.Location) (time.Time, time.Time, bool) {
+	date = date.In(loc)
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	switch period {
+	case "daily":
+		return day, day.AddDate(0, 0, 1), true
+	case "weekly":
+		offset := (int(day.Weekday()) + 6) % 7
+		start := day.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// Handler serves reports. Query parameters:
+//
+//	period  daily (default) or weekly
+//	date    YYYY-MM-DD inside the period, today by default
+//	format  json or html; defaults to html when the client accepts it
+func (h *History) Handler(opts ReportOptions, loc *time.Location) http.Handler {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		period := q.Get("period")
+		if period == "" {
+			period = "daily"
+		}
+		date := time.Now()
+		if v := q.Get("date"); v != "" {
+			d, err := time.ParseInLocation("2006-01-02", v, loc)
+			if err != nil {
+				http.Error(w, "invalid date, use YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			date = d
+		}
+		start, end, ok := Period(period, date, loc)
+		if !ok {
+			http.Error(w, "period must be daily or weekly", http.StatusBadRequest)
+			return
+		}
+
+		report := h.Report(period, start, end, opts)
+
+		format := q.Get("format")
+		if format == "" {
+			format = "json"
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				format = "html"
+			}
+		}
+		switch format {
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			reportTemplate.Execute(w, report)
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		default:
+			http.Error(w, "format must be json or html", http.StatusBadRequest)
+		}
+	})
+}
+
+var reportTemplate = template.Must(template.New("sla").Funcs(template.FuncMap{
+	"pct": func(v float64) string { return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64) + "%" },
+	"ts":  func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"ms":  func(v float64) string { return fmt.Sprintf("%.1f ms", v) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>SLA report {{ts .Start}} – {{ts .End}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f4f4f4; }
+.ok { color: #2e7d32; font-weight: bold; }
+.miss { color: #c62828; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>SLA report ({{.Period}})</h1>
+<p>{{ts .Start}} – {{ts .End}}, generated {{ts .GeneratedAt}}</p>
+<p>Availability <span class="{{if .MeetsTarget}}ok{{else}}miss{{end}}">{{pct .Availability}}</span> against a target of {{pct .Target}}</p>
+
+<h2>Services</h2>
+<table>
+<tr><th>Service</th><th>Availability</th><th>Checks</th><th>Downtime</th><th>Avg check latency</th></tr>
+{{range .Services}}<tr>
+<td>{{.Name}}</td>
+<td class="{{if .MeetsTarget}}ok{{else}}miss{{end}}">{{pct .Availability}}</td>
+<td>{{.HealthyChecks}}/{{.Checks}}</td>
+<td>{{.Downtime}}</td>
+<td>{{ms .AvgLatencyMs}}</td>
+</tr>{{else}}<tr><td colspan="5">No health checks recorded in this period</td></tr>{{end}}
+</table>
+
+<h2>Downtime windows</h2>
+<table>
+<tr><th>Service</th><th>Start</th><th>End</th><th>Duration</th></tr>
+{{range $s := .Services}}{{range .Windows}}<tr>
+<td>{{$s.Name}}</td><td>{{ts .Start}}</td><td>{{ts .End}}{{if .Ongoing}} (ongoing){{end}}</td><td>{{.Duration}}</td>
+</tr>{{end}}{{end}}
+</table>
+
+<h2>Worst endpoints</h2>
+<table>
+<tr><th>Route</th><th>Requests</th><th>5xx</th><th>Error rate</th><th>Avg latency</th></tr>
+{{range .Worst}}<tr>
+<td>{{.Route}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{pct .ErrorRate}}</td><td>{{ms .AvgLatencyMs}}</td>
+</tr>{{else}}<tr><td colspan="5">No traffic recorded in this period</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
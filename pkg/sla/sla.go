@@ -0,0 +1,570 @@
+// Package sla keeps a history of downstream health checks and per-endpoint
+// request outcomes and turns it into daily or weekly availability reports
+// with downtime windows and the worst performing endpoints.
+//
+// The history is an append-only JSON lines file so reports survive restarts;
+// entries older than the retention are dropped when the file is compacted.
+// Expired health checks are first rolled up into per-day check counts,
+// which are kept longer for uptime charts.
+package sla
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check is one health probe of a service.
+type Check struct {
+	Service string        `json:"service"`
+	At      time.Time     `json:"at"`
+	Healthy bool          `json:"healthy"`
+	Latency time.Duration `json:"latency_ns"`
+	// Maintenance marks checks made during planned work, which do not
+	// count towards availability.
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// EndpointStats aggregates the requests of one route.
+type EndpointStats struct {
+	Requests        int64   `json:"requests"`
+	Errors          int64   `json:"errors"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// DayUptime counts the health checks of a service on one UTC day.
+// Checks made during maintenance are counted apart.
+type DayUptime struct {
+	Service           string `json:"service"`
+	Date              string `json:"date"`
+	Checks            int    `json:"checks"`
+	HealthyChecks     int    `json:"healthy_checks"`
+	MaintenanceChecks int    `json:"maintenance_checks,omitempty"`
+}
+
+const dateFormat = "2006-01-02"
+
+// entry is a line of the history file: a check, a day of rolled up checks,
+// or an endpoint summary covering [At-interval, At).
+type entry struct {
+	Kind      string                    `json:"kind"`
+	Check     *Check                    `json:"check,omitempty"`
+	Day       *DayUptime                `json:"day,omitempty"`
+	At        time.Time                 `json:"at,omitempty"`
+	Endpoints map[string]*EndpointStats `json:"endpoints,omitempty"`
+}
+
+// Config configures a History.
+type Config struct {
+	// Path is the history file.
+	Path string
+	// Retention is how long entries are kept; 35 days by default so last
+	// month's weekly reports remain available.
+	Retention time.Duration
+	// DailyRetention is how long the per-day check counts are kept; 90
+	// days by default.
+	DailyRetention time.Duration
+	// OnError is called when an entry cannot be written.
+	OnError func(error)
+}
+
+// History records checks and request outcomes.
+type History struct {
+	cfg Config
+
+	mu        sync.Mutex
+	file      *os.File
+	checks    []Check
+	days      map[string]*DayUptime
+	summaries []entry
+	// pending holds request outcomes not yet flushed to the file.
+	pending      map[string]*EndpointStats
+	pendingSince time.Time
+}
+
+// NewHistory loads the history file, dropping expired entries.
+func NewHistory(cfg Config) (*History, error) {
+	if cfg.Retention <= 0 {
+		cfg.Retention = 35 * 24 * time.Hour
+	}
+	if cfg.DailyRetention <= 0 {
+		cfg.DailyRetention = 90 * 24 * time.Hour
+	}
+	h := &History{cfg: cfg, days: make(map[string]*DayUptime), pending: make(map[string]*EndpointStats), pendingSince: time.Now()}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	if err := h.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) load() error {
+	f, err := os.Open(h.cfg.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open sla history: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		switch {
+		case e.Kind == "check" && e.Check != nil:
+			h.checks = append(h.checks, *e.Check)
+		case e.Kind == "day" && e.Day != nil:
+			h.days[e.Day.Service+"/"+e.Day.Date] = e.Day
+		case e.Kind == "endpoints":
+			h.summaries = append(h.summaries, e)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rolls expired checks up into days, drops expired entries and
+// rewrites the file. Callers must hold mu or own h exclusively.
+func (h *History) compact(now time.Time) error {
+	cutoff := now.Add(-h.cfg.Retention)
+	checks := h.checks[:0]
+	for _, c := range h.checks {
+		if !c.At.Before(cutoff) {
+			checks = append(checks, c)
+			continue
+		}
+		key := c.Service + "/" + c.At.UTC().Format(dateFormat)
+		day, ok := h.days[key]
+		if !ok {
+			day = &DayUptime{Service: c.Service, Date: c.At.UTC().Format(dateFormat)}
+			h.days[key] = day
+		}
+		switch {
+		case c.Maintenance:
+			day.MaintenanceChecks++
+		case c.Healthy:
+			day.Checks++
+			day.HealthyChecks++
+		default:
+			day.Checks++
+		}
+	}
+	h.checks = checks
+	dayCutoff := now.Add(-h.cfg.DailyRetention).UTC().Format(dateFormat)
+	var days []*DayUptime
+	for key, day := range h.days {
+		if day.Date < dayCutoff {
+			delete(h.days, key)
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if days[i].Date != days[j].Date {
+			return days[i].Date < days[j].Date
+		}
+		return days[i].Service < days[j].Service
+	})
+	summaries := h.summaries[:0]
+	for _, s := range h.summaries {
+		if !s.At.Before(cutoff) {
+			summaries = append(summaries, s)
+		}
+	}
+	h.summaries = summaries
+
+	tmp := h.cfg.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("compact sla history: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, day := range days {
+		if err := enc.Encode(entry{Kind: "day", Day: day}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for i := range h.checks {
+		if err := enc.Encode(entry{Kind: "check", Check: &h.checks[i]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, s := range h.summaries {
+		if err := enc.Encode(s); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.cfg.Path); err != nil {
+		return err
+	}
+
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file, err = os.OpenFile(h.cfg.Path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (h *History) append(e entry) {
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = h.file.Write(append(line, '\n'))
+	}
+	if err != nil && h.cfg.OnError != nil {
+		h.cfg.OnError(err)
+	}
+}
+
+// RecordCheck stores the result of a health probe.
+func (h *History) RecordCheck(c Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, c)
+	h.append(entry{Kind: "check", Check: &c})
+}
+
+// RecordRequest counts a request to route; status >= 500 is an error.
+func (h *History) RecordRequest(route string, status int, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.pending[route]
+	if !ok {
+		s = &EndpointStats{}
+		h.pending[route] = s
+	}
+	s.Requests++
+	if status >= 500 {
+		s.Errors++
+	}
+	s.DurationSeconds += duration.Seconds()
+}
+
+// Daily returns the health check counts of each service per UTC day, from
+// the day of start to the day of end, sorted by service and date. Days
+// without checks are left out.
+func (h *History) Daily(start, end time.Time) []DayUptime {
+	from, to := start.UTC().Format(dateFormat), end.UTC().Format(dateFormat)
+	counts := make(map[string]*DayUptime)
+	add := func(d DayUptime) {
+		if d.Date < from || d.Date > to {
+			return
+		}
+		day, ok := counts[d.Service+"/"+d.Date]
+		if !ok {
+			day = &DayUptime{Service: d.Service, Date: d.Date}
+			counts[d.Service+"/"+d.Date] = day
+		}
+		day.Checks += d.Checks
+		day.HealthyChecks += d.HealthyChecks
+		day.MaintenanceChecks += d.MaintenanceChecks
+	}
+
+	h.mu.Lock()
+	for _, day := range h.days {
+		add(*day)
+	}
+	for _, c := range h.checks {
+		d := DayUptime{Service: c.Service, Date: c.At.UTC().Format(dateFormat)}
+		switch {
+		case c.Maintenance:
+			d.MaintenanceChecks = 1
+		case c.Healthy:
+			d.Checks, d.HealthyChecks = 1, 1
+		default:
+			d.Checks = 1
+		}
+		add(d)
+	}
+	h.mu.Unlock()
+
+	days := make([]DayUptime, 0, len(counts))
+	for _, day := range counts {
+		days = append(days, *day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if days[i].Service != days[j].Service {
+			return days[i].Service < days[j].Service
+		}
+		return days[i].Date < days[j].Date
+	})
+	return days
+}
+
+// Flush writes the pending request outcomes as one summary entry.
+func (h *History) Flush(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flushLocked(now)
+}
+
+func (h *History) flushLocked(now time.Time) {
+	if len(h.pending) == 0 {
+		h.pendingSince = now
+		return
+	}
+	e := entry{Kind: "endpoints", At: now, Endpoints: h.pending}
+	h.summaries = append(h.summaries, e)
+	h.append(e)
+	h.pending = make(map[string]*EndpointStats)
+	h.pendingSince = now
+}
+
+// Run flushes request outcomes every interval and compacts the file daily
+// until stop is closed, then flushes once more.
+func (h *History) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastCompact := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			h.Flush(time.Now())
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			h.flushLocked(now)
+			if now.Sub(lastCompact) >= 24*time.Hour {
+				if err := h.compact(now); err != nil && h.cfg.OnError != nil {
+					h.cfg.OnError(err)
+				}
+				lastCompact = now
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes pending outcomes and closes the file.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flushLocked(time.Now())
+	return h.file.Close()
+}
+
+// DowntimeWindow is a period in which a service failed its health checks.
+type DowntimeWindow struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Seconds  float64   `json:"seconds"`
+	// Ongoing is set when the service was still down at the end of the
+	// report period.
+	Ongoing bool `json:"ongoing,omitempty"`
+}
+
+// ServiceReport is the availability of one service. Checks made during
+// maintenance are left out of it.
+type ServiceReport struct {
+	Name              string           `json:"name"`
+	Checks            int              `json:"checks"`
+	HealthyChecks     int              `json:"healthy_checks"`
+	MaintenanceChecks int              `json:"maintenance_checks,omitempty"`
+	Availability      float64          `json:"availability_percent"`
+	MeetsTarget       bool             `json:"meets_target"`
+	AvgLatencyMs      float64          `json:"avg_check_latency_ms"`
+	Downtime          string           `json:"downtime"`
+	DowntimeSecs      float64          `json:"downtime_seconds"`
+	Windows           []DowntimeWindow `json:"downtime_windows"`
+}
+
+// EndpointReport ranks an endpoint by server error rate.
+type EndpointReport struct {
+	Route        string  `json:"route"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate_percent"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// Report is an SLA report for one period.
+type Report struct {
+	Period       string           `json:"period"`
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+	GeneratedAt  time.Time        `json:"generated_at"`
+	Target       float64          `json:"target_percent"`
+	Availability float64          `json:"availability_percent"`
+	MeetsTarget  bool             `json:"meets_target"`
+	Services     []ServiceReport  `json:"services"`
+	Worst        []EndpointReport `json:"worst_endpoints"`
+}
+
+// ReportOptions configures Report.
+type ReportOptions struct {
+	// Target is the availability objective in percent, e.g. 99.9.
+	Target float64
+	// WorstEndpoints is how many endpoints to list.
+	WorstEndpoints int
+	// MinRequests excludes endpoints with too little traffic to rank.
+	MinRequests int64
+}
+
+// Report builds the report for [start, end). Services with no checks in the
+// period are omitted; overall availability is the lowest service
+// availability, since a request may need every service.
+func (h *History) Report(period string, start, end time.Time, opts ReportOptions) Report {
+	now := time.Now()
+	if end.After(now) {
+		end = now
+	}
+
+	h.mu.Lock()
+	byService := make(map[string][]Check)
+	for _, c := range h.checks {
+		if !c.At.Before(start) && c.At.Before(end) {
+			byService[c.Service] = append(byService[c.Service], c)
+		}
+	}
+	endpoints := make(map[string]*EndpointStats)
+	add := func(stats map[string]*EndpointStats) {
+		for route, s := range stats {
+			total, ok := endpoints[route]
+			if !ok {
+				total = &EndpointStats{}
+				endpoints[route] = total
+			}
+			total.Requests += s.Requests
+			total.Errors += s.Errors
+			total.DurationSeconds += s.DurationSeconds
+		}
+	}
+	for _, s := range h.summaries {
+		if s.At.After(start) && !s.At.After(end) {
+			add(s.Endpoints)
+		}
+	}
+	if h.pendingSince.Before(end) && now.After(start) {
+		add(h.pending)
+	}
+	h.mu.Unlock()
+
+	r := Report{
+		Period:       period,
+		Start:        start.UTC(),
+		End:          end.UTC(),
+		GeneratedAt:  now.UTC(),
+		Target:       opts.Target,
+		Availability: 100,
+		Services:     []ServiceReport{},
+		Worst:        []EndpointReport{},
+	}
+
+	names := make([]string, 0, len(byService))
+	for name := range byService {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sr := serviceReport(name, byService[name], end, opts.Target)
+		if sr.Availability < r.Availability {
+			r.Availability = sr.Availability
+		}
+		r.Services = append(r.Services, sr)
+	}
+	r.MeetsTarget = r.Availability >= opts.Target
+
+	for route, s := range endpoints {
+		if s.Requests == 0 || s.Requests < opts.MinRequests {
+			continue
+		}
+		r.Worst = append(r.Worst, EndpointReport{
+			Route:        route,
+			Requests:     s.Requests,
+			Errors:       s.Errors,
+			ErrorRate:    100 * float64(s.Errors) / float64(s.Requests),
+			AvgLatencyMs: 1000 * s.DurationSeconds / float64(s.Requests),
+		})
+	}
+	sort.Slice(r.Worst, func(i, j int) bool {
+		if r.Worst[i].ErrorRate != r.Worst[j].ErrorRate {
+			return r.Worst[i].ErrorRate > r.Worst[j].ErrorRate
+		}
+		return r.Worst[i].AvgLatencyMs > r.Worst[j].AvgLatencyMs
+	})
+	if opts.WorstEndpoints > 0 && len(r.Worst) > opts.WorstEndpoints {
+		r.Worst = r.Worst[:opts.WorstEndpoints]
+	}
+	return r
+}
+
+// serviceReport computes availability from checks sorted by time. A downtime
+// window runs from the first failed check to the next successful one, or to
+// the start of maintenance. A service checked only during maintenance is
+// fully available.
+func serviceReport(name string, checks []Check, end time.Time, target float64) ServiceReport {
+	sort.Slice(checks, func(i, j int) bool { return checks[i].At.Before(checks[j].At) })
+
+	sr := ServiceReport{Name: name, Windows: []DowntimeWindow{}, Availability: 100}
+	var latency time.Duration
+	var downSince *time.Time
+	closeWindow := func(until time.Time, ongoing bool) {
+		seconds := until.Sub(*downSince).Seconds()
+		sr.Windows = append(sr.Windows, DowntimeWindow{
+			Start:    downSince.UTC(),
+			End:      until.UTC(),
+			Duration: until.Sub(*downSince).Round(time.Second).String(),
+			Seconds:  seconds,
+			Ongoing:  ongoing,
+		})
+		sr.DowntimeSecs += seconds
+		downSince = nil
+	}
+
+	for i := range checks {
+		c := checks[i]
+		if c.Maintenance {
+			sr.MaintenanceChecks++
+			if downSince != nil {
+				closeWindow(c.At, false)
+			}
+			continue
+		}
+		sr.Checks++
+		latency += c.Latency
+		if c.Healthy {
+			sr.HealthyChecks++
+			if downSince != nil {
+				closeWindow(c.At, false)
+			}
+		} else if downSince == nil {
+			downSince = &checks[i].At
+		}
+	}
+	if downSince != nil {
+		closeWindow(end, true)
+	}
+
+	if sr.Checks > 0 {
+		sr.Availability = 100 * float64(sr.HealthyChecks) / float64(sr.Checks)
+		sr.AvgLatencyMs = float64(latency.Milliseconds()) / float64(sr.Checks)
+	}
+	sr.MeetsTarget = sr.Availability >= target
+	sr.Downtime = (time.Duration(sr.DowntimeSecs) * time.Second).String()
+	return sr
+}
@@ -0,0 +1,318 @@
+// Package syslog reads syslog messages as sent over TCP by rsyslog,
+// syslog-ng, Fluent Bit and most network devices: RFC 5424 and the older
+// BSD format of RFC 3164, framed by octet counting or newlines (RFC 6587).
+package syslog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTooLong is returned by Reader.Next for a message over the size limit.
+// The message is skipped, so reading can go on.
+var ErrTooLong = errors.New("syslog: message too long")
+
+// Reader splits a TCP stream into messages.
+type Reader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+// NewReader reads messages of up to maxSize bytes from r.
+func NewReader(r io.Reader, maxSize int) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024), maxSize: maxSize}
+}
+
+// Next returns the next message, without its framing. A message starting
+// with a digit is taken to be octet-counted ("<length> <message>"), anything
+// else runs to the end of the line.
+func (r *Reader) Next() ([]byte, error) {
+	for {
+		first, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] >= '0' && first[0] <= '9' {
+			return r.octetCounted()
+		}
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func (r *Reader) octetCounted() ([]byte, error) {
+	digits, err := r.r.ReadSlice(' ')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errors.New("syslog: malformed octet count")
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(digits[:len(digits)-1]))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("syslog: malformed octet count %q", digits[:len(digits)-1])
+	}
+	if n > r.maxSize {
+		if _, err := r.r.Discard(n); err != nil {
+			return nil, err
+		}
+		return nil, ErrTooLong
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r.r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// line reads up to the next newline, dropping it and any carriage return
+// before it. A line cut off by the end of the stream is still returned.
+func (r *Reader) line() ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(line)+len(chunk) > r.maxSize+2 {
+			tooLong = true
+			line = line[:0]
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0 && !tooLong) {
+			return nil, err
+		}
+		break
+	}
+	if tooLong {
+		return nil, ErrTooLong
+	}
+	line = []byte(strings.TrimRight(string(line), "\r\n"))
+	if len(line) > r.maxSize {
+		return nil, ErrTooLong
+	}
+	return line, nil
+}
+
+// Message is a parsed syslog message. Fields the sender left out are empty.
+type Message struct {
+	// Format is "rfc5424" or "rfc3164".
+	Format   string
+	Facility int
+	Severity int
+	// Timestamp is zero when the message has none.
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData holds the RFC 5424 SD-PARAMs by SD-ID and name.
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+// Messages without a priority are user.notice, as RFC 3164 prescribes.
+const (
+	defaultFacility = 1
+	defaultSeverity = 5
+)
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// FacilityName is the keyword of facility, e.g. "local0".
+func FacilityName(facility int) string {
+	if facility >= 0 && facility < len(facilityNames) {
+		return facilityNames[facility]
+	}
+	return strconv.Itoa(facility)
+}
+
+// SeverityName is the keyword of severity, e.g. "warning".
+func SeverityName(severity int) string {
+	if severity >= 0 && severity < len(severityNames) {
+		return severityNames[severity]
+	}
+	return strconv.Itoa(severity)
+}
+
+// Parse parses an RFC 5424 message, falling back to RFC 3164. The BSD format
+// was never strict, so Parse takes what it can recognise and leaves the rest
+// in Message; only an RFC 5424 message with malformed structured data fails.
+// now supplies the year of RFC 3164 timestamps.
+func Parse(b []byte, now time.Time) (Message, error) {
+	// Octet-counted senders often include the newline too.
+	s := strings.TrimRight(string(b), "\r\n")
+	m := Message{Facility: defaultFacility, Severity: defaultSeverity}
+	if pri, rest, ok := parsePriority(s); ok {
+		m.Facility, m.Severity = pri/8, pri%8
+		s = rest
+	}
+	if strings.HasPrefix(s, "1 ") {
+		return parse5424(m, s[2:])
+	}
+	return parse3164(m, s, now), nil
+}
+
+// parsePriority reads "<PRI>".
+func parsePriority(s string) (int, string, bool) {
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return 0, s, false
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, s, false
+	}
+	return pri, s[end+1:], true
+}
+
+func parse5424(m Message, s string) (Message, error) {
+	m.Format = "rfc5424"
+	fields := make([]string, 5)
+	for i := range fields {
+		var ok bool
+		fields[i], s, ok = strings.Cut(s, " ")
+		if !ok && i < len(fields)-1 {
+			return m, errors.New("syslog: truncated RFC 5424 header")
+		}
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+	if fields[0] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return m, fmt.Errorf("syslog: malformed timestamp %q", fields[0])
+		}
+		m.Timestamp = ts
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[1], fields[2], fields[3], fields[4]
+
+	switch {
+	case s == "" || s == "-":
+		s = ""
+	case strings.HasPrefix(s, "- "):
+		s = s[2:]
+	case strings.HasPrefix(s, "["):
+		var err error
+		if m.StructuredData, s, err = parseStructuredData(s); err != nil {
+			return m, err
+		}
+		s = strings.TrimPrefix(s, " ")
+	default:
+		return m, errors.New("syslog: malformed structured data")
+	}
+	m.Message = strings.TrimPrefix(s, "\ufeff")
+	return m, nil
+}
+
+// parseStructuredData reads SD-ELEMENTs: [id name="value" ...]... Values
+// escape '"', '\' and ']' with a backslash.
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	errMalformed := errors.New("syslog: malformed structured data")
+	sd := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			return nil, "", errMalformed
+		}
+		params := make(map[string]string)
+		sd[s[:end]] = params
+		s = s[end:]
+		for strings.HasPrefix(s, " ") {
+			eq := strings.Index(s, `="`)
+			if eq < 2 {
+				return nil, "", errMalformed
+			}
+			name := s[1:eq]
+			s = s[eq+2:]
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				switch c := s[i]; {
+				case c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0:
+					i++
+					value.WriteByte(s[i])
+				case c == '"':
+					s, closed = s[i+1:], true
+				default:
+					value.WriteByte(c)
+				}
+				if closed {
+					break
+				}
+			}
+			if !closed {
+				return nil, "", errMalformed
+			}
+			params[name] = value.String()
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", errMalformed
+		}
+		s = s[1:]
+	}
+	return sd, s, nil
+}
+
+// parse3164 reads "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", also accepting
+// an RFC 3339 timestamp as rsyslog sends by default.
+func parse3164(m Message, s string, now time.Time) Message {
+	m.Format = "rfc3164"
+	if len(s) >= 16 && s[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:15], now.Location()); err == nil {
+			m.Timestamp = ts.AddDate(now.Year(), 0, 0)
+			// A December message read in January is from last year.
+			if m.Timestamp.After(now.AddDate(0, 0, 1)) {
+				m.Timestamp = m.Timestamp.AddDate(-1, 0, 0)
+			}
+			s = s[16:]
+		}
+	}
+	if m.Timestamp.IsZero() {
+		if word, rest, ok := strings.Cut(s, " "); ok {
+			if ts, err := time.Parse(time.RFC3339Nano, word); err == nil {
+				m.Timestamp, s = ts, rest
+			}
+		}
+	}
+
+	// The hostname is missing when the next word is already the tag.
+	if word, rest, ok := strings.Cut(s, " "); ok && !m.Timestamp.IsZero() && !isTag(word) {
+		m.Hostname, s = word, rest
+	}
+	if word, rest, ok := strings.Cut(s, " "); ok && isTag(word) {
+		tag := strings.TrimSuffix(word, ":")
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		m.AppName, s = tag, rest
+	}
+	m.Message = s
+	return m
+}
+
+// isTag reports whether word is a TAG such as "sshd[42]:" or "cron:".
+func isTag(word string) bool {
+	return len(word) > 1 && len(word) <= 64 && strings.HasSuffix(word, ":")
+}
@@ -0,0 +1,151 @@
+package syslog
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderFraming(t *testing.T) {
+	stream := "12 <13>1 - - -\n" + // octet-counted, with the sender's newline inside the count
+		"<13>Jan  2 03:04:05 host app: plain line\r\n" +
+		"\n" +
+		"5 hello" +
+		"60 " + strings.Repeat("x", 60) + // over the limit
+		strings.Repeat("y", 60) + "\n" + // over the limit too
+		"<13>cut off by EOF"
+	r := NewReader(strings.NewReader(stream), 48)
+
+	want := []struct {
+		msg string
+		err error
+	}{
+		{"<13>1 - - -\n", nil},
+		{"<13>Jan  2 03:04:05 host app: plain line", nil},
+		{"hello", nil},
+		{"", ErrTooLong},
+		{"", ErrTooLong},
+		{"<13>cut off by EOF", nil},
+		{"", io.EOF},
+	}
+	for i, w := range want {
+		msg, err := r.Next()
+		if string(msg) != w.msg || !errors.Is(err, w.err) {
+			t.Fatalf("message %d = %q, %v; want %q, %v", i, msg, err, w.msg, w.err)
+		}
+	}
+}
+
+func TestReaderRejectsBadOctetCount(t *testing.T) {
+	for _, stream := range []string{"12x <13>hi", "99999999999999999999 x"} {
+		if _, err := NewReader(strings.NewReader(stream), 1024).Next(); err == nil || err == io.EOF {
+			t.Errorf("%q: err %v", stream, err)
+		}
+	}
+	r := NewReader(strings.NewReader("10 short"), 1024)
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: %v", err)
+	}
+}
+
+func TestParse5424(t *testing.T) {
+	in := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Application" note="a \"quoted\] \\ value"][origin ip="192.0.2.1"]` + " \ufeffAn application event\n"
+	m, err := Parse([]byte(in), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Message{
+		Format:    "rfc5424",
+		Facility:  20,
+		Severity:  5,
+		Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		Hostname:  "mymachine.example.com",
+		AppName:   "evntslog",
+		ProcID:    "1234",
+		MsgID:     "ID47",
+		StructuredData: map[string]map[string]string{
+			"exampleSDID@32473": {"iut": "3", "eventSource": "Application", "note": `a "quoted] \ value`},
+			"origin":            {"ip": "192.0.2.1"},
+		},
+		Message: "An application event",
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Parse = %+v\nwant    %+v", m, want)
+	}
+	if FacilityName(m.Facility) != "local4" || SeverityName(m.Severity) != "notice" {
+		t.Errorf("names %s.%s", FacilityName(m.Facility), SeverityName(m.Severity))
+	}
+
+	m, err = Parse([]byte("<34>1 - - - - - -"), time.Now())
+	if err != nil || m.Hostname != "" || !m.Timestamp.IsZero() || m.StructuredData != nil || m.Message != "" {
+		t.Errorf("nil values: %+v, %v", m, err)
+	}
+	m, err = Parse([]byte("<34>1 - host app - - - body"), time.Now())
+	if err != nil || m.Hostname != "host" || m.Message != "body" {
+		t.Errorf("no structured data: %+v, %v", m, err)
+	}
+}
+
+func TestParse5424Errors(t *testing.T) {
+	for _, in := range []string{
+		"<34>1 - host app",
+		"<34>1 yesterday host app - - - msg",
+		"<34>1 - host app - - junk",
+		`<34>1 - host app - - [id key="unterminated]`,
+		`<34>1 - host app - - [id key=unquoted]`,
+		`<34>1 - host app - - [id key="v"`,
+	} {
+		if _, err := Parse([]byte(in), time.Now()); err == nil {
+			t.Errorf("%q was accepted", in)
+		}
+	}
+}
+
+func TestParse3164(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		in   string
+		want Message
+	}{
+		{"<38>Jun 15 11:59:01 gw sshd[4242]: Accepted publickey for ops", Message{
+			Facility: 4, Severity: 6, Timestamp: time.Date(2024, 6, 15, 11, 59, 1, 0, time.UTC),
+			Hostname: "gw", AppName: "sshd", ProcID: "4242", Message: "Accepted publickey for ops",
+		}},
+		// Without a hostname the tag follows the timestamp.
+		{"<78>Jun  5 01:00:00 cron: job started", Message{
+			Facility: 9, Severity: 6, Timestamp: time.Date(2024, 6, 5, 1, 0, 0, 0, time.UTC),
+			AppName: "cron", Message: "job started",
+		}},
+		// A December message read in June is from this year, but one dated
+		// after tomorrow is from last year.
+		{"<13>Dec 31 23:59:59 host app: late", Message{
+			Facility: 1, Severity: 5, Timestamp: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+			Hostname: "host", AppName: "app", Message: "late",
+		}},
+		{"<13>2024-06-15T11:00:00.5+02:00 host app: rsyslog default", Message{
+			Facility: 1, Severity: 5, Timestamp: time.Date(2024, 6, 15, 11, 0, 0, 500000000, time.FixedZone("", 2*3600)),
+			Hostname: "host", AppName: "app", Message: "rsyslog default",
+		}},
+		// No priority: user.notice, and what cannot be recognised is kept.
+		{"free text from a device", Message{Facility: 1, Severity: 5, Message: "free text from a device"}},
+		{"<999>not a priority", Message{Facility: 1, Severity: 5, Message: "<999>not a priority"}},
+	}
+	for _, tc := range cases {
+		m, err := Parse([]byte(tc.in), now)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		tc.want.Format = "rfc3164"
+		if !m.Timestamp.Equal(tc.want.Timestamp) {
+			t.Errorf("%q: timestamp %v, want %v", tc.in, m.Timestamp, tc.want.Timestamp)
+		}
+		m.Timestamp, tc.want.Timestamp = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(m, tc.want) {
+			t.Errorf("%q: %+v\nwant %+v", tc.in, m, tc.want)
+		}
+	}
+}
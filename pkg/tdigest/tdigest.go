@@ -0,0 +1,173 @@
+// Package tdigest estimates quantiles of a stream in bounded space with a
+// merging t-digest (Dunning & Ertl). Values are kept as weighted centroids
+// that are small near the tails and large near the median, so extreme
+// quantiles such as p99 stay accurate. Digests merge, and encode as JSON,
+// which lets a digest per hour be stored and combined into any window.
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// Centroid is the mean of Weight values.
+type Centroid struct {
+	Mean   float64 `json:"m"`
+	Weight float64 `json:"w"`
+}
+
+// Digest is a t-digest. Its exported fields are its encoding; it is not
+// safe for concurrent use.
+type Digest struct {
+	// Compression bounds the number of centroids to about
+	// Compression/2 after compression; 100 gives quantiles within a
+	// fraction of a percent.
+	Compression float64    `json:"compression"`
+	Centroids   []Centroid `json:"centroids"`
+	Count       float64    `json:"count"`
+	Sum         float64    `json:"sum"`
+	Min         float64    `json:"min"`
+	Max         float64    `json:"max"`
+
+	unmerged []Centroid
+}
+
+// New returns an empty digest. compression defaults to 100 when not
+// positive.
+func New(compression float64) *Digest {
+	if compression <= 0 {
+		compression = 100
+	}
+	return &Digest{Compression: compression}
+}
+
+// Add adds one value. NaN is ignored.
+func (d *Digest) Add(x float64) {
+	if math.IsNaN(x) {
+		return
+	}
+	d.extend(x, x)
+	d.add(Centroid{Mean: x, Weight: 1})
+}
+
+// Merge adds the values of o to d.
+func (d *Digest) Merge(o *Digest) {
+	if o.Count == 0 {
+		return
+	}
+	d.extend(o.Min, o.Max)
+	for _, c := range o.Centroids {
+		d.add(c)
+	}
+	for _, c := range o.unmerged {
+		d.add(c)
+	}
+}
+
+func (d *Digest) extend(min, max float64) {
+	if d.Count == 0 || min < d.Min {
+		d.Min = min
+	}
+	if d.Count == 0 || max > d.Max {
+		d.Max = max
+	}
+}
+
+func (d *Digest) add(c Centroid) {
+	d.Count += c.Weight
+	d.Sum += c.Mean * c.Weight
+	d.unmerged = append(d.unmerged, c)
+	if len(d.unmerged) > int(d.Compression)*4 {
+		d.Compact()
+	}
+}
+
+// k is the k1 scale function, mapping a quantile to the index space in
+// which every centroid spans at most one unit.
+func (d *Digest) k(q float64) float64 {
+	return d.Compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (d *Digest) kInverse(k float64) float64 {
+	if k >= d.Compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/d.Compression) + 1) / 2
+}
+
+// Compact merges the buffered values into the centroids, as it must be
+// before d is encoded.
+func (d *Digest) Compact() {
+	if len(d.unmerged) == 0 {
+		return
+	}
+	all := append(d.Centroids, d.unmerged...)
+	d.unmerged = nil
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+
+	merged := make([]Centroid, 0, int(d.Compression))
+	current := all[0]
+	weightSoFar := 0.0
+	limit := d.Count * d.kInverse(d.k(0)+1)
+	for _, c := range all[1:] {
+		if weightSoFar+current.Weight+c.Weight <= limit {
+			current.Weight += c.Weight
+			current.Mean += (c.Mean - current.Mean) * c.Weight / current.Weight
+			continue
+		}
+		weightSoFar += current.Weight
+		merged = append(merged, current)
+		limit = d.Count * d.kInverse(d.k(weightSoFar/d.Count)+1)
+		current = c
+	}
+	d.Centroids = append(merged, current)
+}
+
+// Quantile estimates the q-th quantile, q in [0, 1]. It is NaN for an
+// empty digest.
+func (d *Digest) Quantile(q float64) float64 {
+	d.Compact()
+	if d.Count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.Min
+	}
+	if q >= 1 {
+		return d.Max
+	}
+	cs := d.Centroids
+	if len(cs) == 1 {
+		return cs[0].Mean
+	}
+
+	// Each centroid's mean sits at the middle of the weight it covers;
+	// quantiles in between are interpolated, and the halves outside the
+	// first and last centroids reach to the observed min and max.
+	target := q * d.Count
+	if first := cs[0].Weight / 2; target < first {
+		return interpolate(d.Min, cs[0].Mean, target/first)
+	}
+	cumulative := cs[0].Weight / 2
+	for i := 0; i < len(cs)-1; i++ {
+		step := (cs[i].Weight + cs[i+1].Weight) / 2
+		if target < cumulative+step {
+			return interpolate(cs[i].Mean, cs[i+1].Mean, (target-cumulative)/step)
+		}
+		cumulative += step
+	}
+	last := cs[len(cs)-1]
+	return interpolate(last.Mean, d.Max, math.Min((target-cumulative)/(last.Weight/2), 1))
+}
+
+// Mean is the mean of the values added.
+func (d *Digest) Mean() float64 {
+	if d.Count == 0 {
+		return math.NaN()
+	}
+	return d.Sum / d.Count
+}
+
+func interpolate(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
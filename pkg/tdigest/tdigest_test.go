@@ -0,0 +1,129 @@
+package tdigest
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// rankError is how far the rank of estimate in sorted is from q.
+func rankError(sorted []float64, q, estimate float64) float64 {
+	rank := float64(sort.SearchFloat64s(sorted, estimate)) / float64(len(sorted))
+	return math.Abs(rank - q)
+}
+
+func TestQuantileAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	sources := map[string]func() float64{
+		"uniform":     rng.Float64,
+		"exponential": rng.ExpFloat64,
+		// Latencies: mostly fast, with a slow tail two orders of magnitude out.
+		"bimodal": func() float64 {
+			if rng.Float64() < 0.02 {
+				return 500 + rng.NormFloat64()*50
+			}
+			return 5 + rng.NormFloat64()
+		},
+	}
+	for name, next := range sources {
+		d := New(100)
+		values := make([]float64, 100000)
+		for i := range values {
+			values[i] = next()
+			d.Add(values[i])
+		}
+		sort.Float64s(values)
+
+		for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+			// The k1 scale keeps tail centroids small, so the tails are
+			// tighter than the median.
+			tolerance := 0.01
+			if q < 0.05 || q > 0.95 {
+				tolerance = 0.002
+			}
+			if err := rankError(values, q, d.Quantile(q)); err > tolerance {
+				t.Errorf("%s: p%g off by %.4f in rank", name, q*100, err)
+			}
+		}
+		if d.Quantile(0) != values[0] || d.Quantile(1) != values[len(values)-1] {
+			t.Errorf("%s: extremes %g and %g, want %g and %g", name, d.Quantile(0), d.Quantile(1), values[0], values[len(values)-1])
+		}
+		if n := len(d.Centroids); n > 100 {
+			t.Errorf("%s: %d centroids for compression 100", name, n)
+		}
+	}
+}
+
+func TestMergeMatchesSingleDigest(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	whole := New(100)
+	var values []float64
+	// Hourly digests of shifting distributions, merged into a day.
+	var day *Digest
+	for hour := 0; hour < 24; hour++ {
+		h := New(100)
+		for i := 0; i < 2000; i++ {
+			v := rng.ExpFloat64() * float64(hour+1)
+			h.Add(v)
+			whole.Add(v)
+			values = append(values, v)
+		}
+		// Stored hourly digests are compacted and go through JSON.
+		h.Compact()
+		b, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stored Digest
+		if err := json.Unmarshal(b, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if day == nil {
+			day = New(stored.Compression)
+		}
+		day.Merge(&stored)
+	}
+	sort.Float64s(values)
+
+	if day.Count != whole.Count || math.Abs(day.Mean()-whole.Mean()) > 1e-9*whole.Mean() {
+		t.Errorf("merged count %g mean %g, want %g and %g", day.Count, day.Mean(), whole.Count, whole.Mean())
+	}
+	if day.Min != values[0] || day.Max != values[len(values)-1] {
+		t.Errorf("merged min %g max %g", day.Min, day.Max)
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99} {
+		if err := rankError(values, q, day.Quantile(q)); err > 0.01 {
+			t.Errorf("merged p%g off by %.4f in rank", q*100, err)
+		}
+	}
+}
+
+func TestSmallDigests(t *testing.T) {
+	d := New(0)
+	if d.Compression != 100 {
+		t.Errorf("default compression %g", d.Compression)
+	}
+	if !math.IsNaN(d.Quantile(0.5)) || !math.IsNaN(d.Mean()) {
+		t.Error("empty digest should give NaN")
+	}
+	d.Merge(New(100))
+	if d.Count != 0 {
+		t.Error("merging an empty digest added values")
+	}
+
+	d.Add(math.NaN())
+	d.Add(42)
+	if d.Count != 1 || d.Quantile(0.5) != 42 || d.Quantile(0.99) != 42 {
+		t.Errorf("one value: count %g, median %g", d.Count, d.Quantile(0.5))
+	}
+	d.Add(10)
+	d.Add(20)
+	if got := d.Quantile(0.5); got != 20 {
+		t.Errorf("median of 10, 20, 42 = %g", got)
+	}
+	if got := d.Mean(); got != 24 {
+		t.Errorf("mean = %g", got)
+	}
+}
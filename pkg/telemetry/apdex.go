@@ -0,0 +1,86 @@
+package telemetry
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Apdex zones as defined by the Apdex specification: satisfied requests finish
+// within T, tolerating within 4T, everything slower (or failing) frustrates.
+const (
+	ApdexSatisfied  = "satisfied"
+	ApdexTolerating = "tolerating"
+	ApdexFrustrated = "frustrated"
+)
+
+// Apdex classifies requests per route into Apdex zones so the score can be
+// computed with a plain rate() ratio:
+//
+//	(satisfied + tolerating/2) / total
+type Apdex struct {
+	threshold time.Duration
+	routes    map[string]time.Duration
+	requests  *prometheus.CounterVec
+	targets   *prometheus.GaugeVec
+}
+
+// NewApdex registers <prefix>_apdex_requests_total{route,zone} and
+// <prefix>_apdex_threshold_seconds{route}. Routes without an override use the
+// default threshold.
+func NewApdex(prefix string, threshold time.Duration, routes map[string]time.Duration) *Apdex {
+	if threshold <= 0 {
+		threshold = 250 * time.Millisecond
+	}
+
+	a := &Apdex{
+		threshold: threshold,
+		routes:    routes,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: prefix + "_apdex_requests_total",
+				Help: "Requests per route classified into Apdex zones",
+			},
+			[]string{"route", "zone"},
+		),
+		targets: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: prefix + "_apdex_threshold_seconds",
+				Help: "Apdex satisfied threshold (T) per route",
+			},
+			[]string{"route"},
+		),
+	}
+	prometheus.MustRegister(a.requests, a.targets)
+
+	a.targets.WithLabelValues("default").Set(threshold.Seconds())
+	for route, t := range routes {
+		a.targets.WithLabelValues(route).Set(t.Seconds())
+	}
+	return a
+}
+
+// Observe classifies a single request. Server errors are always frustrated.
+func (a *Apdex) Observe(route string, duration time.Duration, statusCode int) {
+	a.requests.WithLabelValues(route, a.zone(route, duration, statusCode)).Inc()
+}
+
+func (a *Apdex) zone(route string, duration time.Duration, statusCode int) string {
+	if statusCode >= 500 {
+		return ApdexFrustrated
+	}
+
+	t := a.threshold
+	if override, ok := a.routes[route]; ok && override > 0 {
+		t = override
+	}
+
+	switch {
+	case duration <= t:
+		return ApdexSatisfied
+	case duration <= 4*t:
+		return ApdexTolerating
+	default:
+		return ApdexFrustrated
+	}
+}
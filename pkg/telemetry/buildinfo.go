@@ -0,0 +1,41 @@
+package telemetry
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterBuildInfo registers the service_build_info gauge, which is always 1
+// and carries the deployed version as labels.
+func RegisterBuildInfo(version, commit string) {
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_build_info",
+			Help: "Build information of the running service (always 1)",
+		},
+		[]string{"version", "commit", "go_version"},
+	)
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+}
+
+// RegisterFeatureFlags registers service_feature_enabled with one series per
+// feature (1=enabled, 0=disabled).
+func RegisterFeatureFlags(features map[string]bool) {
+	featureEnabled := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_feature_enabled",
+			Help: "Whether an optional feature is enabled (1=enabled, 0=disabled)",
+		},
+		[]string{"feature"},
+	)
+	prometheus.MustRegister(featureEnabled)
+	for feature, enabled := range features {
+		value := float64(0)
+		if enabled {
+			value = 1
+		}
+		featureEnabled.WithLabelValues(feature).Set(value)
+	}
+}
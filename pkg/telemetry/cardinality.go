@@ -0,0 +1,124 @@
+package telemetry
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowLabelValue replaces every label value once a metric has reached its
+// cardinality limit.
+const OverflowLabelValue = "other"
+
+var (
+	cardinalityMu         sync.RWMutex
+	cardinalityLimit      = 1000
+	cardinalityOnOverflow func(metric string, labelValues []string)
+
+	cardinalityOverflows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metric_cardinality_overflow_total",
+			Help: "Observations collapsed into the overflow series because the metric hit its label limit",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cardinalityOverflows)
+}
+
+// ConfigureCardinality sets the per-metric limit of unique label combinations
+// for all limited vectors. onOverflow is called the first time a metric
+// overflows, typically to log a warning. A limit <= 0 disables the guard.
+func ConfigureCardinality(limit int, onOverflow func(metric string, labelValues []string)) {
+	cardinalityMu.Lock()
+	defer cardinalityMu.Unlock()
+
+	cardinalityLimit = limit
+	cardinalityOnOverflow = onOverflow
+}
+
+// labelLimiter tracks the label combinations admitted for one metric.
+type labelLimiter struct {
+	metric string
+
+	mu       sync.Mutex
+	seen     map[string]struct{}
+	warned   bool
+	overflow []string
+}
+
+func newLabelLimiter(metric string, labelCount int) *labelLimiter {
+	overflow := make([]string, labelCount)
+	for i := range overflow {
+		overflow[i] = OverflowLabelValue
+	}
+	return &labelLimiter{metric: metric, seen: make(map[string]struct{}), overflow: overflow}
+}
+
+// admit returns lvs if the combination is known or still fits under the
+// limit, and the overflow label values otherwise.
+func (l *labelLimiter) admit(lvs []string) []string {
+	cardinalityMu.RLock()
+	limit, onOverflow := cardinalityLimit, cardinalityOnOverflow
+	cardinalityMu.RUnlock()
+
+	if limit <= 0 {
+		return lvs
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	l.mu.Lock()
+	if _, ok := l.seen[key]; ok || len(l.seen) < limit {
+		l.seen[key] = struct{}{}
+		l.mu.Unlock()
+		return lvs
+	}
+	firstOverflow := !l.warned
+	l.warned = true
+	l.mu.Unlock()
+
+	cardinalityOverflows.WithLabelValues(l.metric).Inc()
+	if firstOverflow && onOverflow != nil {
+		onOverflow(l.metric, lvs)
+	}
+	return l.overflow
+}
+
+// LimitedCounterVec is a CounterVec whose WithLabelValues is guarded by the
+// cardinality limit. It registers like the embedded CounterVec.
+type LimitedCounterVec struct {
+	*prometheus.CounterVec
+	limiter *labelLimiter
+}
+
+func NewLimitedCounterVec(opts prometheus.CounterOpts, labelNames []string) *LimitedCounterVec {
+	return &LimitedCounterVec{
+		CounterVec: prometheus.NewCounterVec(opts, labelNames),
+		limiter:    newLabelLimiter(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), len(labelNames)),
+	}
+}
+
+func (v *LimitedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	return v.CounterVec.WithLabelValues(v.limiter.admit(lvs)...)
+}
+
+// LimitedHistogramVec is the HistogramVec counterpart of LimitedCounterVec.
+type LimitedHistogramVec struct {
+	*prometheus.HistogramVec
+	limiter *labelLimiter
+}
+
+func NewLimitedHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *LimitedHistogramVec {
+	return &LimitedHistogramVec{
+		HistogramVec: prometheus.NewHistogramVec(opts, labelNames),
+		limiter:      newLabelLimiter(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), len(labelNames)),
+	}
+}
+
+func (v *LimitedHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.HistogramVec.WithLabelValues(v.limiter.admit(lvs)...)
+}
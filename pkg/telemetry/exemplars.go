@@ -0,0 +1,53 @@
+package telemetry
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TraceIDHeader carries the trace ID of clients that do not send traceparent.
+const TraceIDHeader = "X-Trace-ID"
+
+// TraceID extracts the trace ID from a W3C traceparent header, falling back
+// to X-Trace-ID. It returns "" when the request is not traced or the ID is not
+// a valid W3C trace ID, so clients cannot put arbitrary strings into exemplars
+// or stored records.
+func TraceID(r *http.Request) string {
+	if tp := r.Header.Get("traceparent"); tp != "" {
+		parts := strings.Split(tp, "-")
+		if len(parts) == 4 && ValidTraceID(parts[1]) {
+			return parts[1]
+		}
+	}
+	if id := strings.ToLower(strings.TrimSpace(r.Header.Get(TraceIDHeader))); ValidTraceID(id) {
+		return id
+	}
+	return ""
+}
+
+// ValidTraceID reports whether id is a W3C trace ID: 32 lowercase hex digits,
+// not all zero.
+func ValidTraceID(id string) bool {
+	if len(id) != 32 || id == strings.Repeat("0", 32) {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ObserveWithExemplar records a histogram observation, attaching the trace ID
+// as an exemplar when one is available.
+func ObserveWithExemplar(observer prometheus.Observer, value float64, traceID string) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(value, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(value)
+}
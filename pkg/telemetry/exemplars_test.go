@@ -0,0 +1,60 @@
+package telemetry
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTraceID(t *testing.T) {
+	const id = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceparent string
+		xTraceID    string
+		want        string
+	}{
+		{"traceparent", "00-" + id + "-00f067aa0ba902b7-01", "", id},
+		{"traceparent wins", "00-" + id + "-00f067aa0ba902b7-01", "0af7651916cd43dd8448eb211c80319c", id},
+		{"invalid traceparent falls back", "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01", "0af7651916cd43dd8448eb211c80319c", "0af7651916cd43dd8448eb211c80319c"},
+		{"X-Trace-ID is lowercased", "", strings.ToUpper(id), id},
+		{"not hex", "", strings.Repeat("z", 32), ""},
+		{"too long", "", strings.Repeat("a", 200), ""},
+		{"invalid UTF-8", "", "\xff\xfe" + id[2:], ""},
+		{"uppercase traceparent", "00-" + strings.ToUpper(id) + "-00f067aa0ba902b7-01", "", ""},
+		{"untraced", "", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.traceparent != "" {
+			r.Header.Set("traceparent", tt.traceparent)
+		}
+		if tt.xTraceID != "" {
+			r.Header.Set(TraceIDHeader, tt.xTraceID)
+		}
+		if got := TraceID(r); got != tt.want {
+			t.Errorf("%s: TraceID = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestObserveWithExemplar(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Buckets: []float64{1}})
+	ObserveWithExemplar(h, 0.5, "4bf92f3577b34da6a3ce929d0e0e4736")
+	ObserveWithExemplar(h, 2, "")
+
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("sample count = %d, want 2", got)
+	}
+	ex := m.GetHistogram().GetBucket()[0].GetExemplar()
+	if ex == nil || ex.GetLabel()[0].GetValue() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("exemplar = %v", ex)
+	}
+}
@@ -0,0 +1,87 @@
+package telemetry
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistogramSettings holds the configurable parts of a duration histogram.
+type HistogramSettings struct {
+	// Buckets are the classic bucket boundaries; nil keeps the caller's default.
+	Buckets []float64
+	// Native additionally emits a Prometheus native (sparse) histogram.
+	Native       bool
+	BucketFactor float64
+	MaxBuckets   uint32
+}
+
+// Apply returns opts with the configured buckets and native histogram options.
+func (s HistogramSettings) Apply(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if len(s.Buckets) > 0 {
+		opts.Buckets = s.Buckets
+	}
+	if s.Native {
+		opts.NativeHistogramBucketFactor = s.BucketFactor
+		if opts.NativeHistogramBucketFactor <= 1 {
+			opts.NativeHistogramBucketFactor = 1.1
+		}
+		opts.NativeHistogramMaxBucketNumber = s.MaxBuckets
+	}
+	return opts
+}
+
+// ParseBuckets converts a configuration value (a list of numbers or numeric
+// strings) into sorted, de-duplicated bucket boundaries.
+func ParseBuckets(value interface{}) ([]float64, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	var raw []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		raw = v
+	case []float64:
+		for _, f := range v {
+			raw = append(raw, f)
+		}
+	case []int:
+		for _, i := range v {
+			raw = append(raw, i)
+		}
+	default:
+		return nil, fmt.Errorf("buckets must be a list, got %T", value)
+	}
+
+	buckets := make([]float64, 0, len(raw))
+	for _, item := range raw {
+		var f float64
+		switch n := item.(type) {
+		case float64:
+			f = n
+		case int:
+			f = float64(n)
+		case string:
+			parsed, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bucket %q", n)
+			}
+			f = parsed
+		default:
+			return nil, fmt.Errorf("invalid bucket %v", item)
+		}
+		buckets = append(buckets, f)
+	}
+
+	sort.Float64s(buckets)
+	deduped := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if len(deduped) == 0 || b != deduped[len(deduped)-1] {
+			deduped = append(deduped, b)
+		}
+	}
+	return deduped, nil
+}
@@ -0,0 +1,97 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPExport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests"}, []string{"route"})
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{Name: "inflight"})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Buckets: []float64{0.1, 1}})
+	sizes := prometheus.NewSummary(prometheus.SummaryOpts{Name: "size_bytes", Objectives: map[float64]float64{0.5: 0.05}})
+	registry.MustRegister(requests, inflight, latency, sizes)
+	requests.WithLabelValues("/orders").Add(3)
+	inflight.Set(2)
+	for _, v := range []float64{0.05, 0.5, 0.7, 3} {
+		latency.Observe(v)
+	}
+	sizes.Observe(100)
+
+	var got otlpRequest
+	var header http.Header
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, header = r.URL.Path, r.Header
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode export: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	e := NewOTLPExporter(OTLPConfig{
+		Endpoint:    server.URL + "/",
+		ServiceName: "data-service",
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		Gatherer:    registry,
+	})
+	if err := e.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/metrics" || header.Get("Authorization") != "Bearer token" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("export went to %s with headers %v", path, header)
+	}
+
+	rm := got.ResourceMetrics[0]
+	if rm.Resource.Attributes[0] != (otlpAttribute{Key: "service.name", Value: otlpAnyValue{StringValue: "data-service"}}) {
+		t.Errorf("resource = %+v", rm.Resource)
+	}
+	metrics := make(map[string]otlpMetric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	sum := metrics["requests_total"].Sum
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != aggregationTemporalityCumulative ||
+		sum.DataPoints[0].AsDouble != 3 || sum.DataPoints[0].Attributes[0].Key != "route" || sum.DataPoints[0].Attributes[0].Value.StringValue != "/orders" {
+		t.Errorf("counter = %+v", metrics["requests_total"])
+	}
+	if g := metrics["inflight"].Gauge; g == nil || g.DataPoints[0].AsDouble != 2 {
+		t.Errorf("gauge = %+v", metrics["inflight"])
+	}
+
+	// Cumulative buckets become per-bucket counts with the +Inf bucket last.
+	h := metrics["latency_seconds"].Histogram
+	if h == nil {
+		t.Fatalf("histogram = %+v", metrics["latency_seconds"])
+	}
+	p := h.DataPoints[0]
+	if p.Count != "4" || p.Sum != 4.25 || strings.Join(p.BucketCounts, ",") != "1,2,1" || len(p.ExplicitBounds) != 2 || p.ExplicitBounds[1] != 1 {
+		t.Errorf("histogram point = %+v", p)
+	}
+	if s := metrics["size_bytes"].Summary; s == nil || s.DataPoints[0].Count != "1" || s.DataPoints[0].QuantileValues[0] != (otlpQuantileValue{Quantile: 0.5, Value: 100}) {
+		t.Errorf("summary = %+v", metrics["size_bytes"])
+	}
+	if p.StartTimeUnixNano == "" || p.StartTimeUnixNano > p.TimeUnixNano {
+		t.Errorf("point times %s to %s", p.StartTimeUnixNano, p.TimeUnixNano)
+	}
+}
+
+func TestOTLPExportReportsCollectorErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	e := NewOTLPExporter(OTLPConfig{Endpoint: server.URL, Gatherer: prometheus.NewRegistry()})
+	if err := e.Export(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Export = %v, want the collector's status", err)
+	}
+}
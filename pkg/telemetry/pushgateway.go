@@ -0,0 +1,63 @@
+package telemetry
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushgatewayConfig configures where short-lived job metrics are pushed.
+type PushgatewayConfig struct {
+	URL         string
+	Job         string
+	ServiceName string
+}
+
+// JobResult describes a finished short-lived job. ID is only used to log
+// push failures; it is not a label.
+type JobResult struct {
+	ID       string
+	Kind     string
+	Status   string
+	Items    int
+	Duration time.Duration
+	EndTime  time.Time
+}
+
+// PushJobMetrics pushes the result of a single job to the Pushgateway, grouped
+// by service and job kind. Each push replaces the group, so the Pushgateway
+// holds the latest result of every kind rather than one group per job ever run.
+func PushJobMetrics(cfg PushgatewayConfig, result JobResult) error {
+	registry := prometheus.NewRegistry()
+
+	items := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_job_items_processed",
+		Help: "Number of items processed by the job",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_job_duration_seconds",
+		Help: "Wall-clock duration of the job",
+	})
+	completed := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pipeline_job_last_completion_timestamp_seconds",
+		Help: "Unix time the job finished",
+	})
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pipeline_job_status",
+		Help: "Final job status (1 for the reported status)",
+	}, []string{"status"})
+
+	registry.MustRegister(items, duration, completed, status)
+
+	items.Set(float64(result.Items))
+	duration.Set(result.Duration.Seconds())
+	completed.Set(float64(result.EndTime.Unix()))
+	status.WithLabelValues(result.Status).Set(1)
+
+	return push.New(cfg.URL, cfg.Job).
+		Gatherer(registry).
+		Grouping("service", cfg.ServiceName).
+		Grouping("kind", result.Kind).
+		Push()
+}
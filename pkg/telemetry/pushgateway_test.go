@@ -0,0 +1,50 @@
+package telemetry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushJobMetricsGroupsByKind(t *testing.T) {
+	var mu sync.Mutex
+	var pushes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushes = append(pushes, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if len(body) == 0 {
+			t.Error("empty push")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := PushgatewayConfig{URL: server.URL, Job: "pipeline", ServiceName: "data-service"}
+	for _, id := range []string{"job-1", "job-2"} {
+		err := PushJobMetrics(cfg, JobResult{ID: id, Kind: "processing", Status: "completed", Items: 3, Duration: time.Second, EndTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(pushes) != 2 {
+		t.Fatalf("got %d pushes, want 2", len(pushes))
+	}
+	for _, p := range pushes {
+		method, path, _ := strings.Cut(p, " ")
+		parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+		grouping := make(map[string]string)
+		for i := 0; i+1 < len(parts); i += 2 {
+			grouping[parts[i]] = parts[i+1]
+		}
+		if method != http.MethodPut || len(grouping) != 3 || grouping["job"] != "pipeline" || grouping["service"] != "data-service" || grouping["kind"] != "processing" {
+			t.Errorf("push %s, want a PUT grouped by job, service and kind only", p)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package telemetry
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Runtime saturation signals, as named in RuntimeStatus.Saturated and the
+// signal label of service_runtime_saturated.
+const (
+	SignalGoroutineGrowth = "goroutine_growth"
+	SignalGCPause         = "gc_pause"
+	SignalSchedLatency    = "sched_latency"
+	SignalFDUsage         = "fd_usage"
+)
+
+var (
+	goroutineGrowth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_goroutine_growth_per_minute",
+		Help: "Goroutines started per minute over the saturation window, net of those that ended (0 until a full window has been sampled)",
+	})
+	gcPauseP99 = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_gc_pause_p99_seconds",
+		Help: "99th percentile of the stop-the-world GC pauses since the previous sample",
+	})
+	schedLatencyP99 = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_sched_latency_p99_seconds",
+		Help: "99th percentile of the time runnable goroutines waited for a thread since the previous sample",
+	})
+	fdUsage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "service_fd_usage_ratio",
+		Help: "Open file descriptors divided by the soft limit of the process",
+	})
+	runtimeSaturated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "service_runtime_saturated",
+		Help: "Whether a runtime saturation signal is above its threshold (1) or not (0)",
+	}, []string{"signal"})
+)
+
+// RuntimeThresholds are the levels above which a saturation signal degrades
+// the service; a zero threshold is not checked.
+type RuntimeThresholds struct {
+	// GoroutineGrowth is in goroutines per minute.
+	GoroutineGrowth float64       `mapstructure:"goroutine_growth" json:"goroutine_growth"`
+	GCPauseP99      time.Duration `mapstructure:"gc_pause_p99" json:"gc_pause_p99"`
+	SchedLatencyP99 time.Duration `mapstructure:"sched_latency_p99" json:"sched_latency_p99"`
+	// FDUsage is the share of the file descriptor limit in use, 0 to 1.
+	FDUsage float64 `mapstructure:"fd_usage" json:"fd_usage"`
+}
+
+// RuntimeConfig configures the runtime saturation sampler.
+type RuntimeConfig struct {
+	// Interval is how often the runtime is sampled.
+	Interval time.Duration
+	// Window is how far back the goroutine growth rate looks.
+	Window     time.Duration
+	Thresholds RuntimeThresholds
+}
+
+// RuntimeStatus is the last sample of the runtime, as reported by the
+// services' health endpoints.
+type RuntimeStatus struct {
+	SampledAt       time.Time `json:"sampled_at"`
+	Goroutines      int       `json:"goroutines"`
+	GoroutineGrowth float64   `json:"goroutine_growth_per_minute"`
+	GCPauseP99      float64   `json:"gc_pause_p99_seconds"`
+	SchedLatencyP99 float64   `json:"sched_latency_p99_seconds"`
+	OpenFDs         int       `json:"open_fds,omitempty"`
+	MaxFDs          uint64    `json:"max_fds,omitempty"`
+	FDUsage         float64   `json:"fd_usage_ratio,omitempty"`
+	// Saturated lists the signals above their threshold, each with its
+	// value; a service with any is degraded.
+	Saturated map[string]string `json:"saturated,omitempty"`
+}
+
+var (
+	runtimeMu     sync.RWMutex
+	runtimeStatus RuntimeStatus
+	runtimeOn     bool
+)
+
+// gcPauseMetrics are the runtime/metrics names of the GC pause histogram,
+// newest first; Go 1.22 renamed it.
+var gcPauseMetrics = []string{"/sched/pauses/total/gc:seconds", "/gc/pauses:seconds"}
+
+const schedLatencyMetric = "/sched/latencies:seconds"
+
+// StartRuntimeMetrics replaces the default Go collector with one that also
+// exports the GC pause and scheduler latency histograms
+// (go_gc_pauses_seconds, go_sched_latencies_seconds), and samples the
+// derived saturation signals every cfg.Interval until the returned func is
+// called. The process collector already exports process_open_fds and
+// process_max_fds.
+func StartRuntimeMetrics(cfg RuntimeConfig) func() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(
+		collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(
+			collectors.MetricsGC,
+			collectors.MetricsScheduler,
+		)),
+		goroutineGrowth, gcPauseP99, schedLatencyP99, fdUsage, runtimeSaturated,
+	)
+
+	s := newRuntimeSampler(cfg)
+	s.sample(time.Now())
+	runtimeMu.Lock()
+	runtimeOn = true
+	runtimeMu.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.sample(now)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Runtime returns the last runtime sample, and false when
+// StartRuntimeMetrics was not called.
+func Runtime() (RuntimeStatus, bool) {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return runtimeStatus, runtimeOn
+}
+
+type goroutineSample struct {
+	at    time.Time
+	count int
+}
+
+// runtimeSampler keeps what the signals are derived from between samples.
+type runtimeSampler struct {
+	cfg        RuntimeConfig
+	samples    []metrics.Sample
+	gcPause    string
+	goroutines []goroutineSample
+	// last holds the previous histogram counts, so percentiles cover
+	// only the pauses and waits since then.
+	last map[string][]uint64
+}
+
+func newRuntimeSampler(cfg RuntimeConfig) *runtimeSampler {
+	supported := make(map[string]bool)
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+	s := &runtimeSampler{cfg: cfg, last: make(map[string][]uint64)}
+	for _, name := range gcPauseMetrics {
+		if supported[name] {
+			s.gcPause = name
+			s.samples = append(s.samples, metrics.Sample{Name: name})
+			break
+		}
+	}
+	if supported[schedLatencyMetric] {
+		s.samples = append(s.samples, metrics.Sample{Name: schedLatencyMetric})
+	}
+	return s
+}
+
+func (s *runtimeSampler) sample(now time.Time) {
+	status := RuntimeStatus{SampledAt: now.UTC(), Goroutines: runtime.NumGoroutine()}
+
+	// The growth rate waits for a full window, so the goroutines started
+	// at startup do not count as growth.
+	s.goroutines = append(s.goroutines, goroutineSample{at: now, count: status.Goroutines})
+	for len(s.goroutines) > 2 && now.Sub(s.goroutines[1].at) >= s.cfg.Window {
+		s.goroutines = s.goroutines[1:]
+	}
+	if first := s.goroutines[0]; s.cfg.Window > 0 && now.Sub(first.at) >= s.cfg.Window {
+		status.GoroutineGrowth = round3(float64(status.Goroutines-first.count) / now.Sub(first.at).Minutes())
+	}
+
+	metrics.Read(s.samples)
+	for _, m := range s.samples {
+		if m.Value.Kind() != metrics.KindFloat64Histogram {
+			continue
+		}
+		p99 := s.percentile(m.Name, m.Value.Float64Histogram(), 0.99)
+		if m.Name == s.gcPause {
+			status.GCPauseP99 = p99
+		} else {
+			status.SchedLatencyP99 = p99
+		}
+	}
+
+	if open, max, err := openFDs(); err == nil && max > 0 {
+		status.OpenFDs = open
+		status.MaxFDs = max
+		status.FDUsage = float64(open) / float64(max)
+	}
+
+	t := s.cfg.Thresholds
+	status.Saturated = make(map[string]string)
+	s.check(status.Saturated, SignalGoroutineGrowth, t.GoroutineGrowth > 0 && status.GoroutineGrowth > t.GoroutineGrowth,
+		fmt.Sprintf("%.1f goroutines per minute, above %.1f", status.GoroutineGrowth, t.GoroutineGrowth))
+	s.check(status.Saturated, SignalGCPause, t.GCPauseP99 > 0 && status.GCPauseP99 > t.GCPauseP99.Seconds(),
+		fmt.Sprintf("GC pause p99 %s, above %s", seconds(status.GCPauseP99), t.GCPauseP99))
+	s.check(status.Saturated, SignalSchedLatency, t.SchedLatencyP99 > 0 && status.SchedLatencyP99 > t.SchedLatencyP99.Seconds(),
+		fmt.Sprintf("scheduler latency p99 %s, above %s", seconds(status.SchedLatencyP99), t.SchedLatencyP99))
+	s.check(status.Saturated, SignalFDUsage, t.FDUsage > 0 && status.FDUsage > t.FDUsage,
+		fmt.Sprintf("%d of %d file descriptors open", status.OpenFDs, status.MaxFDs))
+	if len(status.Saturated) == 0 {
+		status.Saturated = nil
+	}
+
+	goroutineGrowth.Set(status.GoroutineGrowth)
+	gcPauseP99.Set(status.GCPauseP99)
+	schedLatencyP99.Set(status.SchedLatencyP99)
+	fdUsage.Set(status.FDUsage)
+
+	runtimeMu.Lock()
+	runtimeStatus = status
+	runtimeMu.Unlock()
+}
+
+// check records whether signal is saturated, with why if it is.
+func (s *runtimeSampler) check(saturated map[string]string, signal string, over bool, why string) {
+	value := 0.0
+	if over {
+		value = 1
+		saturated[signal] = why
+	}
+	runtimeSaturated.WithLabelValues(signal).Set(value)
+}
+
+// percentile estimates quantile q of the observations h gained since the
+// previous sample of name, as the upper bound of the bucket it falls in. It
+// is 0 when there were none.
+func (s *runtimeSampler) percentile(name string, h *metrics.Float64Histogram, q float64) float64 {
+	prev := s.last[name]
+	delta := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, c := range h.Counts {
+		if i < len(prev) && prev[i] <= c {
+			c -= prev[i]
+		}
+		delta[i] = c
+		total += c
+	}
+	s.last[name] = append(prev[:0], h.Counts...)
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(float64(total) * q))
+	var seen uint64
+	for i, c := range delta {
+		seen += c
+		if seen >= rank {
+			// Bucket i spans Buckets[i] to Buckets[i+1]; the last is
+			// unbounded, so its lower bound is the best there is.
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = h.Buckets[i]
+			}
+			return upper
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+// openFDs counts the open file descriptors of the process in /proc and
+// reads their soft limit.
+func openFDs() (int, uint64, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, err
+	}
+	// One entry is the descriptor ReadDir opened on the directory itself.
+	return len(entries) - 1, limit.Cur, nil
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second)).Round(time.Microsecond)
+}
@@ -0,0 +1,199 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxStatsDPacket keeps UDP datagrams under a typical MTU.
+const maxStatsDPacket = 1400
+
+// StatsDConfig configures the StatsD sink. With DogStatsD enabled, metric
+// labels and Tags are sent as tags; otherwise label values are folded into the
+// metric name.
+type StatsDConfig struct {
+	Address   string
+	Prefix    string
+	Tags      []string
+	DogStatsD bool
+	Interval  time.Duration
+	// Metrics limits the mirrored metric families; empty mirrors everything.
+	Metrics  []string
+	Gatherer prometheus.Gatherer
+}
+
+// StatsDSink mirrors selected Prometheus metrics to a StatsD agent. Counters
+// are sent as count deltas, gauges as gauges and histograms as a count delta
+// plus the average of the observations made during the interval.
+type StatsDSink struct {
+	cfg     StatsDConfig
+	allowed map[string]bool
+	last    map[string]float64
+}
+
+func NewStatsDSink(cfg StatsDConfig) *StatsDSink {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.DefaultGatherer
+	}
+
+	var allowed map[string]bool
+	if len(cfg.Metrics) > 0 {
+		allowed = make(map[string]bool, len(cfg.Metrics))
+		for _, name := range cfg.Metrics {
+			allowed[name] = true
+		}
+	}
+
+	return &StatsDSink{cfg: cfg, allowed: allowed, last: make(map[string]float64)}
+}
+
+// Run flushes on every interval until ctx is cancelled.
+func (s *StatsDSink) Run(ctx context.Context, onError func(error)) {
+	conn, err := net.Dial("udp", s.cfg.Address)
+	if err != nil {
+		if onError != nil {
+			onError(fmt.Errorf("dial statsd: %w", err))
+		}
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.flush(conn); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func (s *StatsDSink) flush(conn net.Conn) error {
+	families, err := s.cfg.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %w", err)
+	}
+
+	var lines []string
+	for _, mf := range families {
+		if s.allowed != nil && !s.allowed[mf.GetName()] {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			lines = append(lines, s.linesFor(mf, m)...)
+		}
+	}
+
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxStatsDPacket {
+			if _, err := conn.Write([]byte(packet.String())); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StatsDSink) linesFor(mf *dto.MetricFamily, m *dto.Metric) []string {
+	name, tags := s.nameAndTags(mf.GetName(), m.GetLabel())
+	key := name + "|" + tags
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		if delta := s.delta(key, m.GetCounter().GetValue()); delta > 0 {
+			return []string{s.format(name, delta, "c", tags)}
+		}
+	case dto.MetricType_GAUGE:
+		return []string{s.format(name, m.GetGauge().GetValue(), "g", tags)}
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		count := s.delta(key+"|count", float64(h.GetSampleCount()))
+		sum := s.delta(key+"|sum", h.GetSampleSum())
+		if count > 0 {
+			return []string{
+				s.format(name+".count", count, "c", tags),
+				s.format(name+".avg", sum/count, "g", tags),
+			}
+		}
+	}
+	return nil
+}
+
+// delta returns the increase since the previous flush. Series start at zero
+// with the process, and a decrease means the series was reset, so in both
+// cases the full value is reported.
+func (s *StatsDSink) delta(key string, value float64) float64 {
+	previous, seen := s.last[key]
+	s.last[key] = value
+	if !seen || value < previous {
+		return value
+	}
+	return value - previous
+}
+
+func (s *StatsDSink) nameAndTags(name string, labels []*dto.LabelPair) (string, string) {
+	name = s.cfg.Prefix + name
+
+	if !s.cfg.DogStatsD {
+		for _, l := range labels {
+			if v := sanitizeStatsD(l.GetValue()); v != "" {
+				name += "." + v
+			}
+		}
+		return name, ""
+	}
+
+	tags := append([]string{}, s.cfg.Tags...)
+	for _, l := range labels {
+		tags = append(tags, l.GetName()+":"+sanitizeStatsD(l.GetValue()))
+	}
+	sort.Strings(tags)
+	return name, strings.Join(tags, ",")
+}
+
+func (s *StatsDSink) format(name string, value float64, kind, tags string) string {
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if tags != "" {
+		line += "|#" + tags
+	}
+	return line
+}
+
+func sanitizeStatsD(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', ',', '#', '\n', ' ':
+			return '_'
+		case '/':
+			return '.'
+		}
+		return r
+	}, strings.Trim(value, "/"))
+}
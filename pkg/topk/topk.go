@@ -0,0 +1,252 @@
+// Package topk finds the most frequent values of a stream in bounded memory
+// with the Space-Saving algorithm (Metwally et al.). A Sketch of capacity m
+// counts at most m values; a new value evicts the least frequent one and
+// inherits its count as the error of its own. Every value occurring more
+// than n/m times in n observations is guaranteed to be in the sketch, and
+// each reported count overestimates the true one by at most its Error.
+//
+// Sketches merge (Agarwal et al., "Mergeable Summaries"), which Windowed
+// uses to answer "top values of the last hour" from one sketch per time
+// slice.
+package topk
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Item is a counted value. Count is an upper bound of its occurrences and
+// Count-Error a lower bound.
+type Item struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// Sketch is a Space-Saving summary. It is not safe for concurrent use.
+type Sketch struct {
+	capacity int
+	total    uint64
+	items    map[string]*entry
+	heap     minHeap
+}
+
+type entry struct {
+	Item
+	index int
+}
+
+// New returns a sketch counting at most capacity values, which must be
+// positive.
+func New(capacity int) *Sketch {
+	if capacity <= 0 {
+		panic("topk: capacity must be positive")
+	}
+	return &Sketch{capacity: capacity, items: make(map[string]*entry, capacity)}
+}
+
+// Add counts n occurrences of key.
+func (s *Sketch) Add(key string, n uint64) {
+	s.total += n
+	if e, ok := s.items[key]; ok {
+		e.Count += n
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e := &entry{Item: Item{Key: key, Count: n}}
+		s.items[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	// Replace the least frequent value, which may have been key all along.
+	e := s.heap[0]
+	delete(s.items, e.Key)
+	e.Key, e.Error = key, e.Count
+	e.Count += n
+	s.items[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// Total is the number of occurrences counted, including evicted values.
+func (s *Sketch) Total() uint64 {
+	return s.total
+}
+
+// min is the count every value not in the sketch may have occurred up to.
+func (s *Sketch) min() uint64 {
+	if len(s.heap) < s.capacity {
+		return 0
+	}
+	return s.heap[0].Count
+}
+
+// Merge adds the counts of o to s. A value missing from one sketch is
+// assumed to have occurred as often as that sketch's least frequent value,
+// which keeps the error bounds of both.
+func (s *Sketch) Merge(o *Sketch) {
+	sMin, oMin := s.min(), o.min()
+	merged := make([]Item, 0, len(s.items)+len(o.items))
+	for key, e := range s.items {
+		item := e.Item
+		if oe, ok := o.items[key]; ok {
+			item.Count += oe.Count
+			item.Error += oe.Error
+		} else {
+			item.Count += oMin
+			item.Error += oMin
+		}
+		merged = append(merged, item)
+	}
+	for key, oe := range o.items {
+		if _, ok := s.items[key]; !ok {
+			merged = append(merged, Item{Key: key, Count: oe.Count + sMin, Error: oe.Error + sMin})
+		}
+	}
+	sortItems(merged)
+	if len(merged) > s.capacity {
+		merged = merged[:s.capacity]
+	}
+
+	s.total += o.total
+	s.items = make(map[string]*entry, len(merged))
+	s.heap = s.heap[:0]
+	for _, item := range merged {
+		e := &entry{Item: item}
+		s.items[item.Key] = e
+		heap.Push(&s.heap, e)
+	}
+}
+
+// Top returns up to k values, most frequent first.
+func (s *Sketch) Top(k int) []Item {
+	items := make([]Item, 0, len(s.items))
+	for _, e := range s.items {
+		items = append(items, e.Item)
+	}
+	sortItems(items)
+	if k >= 0 && len(items) > k {
+		items = items[:k]
+	}
+	return items
+}
+
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+}
+
+type minHeap []*entry
+
+func (h minHeap) Len() int           { return len(h) }
+func (h minHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *minHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Windowed keeps one Sketch per slice of time for the last retention, so
+// the top values of any window up to retention can be merged on demand.
+// It is safe for concurrent use.
+type Windowed struct {
+	capacity  int
+	slice     time.Duration
+	retention time.Duration
+
+	mu     sync.Mutex
+	slices []windowSlice // oldest first
+}
+
+type windowSlice struct {
+	start  time.Time
+	sketch *Sketch
+}
+
+// NewWindowed returns a Windowed of sketches of capacity, each covering
+// slice, kept for retention.
+func NewWindowed(capacity int, slice, retention time.Duration) *Windowed {
+	if slice <= 0 {
+		slice = time.Minute
+	}
+	if retention < slice {
+		retention = slice
+	}
+	New(capacity) // validates capacity
+	return &Windowed{capacity: capacity, slice: slice, retention: retention}
+}
+
+// Retention is the longest window Top can answer.
+func (w *Windowed) Retention() time.Duration {
+	return w.retention
+}
+
+// Add counts key as seen at t. Occurrences older than the retention are
+// ignored.
+func (w *Windowed) Add(key string, t time.Time) {
+	start := t.Truncate(w.slice)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.expire(t)
+	if n := len(w.slices); n > 0 && !start.After(w.slices[n-1].start.Add(-w.retention)) {
+		return
+	}
+	i := sort.Search(len(w.slices), func(i int) bool { return !w.slices[i].start.Before(start) })
+	if i < len(w.slices) && w.slices[i].start.Equal(start) {
+		w.slices[i].sketch.Add(key, 1)
+		return
+	}
+	s := windowSlice{start: start, sketch: New(w.capacity)}
+	s.sketch.Add(key, 1)
+	w.slices = append(w.slices, windowSlice{})
+	copy(w.slices[i+1:], w.slices[i:])
+	w.slices[i] = s
+}
+
+// expire drops the slices that ended more than retention before now.
+func (w *Windowed) expire(now time.Time) {
+	n := 0
+	for n < len(w.slices) && !w.slices[n].start.Add(w.slice).After(now.Add(-w.retention)) {
+		n++
+	}
+	w.slices = w.slices[n:]
+}
+
+// Top merges the slices overlapping the window ending at now and returns
+// up to k values, most frequent first, with the total number of
+// occurrences counted and the start of the oldest slice merged. Because
+// whole slices are merged, the window is widened to slice boundaries.
+func (w *Windowed) Top(k int, window time.Duration, now time.Time) (items []Item, total uint64, from time.Time) {
+	merged := New(w.capacity)
+	from = now.Add(-window).Truncate(w.slice)
+
+	w.mu.Lock()
+	w.expire(now)
+	for _, s := range w.slices {
+		if !s.start.Before(from) && !s.start.After(now) {
+			merged.Merge(s.sketch)
+		}
+	}
+	w.mu.Unlock()
+
+	return merged.Top(k), merged.Total(), from
+}
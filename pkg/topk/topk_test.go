@@ -0,0 +1,153 @@
+package topk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// checkBounds verifies the Space-Saving guarantees of s against the true
+// counts: every item brackets its true count, and every value occurring
+// more than total/capacity times is present.
+func checkBounds(t *testing.T, s *Sketch, counts map[string]uint64, capacity int) {
+	t.Helper()
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if s.Total() != total {
+		t.Errorf("total %d, want %d", s.Total(), total)
+	}
+	present := make(map[string]bool)
+	for _, item := range s.Top(-1) {
+		present[item.Key] = true
+		if actual := counts[item.Key]; item.Count < actual || item.Count-item.Error > actual {
+			t.Errorf("%s: count %d error %d does not bracket %d", item.Key, item.Count, item.Error, actual)
+		}
+	}
+	for key, n := range counts {
+		if n > total/uint64(capacity) && !present[key] {
+			t.Errorf("%s occurred %d of %d times but is missing", key, n, total)
+		}
+	}
+}
+
+func zipfStream(seed int64, n int) ([]string, map[string]uint64) {
+	rng := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(rng, 1.2, 1, 10000)
+	keys := make([]string, n)
+	counts := make(map[string]uint64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("source-%d", zipf.Uint64())
+		counts[keys[i]]++
+	}
+	return keys, counts
+}
+
+func TestSketchBounds(t *testing.T) {
+	keys, counts := zipfStream(1, 50000)
+	s := New(50)
+	for _, k := range keys {
+		s.Add(k, 1)
+	}
+	checkBounds(t, s, counts, 50)
+
+	top := s.Top(3)
+	if len(top) != 3 || top[0].Key != "source-0" || top[0].Count < top[1].Count || top[1].Count < top[2].Count {
+		t.Errorf("top 3 = %+v", top)
+	}
+}
+
+func TestSketchIsExactWithinCapacity(t *testing.T) {
+	s := New(3)
+	s.Add("a", 5)
+	s.Add("b", 2)
+	s.Add("c", 2)
+	s.Add("a", 1)
+	want := []Item{{Key: "a", Count: 6}, {Key: "b", Count: 2}, {Key: "c", Count: 2}}
+	if got := s.Top(10); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Top = %+v, want %+v", got, want)
+	}
+
+	// A fourth value replaces the least frequent one and inherits its count.
+	s.Add("d", 1)
+	got := s.Top(10)
+	if len(got) != 3 || got[1] != (Item{Key: "d", Count: 3, Error: 2}) {
+		t.Errorf("after eviction Top = %+v", got)
+	}
+}
+
+func TestMergeKeepsBounds(t *testing.T) {
+	// Two halves with different heavy hitters.
+	keysA, countsA := zipfStream(2, 20000)
+	keysB, countsB := zipfStream(3, 20000)
+	a, b := New(40), New(40)
+	for _, k := range keysA {
+		a.Add(k, 1)
+	}
+	for _, k := range keysB {
+		b.Add("b-"+k, 1)
+		if k == "source-0" {
+			// Shared by both halves.
+			b.Add(k, 1)
+		}
+	}
+	counts := make(map[string]uint64)
+	for k, n := range countsA {
+		counts[k] += n
+	}
+	for k, n := range countsB {
+		counts["b-"+k] += n
+	}
+	counts["source-0"] += countsB["source-0"]
+
+	a.Merge(b)
+	checkBounds(t, a, counts, 40)
+	if len(a.Top(-1)) > 40 {
+		t.Errorf("merged sketch holds %d values", len(a.Top(-1)))
+	}
+}
+
+func TestWindowed(t *testing.T) {
+	w := NewWindowed(10, time.Minute, 10*time.Minute)
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		w.Add("old", base.Add(30*time.Second))
+	}
+	w.Add("recent", base.Add(8*time.Minute))
+	w.Add("recent", base.Add(9*time.Minute))
+	// Out of order, into an earlier slice.
+	w.Add("recent", base.Add(7*time.Minute+10*time.Second))
+
+	now := base.Add(9*time.Minute + 30*time.Second)
+	items, total, from := w.Top(5, 3*time.Minute, now)
+	if total != 3 || len(items) != 1 || items[0] != (Item{Key: "recent", Count: 3}) {
+		t.Errorf("last 3 minutes: %+v, total %d", items, total)
+	}
+	if !from.Equal(base.Add(6 * time.Minute)) {
+		t.Errorf("window widened to %v", from)
+	}
+	if items, total, _ = w.Top(5, 10*time.Minute, now); total != 8 || items[0].Key != "old" {
+		t.Errorf("last 10 minutes: %+v, total %d", items, total)
+	}
+
+	// The first slice ends past the retention and is dropped.
+	later := base.Add(11*time.Minute + time.Second)
+	if items, total, _ = w.Top(5, 10*time.Minute, later); total != 3 || items[0].Key != "recent" {
+		t.Errorf("after expiry: %+v, total %d", items, total)
+	}
+	w.Add("stale", base)
+	if _, total, _ = w.Top(5, 10*time.Minute, later); total != 3 {
+		t.Errorf("an occurrence older than the retention was counted: total %d", total)
+	}
+}
+
+func TestNewRejectsZeroCapacity(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New(0) did not panic")
+		}
+	}()
+	New(0)
+}
@@ -0,0 +1,46 @@
+package usage
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Handler serves usage reports. Query parameters:
+//
+//	key   API key ID; all keys when empty
+//	from  first day, YYYY-MM-DD; six days before to by default
+//	to    last day, YYYY-MM-DD; today by default
+func (s *Store) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		loc := s.cfg.Location
+
+		now := time.Now().In(loc)
+		to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		if v := q.Get("to"); v != "" {
+			d, err := time.ParseInLocation(dayLayout, v, loc)
+			if err != nil {
+				http.Error(w, "invalid to, use YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			to = d
+		}
+		from := to.AddDate(0, 0, -6)
+		if v := q.Get("from"); v != "" {
+			d, err := time.ParseInLocation(dayLayout, v, loc)
+			if err != nil {
+				http.Error(w, "invalid from, use YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			from = d
+		}
+		if from.After(to) {
+			http.Error(w, "from must not be after to", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Report(q.Get("key"), from, to))
+	})
+}
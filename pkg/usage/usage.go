@@ -0,0 +1,328 @@
+// Package usage attributes gateway traffic to API keys. Requests are rolled up
+// per key and day (request and error counts, bytes and a latency histogram)
+// and kept in a JSON file, so platform owners can see which clients drive
+// load over weeks or months.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram bounds in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const dayLayout = "2006-01-02"
+
+// Counters is the rollup of one key on one day.
+type Counters struct {
+	Requests        int64   `json:"requests"`
+	ClientErrors    int64   `json:"client_errors"`
+	ServerErrors    int64   `json:"server_errors"`
+	BytesIn         int64   `json:"bytes_in"`
+	BytesOut        int64   `json:"bytes_out"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Buckets counts requests per latency bucket; the last one is +Inf.
+	Buckets []int64 `json:"buckets"`
+}
+
+func (c *Counters) add(o *Counters) {
+	c.Requests += o.Requests
+	c.ClientErrors += o.ClientErrors
+	c.ServerErrors += o.ServerErrors
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+	c.DurationSeconds += o.DurationSeconds
+	if len(c.Buckets) < len(o.Buckets) {
+		c.Buckets = append(c.Buckets, make([]int64, len(o.Buckets)-len(c.Buckets))...)
+	}
+	for i, n := range o.Buckets {
+		c.Buckets[i] += n
+	}
+}
+
+// file is the on-disk layout.
+type file struct {
+	Buckets []float64                       `json:"buckets"`
+	Days    map[string]map[string]*Counters `json:"days"`
+}
+
+// Config configures a Store.
+type Config struct {
+	// Path is the JSON file the rollups are saved to.
+	Path string
+	// Retention is how many days of rollups are kept; 90 by default.
+	RetentionDays int
+	// Location cuts days; UTC by default.
+	Location *time.Location
+	// Buckets are the latency bounds in seconds; DefaultBuckets by default.
+	// Changing them discards histograms saved with other bounds.
+	Buckets []float64
+}
+
+// Store aggregates requests per API key and day.
+type Store struct {
+	cfg Config
+
+	mu    sync.Mutex
+	days  map[string]map[string]*Counters
+	dirty bool
+}
+
+// NewStore loads the rollups saved at cfg.Path.
+func NewStore(cfg Config) (*Store, error) {
+	if cfg.RetentionDays <= 0 {
+		cfg.RetentionDays = 90
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+	if len(cfg.Buckets) == 0 {
+		cfg.Buckets = DefaultBuckets
+	}
+	s := &Store{cfg: cfg, days: make(map[string]map[string]*Counters)}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open usage store: %w", err)
+	}
+	if len(data) > 0 {
+		var f file
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("parse usage store: %w", err)
+		}
+		sameBuckets := len(f.Buckets) == len(cfg.Buckets)
+		for i := 0; sameBuckets && i < len(f.Buckets); i++ {
+			sameBuckets = f.Buckets[i] == cfg.Buckets[i]
+		}
+		for day, keys := range f.Days {
+			for _, c := range keys {
+				if !sameBuckets {
+					c.Buckets = nil
+				}
+			}
+			s.days[day] = keys
+		}
+	}
+	return s, nil
+}
+
+// Record counts one request of key.
+func (s *Store) Record(key string, at time.Time, status int, bytesIn, bytesOut int64, duration time.Duration) {
+	day := at.In(s.cfg.Location).Format(dayLayout)
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(s.cfg.Buckets, seconds)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, ok := s.days[day]
+	if !ok {
+		keys = make(map[string]*Counters)
+		s.days[day] = keys
+	}
+	c, ok := keys[key]
+	if !ok {
+		c = &Counters{}
+		keys[key] = c
+	}
+	if len(c.Buckets) != len(s.cfg.Buckets)+1 {
+		c.Buckets = make([]int64, len(s.cfg.Buckets)+1)
+	}
+	c.Requests++
+	switch {
+	case status >= 500:
+		c.ServerErrors++
+	case status >= 400:
+		c.ClientErrors++
+	}
+	c.BytesIn += bytesIn
+	c.BytesOut += bytesOut
+	c.DurationSeconds += seconds
+	c.Buckets[bucket]++
+	s.dirty = true
+}
+
+// Save drops days past the retention and writes the store if it changed.
+func (s *Store) Save(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.In(s.cfg.Location).AddDate(0, 0, -s.cfg.RetentionDays).Format(dayLayout)
+	for day := range s.days {
+		if day < cutoff {
+			delete(s.days, day)
+			s.dirty = true
+		}
+	}
+	if !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(file{Buckets: s.cfg.Buckets, Days: s.days})
+	if err != nil {
+		return err
+	}
+	tmp := s.cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("save usage store: %w", err)
+	}
+	if err := os.Rename(tmp, s.cfg.Path); err != nil {
+		return fmt.Errorf("save usage store: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves the store every interval until stop is closed, then once more.
+func (s *Store) Run(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	save := func(now time.Time) {
+		if err := s.Save(now); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	for {
+		select {
+		case <-stop:
+			save(time.Now())
+			return
+		case now := <-ticker.C:
+			save(now)
+		}
+	}
+}
+
+// Summary describes the usage of a key over some days.
+type Summary struct {
+	Requests     int64   `json:"requests"`
+	ClientErrors int64   `json:"client_errors"`
+	ServerErrors int64   `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	BytesIn      int64   `json:"bytes_in"`
+	BytesOut     int64   `json:"bytes_out"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P50Ms        float64 `json:"p50_latency_ms"`
+	P95Ms        float64 `json:"p95_latency_ms"`
+	P99Ms        float64 `json:"p99_latency_ms"`
+}
+
+// DayUsage is one day of a key's usage.
+type DayUsage struct {
+	Date string `json:"date"`
+	Summary
+}
+
+// KeyUsage is a key's usage over a report's range.
+type KeyUsage struct {
+	Key   string     `json:"key"`
+	Total Summary    `json:"total"`
+	Days  []DayUsage `json:"days"`
+}
+
+// Report covers the days from From to To inclusive.
+type Report struct {
+	From string     `json:"from"`
+	To   string     `json:"to"`
+	Keys []KeyUsage `json:"keys"`
+}
+
+// Report returns the usage of key (all keys when empty) on the days from
+// from to to, inclusive, busiest key first.
+func (s *Store) Report(key string, from, to time.Time) Report {
+	fromDay, toDay := from.Format(dayLayout), to.Format(dayLayout)
+	report := Report{From: fromDay, To: toDay, Keys: []KeyUsage{}}
+
+	s.mu.Lock()
+	totals := make(map[string]*Counters)
+	days := make(map[string][]DayUsage)
+	for day, keys := range s.days {
+		if day < fromDay || day > toDay {
+			continue
+		}
+		for k, c := range keys {
+			if key != "" && k != key {
+				continue
+			}
+			t, ok := totals[k]
+			if !ok {
+				t = &Counters{}
+				totals[k] = t
+			}
+			t.add(c)
+			days[k] = append(days[k], DayUsage{Date: day, Summary: s.summarize(c)})
+		}
+	}
+	for k, t := range totals {
+		d := days[k]
+		sort.Slice(d, func(i, j int) bool { return d[i].Date < d[j].Date })
+		report.Keys = append(report.Keys, KeyUsage{Key: k, Total: s.summarize(t), Days: d})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(report.Keys, func(i, j int) bool {
+		if report.Keys[i].Total.Requests != report.Keys[j].Total.Requests {
+			return report.Keys[i].Total.Requests > report.Keys[j].Total.Requests
+		}
+		return report.Keys[i].Key < report.Keys[j].Key
+	})
+	return report
+}
+
+func (s *Store) summarize(c *Counters) Summary {
+	sum := Summary{
+		Requests:     c.Requests,
+		ClientErrors: c.ClientErrors,
+		ServerErrors: c.ServerErrors,
+		BytesIn:      c.BytesIn,
+		BytesOut:     c.BytesOut,
+	}
+	if c.Requests > 0 {
+		sum.ErrorRate = float64(c.ServerErrors) / float64(c.Requests)
+		sum.AvgLatencyMs = c.DurationSeconds / float64(c.Requests) * 1000
+	}
+	sum.P50Ms = s.quantile(c.Buckets, 0.5) * 1000
+	sum.P95Ms = s.quantile(c.Buckets, 0.95) * 1000
+	sum.P99Ms = s.quantile(c.Buckets, 0.99) * 1000
+	return sum
+}
+
+// quantile estimates q from histogram counts by linear interpolation within
+// the bucket, like Prometheus' histogram_quantile.
+func (s *Store) quantile(counts []int64, q float64) float64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 || len(counts) != len(s.cfg.Buckets)+1 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range counts {
+		if float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(s.cfg.Buckets) {
+			return s.cfg.Buckets[len(s.cfg.Buckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.cfg.Buckets[i-1]
+		}
+		if n == 0 {
+			return lower
+		}
+		return lower + (s.cfg.Buckets[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return s.cfg.Buckets[len(s.cfg.Buckets)-1]
+}
@@ -0,0 +1,206 @@
+// Package workload shapes generated load over time. A profile is a list of
+// phases, written one per line or separated by semicolons:
+//
+//	DURATION SHAPE [ARGS...] [errors=SHARE]
+//
+// SHAPE sets the multiplier of the generator's base rate during the phase:
+//
+//	level R     constant R (1 when left out)
+//	ramp A B    linear from A to B
+//	sine A B    from A up to B halfway through and back down to A
+//
+// errors sets the share, 0 to 1, of generated items that should be errors.
+// A profile repeats once its phases are over, so a generator runs on a
+// profile for as long as it has items left.
+package workload
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builtin holds the profiles every service knows; configured profiles of
+// the same name replace them.
+var Builtin = map[string]string{
+	// steady keeps the base rate.
+	"steady": "1m level 1",
+	// diurnal compresses a day into 24 minutes: quiet at midnight, busiest
+	// at noon.
+	"diurnal": "24m sine 0.1 1",
+	// bursty idles at half the base rate with a burst of five times it
+	// every 30 seconds.
+	"bursty": "25s level 0.5; 5s level 5",
+	// error-storm builds up to a storm of mostly errors at three times the
+	// base rate and recovers.
+	"error-storm": "2m level 1 errors=0.02; 30s ramp 1 3 errors=0.5; 2m level 3 errors=0.9; 30s ramp 3 1 errors=0.3",
+}
+
+// Phase is one step of a profile.
+type Phase struct {
+	Duration time.Duration `json:"duration"`
+	Shape    string        `json:"shape"`
+	From     float64       `json:"from"`
+	To       float64       `json:"to"`
+	Errors   float64       `json:"errors,omitempty"`
+}
+
+// Profile is a parsed workload profile.
+type Profile struct {
+	Name   string  `json:"name"`
+	Phases []Phase `json:"phases"`
+}
+
+// Parse reads the profile text under name.
+func Parse(name, text string) (Profile, error) {
+	p := Profile{Name: name}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		phase, err := parsePhase(fields)
+		if err != nil {
+			return p, fmt.Errorf("profile %s: %q: %w", name, strings.TrimSpace(line), err)
+		}
+		p.Phases = append(p.Phases, phase)
+	}
+	if len(p.Phases) == 0 {
+		return p, fmt.Errorf("profile %s has no phases", name)
+	}
+	return p, nil
+}
+
+func parsePhase(fields []string) (Phase, error) {
+	var phase Phase
+	if len(fields) < 2 {
+		return phase, fmt.Errorf("want DURATION SHAPE [ARGS...]")
+	}
+	d, err := time.ParseDuration(fields[0])
+	if err != nil || d <= 0 {
+		return phase, fmt.Errorf("invalid duration %q", fields[0])
+	}
+	phase.Duration, phase.Shape = d, fields[1]
+
+	var args []float64
+	for _, field := range fields[2:] {
+		if share, ok := strings.CutPrefix(field, "errors="); ok {
+			phase.Errors, err = strconv.ParseFloat(share, 64)
+			if err != nil || phase.Errors < 0 || phase.Errors > 1 {
+				return phase, fmt.Errorf("errors must be between 0 and 1, got %q", share)
+			}
+			continue
+		}
+		arg, err := strconv.ParseFloat(field, 64)
+		if err != nil || arg < 0 {
+			return phase, fmt.Errorf("invalid rate multiplier %q", field)
+		}
+		args = append(args, arg)
+	}
+
+	switch {
+	case phase.Shape == "level" && len(args) == 0:
+		phase.From, phase.To = 1, 1
+	case phase.Shape == "level" && len(args) == 1:
+		phase.From, phase.To = args[0], args[0]
+	case (phase.Shape == "ramp" || phase.Shape == "sine") && len(args) == 2:
+		phase.From, phase.To = args[0], args[1]
+	case phase.Shape == "level", phase.Shape == "ramp", phase.Shape == "sine":
+		return phase, fmt.Errorf("wrong number of arguments for %s", phase.Shape)
+	default:
+		return phase, fmt.Errorf("unknown shape %q, want level, ramp or sine", phase.Shape)
+	}
+	return phase, nil
+}
+
+// Length is the time one pass through the profile takes.
+func (p Profile) Length() time.Duration {
+	var total time.Duration
+	for _, phase := range p.Phases {
+		total += phase.Duration
+	}
+	return total
+}
+
+// At returns the rate multiplier and error share elapsed into the profile.
+func (p Profile) At(elapsed time.Duration) (rate, errors float64) {
+	elapsed %= p.Length()
+	for _, phase := range p.Phases {
+		if elapsed >= phase.Duration {
+			elapsed -= phase.Duration
+			continue
+		}
+		f := float64(elapsed) / float64(phase.Duration)
+		switch phase.Shape {
+		case "ramp":
+			rate = phase.From + (phase.To-phase.From)*f
+		case "sine":
+			rate = phase.From + (phase.To-phase.From)*(1-math.Cos(2*math.Pi*f))/2
+		default:
+			rate = phase.From
+		}
+		return rate, phase.Errors
+	}
+	return 0, 0
+}
+
+// Lookup parses the profile name from configured, falling back to Builtin.
+func Lookup(name string, configured map[string]string) (Profile, error) {
+	text, ok := configured[name]
+	if !ok {
+		text, ok = Builtin[name]
+	}
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown workload profile %q, known: %s", name, strings.Join(Names(configured), ", "))
+	}
+	return Parse(name, text)
+}
+
+// Names lists the built-in and configured profile names.
+func Names(configured map[string]string) []string {
+	var names []string
+	for name := range Builtin {
+		if _, ok := configured[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pacer tells a generator how many items are due when items are produced
+// at a base rate per second shaped by a profile. The first item is due at
+// once.
+type Pacer struct {
+	profile *Profile
+	rate    float64
+	start   time.Time
+	last    time.Time
+	due     float64
+}
+
+// NewPacer starts pacing at start. profile may be nil for a constant rate.
+func NewPacer(profile *Profile, rate float64, start time.Time) *Pacer {
+	return &Pacer{profile: profile, rate: rate, start: start, last: start, due: 1}
+}
+
+// Due returns how many items are due by now in total, and the share of
+// them that should be errors at this point of the profile. Calls must pass
+// increasing times; the rate between two calls is taken from the later.
+func (p *Pacer) Due(now time.Time) (int, float64) {
+	multiplier, errors := 1.0, 0.0
+	if p.profile != nil {
+		multiplier, errors = p.profile.At(now.Sub(p.start))
+	}
+	if now.After(p.last) {
+		p.due += p.rate * multiplier * now.Sub(p.last).Seconds()
+		p.last = now
+	}
+	return int(p.due), errors
+}
@@ -136,7 +136,7 @@ check_service_health "Grafana" "http://localhost:3000/api/health"
 
 # Start microservices
 print_status "Starting microservices..."
-$(get_docker_compose_cmd) up -d api-gateway business-service data-service
+$(get_docker_compose_cmd) up -d api-gateway business-service data-service rollup-service
 
 # Wait for microservices to be ready
 sleep 15
@@ -145,6 +145,7 @@ sleep 15
 check_service_health "API Gateway" "http://localhost:8090/health"
 check_service_health "Business Service" "http://localhost:8081/health"
 check_service_health "Data Service" "http://localhost:8082/health"
+check_service_health "Rollup Service" "http://localhost:8085/health"
 
 # Start Jenkins
 print_status "Starting Jenkins..."
@@ -185,6 +186,7 @@ echo -e "${BLUE}📋 Service Access Information:${NC}"
 echo -e "• API Gateway:     ${GREEN}http://localhost:8090${NC}"
 echo -e "• Business Service:${GREEN}http://localhost:8081${NC}"
 echo -e "• Data Service:    ${GREEN}http://localhost:8082${NC}"
+echo -e "• Rollup Service:  ${GREEN}http://localhost:8085${NC}"
 echo -e "• Grafana:         ${GREEN}http://localhost:3000${NC} (admin/admin)"
 echo -e "• Prometheus:      ${GREEN}http://localhost:9090${NC}"
 echo -e "• Loki:            ${GREEN}http://localhost:3100${NC}"
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/rbac"
+	"pipeline/pkg/response"
+)
+
+var adminCommandRuns = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_admin_commands_total",
+		Help: "Admin commands run on services through the gateway, by service, command and result: ok, failed or denied",
+	},
+	[]string{"service", "command", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(adminCommandRuns)
+}
+
+// AdminCommand is an admin operation of downstream services that
+// /admin/services/{service}/{command} may run, from admin_proxy.commands.
+type AdminCommand struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Services are the upstream names, such as data, the command runs on.
+	Services []string `mapstructure:"services" json:"services"`
+	Method   string   `mapstructure:"method" json:"method"`
+	Path     string   `mapstructure:"path" json:"path"`
+	// Roles, when RBAC is enabled, are required on top of the policies
+	// matching the /admin/services path.
+	Roles       []string `mapstructure:"roles" json:"roles,omitempty"`
+	Description string   `mapstructure:"description" json:"description,omitempty"`
+}
+
+var adminCommands []AdminCommand
+
+// loadAdminCommands reads the admin_proxy.commands allowlist.
+func loadAdminCommands() error {
+	var commands []AdminCommand
+	if err := viper.UnmarshalKey("admin_proxy.commands", &commands); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for i := range commands {
+		c := &commands[i]
+		c.Method = strings.ToUpper(c.Method)
+		switch {
+		case !serviceNamePattern.MatchString(c.Name):
+			return fmt.Errorf("command %q: name must be lowercase letters, digits and dashes", c.Name)
+		case !slices.Contains([]string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}, c.Method):
+			return fmt.Errorf("command %q: method must be GET, POST, PUT or DELETE", c.Name)
+		case !strings.HasPrefix(c.Path, "/"):
+			return fmt.Errorf("command %q: path must start with /", c.Name)
+		case len(c.Services) == 0:
+			return fmt.Errorf("command %q: no services", c.Name)
+		}
+		for _, service := range c.Services {
+			if seen[service+"/"+c.Name] {
+				return fmt.Errorf("command %q listed twice for %s", c.Name, service)
+			}
+			seen[service+"/"+c.Name] = true
+		}
+	}
+	adminCommands = commands
+	return nil
+}
+
+// adminCommandFor returns the command of a service by name, or nil.
+func adminCommandFor(service, name string) *AdminCommand {
+	for i, c := range adminCommands {
+		if c.Name == name && slices.Contains(c.Services, service) {
+			return &adminCommands[i]
+		}
+	}
+	return nil
+}
+
+// AdminTargetResult is one target's answer to an admin command. Targets
+// are named by replica ID, as in cookies and metrics.
+type AdminTargetResult struct {
+	Target string          `json:"target"`
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// AdminCommandResult is the outcome of an admin command on every target of
+// a service.
+type AdminCommandResult struct {
+	Service string              `json:"service"`
+	Command string              `json:"command"`
+	Targets []AdminTargetResult `json:"targets"`
+}
+
+func adminCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	response.Write(w, r, http.StatusOK, adminCommands, nil)
+}
+
+// adminCommandHandler runs an allowlisted command on every target of the
+// service, so that, say, pausing processing reaches all replicas. It
+// answers 200 when all targets succeeded, else the status of the first
+// failure, or 502 when a target could not be reached. The gateway's audit
+// trail records the results.
+func adminCommandHandler(authorizer *rbac.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		service, name := mux.Vars(r)["service"], mux.Vars(r)["command"]
+		pool := lookupUpstream(service)
+		command := adminCommandFor(service, name)
+		if pool == nil || command == nil {
+			http.Error(w, "Unknown service or command", http.StatusNotFound)
+			return
+		}
+		if r.Method != command.Method {
+			w.Header().Set("Allow", command.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if authorizer != nil && len(command.Roles) > 0 {
+			id, _ := rbac.FromContext(r.Context())
+			if !authorizer.Allowed(id, command.Roles) {
+				rbacDenied(r, http.StatusForbidden, rbac.ReasonForbidden, id)
+				adminCommandRuns.WithLabelValues(service, name, "denied").Inc()
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		var targets []string
+		for _, target := range pool.targets() {
+			if target != "" && !slices.Contains(targets, target) {
+				targets = append(targets, target)
+			}
+		}
+		if len(targets) == 0 {
+			http.Error(w, "No instance of the service is registered", http.StatusServiceUnavailable)
+			return
+		}
+		result := AdminCommandResult{Service: service, Command: name, Targets: make([]AdminTargetResult, len(targets))}
+		var wg sync.WaitGroup
+		for i, target := range targets {
+			wg.Add(1)
+			go func(i int, target string) {
+				defer wg.Done()
+				result.Targets[i] = callAdminTarget(r, pool, target, command, body)
+			}(i, target)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		for _, res := range result.Targets {
+			if res.Status < 200 || res.Status >= 300 {
+				status = res.Status
+				if status == 0 {
+					status = http.StatusBadGateway
+				}
+				break
+			}
+		}
+		outcome := "ok"
+		if status != http.StatusOK {
+			outcome = "failed"
+		}
+		adminCommandRuns.WithLabelValues(service, name, outcome).Inc()
+		logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+			"service": service,
+			"command": name,
+			"targets": len(targets),
+			"status":  status,
+		}).Info("Admin command run")
+		audit.SetAfter(r.Context(), result)
+		response.Write(w, r, status, result, nil)
+	}
+}
+
+// callAdminTarget sends the command to one target on behalf of r. Like
+// snapshot operations the caller's credentials are passed on, so the
+// services' endpoint_protection must accept the gateway's admin
+// credentials.
+func callAdminTarget(r *http.Request, pool *upstream, target string, command *AdminCommand, body []byte) AdminTargetResult {
+	result := AdminTargetResult{Target: replicaID(target)}
+	defer pool.begin(target)()
+
+	ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration("admin_proxy.timeout"))
+	defer cancel()
+	traceCtx, release := pool.trace(ctx)
+	defer release()
+	req, err := http.NewRequestWithContext(traceCtx, command.Method, strings.TrimRight(target, "/")+command.Path, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Accept", "application/json")
+	for _, h := range []string{"Authorization", "Content-Type", "traceparent", "tracestate", audit.RequestIDHeader} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	requestContext(r).Inject(req.Header)
+
+	resp, err := (&http.Client{Transport: bootstrap.SignedTransport(viper.GetViper(), pool.transport)}).Do(req)
+	if err != nil {
+		// The cause is logged rather than returned, so upstream addresses
+		// stay internal.
+		logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+			"service": pool.name,
+			"command": command.Name,
+			"target":  target,
+		}).WithError(err).Error("Admin command request failed")
+		result.Error = pool.name + " request failed"
+		return result
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	result.Status = resp.StatusCode
+	switch {
+	case resp.StatusCode >= 300:
+		result.Error = strings.TrimSpace(string(data))
+	case json.Valid(data):
+		result.Result = data
+	}
+	return result
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	upstreamAffinity = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_affinity_total",
+			Help: "Proxied requests on sticky routes, by whether they kept their replica (sticky), got a new one (assigned) or had theirs removed (reassigned)",
+		},
+		[]string{"upstream", "result"},
+	)
+	upstreamReplicaRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_replica_requests_total",
+			Help: "Proxied requests by upstream replica",
+		},
+		[]string{"upstream", "replica"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamAffinity, upstreamReplicaRequests)
+}
+
+// AffinityRule pins the clients of matching routes to one replica of an
+// upstream, keyed by a cookie the gateway sets or by a header the client
+// sends.
+type AffinityRule struct {
+	// Route and Methods match like TransformRule's.
+	Route   string   `mapstructure:"route"`
+	Methods []string `mapstructure:"methods"`
+	// Cookie names the cookie holding the replica ID.
+	Cookie string `mapstructure:"cookie"`
+	// Header names a client-supplied session header; its value is hashed
+	// onto the replicas.
+	Header string `mapstructure:"header"`
+	// TTL is the cookie lifetime; a session cookie when zero.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+var affinityRules []AffinityRule
+
+// loadAffinity reads the affinity config section.
+func loadAffinity() error {
+	var rules []AffinityRule
+	if err := viper.UnmarshalKey("affinity", &rules); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Route == "" {
+			return errors.New("affinity rule without route")
+		}
+		if _, err := path.Match(rule.Route, ""); err != nil {
+			return fmt.Errorf("route %q: %w", rule.Route, err)
+		}
+		if (rule.Cookie == "") == (rule.Header == "") {
+			return fmt.Errorf("route %q: set exactly one of cookie and header", rule.Route)
+		}
+		logrus.WithFields(logrus.Fields{
+			"route":  rule.Route,
+			"cookie": rule.Cookie,
+			"header": rule.Header,
+		}).Info("Loaded affinity rule")
+	}
+	affinityRules = rules
+	return nil
+}
+
+func affinityFor(service, upstreamPath, method string) *AffinityRule {
+	target := service + "/" + upstreamPath
+	for i := range affinityRules {
+		if routeMatches(affinityRules[i].Route, target) && methodMatches(affinityRules[i].Methods, method) {
+			return &affinityRules[i]
+		}
+	}
+	return nil
+}
+
+// targets returns the base URLs proxied requests are balanced over: the
+// standby while failed over, else the active blue/green color, else the
+// self-registered instances, else upstreams.<name>.replicas, else the
+// primary.
+func (u *upstream) targets() []string {
+	active := u.activeURL()
+	if active != u.primaryURL() {
+		return []string{active}
+	}
+	if urls := u.colorURLs(u.activeColor()); len(urls) > 0 {
+		return urls
+	}
+	if registered := registeredTargets(u.name); len(registered) > 0 {
+		return registered
+	}
+	if replicas := viper.GetStringSlice("upstreams." + u.name + ".replicas"); len(replicas) > 0 {
+		return replicas
+	}
+	return []string{active}
+}
+
+// balance picks the next target round-robin.
+func (u *upstream) balance() string {
+	targets := u.targets()
+	return targets[(u.next.Add(1)-1)%uint64(len(targets))]
+}
+
+// replicaID names a target in cookies and metrics without exposing its URL.
+func replicaID(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sum[:4])
+}
+
+// targetFor picks the target of a proxied request, honouring the affinity
+// rule of its route. New cookie sessions get a Set-Cookie on w.
+func (u *upstream) targetFor(w http.ResponseWriter, r *http.Request, upstreamPath string) string {
+	target := u.pickTarget(w, r, upstreamPath)
+	upstreamReplicaRequests.WithLabelValues(u.name, replicaID(target)).Inc()
+	return target
+}
+
+func (u *upstream) pickTarget(w http.ResponseWriter, r *http.Request, upstreamPath string) string {
+	targets := u.targets()
+	rule := affinityFor(u.name, upstreamPath, r.Method)
+	if rule == nil || len(targets) == 1 {
+		return u.balance()
+	}
+
+	if rule.Header != "" {
+		key := r.Header.Get(rule.Header)
+		if key == "" {
+			return u.balance()
+		}
+		upstreamAffinity.WithLabelValues(u.name, "sticky").Inc()
+		return rendezvous(key, targets)
+	}
+
+	result := "assigned"
+	if c, err := r.Cookie(rule.Cookie); err == nil {
+		for _, target := range targets {
+			if replicaID(target) == c.Value {
+				upstreamAffinity.WithLabelValues(u.name, "sticky").Inc()
+				return target
+			}
+		}
+		result = "reassigned"
+	}
+	upstreamAffinity.WithLabelValues(u.name, result).Inc()
+	target := u.balance()
+	cookie := &http.Cookie{
+		Name:     rule.Cookie,
+		Value:    replicaID(target),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if rule.TTL > 0 {
+		cookie.MaxAge = int(rule.TTL.Seconds())
+	}
+	http.SetCookie(w, cookie)
+	return target
+}
+
+// rendezvous hashes key onto targets so that removing a target only moves
+// the keys that were on it.
+func rendezvous(key string, targets []string) string {
+	var best string
+	var bestScore uint64
+	for _, target := range targets {
+		sum := sha256.Sum256([]byte(key + "\x00" + target))
+		if score := binary.BigEndian.Uint64(sum[:8]); best == "" || score > bestScore {
+			best, bestScore = target, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+)
+
+// auditRecorder records mutating API calls; it is nil when audit.enabled is
+// false.
+var auditRecorder *audit.Recorder
+
+// auditActors names the callers of audited requests: the caller rbac
+// verified, else the X-Forwarded-User of a request from
+// audit.trusted_proxies.
+var auditActors *audit.Actors
+
+func newAuditActors() (*audit.Actors, error) {
+	return audit.NewActors(apiKeyID, viper.GetStringSlice("audit.trusted_proxies"))
+}
+
+// newAuditRecorder opens the append-only audit store at audit.path.
+func newAuditRecorder(serviceName string) (*audit.Recorder, error) {
+	store, err := audit.NewFileStore(viper.GetString("audit.path"))
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewRecorder(store, audit.Config{
+		Service:         serviceName,
+		MaxSummaryBytes: viper.GetInt("audit.max_summary_bytes"),
+		Actors:          auditActors,
+		RouteFunc:       routeTemplate,
+		OnError: func(err error) {
+			logrus.WithError(err).Error("Failed to write audit event")
+		},
+	}), nil
+}
+
+func auditMiddleware(next http.Handler) http.Handler {
+	if auditRecorder == nil {
+		return next
+	}
+	return auditRecorder.Wrap(next)
+}
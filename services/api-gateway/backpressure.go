@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// backpressureHeader is set by services on every response to report their
+// backlog: ok, elevated or overloaded, optionally followed by "; load=...".
+const backpressureHeader = "X-Backpressure"
+
+var (
+	backpressureState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_upstream_backpressure",
+			Help: "Backpressure an upstream reports: 0 ok, 1 elevated, 2 overloaded",
+		},
+		[]string{"upstream"},
+	)
+	backpressureRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_backpressure_requests_total",
+			Help: "Write requests held back while an upstream was overloaded, by outcome: forwarded or rejected",
+		},
+		[]string{"upstream", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(backpressureState, backpressureRequests)
+}
+
+var backpressureLevels = map[string]float64{"ok": 0, "elevated": 1, "overloaded": 2}
+
+// backpressure is the last state an upstream reported, from the header of
+// any proxied response or from polling its backpressure endpoint. Writes
+// wait on cleared while it is overloaded.
+type backpressure struct {
+	mu      sync.Mutex
+	state   string
+	updated time.Time
+	cleared chan struct{}
+	waiting int
+}
+
+// backpressureEnabled reports whether the upstream's writes are held back
+// on its backpressure.
+func (u *upstream) backpressureEnabled() bool {
+	return viper.GetBool("backpressure.enabled") && slices.Contains(viper.GetStringSlice("backpressure.upstreams"), u.name)
+}
+
+// observeBackpressure records the value of a backpressureHeader; values
+// without a known state are ignored.
+func (u *upstream) observeBackpressure(header string) {
+	state, _, _ := strings.Cut(header, ";")
+	state = strings.TrimSpace(state)
+	level, ok := backpressureLevels[state]
+	if !ok {
+		return
+	}
+
+	b := &u.backpressure
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updated = time.Now()
+	if state == b.state {
+		return
+	}
+	switch {
+	case state == "overloaded":
+		b.cleared = make(chan struct{})
+		logrus.WithField("upstream", u.name).Warn("Upstream overloaded, holding back writes")
+	case b.state == "overloaded":
+		close(b.cleared)
+		logrus.WithField("upstream", u.name).Info("Upstream no longer overloaded")
+	}
+	b.state = state
+	backpressureState.WithLabelValues(u.name).Set(level)
+}
+
+// overloaded returns the channel that is closed when the upstream stops
+// being overloaded, or nil if it is not. A state older than
+// backpressure.stale_after is not trusted, so a service that stops
+// reporting does not block writes forever.
+func (b *backpressure) overloaded() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != "overloaded" || time.Since(b.updated) > viper.GetDuration("backpressure.stale_after") {
+		return nil
+	}
+	return b.cleared
+}
+
+// admitWrite holds a write request back while the upstream is overloaded,
+// for up to backpressure.max_wait and with at most backpressure.max_waiting
+// requests waiting. It returns false if the request should be rejected.
+func (u *upstream) admitWrite(ctx context.Context) bool {
+	cleared := u.backpressure.overloaded()
+	if cleared == nil {
+		return true
+	}
+
+	b := &u.backpressure
+	b.mu.Lock()
+	if b.waiting >= viper.GetInt("backpressure.max_waiting") {
+		b.mu.Unlock()
+		backpressureRequests.WithLabelValues(u.name, "rejected").Inc()
+		return false
+	}
+	b.waiting++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.waiting--
+		b.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(viper.GetDuration("backpressure.max_wait"))
+	defer timer.Stop()
+	select {
+	case <-cleared:
+		backpressureRequests.WithLabelValues(u.name, "forwarded").Inc()
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	backpressureRequests.WithLabelValues(u.name, "rejected").Inc()
+	return false
+}
+
+// isWrite reports whether a proxied request adds to an upstream's backlog.
+func isWrite(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch
+}
+
+// writeBackpressureRejection answers a write turned away by admitWrite.
+func writeBackpressureRejection(w http.ResponseWriter, serviceName string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(viper.GetDuration("backpressure.retry_after").Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     "upstream overloaded",
+		"service":   serviceName,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// startBackpressurePolling polls the backpressure endpoint of each upstream
+// with backpressure enabled every backpressure.poll_interval, so an
+// overloaded upstream is seen to recover while no writes reach it.
+func startBackpressurePolling() func() {
+	if !viper.GetBool("backpressure.enabled") {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, u := range upstreams {
+		if !u.backpressureEnabled() {
+			continue
+		}
+		go func(u *upstream) {
+			ticker := time.NewTicker(viper.GetDuration("backpressure.poll_interval"))
+			defer ticker.Stop()
+			for {
+				resp, err := client.Get(u.activeURL() + viper.GetString("backpressure.path"))
+				if err != nil {
+					logrus.WithError(err).WithField("upstream", u.name).Debug("Backpressure poll failed")
+				} else {
+					resp.Body.Close()
+					u.observeBackpressure(resp.Header.Get(backpressureHeader))
+				}
+				select {
+				case <-ticker.C:
+				case <-stop:
+					return
+				}
+			}
+		}(u)
+	}
+	return func() { close(stop) }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/correlate"
+	"pipeline/pkg/incident"
+	"pipeline/pkg/response"
+)
+
+// correlator gathers the evidence of incidents opened by alerts; it is nil
+// when correlation.enabled is false or incidents are disabled.
+var correlator *correlate.Correlator
+
+// correlationQueue holds the IDs of incidents waiting for their report.
+var correlationQueue = make(chan string, 64)
+
+func startCorrelation() func() {
+	if !viper.GetBool("correlation.enabled") || incidentStore == nil {
+		return func() {}
+	}
+	correlator = correlate.New(correlate.Config{
+		PrometheusURL:    viper.GetString("correlation.prometheus_url"),
+		LokiURL:          viper.GetString("correlation.loki_url"),
+		Lookback:         viper.GetDuration("correlation.lookback"),
+		Timeout:          viper.GetDuration("correlation.timeout"),
+		SlowTraceMin:     viper.GetDuration("correlation.slow_traces.min_duration"),
+		MaxTraces:        viper.GetInt("correlation.slow_traces.max"),
+		ErrorSpikeFactor: viper.GetFloat64("correlation.error_logs.spike_factor"),
+		MinErrors:        viper.GetInt("correlation.error_logs.min_errors"),
+		BacklogQuery:     viper.GetString("correlation.backlog.query"),
+		MinBacklogGrowth: viper.GetFloat64("correlation.backlog.min_growth"),
+		Deploys:          blueGreenSwitches,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-correlationQueue:
+				if _, err := correlateIncident(ctx, id, "correlation"); err != nil {
+					logrus.WithError(err).WithField("incident", id).Error("Failed to save incident")
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// queueCorrelation asks for the correlation report of an incident an alert
+// just opened. Reports are built one at a time; when the queue is full the
+// incident goes without.
+func queueCorrelation(id string) {
+	if correlator == nil {
+		return
+	}
+	select {
+	case correlationQueue <- id:
+	default:
+		logrus.WithField("incident", id).Warn("Correlation queue full, incident not correlated")
+	}
+}
+
+// correlateIncident builds the report of an incident and attaches it.
+func correlateIncident(ctx context.Context, id, actor string) (incident.Incident, error) {
+	in, ok := incidentStore.Get(id)
+	if !ok {
+		return incident.Incident{}, incident.ErrNotFound
+	}
+	report := correlator.Correlate(ctx, in)
+	fields := logrus.Fields{"incident": id, "evidence": len(report.Evidence)}
+	if len(report.Errors) > 0 {
+		fields["errors"] = report.Errors
+	}
+	logrus.WithFields(fields).Info("Incident correlated")
+	return incidentStore.Correlate(id, report, actor)
+}
+
+// blueGreenSwitches reports the blue/green switches of the upstreams in
+// [from, to] as deploys.
+func blueGreenSwitches(from, to time.Time) []incident.Evidence {
+	var found []incident.Evidence
+	for _, name := range upstreamNames {
+		u := upstreams[name]
+		if u == nil || !u.blueGreen() {
+			continue
+		}
+		status := u.deploymentStatus()
+		if status.SwitchedAt == nil || status.SwitchedAt.Before(from) || status.SwitchedAt.After(to) {
+			continue
+		}
+		found = append(found, incident.Evidence{
+			Kind:    correlate.KindDeploy,
+			Service: name + "-service",
+			At:      *status.SwitchedAt,
+			Summary: fmt.Sprintf("%s was switched to its %s deployment", name, status.Active),
+		})
+	}
+	return found
+}
+
+// correlateIncidentHandler rebuilds an incident's correlation report, such
+// as after an incident opened by hand or once the sources have caught up.
+func correlateIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := correlateIncident(r.Context(), mux.Vars(r)["id"], auditActors.Actor(r))
+	if err != nil {
+		writeIncidentError(w, r, err)
+		return
+	}
+	response.Write(w, r, http.StatusOK, in, nil)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	deploymentSwitches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_deployment_switches_total",
+			Help: "Blue/green switches of an upstream, by the color switched to",
+		},
+		[]string{"upstream", "to"},
+	)
+	upstreamActiveColor = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_upstream_active_color",
+			Help: "1 for the blue/green color currently receiving an upstream's traffic",
+		},
+		[]string{"upstream", "color"},
+	)
+	deploymentDraining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_deployment_draining_requests",
+			Help: "In-flight requests to the color an upstream was switched away from",
+		},
+		[]string{"upstream"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deploymentSwitches, upstreamActiveColor, deploymentDraining)
+}
+
+var deploymentColors = []string{"blue", "green"}
+
+// deployment is the blue/green state of an upstream. Colors are URL sets
+// from deployments.<name>.blue and .green; the active one replaces the
+// replicas as proxy targets.
+type deployment struct {
+	mu         sync.Mutex
+	active     string
+	switchedAt time.Time
+	draining   string
+	generation int
+
+	// inflight counts proxied requests per target URL, so the old color can
+	// be drained.
+	inflight sync.Map
+}
+
+// deploymentState is what deployments.path keeps across restarts.
+type deploymentState struct {
+	Active     string    `json:"active"`
+	SwitchedAt time.Time `json:"switched_at"`
+}
+
+func (u *upstream) colorURLs(color string) []string {
+	return viper.GetStringSlice("deployments." + u.name + "." + color)
+}
+
+// blueGreen reports whether the upstream has blue/green URL sets.
+func (u *upstream) blueGreen() bool {
+	return len(u.colorURLs("blue")) > 0 || len(u.colorURLs("green")) > 0
+}
+
+func (u *upstream) activeColor() string {
+	u.deploy.mu.Lock()
+	defer u.deploy.mu.Unlock()
+	return u.deploy.active
+}
+
+// begin counts a request to target as in flight until the returned func is
+// called.
+func (u *upstream) begin(target string) func() {
+	v, _ := u.deploy.inflight.LoadOrStore(target, new(atomic.Int64))
+	n := v.(*atomic.Int64)
+	n.Add(1)
+	return func() { n.Add(-1) }
+}
+
+func (u *upstream) inflightTo(urls []string) int64 {
+	var total int64
+	for _, url := range urls {
+		if v, ok := u.deploy.inflight.Load(url); ok {
+			total += v.(*atomic.Int64).Load()
+		}
+	}
+	return total
+}
+
+func (u *upstream) reportColor() {
+	if !u.blueGreen() {
+		return
+	}
+	active := u.activeColor()
+	for _, color := range deploymentColors {
+		value := 0.0
+		if color == active {
+			value = 1
+		}
+		upstreamActiveColor.WithLabelValues(u.name, color).Set(value)
+	}
+}
+
+// loadDeployments restores the active colors saved at deployments.path,
+// defaulting to deployments.<name>.active.
+func loadDeployments() {
+	saved := make(map[string]deploymentState)
+	if data, err := os.ReadFile(viper.GetString("deployments.path")); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			logrus.WithError(err).Warn("Ignoring unreadable deployment state")
+		}
+	}
+	for _, name := range upstreamNames {
+		u := upstreams[name]
+		active := viper.GetString("deployments." + name + ".active")
+		if state, ok := saved[name]; ok {
+			active = state.Active
+			u.deploy.switchedAt = state.SwitchedAt
+		}
+		if active != "green" {
+			active = "blue"
+		}
+		u.deploy.active = active
+		u.reportColor()
+	}
+}
+
+func saveDeployments() error {
+	state := make(map[string]deploymentState)
+	for _, name := range upstreamNames {
+		u := upstreams[name]
+		if !u.blueGreen() {
+			continue
+		}
+		u.deploy.mu.Lock()
+		state[name] = deploymentState{Active: u.deploy.active, SwitchedAt: u.deploy.switchedAt}
+		u.deploy.mu.Unlock()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := viper.GetString("deployments.path")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// switchColor makes color the active one. Requests still in flight to the
+// old color may finish for up to drain; then the pooled connections are
+// closed.
+func (u *upstream) switchColor(color string, drain time.Duration) {
+	d := &u.deploy
+	d.mu.Lock()
+	previous := d.active
+	d.active = color
+	d.switchedAt = time.Now().UTC()
+	d.draining = previous
+	d.generation++
+	generation := d.generation
+	d.mu.Unlock()
+
+	u.reportColor()
+	deploymentSwitches.WithLabelValues(u.name, color).Inc()
+	logrus.WithFields(logrus.Fields{
+		"upstream": u.name,
+		"from":     previous,
+		"to":       color,
+		"targets":  u.colorURLs(color),
+		"drain":    drain.String(),
+	}).Warn("Switched blue/green deployment")
+
+	go u.drain(previous, generation, drain)
+}
+
+func (u *upstream) drain(color string, generation int, timeout time.Duration) {
+	urls := u.colorURLs(color)
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	remaining := u.inflightTo(urls)
+	for remaining > 0 && time.Now().Before(deadline) {
+		deploymentDraining.WithLabelValues(u.name).Set(float64(remaining))
+		<-ticker.C
+		remaining = u.inflightTo(urls)
+	}
+	deploymentDraining.WithLabelValues(u.name).Set(0)
+
+	u.deploy.mu.Lock()
+	current := u.deploy.generation == generation
+	if current {
+		u.deploy.draining = ""
+	}
+	u.deploy.mu.Unlock()
+	if !current {
+		return
+	}
+	u.transport.CloseIdleConnections()
+	logrus.WithFields(logrus.Fields{
+		"upstream":  u.name,
+		"color":     color,
+		"abandoned": remaining,
+	}).Info("Drained previous blue/green deployment")
+}
+
+type deploymentStatus struct {
+	Upstream   string     `json:"upstream"`
+	Active     string     `json:"active"`
+	Blue       []string   `json:"blue"`
+	Green      []string   `json:"green"`
+	SwitchedAt *time.Time `json:"switched_at,omitempty"`
+	Draining   string     `json:"draining,omitempty"`
+	Inflight   int64      `json:"draining_requests,omitempty"`
+}
+
+func (u *upstream) deploymentStatus() deploymentStatus {
+	u.deploy.mu.Lock()
+	status := deploymentStatus{
+		Upstream: u.name,
+		Active:   u.deploy.active,
+		Draining: u.deploy.draining,
+	}
+	if !u.deploy.switchedAt.IsZero() {
+		at := u.deploy.switchedAt
+		status.SwitchedAt = &at
+	}
+	u.deploy.mu.Unlock()
+	status.Blue = u.colorURLs("blue")
+	status.Green = u.colorURLs("green")
+	if status.Draining != "" {
+		status.Inflight = u.inflightTo(u.colorURLs(status.Draining))
+	}
+	return status
+}
+
+// deploymentsHandler lists the blue/green state of the upstreams that have
+// colors configured.
+func deploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []deploymentStatus{}
+	for _, name := range upstreamNames {
+		if u := upstreams[name]; u.blueGreen() {
+			list = append(list, u.deploymentStatus())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// switchDeploymentHandler switches ?upstream= to ?color=. Every URL of the
+// new color must pass its health check unless force=true; drain overrides
+// deployments.drain_timeout.
+func switchDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	u, ok := upstreams[q.Get("upstream")]
+	if !ok {
+		http.Error(w, "unknown upstream", http.StatusNotFound)
+		return
+	}
+	color := q.Get("color")
+	if color != "blue" && color != "green" {
+		http.Error(w, "color must be blue or green", http.StatusBadRequest)
+		return
+	}
+	urls := u.colorURLs(color)
+	if len(urls) == 0 {
+		http.Error(w, fmt.Sprintf("deployments.%s.%s has no URLs", u.name, color), http.StatusBadRequest)
+		return
+	}
+	drain := viper.GetDuration("deployments.drain_timeout")
+	if v := q.Get("drain"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid drain", http.StatusBadRequest)
+			return
+		}
+		drain = d
+	}
+	if u.activeColor() == color {
+		http.Error(w, u.name+" is already on "+color, http.StatusConflict)
+		return
+	}
+	if q.Get("force") != "true" {
+		for _, url := range urls {
+			if !checkHealth(url) {
+				http.Error(w, url+" is not healthy; pass force=true to switch anyway", http.StatusConflict)
+				return
+			}
+		}
+	}
+
+	u.switchColor(color, drain)
+	if err := saveDeployments(); err != nil {
+		logrus.WithError(err).Error("Failed to save deployment state")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u.deploymentStatus())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var serviceIncompatible = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "gateway_service_incompatible",
+		Help: "Whether a downstream service falls short of its discovery.requirements (1) or not (0)",
+	},
+	[]string{"service"},
+)
+
+func init() {
+	prometheus.MustRegister(serviceIncompatible)
+}
+
+// ServiceInfo is what a service reports on its / endpoint.
+type ServiceInfo struct {
+	Version      string    `json:"version"`
+	APIVersions  []string  `json:"api_versions"`
+	Capabilities []string  `json:"capabilities"`
+	Updated      time.Time `json:"-"`
+}
+
+// Requirement is what the gateway needs of a service, from
+// discovery.requirements.<service>.
+type Requirement struct {
+	// MinVersion is the lowest dotted version accepted, empty for any.
+	MinVersion   string   `mapstructure:"min_version"`
+	APIVersions  []string `mapstructure:"api_versions"`
+	Capabilities []string `mapstructure:"capabilities"`
+}
+
+// serviceRequirements reads discovery.requirements, by service name.
+func serviceRequirements() map[string]Requirement {
+	var requirements map[string]Requirement
+	if err := viper.UnmarshalKey("discovery.requirements", &requirements); err != nil {
+		logrus.WithError(err).Warn("Invalid discovery.requirements, ignored")
+		return nil
+	}
+	return requirements
+}
+
+// discoverServicesContinuously reads the / endpoint of every registered
+// service at once and then every discovery.interval.
+func discoverServicesContinuously() {
+	ticker := time.NewTicker(viper.GetDuration("discovery.interval"))
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		requirements := serviceRequirements()
+		for _, s := range registeredServices() {
+			s.discover(requirements[s.name])
+		}
+	}
+}
+
+// discover refreshes the service's info and checks it against req. When /
+// cannot be read the previous info is kept.
+func (s *registeredService) discover(req Requirement) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("health.timeout"))
+	defer cancel()
+	info, err := fetchServiceInfo(ctx, s.url)
+	if err != nil {
+		logrus.WithError(err).WithField("service", s.name).Debug("Failed to fetch service info")
+		return
+	}
+	info.Updated = time.Now().UTC()
+	problems := incompatibilities(info, req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.info.Version != "" && s.info.Version != info.Version {
+		logrus.WithFields(logrus.Fields{"service": s.name, "from": s.info.Version, "to": info.Version}).Info("Service version changed")
+	}
+	if len(problems) > 0 && !slices.Equal(problems, s.incompatible) {
+		logrus.WithFields(logrus.Fields{
+			"service":  s.name,
+			"version":  info.Version,
+			"problems": problems,
+		}).Warn("Service is incompatible with the gateway")
+	}
+	s.info, s.incompatible = info, problems
+	if len(problems) > 0 {
+		serviceIncompatible.WithLabelValues(s.name).Set(1)
+	} else {
+		serviceIncompatible.WithLabelValues(s.name).Set(0)
+	}
+}
+
+func fetchServiceInfo(ctx context.Context, url string) (ServiceInfo, error) {
+	var info ServiceInfo
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/", nil)
+	if err != nil {
+		return info, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("%s/ returned %d", url, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// incompatibilities lists how info falls short of req.
+func incompatibilities(info ServiceInfo, req Requirement) []string {
+	var problems []string
+	if req.MinVersion != "" && compareVersions(info.Version, req.MinVersion) < 0 {
+		problems = append(problems, fmt.Sprintf("version %q is below %s", info.Version, req.MinVersion))
+	}
+	for _, v := range req.APIVersions {
+		if !slices.Contains(info.APIVersions, v) {
+			problems = append(problems, "missing API version "+v)
+		}
+	}
+	for _, c := range req.Capabilities {
+		if !slices.Contains(info.Capabilities, c) {
+			problems = append(problems, "missing capability "+c)
+		}
+	}
+	return problems
+}
+
+// compareVersions compares dotted versions such as 1.4.0 part by part,
+// ignoring a leading v and anything from a - or +. Parts that are not
+// numbers count as 0.
+func compareVersions(a, b string) int {
+	parts := func(v string) []int {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		var nums []int
+		for _, p := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(p)
+			nums = append(nums, n)
+		}
+		return nums
+	}
+	pa, pb := parts(a), parts(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	upstreamFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_failovers_total",
+			Help: "Switches between an upstream's primary and standby URL",
+		},
+		[]string{"upstream", "to"},
+	)
+	upstreamActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_upstream_active_target",
+			Help: "1 for the target (primary or standby) the proxy currently sends an upstream's traffic to",
+		},
+		[]string{"upstream", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamFailovers, upstreamActive)
+}
+
+// failover tracks which of an upstream's URLs receives proxied traffic. The
+// health loop feeds it the primary's check results; after
+// failover.unhealthy_threshold consecutive failures traffic moves to
+// failover.standby.<name> if that is healthy, and after
+// failover.healthy_threshold consecutive successes it moves back.
+type failover struct {
+	mu        sync.Mutex
+	onStandby bool
+	failures  int
+	successes int
+}
+
+// primaryURL and standbyURL are read on every call so remote config changes
+// apply without a restart.
+func (u *upstream) primaryURL() string {
+	return viper.GetString("services." + u.name)
+}
+
+func (u *upstream) standbyURL() string {
+	return viper.GetString("failover.standby." + u.name)
+}
+
+// activeURL returns the base URL proxied requests should go to.
+func (u *upstream) activeURL() string {
+	u.failover.mu.Lock()
+	onStandby := u.failover.onStandby
+	u.failover.mu.Unlock()
+
+	if standby := u.standbyURL(); onStandby && standby != "" {
+		return standby
+	}
+	return u.primaryURL()
+}
+
+// observePrimaryHealth records a health check of the primary URL and fails
+// over or back when a threshold is crossed.
+func (u *upstream) observePrimaryHealth(healthy bool) {
+	standby := u.standbyURL()
+	// Checked before locking so proxied requests are not held up; only
+	// needed while the primary is failing.
+	standbyHealthy := !healthy && standby != "" && checkHealth(standby)
+
+	f := &u.failover
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if healthy {
+		f.failures = 0
+		f.successes++
+	} else {
+		f.successes = 0
+		f.failures++
+	}
+
+	switch {
+	case !f.onStandby && standby != "" && f.failures >= threshold("failover.unhealthy_threshold"):
+		// Only move traffic if the standby can take it.
+		if !standbyHealthy {
+			if f.failures == threshold("failover.unhealthy_threshold") {
+				logrus.WithFields(logrus.Fields{"upstream": u.name, "standby": standby}).
+					Error("Primary unhealthy but standby is unhealthy too; not failing over")
+			}
+			return
+		}
+		f.onStandby = true
+		upstreamFailovers.WithLabelValues(u.name, "standby").Inc()
+		logrus.WithFields(logrus.Fields{
+			"upstream":      u.name,
+			"primary":       u.primaryURL(),
+			"standby":       standby,
+			"failed_checks": f.failures,
+		}).Warn("Failing over to standby upstream")
+	case f.onStandby && (standby == "" || f.successes >= threshold("failover.healthy_threshold")):
+		f.onStandby = false
+		upstreamFailovers.WithLabelValues(u.name, "primary").Inc()
+		logrus.WithFields(logrus.Fields{
+			"upstream":          u.name,
+			"primary":           u.primaryURL(),
+			"successful_checks": f.successes,
+		}).Info("Failing back to primary upstream")
+	default:
+		return
+	}
+	// Pooled connections belong to the previous target.
+	u.transport.CloseIdleConnections()
+	u.reportActive()
+}
+
+func (u *upstream) reportActive() {
+	primary, standby := 1.0, 0.0
+	if u.failover.onStandby {
+		primary, standby = 0, 1
+	}
+	upstreamActive.WithLabelValues(u.name, "primary").Set(primary)
+	upstreamActive.WithLabelValues(u.name, "standby").Set(standby)
+}
+
+// upstreamForService maps a health-checked service name such as
+// "business-service" to its proxy upstream.
+func upstreamForService(serviceName string) *upstream {
+	return lookupUpstream(upstreamName(serviceName))
+}
+
+func threshold(key string) int {
+	if n := viper.GetInt(key); n > 0 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/response"
+)
+
+// upstreamError is a failed read of a service's REST API made by the gateway
+// itself rather than proxied. The cause of transport errors is logged rather
+// than returned, so upstream addresses stay internal.
+type upstreamError struct {
+	service string
+	status  int
+	err     error
+	// limited is set when the upstream's concurrency limit refused the
+	// request before it was sent.
+	limited bool
+}
+
+func (e *upstreamError) Error() string {
+	if e.err != nil {
+		return e.service + "-service request failed"
+	}
+	return fmt.Sprintf("%s-service returned %d", e.service, e.status)
+}
+
+// Extensions reports the failure in GraphQL errors.
+func (e *upstreamError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": "UPSTREAM_ERROR", "service": e.service + "-service"}
+	if e.status != 0 {
+		ext["status"] = e.status
+	}
+	return ext
+}
+
+// fetchUpstream GETs path from the service's upstream pool on behalf of r
+// and decodes the data of the response envelope, or the bare response, into
+// out. It returns the envelope's pagination, if any. Like proxied requests
+// it is balanced over the upstream's targets, counted against its
+// concurrency limit, signed, and carries r's trace and propagated context
+// headers; links in the response point through the proxy. The response
+// transforms of the proxied route run on the response too, so fields they
+// strip never reach the gateway's own views either.
+func fetchUpstream(ctx context.Context, r *http.Request, service, path string, query url.Values, out interface{}) (pagination *response.Pagination, err error) {
+	pool := upstreams[service]
+	base := pool.balance()
+	upstreamReplicaRequests.WithLabelValues(service, replicaID(base)).Inc()
+	defer pool.begin(base)()
+
+	defer func() {
+		var uerr *upstreamError
+		if errors.As(err, &uerr) && uerr.err != nil {
+			logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+				"service": service,
+				"path":    path,
+				"target":  base,
+			}).WithError(uerr.err).Error("Upstream fetch failed")
+		}
+	}()
+
+	start := time.Now()
+	failed := false
+	if limiter := upstreamLimiters[service]; limiter != nil {
+		done, ok := limiter.Acquire()
+		if !ok {
+			return nil, &upstreamError{service: service, status: http.StatusServiceUnavailable, limited: true}
+		}
+		defer func() { done(time.Since(start), failed) }()
+	}
+
+	target := strings.TrimRight(base, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	traceCtx, release := pool.trace(ctx)
+	defer release()
+	req, err := http.NewRequestWithContext(traceCtx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, &upstreamError{service: service, err: err}
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(response.PrefixHeader, "/api/v1/proxy/"+service)
+	for _, h := range []string{"traceparent", "tracestate", audit.RequestIDHeader} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	requestContext(r).Inject(req.Header)
+
+	resp, err := (&http.Client{Transport: bootstrap.SignedTransport(viper.GetViper(), pool.transport)}).Do(req)
+	if err != nil {
+		failed = true
+		if ctx.Err() == nil {
+			pool.connectionFailed(req.URL.Hostname())
+		}
+		return nil, &upstreamError{service: service, err: err}
+	}
+	defer resp.Body.Close()
+	failed = resp.StatusCode >= 500
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, &upstreamError{service: service, status: resp.StatusCode}
+	}
+	if err := applyResponseTransforms(transformsFor(service, strings.TrimPrefix(path, "/"), http.MethodGet), resp); err != nil {
+		return nil, &upstreamError{service: service, err: err}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &upstreamError{service: service, err: err}
+	}
+	var envelope struct {
+		Data       json.RawMessage      `json:"data"`
+		Pagination *response.Pagination `json:"pagination"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, &upstreamError{service: service, err: fmt.Errorf("invalid response: %w", err)}
+	}
+	// Endpoints that predate the envelope, such as /api/v1/records/stats,
+	// answer with the bare resource.
+	if envelope.Data == nil {
+		envelope.Data = body
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return nil, &upstreamError{service: service, err: fmt.Errorf("invalid response: %w", err)}
+	}
+	return envelope.Pagination, nil
+}
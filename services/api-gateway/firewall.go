@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/firewall"
+)
+
+// newFirewall builds the IP filter and request inspection rules from the
+// firewall config section. Blocked requests are logged and audited.
+func newFirewall() (*firewall.Firewall, error) {
+	if !viper.GetBool("firewall.enabled") {
+		return firewall.New(firewall.Config{})
+	}
+	var rules []firewall.Rule
+	if err := viper.UnmarshalKey("firewall.rules", &rules); err != nil {
+		return nil, fmt.Errorf("firewall.rules: %w", err)
+	}
+	return firewall.New(firewall.Config{
+		AllowCIDRs:        viper.GetStringSlice("firewall.allow_cidrs"),
+		DenyCIDRs:         viper.GetStringSlice("firewall.deny_cidrs"),
+		TrustedProxies:    viper.GetStringSlice("firewall.trusted_proxies"),
+		DisallowedMethods: viper.GetStringSlice("firewall.disallowed_methods"),
+		MaxQueryParams:    viper.GetInt("firewall.max_query_params"),
+		MaxBodyBytes:      viper.GetInt64("firewall.max_body_bytes"),
+		Rules:             rules,
+		ExemptPaths:       viper.GetStringSlice("firewall.exempt_paths"),
+		OnBlock:           firewallBlocked,
+	})
+}
+
+func firewallBlocked(r *http.Request, status int, reason, rule string) {
+	logrus.WithFields(logrus.Fields{
+		"reason":      reason,
+		"rule":        rule,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"remote_addr": r.RemoteAddr,
+		"forwarded":   r.Header.Get("X-Forwarded-For"),
+	}).Warn("Request blocked by firewall")
+	if auditRecorder != nil {
+		summary := "blocked: " + reason
+		if rule != "" {
+			summary += " (" + rule + ")"
+		}
+		auditRecorder.Record(r, status, summary)
+	}
+}
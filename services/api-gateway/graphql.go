@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/graphql"
+	"pipeline/pkg/response"
+)
+
+var (
+	graphqlRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_graphql_requests_total",
+			Help: "GraphQL requests by result: ok, partial (data with errors) or error (rejected before execution)",
+		},
+		[]string{"result"},
+	)
+	graphqlDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gateway_graphql_request_duration_seconds",
+			Help:    "Time to execute a GraphQL request, including the upstream fan-out",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	graphqlUpstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_graphql_upstream_requests_total",
+			Help: "Upstream requests made to resolve GraphQL queries, by service and outcome",
+		},
+		[]string{"service", "outcome"},
+	)
+	graphqlBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gateway_graphql_batch_keys",
+			Help:    "Keys fetched per batched upstream request, by loader",
+			Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250},
+		},
+		[]string{"loader"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(graphqlRequests, graphqlDuration, graphqlUpstreamRequests, graphqlBatchSize)
+}
+
+// graphqlServices maps the service names of the schema to upstreams.
+var graphqlServices = []struct{ name, upstream string }{
+	{"business-service", "business"},
+	{"data-service", "data"},
+}
+
+// Wire types of the services' /api/v2 resources.
+type gqlOrder struct {
+	ID         string    `json:"id"`
+	Product    string    `json:"product"`
+	Quantity   int       `json:"quantity"`
+	PriceCents int64     `json:"price_cents"`
+	TotalCents int64     `json:"total_cents"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	CustomerID string    `json:"customer_id"`
+}
+
+type gqlRecord struct {
+	ID            string            `json:"id"`
+	Type          string            `json:"type"`
+	Data          map[string]string `json:"data"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Processed     bool              `json:"processed"`
+	ProcessedAt   *time.Time        `json:"processed_at"`
+	TraceID       string            `json:"trace_id"`
+	JobID         string            `json:"job_id"`
+	OrderID       string            `json:"order_id"`
+	CorrelationID string            `json:"correlation_id"`
+}
+
+type gqlJob struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+	Records   int        `json:"records_processed"`
+	Error     string     `json:"error"`
+}
+
+// gqlPage is a page of a collection as the schema's *Page types return it.
+type gqlPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+// gqlService is a downstream service; its health is checked only when a
+// query selects it.
+type gqlService struct {
+	Name     string `json:"name"`
+	upstream *upstream
+}
+
+// graphqlRequest is the per-request state resolvers share: the client
+// request, whose context headers are forwarded upstream, and the loaders
+// that batch and cache upstream reads.
+type graphqlRequest struct {
+	r *http.Request
+
+	orders     *graphql.Loader[string, *gqlOrder]
+	records    *graphql.Loader[string, *gqlRecord]
+	jobs       *graphql.Loader[string, *gqlJob]
+	jobRecords *graphql.Loader[string, []gqlRecord]
+	health     *graphql.Loader[string, bool]
+}
+
+type graphqlRequestKey struct{}
+
+func newGraphQLRequest(r *http.Request) *graphqlRequest {
+	wait := viper.GetDuration("graphql.batch_wait")
+	maxBatch := viper.GetInt("graphql.max_batch")
+	if maxBatch <= 0 || maxBatch > response.MaxLimit {
+		maxBatch = response.MaxLimit
+	}
+	g := &graphqlRequest{r: r}
+	g.orders = graphql.NewLoader(byID[gqlOrder](g, "orders", "business", "/api/v2/orders", func(o *gqlOrder) string { return o.ID }), wait, maxBatch)
+	g.records = graphql.NewLoader(byID[gqlRecord](g, "records", "data", "/api/v2/records", func(rec *gqlRecord) string { return rec.ID }), wait, maxBatch)
+	g.jobs = graphql.NewLoader(byID[gqlJob](g, "jobs", "data", "/api/v2/jobs", func(j *gqlJob) string { return j.ID }), wait, maxBatch)
+	g.jobRecords = graphql.NewLoader(g.recordsOfJobs, wait, maxBatch)
+	g.health = graphql.NewLoader(func(ctx context.Context, names []string) (map[string]bool, error) {
+		healthy := make(map[string]bool, len(names))
+		for _, name := range names {
+			healthy[name] = checkHealth(upstreams[name].activeURL())
+		}
+		return healthy, nil
+	}, 0, 0)
+	return g
+}
+
+func graphqlRequestFrom(ctx context.Context) *graphqlRequest {
+	return ctx.Value(graphqlRequestKey{}).(*graphqlRequest)
+}
+
+// byID returns a batch function that fetches the resources with the given
+// IDs from path in one request, using the collection's repeatable id
+// filter.
+func byID[T any](g *graphqlRequest, loader, service, path string, id func(*T) string) graphql.BatchFunc[string, *T] {
+	return func(ctx context.Context, ids []string) (map[string]*T, error) {
+		graphqlBatchSize.WithLabelValues(loader).Observe(float64(len(ids)))
+		query := url.Values{"id": ids, "limit": {strconv.Itoa(len(ids))}}
+		var items []*T
+		if _, err := g.fetch(ctx, service, path, query, &items); err != nil {
+			return nil, err
+		}
+		found := make(map[string]*T, len(items))
+		for _, item := range items {
+			found[id(item)] = item
+		}
+		return found, nil
+	}
+}
+
+// recordsOfJobs fetches every record processed by the given jobs, following
+// the collection's pages, and groups them by job.
+func (g *graphqlRequest) recordsOfJobs(ctx context.Context, jobIDs []string) (map[string][]gqlRecord, error) {
+	graphqlBatchSize.WithLabelValues("job_records").Observe(float64(len(jobIDs)))
+	byJob := make(map[string][]gqlRecord, len(jobIDs))
+	query := url.Values{"job_id": jobIDs, "limit": {strconv.Itoa(response.MaxLimit)}}
+	for offset := 0; ; offset += response.MaxLimit {
+		query.Set("offset", strconv.Itoa(offset))
+		var records []gqlRecord
+		pagination, err := g.fetch(ctx, "data", "/api/v2/records", query, &records)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			byJob[record.JobID] = append(byJob[record.JobID], record)
+		}
+		if pagination == nil || pagination.Next == "" {
+			return byJob, nil
+		}
+	}
+}
+
+// listResolver resolves a collection field with one page of the
+// collection at path, narrowed by the ids argument and by filters.
+func listResolver[T any](service, path string, filters func(args map[string]interface{}, q url.Values)) graphql.ResolveFunc {
+	return func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+		page, err := parsePageArgs(p.Args)
+		if err != nil {
+			return nil, err
+		}
+		q := url.Values{"offset": {strconv.Itoa(page.Offset)}, "limit": {strconv.Itoa(page.Limit)}}
+		if ids, ok := p.Args["ids"].([]interface{}); ok {
+			for _, id := range ids {
+				q.Add("id", id.(string))
+			}
+		}
+		filters(p.Args, q)
+
+		var items []*T
+		pagination, err := graphqlRequestFrom(ctx).fetch(ctx, service, path, q, &items)
+		if err != nil {
+			return nil, err
+		}
+		if pagination == nil {
+			return nil, &upstreamError{service: service, err: errors.New("response is not a page")}
+		}
+		return &gqlPage{Total: pagination.Total, Offset: pagination.Offset, Limit: pagination.Limit, Items: items}, nil
+	}
+}
+
+// fetch is fetchUpstream for g's client request, counted by outcome.
+func (g *graphqlRequest) fetch(ctx context.Context, service, path string, query url.Values, out interface{}) (*response.Pagination, error) {
+	pagination, err := fetchUpstream(ctx, g.r, service, path, query, out)
+	outcome := "ok"
+	var uerr *upstreamError
+	if errors.As(err, &uerr) && uerr.limited {
+		outcome = "limited"
+	} else if err != nil {
+		outcome = "error"
+	}
+	graphqlUpstreamRequests.WithLabelValues(service, outcome).Inc()
+	return pagination, err
+}
+
+// newGraphQLSchema builds the gateway's schema over the business and data
+// services' v2 APIs.
+func newGraphQLSchema() (*graphql.Schema, error) {
+	nonNull := func(t graphql.Type) graphql.Type { return &graphql.NonNull{Of: t} }
+	listOf := func(t graphql.Type) graphql.Type { return nonNull(&graphql.List{Of: nonNull(t)}) }
+	pageArgs := func(args ...*graphql.ArgumentDefinition) []*graphql.ArgumentDefinition {
+		return append(args,
+			&graphql.ArgumentDefinition{Name: "offset", Type: graphql.Int, Default: 0},
+			&graphql.ArgumentDefinition{Name: "limit", Type: graphql.Int, Default: response.DefaultLimit, Description: fmt.Sprintf("At most %d.", response.MaxLimit)},
+		)
+	}
+	idsArg := &graphql.ArgumentDefinition{Name: "ids", Type: &graphql.List{Of: nonNull(graphql.ID)}, Description: "Only these IDs."}
+	timestamp := func(name, description string, get func(source interface{}) *time.Time) *graphql.FieldDefinition {
+		return &graphql.FieldDefinition{
+			Name:        name,
+			Description: description + " RFC 3339.",
+			Type:        graphql.String,
+			Resolve: func(_ context.Context, p graphql.ResolveParams) (interface{}, error) {
+				if t := get(p.Source); t != nil {
+					return t.UTC().Format(time.RFC3339Nano), nil
+				}
+				return nil, nil
+			},
+		}
+	}
+	field := func(name string, t graphql.Type, description string, get func(source interface{}) interface{}) *graphql.FieldDefinition {
+		return &graphql.FieldDefinition{
+			Name:        name,
+			Description: description,
+			Type:        t,
+			Resolve: func(_ context.Context, p graphql.ResolveParams) (interface{}, error) {
+				return get(p.Source), nil
+			},
+		}
+	}
+	enum := func(name, description string, values ...string) *graphql.Enum {
+		e := &graphql.Enum{Name: name, Description: description}
+		for _, v := range values {
+			e.Values = append(e.Values, &graphql.EnumValueDefinition{Name: v})
+		}
+		return e
+	}
+	pageType := func(name string, item graphql.Type) *graphql.Object {
+		return &graphql.Object{
+			Name:        name,
+			Description: "A page of a collection, oldest first.",
+			Fields: []*graphql.FieldDefinition{
+				{Name: "total", Type: nonNull(graphql.Int), Description: "Items in the whole collection, after filters."},
+				{Name: "offset", Type: nonNull(graphql.Int)},
+				{Name: "limit", Type: nonNull(graphql.Int)},
+				{Name: "items", Type: listOf(item)},
+			},
+		}
+	}
+
+	jsonScalar := &graphql.Scalar{
+		Name:        "JSON",
+		Description: "An arbitrary JSON value.",
+		Serialize:   func(v interface{}) (interface{}, error) { return v, nil },
+		ParseValue:  func(v interface{}) (interface{}, error) { return v, nil },
+	}
+	orderStatus := enum("OrderStatus", "The state of an order.", "pending", "completed", "failed", "cancelled")
+	jobStatus := enum("JobStatus", "The state of a processing job.", "pending", "running", "completed", "failed", "cancelled")
+
+	order := &graphql.Object{
+		Name:        "Order",
+		Description: "An order of the business service. Money is in integer cents.",
+		Fields: []*graphql.FieldDefinition{
+			field("id", nonNull(graphql.ID), "", func(s interface{}) interface{} { return s.(*gqlOrder).ID }),
+			field("product", nonNull(graphql.String), "", func(s interface{}) interface{} { return s.(*gqlOrder).Product }),
+			field("quantity", nonNull(graphql.Int), "", func(s interface{}) interface{} { return s.(*gqlOrder).Quantity }),
+			field("priceCents", nonNull(graphql.Int), "Unit price.", func(s interface{}) interface{} { return s.(*gqlOrder).PriceCents }),
+			field("totalCents", nonNull(graphql.Int), "Unit price times quantity.", func(s interface{}) interface{} { return s.(*gqlOrder).TotalCents }),
+			field("status", nonNull(orderStatus), "", func(s interface{}) interface{} { return s.(*gqlOrder).Status }),
+			timestamp("createdAt", "When the order was placed.", func(s interface{}) *time.Time { return &s.(*gqlOrder).CreatedAt }),
+			timestamp("updatedAt", "When the order last changed.", func(s interface{}) *time.Time { return &s.(*gqlOrder).UpdatedAt }),
+			field("customerId", graphql.ID, "Who placed the order.", func(s interface{}) interface{} { return nullableString(s.(*gqlOrder).CustomerID) }),
+		},
+	}
+
+	job := &graphql.Object{Name: "Job", Description: "A processing job of the data service."}
+	record := &graphql.Object{
+		Name:        "Record",
+		Description: "A data record of the data service.",
+		Fields: []*graphql.FieldDefinition{
+			field("id", nonNull(graphql.ID), "", func(s interface{}) interface{} { return s.(*gqlRecord).ID }),
+			field("type", nonNull(graphql.String), "", func(s interface{}) interface{} { return s.(*gqlRecord).Type }),
+			field("data", jsonScalar, "The record's key/value payload.", func(s interface{}) interface{} { return s.(*gqlRecord).Data }),
+			timestamp("timestamp", "When the record was created.", func(s interface{}) *time.Time { return &s.(*gqlRecord).Timestamp }),
+			field("processed", nonNull(graphql.Boolean), "", func(s interface{}) interface{} { return s.(*gqlRecord).Processed }),
+			timestamp("processedAt", "When the record was processed.", func(s interface{}) *time.Time { return s.(*gqlRecord).ProcessedAt }),
+			field("traceId", graphql.String, "Trace of the request that created the record.", func(s interface{}) interface{} { return nullableString(s.(*gqlRecord).TraceID) }),
+			field("orderId", graphql.ID, "Order the record belongs to.", func(s interface{}) interface{} { return nullableString(s.(*gqlRecord).OrderID) }),
+			field("correlationId", graphql.ID, "Groups the records of one cross-service flow.", func(s interface{}) interface{} { return nullableString(s.(*gqlRecord).CorrelationID) }),
+			{
+				Name:        "job",
+				Description: "The job that processed the record.",
+				Type:        job,
+				Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+					id := p.Source.(*gqlRecord).JobID
+					if id == "" {
+						return nil, nil
+					}
+					return graphqlRequestFrom(ctx).jobs.Load(ctx, id)
+				},
+			},
+		},
+	}
+	recordPage := pageType("RecordPage", record)
+
+	job.Fields = []*graphql.FieldDefinition{
+		field("id", nonNull(graphql.ID), "", func(s interface{}) interface{} { return s.(*gqlJob).ID }),
+		field("status", nonNull(jobStatus), "", func(s interface{}) interface{} { return s.(*gqlJob).Status }),
+		timestamp("startTime", "When the job started.", func(s interface{}) *time.Time { return &s.(*gqlJob).StartTime }),
+		timestamp("endTime", "When the job finished.", func(s interface{}) *time.Time { return s.(*gqlJob).EndTime }),
+		field("recordsProcessed", nonNull(graphql.Int), "", func(s interface{}) interface{} { return s.(*gqlJob).Records }),
+		field("error", graphql.String, "Why the job failed.", func(s interface{}) interface{} { return nullableString(s.(*gqlJob).Error) }),
+		{
+			Name:        "records",
+			Description: "The records the job processed.",
+			Type:        recordPage,
+			Args:        pageArgs(),
+			Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+				page, err := parsePageArgs(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				records, err := graphqlRequestFrom(ctx).jobRecords.Load(ctx, p.Source.(*gqlJob).ID)
+				if err != nil {
+					return nil, err
+				}
+				lo, hi := page.Bounds(len(records))
+				items := make([]*gqlRecord, 0, hi-lo)
+				for i := lo; i < hi; i++ {
+					items = append(items, &records[i])
+				}
+				return &gqlPage{Total: len(records), Offset: page.Offset, Limit: page.Limit, Items: items}, nil
+			},
+		},
+	}
+
+	service := &graphql.Object{
+		Name:        "Service",
+		Description: "A downstream service of the gateway.",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "name", Type: nonNull(graphql.String)},
+			field("url", nonNull(graphql.String), "The primary URL.", func(s interface{}) interface{} { return s.(*gqlService).upstream.primaryURL() }),
+			field("activeUrl", nonNull(graphql.String), "Where requests go now: the standby while failed over.", func(s interface{}) interface{} {
+				return s.(*gqlService).upstream.activeURL()
+			}),
+			{
+				Name:        "healthy",
+				Description: "Whether the active URL's /health answers 200 now.",
+				Type:        nonNull(graphql.Boolean),
+				Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+					return graphqlRequestFrom(ctx).health.Load(ctx, p.Source.(*gqlService).upstream.name)
+				},
+			},
+		},
+	}
+
+	stringFilter := func(args map[string]interface{}, q url.Values, arg, param string) {
+		if v, ok := args[arg].(string); ok {
+			q.Set(param, v)
+		}
+	}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: []*graphql.FieldDefinition{
+			{
+				Name: "order",
+				Type: order,
+				Args: []*graphql.ArgumentDefinition{{Name: "id", Type: nonNull(graphql.ID)}},
+				Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+					return graphqlRequestFrom(ctx).orders.Load(ctx, p.Args["id"].(string))
+				},
+			},
+			{
+				Name: "orders",
+				Type: pageType("OrderPage", order),
+				Args: pageArgs(idsArg,
+					&graphql.ArgumentDefinition{Name: "status", Type: orderStatus},
+					&graphql.ArgumentDefinition{Name: "product", Type: graphql.String},
+					&graphql.ArgumentDefinition{Name: "customerId", Type: graphql.ID},
+				),
+				Resolve: listResolver[gqlOrder]("business", "/api/v2/orders", func(args map[string]interface{}, q url.Values) {
+					stringFilter(args, q, "status", "status")
+					stringFilter(args, q, "product", "product")
+					stringFilter(args, q, "customerId", "customer_id")
+				}),
+			},
+			{
+				Name: "record",
+				Type: record,
+				Args: []*graphql.ArgumentDefinition{{Name: "id", Type: nonNull(graphql.ID)}},
+				Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+					return graphqlRequestFrom(ctx).records.Load(ctx, p.Args["id"].(string))
+				},
+			},
+			{
+				Name: "records",
+				Type: recordPage,
+				Args: pageArgs(idsArg,
+					&graphql.ArgumentDefinition{Name: "type", Type: graphql.String},
+					&graphql.ArgumentDefinition{Name: "jobId", Type: graphql.ID},
+					&graphql.ArgumentDefinition{Name: "orderId", Type: graphql.ID},
+					&graphql.ArgumentDefinition{Name: "correlationId", Type: graphql.ID},
+					&graphql.ArgumentDefinition{Name: "processed", Type: graphql.Boolean},
+				),
+				Resolve: listResolver[gqlRecord]("data", "/api/v2/records", func(args map[string]interface{}, q url.Values) {
+					stringFilter(args, q, "type", "type")
+					stringFilter(args, q, "jobId", "job_id")
+					stringFilter(args, q, "orderId", "order_id")
+					stringFilter(args, q, "correlationId", "correlation_id")
+					if processed, ok := args["processed"].(bool); ok {
+						q.Set("processed", strconv.FormatBool(processed))
+					}
+				}),
+			},
+			{
+				Name: "job",
+				Type: job,
+				Args: []*graphql.ArgumentDefinition{{Name: "id", Type: nonNull(graphql.ID)}},
+				Resolve: func(ctx context.Context, p graphql.ResolveParams) (interface{}, error) {
+					return graphqlRequestFrom(ctx).jobs.Load(ctx, p.Args["id"].(string))
+				},
+			},
+			{
+				Name: "jobs",
+				Type: pageType("JobPage", job),
+				Args: pageArgs(idsArg, &graphql.ArgumentDefinition{Name: "status", Type: jobStatus}),
+				Resolve: listResolver[gqlJob]("data", "/api/v2/jobs", func(args map[string]interface{}, q url.Values) {
+					stringFilter(args, q, "status", "status")
+				}),
+			},
+			{
+				Name:        "services",
+				Description: "The gateway's downstream services.",
+				Type:        listOf(service),
+				Resolve: func(context.Context, graphql.ResolveParams) (interface{}, error) {
+					services := make([]*gqlService, len(graphqlServices))
+					for i, s := range graphqlServices {
+						services[i] = &gqlService{Name: s.name, upstream: upstreams[s.upstream]}
+					}
+					return services, nil
+				},
+			},
+			{
+				Name: "service",
+				Type: service,
+				Args: []*graphql.ArgumentDefinition{{Name: "name", Type: nonNull(graphql.String), Description: "e.g. \"data-service\"."}},
+				Resolve: func(_ context.Context, p graphql.ResolveParams) (interface{}, error) {
+					for _, s := range graphqlServices {
+						if s.name == p.Args["name"] {
+							return &gqlService{Name: s.name, upstream: upstreams[s.upstream]}, nil
+						}
+					}
+					return nil, nil
+				},
+			},
+		},
+	}
+	return graphql.NewSchema(query)
+}
+
+// parsePageArgs reads the offset and limit arguments of a collection field.
+func parsePageArgs(args map[string]interface{}) (response.Page, error) {
+	page := response.Page{Offset: args["offset"].(int), Limit: args["limit"].(int)}
+	if page.Offset < 0 {
+		return page, fmt.Errorf("invalid offset %d", page.Offset)
+	}
+	if page.Limit < 1 || page.Limit > response.MaxLimit {
+		return page, fmt.Errorf("invalid limit %d: must be between 1 and %d", page.Limit, response.MaxLimit)
+	}
+	return page, nil
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// graphqlHandler serves GraphQL over HTTP: queries as a JSON POST body
+// ({"query", "operationName", "variables"}) or in the query string of a
+// GET. Requests that fail before execution get 400; once executed the
+// status is 200 even when some fields failed, with the failures in errors.
+func graphqlHandler(schema *graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		req, err := readGraphQLRequest(w, r)
+		if err != nil {
+			graphqlRequests.WithLabelValues("error").Inc()
+			writeGraphQL(w, http.StatusBadRequest, &graphql.Response{Errors: []*graphql.Error{{Message: err.Error()}}})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration("graphql.timeout"))
+		defer cancel()
+		ctx = context.WithValue(ctx, graphqlRequestKey{}, newGraphQLRequest(r))
+		resp := schema.Execute(ctx, req, graphql.Limits{
+			MaxDepth:  viper.GetInt("graphql.max_depth"),
+			MaxFields: viper.GetInt("graphql.max_fields"),
+			MaxCost:   viper.GetInt("graphql.max_cost"),
+			ListSize:  viper.GetInt("graphql.list_size"),
+		})
+		graphqlDuration.Observe(time.Since(start).Seconds())
+
+		status := http.StatusOK
+		switch {
+		case !resp.Executed():
+			status = http.StatusBadRequest
+			graphqlRequests.WithLabelValues("error").Inc()
+		case len(resp.Errors) > 0:
+			graphqlRequests.WithLabelValues("partial").Inc()
+		default:
+			graphqlRequests.WithLabelValues("ok").Inc()
+		}
+		if len(resp.Errors) > 0 {
+			messages := make([]string, len(resp.Errors))
+			for i, e := range resp.Errors {
+				messages[i] = e.Message
+			}
+			sort.Strings(messages)
+			logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+				"operation": req.OperationName,
+				"errors":    messages,
+			}).Warn("GraphQL request had errors")
+		}
+		writeGraphQL(w, status, resp)
+	}
+}
+
+func readGraphQLRequest(w http.ResponseWriter, r *http.Request) (graphql.Request, error) {
+	var req graphql.Request
+	maxBytes := viper.GetInt64("graphql.max_query_bytes")
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := decodeJSON(strings.NewReader(v), &req.Variables); err != nil {
+				return req, fmt.Errorf("invalid variables: %v", err)
+			}
+		}
+	} else {
+		contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+		body := http.MaxBytesReader(w, r.Body, maxBytes)
+		switch contentType {
+		case "application/json", "":
+			if err := decodeJSON(body, &req); err != nil {
+				return req, fmt.Errorf("invalid request body: %v", err)
+			}
+		case "application/graphql":
+			query, err := io.ReadAll(body)
+			if err != nil {
+				return req, fmt.Errorf("invalid request body: %v", err)
+			}
+			req.Query = string(query)
+		default:
+			return req, fmt.Errorf("unsupported content type %q", contentType)
+		}
+	}
+	if req.Query == "" {
+		return req, errors.New("query is required")
+	}
+	if int64(len(req.Query)) > maxBytes {
+		return req, fmt.Errorf("query is larger than %d bytes", maxBytes)
+	}
+	return req, nil
+}
+
+// decodeJSON decodes numbers as json.Number so Int variables keep their
+// exact value.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func writeGraphQL(w http.ResponseWriter, status int, resp *graphql.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
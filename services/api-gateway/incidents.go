@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/incident"
+	"pipeline/pkg/response"
+)
+
+// incidentStore tracks incidents; it is nil when incidents.enabled is false.
+var incidentStore *incident.Store
+
+func startIncidents() {
+	if !viper.GetBool("incidents.enabled") {
+		return
+	}
+	store, err := incident.NewStore(incident.Config{
+		Path:        viper.GetString("incidents.path"),
+		Retention:   viper.GetDuration("incidents.retention"),
+		AutoResolve: viper.GetBool("incidents.auto_resolve"),
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open incident store")
+	}
+	incidentStore = store
+}
+
+// writeIncidentError answers with the status matching a store error.
+func writeIncidentError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, incident.ErrNotFound):
+		http.Error(w, "Incident not found", http.StatusNotFound)
+	case errors.Is(err, incident.ErrResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, incident.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		logrus.WithFields(contextLogFields(r)).WithError(err).Error("Failed to save incident")
+		http.Error(w, "Failed to save incident", http.StatusInternalServerError)
+	}
+}
+
+func listIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	list := incidentStore.List(incident.Filter{Status: q.Get("status"), Service: q.Get("service"), Severity: q.Get("severity")})
+	lo, hi := page.Bounds(len(list))
+	response.WriteList(w, r, list[lo:hi], page, len(list), nil)
+}
+
+func openIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	var in incident.Incident
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	created, err := incidentStore.Open(in, auditActors.Actor(r))
+	if err != nil {
+		writeIncidentError(w, r, err)
+		return
+	}
+	logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{"incident": created.ID, "severity": created.Severity}).Warn("Incident opened")
+	wakeOnCall()
+	response.Created(w, r, created, response.Links{"self": response.Link(r, "/api/v1/incidents/"+created.ID)})
+}
+
+func getIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	in, ok := incidentStore.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	}
+	response.Write(w, r, http.StatusOK, in, nil)
+}
+
+func updateIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	var u incident.Update
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if before, ok := incidentStore.Get(id); ok {
+		audit.SetBefore(r.Context(), before)
+	}
+	updated, err := incidentStore.Update(id, u, auditActors.Actor(r))
+	if err != nil {
+		writeIncidentError(w, r, err)
+		return
+	}
+	response.Write(w, r, http.StatusOK, updated, nil)
+}
+
+func deleteIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if before, ok := incidentStore.Get(id); ok {
+		audit.SetBefore(r.Context(), before)
+	}
+	if err := incidentStore.Delete(id); err != nil {
+		writeIncidentError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// incidentActionHandler acknowledges or resolves an incident, with an
+// optional {"note"} for its timeline.
+func incidentActionHandler(action func(id, actor, note string) (incident.Incident, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Note string `json:"note"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		in, err := action(mux.Vars(r)["id"], auditActors.Actor(r), body.Note)
+		if err != nil {
+			writeIncidentError(w, r, err)
+			return
+		}
+		logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{"incident": in.ID, "status": in.Status}).Info("Incident updated")
+		wakeOnCall()
+		response.Write(w, r, http.StatusOK, in, nil)
+	}
+}
+
+// incidentStatsHandler reports the MTTA and MTTR of the incidents opened
+// within window, 30 days by default.
+func incidentStatsHandler(w http.ResponseWriter, r *http.Request) {
+	window := 30 * 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid window, use a duration such as 720h", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	response.Write(w, r, http.StatusOK, incidentStore.Stats(time.Now().Add(-window)), nil)
+}
+
+// alertmanagerWebhook is the body Alertmanager posts to webhook receivers.
+type alertmanagerWebhook struct {
+	Alerts []struct {
+		Status      string            `json:"status"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+		EndsAt      time.Time         `json:"endsAt"`
+		Fingerprint string            `json:"fingerprint"`
+	} `json:"alerts"`
+}
+
+// alertWebhookHandler receives Alertmanager notifications. Firing alerts
+// with a severity in incidents.alert_severities open an incident, or are
+// added to the one their fingerprint already has open, unless a silence or
+// maintenance window mutes them.
+func alertWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var hook alertmanagerWebhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	severities := viper.GetStringSlice("incidents.alert_severities")
+	var opened, updated, ignored, silenced int
+	for _, a := range hook.Alerts {
+		alert := incident.Alert{
+			Fingerprint: a.Fingerprint,
+			Name:        a.Labels["alertname"],
+			Service:     a.Labels["service"],
+			Severity:    a.Labels["severity"],
+			Summary:     a.Annotations["summary"],
+			Labels:      a.Labels,
+			Firing:      a.Status == "firing",
+			At:          a.StartsAt,
+		}
+		if alert.Fingerprint == "" {
+			alert.Fingerprint = labelsFingerprint(a.Labels)
+		}
+		if alert.Service == "" {
+			alert.Service = a.Labels["job"]
+		}
+		if !alert.Firing {
+			alert.At = a.EndsAt
+		}
+		if len(severities) > 0 && !slices.Contains(severities, alert.Severity) {
+			ignored++
+			continue
+		}
+		if alert.Firing {
+			labels := map[string]string{"service": alert.Service}
+			for name, value := range a.Labels {
+				labels[name] = value
+			}
+			if id, muted := mutedBy(labels); muted {
+				silenced++
+				logrus.WithFields(logrus.Fields{"alert": alert.Name, "service": alert.Service, "silence": id}).Debug("Alert silenced")
+				continue
+			}
+		}
+
+		in, isNew, err := incidentStore.Alert(alert)
+		switch {
+		case errors.Is(err, incident.ErrNotFound):
+			ignored++
+		case err != nil:
+			writeIncidentError(w, r, err)
+			return
+		case isNew:
+			opened++
+			logrus.WithFields(logrus.Fields{"incident": in.ID, "alert": alert.Name, "severity": in.Severity}).Warn("Incident opened from alert")
+			queueCorrelation(in.ID)
+		default:
+			updated++
+		}
+	}
+	if opened+updated > 0 {
+		wakeOnCall()
+	}
+	response.Write(w, r, http.StatusOK, map[string]int{"opened": opened, "updated": updated, "ignored": ignored, "silenced": silenced}, nil)
+}
+
+// labelsFingerprint identifies an alert by its labels, for senders that do
+// not fingerprint alerts themselves.
+func labelsFingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "=" + labels[name] + "\n")
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// raiseAlert feeds an alert the gateway evaluates itself into the
+// incidents, the way alertWebhookHandler does Alertmanager's. A firing
+// alert muted by a silence or maintenance window is dropped and the muting
+// one's ID returned; a resolved alert without an incident is not an error.
+func raiseAlert(a incident.Alert) (incident.Incident, string, error) {
+	if incidentStore == nil {
+		return incident.Incident{}, "", nil
+	}
+	if a.Firing {
+		labels := map[string]string{"service": a.Service}
+		for name, value := range a.Labels {
+			labels[name] = value
+		}
+		if id, muted := mutedBy(labels); muted {
+			return incident.Incident{}, id, nil
+		}
+	}
+	in, isNew, err := incidentStore.Alert(a)
+	if errors.Is(err, incident.ErrNotFound) {
+		return incident.Incident{}, "", nil
+	}
+	if err != nil {
+		return incident.Incident{}, "", err
+	}
+	if isNew {
+		logrus.WithFields(logrus.Fields{"incident": in.ID, "alert": a.Name, "severity": in.Severity}).Warn("Incident opened from alert")
+		queueCorrelation(in.ID)
+	}
+	wakeOnCall()
+	return in, "", nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/incident"
+	"pipeline/pkg/kpi"
+	"pipeline/pkg/response"
+)
+
+var kpiEvaluationErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_kpi_evaluation_errors_total",
+		Help: "KPI rule evaluations that failed to read the order rollups, by rule",
+	},
+	[]string{"rule"},
+)
+
+func init() {
+	prometheus.MustRegister(kpiEvaluationErrors)
+}
+
+// kpiRuleStatus is a KPI rule with the outcome of its last evaluation, as
+// listed by GET /api/v1/kpi-alerts.
+type kpiRuleStatus struct {
+	Rule        kpi.Rule    `json:"rule"`
+	EvaluatedAt *time.Time  `json:"evaluated_at,omitempty"`
+	Current     *kpi.Totals `json:"current,omitempty"`
+	Baseline    *kpi.Totals `json:"baseline,omitempty"`
+	Result      *kpi.Result `json:"result,omitempty"`
+	FiringSince *time.Time  `json:"firing_since,omitempty"`
+	// Incident is the incident the rule last fired into, and SilencedBy
+	// the silence or maintenance window muting it.
+	Incident   string `json:"incident,omitempty"`
+	SilencedBy string `json:"silenced_by,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// alerted is set once the firing rule has reached the incidents, and
+	// cleared when its resolution has.
+	alerted bool
+}
+
+var (
+	kpiMu    sync.Mutex
+	kpiRules []*kpiRuleStatus
+)
+
+// startKPIAlerts evaluates kpi_alerts.rules every kpi_alerts.interval over
+// the rollup service's order rollups.
+func startKPIAlerts() func() {
+	if !viper.GetBool("kpi_alerts.enabled") {
+		return func() {}
+	}
+	var rules []kpi.Rule
+	if err := viper.UnmarshalKey("kpi_alerts.rules", &rules); err != nil {
+		logrus.WithError(err).Fatal("Invalid kpi_alerts config")
+	}
+	if err := kpi.Validate(rules); err != nil {
+		logrus.WithError(err).Fatal("Invalid kpi_alerts config")
+	}
+	for _, r := range rules {
+		kpiRules = append(kpiRules, &kpiRuleStatus{Rule: r})
+	}
+	if len(kpiRules) == 0 {
+		return func() {}
+	}
+
+	client := &http.Client{Timeout: viper.GetDuration("kpi_alerts.timeout")}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(viper.GetDuration("kpi_alerts.interval"))
+		defer ticker.Stop()
+		for {
+			evaluateKPIRules(client, time.Now())
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// evaluateKPIRules evaluates every rule at now and raises or resolves its
+// alert when it starts or stops firing. A rule whose rollups cannot be read
+// keeps its state.
+func evaluateKPIRules(client *http.Client, now time.Time) {
+	kpiMu.Lock()
+	defer kpiMu.Unlock()
+	for _, status := range kpiRules {
+		r := status.Rule
+		res := kpiResolution(r.Duration())
+		to := now.UTC().Truncate(res)
+		from := to.Add(-r.Duration())
+
+		current, err := orderTotals(client, res, from, to)
+		var baseline kpi.Totals
+		if err == nil && r.Type == kpi.TypeRevenueDrop {
+			baseline, err = orderTotals(client, res, from.Add(-kpi.Baseline), to.Add(-kpi.Baseline))
+		}
+		if err != nil {
+			kpiEvaluationErrors.WithLabelValues(r.Name).Inc()
+			status.Error = err.Error()
+			logrus.WithError(err).WithField("rule", r.Name).Warn("Failed to evaluate KPI rule")
+			continue
+		}
+
+		result := kpi.Evaluate(r, current, baseline)
+		first := status.Result == nil
+		wasFiring := !first && status.Result.Firing
+		status.EvaluatedAt = &now
+		status.Current = &current
+		status.Baseline = nil
+		if r.Type == kpi.TypeRevenueDrop {
+			status.Baseline = &baseline
+		}
+		status.Result = &result
+		status.Error = ""
+		switch {
+		case result.Firing && !wasFiring:
+			status.FiringSince = &now
+			logrus.WithFields(logrus.Fields{"rule": r.Name, "value": result.Value}).Warn("KPI rule firing")
+		case !result.Firing && wasFiring:
+			status.FiringSince = nil
+			logrus.WithFields(logrus.Fields{"rule": r.Name, "value": result.Value}).Info("KPI rule resolved")
+		}
+
+		// A rule seen resolved on its first evaluation also resolves the
+		// incident it may have left open before a restart.
+		leftOpen := first && !result.Firing
+		if result.Firing == status.alerted && !leftOpen {
+			continue
+		}
+		alert := incident.Alert{
+			Fingerprint: labelsFingerprint(map[string]string{"alertname": r.Name, "source": "kpi"}),
+			Name:        r.Name,
+			Service:     "business-service",
+			Severity:    r.Severity,
+			Summary:     result.Summary,
+			Labels:      map[string]string{"alertname": r.Name, "kpi": r.Type, "severity": r.Severity},
+			Firing:      result.Firing,
+			At:          now,
+		}
+		in, silencedBy, err := raiseAlert(alert)
+		if err != nil {
+			logrus.WithError(err).WithField("rule", r.Name).Error("Failed to save incident")
+			continue
+		}
+		status.SilencedBy = silencedBy
+		if silencedBy == "" {
+			status.alerted = result.Firing
+		}
+		if in.ID != "" {
+			status.Incident = in.ID
+		}
+	}
+}
+
+// kpiResolution picks the rollup resolution a window is summed from: 5m
+// for windows of 6h and more that it divides, else 1m.
+func kpiResolution(window time.Duration) time.Duration {
+	if window >= 6*time.Hour && window%(5*time.Minute) == 0 {
+		return 5 * time.Minute
+	}
+	return time.Minute
+}
+
+// orderTotals sums the rollup service's order rollups at resolution res
+// with from <= start < to.
+func orderTotals(client *http.Client, res time.Duration, from, to time.Time) (kpi.Totals, error) {
+	q := url.Values{}
+	q.Set("resolution", strings.TrimSuffix(res.String(), "0s"))
+	q.Set("from", from.Format(time.RFC3339))
+	q.Set("to", to.Format(time.RFC3339))
+	u := strings.TrimRight(viper.GetString("kpi_alerts.rollup_url"), "/") + "/api/v1/rollups/orders?" + q.Encode()
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return kpi.Totals{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return kpi.Totals{}, fmt.Errorf("rollup service returned %s", resp.Status)
+	}
+	var body struct {
+		Rollups   []kpi.Totals `json:"rollups"`
+		Truncated bool         `json:"truncated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return kpi.Totals{}, fmt.Errorf("decode order rollups: %w", err)
+	}
+	if body.Truncated {
+		return kpi.Totals{}, fmt.Errorf("order rollups from %s to %s truncated", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	var sum kpi.Totals
+	for _, r := range body.Rollups {
+		sum.Created += r.Created
+		sum.Completed += r.Completed
+		sum.Failed += r.Failed
+		sum.Revenue += r.Revenue
+	}
+	return sum, nil
+}
+
+// kpiAlertsHandler lists the KPI rules and the outcome of their last
+// evaluation.
+func kpiAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	kpiMu.Lock()
+	list := make([]kpiRuleStatus, len(kpiRules))
+	for i, status := range kpiRules {
+		list[i] = *status
+	}
+	kpiMu.Unlock()
+	response.Write(w, r, http.StatusOK, list, nil)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +16,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/prober"
+	"pipeline/pkg/sla"
+	"pipeline/pkg/telemetry"
 )
 
 type ServiceHealth struct {
@@ -25,16 +31,26 @@ type ServiceHealth struct {
 }
 
 type HealthResponse struct {
-	Status   string          `json:"status"`
-	Services []ServiceHealth `json:"services"`
-	Uptime   string          `json:"uptime"`
+	Status   string                   `json:"status"`
+	Services []ServiceHealth          `json:"services"`
+	Uptime   string                   `json:"uptime"`
+	Runtime  *telemetry.RuntimeStatus `json:"runtime,omitempty"`
 }
 
+// version and commit are set at build time via -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "1.0.0"
+	commit  = "unknown"
+)
+
 var (
 	startTime = time.Now()
 
-	// Prometheus metrics
-	httpRequestsTotal = prometheus.NewCounterVec(
+	// Prometheus metrics; histograms are built by registerHistograms once
+	// the bucket configuration has been loaded.
+	httpRequestDuration *telemetry.LimitedHistogramVec
+
+	httpRequestsTotal = telemetry.NewLimitedCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
 			Help: "Total number of HTTP requests",
@@ -42,15 +58,6 @@ var (
 		[]string{"method", "path", "status"},
 	)
 
-	httpRequestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "HTTP request duration in seconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"method", "path", "status"},
-	)
-
 	activeConnections = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "active_connections",
@@ -61,7 +68,15 @@ var (
 	serviceHealth = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "service_health",
-			Help: "Health status of downstream services (1=healthy, 0=unhealthy)",
+			Help: "Health status of downstream services (1=healthy, 0=unhealthy or not checked yet)",
+		},
+		[]string{"service_name"},
+	)
+
+	serviceHealthUnknown = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_health_unknown",
+			Help: "Whether a downstream service has not been checked yet (1) or has (0)",
 		},
 		[]string{"service_name"},
 	)
@@ -69,43 +84,268 @@ var (
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(httpRequestDuration)
 	prometheus.MustRegister(activeConnections)
 	prometheus.MustRegister(serviceHealth)
+	prometheus.MustRegister(serviceHealthUnknown)
 
 	// Configure logging
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	logrus.SetLevel(logrus.InfoLevel)
 }
 
+// registerHistograms builds and registers the duration histograms using the
+// configured buckets and native histogram settings.
+func registerHistograms() {
+	httpRequestDuration = telemetry.NewLimitedHistogramVec(
+		bootstrap.HistogramSettings(viper.GetViper(), "http_request_duration").Apply(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request duration in seconds",
+			Buckets: prometheus.DefBuckets,
+		}),
+		[]string{"method", "path", "status"},
+	)
+	prometheus.MustRegister(httpRequestDuration)
+}
+
 func main() {
 	// Load configuration
 	loadConfig()
+	stopLogShipping := bootstrap.StartLogShipping(viper.GetViper(), "api-gateway")
+	defer stopLogShipping()
+	telemetry.ConfigureCardinality(viper.GetInt("metrics.cardinality_limit"), func(metric string, labelValues []string) {
+		logrus.WithFields(logrus.Fields{
+			"metric": metric,
+			"labels": labelValues,
+			"limit":  viper.GetInt("metrics.cardinality_limit"),
+		}).Warn("Metric cardinality limit reached, collapsing new label sets into \"other\"")
+	})
+	registerHistograms()
+	telemetry.RegisterBuildInfo(version, commit)
+	telemetry.RegisterFeatureFlags(featureFlags())
+	apdex = bootstrap.NewApdex(viper.GetViper(), "http")
+	requestLogger = bootstrap.NewRequestLogger(viper.GetViper(), "HTTP request", contextLogFields)
+
+	stopSinks := bootstrap.StartMetricSinks(viper.GetViper(), "api-gateway")
+	defer stopSinks()
+	stopRuntime := bootstrap.StartRuntimeMetrics(viper.GetViper())
+	defer stopRuntime()
+	stopProfiling := bootstrap.StartProfiling(viper.GetViper(), "api-gateway", version)
+	defer stopProfiling()
+	auditor := bootstrap.StartShutdownAudit(viper.GetViper())
+	var drainErr error
+	defer func() {
+		bootstrap.FinishShutdownAudit(auditor, drainErr, 0)
+	}()
+	stopSLAHistory := startSLAHistory()
+	defer stopSLAHistory()
+	stopBurnRates := startBurnRates()
+	defer stopBurnRates()
+	stopUsageTracking := startUsageTracking()
+	defer stopUsageTracking()
+	startIncidents()
+	stopCorrelation := startCorrelation()
+	defer stopCorrelation()
+	stopSilences := startSilences()
+	defer stopSilences()
+	stopOnCall := startOnCall()
+	defer stopOnCall()
+	stopKPIAlerts := startKPIAlerts()
+	defer stopKPIAlerts()
+	stopQuotas := startQuotas()
+	defer stopQuotas()
+
+	actors, err := newAuditActors()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid audit.trusted_proxies config")
+	}
+	auditActors = actors
+	if viper.GetBool("audit.enabled") {
+		recorder, err := newAuditRecorder("api-gateway")
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to open audit log")
+		}
+		auditRecorder = recorder
+	}
+
+	guard, err := bootstrap.NewAccessGuard(viper.GetViper())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid endpoint_protection config")
+	}
+
+	requestFirewall, err := newFirewall()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid firewall config")
+	}
+
+	authorizer, err := newAuthorizer()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid rbac config")
+	}
+	policyHook, err := newPolicyHook()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid opa config")
+	}
+
+	loadShedder := bootstrap.NewLoadShedder(viper.GetViper())
+	defer loadShedder.Close()
+
+	upstreams = newUpstreams()
+	loadDeployments()
+	if err := loadTransforms(); err != nil {
+		logrus.WithError(err).Fatal("Invalid transforms config")
+	}
+	if err := loadValidation(); err != nil {
+		logrus.WithError(err).Fatal("Invalid validation config")
+	}
+	if err := loadAffinity(); err != nil {
+		logrus.WithError(err).Fatal("Invalid affinity config")
+	}
+	if err := loadAdminCommands(); err != nil {
+		logrus.WithError(err).Fatal("Invalid admin_proxy config")
+	}
+	// Without endpoint_protection the admin commands would be open to anyone
+	// who can reach the gateway.
+	if viper.GetBool("admin_proxy.enabled") && !guard.Enabled() {
+		logrus.Fatal("admin_proxy.enabled requires endpoint_protection credentials or allowed_ips")
+	}
+	// Registered instances take traffic for their service, so an open
+	// registration endpoint would let anyone redirect it.
+	if viper.GetBool("registration.enabled") && !guard.Enabled() {
+		logrus.Fatal("registration.enabled requires endpoint_protection credentials or allowed_ips")
+	}
+	upstreamLimiters = newUpstreamLimiters()
+	stopBackpressurePolling := startBackpressurePolling()
+	defer stopBackpressurePolling()
+	requestRecorder = newRequestRecorder()
+	graphqlSchema, err := newGraphQLSchema()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid GraphQL schema")
+	}
 
 	router := mux.NewRouter()
 
 	// Middleware
 	router.Use(loggingMiddleware)
 	router.Use(metricsMiddleware)
+	router.Use(authenticationMiddleware(authorizer))
+	router.Use(usageMiddleware)
+	router.Use(loadShedder.Wrap)
+	router.Use(authorizationMiddleware(authorizer))
+	router.Use(policyMiddleware(policyHook))
+	router.Use(auditMiddleware)
 
 	// Routes
 	router.HandleFunc("/", homeHandler).Methods("GET")
 	router.HandleFunc("/health", healthHandler).Methods("GET")
 	router.HandleFunc("/ready", readinessHandler).Methods("GET")
-	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+	if viper.GetBool("status_page.enabled") {
+		router.HandleFunc("/status", statusPageHandler).Methods("GET")
+	}
+	router.Handle("/metrics", guard.Wrap(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		// OpenMetrics is required for exemplars to be exposed.
+		EnableOpenMetrics: true,
+	}))).Methods("GET")
+	router.Handle("/admin/config", guard.Wrap(configSources.Handler())).Methods("GET")
+	if quotaManager != nil {
+		router.Handle("/admin/quotas", guard.Wrap(quotaManager.Handler())).Methods("GET", "PUT", "DELETE")
+		router.Handle("/admin/quotas/reset", guard.Wrap(quotaManager.ResetHandler())).Methods("POST")
+	}
+	router.Handle("/admin/deployments", guard.WrapFunc(deploymentsHandler)).Methods("GET")
+	// A switch moves all of an upstream's traffic, so without
+	// endpoint_protection it is not served at all.
+	if guard.Enabled() {
+		router.Handle("/admin/deployments/switch", guard.WrapFunc(switchDeploymentHandler)).Methods("POST")
+	}
+	router.Handle("/admin/snapshots", guard.WrapFunc(listPipelineSnapshotsHandler)).Methods("GET")
+	// Saving, deleting and restoring snapshots replace the state of every
+	// service, so without endpoint_protection they are not served at all.
+	if guard.Enabled() {
+		router.Handle("/admin/snapshots/{name}", guard.WrapFunc(createPipelineSnapshotHandler)).Methods("PUT")
+		router.Handle("/admin/snapshots/{name}", guard.WrapFunc(deletePipelineSnapshotHandler)).Methods("DELETE")
+		router.Handle("/admin/snapshots/{name}/restore", guard.WrapFunc(restorePipelineSnapshotHandler)).Methods("POST")
+	}
+	if viper.GetBool("admin_proxy.enabled") {
+		router.Handle("/admin/services", guard.WrapFunc(adminCommandsHandler)).Methods("GET")
+		router.Handle("/admin/services/{service}/{command}", guard.WrapFunc(adminCommandHandler(authorizer))).Methods("GET", "POST", "PUT", "DELETE")
+	}
+	if requestRecorder != nil {
+		router.Handle("/admin/recordings", guard.Wrap(requestRecorder.Handler())).Methods("GET", "DELETE")
+		router.Handle("/admin/recordings/replay", guard.Wrap(replayHandler())).Methods("POST")
+	}
+
+	if viper.GetBool("graphql.enabled") {
+		router.Handle("/graphql", withQuota(graphqlHandler(graphqlSchema))).Methods("GET", "POST")
+	}
 
 	// API routes
 	api := router.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/proxy/{service}/{path:.*}", proxyHandler).Methods("GET", "POST", "PUT", "DELETE")
+	api.Handle("/proxy/{service}/{path:.*}", withQuota(proxyHandler)).Methods("GET", "POST", "PUT", "DELETE")
 	api.HandleFunc("/services", servicesHandler).Methods("GET")
+	api.HandleFunc("/pipeline/status", pipelineStatusHandler).Methods("GET")
+	if viper.GetBool("registration.enabled") {
+		api.Handle("/register", guard.WrapFunc(registerHandler)).Methods("POST")
+		api.Handle("/register/{name}", guard.WrapFunc(deregisterHandler)).Methods("DELETE")
+	}
+	if viper.GetBool("stitching.enabled") {
+		api.Handle("/orders/{id}/records", withQuota(orderRecordsHandler)).Methods("GET")
+	}
+	if slaHistory != nil {
+		api.Handle("/reports/sla", slaHistory.Handler(slaReportOptions(), slaLocation())).Methods("GET")
+		api.HandleFunc("/reports/sla/burn-rates", burnRatesHandler).Methods("GET")
+	}
+	if usageStore != nil {
+		api.Handle("/usage", guard.Wrap(usageStore.Handler())).Methods("GET")
+	}
+	if auditRecorder != nil {
+		api.Handle("/audit", guard.Wrap(auditRecorder.Handler())).Methods("GET")
+	}
+	if incidentStore != nil {
+		api.Handle("/incidents", guard.WrapFunc(listIncidentsHandler)).Methods("GET")
+		api.Handle("/incidents", guard.WrapFunc(openIncidentHandler)).Methods("POST")
+		api.Handle("/incidents/stats", guard.WrapFunc(incidentStatsHandler)).Methods("GET")
+		api.Handle("/incidents/{id}", guard.WrapFunc(getIncidentHandler)).Methods("GET")
+		api.Handle("/incidents/{id}", guard.WrapFunc(updateIncidentHandler)).Methods("PATCH")
+		api.Handle("/incidents/{id}", guard.WrapFunc(deleteIncidentHandler)).Methods("DELETE")
+		api.Handle("/incidents/{id}/acknowledge", guard.WrapFunc(incidentActionHandler(incidentStore.Acknowledge))).Methods("POST")
+		api.Handle("/incidents/{id}/resolve", guard.WrapFunc(incidentActionHandler(incidentStore.Resolve))).Methods("POST")
+		api.Handle("/alerts", guard.WrapFunc(alertWebhookHandler)).Methods("POST")
+		if correlator != nil {
+			api.Handle("/incidents/{id}/correlate", guard.WrapFunc(correlateIncidentHandler)).Methods("POST")
+		}
+	}
+	if silenceStore != nil {
+		api.Handle("/silences", guard.WrapFunc(listSilencesHandler)).Methods("GET")
+		api.Handle("/silences", guard.WrapFunc(createSilenceHandler)).Methods("POST")
+		api.Handle("/silences/{id}", guard.WrapFunc(getSilenceHandler)).Methods("GET")
+		api.Handle("/silences/{id}", guard.WrapFunc(expireSilenceHandler)).Methods("DELETE")
+		api.Handle("/maintenance", guard.WrapFunc(listMaintenanceHandler)).Methods("GET")
+		api.Handle("/maintenance", guard.WrapFunc(createMaintenanceHandler)).Methods("POST")
+		api.Handle("/maintenance/{id}", guard.WrapFunc(getMaintenanceHandler)).Methods("GET")
+		api.Handle("/maintenance/{id}", guard.WrapFunc(endMaintenanceHandler)).Methods("DELETE")
+	}
+	if len(kpiRules) > 0 {
+		api.Handle("/kpi-alerts", guard.WrapFunc(kpiAlertsHandler)).Methods("GET")
+	}
+	if pager != nil {
+		api.Handle("/oncall", guard.WrapFunc(oncallHandler)).Methods("GET", "PUT", "DELETE")
+		api.Handle("/oncall/pages", guard.WrapFunc(oncallPagesHandler)).Methods("GET")
+	}
 
-	// Health checks for downstream services
-	checkServiceHealth("business-service", viper.GetString("services.business"))
-	checkServiceHealth("data-service", viper.GetString("services.data"))
+	// Health checks for downstream services; those without a configured
+	// URL are checked once they register.
+	for _, name := range upstreamNames {
+		if url := viper.GetString("services." + name); url != "" {
+			checkServiceHealth(name+"-service", url, "/health")
+		}
+	}
+	go discoverServicesContinuously()
+	go expireRegistrationsContinuously()
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", viper.GetString("port")),
-		Handler:      router,
+		// The firewall sits in front of the router so unrouted paths and
+		// methods are filtered too.
+		Handler:      auditor.Wrap(requestFirewall.Wrap(router)),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -127,11 +367,11 @@ func main() {
 
 	logrus.Info("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown.drain_timeout"))
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		logrus.WithError(err).Error("Server forced to shutdown")
+	if drainErr = srv.Shutdown(ctx); drainErr != nil {
+		logrus.WithError(drainErr).Error("Server forced to shutdown")
 	}
 
 	logrus.Info("Server exited")
@@ -146,6 +386,248 @@ func loadConfig() {
 	// Set defaults
 	viper.SetDefault("port", "8080")
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("logging.sample_rate", 1.0)
+	viper.SetDefault("logging.slow_threshold", "1s")
+	viper.SetDefault("logging.capture_bodies", false)
+	viper.SetDefault("logging.max_body_bytes", 2048)
+	viper.SetDefault("remote_config.enabled", false)
+	viper.SetDefault("remote_config.provider", "consul")
+	viper.SetDefault("remote_config.endpoint", "http://consul:8500")
+	viper.SetDefault("remote_config.path", "config/api-gateway")
+	viper.SetDefault("remote_config.format", "yaml")
+	viper.SetDefault("remote_config.watch_interval", "30s")
+	viper.SetDefault("secrets.provider", "env")
+	viper.SetDefault("secrets.refresh_interval", "5m")
+	viper.SetDefault("secrets.vault.mount", "secret")
+	viper.SetDefault("secrets.vault.kubernetes.mount", "kubernetes")
+	viper.BindEnv("secrets.vault.address", "SECRETS_VAULT_ADDRESS", "VAULT_ADDR")
+	viper.BindEnv("secrets.vault.token", "SECRETS_VAULT_TOKEN", "VAULT_TOKEN")
+	viper.BindEnv("secrets.vault.namespace", "SECRETS_VAULT_NAMESPACE", "VAULT_NAMESPACE")
+	viper.SetDefault("audit.enabled", true)
+	viper.SetDefault("audit.path", "audit.log")
+	viper.SetDefault("audit.max_summary_bytes", 1024)
+	viper.SetDefault("audit.trusted_proxies", []string{})
+	viper.SetDefault("sla.enabled", true)
+	viper.SetDefault("sla.path", "sla_history.jsonl")
+	viper.SetDefault("sla.retention", "840h")
+	viper.SetDefault("sla.daily_retention", "2160h")
+	viper.SetDefault("sla.flush_interval", "5m")
+	viper.SetDefault("sla.target", 99.9)
+	viper.SetDefault("sla.worst_endpoints", 5)
+	viper.SetDefault("sla.min_requests", 10)
+	viper.SetDefault("sla.timezone", "UTC")
+	viper.SetDefault("sla.burn_rate.windows", []string{"5m", "30m", "1h", "6h"})
+	viper.SetDefault("sla.burn_rate.interval", "30s")
+	viper.SetDefault("usage.enabled", true)
+	viper.SetDefault("usage.path", "usage.json")
+	viper.SetDefault("usage.retention_days", 90)
+	viper.SetDefault("usage.flush_interval", "1m")
+	viper.SetDefault("usage.timezone", "UTC")
+	viper.SetDefault("quotas.enabled", true)
+	viper.SetDefault("quotas.path", "quotas.json")
+	viper.SetDefault("quotas.flush_interval", "10s")
+	viper.SetDefault("quotas.timezone", "UTC")
+	viper.SetDefault("quotas.default.daily", 0)
+	viper.SetDefault("quotas.default.monthly", 0)
+	viper.SetDefault("firewall.enabled", true)
+	viper.SetDefault("firewall.allow_cidrs", []string{})
+	viper.SetDefault("firewall.deny_cidrs", []string{})
+	viper.SetDefault("firewall.trusted_proxies", []string{})
+	viper.SetDefault("firewall.disallowed_methods", []string{"TRACE", "CONNECT"})
+	viper.SetDefault("firewall.max_query_params", 50)
+	viper.SetDefault("firewall.max_body_bytes", 65536)
+	viper.SetDefault("firewall.exempt_paths", []string{"/health", "/ready"})
+	viper.SetDefault("rbac.enabled", false)
+	viper.SetDefault("rbac.jwt.public_key", "")
+	viper.SetDefault("rbac.jwt.public_key_file", "")
+	viper.SetDefault("rbac.jwt.issuer", "")
+	viper.SetDefault("rbac.jwt.audience", "")
+	viper.SetDefault("rbac.jwt.roles_claim", "roles")
+	viper.SetDefault("rbac.jwt.leeway", "30s")
+	viper.SetDefault("rbac.anonymous_roles", []string{})
+	viper.SetDefault("rbac.default_allow", true)
+	viper.SetDefault("opa.enabled", false)
+	viper.SetDefault("opa.url", "http://localhost:8181")
+	viper.SetDefault("opa.policy", "pipeline/authz/allow")
+	viper.SetDefault("opa.timeout", "500ms")
+	viper.SetDefault("opa.fail_open", false)
+	viper.SetDefault("opa.path_prefixes", []string{"/api/"})
+	viper.SetDefault("recording.enabled", false)
+	viper.SetDefault("recording.sample_rate", 0.01)
+	viper.SetDefault("recording.capacity", 100)
+	viper.SetDefault("recording.max_body_bytes", 65536)
+	viper.SetDefault("recording.dir", "")
+	viper.SetDefault("recording.replay_timeout", "30s")
+	viper.SetDefault("propagation.default_tenant", "")
+	viper.SetDefault("upstreams.defaults.max_idle_conns_per_host", 32)
+	viper.SetDefault("upstreams.defaults.max_conns_per_host", 0)
+	viper.SetDefault("upstreams.defaults.idle_conn_timeout", "90s")
+	viper.SetDefault("upstreams.defaults.dial_timeout", "5s")
+	viper.SetDefault("upstreams.defaults.keep_alive", "30s")
+	viper.SetDefault("upstreams.defaults.tls_handshake_timeout", "10s")
+	viper.SetDefault("upstreams.defaults.tls_session_cache_size", 64)
+	viper.SetDefault("upstreams.defaults.response_header_timeout", "0s")
+	viper.SetDefault("upstreams.defaults.dns_cache_ttl", "30s")
+	viper.SetDefault("profiling.enabled", false)
+	viper.SetDefault("profiling.backend", "pyroscope")
+	viper.SetDefault("profiling.url", "http://pyroscope:4040")
+	viper.SetDefault("profiling.profiles", []string{"cpu", "heap"})
+	viper.SetDefault("profiling.interval", "15s")
+	viper.SetDefault("profiling.timeout", "10s")
+	viper.SetDefault("profiling.tags", map[string]string{})
+	viper.SetDefault("shutdown.drain_timeout", "30s")
+	viper.SetDefault("shutdown.settle", "2s")
+	viper.SetDefault("shutdown.report_path", "shutdown.json")
+	viper.SetDefault("runtime.enabled", true)
+	viper.SetDefault("runtime.interval", "15s")
+	viper.SetDefault("runtime.window", "5m")
+	viper.SetDefault("runtime.thresholds.goroutine_growth", 100)
+	viper.SetDefault("runtime.thresholds.gc_pause_p99", "100ms")
+	viper.SetDefault("runtime.thresholds.sched_latency_p99", "50ms")
+	viper.SetDefault("runtime.thresholds.fd_usage", 0.8)
+	viper.SetDefault("health.check_interval", "30s")
+	viper.SetDefault("health.timeout", "5s")
+	viper.SetDefault("health.jitter", "0s")
+	viper.SetDefault("discovery.interval", "60s")
+	viper.SetDefault("admin_proxy.enabled", false)
+	viper.SetDefault("admin_proxy.timeout", "10s")
+	viper.SetDefault("admin_proxy.commands", []map[string]interface{}{})
+	viper.SetDefault("incidents.enabled", true)
+	viper.SetDefault("incidents.path", "incidents.json")
+	viper.SetDefault("incidents.retention", "2160h")
+	viper.SetDefault("incidents.auto_resolve", true)
+	viper.SetDefault("incidents.alert_severities", []string{"critical", "warning"})
+	viper.SetDefault("correlation.enabled", true)
+	viper.SetDefault("correlation.prometheus_url", "http://prometheus:9090")
+	viper.SetDefault("correlation.loki_url", "http://loki:3100")
+	viper.SetDefault("correlation.lookback", "30m")
+	viper.SetDefault("correlation.timeout", "10s")
+	viper.SetDefault("correlation.slow_traces.min_duration", "500ms")
+	viper.SetDefault("correlation.slow_traces.max", 5)
+	viper.SetDefault("correlation.error_logs.spike_factor", 3)
+	viper.SetDefault("correlation.error_logs.min_errors", 10)
+	viper.SetDefault("correlation.backlog.query", `data_records_total{status="pending"}`)
+	viper.SetDefault("correlation.backlog.min_growth", 100)
+	viper.SetDefault("silences.enabled", true)
+	viper.SetDefault("silences.path", "silences.json")
+	viper.SetDefault("silences.retention", "168h")
+	viper.SetDefault("oncall.enabled", true)
+	viper.SetDefault("oncall.path", "oncall.json")
+	viper.SetDefault("oncall.interval", "15s")
+	viper.SetDefault("oncall.timeout", "10s")
+	viper.SetDefault("oncall.incident_url", "")
+	viper.SetDefault("kpi_alerts.enabled", true)
+	viper.SetDefault("kpi_alerts.rollup_url", "http://rollup-service:8085")
+	viper.SetDefault("kpi_alerts.interval", "1m")
+	viper.SetDefault("kpi_alerts.timeout", "10s")
+	viper.SetDefault("status_page.enabled", true)
+	viper.SetDefault("status_page.title", "Pipeline Status")
+	viper.SetDefault("status_page.days", 90)
+	viper.SetDefault("status_page.down_below", 95)
+	viper.SetDefault("status_page.min_incident", "1m")
+	viper.SetDefault("status_page.max_incidents", 20)
+	viper.SetDefault("status_page.show_reasons", false)
+	viper.SetDefault("status_page.max_age", "60s")
+	viper.SetDefault("pipeline_status.cache_ttl", "10s")
+	viper.SetDefault("pipeline_status.timeout", "5s")
+	viper.SetDefault("pipeline_status.backlog.pending_yellow", 1000)
+	viper.SetDefault("pipeline_status.backlog.pending_red", 10000)
+	viper.SetDefault("pipeline_status.backlog.age_yellow", "5m")
+	viper.SetDefault("pipeline_status.backlog.age_red", "30m")
+	viper.SetDefault("pipeline_status.job_failures.window", "1h")
+	viper.SetDefault("pipeline_status.job_failures.yellow", 1)
+	viper.SetDefault("pipeline_status.job_failures.red", 5)
+	viper.SetDefault("pipeline_status.slo.window", "720h")
+	viper.SetDefault("pipeline_status.slo.budget_yellow", 25)
+	viper.SetDefault("registration.enabled", false)
+	viper.SetDefault("registration.ttl", "30s")
+	viper.SetDefault("registration.max_services", 20)
+	viper.SetDefault("registration.configured_services", false)
+	viper.SetDefault("discovery.requirements", map[string]interface{}{})
+	viper.SetDefault("failover.unhealthy_threshold", 2)
+	viper.SetDefault("failover.healthy_threshold", 3)
+	viper.SetDefault("failover.standby.business", "")
+	viper.SetDefault("failover.standby.data", "")
+	viper.SetDefault("upstreams.business.replicas", []string{})
+	viper.SetDefault("upstreams.data.replicas", []string{})
+	viper.SetDefault("validation.specs.business", "openapi/business.yaml")
+	viper.SetDefault("validation.specs.data", "openapi/data.yaml")
+	viper.SetDefault("validation.max_body_bytes", 1<<20)
+	viper.SetDefault("deployments.path", "deployments.json")
+	viper.SetDefault("deployments.drain_timeout", "30s")
+	viper.SetDefault("snapshots.timeout", "2m")
+	viper.SetDefault("deployments.business.active", "blue")
+	viper.SetDefault("deployments.business.blue", []string{})
+	viper.SetDefault("deployments.business.green", []string{})
+	viper.SetDefault("deployments.data.active", "blue")
+	viper.SetDefault("deployments.data.blue", []string{})
+	viper.SetDefault("deployments.data.green", []string{})
+	viper.SetDefault("backpressure.enabled", true)
+	viper.SetDefault("backpressure.upstreams", []string{"data"})
+	viper.SetDefault("backpressure.path", "/api/v1/backpressure")
+	viper.SetDefault("backpressure.poll_interval", "5s")
+	viper.SetDefault("backpressure.stale_after", "30s")
+	viper.SetDefault("backpressure.max_wait", "2s")
+	viper.SetDefault("backpressure.max_waiting", 100)
+	viper.SetDefault("backpressure.retry_after", "5s")
+	viper.SetDefault("concurrency.enabled", true)
+	viper.SetDefault("concurrency.initial_limit", 50)
+	viper.SetDefault("concurrency.min_limit", 10)
+	viper.SetDefault("concurrency.max_limit", 500)
+	viper.SetDefault("concurrency.latency_tolerance", 2.0)
+	viper.SetDefault("concurrency.backoff", 0.9)
+	viper.SetDefault("log_shipping.enabled", false)
+	viper.SetDefault("log_shipping.backend", "loki")
+	viper.SetDefault("log_shipping.url", "http://loki:3100")
+	viper.SetDefault("log_shipping.index", "pipeline-logs")
+	viper.SetDefault("log_shipping.batch_size", 100)
+	viper.SetDefault("log_shipping.flush_interval", "2s")
+	viper.SetDefault("log_shipping.buffer_size", 10000)
+	viper.SetDefault("log_shipping.max_retries", 3)
+	viper.SetDefault("log_shipping.timeout", "5s")
+	viper.SetDefault("endpoint_protection.allowed_ips", []string{})
+	// Credential keys need defaults so vault: references given only via
+	// environment variables are seen by resolveSecrets.
+	viper.SetDefault("endpoint_protection.bearer_token", "")
+	viper.SetDefault("endpoint_protection.basic_auth.username", "")
+	viper.SetDefault("endpoint_protection.basic_auth.password", "")
+	viper.SetDefault("rbac.jwt.hmac_secret", "")
+	viper.SetDefault("load_shedding.enabled", true)
+	viper.SetDefault("load_shedding.max_in_flight", 100)
+	viper.SetDefault("load_shedding.cpu_threshold", 0.9)
+	viper.SetDefault("load_shedding.low_priority_at", 0.6)
+	viper.SetDefault("load_shedding.normal_priority_at", 0.85)
+	viper.SetDefault("load_shedding.retry_after", "1s")
+	viper.SetDefault("load_shedding.exempt_paths", []string{})
+	viper.SetDefault("request_signing.enabled", false)
+	viper.SetDefault("request_signing.secret", "")
+	viper.SetDefault("request_signing.max_body_bytes", 10485760)
+	viper.SetDefault("metrics.apdex.threshold", "250ms")
+	viper.SetDefault("metrics.cardinality_limit", 1000)
+	viper.SetDefault("metrics.native_histograms.enabled", false)
+	viper.SetDefault("metrics.native_histograms.bucket_factor", 1.1)
+	viper.SetDefault("metrics.native_histograms.max_buckets", 160)
+	viper.SetDefault("otlp.enabled", false)
+	viper.SetDefault("otlp.endpoint", "http://otel-collector:4318")
+	viper.SetDefault("otlp.interval", "15s")
+	viper.SetDefault("otlp.timeout", "5s")
+	viper.SetDefault("statsd.enabled", false)
+	viper.SetDefault("statsd.address", "localhost:8125")
+	viper.SetDefault("statsd.prefix", "pipeline.")
+	viper.SetDefault("statsd.dogstatsd", true)
+	viper.SetDefault("statsd.interval", "10s")
+	viper.SetDefault("statsd.metrics", []string{"http_requests_total", "http_request_duration_seconds", "service_health"})
+	viper.SetDefault("graphql.enabled", true)
+	viper.SetDefault("graphql.max_depth", 8)
+	viper.SetDefault("graphql.max_fields", 200)
+	viper.SetDefault("graphql.max_cost", 10000)
+	viper.SetDefault("graphql.list_size", 10)
+	viper.SetDefault("graphql.max_query_bytes", 65536)
+	viper.SetDefault("graphql.batch_wait", "2ms")
+	viper.SetDefault("graphql.max_batch", 100)
+	viper.SetDefault("graphql.timeout", "10s")
+	viper.SetDefault("stitching.enabled", true)
+	viper.SetDefault("stitching.timeout", "5s")
 	viper.SetDefault("services.business", "http://business-service:8081")
 	viper.SetDefault("services.data", "http://data-service:8082")
 
@@ -154,29 +636,15 @@ func loadConfig() {
 	}
 
 	// Allow environment variables to override config
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
+
+	loadRemoteConfig()
+	resolveSecrets()
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// Wrap response writer to capture status code
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(wrapped, r)
-
-		duration := time.Since(start)
-
-		logrus.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status":      wrapped.statusCode,
-			"duration":    duration.String(),
-			"user_agent":  r.UserAgent(),
-			"remote_addr": r.RemoteAddr,
-		}).Info("HTTP request")
-	})
+	return requestLogger.Wrap(next)
 }
 
 type responseWriter struct {
@@ -200,10 +668,15 @@ func metricsMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		duration := time.Since(start).Seconds()
+		elapsed := time.Since(start)
+		duration := elapsed.Seconds()
 
 		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Inc()
-		httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Observe(duration)
+		telemetry.ObserveWithExemplar(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)), duration, telemetry.TraceID(r))
+		apdex.Observe(routeTemplate(r), elapsed, wrapped.statusCode)
+		if slaHistory != nil {
+			slaHistory.RecordRequest(r.Method+" "+routeTemplate(r), wrapped.statusCode, elapsed)
+		}
 	})
 }
 
@@ -211,7 +684,7 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
 		"service":     "API Gateway",
-		"version":     "1.0.0",
+		"version":     version,
 		"status":      "running",
 		"timestamp":   time.Now().UTC().Format(time.RFC3339),
 		"uptime":      time.Since(startTime).String(),
@@ -239,10 +712,14 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// A saturated runtime degrades the gateway but keeps it in rotation.
+	runtimeStatus, sampled := telemetry.Runtime()
 	status := "healthy"
 	if !allHealthy {
 		status = "degraded"
 		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if len(runtimeStatus.Saturated) > 0 {
+		status = "degraded"
 	}
 
 	response := HealthResponse{
@@ -250,6 +727,9 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		Services: services,
 		Uptime:   time.Since(startTime).String(),
 	}
+	if sampled {
+		response.Runtime = &runtimeStatus
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
@@ -263,87 +743,51 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	serviceName := vars["service"]
-	path := vars["path"]
-
-	var targetURL string
-	switch serviceName {
-	case "business":
-		targetURL = viper.GetString("services.business") + "/" + path
-	case "data":
-		targetURL = viper.GetString("services.data") + "/" + path
-	default:
-		http.Error(w, "Unknown service", http.StatusNotFound)
-		return
+// healthProbe is the probe of a service's health endpoint under the
+// health.* settings.
+func healthProbe(serviceName, url, healthPath string) prober.Config {
+	return prober.Config{
+		Name:     serviceName,
+		Kind:     prober.HTTP,
+		Target:   url + healthPath,
+		Interval: viper.GetDuration("health.check_interval"),
+		Timeout:  viper.GetDuration("health.timeout"),
+		Jitter:   viper.GetDuration("health.jitter"),
 	}
-
-	logrus.WithFields(logrus.Fields{
-		"service": serviceName,
-		"path":    path,
-		"target":  targetURL,
-	}).Info("Proxying request")
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":    "Proxy functionality - request would be forwarded to target service",
-		"service":    serviceName,
-		"path":       path,
-		"target_url": targetURL,
-		"timestamp":  time.Now().UTC().Format(time.RFC3339),
-	})
-}
-
-func servicesHandler(w http.ResponseWriter, r *http.Request) {
-	services := map[string]interface{}{
-		"services": []map[string]string{
-			{
-				"name": "business-service",
-				"url":  viper.GetString("services.business"),
-				"type": "REST API",
-			},
-			{
-				"name": "data-service",
-				"url":  viper.GetString("services.data"),
-				"type": "REST API",
-			},
-		},
-		"gateway_version": "1.0.0",
-		"timestamp":       time.Now().UTC().Format(time.RFC3339),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(services)
 }
 
 func checkHealth(url string) bool {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url + "/health")
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+	return prober.Check(context.Background(), healthProbe(url, url, "/health")).Healthy
 }
 
-func checkServiceHealth(serviceName, url string) {
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			healthy := checkHealth(url)
-			value := float64(0)
-			if healthy {
-				value = 1
-			}
-			serviceHealth.WithLabelValues(serviceName).Set(value)
-
-			logrus.WithFields(logrus.Fields{
-				"service": serviceName,
-				"healthy": healthy,
-			}).Debug("Service health check")
+// checkServiceHealth registers a downstream service and probes it at once
+// and then every health.check_interval, feeding the SLA history and
+// failover every result. Until the first check completes the service is
+// reported unknown. It returns a function that stops the checks.
+func checkServiceHealth(serviceName, url, healthPath string) func() {
+	serviceHealth.WithLabelValues(serviceName).Set(0)
+	serviceHealthUnknown.WithLabelValues(serviceName).Set(1)
+	service := &registeredService{name: serviceName, url: url}
+	service.prober = prober.New(healthProbe(serviceName, url, healthPath), func(result prober.Result, status prober.Status) {
+		if slaHistory != nil {
+			_, maintenance := inMaintenance(serviceName, result.At)
+			slaHistory.RecordCheck(sla.Check{Service: serviceName, At: result.At, Healthy: result.Healthy, Latency: result.Latency, Maintenance: maintenance})
 		}
-	}()
-}
\ No newline at end of file
+		value := float64(0)
+		if status.Healthy {
+			value = 1
+		}
+		serviceHealth.WithLabelValues(serviceName).Set(value)
+		serviceHealthUnknown.WithLabelValues(serviceName).Set(0)
+		if u := upstreamForService(serviceName); u != nil {
+			u.observePrimaryHealth(result.Healthy)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"service": serviceName,
+			"healthy": result.Healthy,
+		}).Debug("Service health check")
+	})
+	registerService(service)
+	return service.prober.Start()
+}
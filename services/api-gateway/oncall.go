@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/incident"
+	"pipeline/pkg/oncall"
+	"pipeline/pkg/response"
+)
+
+// pager pages the people on call for incidents; it is nil when
+// oncall.enabled is false or incidents are disabled.
+var pager *oncall.Pager
+
+// oncallWake asks the paging loop to run ahead of its interval, after an
+// incident changes.
+var oncallWake = make(chan struct{}, 1)
+
+// wakeOnCall lets an opened, acknowledged or resolved incident be paged
+// without waiting for oncall.interval.
+func wakeOnCall() {
+	select {
+	case oncallWake <- struct{}{}:
+	default:
+	}
+}
+
+func startOnCall() func() {
+	if !viper.GetBool("oncall.enabled") || incidentStore == nil {
+		return func() {}
+	}
+	var routing oncall.Routing
+	if err := viper.UnmarshalKey("oncall", &routing); err != nil {
+		logrus.WithError(err).Fatal("Invalid oncall config")
+	}
+	var link func(string) string
+	if tmpl := viper.GetString("oncall.incident_url"); tmpl != "" {
+		link = func(id string) string { return strings.ReplaceAll(tmpl, "{id}", id) }
+	}
+	p, err := oncall.NewPager(oncall.Config{
+		Path:    viper.GetString("oncall.path"),
+		Routing: routing,
+		Timeout: viper.GetDuration("oncall.timeout"),
+		Link:    link,
+		Muted:   incidentMuted,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to start on-call paging")
+	}
+	pager = p
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(viper.GetDuration("oncall.interval"))
+		defer ticker.Stop()
+		for {
+			runOnCall()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-oncallWake:
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// runOnCall pages the incidents and records each notification on the
+// incident's timeline.
+func runOnCall() {
+	sent, err := pager.Tick(incidentStore.List(incident.Filter{}), time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to save on-call state")
+	}
+	for _, n := range sent {
+		fields := logrus.Fields{"incident": n.IncidentID, "event": n.Event, "channel": n.Channel}
+		note := fmt.Sprintf("%s sent to %s", n.Event, n.Channel)
+		if n.Step > 0 {
+			fields["step"] = n.Step
+			note = fmt.Sprintf("step %d: %s", n.Step, note)
+		}
+		if n.Err != nil {
+			logrus.WithFields(fields).WithError(n.Err).Warn("On-call notification failed")
+			note = fmt.Sprintf("%s failed: %v", note, n.Err)
+		} else {
+			logrus.WithFields(fields).Info("On-call notification sent")
+		}
+		if err := incidentStore.Note(n.IncidentID, incident.Event{Type: "notified", Actor: "oncall", Note: note}); err != nil && !errors.Is(err, incident.ErrNotFound) {
+			logrus.WithError(err).WithField("incident", n.IncidentID).Error("Failed to save incident")
+		}
+	}
+}
+
+// oncallRouting is the response of GET /api/v1/oncall.
+type oncallRouting struct {
+	// Source is config, or api once the routing has been set through the
+	// API.
+	Source  string         `json:"source"`
+	Routing oncall.Routing `json:"routing"`
+}
+
+// oncallHandler shows the routing with its secrets redacted, replaces it
+// (PUT) or goes back to the configured one (DELETE).
+func oncallHandler(w http.ResponseWriter, r *http.Request) {
+	current, source := pager.Routing()
+	switch r.Method {
+	case http.MethodPut:
+		var routing oncall.Routing
+		if err := json.NewDecoder(r.Body).Decode(&routing); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		audit.SetBefore(r.Context(), current.Redacted())
+		if err := pager.SetRouting(routing); errors.Is(err, oncall.ErrInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logrus.WithFields(contextLogFields(r)).WithError(err).Error("Failed to save on-call state")
+			http.Error(w, "Failed to save on-call state", http.StatusInternalServerError)
+			return
+		}
+		logrus.WithFields(contextLogFields(r)).Info("On-call routing replaced")
+	case http.MethodDelete:
+		audit.SetBefore(r.Context(), current.Redacted())
+		if err := pager.ResetRouting(); err != nil {
+			logrus.WithFields(contextLogFields(r)).WithError(err).Error("Failed to save on-call state")
+			http.Error(w, "Failed to save on-call state", http.StatusInternalServerError)
+			return
+		}
+		logrus.WithFields(contextLogFields(r)).Info("On-call routing reset to config")
+	}
+	current, source = pager.Routing()
+	response.Write(w, r, http.StatusOK, oncallRouting{Source: source, Routing: current.Redacted()}, nil)
+}
+
+// oncallPagesHandler lists the incidents being paged and how far their
+// escalation has gone.
+func oncallPagesHandler(w http.ResponseWriter, r *http.Request) {
+	response.Write(w, r, http.StatusOK, pager.Pages(), nil)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/access"
+	"pipeline/pkg/opa"
+	"pipeline/pkg/rbac"
+)
+
+// newPolicyHook builds the OPA authorization hook from the opa config
+// section; it is nil when opa.enabled is false.
+func newPolicyHook() (*opa.Client, error) {
+	if !viper.GetBool("opa.enabled") {
+		return nil, nil
+	}
+	proxies, err := access.ParseNetworks(viper.GetStringSlice("firewall.trusted_proxies"))
+	if err != nil {
+		return nil, fmt.Errorf("firewall.trusted_proxies: %w", err)
+	}
+	return opa.New(opa.Config{
+		URL:      viper.GetString("opa.url"),
+		Policy:   viper.GetString("opa.policy"),
+		Timeout:  viper.GetDuration("opa.timeout"),
+		FailOpen: viper.GetBool("opa.fail_open"),
+		Input:    func(r *http.Request) map[string]interface{} { return policyInput(r, proxies) },
+		OnDeny:   policyDenied,
+	})
+}
+
+// policyInput describes r to the policy, with the client IP as the firewall
+// sees it behind proxies. Credentials are never sent; the
+// caller is described by its API key ID and, when rbac verified a JWT, the
+// token's claims.
+func policyInput(r *http.Request, proxies []*net.IPNet) map[string]interface{} {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		switch name {
+		case "Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key":
+			continue
+		}
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	values := requestContext(r)
+
+	input := map[string]interface{}{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"segments":   strings.Split(strings.Trim(r.URL.Path, "/"), "/"),
+		"route":      routeTemplate(r),
+		"query":      r.URL.Query(),
+		"headers":    headers,
+		"client_ip":  access.ClientIP(r, proxies).String(),
+		"tenant":     values.Tenant,
+		"api_key_id": values.APIKeyID,
+		"priority":   values.PriorityLabel(),
+	}
+	if id, ok := rbac.FromContext(r.Context()); ok {
+		input["subject"] = id.Subject
+		input["roles"] = id.Roles
+		input["claims"] = id.Claims
+	}
+	return input
+}
+
+func policyDenied(r *http.Request, status int, reason string, err error) {
+	entry := logrus.WithFields(logrus.Fields{
+		"reason":      reason,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"remote_addr": r.RemoteAddr,
+	})
+	if err != nil {
+		entry.WithError(err).Error("Policy evaluation failed")
+	} else {
+		entry.Warn("Request denied by OPA policy")
+	}
+	if auditRecorder != nil {
+		auditRecorder.Record(r, status, "denied: "+reason)
+	}
+}
+
+// policyMiddleware enforces the OPA policy on paths under
+// opa.path_prefixes.
+func policyMiddleware(hook *opa.Client) func(http.Handler) http.Handler {
+	prefixes := viper.GetStringSlice("opa.path_prefixes")
+	return func(next http.Handler) http.Handler {
+		if hook == nil {
+			return next
+		}
+		guarded := hook.Wrap(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					guarded.ServeHTTP(w, r)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// Traffic light colors of the pipeline status, from best to worst.
+const (
+	statusGreen  = "green"
+	statusYellow = "yellow"
+	statusRed    = "red"
+)
+
+var statusRank = map[string]int{statusGreen: 0, statusYellow: 1, statusRed: 2}
+
+// ComponentStatus is the color of one part of the pipeline and the reasons
+// it is not green.
+type ComponentStatus struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// flag records a reason and raises the component's color to status.
+func (c *ComponentStatus) flag(status, format string, args ...interface{}) {
+	if statusRank[status] > statusRank[c.Status] {
+		c.Status = status
+	}
+	c.Reasons = append(c.Reasons, fmt.Sprintf(format, args...))
+}
+
+// PipelineStatus is the response of GET /api/v1/pipeline/status: the worst
+// color of the components, with all their reasons.
+type PipelineStatus struct {
+	Status      string            `json:"status"`
+	Reasons     []string          `json:"reasons"`
+	Components  []ComponentStatus `json:"components"`
+	GeneratedAt time.Time         `json:"generated_at"`
+}
+
+// pipelineStatusCache keeps the last status for pipeline_status.cache_ttl,
+// so that status pages polling the endpoint do not each query the services.
+var pipelineStatusCache struct {
+	sync.Mutex
+	status PipelineStatus
+}
+
+func currentPipelineStatus(r *http.Request) PipelineStatus {
+	pipelineStatusCache.Lock()
+	defer pipelineStatusCache.Unlock()
+	if time.Since(pipelineStatusCache.status.GeneratedAt) < viper.GetDuration("pipeline_status.cache_ttl") {
+		return pipelineStatusCache.status
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration("pipeline_status.timeout"))
+	defer cancel()
+	var backlog, jobs ComponentStatus
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		backlog = backlogStatus(ctx, r)
+	}()
+	go func() {
+		defer wg.Done()
+		jobs = jobFailureStatus(ctx, r)
+	}()
+
+	var entries []ServiceEntry
+	for _, s := range registeredServices() {
+		entries = append(entries, s.entry())
+	}
+	components := []ComponentStatus{serviceHealthStatus(entries), failoverStatus(entries)}
+	if slaHistory != nil {
+		components = append(components, errorBudgetStatus())
+	}
+	wg.Wait()
+	components = append(components, backlog, jobs)
+
+	status := PipelineStatus{Status: statusGreen, Reasons: []string{}, Components: components, GeneratedAt: time.Now().UTC()}
+	for _, c := range components {
+		if statusRank[c.Status] > statusRank[status.Status] {
+			status.Status = c.Status
+		}
+		status.Reasons = append(status.Reasons, c.Reasons...)
+	}
+	pipelineStatusCache.status = status
+	return status
+}
+
+// serviceHealthStatus is red while a service fails its health checks and
+// yellow while one is unchecked, incompatible or under maintenance.
+func serviceHealthStatus(entries []ServiceEntry) ComponentStatus {
+	c := ComponentStatus{Name: "services", Status: statusGreen}
+	for _, e := range entries {
+		if w, ok := inMaintenance(e.Name, time.Now()); ok {
+			c.flag(statusYellow, "%s is under maintenance until %s: %s", e.Name, w.EndsAt.Format(time.RFC3339), w.Reason)
+			continue
+		}
+		switch {
+		case e.Status == "unhealthy" && e.LastError != "":
+			c.flag(statusRed, "%s is unhealthy: %s", e.Name, e.LastError)
+		case e.Status == "unhealthy":
+			c.flag(statusRed, "%s is unhealthy", e.Name)
+		case e.Status == "unknown":
+			c.flag(statusYellow, "%s has not been checked yet", e.Name)
+		}
+		if len(e.Incompatible) > 0 {
+			c.flag(statusYellow, "%s is incompatible: %s", e.Name, strings.Join(e.Incompatible, "; "))
+		}
+	}
+	return c
+}
+
+// failoverStatus is yellow while a service is served from its standby or
+// reports elevated load, and red while one is overloaded.
+func failoverStatus(entries []ServiceEntry) ComponentStatus {
+	c := ComponentStatus{Name: "failover", Status: statusGreen}
+	for _, e := range entries {
+		if e.ActiveTarget == "standby" {
+			c.flag(statusYellow, "%s is served from its standby", e.Name)
+		}
+		switch e.Backpressure {
+		case "elevated":
+			c.flag(statusYellow, "%s reports elevated load", e.Name)
+		case "overloaded":
+			c.flag(statusRed, "%s is overloaded and requests to it are held back", e.Name)
+		}
+	}
+	return c
+}
+
+// backlogStatus grades the data service's pending records by count and by
+// the age of the oldest one.
+func backlogStatus(ctx context.Context, r *http.Request) ComponentStatus {
+	c := ComponentStatus{Name: "backlog", Status: statusGreen}
+	var stats struct {
+		Types []struct {
+			Pending              int     `json:"pending"`
+			OldestPendingSeconds float64 `json:"oldest_pending_seconds"`
+		} `json:"types"`
+	}
+	if _, err := fetchUpstream(ctx, r, "data", "/api/v1/records/stats", nil, &stats); err != nil {
+		c.flag(statusYellow, "backlog unknown: %v", err)
+		return c
+	}
+	pending, oldest := 0, time.Duration(0)
+	for _, t := range stats.Types {
+		pending += t.Pending
+		oldest = max(oldest, time.Duration(t.OldestPendingSeconds*float64(time.Second)))
+	}
+
+	switch {
+	case pending >= viper.GetInt("pipeline_status.backlog.pending_red"):
+		c.flag(statusRed, "%d records pending", pending)
+	case pending >= viper.GetInt("pipeline_status.backlog.pending_yellow"):
+		c.flag(statusYellow, "%d records pending", pending)
+	}
+	switch {
+	case oldest >= viper.GetDuration("pipeline_status.backlog.age_red"):
+		c.flag(statusRed, "oldest pending record is %s old", oldest.Round(time.Second))
+	case oldest >= viper.GetDuration("pipeline_status.backlog.age_yellow"):
+		c.flag(statusYellow, "oldest pending record is %s old", oldest.Round(time.Second))
+	}
+	return c
+}
+
+// jobFailureStatus grades the processing jobs that failed within
+// pipeline_status.job_failures.window.
+func jobFailureStatus(ctx context.Context, r *http.Request) ComponentStatus {
+	c := ComponentStatus{Name: "jobs", Status: statusGreen}
+	type failedJob struct {
+		ID      string     `json:"id"`
+		EndTime *time.Time `json:"end_time"`
+		Error   string     `json:"error"`
+	}
+	// Jobs are listed oldest first, so the recent failures are on the last
+	// page.
+	var jobs []failedJob
+	query := url.Values{"status": {"failed"}, "limit": {strconv.Itoa(response.MaxLimit)}}
+	pagination, err := fetchUpstream(ctx, r, "data", "/api/v1/jobs", query, &jobs)
+	if err == nil && pagination != nil && pagination.Total > response.MaxLimit {
+		query.Set("offset", strconv.Itoa(pagination.Total-response.MaxLimit))
+		_, err = fetchUpstream(ctx, r, "data", "/api/v1/jobs", query, &jobs)
+	}
+	if err != nil {
+		c.flag(statusYellow, "job failures unknown: %v", err)
+		return c
+	}
+
+	window := viper.GetDuration("pipeline_status.job_failures.window")
+	since := time.Now().Add(-window)
+	var failed int
+	var last *failedJob
+	for i, job := range jobs {
+		if job.EndTime == nil || job.EndTime.Before(since) {
+			continue
+		}
+		failed++
+		if last == nil || job.EndTime.After(*last.EndTime) {
+			last = &jobs[i]
+		}
+	}
+	if failed == 0 {
+		return c
+	}
+	reason := fmt.Sprintf("%d jobs failed in the last %s, most recently %s: %s", failed, window, last.ID, last.Error)
+	switch {
+	case failed >= viper.GetInt("pipeline_status.job_failures.red"):
+		c.flag(statusRed, "%s", reason)
+	case failed >= viper.GetInt("pipeline_status.job_failures.yellow"):
+		c.flag(statusYellow, "%s", reason)
+	}
+	return c
+}
+
+// errorBudgetStatus grades how much of each service's error budget, the
+// downtime sla.target allows, is left over pipeline_status.slo.window.
+func errorBudgetStatus() ComponentStatus {
+	c := ComponentStatus{Name: "slo", Status: statusGreen}
+	opts := slaReportOptions()
+	allowed := 100 - opts.Target
+	if allowed <= 0 {
+		return c
+	}
+	window := viper.GetDuration("pipeline_status.slo.window")
+	now := time.Now()
+	report := slaHistory.Report("rolling", now.Add(-window), now, opts)
+	for _, s := range report.Services {
+		left := 100 - 100*(100-s.Availability)/allowed
+		switch {
+		case left <= 0:
+			c.flag(statusRed, "%s has used up its error budget: %.3f%% available against a %.3f%% target", s.Name, s.Availability, opts.Target)
+		case left < viper.GetFloat64("pipeline_status.slo.budget_yellow"):
+			c.flag(statusYellow, "%s has %.0f%% of its error budget left", s.Name, left)
+		}
+	}
+	return c
+}
+
+func pipelineStatusHandler(w http.ResponseWriter, r *http.Request) {
+	response.Write(w, r, http.StatusOK, currentPipelineStatus(r), nil)
+}
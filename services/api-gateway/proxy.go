@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/concurrency"
+	"pipeline/pkg/propagation"
+	"pipeline/pkg/rbac"
+	"pipeline/pkg/recording"
+	"pipeline/pkg/response"
+	"pipeline/pkg/telemetry"
+)
+
+// upstreamLimiters holds the adaptive concurrency limit of each proxied
+// service; nil when concurrency.enabled is off.
+var upstreamLimiters map[string]*concurrency.Limiter
+
+func newUpstreamLimiters() map[string]*concurrency.Limiter {
+	if !viper.GetBool("concurrency.enabled") {
+		return nil
+	}
+	limiters := make(map[string]*concurrency.Limiter)
+	for _, name := range []string{"business", "data"} {
+		limiters[name] = concurrency.NewLimiter(concurrency.Config{
+			Name:         name,
+			InitialLimit: viper.GetInt("concurrency.initial_limit"),
+			MinLimit:     viper.GetInt("concurrency.min_limit"),
+			MaxLimit:     viper.GetInt("concurrency.max_limit"),
+			Tolerance:    viper.GetFloat64("concurrency.latency_tolerance"),
+			Backoff:      viper.GetFloat64("concurrency.backoff"),
+		})
+	}
+	return limiters
+}
+
+// proxyHandler forwards /api/v1/proxy/{service}/{path} to the service's
+// {path}. Trace context and baggage pass through unchanged; the tenant,
+// API key and priority headers are normalised by requestContext first.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serviceName := vars["service"]
+	path := vars["path"]
+
+	pool := lookupUpstream(serviceName)
+	if pool == nil {
+		http.Error(w, "Unknown service", http.StatusNotFound)
+		return
+	}
+	if !routeRegistered(serviceName, path) {
+		http.Error(w, "No registered instance serves this route", http.StatusNotFound)
+		return
+	}
+	base := pool.targetFor(w, r, path)
+	if base == "" {
+		http.Error(w, "No instance of the service is registered", http.StatusServiceUnavailable)
+		return
+	}
+	defer pool.begin(base)()
+	target, err := url.Parse(base)
+	if err != nil {
+		http.Error(w, "Invalid upstream URL", http.StatusInternalServerError)
+		return
+	}
+
+	values := requestContext(r)
+	entry := logrus.WithFields(logrus.Fields{
+		"service": serviceName,
+		"path":    path,
+		"target":  base,
+	}).WithFields(values.LogFields())
+	entry.Info("Proxying request")
+
+	transforms := transformsFor(serviceName, path, r.Method)
+	if err := applyRequestTransforms(transforms, r); err != nil {
+		entry.WithError(err).Error("Request transform failed")
+		http.Error(w, "Request transform failed", http.StatusBadGateway)
+		return
+	}
+
+	// Invalid requests are turned away before they take a slot of the
+	// upstream's concurrency limit.
+	validation := validationFor(serviceName, path, r.Method)
+	if !validateRequest(w, r, validation, serviceName, path, entry) {
+		return
+	}
+
+	// Writes to an overloaded upstream wait for its backlog to drain
+	// rather than adding to it.
+	if pool.backpressureEnabled() && isWrite(r) && !pool.admitWrite(r.Context()) {
+		entry.Warn("Upstream overloaded, write rejected")
+		writeBackpressureRejection(w, serviceName)
+		return
+	}
+
+	// Requests over the upstream's limit fail fast rather than queueing
+	// behind a slow service. The latency sample is taken when the response
+	// headers arrive so streamed bodies do not count as slowness.
+	start := time.Now()
+	var latency time.Duration
+	failed := false
+	if limiter := upstreamLimiters[serviceName]; limiter != nil {
+		done, ok := limiter.Acquire()
+		if !ok {
+			entry.Warn("Upstream concurrency limit reached")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":     "upstream concurrency limit reached",
+				"service":   serviceName,
+				"timestamp": time.Now().UTC().Format(time.RFC3339),
+			})
+			return
+		}
+		defer func() {
+			if latency == 0 {
+				latency = time.Since(start)
+			}
+			done(latency, failed)
+		}()
+	}
+
+	// Sampled requests are recorded as the upstream sees them, after
+	// transforms and with the normalised context headers.
+	var captured *recording.Recording
+	status := http.StatusBadGateway
+	if requestRecorder != nil && requestRecorder.Sample() {
+		if captured, err = requestRecorder.Capture(r, serviceName, path); err != nil {
+			entry.WithError(err).Warn("Failed to record request")
+			captured = nil
+		} else {
+			values.Inject(captured.Header)
+			captured.TraceID = telemetry.TraceID(r)
+		}
+	}
+
+	releaseConn := func() {}
+	defer func() { releaseConn() }()
+
+	proxy := &httputil.ReverseProxy{
+		Transport: bootstrap.SignedTransport(viper.GetViper(), pool.transport),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			var ctx context.Context
+			ctx, releaseConn = pool.trace(pr.Out.Context())
+			pr.Out = pr.Out.WithContext(ctx)
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.URL.Path = strings.TrimRight(target.Path, "/") + "/" + path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = ""
+			pr.SetXForwarded()
+			// Lets the service's hypermedia links point back through the gateway.
+			pr.Out.Header.Set(response.PrefixHeader, "/api/v1/proxy/"+serviceName)
+			values.Inject(pr.Out.Header)
+			// The services believe X-Forwarded-User from the gateway, so it
+			// only ever names a caller the gateway verified.
+			pr.Out.Header.Del(audit.ForwardedUserHeader)
+			if actor := auditActors.Actor(r); actor != audit.Anonymous {
+				pr.Out.Header.Set(audit.ForwardedUserHeader, actor)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			latency = time.Since(start)
+			if pool.backpressureEnabled() {
+				pool.observeBackpressure(resp.Header.Get(backpressureHeader))
+			}
+			failed = resp.StatusCode >= 500
+			status = resp.StatusCode
+			validateResponse(resp, validation, serviceName, path, entry)
+			return applyResponseTransforms(transforms, resp)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status = http.StatusBadGateway
+			var terr *transformError
+			if errors.As(err, &terr) {
+				entry.WithError(err).Error("Response transform failed")
+				http.Error(w, "Response transform failed", http.StatusBadGateway)
+				return
+			}
+			failed = true
+			if r.Context().Err() == nil {
+				pool.connectionFailed(target.Hostname())
+			}
+			entry.WithError(err).Error("Proxy request failed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":     "upstream request failed",
+				"service":   serviceName,
+				"timestamp": time.Now().UTC().Format(time.RFC3339),
+			})
+		},
+	}
+	proxy.ServeHTTP(w, r)
+
+	if captured != nil {
+		captured.Status = status
+		captured.Duration = float64(time.Since(start).Microseconds()) / 1000
+		if err := requestRecorder.Add(captured); err != nil {
+			entry.WithError(err).Warn("Failed to save recorded request")
+		}
+	}
+}
+
+// requestContext returns the propagated values of r as the gateway forwards
+// them. The API key ID is derived from the request's credentials rather than
+// taken from the client, so downstream services can trust it.
+func requestContext(r *http.Request) propagation.Values {
+	values := propagation.FromRequest(r)
+	values.APIKeyID = apiKeyID(r)
+	if values.Tenant == "" {
+		values.Tenant = viper.GetString("propagation.default_tenant")
+	}
+	return values
+}
+
+// apiKeyID is the caller rbac verified: the ID of the API key whose
+// credentials the request carries, or the subject of its JWT. It is empty
+// for anonymous requests and for credentials rbac could not verify.
+func apiKeyID(r *http.Request) string {
+	return rbac.Caller(r)
+}
+
+// callerKey is the API key ID usage and quotas are accounted to. Anonymous
+// requests and credentials rbac could not verify share the key "anonymous",
+// so made-up tokens neither escape quotas nor add keys to the stores.
+func callerKey(r *http.Request) string {
+	if id := apiKeyID(r); id != "" {
+		return id
+	}
+	return "anonymous"
+}
+
+func contextLogFields(r *http.Request) logrus.Fields {
+	return requestContext(r).LogFields()
+}
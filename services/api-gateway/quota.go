@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/quota"
+)
+
+// quotaManager enforces the per-API-key quotas on proxied requests; it is nil
+// when quotas.enabled is false.
+var quotaManager *quota.Manager
+
+// startQuotas opens the quota store at quotas.path. The returned func saves
+// it a last time.
+func startQuotas() func() {
+	if !viper.GetBool("quotas.enabled") {
+		return func() {}
+	}
+
+	var keys map[string]quota.Limits
+	if err := viper.UnmarshalKey("quotas.keys", &keys); err != nil {
+		logrus.WithError(err).Fatal("Invalid quotas.keys config")
+	}
+	loc, err := time.LoadLocation(viper.GetString("quotas.timezone"))
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid quotas.timezone, using UTC")
+		loc = time.UTC
+	}
+	manager, err := quota.NewManager(quota.Config{
+		Path: viper.GetString("quotas.path"),
+		Default: quota.Limits{
+			Daily:   viper.GetInt64("quotas.default.daily"),
+			Monthly: viper.GetInt64("quotas.default.monthly"),
+		},
+		Keys:     keys,
+		Location: loc,
+		Key:      callerKey,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open quota store")
+	}
+	quotaManager = manager
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Run(viper.GetDuration("quotas.flush_interval"), stop, func(err error) {
+			logrus.WithError(err).Error("Failed to save quota store")
+		})
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// withQuota enforces quotas on next when they are enabled.
+func withQuota(next http.HandlerFunc) http.Handler {
+	if quotaManager == nil {
+		return next
+	}
+	return quotaManager.Wrap(next)
+}
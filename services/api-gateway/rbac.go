@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/rbac"
+)
+
+// newAuthorizer builds the role-based access control middleware from the
+// rbac config section; it is nil when rbac.enabled is false.
+func newAuthorizer() (*rbac.Authorizer, error) {
+	if !viper.GetBool("rbac.enabled") {
+		return nil, nil
+	}
+
+	var apiKeys map[string]rbac.APIKey
+	if err := viper.UnmarshalKey("rbac.api_keys", &apiKeys); err != nil {
+		return nil, fmt.Errorf("rbac.api_keys: %w", err)
+	}
+	if _, ok := apiKeys["anonymous"]; ok {
+		return nil, fmt.Errorf("rbac.api_keys: anonymous is the key of unverified callers")
+	}
+	var inherits map[string][]string
+	if viper.IsSet("rbac.inherits") {
+		if err := viper.UnmarshalKey("rbac.inherits", &inherits); err != nil {
+			return nil, fmt.Errorf("rbac.inherits: %w", err)
+		}
+	}
+	var policies []rbac.Policy
+	if err := viper.UnmarshalKey("rbac.policies", &policies); err != nil {
+		return nil, fmt.Errorf("rbac.policies: %w", err)
+	}
+	publicKey := viper.GetString("rbac.jwt.public_key")
+	if file := viper.GetString("rbac.jwt.public_key_file"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("rbac.jwt.public_key_file: %w", err)
+		}
+		publicKey = string(data)
+	}
+
+	return rbac.New(rbac.Config{
+		JWT: rbac.JWTConfig{
+			HMACSecret:   viper.GetString("rbac.jwt.hmac_secret"),
+			PublicKeyPEM: publicKey,
+			Issuer:       viper.GetString("rbac.jwt.issuer"),
+			Audience:     viper.GetString("rbac.jwt.audience"),
+			RolesClaim:   viper.GetString("rbac.jwt.roles_claim"),
+			Leeway:       viper.GetDuration("rbac.jwt.leeway"),
+		},
+		APIKeys:        apiKeys,
+		AnonymousRoles: viper.GetStringSlice("rbac.anonymous_roles"),
+		Inherits:       inherits,
+		Policies:       policies,
+		DefaultAllow:   viper.GetBool("rbac.default_allow"),
+		OnDeny:         rbacDenied,
+	})
+}
+
+func rbacDenied(r *http.Request, status int, reason string, id rbac.Identity) {
+	logrus.WithFields(logrus.Fields{
+		"reason":      reason,
+		"subject":     id.Subject,
+		"roles":       id.Roles,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"remote_addr": r.RemoteAddr,
+	}).Warn("Request denied by access policy")
+	if auditRecorder != nil {
+		auditRecorder.Record(r, status, "denied: "+reason)
+	}
+}
+
+// authenticationMiddleware identifies callers for the usage, quota and audit
+// records as well as for authorizationMiddleware. Without rbac no caller is
+// verified and all count as anonymous.
+func authenticationMiddleware(authorizer *rbac.Authorizer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if authorizer == nil {
+			return next
+		}
+		return authorizer.Authenticate(next)
+	}
+}
+
+func authorizationMiddleware(authorizer *rbac.Authorizer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if authorizer == nil {
+			return next
+		}
+		return authorizer.Wrap(next)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/recording"
+)
+
+// requestRecorder samples proxied requests for replay; it is nil when
+// recording.enabled is false.
+var requestRecorder *recording.Recorder
+
+func newRequestRecorder() *recording.Recorder {
+	if !viper.GetBool("recording.enabled") {
+		return nil
+	}
+	var redact []string
+	if viper.IsSet("recording.redact_headers") {
+		redact = viper.GetStringSlice("recording.redact_headers")
+	}
+	rec, err := recording.New(recording.Config{
+		SampleRate:    viper.GetFloat64("recording.sample_rate"),
+		Capacity:      viper.GetInt("recording.capacity"),
+		MaxBodyBytes:  viper.GetInt64("recording.max_body_bytes"),
+		Dir:           viper.GetString("recording.dir"),
+		RedactHeaders: redact,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open request recordings")
+	}
+	return rec
+}
+
+// replayTarget resolves the target of a replay: the recording's own upstream
+// when empty, another upstream by name, or one of recording.replay_targets.
+// Anything else is refused so replays cannot reach arbitrary hosts.
+func replayTarget(r *recording.Recording, target string) (string, error) {
+	if target == "" {
+		target = r.Service
+	}
+	if pool, ok := upstreams[target]; ok {
+		return pool.balance(), nil
+	}
+	if url := viper.GetStringMapString("recording.replay_targets")[target]; url != "" {
+		return url, nil
+	}
+	return "", fmt.Errorf("unknown replay target %q", target)
+}
+
+func replayHandler() http.Handler {
+	client := &http.Client{Timeout: viper.GetDuration("recording.replay_timeout"), Transport: bootstrap.SignedTransport(viper.GetViper(), nil)}
+	return requestRecorder.ReplayHandler(client, replayTarget, viper.GetInt64("recording.max_body_bytes"))
+}
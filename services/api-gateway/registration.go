@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+var (
+	registeredInstanceCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_registered_instances",
+			Help: "Instances of each service with a live self-registration",
+		},
+		[]string{"service"},
+	)
+	registrationEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_registrations_total",
+			Help: "Self-registration events by service and event: registered, renewed, expired or deregistered",
+		},
+		[]string{"service", "event"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(registeredInstanceCount, registrationEvents)
+}
+
+// Instance is a service instance registered with POST /api/v1/register.
+type Instance struct {
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	HealthPath string    `json:"health_path"`
+	Routes     []string  `json:"routes,omitempty"`
+	Registered time.Time `json:"registered_at"`
+	Expires    time.Time `json:"expires_at"`
+}
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// validate checks a registration and fills in the default health path.
+func (in *Instance) validate() error {
+	if !serviceNamePattern.MatchString(in.Name) {
+		return fmt.Errorf("name must be lowercase letters, digits and dashes")
+	}
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	in.URL = strings.TrimSuffix(in.URL, "/")
+	if in.HealthPath == "" {
+		in.HealthPath = "/health"
+	}
+	if !strings.HasPrefix(in.HealthPath, "/") {
+		return fmt.Errorf("health_path must start with /")
+	}
+	return nil
+}
+
+// serves reports whether the instance accepts proxied requests for path;
+// an instance without routes accepts all.
+func (in *Instance) serves(path string) bool {
+	if len(in.Routes) == 0 {
+		return true
+	}
+	path = "/" + strings.TrimPrefix(path, "/")
+	for _, route := range in.Routes {
+		if prefix, ok := strings.CutSuffix(route, "*"); (ok && strings.HasPrefix(path, prefix)) || path == route {
+			return true
+		}
+	}
+	return false
+}
+
+// healthCheck is the health check of a service that is not configured,
+// made against one of its instances.
+type healthCheck struct {
+	url  string
+	stop func()
+}
+
+// registrations holds the live instances by upstream name, such as data for
+// data-service, and the upstreams and health checks created for services
+// that are not in upstreamNames.
+var registrations = struct {
+	mu        sync.RWMutex
+	instances map[string][]*Instance
+	dynamic   map[string]*upstream
+	checks    map[string]healthCheck
+}{
+	instances: make(map[string][]*Instance),
+	dynamic:   make(map[string]*upstream),
+	checks:    make(map[string]healthCheck),
+}
+
+func upstreamName(serviceName string) string {
+	return strings.TrimSuffix(serviceName, "-service")
+}
+
+// lookupUpstream returns the upstream of a proxied service: a configured
+// one, or one created for a registered service; nil if there is neither.
+func lookupUpstream(name string) *upstream {
+	if u, ok := upstreams[name]; ok {
+		return u
+	}
+	registrations.mu.RLock()
+	defer registrations.mu.RUnlock()
+	return registrations.dynamic[name]
+}
+
+// registeredTargets returns the URLs of the upstream's live instances.
+func registeredTargets(name string) []string {
+	registrations.mu.RLock()
+	defer registrations.mu.RUnlock()
+	var targets []string
+	for _, in := range registrations.instances[name] {
+		targets = append(targets, in.URL)
+	}
+	return targets
+}
+
+// registeredInstances returns copies of the upstream's live instances.
+func registeredInstances(name string) []Instance {
+	registrations.mu.RLock()
+	defer registrations.mu.RUnlock()
+	var instances []Instance
+	for _, in := range registrations.instances[name] {
+		instances = append(instances, *in)
+	}
+	return instances
+}
+
+// routeRegistered reports whether a live instance of the upstream serves
+// path; true when the upstream has no instances, so configured services
+// that do not register are proxied as before.
+func routeRegistered(name, path string) bool {
+	registrations.mu.RLock()
+	defer registrations.mu.RUnlock()
+	instances := registrations.instances[name]
+	if len(instances) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(instances, func(in *Instance) bool { return in.serves(path) })
+}
+
+// errConfiguredService is returned by register for a service in
+// upstreamNames while registration.configured_services is off.
+var errConfiguredService = errors.New("service is configured on the gateway and registration.configured_services is off")
+
+// register adds or renews an instance. The first instance of a service
+// that is not configured gets an upstream and a health check of its own.
+func register(in Instance) (Instance, error) {
+	name := upstreamName(in.Name)
+	now := time.Now().UTC()
+	in.Expires = now.Add(viper.GetDuration("registration.ttl"))
+
+	_, configured := upstreams[name]
+	if configured && !viper.GetBool("registration.configured_services") {
+		return in, errConfiguredService
+	}
+
+	registrations.mu.Lock()
+	defer registrations.mu.Unlock()
+	for _, existing := range registrations.instances[name] {
+		if existing.URL == in.URL {
+			in.Registered = existing.Registered
+			*existing = in
+			registrationEvents.WithLabelValues(in.Name, "renewed").Inc()
+			return in, nil
+		}
+	}
+
+	_, known := registrations.instances[name]
+	if !configured && !known && len(registrations.dynamic) >= viper.GetInt("registration.max_services") {
+		return in, fmt.Errorf("registration.max_services reached")
+	}
+	in.Registered = now
+	registrations.instances[name] = append(registrations.instances[name], &in)
+	if !configured && registrations.dynamic[name] == nil {
+		registrations.dynamic[name] = newUpstream(name)
+		registrations.checks[name] = healthCheck{in.URL, checkServiceHealth(in.Name, in.URL, in.HealthPath)}
+	}
+	registeredInstanceCount.WithLabelValues(in.Name).Set(float64(len(registrations.instances[name])))
+	registrationEvents.WithLabelValues(in.Name, "registered").Inc()
+	logrus.WithFields(logrus.Fields{"service": in.Name, "url": in.URL, "routes": in.Routes}).Info("Service instance registered")
+	return in, nil
+}
+
+// deregister removes the instance of serviceName at instanceURL, reporting
+// whether there was one; event is why.
+func deregister(serviceName, instanceURL, event string) bool {
+	registrations.mu.Lock()
+	defer registrations.mu.Unlock()
+	return removeInstance(upstreamName(serviceName), strings.TrimSuffix(instanceURL, "/"), event)
+}
+
+// removeInstance drops an instance. For a service that is not configured,
+// the health check moves to another instance, and the last instance takes
+// the upstream and health check with it. Callers hold registrations.mu.
+func removeInstance(name, instanceURL, event string) bool {
+	instances := registrations.instances[name]
+	i := slices.IndexFunc(instances, func(in *Instance) bool { return in.URL == instanceURL })
+	if i < 0 {
+		return false
+	}
+	in := instances[i]
+	instances = slices.Delete(instances, i, i+1)
+	registrationEvents.WithLabelValues(in.Name, event).Inc()
+	registeredInstanceCount.WithLabelValues(in.Name).Set(float64(len(instances)))
+	logrus.WithFields(logrus.Fields{"service": in.Name, "url": in.URL, "reason": event}).Info("Service instance removed from routing")
+	check, checked := registrations.checks[name]
+	if checked && check.url == in.URL {
+		check.stop()
+		unregisterService(in.Name)
+		delete(registrations.checks, name)
+	}
+	if len(instances) > 0 {
+		registrations.instances[name] = instances
+		if checked && check.url == in.URL {
+			next := instances[0]
+			registrations.checks[name] = healthCheck{next.URL, checkServiceHealth(next.Name, next.URL, next.HealthPath)}
+		}
+		return true
+	}
+
+	delete(registrations.instances, name)
+	if u, ok := registrations.dynamic[name]; ok {
+		u.transport.CloseIdleConnections()
+		delete(registrations.dynamic, name)
+	}
+	return true
+}
+
+// expireRegistrationsContinuously removes instances whose registration was
+// not renewed within registration.ttl.
+func expireRegistrationsContinuously() {
+	ticker := time.NewTicker(max(viper.GetDuration("registration.ttl")/3, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		registrations.mu.Lock()
+		for name, instances := range registrations.instances {
+			for _, in := range slices.Clone(instances) {
+				if now.After(in.Expires) {
+					removeInstance(name, in.URL, "expired")
+				}
+			}
+		}
+		registrations.mu.Unlock()
+	}
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	var in Instance
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := in.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	registered, err := register(in)
+	if errors.Is(err, errConfiguredService) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	response.Write(w, r, http.StatusOK, registered, nil)
+}
+
+func deregisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !deregister(mux.Vars(r)["name"], r.URL.Query().Get("url"), "deregistered") {
+		http.Error(w, "Registration not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
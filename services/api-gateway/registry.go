@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"pipeline/pkg/prober"
+)
+
+// ServiceEntry is a downstream service as listed by GET /api/v1/services.
+type ServiceEntry struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	ActiveURL string `json:"active_url"`
+	Type      string `json:"type"`
+	// Status is healthy, unhealthy or unknown until the first check.
+	Status              string     `json:"status"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	Latency             float64    `json:"latency_seconds"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	// Version, APIVersions and Capabilities are what the service's /
+	// endpoint last reported, at InfoUpdated.
+	Version      string     `json:"version,omitempty"`
+	APIVersions  []string   `json:"api_versions,omitempty"`
+	Capabilities []string   `json:"capabilities,omitempty"`
+	InfoUpdated  *time.Time `json:"info_updated,omitempty"`
+	// Incompatible lists how the service falls short of its
+	// discovery.requirements; empty when it meets them.
+	Incompatible []string `json:"incompatible,omitempty"`
+	// ActiveTarget is primary, or standby while failover has tripped and
+	// traffic goes to failover.standby.<upstream>.
+	ActiveTarget string `json:"active_target,omitempty"`
+	// Backpressure is the last state the service reported, for upstreams
+	// with backpressure enabled.
+	Backpressure string `json:"backpressure,omitempty"`
+	// Instances are the live self-registrations of the service.
+	Instances []Instance `json:"instances,omitempty"`
+}
+
+// registeredService is a health-checked service and what the gateway has
+// learned about it.
+type registeredService struct {
+	name   string
+	url    string
+	prober *prober.Prober
+
+	mu           sync.Mutex
+	info         ServiceInfo
+	incompatible []string
+}
+
+// registry holds the downstream services by name.
+var registry = struct {
+	mu       sync.RWMutex
+	services map[string]*registeredService
+}{services: make(map[string]*registeredService)}
+
+func registerService(s *registeredService) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.services[s.name] = s
+}
+
+// unregisterService drops a service from the registry and its health
+// gauges.
+func unregisterService(name string) {
+	registry.mu.Lock()
+	delete(registry.services, name)
+	registry.mu.Unlock()
+	serviceHealth.DeleteLabelValues(name)
+	serviceHealthUnknown.DeleteLabelValues(name)
+	serviceIncompatible.DeleteLabelValues(name)
+}
+
+// registeredServices returns the services sorted by name.
+func registeredServices() []*registeredService {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	services := make([]*registeredService, 0, len(registry.services))
+	for _, s := range registry.services {
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].name < services[j].name })
+	return services
+}
+
+// entry is the service's current state.
+func (s *registeredService) entry() ServiceEntry {
+	status := s.prober.Status()
+	e := ServiceEntry{
+		Name:                s.name,
+		URL:                 s.url,
+		ActiveURL:           s.url,
+		Type:                "REST API",
+		Status:              "unknown",
+		LastError:           status.LastError,
+		Latency:             status.Latency,
+		ConsecutiveFailures: status.ConsecutiveFailures,
+	}
+	if status.Known {
+		e.Status = "unhealthy"
+		if status.Healthy {
+			e.Status = "healthy"
+		}
+		e.LastCheck = &status.LastCheck
+	}
+	s.mu.Lock()
+	e.Version = s.info.Version
+	e.APIVersions = s.info.APIVersions
+	e.Capabilities = s.info.Capabilities
+	if !s.info.Updated.IsZero() {
+		updated := s.info.Updated
+		e.InfoUpdated = &updated
+	}
+	e.Incompatible = s.incompatible
+	s.mu.Unlock()
+
+	e.Instances = registeredInstances(upstreamName(s.name))
+	if u := upstreamForService(s.name); u != nil {
+		if primary := u.primaryURL(); primary != "" {
+			e.URL, e.ActiveURL = primary, u.activeURL()
+		}
+		e.ActiveTarget = "primary"
+		u.failover.mu.Lock()
+		if u.failover.onStandby {
+			e.ActiveTarget = "standby"
+		}
+		u.failover.mu.Unlock()
+		if u.backpressureEnabled() {
+			u.backpressure.mu.Lock()
+			e.Backpressure = u.backpressure.state
+			u.backpressure.mu.Unlock()
+		}
+	}
+	return e
+}
+
+func servicesHandler(w http.ResponseWriter, r *http.Request) {
+	services := registeredServices()
+	entries := make([]ServiceEntry, len(services))
+	for i, s := range services {
+		entries[i] = s.entry()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"services":        entries,
+		"gateway_version": version,
+		"timestamp":       time.Now().UTC().Format(time.RFC3339),
+	})
+}
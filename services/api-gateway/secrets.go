@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+)
+
+// resolveSecrets replaces every vault:<path>#<field> config value with the
+// secret it references and watches them for rotation. Every setting is read
+// once, so rotated secrets apply on restart.
+func resolveSecrets() {
+	bootstrap.ResolveSecrets(viper.GetViper(), func(key string) {
+		logrus.WithField("key", key).Warn("Secret rotated, restart to apply")
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/incident"
+	"pipeline/pkg/response"
+	"pipeline/pkg/silence"
+)
+
+// silenceStore holds the silences and maintenance windows; it is nil when
+// silences.enabled is false.
+var silenceStore *silence.Store
+
+func startSilences() func() {
+	if !viper.GetBool("silences.enabled") {
+		return func() {}
+	}
+	store, err := silence.NewStore(silence.Config{
+		Path:      viper.GetString("silences.path"),
+		Retention: viper.GetDuration("silences.retention"),
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open silence store")
+	}
+	silenceStore = store
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			store.UpdateGauges()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// mutedBy returns the silence or maintenance window muting an alert with
+// labels now.
+func mutedBy(labels map[string]string) (string, bool) {
+	if silenceStore == nil {
+		return "", false
+	}
+	return silenceStore.Muted(labels, time.Now())
+}
+
+// incidentMuted reports whether an incident's alert labels, or its service,
+// are muted; muted incidents are not paged.
+func incidentMuted(in incident.Incident) bool {
+	labels := make(map[string]string, len(in.Labels)+1)
+	for name, value := range in.Labels {
+		labels[name] = value
+	}
+	if in.Service != "" {
+		labels["service"] = in.Service
+	}
+	_, muted := mutedBy(labels)
+	return muted
+}
+
+// inMaintenance reports whether a service is under a maintenance window at
+// a time, so its health checks do not count towards availability.
+func inMaintenance(service string, at time.Time) (silence.Window, bool) {
+	if silenceStore == nil {
+		return silence.Window{}, false
+	}
+	return silenceStore.InMaintenance(service, at)
+}
+
+// writeSilenceError answers with the status matching a store error.
+func writeSilenceError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, silence.ErrNotFound):
+		http.Error(w, "Silence not found", http.StatusNotFound)
+	case errors.Is(err, silence.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		logrus.WithFields(contextLogFields(r)).WithError(err).Error("Failed to save silences")
+		http.Error(w, "Failed to save silences", http.StatusInternalServerError)
+	}
+}
+
+// silenceState reads the state filter of the list endpoints.
+func silenceState(r *http.Request) (string, bool) {
+	switch state := r.URL.Query().Get("state"); state {
+	case "", silence.StatePending, silence.StateActive, silence.StateExpired:
+		return state, true
+	default:
+		return "", false
+	}
+}
+
+// endsAfter sets the end of a period from a duration such as 2h, for
+// requests that give one instead of ends_at.
+func endsAfter(p *silence.Period, duration string) error {
+	if duration == "" || !p.EndsAt.IsZero() {
+		return nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return errors.New("invalid duration, use a duration such as 2h")
+	}
+	start := p.StartsAt
+	if start.IsZero() {
+		start = time.Now()
+	}
+	p.EndsAt = start.Add(d)
+	return nil
+}
+
+func listSilencesHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, ok := silenceState(r)
+	if !ok {
+		http.Error(w, "state must be pending, active or expired", http.StatusBadRequest)
+		return
+	}
+	list := silenceStore.Silences(state)
+	lo, hi := page.Bounds(len(list))
+	response.WriteList(w, r, list[lo:hi], page, len(list), nil)
+}
+
+func createSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		silence.Silence
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := endsAfter(&body.Period, body.Duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	created, err := silenceStore.AddSilence(body.Silence, auditActors.Actor(r))
+	if err != nil {
+		writeSilenceError(w, r, err)
+		return
+	}
+	logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{"silence": created.ID, "ends_at": created.EndsAt}).Info("Silence created")
+	response.Created(w, r, created, response.Links{"self": response.Link(r, "/api/v1/silences/"+created.ID)})
+}
+
+func getSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	sil, ok := silenceStore.Silence(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	response.Write(w, r, http.StatusOK, sil, nil)
+}
+
+// expireSilenceHandler ends a silence now. The silence is kept, expired,
+// for silences.retention.
+func expireSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if before, ok := silenceStore.Silence(id); ok {
+		audit.SetBefore(r.Context(), before)
+	}
+	expired, err := silenceStore.ExpireSilence(id)
+	if err != nil {
+		writeSilenceError(w, r, err)
+		return
+	}
+	logrus.WithFields(contextLogFields(r)).WithField("silence", id).Info("Silence expired")
+	wakeOnCall()
+	response.Write(w, r, http.StatusOK, expired, nil)
+}
+
+func listMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, ok := silenceState(r)
+	if !ok {
+		http.Error(w, "state must be pending, active or expired", http.StatusBadRequest)
+		return
+	}
+	list := silenceStore.Windows(state)
+	lo, hi := page.Bounds(len(list))
+	response.WriteList(w, r, list[lo:hi], page, len(list), nil)
+}
+
+func createMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		silence.Window
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := endsAfter(&body.Period, body.Duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	created, err := silenceStore.AddWindow(body.Window, auditActors.Actor(r))
+	if err != nil {
+		writeSilenceError(w, r, err)
+		return
+	}
+	logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{"window": created.ID, "services": created.Services, "starts_at": created.StartsAt, "ends_at": created.EndsAt}).Info("Maintenance window scheduled")
+	response.Created(w, r, created, response.Links{"self": response.Link(r, "/api/v1/maintenance/"+created.ID)})
+}
+
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	win, ok := silenceStore.Window(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Maintenance window not found", http.StatusNotFound)
+		return
+	}
+	response.Write(w, r, http.StatusOK, win, nil)
+}
+
+// endMaintenanceHandler ends a maintenance window now, or cancels a pending
+// one.
+func endMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if before, ok := silenceStore.Window(id); ok {
+		audit.SetBefore(r.Context(), before)
+	}
+	ended, err := silenceStore.EndWindow(id)
+	if errors.Is(err, silence.ErrNotFound) {
+		http.Error(w, "Maintenance window not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeSilenceError(w, r, err)
+		return
+	}
+	logrus.WithFields(contextLogFields(r)).WithField("window", id).Info("Maintenance window ended")
+	wakeOnCall()
+	response.Write(w, r, http.StatusOK, ended, nil)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+	"pipeline/pkg/sla"
+)
+
+// slaHistory records health checks and request outcomes for the SLA reports;
+// it is nil when sla.enabled is false.
+var slaHistory *sla.History
+
+// startSLAHistory opens the history at sla.path. The returned func flushes
+// and closes it.
+func startSLAHistory() func() {
+	if !viper.GetBool("sla.enabled") {
+		return func() {}
+	}
+
+	history, err := sla.NewHistory(sla.Config{
+		Path:           viper.GetString("sla.path"),
+		Retention:      viper.GetDuration("sla.retention"),
+		DailyRetention: viper.GetDuration("sla.daily_retention"),
+		OnError: func(err error) {
+			logrus.WithError(err).Error("Failed to write SLA history")
+		},
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open SLA history")
+	}
+	slaHistory = history
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		history.Run(viper.GetDuration("sla.flush_interval"), stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+		history.Close()
+	}
+}
+
+func slaReportOptions() sla.ReportOptions {
+	return sla.ReportOptions{
+		Target:         viper.GetFloat64("sla.target"),
+		WorstEndpoints: viper.GetInt("sla.worst_endpoints"),
+		MinRequests:    viper.GetInt64("sla.min_requests"),
+	}
+}
+
+// slaLocation is the time zone that report days and weeks are cut in.
+func slaLocation() *time.Location {
+	loc, err := time.LoadLocation(viper.GetString("sla.timezone"))
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid sla.timezone, using UTC")
+		return time.UTC
+	}
+	return loc
+}
+
+// burnWindows are the sla.burn_rate.windows the burn rates are computed
+// over.
+var burnWindows []time.Duration
+
+// startBurnRates refreshes pipeline_slo_burn_rate every
+// sla.burn_rate.interval for Prometheus' multi-window burn-rate alerts.
+func startBurnRates() func() {
+	if slaHistory == nil {
+		return func() {}
+	}
+	for _, v := range viper.GetStringSlice("sla.burn_rate.windows") {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			logrus.WithField("window", v).Fatal("Invalid sla.burn_rate.windows, use durations of at least 1m such as 5m")
+		}
+		burnWindows = append(burnWindows, d)
+	}
+	if len(burnWindows) == 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(viper.GetDuration("sla.burn_rate.interval"))
+		defer ticker.Stop()
+		for {
+			slaHistory.BurnRates(burnWindows, time.Now(), viper.GetFloat64("sla.target"))
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// burnRatesHandler serves the current burn rate of every service over each
+// of sla.burn_rate.windows.
+func burnRatesHandler(w http.ResponseWriter, r *http.Request) {
+	target := viper.GetFloat64("sla.target")
+	response.Write(w, r, http.StatusOK, map[string]interface{}{
+		"target_percent": target,
+		"burn_rates":     slaHistory.BurnRates(burnWindows, time.Now(), target),
+	}, nil)
+}
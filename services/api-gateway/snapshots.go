@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+	"pipeline/pkg/bootstrap"
+)
+
+var snapshotOperations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_snapshot_operations_total",
+		Help: "Pipeline snapshot operations run across the services, by operation and result",
+	},
+	[]string{"operation", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(snapshotOperations)
+}
+
+// serviceSnapshotResult is one service's answer to a snapshot operation.
+type serviceSnapshotResult struct {
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// pipelineSnapshotResult is the outcome of a snapshot operation across
+// the services, keyed by upstream name.
+type pipelineSnapshotResult struct {
+	Name     string                           `json:"name"`
+	Services map[string]serviceSnapshotResult `json:"services"`
+}
+
+// callSnapshotService sends method path to one of the service's upstream
+// targets on behalf of r. The caller's credentials are passed on, so the
+// services' endpoint_protection must accept the same admin credentials as
+// the gateway's.
+func callSnapshotService(r *http.Request, service, method, path string) serviceSnapshotResult {
+	pool := upstreams[service]
+	base := pool.balance()
+	defer pool.begin(base)()
+
+	ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration("snapshots.timeout"))
+	defer cancel()
+	traceCtx, release := pool.trace(ctx)
+	defer release()
+	req, err := http.NewRequestWithContext(traceCtx, method, strings.TrimRight(base, "/")+path, nil)
+	if err != nil {
+		return serviceSnapshotResult{Error: err.Error()}
+	}
+	req.Header.Set("Accept", "application/json")
+	for _, h := range []string{"Authorization", "traceparent", "tracestate", audit.RequestIDHeader} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	requestContext(r).Inject(req.Header)
+
+	resp, err := (&http.Client{Transport: bootstrap.SignedTransport(viper.GetViper(), pool.transport)}).Do(req)
+	if err != nil {
+		// The cause is logged rather than returned, so upstream addresses
+		// stay internal.
+		logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+			"service": service,
+			"path":    path,
+			"target":  base,
+		}).WithError(err).Error("Snapshot request failed")
+		return serviceSnapshotResult{Error: service + "-service request failed"}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	result := serviceSnapshotResult{Status: resp.StatusCode}
+	switch {
+	case resp.StatusCode >= 300:
+		result.Error = strings.TrimSpace(string(body))
+	case json.Valid(body):
+		result.Result = body
+	}
+	return result
+}
+
+// runSnapshotOperation calls every upstream in turn and answers with their
+// results: 200 when all succeeded, else the status of the first failure,
+// or 502 when a service could not be reached.
+func runSnapshotOperation(w http.ResponseWriter, r *http.Request, operation, method, path string) {
+	result := pipelineSnapshotResult{Name: mux.Vars(r)["name"], Services: map[string]serviceSnapshotResult{}}
+	status := http.StatusOK
+	for _, service := range upstreamNames {
+		res := callSnapshotService(r, service, method, path)
+		result.Services[service] = res
+		if res.Error != "" && status == http.StatusOK {
+			status = res.Status
+			if status == 0 {
+				status = http.StatusBadGateway
+			}
+		}
+	}
+	outcome := "ok"
+	if status != http.StatusOK {
+		outcome = "failed"
+	}
+	snapshotOperations.WithLabelValues(operation, outcome).Inc()
+	logrus.WithFields(contextLogFields(r)).WithFields(logrus.Fields{
+		"snapshot":  result.Name,
+		"operation": operation,
+		"status":    status,
+	}).Info("Pipeline snapshot operation finished")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// listSnapshots returns the snapshots of every service by name and then
+// service. On failure it answers r itself and returns nil.
+func listSnapshots(w http.ResponseWriter, r *http.Request) map[string]map[string]json.RawMessage {
+	byName := map[string]map[string]json.RawMessage{}
+	for _, service := range upstreamNames {
+		res := callSnapshotService(r, service, http.MethodGet, "/api/v1/snapshots")
+		var infos []json.RawMessage
+		if res.Error != "" || json.Unmarshal(res.Result, &infos) != nil {
+			status := res.Status
+			if status < 400 {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, service+"-service: "+res.Error, status)
+			return nil
+		}
+		for _, info := range infos {
+			var named struct {
+				Name string `json:"name"`
+			}
+			if json.Unmarshal(info, &named) != nil || named.Name == "" {
+				continue
+			}
+			if byName[named.Name] == nil {
+				byName[named.Name] = map[string]json.RawMessage{}
+			}
+			byName[named.Name][service] = info
+		}
+	}
+	return byName
+}
+
+// listPipelineSnapshotsHandler serves GET /admin/snapshots: each snapshot
+// name with what every service holds under it. Only complete snapshots,
+// held by every service, can be restored.
+func listPipelineSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	byName := listSnapshots(w, r)
+	if byName == nil {
+		return
+	}
+
+	type pipelineSnapshot struct {
+		Name     string                     `json:"name"`
+		Complete bool                       `json:"complete"`
+		Services map[string]json.RawMessage `json:"services"`
+	}
+	list := make([]pipelineSnapshot, 0, len(byName))
+	for name, services := range byName {
+		list = append(list, pipelineSnapshot{Name: name, Complete: len(services) == len(upstreamNames), Services: services})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// createPipelineSnapshotHandler serves PUT /admin/snapshots/{name}, saving
+// the state of every service under name.
+func createPipelineSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	runSnapshotOperation(w, r, "create", http.MethodPut, "/api/v1/snapshots/"+mux.Vars(r)["name"])
+}
+
+// restorePipelineSnapshotHandler serves POST /admin/snapshots/{name}/restore.
+// Nothing is restored unless every service holds the snapshot. Services are
+// then restored one after another; a failure leaves the services before it
+// restored, and the request can be repeated.
+func restorePipelineSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	byName := listSnapshots(w, r)
+	if byName == nil {
+		return
+	}
+	var missing []string
+	for _, service := range upstreamNames {
+		if _, ok := byName[name][service]; !ok {
+			missing = append(missing, service+"-service")
+		}
+	}
+	if len(missing) > 0 {
+		snapshotOperations.WithLabelValues("restore", "failed").Inc()
+		http.Error(w, "Snapshot not found in "+strings.Join(missing, ", "), http.StatusNotFound)
+		return
+	}
+	runSnapshotOperation(w, r, "restore", http.MethodPost, "/api/v1/snapshots/"+mux.Vars(r)["name"]+"/restore")
+}
+
+// deletePipelineSnapshotHandler serves DELETE /admin/snapshots/{name}.
+func deletePipelineSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	runSnapshotOperation(w, r, "delete", http.MethodDelete, "/api/v1/snapshots/"+mux.Vars(r)["name"])
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/incident"
+	"pipeline/pkg/response"
+	"pipeline/pkg/sla"
+)
+
+// StatusPage is the public status page served at /status.
+type StatusPage struct {
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	// Components are those of the pipeline status; their reasons are only
+	// shown with status_page.show_reasons, as they may name internal hosts.
+	Components  []ComponentStatus `json:"components"`
+	Services    []ServiceUptime   `json:"services"`
+	Incidents   []StatusIncident  `json:"incidents"`
+	Days        int               `json:"days"`
+	GeneratedAt time.Time         `json:"generated_at"`
+}
+
+// ServiceUptime is a service's current health and its uptime per day, oldest
+// day first.
+type ServiceUptime struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Uptime is the share of healthy checks over all days, nil without
+	// checks.
+	Uptime *float64    `json:"uptime_percent"`
+	Days   []UptimeDay `json:"days"`
+}
+
+// UptimeDay is one bar of a service's uptime chart. Status is ok at or
+// above sla.target, degraded below it, down below status_page.down_below,
+// maintenance for days checked only during maintenance and none for days
+// without checks.
+type UptimeDay struct {
+	Date      string   `json:"date"`
+	Uptime    *float64 `json:"uptime_percent,omitempty"`
+	Status    string   `json:"status"`
+	Incidents int      `json:"incidents,omitempty"`
+}
+
+// StatusIncident is an incident opened within the page's days or, without
+// an incident store, a period in which a service failed its health checks.
+type StatusIncident struct {
+	Title    string    `json:"title,omitempty"`
+	Service  string    `json:"service"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Ongoing  bool      `json:"ongoing,omitempty"`
+}
+
+// statusPageCache keeps the page built from the cached pipeline status.
+var statusPageCache struct {
+	sync.Mutex
+	page StatusPage
+}
+
+func currentStatusPage(r *http.Request) StatusPage {
+	status := currentPipelineStatus(r)
+	statusPageCache.Lock()
+	defer statusPageCache.Unlock()
+	if !statusPageCache.page.GeneratedAt.Equal(status.GeneratedAt) {
+		statusPageCache.page = buildStatusPage(status)
+	}
+	return statusPageCache.page
+}
+
+// buildStatusPage combines the pipeline status with status_page.days of
+// SLA history and the incidents of those days.
+func buildStatusPage(status PipelineStatus) StatusPage {
+	days := max(viper.GetInt("status_page.days"), 1)
+	now := time.Now().UTC()
+	first := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-days)
+	page := StatusPage{
+		Title:       viper.GetString("status_page.title"),
+		Status:      status.Status,
+		Services:    []ServiceUptime{},
+		Incidents:   []StatusIncident{},
+		Days:        days,
+		GeneratedAt: status.GeneratedAt,
+	}
+	for _, c := range status.Components {
+		if !viper.GetBool("status_page.show_reasons") {
+			c.Reasons = nil
+		}
+		page.Components = append(page.Components, c)
+	}
+
+	current := make(map[string]string)
+	for _, s := range registeredServices() {
+		current[s.name] = s.entry().Status
+	}
+	counts := make(map[string]map[string]sla.DayUptime)
+	if slaHistory != nil {
+		for _, day := range slaHistory.Daily(first, now) {
+			if counts[day.Service] == nil {
+				counts[day.Service] = make(map[string]sla.DayUptime)
+			}
+			counts[day.Service][day.Date] = day
+		}
+	}
+	page.Incidents = statusIncidents(first, now)
+	sort.Slice(page.Incidents, func(i, j int) bool { return page.Incidents[i].Start.After(page.Incidents[j].Start) })
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	for name := range counts {
+		if _, ok := current[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	target := slaReportOptions().Target
+	downBelow := viper.GetFloat64("status_page.down_below")
+	for _, name := range names {
+		service := ServiceUptime{Name: name, Status: current[name], Days: make([]UptimeDay, days)}
+		if service.Status == "" {
+			service.Status = "unknown"
+		}
+		var checks, healthy int
+		for i := range service.Days {
+			date := first.AddDate(0, 0, i).Format("2006-01-02")
+			day := UptimeDay{Date: date, Status: "none"}
+			if c, ok := counts[name][date]; ok && c.Checks > 0 {
+				uptime := 100 * float64(c.HealthyChecks) / float64(c.Checks)
+				day.Uptime = &uptime
+				switch {
+				case uptime < downBelow:
+					day.Status = "down"
+				case uptime < target:
+					day.Status = "degraded"
+				default:
+					day.Status = "ok"
+				}
+				checks += c.Checks
+				healthy += c.HealthyChecks
+			} else if ok && c.MaintenanceChecks > 0 {
+				day.Status = "maintenance"
+			}
+			for _, in := range page.Incidents {
+				if in.Service == name && in.Start.Format("2006-01-02") <= date && in.End.Format("2006-01-02") >= date {
+					day.Incidents++
+				}
+			}
+			service.Days[i] = day
+		}
+		if checks > 0 {
+			uptime := 100 * float64(healthy) / float64(checks)
+			service.Uptime = &uptime
+		}
+		page.Services = append(page.Services, service)
+	}
+
+	if limit := viper.GetInt("status_page.max_incidents"); len(page.Incidents) > limit {
+		page.Incidents = page.Incidents[:limit]
+	}
+	return page
+}
+
+// statusIncidents lists the incidents opened since first, and those still
+// unresolved. Without an incident store they are the downtime windows in the
+// SLA history's raw checks of at least status_page.min_incident, and those
+// still ongoing.
+func statusIncidents(first, now time.Time) []StatusIncident {
+	incidents := []StatusIncident{}
+	if incidentStore != nil {
+		for _, in := range incidentStore.List(incident.Filter{}) {
+			end := now
+			if in.ResolvedAt != nil {
+				end = *in.ResolvedAt
+			}
+			if end.Before(first) {
+				continue
+			}
+			incidents = append(incidents, StatusIncident{
+				Title:    in.Title,
+				Service:  in.Service,
+				Start:    in.OpenedAt,
+				End:      end,
+				Duration: end.Sub(in.OpenedAt).Round(time.Second).String(),
+				Ongoing:  in.ResolvedAt == nil,
+			})
+		}
+		return incidents
+	}
+	if slaHistory == nil {
+		return incidents
+	}
+	minDuration := viper.GetDuration("status_page.min_incident")
+	for _, s := range slaHistory.Report("status", first, now, slaReportOptions()).Services {
+		for _, w := range s.Windows {
+			if w.Ongoing || w.Seconds >= minDuration.Seconds() {
+				incidents = append(incidents, StatusIncident{Service: s.Name, Start: w.Start, End: w.End, Duration: w.Duration, Ongoing: w.Ongoing})
+			}
+		}
+	}
+	return incidents
+}
+
+// statusPageHandler serves the status page as HTML to browsers and as JSON
+// otherwise, or as format=html|json asks. It needs no credentials and may
+// be cached for status_page.max_age.
+func statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			format = "html"
+		}
+	}
+	if format != "html" && format != "json" {
+		http.Error(w, "format must be json or html", http.StatusBadRequest)
+		return
+	}
+
+	page := currentStatusPage(r)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(viper.GetDuration("status_page.max_age").Seconds())))
+	if format == "json" {
+		response.WriteResource(w, r, page, nil, page.GeneratedAt)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Last-Modified", page.GeneratedAt.Format(http.TimeFormat))
+	statusPageTemplate.Execute(w, page)
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"pct": func(v *float64) string {
+		if v == nil {
+			return "no data"
+		}
+		return strconv.FormatFloat(*v, 'f', 2, 64) + "%"
+	},
+	"ts": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+	"tip": func(d UptimeDay) string {
+		if d.Status == "maintenance" {
+			return d.Date + ": maintenance"
+		}
+		if d.Uptime == nil {
+			return d.Date + ": no data"
+		}
+		tip := fmt.Sprintf("%s: %.2f%%", d.Date, *d.Uptime)
+		if d.Incidents > 0 {
+			tip += fmt.Sprintf(", %d incident(s)", d.Incidents)
+		}
+		return tip
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+.banner { padding: 1em; border-radius: 4px; color: #fff; font-size: 1.2em; }
+.banner.green { background: #2e7d32; } .banner.yellow { background: #f9a825; } .banner.red { background: #c62828; }
+.components span { display: inline-block; margin: 0.5em 1em 0 0; }
+.dot { display: inline-block; width: 0.7em; height: 0.7em; border-radius: 50%; }
+.dot.green { background: #2e7d32; } .dot.yellow { background: #f9a825; } .dot.red { background: #c62828; }
+.service { margin-top: 1.5em; }
+.bars { display: flex; gap: 2px; height: 2em; }
+.bars div { flex: 1; border-radius: 1px; }
+.bars .ok { background: #43a047; } .bars .degraded { background: #fbc02d; }
+.bars .down { background: #e53935; } .bars .none { background: #ddd; } .bars .maintenance { background: #1e88e5; }
+.bars .incident { box-shadow: inset 0 -4px #000; }
+.legend { display: flex; justify-content: space-between; color: #777; font-size: 0.8em; }
+table { border-collapse: collapse; } th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="banner {{.Status}}">{{if eq .Status "green"}}All systems operational{{else if eq .Status "yellow"}}Degraded performance{{else}}Major outage{{end}}</div>
+<div class="components">{{range .Components}}<span><span class="dot {{.Status}}"></span> {{.Name}}{{range .Reasons}}: {{.}}{{end}}</span>{{end}}</div>
+
+{{range .Services}}<div class="service">
+<h3>{{.Name}} <small>({{.Status}}, {{pct .Uptime}} uptime)</small></h3>
+<div class="bars">{{range .Days}}<div class="{{.Status}}{{if .Incidents}} incident{{end}}" title="{{tip .}}"></div>{{end}}</div>
+<div class="legend"><span>{{$.Days}} days ago</span><span>Today</span></div>
+</div>{{end}}
+
+<h2>Incidents</h2>
+<table>
+<tr><th>Incident</th><th>Start</th><th>End</th><th>Duration</th></tr>
+{{range .Incidents}}<tr><td>{{if .Title}}{{.Title}}{{if .Service}} ({{.Service}}){{end}}{{else}}{{.Service}}{{end}}</td><td>{{ts .Start}}</td><td>{{if .Ongoing}}ongoing{{else}}{{ts .End}}{{end}}</td><td>{{.Duration}}</td></tr>
+{{else}}<tr><td colspan="4">No incidents recorded</td></tr>{{end}}
+</table>
+<p><small>Updated {{ts .GeneratedAt}}</small></p>
+</body>
+</html>
+`))
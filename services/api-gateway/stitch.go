@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+var stitchedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_stitched_requests_total",
+		Help: "Requests for views stitched from several services, by view and result: ok, partial, not_found or error",
+	},
+	[]string{"view", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(stitchedRequests)
+}
+
+// orderRecords is the stitched view of an order and the records linked to
+// it by data.order_id. A part whose service failed is null and the failure
+// is listed in Errors; a view with errors is partial.
+type orderRecords struct {
+	Order   json.RawMessage `json:"order"`
+	Records *recordsPage    `json:"records"`
+	Errors  []stitchError   `json:"errors,omitempty"`
+}
+
+// recordsPage is one page of an order's records.
+type recordsPage struct {
+	Items  []json.RawMessage `json:"items"`
+	Total  int               `json:"total"`
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+}
+
+// stitchError is a part of a stitched view that could not be fetched.
+type stitchError struct {
+	Service string `json:"service"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message"`
+}
+
+func newStitchError(err error) stitchError {
+	var uerr *upstreamError
+	if !errors.As(err, &uerr) {
+		return stitchError{Message: err.Error()}
+	}
+	return stitchError{Service: uerr.service + "-service", Status: uerr.status, Message: uerr.Error()}
+}
+
+// orderRecordsHandler serves GET /api/v1/orders/{id}/records. The order is
+// read from business-service and a page of its records from data-service
+// concurrently. An order business-service does not know is a 404; when
+// only one service fails the other's part is still returned with 200, and
+// when both fail the view is a 502.
+func orderRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	page, err := response.ParsePage(r)
+	if err != nil {
+		stitchedRequests.WithLabelValues("order_records", "error").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), viper.GetDuration("stitching.timeout"))
+	defer cancel()
+
+	var (
+		wg                  sync.WaitGroup
+		order               json.RawMessage
+		records             []json.RawMessage
+		pagination          *response.Pagination
+		orderErr, recordErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, orderErr = fetchUpstream(ctx, r, "business", "/api/v2/orders/"+url.PathEscape(id), nil, &order)
+	}()
+	go func() {
+		defer wg.Done()
+		query := url.Values{
+			"data.order_id": {id},
+			"offset":        {strconv.Itoa(page.Offset)},
+			"limit":         {strconv.Itoa(page.Limit)},
+		}
+		pagination, recordErr = fetchUpstream(ctx, r, "data", "/api/v2/records", query, &records)
+		if recordErr == nil && pagination == nil {
+			recordErr = &upstreamError{service: "data", err: errors.New("response is not a page")}
+		}
+	}()
+	wg.Wait()
+
+	var uerr *upstreamError
+	if errors.As(orderErr, &uerr) && uerr.status == http.StatusNotFound {
+		stitchedRequests.WithLabelValues("order_records", "not_found").Inc()
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	view := orderRecords{}
+	if orderErr != nil {
+		view.Errors = append(view.Errors, newStitchError(orderErr))
+	} else {
+		view.Order = order
+	}
+	if recordErr != nil {
+		view.Errors = append(view.Errors, newStitchError(recordErr))
+	} else {
+		if records == nil {
+			records = []json.RawMessage{}
+		}
+		view.Records = &recordsPage{Items: records, Total: pagination.Total, Offset: pagination.Offset, Limit: pagination.Limit}
+	}
+
+	status, result := http.StatusOK, "ok"
+	switch len(view.Errors) {
+	case 1:
+		result = "partial"
+	case 2:
+		status, result = http.StatusBadGateway, "error"
+	}
+	stitchedRequests.WithLabelValues("order_records", result).Inc()
+
+	self := "/api/v1/orders/" + url.PathEscape(id) + "/records"
+	pageLink := func(offset int) string {
+		return self + "?" + url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(page.Limit)}}.Encode()
+	}
+	links := response.Links{
+		"self":    pageLink(page.Offset),
+		"order":   "/api/v1/proxy/business/api/v2/orders/" + url.PathEscape(id),
+		"records": "/api/v1/proxy/data/api/v2/records?" + url.Values{"data.order_id": {id}}.Encode(),
+	}
+	if view.Records != nil {
+		if next := page.Offset + page.Limit; next < view.Records.Total {
+			links["next"] = pageLink(next)
+		}
+		if page.Offset > 0 {
+			links["prev"] = pageLink(max(page.Offset-page.Limit, 0))
+		}
+	}
+	response.Write(w, r, status, view, links)
+}
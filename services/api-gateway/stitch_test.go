@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+func TestOrderRecordsAppliesResponseTransforms(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v2/orders/o-1":
+			w.Write([]byte(`{"data": {"id": "o-1", "customer_email": "a@example.com", "total": 12.5}}`))
+		case "/api/v2/records":
+			w.Write([]byte(`{"data": [{"id": "r1", "data": {"order_id": "o-1", "email": "a@example.com"}}],
+				"pagination": {"total": 1, "offset": 0, "limit": 20}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	for _, key := range []string{"services.business", "services.data", "transforms"} {
+		defer viper.Set(key, viper.Get(key))
+	}
+	viper.Set("services.business", backend.URL)
+	viper.Set("services.data", backend.URL)
+	viper.Set("transforms", []map[string]interface{}{
+		{"route": "data/api/v2/records*", "plugins": []map[string]interface{}{
+			{"name": "strip_fields", "options": map[string]interface{}{"fields": []string{"data.data.email"}}},
+		}},
+		{"route": "business/api/v2/orders/*", "plugins": []map[string]interface{}{
+			{"name": "strip_fields", "options": map[string]interface{}{"fields": []string{"data.customer_email"}}},
+		}},
+	})
+	defer func(saved map[string]*upstream) { upstreams = saved }(upstreams)
+	upstreams = newUpstreams()
+	defer func(saved []transformRoute) { transformRoutes = saved }(transformRoutes)
+	if err := loadTransforms(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/orders/{id}/records", orderRecordsHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/orders/o-1/records", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "a@example.com") {
+		t.Errorf("stripped field in the stitched view: %s", body)
+	}
+
+	var view struct {
+		Data orderRecords `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Data.Records == nil || len(view.Data.Records.Items) != 1 || len(view.Data.Errors) != 0 {
+		t.Fatalf("view = %+v", view.Data)
+	}
+	var record struct {
+		ID   string            `json:"id"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(view.Data.Records.Items[0], &record); err != nil || record.ID != "r1" || record.Data["order_id"] != "o-1" {
+		t.Errorf("record = %+v, %v; want r1 with its other fields", record, err)
+	}
+	if !strings.Contains(string(view.Data.Order), `"total":12.5`) {
+		t.Errorf("order = %s", view.Data.Order)
+	}
+}
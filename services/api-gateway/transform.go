@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var transformErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_transform_errors_total",
+		Help: "Proxied requests or responses a transform plugin failed on",
+	},
+	[]string{"plugin", "stage"},
+)
+
+func init() {
+	prometheus.MustRegister(transformErrors)
+}
+
+// Transform rewrites proxied traffic for the routes it is configured on.
+// TransformRequest sees the outgoing request before it is sent upstream and
+// TransformResponse the upstream response before it is returned; embed
+// NopTransform to implement only one of them. A returned error fails the
+// request with 502 rather than passing traffic through untransformed.
+type Transform interface {
+	TransformRequest(r *http.Request) error
+	TransformResponse(resp *http.Response) error
+}
+
+// NopTransform leaves requests and responses unchanged.
+type NopTransform struct{}
+
+func (NopTransform) TransformRequest(*http.Request) error   { return nil }
+func (NopTransform) TransformResponse(*http.Response) error { return nil }
+
+// TransformFactory builds a Transform from the options of one config entry.
+type TransformFactory func(options map[string]interface{}) (Transform, error)
+
+var (
+	transformRegistryMu sync.Mutex
+	transformRegistry   = make(map[string]TransformFactory)
+)
+
+// RegisterTransform makes a plugin available to the transforms config under
+// name. Plugins register from init functions, so adding one is a matter of
+// dropping a file into this package.
+func RegisterTransform(name string, factory TransformFactory) {
+	transformRegistryMu.Lock()
+	defer transformRegistryMu.Unlock()
+	if _, dup := transformRegistry[name]; dup {
+		panic("transform plugin registered twice: " + name)
+	}
+	transformRegistry[name] = factory
+}
+
+// TransformRule is one entry of the transforms config section.
+type TransformRule struct {
+	// Route matches "<service>/<path>" of /api/v1/proxy requests, e.g.
+	// "data/api/v1/records/*". A trailing "*" matches any suffix, otherwise
+	// path.Match syntax applies.
+	Route   string   `mapstructure:"route"`
+	Methods []string `mapstructure:"methods"`
+	Plugins []struct {
+		Name    string                 `mapstructure:"name"`
+		Options map[string]interface{} `mapstructure:"options"`
+	} `mapstructure:"plugins"`
+}
+
+type namedTransform struct {
+	name string
+	Transform
+}
+
+type transformRoute struct {
+	rule       TransformRule
+	transforms []namedTransform
+}
+
+var transformRoutes []transformRoute
+
+// loadTransforms builds the plugin chains of the transforms config section.
+func loadTransforms() error {
+	var rules []TransformRule
+	if err := viper.UnmarshalKey("transforms", &rules); err != nil {
+		return err
+	}
+
+	routes := make([]transformRoute, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Route == "" {
+			return errors.New("transform rule without route")
+		}
+		if _, err := path.Match(rule.Route, ""); err != nil {
+			return fmt.Errorf("route %q: %w", rule.Route, err)
+		}
+		route := transformRoute{rule: rule}
+		for _, p := range rule.Plugins {
+			transformRegistryMu.Lock()
+			factory, ok := transformRegistry[p.Name]
+			transformRegistryMu.Unlock()
+			if !ok {
+				return fmt.Errorf("route %q: unknown transform plugin %q (available: %s)", rule.Route, p.Name, strings.Join(transformNames(), ", "))
+			}
+			t, err := factory(p.Options)
+			if err != nil {
+				return fmt.Errorf("route %q: plugin %s: %w", rule.Route, p.Name, err)
+			}
+			route.transforms = append(route.transforms, namedTransform{name: p.Name, Transform: t})
+		}
+		routes = append(routes, route)
+		logrus.WithFields(logrus.Fields{
+			"route":   rule.Route,
+			"plugins": len(route.transforms),
+		}).Info("Loaded transform rule")
+	}
+	transformRoutes = routes
+	return nil
+}
+
+func transformNames() []string {
+	transformRegistryMu.Lock()
+	defer transformRegistryMu.Unlock()
+	names := make([]string, 0, len(transformRegistry))
+	for name := range transformRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transformsFor returns the transforms of every rule matching the proxied
+// service, path and method, in config order.
+func transformsFor(service, upstreamPath, method string) []namedTransform {
+	target := service + "/" + upstreamPath
+	var matched []namedTransform
+	for _, route := range transformRoutes {
+		if !routeMatches(route.rule.Route, target) || !methodMatches(route.rule.Methods, method) {
+			continue
+		}
+		matched = append(matched, route.transforms...)
+	}
+	return matched
+}
+
+func routeMatches(pattern, target string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(target, prefix)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
+
+func methodMatches(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformError marks proxy errors caused by a plugin rather than the
+// upstream connection.
+type transformError struct {
+	plugin string
+	err    error
+}
+
+func (e *transformError) Error() string { return "transform " + e.plugin + ": " + e.err.Error() }
+func (e *transformError) Unwrap() error { return e.err }
+
+// appliedTransformsHeader tells the upstream which request transforms ran,
+// in order, so the data service can record them in a record's lineage.
+// Clients cannot set it.
+const appliedTransformsHeader = "X-Applied-Transforms"
+
+func applyRequestTransforms(transforms []namedTransform, r *http.Request) error {
+	r.Header.Del(appliedTransformsHeader)
+	names := make([]string, 0, len(transforms))
+	for _, t := range transforms {
+		if err := t.TransformRequest(r); err != nil {
+			transformErrors.WithLabelValues(t.name, "request").Inc()
+			return &transformError{plugin: t.name, err: err}
+		}
+		names = append(names, t.name)
+	}
+	if len(names) > 0 {
+		r.Header.Set(appliedTransformsHeader, strings.Join(names, ","))
+	}
+	return nil
+}
+
+func applyResponseTransforms(transforms []namedTransform, resp *http.Response) error {
+	for _, t := range transforms {
+		if err := t.TransformResponse(resp); err != nil {
+			transformErrors.WithLabelValues(t.name, "response").Inc()
+			return &transformError{plugin: t.name, err: err}
+		}
+	}
+	return nil
+}
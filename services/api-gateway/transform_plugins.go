@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterTransform("strip_fields", newStripFields)
+	RegisterTransform("headers", newHeaderTransform)
+}
+
+// maxTransformBodyBytes bounds the JSON bodies strip_fields buffers.
+const maxTransformBodyBytes = 10 << 20
+
+// stripFields removes or redacts fields of JSON responses, e.g. personal
+// data in record payloads. Options:
+//
+//	fields  dotted paths; arrays are traversed, so "records.data.email"
+//	        applies to every record of a list response
+//	action  "remove" (default) or "redact"
+type stripFields struct {
+	NopTransform
+	paths  [][]string
+	redact bool
+}
+
+func newStripFields(options map[string]interface{}) (Transform, error) {
+	fields, err := stringList(options["fields"])
+	if err != nil || len(fields) == 0 {
+		return nil, fmt.Errorf("fields must be a non-empty list of dotted paths")
+	}
+	t := &stripFields{}
+	for _, f := range fields {
+		t.paths = append(t.paths, strings.Split(f, "."))
+	}
+	switch action, _ := options["action"].(string); action {
+	case "", "remove":
+	case "redact":
+		t.redact = true
+	default:
+		return nil, fmt.Errorf("unknown action %q, use remove or redact", action)
+	}
+	return t, nil
+}
+
+func (t *stripFields) TransformResponse(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" || resp.Body == nil {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return fmt.Errorf("cannot inspect %s encoded body", enc)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBodyBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxTransformBodyBytes {
+		return fmt.Errorf("body larger than %d bytes", maxTransformBodyBytes)
+	}
+
+	var doc interface{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("invalid JSON body: %w", err)
+		}
+		for _, p := range t.paths {
+			t.strip(doc, p)
+		}
+		if body, err = json.Marshal(doc); err != nil {
+			return err
+		}
+		body = append(body, '\n')
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func (t *stripFields) strip(node interface{}, p []string) {
+	switch v := node.(type) {
+	case []interface{}:
+		for _, item := range v {
+			t.strip(item, p)
+		}
+	case map[string]interface{}:
+		if len(p) == 1 {
+			if _, ok := v[p[0]]; !ok {
+				return
+			}
+			if t.redact {
+				v[p[0]] = redactedValue
+			} else {
+				delete(v, p[0])
+			}
+			return
+		}
+		if child, ok := v[p[0]]; ok {
+			t.strip(child, p[1:])
+		}
+	}
+}
+
+const redactedValue = "[REDACTED]"
+
+// headerTransform sets and removes request and response headers. Options:
+//
+//	request_set, response_set        header: value maps
+//	request_remove, response_remove  header name lists
+type headerTransform struct {
+	requestSet, responseSet       map[string]string
+	requestRemove, responseRemove []string
+}
+
+func newHeaderTransform(options map[string]interface{}) (Transform, error) {
+	t := &headerTransform{}
+	var err error
+	if t.requestSet, err = stringMap(options["request_set"]); err != nil {
+		return nil, fmt.Errorf("request_set: %w", err)
+	}
+	if t.responseSet, err = stringMap(options["response_set"]); err != nil {
+		return nil, fmt.Errorf("response_set: %w", err)
+	}
+	if t.requestRemove, err = stringList(options["request_remove"]); err != nil {
+		return nil, fmt.Errorf("request_remove: %w", err)
+	}
+	if t.responseRemove, err = stringList(options["response_remove"]); err != nil {
+		return nil, fmt.Errorf("response_remove: %w", err)
+	}
+	return t, nil
+}
+
+func (t *headerTransform) TransformRequest(r *http.Request) error {
+	editHeaders(r.Header, t.requestSet, t.requestRemove)
+	return nil
+}
+
+func (t *headerTransform) TransformResponse(resp *http.Response) error {
+	editHeaders(resp.Header, t.responseSet, t.responseRemove)
+	return nil
+}
+
+func editHeaders(h http.Header, set map[string]string, remove []string) {
+	for _, name := range remove {
+		h.Del(name)
+	}
+	for name, value := range set {
+		h.Set(name, value)
+	}
+}
+
+func stringList(v interface{}) ([]string, error) {
+	switch list := v.(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		return list, nil
+	case []interface{}:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings")
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("expected a list of strings")
+}
+
+func stringMap(v interface{}) (map[string]string, error) {
+	switch m := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]string:
+		return m, nil
+	case map[string]interface{}:
+		out := make(map[string]string, len(m))
+		for k, item := range m {
+			out[k] = fmt.Sprint(item)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("expected a map of strings")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/dnscache"
+)
+
+var (
+	upstreamConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gateway_upstream_connections",
+			Help: "Open connections to each upstream by state (idle or in_use)",
+		},
+		[]string{"upstream", "state"},
+	)
+	upstreamDialErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_dial_errors_total",
+			Help: "Failed connection attempts to each upstream",
+		},
+		[]string{"upstream"},
+	)
+	upstreamDialDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gateway_upstream_dial_duration_seconds",
+			Help:    "Time to establish a TCP connection to each upstream",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"upstream"},
+	)
+	upstreamConnReuse = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gateway_upstream_requests_by_connection_total",
+			Help: "Proxied requests by whether they reused a pooled connection",
+		},
+		[]string{"upstream", "reused"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamConnections, upstreamDialErrors, upstreamDialDuration, upstreamConnReuse)
+}
+
+// upstreamNames lists the services the proxy forwards to.
+var upstreamNames = []string{"business", "data"}
+
+// upstream is the connection pool of one proxied service.
+type upstream struct {
+	name      string
+	transport *http.Transport
+	// resolver caches DNS lookups; nil when upstreams.*.dns_cache_ttl is 0.
+	resolver *dnscache.Resolver
+
+	open  atomic.Int64
+	inUse atomic.Int64
+	// next is the round-robin position over the upstream's replicas.
+	next atomic.Uint64
+
+	failover     failover
+	deploy       deployment
+	backpressure backpressure
+}
+
+var upstreams map[string]*upstream
+
+// newUpstreams builds one transport per upstream from upstreams.<name>.*,
+// falling back to upstreams.defaults.*.
+func newUpstreams() map[string]*upstream {
+	pools := make(map[string]*upstream, len(upstreamNames))
+	for _, name := range upstreamNames {
+		pools[name] = newUpstream(name)
+	}
+	return pools
+}
+
+func newUpstream(name string) *upstream {
+	key := func(setting string) string {
+		if k := "upstreams." + name + "." + setting; viper.IsSet(k) {
+			return k
+		}
+		return "upstreams.defaults." + setting
+	}
+
+	u := &upstream{name: name}
+	dialer := &net.Dialer{
+		Timeout:   viper.GetDuration(key("dial_timeout")),
+		KeepAlive: viper.GetDuration(key("keep_alive")),
+	}
+
+	dial := dialer.DialContext
+	if ttl := viper.GetDuration(key("dns_cache_ttl")); ttl > 0 {
+		u.resolver = dnscache.New(ttl)
+		dial = u.resolver.DialContext(dial)
+	}
+
+	tlsConfig := &tls.Config{}
+	if size := viper.GetInt(key("tls_session_cache_size")); size > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	}
+
+	u.transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           u.dialContext(dial),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          viper.GetInt(key("max_idle_conns_per_host")),
+		MaxIdleConnsPerHost:   viper.GetInt(key("max_idle_conns_per_host")),
+		MaxConnsPerHost:       viper.GetInt(key("max_conns_per_host")),
+		IdleConnTimeout:       viper.GetDuration(key("idle_conn_timeout")),
+		TLSHandshakeTimeout:   viper.GetDuration(key("tls_handshake_timeout")),
+		ResponseHeaderTimeout: viper.GetDuration(key("response_header_timeout")),
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	u.report()
+	u.reportActive()
+	return u
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialContext times dials and tracks open connections.
+func (u *upstream) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			upstreamDialErrors.WithLabelValues(u.name).Inc()
+			return nil, err
+		}
+		upstreamDialDuration.WithLabelValues(u.name).Observe(time.Since(start).Seconds())
+		u.open.Add(1)
+		u.report()
+		return &trackedConn{Conn: conn, onClose: func() {
+			u.open.Add(-1)
+			u.report()
+		}}, nil
+	}
+}
+
+// connectionFailed drops the cached addresses of host and the idle
+// connections to it, so the next request re-resolves and dials afresh after
+// the upstream's pods moved.
+func (u *upstream) connectionFailed(host string) {
+	if u.resolver != nil {
+		u.resolver.Invalidate(host)
+	}
+	u.transport.CloseIdleConnections()
+}
+
+// trace marks a request's connection as in use from when it is obtained
+// until the returned func is called.
+func (u *upstream) trace(ctx context.Context) (context.Context, func()) {
+	var got atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if got.Swap(true) {
+				return
+			}
+			upstreamConnReuse.WithLabelValues(u.name, boolLabel(info.Reused)).Inc()
+			u.inUse.Add(1)
+			u.report()
+		},
+	})
+	return ctx, func() {
+		if got.Swap(false) {
+			u.inUse.Add(-1)
+			u.report()
+		}
+	}
+}
+
+func (u *upstream) report() {
+	open, inUse := u.open.Load(), u.inUse.Load()
+	idle := open - inUse
+	if idle < 0 {
+		idle = 0
+	}
+	upstreamConnections.WithLabelValues(u.name, "in_use").Set(float64(inUse))
+	upstreamConnections.WithLabelValues(u.name, "idle").Set(float64(idle))
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+func boolLabel(v bool) string {
+	if v {
+		return "true"
+	}
+	return "false"
+}
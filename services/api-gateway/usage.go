@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/usage"
+)
+
+// usageStore holds the per-API-key usage rollups; it is nil when
+// usage.enabled is false.
+var usageStore *usage.Store
+
+// startUsageTracking opens the store at usage.path. The returned func saves
+// it a last time.
+func startUsageTracking() func() {
+	if !viper.GetBool("usage.enabled") {
+		return func() {}
+	}
+
+	loc, err := time.LoadLocation(viper.GetString("usage.timezone"))
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid usage.timezone, using UTC")
+		loc = time.UTC
+	}
+	store, err := usage.NewStore(usage.Config{
+		Path:          viper.GetString("usage.path"),
+		RetentionDays: viper.GetInt("usage.retention_days"),
+		Location:      loc,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open usage store")
+	}
+	usageStore = store
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.Run(viper.GetDuration("usage.flush_interval"), stop, func(err error) {
+			logrus.WithError(err).Error("Failed to save usage store")
+		})
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// usageWriter counts the bytes written to the client.
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *usageWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *usageWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// proxied streams need to flush.
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// usageMiddleware attributes API requests to the caller's API key ID. Probes and scrapes are not API traffic and are not counted.
+func usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if usageStore == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		wrapped := &usageWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(wrapped, r)
+
+		bytesIn := r.ContentLength
+		if bytesIn < 0 {
+			bytesIn = 0
+		}
+		usageStore.Record(callerKey(r), start, wrapped.status, bytesIn, wrapped.bytes, time.Since(start))
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/openapi"
+)
+
+var validationResults = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gateway_openapi_validation_total",
+		Help: "Proxied requests and responses checked against the upstream's OpenAPI spec, by direction and result",
+	},
+	[]string{"upstream", "direction", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(validationResults)
+}
+
+// ValidationRule turns on OpenAPI validation for matching routes.
+type ValidationRule struct {
+	// Route and Methods match like TransformRule's.
+	Route   string   `mapstructure:"route"`
+	Methods []string `mapstructure:"methods"`
+	// Requests rejects requests that do not match the spec with 400; on
+	// unless set to false.
+	Requests *bool `mapstructure:"requests"`
+	// Responses logs and counts responses that do not match the spec. They
+	// are still returned, as the upstream has already done the work.
+	Responses bool `mapstructure:"responses"`
+}
+
+var (
+	validationRules []ValidationRule
+	// apiSpecs holds the OpenAPI spec of each upstream named in
+	// validation.specs.
+	apiSpecs map[string]*openapi.Spec
+)
+
+// loadValidation reads the validation config section and the specs its
+// routes need.
+func loadValidation() error {
+	var rules []ValidationRule
+	if err := viper.UnmarshalKey("validation.routes", &rules); err != nil {
+		return err
+	}
+	specs := make(map[string]*openapi.Spec)
+	for _, rule := range rules {
+		if rule.Route == "" {
+			return errors.New("validation rule without route")
+		}
+		if _, err := path.Match(rule.Route, ""); err != nil {
+			return fmt.Errorf("route %q: %w", rule.Route, err)
+		}
+		service, _, _ := strings.Cut(rule.Route, "/")
+		if _, ok := specs[service]; !ok {
+			file := viper.GetString("validation.specs." + service)
+			if file == "" {
+				return fmt.Errorf("route %q: no spec in validation.specs.%s", rule.Route, service)
+			}
+			spec, err := openapi.Load(file)
+			if err != nil {
+				return fmt.Errorf("route %q: %w", rule.Route, err)
+			}
+			specs[service] = spec
+		}
+		logrus.WithFields(logrus.Fields{
+			"route":     rule.Route,
+			"requests":  rule.validatesRequests(),
+			"responses": rule.Responses,
+		}).Info("Loaded validation rule")
+	}
+	validationRules = rules
+	apiSpecs = specs
+	return nil
+}
+
+func (rule *ValidationRule) validatesRequests() bool {
+	return rule.Requests == nil || *rule.Requests
+}
+
+func validationFor(service, upstreamPath, method string) *ValidationRule {
+	target := service + "/" + upstreamPath
+	for i := range validationRules {
+		if routeMatches(validationRules[i].Route, target) && methodMatches(validationRules[i].Methods, method) {
+			return &validationRules[i]
+		}
+	}
+	return nil
+}
+
+// validateRequest checks a proxied request against the upstream's spec and
+// answers 400 with the problems found. It reports whether the request may
+// proceed. Operations the spec does not describe are let through.
+func validateRequest(w http.ResponseWriter, r *http.Request, rule *ValidationRule, service, upstreamPath string, entry *logrus.Entry) bool {
+	if rule == nil || !rule.validatesRequests() {
+		return true
+	}
+	op, problems := apiSpecs[service].ValidateRequest(r, "/"+upstreamPath, viper.GetInt64("validation.max_body_bytes"))
+	switch {
+	case op == nil:
+		validationResults.WithLabelValues(service, "request", "undocumented").Inc()
+		return true
+	case len(problems) == 0:
+		validationResults.WithLabelValues(service, "request", "valid").Inc()
+		return true
+	}
+	validationResults.WithLabelValues(service, "request", "invalid").Inc()
+	entry.WithFields(logrus.Fields{
+		"operation": op.OperationID,
+		"problems":  len(problems),
+		"first":     problems[0].Error(),
+	}).Warn("Request does not match the API spec")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     "request does not match the API spec",
+		"service":   service,
+		"operation": op.OperationID,
+		"details":   problems,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	return false
+}
+
+// validateResponse checks a JSON response against the upstream's spec and
+// logs what does not match. Bodies over validation.max_body_bytes are
+// skipped rather than buffered.
+func validateResponse(resp *http.Response, rule *ValidationRule, service, upstreamPath string, entry *logrus.Entry) {
+	if rule == nil || !rule.Responses {
+		return
+	}
+	var body []byte
+	if openapi.IsJSON(resp.Header.Get("Content-Type")) {
+		limit := viper.GetInt64("validation.max_body_bytes")
+		if resp.ContentLength > limit {
+			validationResults.WithLabelValues(service, "response", "skipped").Inc()
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		if err != nil || int64(len(data)) > limit {
+			validationResults.WithLabelValues(service, "response", "skipped").Inc()
+			return
+		}
+		body = data
+	}
+
+	method := resp.Request.Method
+	op, problems := apiSpecs[service].ValidateResponse(method, "/"+upstreamPath, resp.StatusCode, resp.Header, body)
+	if op == nil {
+		validationResults.WithLabelValues(service, "response", "undocumented").Inc()
+		return
+	}
+	if len(problems) == 0 {
+		validationResults.WithLabelValues(service, "response", "valid").Inc()
+		return
+	}
+	validationResults.WithLabelValues(service, "response", "invalid").Inc()
+	messages := make([]string, len(problems))
+	for i, p := range problems {
+		messages[i] = p.Error()
+	}
+	entry.WithFields(logrus.Fields{
+		"operation": op.OperationID,
+		"status":    resp.StatusCode,
+		"problems":  messages,
+	}).Warn("Response does not match the API spec")
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+)
+
+// applyLogLevel sets the configured log_level; an invalid one is logged and
+// leaves the level at info.
+func applyLogLevel() {
+	level, err := logrus.ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid log_level, using info")
+		return
+	}
+	logrus.SetLevel(level)
+}
+
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// setLogLevelHandler changes the log level until the next restart.
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	level, err := logrus.ParseLevel(body.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.SetBefore(r.Context(), map[string]string{"level": logrus.GetLevel().String()})
+	logrus.SetLevel(level)
+	logrus.WithField("level", level.String()).Warn("Log level changed")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": level.String()})
+}
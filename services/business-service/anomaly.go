@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/anomaly"
+)
+
+// ordersCreated counts orders since startup for the order_throughput signal.
+var ordersCreated atomic.Int64
+
+// startAnomalyDetection watches order throughput for unusual drops when
+// anomaly.enabled is set. The returned func stops it.
+func startAnomalyDetection() context.CancelFunc {
+	if !viper.GetBool("anomaly.enabled") {
+		return func() {}
+	}
+	return anomaly.Start(viper.GetViper(), "business-service", "order_throughput", anomaly.Down, anomaly.RateOf(ordersCreated.Load))
+}
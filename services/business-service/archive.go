@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/evict"
+)
+
+// orderPolicy picks the orders to move from the orders map to the archive:
+// those unused for order_store.ttl, then the least recently used beyond
+// order_store.max_entries. Pending orders are being processed and stay.
+var orderPolicy *evict.Policy
+
+// archivedOrder is one line of the order archive. A line without an order
+// is a tombstone: the order was brought back into memory.
+type archivedOrder struct {
+	OrderID    string    `json:"order_id"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Order      *Order    `json:"order,omitempty"`
+}
+
+type archiveEntry struct {
+	offset int64
+	length int
+}
+
+// orderArchive holds the orders evicted from memory as JSON lines appended
+// to a file that, like the event log, is never rewritten. Only the offset of
+// each order's latest line is kept in memory, so an archived order costs an
+// index entry rather than the order.
+type orderArchive struct {
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	index map[string]archiveEntry
+}
+
+// openOrderArchive opens the archive at path and indexes its orders.
+func openOrderArchive(path string) (*orderArchive, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open order archive: %w", err)
+	}
+	a := &orderArchive{file: file, index: make(map[string]archiveEntry)}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logrus.WithField("offset", a.size).Warn("Truncating incomplete order at end of archive")
+				if err := file.Truncate(a.size); err != nil {
+					file.Close()
+					return nil, fmt.Errorf("truncate order archive: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read order archive: %w", err)
+		}
+		var entry archivedOrder
+		if err := json.Unmarshal(line, &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("order archive at offset %d: %w", a.size, err)
+		}
+		if entry.Order != nil {
+			a.index[entry.OrderID] = archiveEntry{offset: a.size, length: len(line)}
+		} else {
+			delete(a.index, entry.OrderID)
+		}
+		a.size += int64(len(line))
+	}
+	if _, err := file.Seek(a.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// write appends entry without syncing; see sync.
+func (a *orderArchive) write(entry archivedOrder) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(line); err != nil {
+		// Drop what was written, so the archive stays one order per line.
+		if terr := a.file.Truncate(a.size); terr == nil {
+			a.file.Seek(a.size, io.SeekStart)
+		}
+		return err
+	}
+	if entry.Order != nil {
+		a.index[entry.OrderID] = archiveEntry{offset: a.size, length: len(line)}
+	} else {
+		delete(a.index, entry.OrderID)
+	}
+	a.size += int64(len(line))
+	return nil
+}
+
+// put adds order to the archive. It is on disk once sync returns.
+func (a *orderArchive) put(order Order) error {
+	order.Links = nil
+	return a.write(archivedOrder{OrderID: order.ID, ArchivedAt: time.Now().UTC(), Order: &order})
+}
+
+// drop takes order id out of the archive.
+func (a *orderArchive) drop(id string) error {
+	if !a.has(id) {
+		return nil
+	}
+	if err := a.write(archivedOrder{OrderID: id, ArchivedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+	return a.sync()
+}
+
+func (a *orderArchive) sync() error {
+	return a.file.Sync()
+}
+
+func (a *orderArchive) has(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.index[id]
+	return ok
+}
+
+func (a *orderArchive) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.index)
+}
+
+// get reads archived order id.
+func (a *orderArchive) get(id string) (Order, bool, error) {
+	a.mu.Lock()
+	entry, ok := a.index[id]
+	a.mu.Unlock()
+	if !ok {
+		return Order{}, false, nil
+	}
+	line := make([]byte, entry.length)
+	if _, err := a.file.ReadAt(line, entry.offset); err != nil {
+		return Order{}, false, fmt.Errorf("read archived order %s: %w", id, err)
+	}
+	var archived archivedOrder
+	if err := json.Unmarshal(line, &archived); err != nil || archived.Order == nil {
+		return Order{}, false, fmt.Errorf("archived order %s at offset %d is corrupt", id, entry.offset)
+	}
+	return *archived.Order, true, nil
+}
+
+// each calls fn with every archived order, reading them one at a time.
+func (a *orderArchive) each(fn func(Order)) error {
+	a.mu.Lock()
+	ids := make([]string, 0, len(a.index))
+	for id := range a.index {
+		ids = append(ids, id)
+	}
+	a.mu.Unlock()
+	for _, id := range ids {
+		order, ok, err := a.get(id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			fn(order)
+		}
+	}
+	return nil
+}
+
+func (a *orderArchive) Close() error {
+	return a.file.Close()
+}
+
+// findOrder returns order id from memory, marking it used, or else from the
+// archive, where it stays. The caller must hold ordersMu.
+func findOrder(id string) (Order, bool, error) {
+	if order, ok := orders[id]; ok {
+		orderPolicy.Touch(id)
+		return order, true, nil
+	}
+	return orderEvents.archive.get(id)
+}
+
+// restoreOrder brings order id back from the archive with an OrderRestored
+// event so it can be changed, and reports whether it was archived. The
+// caller must hold ordersMu for writing.
+func restoreOrder(id, actor string) (bool, error) {
+	if _, ok := orders[id]; ok {
+		return false, nil
+	}
+	order, ok, err := orderEvents.archive.get(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := orderEvents.append(OrderEvent{Type: OrderRestored, OrderID: id, Timestamp: time.Now(), Actor: actor, Order: &order}); err != nil {
+		return false, err
+	}
+	orderPolicy.Restored(id)
+	if orderPolicy.Occupancy().Full {
+		wakeOrderEviction()
+	}
+	// An order both in memory and in the archive is taken out of the
+	// archive at startup, so a failure here only costs disk space.
+	if err := orderEvents.archive.drop(id); err != nil {
+		logrus.WithError(err).WithField("order_id", id).Warn("Failed to take restored order out of the archive")
+	}
+	return true, nil
+}
+
+// evictOrders moves the orders orderPolicy picks to the archive: each is
+// written there first, then an OrderArchived event takes it out of memory.
+// The caller must hold ordersMu for writing.
+func evictOrders() {
+	victims := orderPolicy.Victims(time.Now(), func(id string) bool {
+		order, ok := orders[id]
+		return ok && order.Status != "pending"
+	})
+	if len(victims) == 0 {
+		return
+	}
+
+	archive := orderEvents.archive
+	written := victims[:0]
+	for _, v := range victims {
+		if err := archive.put(orders[v.ID]); err != nil {
+			logrus.WithError(err).WithField("order_id", v.ID).Error("Failed to archive order")
+			break
+		}
+		written = append(written, v)
+	}
+	if err := archive.sync(); err != nil {
+		logrus.WithError(err).Error("Failed to sync order archive, orders stay in memory")
+		return
+	}
+
+	evicted := 0
+	for _, v := range written {
+		if _, err := orderEvents.append(OrderEvent{Type: OrderArchived, OrderID: v.ID, Timestamp: time.Now(), Actor: "eviction"}); err != nil {
+			logrus.WithError(err).WithField("order_id", v.ID).Error("Failed to append order event, order stays in memory")
+			break
+		}
+		orderPolicy.Evicted(v.ID, v.Reason)
+		evicted++
+	}
+	logrus.WithFields(logrus.Fields{
+		"evicted":  evicted,
+		"resident": len(orders),
+		"archived": archive.len(),
+	}).Info("Orders archived")
+}
+
+// evictOrdersNow asks the eviction loop for a pass before its next tick,
+// when the orders map has outgrown order_store.max_entries.
+var evictOrdersNow = make(chan struct{}, 1)
+
+func wakeOrderEviction() {
+	select {
+	case evictOrdersNow <- struct{}{}:
+	default:
+	}
+}
+
+// startOrderEviction archives orders every order_store.interval, and as
+// soon as the orders map is full, until the returned func is called.
+func startOrderEviction() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(viper.GetDuration("order_store.interval"))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-evictOrdersNow:
+			}
+			ordersMu.Lock()
+			evictOrders()
+			ordersMu.Unlock()
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/prober"
+)
+
+var dependencyUp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "business_dependency_up",
+		Help: "Whether a downstream dependency is healthy (1) or not (0)",
+	},
+	[]string{"dependency"},
+)
+
+func init() {
+	prometheus.MustRegister(dependencyUp)
+}
+
+// Dependency is a downstream service the business service calls, such as a
+// payment or notification service. An unhealthy critical dependency makes
+// the business service unhealthy; any other only degrades it.
+type Dependency struct {
+	prober.Config `mapstructure:",squash"`
+	Critical      bool `mapstructure:"critical"`
+}
+
+type dependencyProbe struct {
+	critical bool
+	prober   *prober.Prober
+}
+
+// dependencyProbes are the probers of the configured dependencies, by name.
+var dependencyProbes = make(map[string]dependencyProbe)
+
+// startDependencyProbes reads dependencies and starts a prober for each;
+// invalid entries are skipped. Entries without an interval or timeout use
+// health.check_interval and health.timeout. It returns a function that
+// stops them.
+func startDependencyProbes() func() {
+	var dependencies []Dependency
+	if err := viper.UnmarshalKey("dependencies", &dependencies); err != nil {
+		logrus.WithError(err).Warn("Invalid dependencies config, no dependencies probed")
+	}
+
+	var stops []func()
+	for _, d := range dependencies {
+		if err := d.Validate(); err != nil {
+			logrus.WithError(err).Warn("Invalid dependency, skipped")
+			continue
+		}
+		if d.Interval <= 0 {
+			d.Interval = viper.GetDuration("health.check_interval")
+		}
+		if d.Timeout <= 0 {
+			d.Timeout = viper.GetDuration("health.timeout")
+		}
+		if _, ok := dependencyProbes[d.Name]; ok {
+			logrus.WithField("dependency", d.Name).Warn("Duplicate dependency, skipped")
+			continue
+		}
+		p := prober.New(d.Config, func(result prober.Result, status prober.Status) {
+			if status.Healthy {
+				dependencyUp.WithLabelValues(status.Name).Set(1)
+			} else {
+				dependencyUp.WithLabelValues(status.Name).Set(0)
+			}
+			if !result.Healthy {
+				logrus.WithError(result.Err).WithField("dependency", status.Name).Warn("Dependency check failed")
+			}
+		})
+		dependencyProbes[d.Name] = dependencyProbe{critical: d.Critical, prober: p}
+		stops = append(stops, p.Start())
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// dependencyHealth returns the state of each dependency and whether any
+// critical or other dependency is unhealthy. Dependencies not checked yet
+// count as healthy.
+func dependencyHealth() (statuses []prober.Status, criticalDown, degraded bool) {
+	for _, d := range dependencyProbes {
+		status := d.prober.Status()
+		statuses = append(statuses, status)
+		if status.Known && !status.Healthy {
+			if d.critical {
+				criticalDown = true
+			} else {
+				degraded = true
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, criticalDown, degraded
+}
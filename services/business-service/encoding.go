@@ -0,0 +1,28 @@
+package main
+
+import "pipeline/pkg/codec"
+
+// MarshalProto encodes o as the Order message of proto/business.proto.
+func (o Order) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendString(b, 1, o.ID)
+	b = codec.AppendString(b, 2, o.Product)
+	b = codec.AppendInt64(b, 3, int64(o.Quantity))
+	b = codec.AppendDouble(b, 4, o.Price)
+	b = codec.AppendString(b, 5, o.Status)
+	b = codec.AppendTimestamp(b, 6, o.CreatedAt)
+	b = codec.AppendTimestamp(b, 7, o.UpdatedAt)
+	b = codec.AppendStringMap(b, 8, o.Links)
+	b = codec.AppendString(b, 9, o.CustomerID)
+	return b
+}
+
+// MarshalProto encodes m as the BusinessMetrics message.
+func (m BusinessMetrics) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendInt64(b, 1, int64(m.TotalOrders))
+	b = codec.AppendDouble(b, 2, m.TotalRevenue)
+	b = codec.AppendDouble(b, 3, m.OrdersPerMinute)
+	b = codec.AppendDouble(b, 4, m.AverageOrderSize)
+	return b
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/evict"
+	"pipeline/pkg/response"
+)
+
+// Order event types.
+const (
+	OrderCreated  = "OrderCreated"
+	StatusChanged = "StatusChanged"
+	OrderDeleted  = "OrderDeleted"
+	// OrderArchived takes an order out of memory once it is in the archive
+	// of archive.go; OrderRestored brings it back to be changed.
+	OrderArchived = "OrderArchived"
+	OrderRestored = "OrderRestored"
+)
+
+// OrderEvent is one change to an order. The event log is the system of
+// record for orders: the orders map is the state its events produce, and
+// the read model of readmodel.go is built from them for queries.
+type OrderEvent struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	OrderID   string    `json:"order_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+
+	// Order is the new order of an OrderCreated event, or the archived
+	// order of an OrderRestored event.
+	Order *Order `json:"order,omitempty"`
+	// From and To are the statuses of a StatusChanged event.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// orderSnapshot is the state of every order after the event with sequence
+// Seq.
+type orderSnapshot struct {
+	Seq    uint64           `json:"seq"`
+	At     time.Time        `json:"at"`
+	Orders map[string]Order `json:"orders"`
+}
+
+var (
+	orderEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "business_order_events_total",
+			Help: "Order events appended to the event log, by type",
+		},
+		[]string{"type"},
+	)
+	orderSnapshotsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "business_order_snapshots_total",
+			Help: "Order state snapshots written, by result",
+		},
+		[]string{"result"},
+	)
+	orderReplayedEvents = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "business_order_events_replayed",
+			Help: "Events replayed on top of the snapshot when the service started",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(orderEventsTotal, orderSnapshotsTotal, orderReplayedEvents)
+}
+
+var (
+	// ordersMu guards orders; writers hold it across appending an event and
+	// applying it.
+	ordersMu sync.RWMutex
+
+	orderEvents *orderEventLog
+)
+
+// orderEventEntry locates one event of an order in the event log.
+type orderEventEntry struct {
+	seq    uint64
+	offset int64
+	length int
+}
+
+// orderEventLog appends order events as JSON lines to a file that is never
+// rewritten, and snapshots the resulting state every snapshotEvery events
+// so startup replays only the events after the latest snapshot. The
+// location of every event is indexed by order, so an order's history is
+// read without scanning the log.
+type orderEventLog struct {
+	path          string
+	file          *os.File
+	size          int64
+	seq           uint64
+	snapshotPath  string
+	snapshotEvery uint64
+
+	// byOrder is guarded by ordersMu.
+	byOrder map[string][]orderEventEntry
+
+	snapshotMu  sync.Mutex
+	snapshotSeq uint64
+
+	readModel *orderReadModel
+	archive   *orderArchive
+}
+
+// openOrderEventLog loads the latest snapshot, replays the events after it
+// into orders and opens the log for appending, along with the archive of
+// the orders evicted from memory.
+func openOrderEventLog() (*orderEventLog, error) {
+	l := &orderEventLog{
+		path:          viper.GetString("order_events.path"),
+		snapshotPath:  viper.GetString("order_events.snapshot_path"),
+		snapshotEvery: uint64(viper.GetInt("order_events.snapshot_every")),
+		byOrder:       make(map[string][]orderEventEntry),
+	}
+	var store evict.Config
+	if err := viper.UnmarshalKey("order_store", &store); err != nil {
+		return nil, fmt.Errorf("order_store config: %w", err)
+	}
+	orderPolicy = evict.New("orders", store)
+
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+
+	snapshot, err := readOrderSnapshot(l.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	orders = snapshot.Orders
+	l.seq = snapshot.Seq
+	l.snapshotSeq = snapshot.Seq
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open order event log: %w", err)
+	}
+	replayed, err := l.replay(file, snapshot.Seq)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if l.size, err = file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.file = file
+
+	if l.archive, err = openOrderArchive(viper.GetString("order_events.archive_path")); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// An order is in both when a crash came between archiving it and its
+	// OrderArchived event, or between its OrderRestored event and taking it
+	// out of the archive; the event log decides.
+	for id := range orders {
+		if err := l.archive.drop(id); err != nil {
+			l.archive.Close()
+			file.Close()
+			return nil, err
+		}
+	}
+	for id, order := range orders {
+		orderPolicy.TouchAt(id, order.UpdatedAt)
+	}
+	orderPolicy.SetArchived(l.archive.len())
+
+	l.readModel = newOrderReadModel(orders, l.seq)
+	if err := l.archive.each(l.readModel.addArchived); err != nil {
+		l.readModel.Close()
+		l.archive.Close()
+		file.Close()
+		return nil, err
+	}
+
+	activeOrders.Set(float64(len(orders) + l.archive.len()))
+	orderReplayedEvents.Set(float64(replayed))
+	logrus.WithFields(logrus.Fields{
+		"orders":       len(orders),
+		"archived":     l.archive.len(),
+		"snapshot_seq": snapshot.Seq,
+		"replayed":     replayed,
+		"last_seq":     l.seq,
+	}).Info("Order state rebuilt from event log")
+	return l, nil
+}
+
+// replay indexes the events of file and applies those after seq. A last
+// line cut short by a crash is truncated away so the next append starts on
+// a line of its own.
+func (l *orderEventLog) replay(file *os.File, seq uint64) (int, error) {
+	reader := bufio.NewReader(file)
+	var offset int64
+	replayed := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logrus.WithField("offset", offset).Warn("Truncating incomplete order event at end of log")
+				if err := file.Truncate(offset); err != nil {
+					return replayed, fmt.Errorf("truncate order event log: %w", err)
+				}
+			}
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("read order event log: %w", err)
+		}
+		var event OrderEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return replayed, fmt.Errorf("order event log at offset %d: %w", offset, err)
+		}
+		l.index(event, offset, len(line))
+		offset += int64(len(line))
+		if event.Seq > l.seq {
+			l.seq = event.Seq
+		}
+		if event.Seq <= seq {
+			continue
+		}
+		applyOrderEvent(event)
+		replayed++
+	}
+}
+
+// append assigns event the next sequence number, writes it and applies it
+// to orders. The caller must hold ordersMu for writing.
+func (l *orderEventLog) append(event OrderEvent) (OrderEvent, error) {
+	event.Seq = l.seq + 1
+	line, err := json.Marshal(event)
+	if err != nil {
+		return event, err
+	}
+	line = append(line, '\n')
+	if _, err = l.file.Write(line); err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Drop what was written of the event: it was not committed, and
+		// the log stays one event per line.
+		if terr := l.file.Truncate(l.size); terr == nil {
+			l.file.Seek(l.size, io.SeekStart)
+		}
+		return event, err
+	}
+	l.index(event, l.size, len(line))
+	l.size += int64(len(line))
+	l.seq = event.Seq
+	applyOrderEvent(event)
+	l.readModel.publish(event)
+	orderEventsTotal.WithLabelValues(event.Type).Inc()
+	switch event.Type {
+	case OrderCreated, StatusChanged:
+		orderPolicy.Touch(event.OrderID)
+		if orderPolicy.Occupancy().Full {
+			wakeOrderEviction()
+		}
+	case OrderDeleted:
+		orderPolicy.Forget(event.OrderID)
+	}
+
+	if l.snapshotEvery > 0 && event.Seq%l.snapshotEvery == 0 {
+		snapshot := orderSnapshot{Seq: event.Seq, At: time.Now(), Orders: make(map[string]Order, len(orders))}
+		for id, order := range orders {
+			snapshot.Orders[id] = order
+		}
+		go l.writeSnapshot(snapshot)
+	}
+	return event, nil
+}
+
+// index records where event is in the log. The caller must hold ordersMu
+// for writing.
+func (l *orderEventLog) index(event OrderEvent, offset int64, length int) {
+	l.byOrder[event.OrderID] = append(l.byOrder[event.OrderID], orderEventEntry{seq: event.Seq, offset: offset, length: length})
+}
+
+// applyOrderEvent updates orders with event.
+func applyOrderEvent(event OrderEvent) {
+	switch event.Type {
+	case OrderCreated:
+		if event.Order != nil {
+			orders[event.OrderID] = *event.Order
+		}
+	case StatusChanged:
+		if order, ok := orders[event.OrderID]; ok {
+			order.Status = event.To
+			order.UpdatedAt = event.Timestamp
+			orders[event.OrderID] = order
+		}
+	case OrderDeleted, OrderArchived:
+		delete(orders, event.OrderID)
+	case OrderRestored:
+		if event.Order != nil {
+			orders[event.OrderID] = *event.Order
+		}
+	}
+}
+
+// snapshot writes the current state; the caller must hold ordersMu.
+func (l *orderEventLog) snapshot() {
+	s := orderSnapshot{Seq: l.seq, At: time.Now(), Orders: orders}
+	l.writeSnapshot(s)
+}
+
+// writeSnapshot replaces the snapshot file unless a newer one was written
+// meanwhile. The file is written beside the old one and renamed over it so
+// a crash never leaves a partial snapshot.
+func (l *orderEventLog) writeSnapshot(s orderSnapshot) {
+	l.snapshotMu.Lock()
+	defer l.snapshotMu.Unlock()
+	if s.Seq <= l.snapshotSeq || l.snapshotPath == "" {
+		return
+	}
+
+	err := func() error {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		tmp := l.snapshotPath + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, l.snapshotPath)
+	}()
+	if err != nil {
+		orderSnapshotsTotal.WithLabelValues("error").Inc()
+		logrus.WithError(err).WithField("seq", s.Seq).Error("Failed to write order snapshot")
+		return
+	}
+	l.snapshotSeq = s.Seq
+	orderSnapshotsTotal.WithLabelValues("ok").Inc()
+	logrus.WithFields(logrus.Fields{"seq": s.Seq, "orders": len(s.Orders)}).Info("Order snapshot written")
+}
+
+// readOrderSnapshot reads the snapshot at path; a missing file is the empty
+// state before the first event.
+func readOrderSnapshot(path string) (orderSnapshot, error) {
+	snapshot := orderSnapshot{Orders: make(map[string]Order)}
+	if path == "" {
+		return snapshot, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, fmt.Errorf("read order snapshot: %w", err)
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("order snapshot %s: %w", path, err)
+	}
+	if snapshot.Orders == nil {
+		snapshot.Orders = make(map[string]Order)
+	}
+	return snapshot, nil
+}
+
+// Close snapshots the state so the next start replays nothing, and closes
+// the log, its read model and the archive.
+func (l *orderEventLog) Close() error {
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+	l.snapshot()
+	l.readModel.Close()
+	l.archive.Close()
+	return l.file.Close()
+}
+
+// eventsOf returns up to limit events of order id with sequence numbers
+// after since, oldest first, reading only those events from the log.
+func (l *orderEventLog) eventsOf(id string, since uint64, limit int) ([]OrderEvent, bool, error) {
+	ordersMu.RLock()
+	entries := l.byOrder[id]
+	ordersMu.RUnlock()
+	if len(entries) == 0 {
+		return nil, false, nil
+	}
+
+	first := sort.Search(len(entries), func(i int) bool { return entries[i].seq > since })
+	entries = entries[first:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	events := make([]OrderEvent, 0, len(entries))
+	for _, entry := range entries {
+		line := make([]byte, entry.length)
+		if _, err := l.file.ReadAt(line, entry.offset); err != nil {
+			return nil, true, fmt.Errorf("read order event %d: %w", entry.seq, err)
+		}
+		var event OrderEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, true, fmt.Errorf("order event log at offset %d: %w", entry.offset, err)
+		}
+		events = append(events, event)
+	}
+	return events, true, nil
+}
+
+// getOrderEventsHandler serves GET /api/v1/orders/{id}/events?since=&limit=,
+// the order's events in the order they happened. Events of deleted orders
+// are still served.
+func getOrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q", v), http.StatusBadRequest)
+			return
+		}
+		since = seq
+	}
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, found, err := orderEvents.eventsOf(orderID, since, page.Limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read order events")
+		http.Error(w, "Failed to read order events", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	base := apiPath(r, "/orders/"+orderID+"/events")
+	links := response.Links{
+		"self":  response.Link(r, base+"?since="+strconv.FormatUint(since, 10)),
+		"order": response.Link(r, apiPath(r, "/orders/"+orderID)),
+	}
+	if len(events) == page.Limit {
+		links["next"] = response.Link(r, base+"?since="+strconv.FormatUint(events[len(events)-1].Seq, 10)+"&limit="+strconv.Itoa(page.Limit))
+	}
+	response.Write(w, r, http.StatusOK, events, links)
+}
+
+// since returns up to limit events of every order with sequence numbers
+// after since, oldest first, and the sequence of the latest event.
+func (l *orderEventLog) since(since uint64, limit int) ([]OrderEvent, uint64, error) {
+	ordersMu.RLock()
+	last := l.seq
+	ordersMu.RUnlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, last, err
+	}
+	defer file.Close()
+
+	events := []OrderEvent{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(events) < limit {
+		var event OrderEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Seq <= since {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, last, scanner.Err()
+}
+
+// listOrderEventsHandler serves GET /api/v1/order-events?since=&limit=, the
+// events of every order in the order they happened, for consumers such as
+// the rollup service that follow the log the way they follow the data
+// service change feed.
+func listOrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q", v), http.StatusBadRequest)
+			return
+		}
+		since = seq
+	}
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, last, err := orderEvents.since(since, page.Limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read order events")
+		http.Error(w, "Failed to read order events", http.StatusInternalServerError)
+		return
+	}
+	next := since
+	if len(events) > 0 {
+		next = events[len(events)-1].Seq
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":   events,
+		"next":     next,
+		"last_seq": last,
+	})
+}
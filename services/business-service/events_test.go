@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// openTestEventLog points orderEvents at an event log in dir.
+func openTestEventLog(t *testing.T, dir string) {
+	t.Helper()
+	viper.Set("order_events.path", filepath.Join(dir, "orders.events.log"))
+	viper.Set("order_events.snapshot_path", filepath.Join(dir, "orders.snapshot.json"))
+	viper.Set("order_events.archive_path", filepath.Join(dir, "orders.archive.jsonl"))
+	viper.Set("order_events.snapshot_every", 0)
+	var err error
+	if orderEvents, err = openOrderEventLog(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendTestEvents(t *testing.T, events ...OrderEvent) {
+	t.Helper()
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+	for _, e := range events {
+		e.Timestamp = time.Now()
+		if _, err := orderEvents.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEventsOfUsesOrderIndex(t *testing.T) {
+	dir := t.TempDir()
+	openTestEventLog(t, dir)
+	appendTestEvents(t,
+		OrderEvent{Type: OrderCreated, OrderID: "o1", Order: &Order{ID: "o1", Status: "pending"}},
+		OrderEvent{Type: OrderCreated, OrderID: "o2", Order: &Order{ID: "o2", Status: "pending"}},
+		OrderEvent{Type: StatusChanged, OrderID: "o1", From: "pending", To: "confirmed"},
+		OrderEvent{Type: StatusChanged, OrderID: "o2", From: "pending", To: "confirmed"},
+		OrderEvent{Type: OrderDeleted, OrderID: "o1"},
+	)
+
+	check := func(when string) {
+		t.Helper()
+		events, found, err := orderEvents.eventsOf("o1", 0, 10)
+		if err != nil || !found || len(events) != 3 || events[0].Seq != 1 || events[1].To != "confirmed" || events[2].Type != OrderDeleted {
+			t.Errorf("%s: eventsOf(o1) = %+v, %v, %v", when, events, found, err)
+		}
+		if events, _, _ := orderEvents.eventsOf("o1", 1, 1); len(events) != 1 || events[0].Seq != 3 {
+			t.Errorf("%s: eventsOf(o1, since 1, limit 1) = %+v", when, events)
+		}
+		if events, found, _ := orderEvents.eventsOf("o2", 4, 10); !found || len(events) != 0 {
+			t.Errorf("%s: eventsOf(o2, since 4) = %+v, found %v", when, events, found)
+		}
+		if _, found, _ := orderEvents.eventsOf("missing", 0, 10); found {
+			t.Errorf("%s: unknown order found", when)
+		}
+	}
+	check("after appending")
+
+	// A restart rebuilds the index from the log, including the events
+	// covered by the snapshot written on close.
+	if err := orderEvents.Close(); err != nil {
+		t.Fatal(err)
+	}
+	openTestEventLog(t, dir)
+	defer orderEvents.Close()
+	check("after reopening")
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"pipeline/pkg/response"
+)
+
+// orderLinks links an order to itself, the order collection and, when the
+// audit log is enabled, the audit events of the order, all under the API
+// version of r.
+func orderLinks(r *http.Request, o Order) response.Links {
+	self := apiPath(r, "/orders/"+o.ID)
+	links := response.Links{
+		"self":       response.Link(r, self),
+		"collection": response.Link(r, apiPath(r, "/orders")),
+	}
+	if auditRecorder != nil {
+		links["events"] = response.Link(r, "/api/v1/audit?resource="+url.QueryEscape(self))
+	}
+	return links
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +20,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+
+	"pipeline/pkg/apiversion"
+	"pipeline/pkg/audit"
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/codec"
+	"pipeline/pkg/response"
+	"pipeline/pkg/telemetry"
+	"pipeline/pkg/workload"
 )
 
 type Order struct {
@@ -27,6 +38,12 @@ type Order struct {
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// CustomerID optionally names who placed the order.
+	CustomerID string `json:"customer_id,omitempty"`
+
+	// Links is set on orders listed in a collection response.
+	Links map[string]string `json:"links,omitempty"`
 }
 
 type BusinessMetrics struct {
@@ -36,13 +53,22 @@ type BusinessMetrics struct {
 	AverageOrderSize float64 `json:"average_order_size"`
 }
 
+// version and commit are set at build time via -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "1.0.0"
+	commit  = "unknown"
+)
+
 var (
 	startTime = time.Now()
 	orders    = make(map[string]Order)
-	orderLock = make(map[string]bool)
 
-	// Prometheus metrics
-	httpRequestsTotal = prometheus.NewCounterVec(
+	// Prometheus metrics; histograms are built by registerHistograms once
+	// the bucket configuration has been loaded.
+	httpRequestDuration     *telemetry.LimitedHistogramVec
+	orderProcessingDuration *prometheus.HistogramVec
+
+	httpRequestsTotal = telemetry.NewLimitedCounterVec(
 		prometheus.CounterOpts{
 			Name: "business_http_requests_total",
 			Help: "Total number of HTTP requests for business service",
@@ -50,15 +76,6 @@ var (
 		[]string{"method", "endpoint", "status"},
 	)
 
-	httpRequestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "business_http_request_duration_seconds",
-			Help:    "HTTP request duration for business service",
-			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
-		},
-		[]string{"method", "endpoint", "status"},
-	)
-
 	activeOrders = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "business_active_orders",
@@ -72,56 +89,171 @@ var (
 			Help: "Total revenue from all orders",
 		},
 	)
-
-	orderProcessingDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "business_order_processing_duration_seconds",
-			Help:    "Time taken to process orders",
-			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10},
-		},
-		[]string{"status"},
-	)
 )
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(httpRequestDuration)
 	prometheus.MustRegister(activeOrders)
 	prometheus.MustRegister(totalRevenue)
-	prometheus.MustRegister(orderProcessingDuration)
 
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	logrus.SetLevel(logrus.InfoLevel)
 }
 
+// registerHistograms builds and registers the duration histograms using the
+// configured buckets and native histogram settings.
+func registerHistograms() {
+	httpRequestDuration = telemetry.NewLimitedHistogramVec(
+		bootstrap.HistogramSettings(viper.GetViper(), "http_request_duration").Apply(prometheus.HistogramOpts{
+			Name:    "business_http_request_duration_seconds",
+			Help:    "HTTP request duration for business service",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		}),
+		[]string{"method", "endpoint", "status"},
+	)
+	prometheus.MustRegister(httpRequestDuration)
+
+	orderProcessingDuration = prometheus.NewHistogramVec(
+		bootstrap.HistogramSettings(viper.GetViper(), "order_processing_duration").Apply(prometheus.HistogramOpts{
+			Name:    "business_order_processing_duration_seconds",
+			Help:    "Time taken to process orders",
+			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10},
+		}),
+		[]string{"status"},
+	)
+	prometheus.MustRegister(orderProcessingDuration)
+}
+
 func main() {
 	loadConfig()
+	applyLogLevel()
+	stopLogShipping := bootstrap.StartLogShipping(viper.GetViper(), "business-service")
+	defer stopLogShipping()
+	telemetry.ConfigureCardinality(viper.GetInt("metrics.cardinality_limit"), func(metric string, labelValues []string) {
+		logrus.WithFields(logrus.Fields{
+			"metric": metric,
+			"labels": labelValues,
+			"limit":  viper.GetInt("metrics.cardinality_limit"),
+		}).Warn("Metric cardinality limit reached, collapsing new label sets into \"other\"")
+	})
+	registerHistograms()
+	telemetry.RegisterBuildInfo(version, commit)
+	telemetry.RegisterFeatureFlags(featureFlags())
+	apdex = bootstrap.NewApdex(viper.GetViper(), "business")
+	requestLogger = bootstrap.NewRequestLogger(viper.GetViper(), "Business service request", contextLogFields)
+
+	stopSinks := bootstrap.StartMetricSinks(viper.GetViper(), "business-service")
+	defer stopSinks()
+	stopRuntime := bootstrap.StartRuntimeMetrics(viper.GetViper())
+	defer stopRuntime()
+	stopProfiling := bootstrap.StartProfiling(viper.GetViper(), "business-service", version)
+	defer stopProfiling()
+	auditor := bootstrap.StartShutdownAudit(viper.GetViper())
+	var drainErr error
+	defer func() {
+		bootstrap.FinishShutdownAudit(auditor, drainErr, 0)
+	}()
+	stopAnomalyDetection := startAnomalyDetection()
+	defer stopAnomalyDetection()
+	stopDependencyProbes := startDependencyProbes()
+	defer stopDependencyProbes()
+
+	actors, err := newAuditActors()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid audit.trusted_proxies config")
+	}
+	auditActors = actors
+	if viper.GetBool("audit.enabled") {
+		recorder, err := newAuditRecorder("business-service")
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to open audit log")
+		}
+		auditRecorder = recorder
+	}
+
+	events, err := openOrderEventLog()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open order event log")
+	}
+	orderEvents = events
+	defer orderEvents.Close()
+	stopOrderEviction := startOrderEviction()
+	defer stopOrderEviction()
+
+	guard, err := bootstrap.NewAccessGuard(viper.GetViper())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid endpoint_protection config")
+	}
+
+	signatureVerifier, err := bootstrap.NewSignatureVerifier(viper.GetViper())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid request_signing config")
+	}
+
+	loadShedder := bootstrap.NewLoadShedder(viper.GetViper())
+	defer loadShedder.Close()
 
 	router := mux.NewRouter()
 
 	// Middleware
 	router.Use(loggingMiddleware)
 	router.Use(metricsMiddleware)
+	router.Use(loadShedder.Wrap)
+	if signatureVerifier != nil {
+		router.Use(signatureVerifier.Wrap)
+	}
+	router.Use(auditMiddleware)
 
 	// Routes
 	router.HandleFunc("/", homeHandler).Methods("GET")
 	router.HandleFunc("/health", healthHandler).Methods("GET")
 	router.HandleFunc("/ready", readinessHandler).Methods("GET")
-	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+	router.Handle("/metrics", guard.Wrap(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		// OpenMetrics is required for exemplars to be exposed.
+		EnableOpenMetrics: true,
+	}))).Methods("GET")
+	router.Handle("/admin/config", guard.Wrap(configSources.Handler())).Methods("GET")
+	router.Handle("/admin/log-level", guard.WrapFunc(logLevelHandler)).Methods("GET")
+	router.Handle("/admin/log-level", guard.WrapFunc(setLogLevelHandler)).Methods("PUT")
+
+	v1, v2, err := newAPIVersions(router)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid api config")
+	}
 
-	// Business logic endpoints
+	// Business logic endpoints. v2 serves the same resources with integer
+	// money amounts; the other endpoints are only served under v1.
+	for _, version := range []*apiversion.Version{v1, v2} {
+		api := router.PathPrefix(version.Prefix).Subrouter()
+		api.Use(version.Wrap)
+		api.HandleFunc("/orders", createOrderHandler).Methods("POST")
+		api.HandleFunc("/orders", getOrdersHandler).Methods("GET")
+		api.HandleFunc("/orders/{id}", getOrderHandler).Methods("GET")
+		api.HandleFunc("/orders/{id}", updateOrderHandler).Methods("PUT")
+		api.HandleFunc("/orders/{id}", deleteOrderHandler).Methods("DELETE")
+		api.HandleFunc("/metrics", businessMetricsHandler).Methods("GET")
+		api.HandleFunc("/reports/orders", getOrderReportHandler).Methods("GET")
+	}
 	api := router.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/orders", createOrderHandler).Methods("POST")
-	api.HandleFunc("/orders", getOrdersHandler).Methods("GET")
-	api.HandleFunc("/orders/{id}", getOrderHandler).Methods("GET")
-	api.HandleFunc("/orders/{id}", updateOrderHandler).Methods("PUT")
-	api.HandleFunc("/orders/{id}", deleteOrderHandler).Methods("DELETE")
-	api.HandleFunc("/metrics", businessMetricsHandler).Methods("GET")
-	api.HandleFunc("/simulate", simulateBusinessActivity).Methods("POST")
+	api.Use(v1.Wrap)
+	api.HandleFunc("/orders/{id}/events", getOrderEventsHandler).Methods("GET")
+	api.HandleFunc("/order-events", listOrderEventsHandler).Methods("GET")
+	api.Handle("/simulate", guard.WrapFunc(simulateBusinessActivity)).Methods("POST")
+	api.Handle("/snapshots", guard.WrapFunc(listSnapshotsHandler)).Methods("GET")
+	// Saving, deleting and restoring snapshots replace the service's state,
+	// so without endpoint_protection they are not served at all.
+	if guard.Enabled() {
+		api.Handle("/snapshots/{name}", guard.WrapFunc(createSnapshotHandler)).Methods("PUT")
+		api.Handle("/snapshots/{name}", guard.WrapFunc(deleteSnapshotHandler)).Methods("DELETE")
+		api.Handle("/snapshots/{name}/restore", guard.WrapFunc(restoreSnapshotHandler)).Methods("POST")
+	}
+	if auditRecorder != nil {
+		api.Handle("/audit", guard.Wrap(auditRecorder.Handler())).Methods("GET")
+	}
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", viper.GetString("port")),
-		Handler:      router,
+		Handler:      auditor.Wrap(router),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -134,18 +266,22 @@ func main() {
 			logrus.WithError(err).Fatal("Server failed to start")
 		}
 	}()
+	stopRegistration := startRegistration()
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// Withdrawn first so the gateway stops routing here while in-flight
+	// requests drain.
+	stopRegistration()
 	logrus.Info("Shutting down business service...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown.drain_timeout"))
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		logrus.WithError(err).Error("Server forced to shutdown")
+	if drainErr = srv.Shutdown(ctx); drainErr != nil {
+		logrus.WithError(drainErr).Error("Server forced to shutdown")
 	}
 
 	logrus.Info("Business service exited")
@@ -159,34 +295,138 @@ func loadConfig() {
 
 	viper.SetDefault("port", "8081")
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("logging.sample_rate", 1.0)
+	viper.SetDefault("logging.slow_threshold", "1s")
+	viper.SetDefault("logging.capture_bodies", false)
+	viper.SetDefault("logging.max_body_bytes", 2048)
+	viper.SetDefault("remote_config.enabled", false)
+	viper.SetDefault("remote_config.provider", "consul")
+	viper.SetDefault("remote_config.endpoint", "http://consul:8500")
+	viper.SetDefault("remote_config.path", "config/business-service")
+	viper.SetDefault("remote_config.format", "yaml")
+	viper.SetDefault("remote_config.watch_interval", "30s")
+	viper.SetDefault("secrets.provider", "env")
+	viper.SetDefault("secrets.refresh_interval", "5m")
+	viper.SetDefault("secrets.vault.mount", "secret")
+	viper.SetDefault("secrets.vault.kubernetes.mount", "kubernetes")
+	viper.BindEnv("secrets.vault.address", "SECRETS_VAULT_ADDRESS", "VAULT_ADDR")
+	viper.BindEnv("secrets.vault.token", "SECRETS_VAULT_TOKEN", "VAULT_TOKEN")
+	viper.BindEnv("secrets.vault.namespace", "SECRETS_VAULT_NAMESPACE", "VAULT_NAMESPACE")
+	viper.SetDefault("api.v1.deprecated_at", "2026-10-17T00:00:00Z")
+	viper.SetDefault("api.v1.sunset", "2027-04-17T00:00:00Z")
+	viper.SetDefault("api.v1.docs_url", "")
+	viper.SetDefault("audit.enabled", true)
+	viper.SetDefault("audit.path", "audit.log")
+	viper.SetDefault("audit.max_summary_bytes", 1024)
+	viper.SetDefault("audit.trusted_proxies", []string{})
+	viper.SetDefault("order_events.path", "orders.events.log")
+	viper.SetDefault("order_events.snapshot_path", "orders.snapshot.json")
+	viper.SetDefault("order_events.snapshot_every", 500)
+	viper.SetDefault("order_events.archive_path", "orders.archive.jsonl")
+	viper.SetDefault("order_store.max_entries", 10000)
+	viper.SetDefault("order_store.ttl", "24h")
+	viper.SetDefault("order_store.interval", "1m")
+	viper.SetDefault("snapshots.path", "snapshots")
+	viper.SetDefault("simulation.max_count", 10000)
+	viper.SetDefault("anomaly.enabled", false)
+	viper.SetDefault("anomaly.interval", "1m")
+	viper.SetDefault("anomaly.alpha", 0.1)
+	viper.SetDefault("anomaly.threshold", 3.0)
+	viper.SetDefault("anomaly.min_samples", 10)
+	viper.SetDefault("anomaly.min_stddev", 0.1)
+	viper.SetDefault("anomaly.notify.alertmanager_url", "")
+	viper.SetDefault("anomaly.notify.webhook_url", "")
+	viper.SetDefault("anomaly.notify.severity", "warning")
+	viper.SetDefault("log_shipping.enabled", false)
+	viper.SetDefault("log_shipping.backend", "loki")
+	viper.SetDefault("log_shipping.url", "http://loki:3100")
+	viper.SetDefault("log_shipping.index", "pipeline-logs")
+	viper.SetDefault("log_shipping.batch_size", 100)
+	viper.SetDefault("log_shipping.flush_interval", "2s")
+	viper.SetDefault("log_shipping.buffer_size", 10000)
+	viper.SetDefault("log_shipping.max_retries", 3)
+	viper.SetDefault("log_shipping.timeout", "5s")
+	viper.SetDefault("endpoint_protection.allowed_ips", []string{})
+	// Credential keys need defaults so vault: references given only via
+	// environment variables are seen by resolveSecrets.
+	viper.SetDefault("endpoint_protection.bearer_token", "")
+	viper.SetDefault("endpoint_protection.basic_auth.username", "")
+	viper.SetDefault("endpoint_protection.basic_auth.password", "")
+	viper.SetDefault("profiling.enabled", false)
+	viper.SetDefault("profiling.backend", "pyroscope")
+	viper.SetDefault("profiling.url", "http://pyroscope:4040")
+	viper.SetDefault("profiling.profiles", []string{"cpu", "heap"})
+	viper.SetDefault("profiling.interval", "15s")
+	viper.SetDefault("profiling.timeout", "10s")
+	viper.SetDefault("profiling.tags", map[string]string{})
+	viper.SetDefault("shutdown.drain_timeout", "30s")
+	viper.SetDefault("shutdown.settle", "2s")
+	viper.SetDefault("shutdown.report_path", "shutdown.json")
+	viper.SetDefault("runtime.enabled", true)
+	viper.SetDefault("runtime.interval", "15s")
+	viper.SetDefault("runtime.window", "5m")
+	viper.SetDefault("runtime.thresholds.goroutine_growth", 100)
+	viper.SetDefault("runtime.thresholds.gc_pause_p99", "100ms")
+	viper.SetDefault("runtime.thresholds.sched_latency_p99", "50ms")
+	viper.SetDefault("runtime.thresholds.fd_usage", 0.8)
+	viper.SetDefault("load_shedding.enabled", true)
+	viper.SetDefault("load_shedding.max_in_flight", 100)
+	viper.SetDefault("load_shedding.cpu_threshold", 0.9)
+	viper.SetDefault("load_shedding.low_priority_at", 0.6)
+	viper.SetDefault("load_shedding.normal_priority_at", 0.85)
+	viper.SetDefault("load_shedding.retry_after", "1s")
+	viper.SetDefault("load_shedding.exempt_paths", []string{})
+	viper.SetDefault("request_signing.enabled", false)
+	viper.SetDefault("request_signing.secret", "")
+	viper.SetDefault("request_signing.max_body_bytes", 10485760)
+	viper.SetDefault("request_signing.previous_secrets", []string{})
+	viper.SetDefault("request_signing.max_skew", "5m")
+	viper.SetDefault("request_signing.exempt_paths", []string{})
+	viper.SetDefault("metrics.apdex.threshold", "250ms")
+	viper.SetDefault("metrics.cardinality_limit", 1000)
+	viper.SetDefault("metrics.native_histograms.enabled", false)
+	viper.SetDefault("metrics.native_histograms.bucket_factor", 1.1)
+	viper.SetDefault("metrics.native_histograms.max_buckets", 160)
+	viper.SetDefault("otlp.enabled", false)
+	viper.SetDefault("otlp.endpoint", "http://otel-collector:4318")
+	viper.SetDefault("otlp.interval", "15s")
+	viper.SetDefault("otlp.timeout", "5s")
+	viper.SetDefault("pushgateway.enabled", false)
+	viper.SetDefault("pushgateway.url", "http://pushgateway:9091")
+	viper.SetDefault("pushgateway.job", "business-service")
+	viper.SetDefault("statsd.enabled", false)
+	viper.SetDefault("statsd.address", "localhost:8125")
+	viper.SetDefault("statsd.prefix", "pipeline.")
+	viper.SetDefault("statsd.dogstatsd", true)
+	viper.SetDefault("statsd.interval", "10s")
+	viper.SetDefault("statsd.metrics", []string{"business_http_requests_total", "business_http_request_duration_seconds", "business_active_orders", "business_order_processing_duration_seconds"})
 	viper.SetDefault("order_processing_time", "2s")
+	viper.SetDefault("health.check_interval", "30s")
+	viper.SetDefault("health.timeout", "5s")
+	viper.SetDefault("dependencies", []map[string]interface{}{})
+	viper.SetDefault("registration.enabled", false)
+	viper.SetDefault("registration.gateway_url", "http://api-gateway:8080")
+	viper.SetDefault("registration.name", "business-service")
+	viper.SetDefault("registration.url", "http://business-service:8081")
+	viper.SetDefault("registration.health_path", "/health")
+	viper.SetDefault("registration.routes", []string{})
+	viper.SetDefault("registration.interval", "10s")
+	viper.SetDefault("registration.timeout", "5s")
+	viper.SetDefault("registration.token", "")
 
 	if err := viper.ReadInConfig(); err != nil {
 		logrus.WithError(err).Warn("Could not read config file, using defaults")
 	}
 
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
+
+	loadRemoteConfig()
+	resolveSecrets()
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(wrapped, r)
-
-		duration := time.Since(start)
-
-		logrus.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status":      wrapped.statusCode,
-			"duration":    duration.String(),
-			"user_agent":  r.UserAgent(),
-			"remote_addr": r.RemoteAddr,
-		}).Info("Business service request")
-	})
+	return requestLogger.Wrap(next)
 }
 
 func metricsMiddleware(next http.Handler) http.Handler {
@@ -197,10 +437,13 @@ func metricsMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		duration := time.Since(start).Seconds()
+		elapsed := time.Since(start)
+		duration := elapsed.Seconds()
 
 		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Inc()
-		httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Observe(duration)
+		telemetry.ObserveWithExemplar(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)), duration, telemetry.TraceID(r))
+		apdex.Observe(routeTemplate(r), elapsed, wrapped.statusCode)
+		observeRequestContext(r, fmt.Sprintf("%d", wrapped.statusCode))
 	})
 }
 
@@ -215,14 +458,18 @@ func (rw *responseWriter) WriteHeader(code int) {
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
+	ordersMu.RLock()
+	defer ordersMu.RUnlock()
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
-		"service":   "Business Service",
-		"version":   "1.0.0",
-		"status":    "running",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-		"uptime":    time.Since(startTime).String(),
-		"orders":    len(orders),
+		"service":      "Business Service",
+		"version":      version,
+		"status":       "running",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+		"uptime":       time.Since(startTime).String(),
+		"orders":       len(orders),
+		"api_versions": apiVersions,
+		"capabilities": capabilities(),
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -231,17 +478,26 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Simulate some business logic check
-	healthy := true
-	if len(orders) > 1000 { // Example threshold
-		healthy = false
-	}
+	ordersMu.RLock()
+	defer ordersMu.RUnlock()
+
+	// Orders beyond order_store.max_entries that could not be archived yet,
+	// such as pending ones, degrade the service.
+	store := orderPolicy.Occupancy()
+
+	dependencies, criticalDown, degraded := dependencyHealth()
+	// A saturated runtime degrades the service but keeps it in rotation.
+	runtimeStatus, sampled := telemetry.Runtime()
+	saturated := len(runtimeStatus.Saturated) > 0
 
 	status := "healthy"
 	statusCode := http.StatusOK
-	if !healthy {
+	switch {
+	case criticalDown:
 		status = "unhealthy"
 		statusCode = http.StatusServiceUnavailable
+	case degraded || saturated || store.Full:
+		status = "degraded"
 	}
 
 	response := map[string]interface{}{
@@ -250,9 +506,18 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		"uptime":    time.Since(startTime).String(),
 		"orders":    len(orders),
 		"checks": map[string]bool{
-			"database":   true,
-			"processing": healthy,
+			"database":     true,
+			"order_store":  !store.Full,
+			"dependencies": !criticalDown && !degraded,
+			"runtime":      !saturated,
 		},
+		"order_store": store,
+	}
+	if len(dependencies) > 0 {
+		response["dependencies"] = dependencies
+	}
+	if sampled {
+		response["runtime"] = runtimeStatus
 	}
 
 	w.WriteHeader(statusCode)
@@ -270,7 +535,14 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 
 func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	var order Order
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+	if isV2(r) {
+		var body NewOrderV2
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		order = Order{Product: body.Product, Quantity: body.Quantity, Price: float64(body.PriceCents) / 100, CustomerID: body.CustomerID}
+	} else if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -278,25 +550,40 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	order.ID = uuid.New().String()
 	order.Status = "pending"
 	order.CreatedAt = time.Now()
-	order.UpdatedAt = time.Now()
-
-	orderLock[order.ID] = true
-	defer delete(orderLock, order.ID)
+	order.UpdatedAt = order.CreatedAt
+
+	// The order is pending while it is processed.
+	actor := auditActors.Actor(r)
+	ordersMu.Lock()
+	_, err := orderEvents.append(OrderEvent{Type: OrderCreated, OrderID: order.ID, Timestamp: order.CreatedAt, Actor: actor, Order: &order})
+	ordersMu.Unlock()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to append order event")
+		http.Error(w, "Failed to save order", http.StatusInternalServerError)
+		return
+	}
 
 	// Simulate order processing time
 	processingTime := time.Duration(rand.Intn(3)+1) * time.Second
 	time.Sleep(processingTime)
 
 	// Randomly fail some orders (5% failure rate for demo)
+	status := "completed"
 	if rand.Float32() < 0.05 {
-		order.Status = "failed"
-		orderProcessingDuration.WithLabelValues("failed").Observe(processingTime.Seconds())
-	} else {
-		order.Status = "completed"
-		orderProcessingDuration.WithLabelValues("completed").Observe(processingTime.Seconds())
+		status = "failed"
 	}
-
-	orders[order.ID] = order
+	telemetry.ObserveWithExemplar(orderProcessingDuration.WithLabelValues(status), processingTime.Seconds(), telemetry.TraceID(r))
+
+	ordersMu.Lock()
+	_, err = orderEvents.append(OrderEvent{Type: StatusChanged, OrderID: order.ID, Timestamp: time.Now(), Actor: actor, From: order.Status, To: status})
+	order = orders[order.ID]
+	ordersMu.Unlock()
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", order.ID).Error("Failed to append order event, order stays pending")
+		http.Error(w, "Failed to save order", http.StatusInternalServerError)
+		return
+	}
+	ordersCreated.Add(1)
 	activeOrders.Inc()
 	totalRevenue.Add(order.Price * float64(order.Quantity))
 
@@ -306,98 +593,147 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 		"price":    order.Price,
 	}).Info("Order processed")
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(order)
+	response.Created(w, r, presentOrder(r, order), orderLinks(r, order))
 }
 
+// getOrdersHandler serves
+// GET /api/v1/orders?status=&product=&customer_id=&offset=&limit=, oldest
+// orders first, from the read model. Archived orders are not listed; they
+// are served by ID.
 func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	orderList := make([]Order, 0, len(orders))
-	for _, order := range orders {
-		orderList = append(orderList, order)
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	response := map[string]interface{}{
-		"orders": orderList,
-		"total":  len(orderList),
+	filter, err := parseOrderFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	pageOrders, total := orderEvents.readModel.list(filter, page)
+	for i := range pageOrders {
+		pageOrders[i].Links = orderLinks(r, pageOrders[i])
+	}
+	response.WriteList(w, r, presentOrders(r, pageOrders), page, total, nil)
 }
 
 func getOrderHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["id"]
 
-	order, exists := orders[orderID]
+	// Archived orders are read from the archive and stay there.
+	ordersMu.RLock()
+	order, exists, err := findOrder(orderID)
+	ordersMu.RUnlock()
+	if err != nil {
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to read archived order")
+		http.Error(w, "Failed to read order", http.StatusInternalServerError)
+		return
+	}
 	if !exists {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+	response.WriteResource(w, r, presentOrder(r, order), orderLinks(r, order), order.UpdatedAt)
 }
 
 func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["id"]
 
-	order, exists := orders[orderID]
-	if !exists {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
-	}
-
 	var updateData map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if status, ok := updateData["status"].(string); ok {
-		order.Status = status
+	ordersMu.Lock()
+	order, exists, err := findOrder(orderID)
+	if err != nil {
+		ordersMu.Unlock()
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to read archived order")
+		http.Error(w, "Failed to read order", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		ordersMu.Unlock()
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
 	}
-	order.UpdatedAt = time.Now()
 
-	orders[orderID] = order
+	audit.SetBefore(r.Context(), order)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+	// Only a change of status is an event; other updates leave the order as
+	// it is.
+	if status, ok := updateData["status"].(string); ok && status != order.Status {
+		if _, err := restoreOrder(orderID, auditActors.Actor(r)); err != nil {
+			ordersMu.Unlock()
+			logrus.WithError(err).Error("Failed to restore archived order")
+			http.Error(w, "Failed to save order", http.StatusInternalServerError)
+			return
+		}
+		if _, err := orderEvents.append(OrderEvent{Type: StatusChanged, OrderID: orderID, Timestamp: time.Now(), Actor: auditActors.Actor(r), From: order.Status, To: status}); err != nil {
+			ordersMu.Unlock()
+			logrus.WithError(err).Error("Failed to append order event")
+			http.Error(w, "Failed to save order", http.StatusInternalServerError)
+			return
+		}
+		order = orders[orderID]
+	}
+	ordersMu.Unlock()
+
+	response.Write(w, r, http.StatusOK, presentOrder(r, order), orderLinks(r, order))
 }
 
 func deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["id"]
 
-	_, exists := orders[orderID]
+	ordersMu.Lock()
+	order, exists, err := findOrder(orderID)
+	if err != nil {
+		ordersMu.Unlock()
+		logrus.WithError(err).WithField("order_id", orderID).Error("Failed to read archived order")
+		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+		return
+	}
 	if !exists {
+		ordersMu.Unlock()
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
+	audit.SetBefore(r.Context(), order)
 
-	delete(orders, orderID)
+	// An archived order is restored first, so its deletion is applied like
+	// any other.
+	_, err = restoreOrder(orderID, auditActors.Actor(r))
+	if err == nil {
+		_, err = orderEvents.append(OrderEvent{Type: OrderDeleted, OrderID: orderID, Timestamp: time.Now(), Actor: auditActors.Actor(r)})
+	}
+	ordersMu.Unlock()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to append order event")
+		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+		return
+	}
 	activeOrders.Dec()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Order deleted successfully",
+	response.Write(w, r, http.StatusOK, map[string]string{
+		"message":  "Order deleted successfully",
 		"order_id": orderID,
-	})
+	}, response.Links{"collection": response.Link(r, apiPath(r, "/orders"))})
 }
 
 func businessMetricsHandler(w http.ResponseWriter, r *http.Request) {
-	totalOrders := len(orders)
-	var totalRev float64
-	for _, order := range orders {
-		totalRev += order.Price * float64(order.Quantity)
-	}
+	totalOrders, totalRev, totalRevCents := orderEvents.readModel.totals()
 
 	ordersPerMinute := float64(totalOrders) / time.Since(startTime).Minutes()
 	avgOrderSize := float64(totalOrders)
 	if totalOrders > 0 {
-		avgOrderSize = float64(totalOrders) / float64(len(orders))
+		avgOrderSize = float64(totalOrders) / float64(totalOrders)
 	}
 
 	metrics := BusinessMetrics{
@@ -407,37 +743,126 @@ func businessMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		AverageOrderSize: avgOrderSize,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	if isV2(r) {
+		codec.Write(w, r, http.StatusOK, BusinessMetricsV2{
+			TotalOrders:       metrics.TotalOrders,
+			TotalRevenueCents: totalRevCents,
+			OrdersPerMinute:   metrics.OrdersPerMinute,
+			AverageOrderSize:  metrics.AverageOrderSize,
+		})
+		return
+	}
+	codec.Write(w, r, http.StatusOK, metrics)
 }
 
+// simulateBusinessActivity creates orders, by default 10 at one a second.
+// The optional body can ask for another count and rate, and name a workload
+// profile that shapes the rate over time and fails a share of the orders.
+// The orders, IDs included, are drawn from the seed in the body, or from a
+// random one; either is returned so the simulation can be repeated.
 func simulateBusinessActivity(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Seed    *int64  `json:"seed"`
+		Count   int     `json:"count"`
+		Rate    float64 `json:"rate"`
+		Profile string  `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := viper.GetInt("simulation.max_count"); body.Count < 0 || (limit > 0 && body.Count > limit) {
+		http.Error(w, fmt.Sprintf("count must be between 1 and simulation.max_count (%d)", limit), http.StatusBadRequest)
+		return
+	}
+	if body.Rate < 0 {
+		http.Error(w, "rate must be positive", http.StatusBadRequest)
+		return
+	}
+	if body.Count == 0 {
+		body.Count = 10
+	}
+	if body.Rate == 0 {
+		body.Rate = 1
+	}
+	var profile *workload.Profile
+	if body.Profile != "" {
+		p, err := workload.Lookup(body.Profile, viper.GetStringMapString("workload.profiles"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		profile = &p
+	}
+	seed := rand.Int63()
+	if body.Seed != nil {
+		seed = *body.Seed
+	}
+
+	simulationID := uuid.New().String()
 	go func() {
+		start := time.Now()
+		rng := rand.New(rand.NewSource(seed))
 		products := []string{"Laptop", "Phone", "Tablet", "Headphones", "Mouse", "Keyboard"}
-		for i := 0; i < 10; i++ {
-			order := Order{
-				ID:        uuid.New().String(),
-				Product:   products[rand.Intn(len(products))],
-				Quantity:  rand.Intn(5) + 1,
-				Price:     float64(rand.Intn(1000)+100) / 10,
-				Status:    "completed",
-				CreatedAt: time.Now(),
-				UpdatedAt: time.Now(),
+		pacer := workload.NewPacer(profile, body.Rate, start)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		created := 0
+		for {
+			due, errorShare := pacer.Due(time.Now())
+			for ; created < min(due, body.Count); created++ {
+				order := Order{
+					ID:        uuid.Must(uuid.NewRandomFromReader(rng)).String(),
+					Product:   products[rng.Intn(len(products))],
+					Quantity:  rng.Intn(5) + 1,
+					Price:     float64(rng.Intn(1000)+100) / 10,
+					Status:    "completed",
+					CreatedAt: time.Now(),
+					UpdatedAt: time.Now(),
+				}
+				if errorShare > 0 && rng.Float64() < errorShare {
+					order.Status = "failed"
+				}
+
+				ordersMu.Lock()
+				_, err := orderEvents.append(OrderEvent{Type: OrderCreated, OrderID: order.ID, Timestamp: order.CreatedAt, Actor: "simulation", Order: &order})
+				ordersMu.Unlock()
+				if err != nil {
+					logrus.WithError(err).Error("Failed to append order event")
+					continue
+				}
+				ordersCreated.Add(1)
+				activeOrders.Inc()
+				totalRevenue.Add(order.Price * float64(order.Quantity))
+
+				logrus.WithFields(logrus.Fields{"order_id": order.ID, "status": order.Status}).Info("Simulated order created")
 			}
-
-			orders[order.ID] = order
-			activeOrders.Inc()
-			totalRevenue.Add(order.Price * float64(order.Quantity))
-
-			logrus.WithField("order_id", order.ID).Info("Simulated order created")
-
-			time.Sleep(1 * time.Second)
+			if created >= body.Count {
+				break
+			}
+			<-ticker.C
 		}
+
+		end := time.Now()
+		bootstrap.PushJobResult(viper.GetViper(), "business-service", telemetry.JobResult{
+			ID:       simulationID,
+			Kind:     "simulation",
+			Status:   "completed",
+			Items:    body.Count,
+			Duration: end.Sub(start),
+			EndTime:  end,
+		})
 	}()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	result := map[string]string{
 		"message": "Business activity simulation started",
+		"simulation_id": simulationID,
+		"seed": strconv.FormatInt(seed, 10),
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
+	}
+	if body.Profile != "" {
+		result["profile"] = body.Profile
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
\ No newline at end of file
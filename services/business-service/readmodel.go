@@ -0,0 +1,521 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"pipeline/pkg/response"
+)
+
+var (
+	readModelLag = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "business_read_model_lag_events",
+			Help: "Order events appended to the log but not yet applied to the read model",
+		},
+	)
+	readModelApplied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "business_read_model_events_applied_total",
+			Help: "Order events applied to the read model",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(readModelLag, readModelApplied)
+}
+
+// orderKey orders the read model's lists as the API lists orders: oldest
+// first, by ID among orders created at the same time.
+type orderKey struct {
+	created time.Time
+	id      string
+}
+
+func (k orderKey) before(other orderKey) bool {
+	if !k.created.Equal(other.created) {
+		return k.created.Before(other.created)
+	}
+	return k.id < other.id
+}
+
+// orderList is a list of orders sorted by orderKey.
+type orderList []orderKey
+
+func (l orderList) search(k orderKey) int {
+	return sort.Search(len(l), func(i int) bool { return !l[i].before(k) })
+}
+
+func (l *orderList) insert(k orderKey) {
+	i := l.search(k)
+	*l = append(*l, orderKey{})
+	copy((*l)[i+1:], (*l)[i:])
+	(*l)[i] = k
+}
+
+func (l *orderList) remove(k orderKey) {
+	i := l.search(k)
+	if i < len(*l) && (*l)[i].id == k.id {
+		*l = append((*l)[:i], (*l)[i+1:]...)
+	}
+}
+
+// orderBucket sums the orders created in one hour.
+type orderBucket struct {
+	Orders       int
+	Quantity     int
+	RevenueCents int64
+	ByStatus     map[string]int
+}
+
+func (b *orderBucket) add(o Order, sign int) {
+	b.Orders += sign
+	b.Quantity += sign * o.Quantity
+	b.RevenueCents += int64(sign) * cents(o.Price) * int64(o.Quantity)
+	b.ByStatus[o.Status] += sign
+	if b.ByStatus[o.Status] == 0 {
+		delete(b.ByStatus, o.Status)
+	}
+}
+
+// orderIndex is one secondary index of the read model: the orders of each
+// value of a field.
+type orderIndex struct {
+	value func(Order) string
+	lists map[string]*orderList
+}
+
+func newOrderIndex(value func(Order) string) *orderIndex {
+	return &orderIndex{value: value, lists: make(map[string]*orderList)}
+}
+
+func (x *orderIndex) add(o Order) {
+	v := x.value(o)
+	if v == "" {
+		return
+	}
+	list := x.lists[v]
+	if list == nil {
+		list = &orderList{}
+		x.lists[v] = list
+	}
+	list.insert(orderKey{o.CreatedAt, o.ID})
+}
+
+func (x *orderIndex) remove(o Order) {
+	v := x.value(o)
+	if list := x.lists[v]; list != nil {
+		list.remove(orderKey{o.CreatedAt, o.ID})
+		if len(*list) == 0 {
+			delete(x.lists, v)
+		}
+	}
+}
+
+// orderReadModel is the query side of the orders: a denormalized copy of
+// the orders, indexed by status, product and customer and summed per hour,
+// that the list and report endpoints read instead of the orders map. It is
+// fed the events of the event log by a goroutine of its own, so reads never
+// take ordersMu and a slow report never holds up an order being written.
+// It trails the log by the events still queued. Archived orders leave the
+// copy and the indexes but stay in the hourly sums and the totals.
+type orderReadModel struct {
+	mu         sync.RWMutex
+	seq        uint64
+	orders     map[string]Order
+	all        orderList
+	byStatus   *orderIndex
+	byProduct  *orderIndex
+	byCustomer *orderIndex
+	buckets    map[int64]*orderBucket
+	revenue    float64
+	archived   int
+
+	queueMu sync.Mutex
+	queue   []OrderEvent
+	queued  uint64
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newOrderReadModel builds the read model of state, the orders after the
+// event with sequence seq, and starts applying the events published after
+// it.
+func newOrderReadModel(state map[string]Order, seq uint64) *orderReadModel {
+	m := &orderReadModel{
+		seq:        seq,
+		queued:     seq,
+		orders:     make(map[string]Order, len(state)),
+		byStatus:   newOrderIndex(func(o Order) string { return o.Status }),
+		byProduct:  newOrderIndex(func(o Order) string { return o.Product }),
+		byCustomer: newOrderIndex(func(o Order) string { return o.CustomerID }),
+		buckets:    make(map[int64]*orderBucket),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, order := range state {
+		m.add(order)
+	}
+	go m.run()
+	return m
+}
+
+// publish queues event for the read model. It never blocks on the read
+// model's readers.
+func (m *orderReadModel) publish(event OrderEvent) {
+	if event.Order != nil {
+		order := *event.Order
+		event.Order = &order
+	}
+	m.queueMu.Lock()
+	m.queue = append(m.queue, event)
+	m.queued = event.Seq
+	m.queueMu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *orderReadModel) run() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.wake:
+			m.drain()
+		case <-m.stop:
+			m.drain()
+			return
+		}
+	}
+}
+
+// drain applies the queued events.
+func (m *orderReadModel) drain() {
+	m.queueMu.Lock()
+	events := m.queue
+	m.queue = nil
+	m.queueMu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	for _, event := range events {
+		m.apply(event)
+	}
+	seq := m.seq
+	m.mu.Unlock()
+
+	readModelApplied.Add(float64(len(events)))
+	m.queueMu.Lock()
+	readModelLag.Set(float64(m.queued - seq))
+	m.queueMu.Unlock()
+}
+
+// Close applies the events still queued and stops the read model.
+func (m *orderReadModel) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+// apply updates the read model with event; the caller must hold mu.
+func (m *orderReadModel) apply(event OrderEvent) {
+	if event.Seq <= m.seq {
+		return
+	}
+	m.seq = event.Seq
+	switch event.Type {
+	case OrderCreated:
+		if event.Order != nil {
+			m.remove(event.OrderID)
+			m.add(*event.Order)
+		}
+	case StatusChanged:
+		if order, ok := m.orders[event.OrderID]; ok {
+			m.remove(order.ID)
+			order.Status = event.To
+			order.UpdatedAt = event.Timestamp
+			m.add(order)
+		}
+	case OrderDeleted:
+		m.remove(event.OrderID)
+	case OrderArchived:
+		if o, ok := m.orders[event.OrderID]; ok {
+			m.unindex(o)
+			m.archived++
+		}
+	case OrderRestored:
+		if _, ok := m.orders[event.OrderID]; !ok && event.Order != nil {
+			m.index(*event.Order)
+			m.archived--
+		}
+	}
+}
+
+// addArchived counts an order of the archive in the sums and totals.
+func (m *orderReadModel) addArchived(o Order) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sum(o, 1)
+	m.archived++
+}
+
+func (m *orderReadModel) add(o Order) {
+	m.index(o)
+	m.sum(o, 1)
+}
+
+func (m *orderReadModel) remove(id string) {
+	o, ok := m.orders[id]
+	if !ok {
+		return
+	}
+	m.unindex(o)
+	m.sum(o, -1)
+}
+
+func (m *orderReadModel) index(o Order) {
+	o.Links = nil
+	m.orders[o.ID] = o
+	m.all.insert(orderKey{o.CreatedAt, o.ID})
+	m.byStatus.add(o)
+	m.byProduct.add(o)
+	m.byCustomer.add(o)
+}
+
+func (m *orderReadModel) unindex(o Order) {
+	delete(m.orders, o.ID)
+	m.all.remove(orderKey{o.CreatedAt, o.ID})
+	m.byStatus.remove(o)
+	m.byProduct.remove(o)
+	m.byCustomer.remove(o)
+}
+
+// sum adds o to the revenue and its hour's bucket, or with sign -1 takes it
+// out.
+func (m *orderReadModel) sum(o Order, sign int) {
+	m.revenue += float64(sign) * o.Price * float64(o.Quantity)
+
+	hour := o.CreatedAt.Truncate(time.Hour).Unix()
+	bucket := m.buckets[hour]
+	if bucket == nil {
+		if sign < 0 {
+			return
+		}
+		bucket = &orderBucket{ByStatus: make(map[string]int)}
+		m.buckets[hour] = bucket
+	}
+	bucket.add(o, sign)
+	if bucket.Orders == 0 {
+		delete(m.buckets, hour)
+	}
+}
+
+// orderFilter is the query of GET /api/v1/orders.
+type orderFilter struct {
+	IDs        map[string]bool
+	Status     string
+	Product    string
+	CustomerID string
+}
+
+func parseOrderFilter(r *http.Request) (orderFilter, error) {
+	ids, err := response.ParseIDs(r)
+	if err != nil {
+		return orderFilter{}, err
+	}
+	q := r.URL.Query()
+	return orderFilter{
+		IDs:        ids,
+		Status:     q.Get("status"),
+		Product:    q.Get("product"),
+		CustomerID: q.Get("customer_id"),
+	}, nil
+}
+
+func (f orderFilter) matches(o Order) bool {
+	return (f.IDs == nil || f.IDs[o.ID]) &&
+		(f.Status == "" || o.Status == f.Status) &&
+		(f.Product == "" || o.Product == f.Product) &&
+		(f.CustomerID == "" || o.CustomerID == f.CustomerID)
+}
+
+// candidates returns the shortest list of orders that holds every order
+// matching f, and whether every order of it matches.
+func (m *orderReadModel) candidates(f orderFilter) (orderList, bool) {
+	if f.IDs != nil {
+		list := make(orderList, 0, len(f.IDs))
+		for id := range f.IDs {
+			if o, ok := m.orders[id]; ok {
+				list = append(list, orderKey{o.CreatedAt, o.ID})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].before(list[j]) })
+		return list, f.Status == "" && f.Product == "" && f.CustomerID == ""
+	}
+
+	list, filters := m.all, 0
+	for _, c := range []struct {
+		index *orderIndex
+		value string
+	}{{m.byStatus, f.Status}, {m.byProduct, f.Product}, {m.byCustomer, f.CustomerID}} {
+		if c.value == "" {
+			continue
+		}
+		filters++
+		indexed := c.index.lists[c.value]
+		if indexed == nil {
+			return nil, true
+		}
+		if filters == 1 || len(*indexed) < len(list) {
+			list = *indexed
+		}
+	}
+	return list, filters <= 1
+}
+
+// list returns the orders of page matching f and how many match in all.
+func (m *orderReadModel) list(f orderFilter, page response.Page) ([]Order, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list, exact := m.candidates(f)
+	if exact {
+		lo, hi := page.Bounds(len(list))
+		orders := make([]Order, 0, hi-lo)
+		for _, k := range list[lo:hi] {
+			orders = append(orders, m.orders[k.id])
+		}
+		return orders, len(list)
+	}
+
+	var matched []Order
+	for _, k := range list {
+		if o := m.orders[k.id]; f.matches(o) {
+			matched = append(matched, o)
+		}
+	}
+	lo, hi := page.Bounds(len(matched))
+	return matched[lo:hi], len(matched)
+}
+
+// totals returns the number of orders, archived ones included, and their
+// revenue, as an amount and in cents.
+func (m *orderReadModel) totals() (int, float64, int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var revenueCents int64
+	for _, bucket := range m.buckets {
+		revenueCents += bucket.RevenueCents
+	}
+	return len(m.orders) + m.archived, m.revenue, revenueCents
+}
+
+// OrderReportRow sums the orders created in one interval of a report.
+type OrderReportRow struct {
+	Start        time.Time      `json:"start"`
+	Orders       int            `json:"orders"`
+	Quantity     int            `json:"quantity"`
+	RevenueCents int64          `json:"revenue_cents"`
+	ByStatus     map[string]int `json:"by_status"`
+}
+
+// OrderReport is the body of GET /api/v1/reports/orders.
+type OrderReport struct {
+	Interval string           `json:"interval"`
+	From     time.Time        `json:"from"`
+	To       time.Time        `json:"to"`
+	Seq      uint64           `json:"seq"`
+	Rows     []OrderReportRow `json:"rows"`
+}
+
+// reportIntervals are the intervals an order report sums by.
+var reportIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// report sums the orders created in [from, to) per interval, oldest first.
+// Intervals without orders are left out.
+func (m *orderReadModel) report(interval string, from, to time.Time) OrderReport {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	size := reportIntervals[interval]
+	rows := make(map[int64]*OrderReportRow)
+	for hour, bucket := range m.buckets {
+		start := time.Unix(hour, 0).UTC()
+		if start.Before(from.Truncate(time.Hour)) || !start.Before(to) {
+			continue
+		}
+		key := start.Truncate(size).Unix()
+		row := rows[key]
+		if row == nil {
+			row = &OrderReportRow{Start: time.Unix(key, 0).UTC(), ByStatus: make(map[string]int)}
+			rows[key] = row
+		}
+		row.Orders += bucket.Orders
+		row.Quantity += bucket.Quantity
+		row.RevenueCents += bucket.RevenueCents
+		for status, n := range bucket.ByStatus {
+			row.ByStatus[status] += n
+		}
+	}
+
+	report := OrderReport{Interval: interval, From: from, To: to, Seq: m.seq, Rows: make([]OrderReportRow, 0, len(rows))}
+	for _, row := range rows {
+		report.Rows = append(report.Rows, *row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Start.Before(report.Rows[j].Start) })
+	return report
+}
+
+// getOrderReportHandler serves GET /api/v1/reports/orders?interval=&from=&to=,
+// the orders created per hour or day. The report covers the last day by
+// default; from and to are RFC 3339 times.
+func getOrderReportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	if _, ok := reportIntervals[interval]; !ok {
+		http.Error(w, fmt.Sprintf("invalid interval %q: must be hour or day", interval), http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to %q", v), http.StatusBadRequest)
+			return
+		}
+		to = t.UTC()
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from %q", v), http.StatusBadRequest)
+			return
+		}
+		from = t.UTC()
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	response.Write(w, r, http.StatusOK, orderEvents.readModel.report(interval, from, to), response.Links{
+		"orders": response.Link(r, apiPath(r, "/orders")),
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// StateSnapshot is a named copy of the orders, kept under snapshots.path so
+// a demo environment can be reset to it. Unlike the order snapshots of
+// events.go it is only written on request and never replaces the log.
+type StateSnapshot struct {
+	Name      string           `json:"name"`
+	CreatedAt time.Time        `json:"created_at"`
+	Orders    map[string]Order `json:"orders"`
+}
+
+// SnapshotInfo describes a stored snapshot.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Orders    int       `json:"orders"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// SnapshotRestore reports what a restore changed.
+type SnapshotRestore struct {
+	SnapshotInfo
+	OrdersCreated   int `json:"orders_created"`
+	OrdersUpdated   int `json:"orders_updated"`
+	OrdersDeleted   int `json:"orders_deleted"`
+	OrdersUnchanged int `json:"orders_unchanged"`
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(viper.GetString("snapshots.path"), name+".json")
+}
+
+func (s StateSnapshot) info(bytes int64) SnapshotInfo {
+	return SnapshotInfo{Name: s.Name, CreatedAt: s.CreatedAt, Orders: len(s.Orders), Bytes: bytes}
+}
+
+func readStateSnapshot(name string) (StateSnapshot, int64, error) {
+	var snapshot StateSnapshot
+	data, err := os.ReadFile(snapshotPath(name))
+	if err != nil {
+		return snapshot, 0, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, 0, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	return snapshot, int64(len(data)), nil
+}
+
+// sameOrder reports whether a and b serialize alike; times read back from
+// JSON lose their monotonic reading, so they are not compared with ==.
+func sameOrder(a, b Order) bool {
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(x) == string(y)
+}
+
+// restoreOrders appends the events that turn orders into snapshot.Orders:
+// a StatusChanged event for orders that differ only in status, else an
+// OrderDeleted and an OrderCreated event. The log stays the system of
+// record, so the read model and event consumers see the reset like any
+// other change. Archived orders the reset changes are restored first;
+// those it leaves as they are stay archived.
+func restoreOrders(snapshot StateSnapshot, actor string) (SnapshotRestore, error) {
+	result := SnapshotRestore{SnapshotInfo: snapshot.info(0)}
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+
+	var changed []string
+	archivedUnchanged := make(map[string]bool)
+	err := orderEvents.archive.each(func(o Order) {
+		if want, ok := snapshot.Orders[o.ID]; ok && sameOrder(o, want) {
+			archivedUnchanged[o.ID] = true
+		} else {
+			changed = append(changed, o.ID)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+	sort.Strings(changed)
+	for _, id := range changed {
+		if _, err := restoreOrder(id, actor); err != nil {
+			return result, err
+		}
+	}
+
+	var events []OrderEvent
+	now := time.Now()
+	ids := make([]string, 0, len(orders))
+	for id := range orders {
+		if _, ok := snapshot.Orders[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		events = append(events, OrderEvent{Type: OrderDeleted, OrderID: id, Timestamp: now, Actor: actor})
+		result.OrdersDeleted++
+	}
+
+	ids = ids[:0]
+	for id := range snapshot.Orders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		want := snapshot.Orders[id]
+		have, exists := orders[id]
+		switch {
+		case archivedUnchanged[id], exists && sameOrder(have, want):
+			result.OrdersUnchanged++
+			continue
+		case exists:
+			result.OrdersUpdated++
+			statusOnly := have
+			statusOnly.Status, statusOnly.UpdatedAt = want.Status, want.UpdatedAt
+			if sameOrder(statusOnly, want) {
+				events = append(events, OrderEvent{Type: StatusChanged, OrderID: id, Timestamp: want.UpdatedAt, Actor: actor, From: have.Status, To: want.Status})
+				continue
+			}
+			events = append(events, OrderEvent{Type: OrderDeleted, OrderID: id, Timestamp: now, Actor: actor})
+		default:
+			result.OrdersCreated++
+		}
+		order := want
+		events = append(events, OrderEvent{Type: OrderCreated, OrderID: id, Timestamp: order.CreatedAt, Actor: actor, Order: &order})
+	}
+
+	for _, event := range events {
+		if _, err := orderEvents.append(event); err != nil {
+			return result, err
+		}
+	}
+
+	revenue := 0.0
+	for _, order := range orders {
+		revenue += order.Price * float64(order.Quantity)
+	}
+	err = orderEvents.archive.each(func(order Order) {
+		revenue += order.Price * float64(order.Quantity)
+	})
+	activeOrders.Set(float64(len(orders) + orderEvents.archive.len()))
+	totalRevenue.Set(revenue)
+	return result, err
+}
+
+// listSnapshotsHandler serves GET /api/v1/snapshots, the stored snapshots
+// by name.
+func listSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(viper.GetString("snapshots.path"))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Error("Failed to list snapshots")
+		http.Error(w, "Failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+	list := []SnapshotInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !snapshotNamePattern.MatchString(name) {
+			continue
+		}
+		snapshot, bytes, err := readStateSnapshot(name)
+		if err != nil {
+			logrus.WithError(err).WithField("snapshot", name).Warn("Skipping unreadable snapshot")
+			continue
+		}
+		list = append(list, snapshot.info(bytes))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// createSnapshotHandler serves PUT /api/v1/snapshots/{name}, saving the
+// current orders, archived ones included, under name, replacing an older
+// snapshot of that name.
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "name must be 1-64 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	snapshot := StateSnapshot{Name: name, CreatedAt: time.Now().UTC()}
+	ordersMu.RLock()
+	snapshot.Orders = make(map[string]Order, len(orders))
+	for id, order := range orders {
+		snapshot.Orders[id] = order
+	}
+	err := orderEvents.archive.each(func(order Order) {
+		snapshot.Orders[order.ID] = order
+	})
+	ordersMu.RUnlock()
+
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(snapshot)
+	}
+	if err == nil {
+		err = os.MkdirAll(viper.GetString("snapshots.path"), 0700)
+	}
+	status := http.StatusCreated
+	if _, statErr := os.Stat(snapshotPath(name)); statErr == nil {
+		status = http.StatusOK
+	}
+	if err == nil {
+		// Written beside the old snapshot and renamed over it, so a failed
+		// write never leaves a partial one.
+		tmp := snapshotPath(name) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, snapshotPath(name))
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to write snapshot")
+		http.Error(w, "Failed to write snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	info := snapshot.info(int64(len(data)))
+	logrus.WithFields(logrus.Fields{"snapshot": name, "orders": info.Orders}).Info("State snapshot written")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(info)
+}
+
+// restoreSnapshotHandler serves POST /api/v1/snapshots/{name}/restore.
+func restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	snapshot, bytes, err := readStateSnapshot(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to read snapshot")
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := restoreOrders(snapshot, auditActors.Actor(r))
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to restore snapshot")
+		http.Error(w, "Failed to restore snapshot", http.StatusInternalServerError)
+		return
+	}
+	result.Bytes = bytes
+	logrus.WithFields(logrus.Fields{
+		"snapshot":  name,
+		"created":   result.OrdersCreated,
+		"updated":   result.OrdersUpdated,
+		"deleted":   result.OrdersDeleted,
+		"unchanged": result.OrdersUnchanged,
+	}).Info("State snapshot restored")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// deleteSnapshotHandler serves DELETE /api/v1/snapshots/{name}.
+func deleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	err := os.Remove(snapshotPath(name))
+	if os.IsNotExist(err) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to delete snapshot")
+		http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/apiversion"
+	"pipeline/pkg/codec"
+	"pipeline/pkg/response"
+)
+
+// newAPIVersions returns the versions of the order API: v1, deprecated once
+// api.v1.deprecated_at is set, and v2, which carries money as integer cents.
+func newAPIVersions(router *mux.Router) (v1, v2 *apiversion.Version, err error) {
+	v1 = &apiversion.Version{
+		Name:      "v1",
+		Prefix:    "/api/v1",
+		DocsURL:   viper.GetString("api.v1.docs_url"),
+		Successor: successorIn(router, "/api/v1", "/api/v2"),
+		RouteFunc: routeTemplate,
+	}
+	if v1.Deprecated, err = configTime("api.v1.deprecated_at"); err != nil {
+		return nil, nil, err
+	}
+	if v1.Sunset, err = configTime("api.v1.sunset"); err != nil {
+		return nil, nil, err
+	}
+	v2 = &apiversion.Version{Name: "v2", Prefix: "/api/v2", RouteFunc: routeTemplate}
+	return v1, v2, nil
+}
+
+// apiVersions are the API versions the service serves, reported on / so
+// callers such as the gateway can check they are compatible with it.
+var apiVersions = []string{"v1", "v2"}
+
+// capabilities lists the features the service offers with its current
+// config, reported on / next to apiVersions.
+func capabilities() []string {
+	caps := []string{"orders", "order_events", "snapshots", "simulation"}
+	if viper.GetBool("audit.enabled") {
+		caps = append(caps, "audit")
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// configTime reads an optional RFC 3339 time from the config.
+func configTime(key string) (time.Time, error) {
+	v := viper.GetString(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// successorIn returns an apiversion Successor func: the path of a request
+// under to instead of from, if router serves it.
+func successorIn(router *mux.Router, from, to string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		rest, ok := strings.CutPrefix(r.URL.Path, from)
+		if !ok {
+			return ""
+		}
+		successor := *r
+		u := *r.URL
+		u.Path, u.RawPath = to+rest, ""
+		successor.URL = &u
+		if !router.Match(&successor, &mux.RouteMatch{}) {
+			return ""
+		}
+		return response.Link(r, u.Path)
+	}
+}
+
+// apiPath returns path, e.g. "/orders", under the API version r was served
+// by.
+func apiPath(r *http.Request, path string) string {
+	version := apiversion.FromRequest(r)
+	if version == "" {
+		version = "v1"
+	}
+	return "/api/" + version + path
+}
+
+func isV2(r *http.Request) bool {
+	return apiversion.FromRequest(r) == "v2"
+}
+
+// cents converts an amount of money to integer cents.
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// OrderV2 is an order in API v2: prices are integer cents, so amounts are
+// exact, and the order total is included.
+type OrderV2 struct {
+	ID         string            `json:"id"`
+	Product    string            `json:"product"`
+	Quantity   int               `json:"quantity"`
+	PriceCents int64             `json:"price_cents"`
+	TotalCents int64             `json:"total_cents"`
+	Status     string            `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	CustomerID string            `json:"customer_id,omitempty"`
+	Links      map[string]string `json:"links,omitempty"`
+}
+
+// NewOrderV2 is the body of POST /api/v2/orders.
+type NewOrderV2 struct {
+	Product    string `json:"product"`
+	Quantity   int    `json:"quantity"`
+	PriceCents int64  `json:"price_cents"`
+	CustomerID string `json:"customer_id"`
+}
+
+func orderV2(o Order) OrderV2 {
+	price := cents(o.Price)
+	return OrderV2{
+		ID:         o.ID,
+		Product:    o.Product,
+		Quantity:   o.Quantity,
+		PriceCents: price,
+		TotalCents: price * int64(o.Quantity),
+		Status:     o.Status,
+		CreatedAt:  o.CreatedAt,
+		UpdatedAt:  o.UpdatedAt,
+		CustomerID: o.CustomerID,
+		Links:      o.Links,
+	}
+}
+
+// presentOrder returns o as the API version of r represents it.
+func presentOrder(r *http.Request, o Order) interface{} {
+	if isV2(r) {
+		return orderV2(o)
+	}
+	return o
+}
+
+// presentOrders is presentOrder for a page of orders.
+func presentOrders(r *http.Request, orders []Order) interface{} {
+	if !isV2(r) {
+		return orders
+	}
+	list := make([]OrderV2, len(orders))
+	for i, o := range orders {
+		list[i] = orderV2(o)
+	}
+	return list
+}
+
+// MarshalProto encodes o as the Order message of proto/business_v2.proto.
+func (o OrderV2) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendString(b, 1, o.ID)
+	b = codec.AppendString(b, 2, o.Product)
+	b = codec.AppendInt64(b, 3, int64(o.Quantity))
+	b = codec.AppendInt64(b, 4, o.PriceCents)
+	b = codec.AppendInt64(b, 5, o.TotalCents)
+	b = codec.AppendString(b, 6, o.Status)
+	b = codec.AppendTimestamp(b, 7, o.CreatedAt)
+	b = codec.AppendTimestamp(b, 8, o.UpdatedAt)
+	b = codec.AppendStringMap(b, 9, o.Links)
+	b = codec.AppendString(b, 10, o.CustomerID)
+	return b
+}
+
+// BusinessMetricsV2 is BusinessMetrics in API v2, with revenue in cents.
+type BusinessMetricsV2 struct {
+	TotalOrders       int     `json:"total_orders"`
+	TotalRevenueCents int64   `json:"total_revenue_cents"`
+	OrdersPerMinute   float64 `json:"orders_per_minute"`
+	AverageOrderSize  float64 `json:"average_order_size"`
+}
+
+// MarshalProto encodes m as the BusinessMetrics message of
+// proto/business_v2.proto.
+func (m BusinessMetricsV2) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendInt64(b, 1, int64(m.TotalOrders))
+	b = codec.AppendInt64(b, 2, m.TotalRevenueCents)
+	b = codec.AppendDouble(b, 3, m.OrdersPerMinute)
+	b = codec.AppendDouble(b, 4, m.AverageOrderSize)
+	return b
+}
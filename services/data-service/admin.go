@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/audit"
+)
+
+var processingPausedGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "data_processing_paused",
+		Help: "Whether background record processing is paused (1) or running (0)",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(processingPausedGauge)
+}
+
+// ProcessingState is the response of the /admin/processing endpoints.
+type ProcessingState struct {
+	Paused bool       `json:"paused"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+// processingPause stops the background processing loops from picking up
+// batches; processing jobs still run.
+var processingPause struct {
+	sync.Mutex
+	paused bool
+	since  time.Time
+}
+
+func processingPaused() bool {
+	processingPause.Lock()
+	defer processingPause.Unlock()
+	return processingPause.paused
+}
+
+func currentProcessingState() ProcessingState {
+	processingPause.Lock()
+	defer processingPause.Unlock()
+	state := ProcessingState{Paused: processingPause.paused}
+	if state.Paused {
+		since := processingPause.since
+		state.Since = &since
+	}
+	return state
+}
+
+func setProcessingPaused(paused bool) ProcessingState {
+	processingPause.Lock()
+	if processingPause.paused != paused {
+		processingPause.paused, processingPause.since = paused, time.Now().UTC()
+		if paused {
+			processingPausedGauge.Set(1)
+			logrus.Warn("Record processing paused")
+		} else {
+			processingPausedGauge.Set(0)
+			logrus.Info("Record processing resumed")
+		}
+	}
+	processingPause.Unlock()
+	return currentProcessingState()
+}
+
+func processingStateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentProcessingState())
+}
+
+func pauseProcessingHandler(w http.ResponseWriter, r *http.Request) {
+	audit.SetBefore(r.Context(), currentProcessingState())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setProcessingPaused(true))
+}
+
+func resumeProcessingHandler(w http.ResponseWriter, r *http.Request) {
+	audit.SetBefore(r.Context(), currentProcessingState())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setProcessingPaused(false))
+}
+
+// applyLogLevel sets the configured log_level; an invalid one is logged and
+// leaves the level at info.
+func applyLogLevel() {
+	level, err := logrus.ParseLevel(viper.GetString("log_level"))
+	if err != nil {
+		logrus.WithError(err).Warn("Invalid log_level, using info")
+		return
+	}
+	logrus.SetLevel(level)
+}
+
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logrus.GetLevel().String()})
+}
+
+// setLogLevelHandler changes the log level until the next restart.
+func setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	level, err := logrus.ParseLevel(body.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit.SetBefore(r.Context(), map[string]string{"level": logrus.GetLevel().String()})
+	logrus.SetLevel(level)
+	logrus.WithField("level", level.String()).Warn("Log level changed")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": level.String()})
+}
+
+// Backup is a copy of the database written by POST /admin/backup.
+type Backup struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeBackup copies the database, consistently and without blocking
+// writers, to backup.path and keeps the newest backup.keep copies.
+func writeBackup() (Backup, error) {
+	dir := viper.GetString("backup.path")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Backup{}, err
+	}
+	now := time.Now().UTC()
+	backup := Backup{Path: filepath.Join(dir, "data-"+now.Format("20060102T150405Z")+".db"), CreatedAt: now}
+	tmp := backup.Path + ".tmp"
+	err := db.View(func(tx *bolt.Tx) error {
+		backup.Size = tx.Size()
+		return tx.CopyFile(tmp, 0600)
+	})
+	if err == nil {
+		err = os.Rename(tmp, backup.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return Backup{}, err
+	}
+	pruneBackups(dir, viper.GetInt("backup.keep"))
+	return backup, nil
+}
+
+// pruneBackups removes all but the newest keep backups; keep <= 0 keeps all.
+func pruneBackups(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "data-*.db"))
+	// The timestamped names sort oldest first.
+	sort.Strings(names)
+	for _, name := range names[:max(len(names)-keep, 0)] {
+		if err := os.Remove(name); err != nil {
+			logrus.WithError(err).WithField("path", name).Warn("Failed to remove old backup")
+		}
+	}
+}
+
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	backup, err := writeBackup()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to write backup")
+		http.Error(w, "Failed to write backup", http.StatusInternalServerError)
+		return
+	}
+	logrus.WithFields(logrus.Fields{"path": backup.Path, "size_bytes": backup.Size}).Info("Database backup written")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backup)
+}
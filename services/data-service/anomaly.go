@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/anomaly"
+)
+
+// startAnomalyDetection watches the pending record count for unusual spikes
+// when anomaly.enabled is set. The returned func stops it.
+func startAnomalyDetection() context.CancelFunc {
+	if !viper.GetBool("anomaly.enabled") {
+		return func() {}
+	}
+	return anomaly.Start(viper.GetViper(), "data-service", "pending_records", anomaly.Up, func() (float64, error) {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		pending := 0
+		for _, c := range typeStats {
+			pending += c.Pending
+		}
+		return float64(pending), nil
+	})
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ArchiveEntry is the manifest entry kept for every archived record so it can
+// still be located after it has been removed from Bolt.
+type ArchiveEntry struct {
+	RecordID   string    `json:"record_id"`
+	Type       string    `json:"type"`
+	Object     string    `json:"object"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+type ArchiveRun struct {
+	Object   string    `json:"object,omitempty"`
+	Archived int       `json:"archived"`
+	Cutoff   time.Time `json:"cutoff"`
+	RanAt    time.Time `json:"ran_at"`
+}
+
+// archiveStore persists archive objects. Only the local filesystem backend is
+// built in; object storage backends plug in behind the same interface.
+type archiveStore interface {
+	// Put writes a new object and returns its name for the manifest. It
+	// fails rather than overwrite an existing object.
+	Put(name string, data []byte) (string, error)
+	Get(object string) ([]byte, error)
+	// Replace overwrites an existing object, for subject deletion.
+	Replace(object string, data []byte) error
+	Delete(object string) error
+}
+
+type localArchiveStore struct {
+	dir string
+}
+
+func (s localArchiveStore) Put(name string, data []byte) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+	// Never replace an object: its records are already gone from Bolt.
+	path := filepath.Join(s.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return "file://" + path, nil
+}
+
+func (s localArchiveStore) Get(object string) ([]byte, error) {
+	return os.ReadFile(strings.TrimPrefix(object, "file://"))
+}
+
+func (s localArchiveStore) Replace(object string, data []byte) error {
+	path := strings.TrimPrefix(object, "file://")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s localArchiveStore) Delete(object string) error {
+	err := os.Remove(strings.TrimPrefix(object, "file://"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+var archiveMu sync.Mutex
+
+// checkArchiveBackend rejects archive.backend values other than the local
+// filesystem, so records are never archived somewhere other than configured.
+func checkArchiveBackend() error {
+	if backend := viper.GetString("archive.backend"); backend != "local" {
+		return fmt.Errorf("archive.backend %q is not supported, use local", backend)
+	}
+	return nil
+}
+
+func newArchiveStore() archiveStore {
+	return localArchiveStore{dir: viper.GetString("archive.path")}
+}
+
+// encodeArchive returns records as gzip-compressed NDJSON.
+func encodeArchive(records []DataRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeArchive(data []byte) ([]DataRecord, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var records []DataRecord
+	dec := json.NewDecoder(gz)
+	for {
+		var record DataRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+func archiveContinuously() {
+	interval, err := time.ParseDuration(viper.GetString("archive.interval"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		if _, err := archiveOldRecords(); err != nil {
+			logrus.WithError(err).Error("Archive run failed")
+		}
+	}
+}
+
+// archiveCutoff is the processing time before which records are archived.
+func archiveCutoff() time.Time {
+	return time.Now().AddDate(0, 0, -viper.GetInt("archive.after_days"))
+}
+
+// archiveOldRecords exports processed records older than archive.after_days
+// as a gzip-compressed NDJSON object, records them in the manifest and
+// deletes them from the records bucket.
+func archiveOldRecords() (ArchiveRun, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	cutoff := archiveCutoff()
+	records, _, err := archiveCandidates(cutoff)
+	if err != nil {
+		return ArchiveRun{Cutoff: cutoff, RanAt: time.Now()}, err
+	}
+	return archiveRecords(cutoff, records)
+}
+
+// archiveCandidates returns the processed records processed before cutoff
+// and the plan of their deletion.
+func archiveCandidates(cutoff time.Time) ([]DataRecord, DeletionPlan, error) {
+	plan := newDeletionPlan("archive", map[string]string{"cutoff": cutoff.Format(time.RFC3339Nano)})
+	var records []DataRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
+			}
+			if record.Processed && record.ProcessedAt != nil && record.ProcessedAt.Before(cutoff) {
+				records = append(records, record)
+				plan.add(record, v)
+			}
+			return nil
+		})
+	})
+	return records, plan, err
+}
+
+// archiveRecords archives records, the candidates for cutoff. The caller
+// holds archiveMu.
+func archiveRecords(cutoff time.Time, records []DataRecord) (ArchiveRun, error) {
+	run := ArchiveRun{Cutoff: cutoff, RanAt: time.Now()}
+	if len(records) == 0 {
+		return run, nil
+	}
+
+	data, err := encodeArchive(records)
+	if err != nil {
+		return run, err
+	}
+
+	name := fmt.Sprintf("records-%s.ndjson.gz", run.RanAt.UTC().Format("20060102T150405.000000000Z"))
+	object, err := newArchiveStore().Put(name, data)
+	if err != nil {
+		return run, fmt.Errorf("write archive object: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		manifest := tx.Bucket([]byte("archive_manifest"))
+		for _, record := range records {
+			entry, err := json.Marshal(ArchiveEntry{
+				RecordID:   record.ID,
+				Type:       record.Type,
+				Object:     object,
+				ArchivedAt: run.RanAt,
+			})
+			if err != nil {
+				return err
+			}
+			if err := manifest.Put([]byte(record.ID), entry); err != nil {
+				return err
+			}
+			if err := deleteRecord(tx, []byte(record.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return run, err
+	}
+
+	run.Object = object
+	run.Archived = len(records)
+
+	logrus.WithFields(logrus.Fields{
+		"object":   object,
+		"archived": run.Archived,
+		"cutoff":   run.Cutoff.Format(time.RFC3339),
+	}).Info("Old records archived")
+
+	return run, nil
+}
+
+// archivedSubject is an archive object holding records of a subject being
+// deleted, split into the records to keep and those to erase.
+type archivedSubject struct {
+	object string
+	kept   []DataRecord
+	erased []DataRecord
+}
+
+// findArchivedSubject reads the archive objects listed in the manifest and
+// returns those holding records that reference subjectID. The caller holds
+// archiveMu.
+func findArchivedSubject(tx *bolt.Tx, subjectID string) ([]archivedSubject, error) {
+	objects := make(map[string]bool)
+	err := tx.Bucket([]byte("archive_manifest")).ForEach(func(k, v []byte) error {
+		var entry ArchiveEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("decode manifest entry %s: %w", k, err)
+		}
+		objects[entry.Object] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(objects))
+	for object := range objects {
+		names = append(names, object)
+	}
+	sort.Strings(names)
+
+	store := newArchiveStore()
+	var matches []archivedSubject
+	for _, object := range names {
+		data, err := store.Get(object)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive object %s: %w", object, err)
+		}
+		records, err := decodeArchive(data)
+		if err != nil {
+			return nil, fmt.Errorf("decode archive object %s: %w", object, err)
+		}
+		match := archivedSubject{object: object}
+		for _, record := range records {
+			if referencesSubject(record, subjectID) {
+				match.erased = append(match.erased, record)
+			} else {
+				match.kept = append(match.kept, record)
+			}
+		}
+		if len(match.erased) > 0 {
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
+}
+
+// eraseArchived rewrites each object without its erased records, removing it
+// when none are left, and drops their manifest entries. The caller holds
+// archiveMu.
+func eraseArchived(tx *bolt.Tx, matches []archivedSubject) error {
+	store := newArchiveStore()
+	manifest := tx.Bucket([]byte("archive_manifest"))
+	for _, match := range matches {
+		for _, record := range match.erased {
+			if err := manifest.Delete([]byte(record.ID)); err != nil {
+				return err
+			}
+		}
+		if len(match.kept) == 0 {
+			if err := store.Delete(match.object); err != nil {
+				return fmt.Errorf("delete archive object %s: %w", match.object, err)
+			}
+			continue
+		}
+		data, err := encodeArchive(match.kept)
+		if err != nil {
+			return err
+		}
+		if err := store.Replace(match.object, data); err != nil {
+			return fmt.Errorf("rewrite archive object %s: %w", match.object, err)
+		}
+	}
+	return nil
+}
+
+// lookupArchiveEntry returns the manifest entry for a record that is no
+// longer in the records bucket.
+func lookupArchiveEntry(recordID string) (*ArchiveEntry, error) {
+	var entry *ArchiveEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("archive_manifest")).Get([]byte(recordID))
+		if data == nil {
+			return nil
+		}
+		entry = &ArchiveEntry{}
+		return json.Unmarshal(data, entry)
+	})
+	return entry, err
+}
+
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	// A confirmed run archives up to the cutoff the token was issued for.
+	cutoff, confirmed := archiveCutoff(), false
+	if token := r.URL.Query().Get("confirm"); token != "" && !dryRun {
+		scope, err := redeemConfirmation(token, "archive")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		cutoff, _ = time.Parse(time.RFC3339Nano, scope)
+		confirmed = true
+	}
+
+	records, plan, err := archiveCandidates(cutoff)
+	if err == nil && (dryRun || (!confirmed && plan.needsConfirmation())) {
+		plan.DryRun = dryRun
+		if plan.needsConfirmation() {
+			plan.confirm(plan.Scope["cutoff"])
+		}
+		writeDeletionPlan(w, plan)
+		return
+	}
+	var run ArchiveRun
+	if err == nil {
+		run, err = archiveRecords(cutoff, records)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Archive run failed")
+		http.Error(w, "Failed to archive records", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
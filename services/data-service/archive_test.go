@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckArchiveBackend(t *testing.T) {
+	defer viper.Set("archive.backend", viper.GetString("archive.backend"))
+	for backend, ok := range map[string]bool{"local": true, "s3": false, "gcs": false, "parquet": false} {
+		viper.Set("archive.backend", backend)
+		if err := checkArchiveBackend(); (err == nil) != ok {
+			t.Errorf("checkArchiveBackend(%s) = %v", backend, err)
+		}
+	}
+}
+
+func TestSubjectDeletionErasesArchivedRecords(t *testing.T) {
+	openTestDB(t)
+	loadPrivacyConfig()
+	defer viper.Set("archive.path", viper.GetString("archive.path"))
+	viper.Set("archive.path", t.TempDir())
+
+	processed := time.Now().Add(-30 * 24 * time.Hour)
+	archive := func(records ...DataRecord) string {
+		t.Helper()
+		for i := range records {
+			records[i].Type, records[i].Timestamp, records[i].Processed, records[i].ProcessedAt = "event", processed, true, &processed
+		}
+		storeTestRecords(t, records...)
+		run, err := archiveRecords(time.Now(), records)
+		if err != nil || run.Archived != len(records) {
+			t.Fatalf("archive run %+v, %v", run, err)
+		}
+		return run.Object
+	}
+	mixed := archive(
+		DataRecord{ID: "r1", Data: map[string]string{"user_id": "u-42"}},
+		DataRecord{ID: "r2", Data: map[string]string{"user_id": "u-7"}},
+	)
+	only := archive(DataRecord{ID: "r3", Data: map[string]string{"session_id": "u-42"}})
+
+	w := httptest.NewRecorder()
+	deleteSubjectRecordsHandler(w, httptest.NewRequest("DELETE", "/api/v1/records?subject_id=u-42&dry_run=true", nil))
+	var plan DeletionPlan
+	if err := json.NewDecoder(w.Body).Decode(&plan); err != nil || plan.Records != 2 {
+		t.Fatalf("dry run plan = %+v, %v; want 2 records", plan, err)
+	}
+
+	w = httptest.NewRecorder()
+	deleteSubjectRecordsHandler(w, httptest.NewRequest("DELETE", "/api/v1/records?subject_id=u-42", nil))
+	var report DeletionReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", w.Code, err)
+	}
+	if report.DeletedCount != 2 || report.ArchivedCount != 2 {
+		t.Errorf("report = %+v, want 2 archived records deleted", report)
+	}
+
+	store := newArchiveStore()
+	data, err := store.Get(mixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := decodeArchive(data)
+	if err != nil || len(records) != 1 || records[0].ID != "r2" {
+		t.Errorf("archive object after deletion = %+v, %v; want only r2", records, err)
+	}
+	if _, err := store.Get(only); !os.IsNotExist(err) {
+		t.Errorf("object holding only the subject's records still exists: %v", err)
+	}
+	for id, want := range map[string]bool{"r1": false, "r2": true, "r3": false} {
+		if entry, err := lookupArchiveEntry(id); err != nil || (entry != nil) != want {
+			t.Errorf("manifest entry of %s = %+v, %v; want present %v", id, entry, err, want)
+		}
+	}
+}
+
+func TestArchiveRunsNeverShareAnObject(t *testing.T) {
+	openTestDB(t)
+	defer viper.Set("archive.path", viper.GetString("archive.path"))
+	viper.Set("archive.path", t.TempDir())
+
+	processed := time.Now().Add(-30 * 24 * time.Hour)
+	objects := make(map[string]bool)
+	for _, id := range []string{"r1", "r2", "r3"} {
+		record := DataRecord{ID: id, Type: "event", Timestamp: processed, Processed: true, ProcessedAt: &processed}
+		storeTestRecords(t, record)
+		run, err := archiveRecords(time.Now(), []DataRecord{record})
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[run.Object] = true
+	}
+	if len(objects) != 3 {
+		t.Fatalf("three runs wrote %d objects", len(objects))
+	}
+	for object := range objects {
+		data, err := newArchiveStore().Get(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records, err := decodeArchive(data); err != nil || len(records) != 1 {
+			t.Errorf("%s holds %d records, %v", object, len(records), err)
+		}
+	}
+
+	store := localArchiveStore{dir: viper.GetString("archive.path")}
+	if _, err := store.Put("taken.ndjson.gz", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("taken.ndjson.gz", []byte("second")); !os.IsExist(err) {
+		t.Errorf("second Put of the same name: %v", err)
+	}
+}
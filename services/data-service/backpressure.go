@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// BackpressureHeader carries the backpressure state on every response, e.g.
+// "overloaded; load=1.25", so callers learn of it without polling.
+const BackpressureHeader = "X-Backpressure"
+
+// Backpressure states, by rising backlog.
+const (
+	backpressureOK         = "ok"
+	backpressureElevated   = "elevated"
+	backpressureOverloaded = "overloaded"
+)
+
+var backpressureLoad = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "data_backpressure_load",
+		Help: "Pending records as a share of backpressure.capacity",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(backpressureLoad)
+}
+
+// Backpressure is the response of GET /api/v1/backpressure.
+type Backpressure struct {
+	State     string    `json:"state"`
+	Depth     int       `json:"depth"`
+	Capacity  int       `json:"capacity"`
+	Load      float64   `json:"load"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// currentBackpressure compares the pending records, from the incremental
+// type counters, with backpressure.capacity. With no capacity the state is
+// always ok.
+func currentBackpressure() Backpressure {
+	statsMu.Lock()
+	depth := 0
+	for _, c := range typeStats {
+		depth += c.Pending
+	}
+	statsMu.Unlock()
+
+	bp := Backpressure{State: backpressureOK, Depth: depth, Capacity: viper.GetInt("backpressure.capacity"), Timestamp: time.Now().UTC()}
+	if bp.Capacity <= 0 {
+		return bp
+	}
+	bp.Load = float64(depth) / float64(bp.Capacity)
+	switch {
+	case bp.Load >= viper.GetFloat64("backpressure.overloaded_at"):
+		bp.State = backpressureOverloaded
+	case bp.Load >= viper.GetFloat64("backpressure.elevated_at"):
+		bp.State = backpressureElevated
+	}
+	backpressureLoad.Set(bp.Load)
+	return bp
+}
+
+// backpressureMiddleware sets BackpressureHeader on every response.
+func backpressureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bp := currentBackpressure()
+		w.Header().Set(BackpressureHeader, fmt.Sprintf("%s; load=%.2f", bp.State, bp.Load))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func backpressureHandler(w http.ResponseWriter, r *http.Request) {
+	response.Write(w, r, http.StatusOK, currentBackpressure(), nil)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+var (
+	bulkDeletedRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_bulk_deleted_records_total",
+			Help: "Records deleted by bulk deletion jobs, by type",
+		},
+		[]string{"type"},
+	)
+	bulkDeleteBatchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "data_bulk_delete_batch_duration_seconds",
+			Help:    "Duration of the write transactions of bulk deletion jobs",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bulkDeletedRecords, bulkDeleteBatchDuration)
+}
+
+// DeletionFilter selects the records of a bulk deletion job. Before is
+// exclusive.
+type DeletionFilter struct {
+	Type      string     `json:"type,omitempty"`
+	Before    *time.Time `json:"before,omitempty"`
+	Processed *bool      `json:"processed,omitempty"`
+}
+
+func parseDeletionFilter(r *http.Request) (DeletionFilter, error) {
+	q := r.URL.Query()
+	filter := DeletionFilter{Type: q.Get("type")}
+	if v := q.Get("before"); v != "" {
+		before, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid before %q", v)
+		}
+		filter.Before = &before
+	}
+	if v := q.Get("processed"); v != "" {
+		processed, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid processed %q", v)
+		}
+		filter.Processed = &processed
+	}
+	if filter.Type == "" && filter.Before == nil && filter.Processed == nil {
+		return filter, errors.New("subject_id, or at least one of type, before and processed, is required")
+	}
+	return filter, nil
+}
+
+func (f DeletionFilter) matches(record DataRecord) bool {
+	if f.Type != "" && record.Type != f.Type {
+		return false
+	}
+	if f.Before != nil && !record.Timestamp.Before(*f.Before) {
+		return false
+	}
+	return f.Processed == nil || record.Processed == *f.Processed
+}
+
+// scope is the filter as the Scope of a DeletionPlan.
+func (f DeletionFilter) scope() map[string]string {
+	scope := map[string]string{}
+	if f.Type != "" {
+		scope["type"] = f.Type
+	}
+	if f.Before != nil {
+		scope["before"] = f.Before.Format(time.RFC3339Nano)
+	}
+	if f.Processed != nil {
+		scope["processed"] = strconv.FormatBool(*f.Processed)
+	}
+	return scope
+}
+
+// deleteRecordsHandler serves DELETE /api/v1/records: the erasure of a data
+// subject with subject_id, else a bulk deletion job.
+func deleteRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("subject_id") {
+		deleteSubjectRecordsHandler(w, r)
+		return
+	}
+	bulkDeleteRecordsHandler(w, r)
+}
+
+// bulkDeleteRecordsHandler serves DELETE /api/v1/records?type=&before=&processed=.
+// It plans the deletion like the other destructive admin endpoints, then
+// leaves it to a job that deletes admin.delete_batch_size records per
+// transaction and can be followed and cancelled under /jobs/{id}.
+func bulkDeleteRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseDeletionFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plan := newDeletionPlan("bulk_deletion", filter.scope())
+	plan.DryRun = dryRun
+	scope, _ := json.Marshal(plan.Scope)
+	confirmed := false
+	if token := r.URL.Query().Get("confirm"); token != "" && !dryRun {
+		tokenScope, err := redeemConfirmation(token, plan.Operation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if tokenScope != string(scope) {
+			http.Error(w, "Confirmation token was issued for another filter", http.StatusConflict)
+			return
+		}
+		confirmed = true
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil && filter.matches(record) {
+				plan.add(record, v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to plan deletion", http.StatusInternalServerError)
+		return
+	}
+	if dryRun || (!confirmed && plan.needsConfirmation()) {
+		if plan.needsConfirmation() {
+			plan.confirm(string(scope))
+		}
+		writeDeletionPlan(w, plan)
+		return
+	}
+
+	job, err := enqueueJob(ProcessingJob{
+		ID:        uuid.New().String(),
+		Status:    "pending",
+		StartTime: time.Now(),
+		Deletion:  &filter,
+	})
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	links := jobLinks(r, job)
+	w.Header().Set("Location", links["self"])
+	response.Write(w, r, http.StatusAccepted, job, links)
+}
+
+// deleteRecordsJob deletes the records matching the job's filter,
+// admin.delete_batch_size per write transaction so other writers are not
+// held up for long, until done or ctx is cancelled. Each deletion goes
+// through deleteRecord, which keeps the indexes, counters, ledger and change
+// feed in step. Progress is stored on the job after every transaction.
+func deleteRecordsJob(ctx context.Context, job ProcessingJob) error {
+	log := jobLog(job.ID)
+	filter := *job.Deletion
+
+	var keys [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil && filter.matches(record) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.warn("Failed to select records to delete", logrus.Fields{"error": err})
+		return err
+	}
+	updateJob(job.ID, func(job *ProcessingJob) { job.RecordsMatched = len(keys) })
+	log.info("Selected records to delete", logrus.Fields{"records": len(keys)})
+
+	batchSize := viper.GetInt("admin.delete_batch_size")
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	deleted := 0
+	for len(keys) > 0 && ctx.Err() == nil {
+		batch := keys[:min(batchSize, len(keys))]
+		keys = keys[len(batch):]
+
+		var removed []DataRecord
+		start := time.Now()
+		err := db.Update(func(tx *bolt.Tx) error {
+			for _, k := range batch {
+				// Records changed since they were selected are checked again.
+				_, v := findRecord(tx, k)
+				var record DataRecord
+				if v == nil || decodeRecord(k, v, &record) != nil || !filter.matches(record) {
+					continue
+				}
+				if err := deleteRecord(tx, k); err != nil {
+					return err
+				}
+				removed = append(removed, record)
+			}
+			return nil
+		})
+		bulkDeleteBatchDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			log.warn("Failed to delete records", logrus.Fields{"error": err, "deleted": deleted})
+			return err
+		}
+
+		for _, record := range removed {
+			bulkDeletedRecords.WithLabelValues(record.Type).Inc()
+			if record.Processed {
+				dataRecordsTotal.WithLabelValues("processed").Dec()
+			} else {
+				dataRecordsTotal.WithLabelValues("pending").Dec()
+			}
+		}
+		deleted += len(removed)
+		updateJob(job.ID, func(job *ProcessingJob) { job.RecordsDeleted = deleted })
+		log.log(logrus.DebugLevel, "Deleted batch of records", logrus.Fields{"records": len(removed), "remaining": len(keys)})
+	}
+	return nil
+}
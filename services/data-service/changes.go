@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RecordChange is a single entry of the change data capture log. Erased
+// marks the delete of a record removed by subject deletion, whose earlier
+// entries no longer carry its data.
+type RecordChange struct {
+	Sequence  uint64      `json:"seq"`
+	Operation string      `json:"op"`
+	RecordID  string      `json:"record_id"`
+	Record    *DataRecord `json:"record,omitempty"`
+	Erased    bool        `json:"erased,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+const (
+	defaultChangesLimit = 500
+	changesPollInterval = 1 * time.Second
+)
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func appendChange(tx *bolt.Tx, change RecordChange) (uint64, error) {
+	b := tx.Bucket([]byte("changes"))
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	change.Sequence = seq
+	change.Timestamp = time.Now()
+	if change.Record != nil {
+		change.Record.Sequence = seq
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return 0, err
+	}
+	return seq, b.Put(sequenceKey(seq), data)
+}
+
+// putRecord stores a record and appends a create or update change entry in
+// the same transaction. All record writes should go through it.
+func putRecord(tx *bolt.Tx, record *DataRecord) error {
+	op := "create"
+	var previous *DataRecord
+	b, existing := findRecord(tx, []byte(record.ID))
+	if existing != nil {
+		op = "update"
+		previous = &DataRecord{}
+		if err := json.Unmarshal(existing, previous); err != nil {
+			previous = nil
+		}
+	} else {
+		var err error
+		if b, err = tx.CreateBucketIfNotExists([]byte(shardBucketName(shardOf(record)))); err != nil {
+			return err
+		}
+	}
+
+	record.Priority = recordPriority(*record)
+	snapshot := *record
+	seq, err := appendChange(tx, RecordChange{Operation: op, RecordID: record.ID, Record: &snapshot})
+	if err != nil {
+		return err
+	}
+	record.Sequence = seq
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(record.ID), data); err != nil {
+		return err
+	}
+	for _, ix := range recordIndexes {
+		if err := ix.update(tx, previous, *record); err != nil {
+			return err
+		}
+	}
+	trackRecordWrite(tx, previous, *record)
+	if previous == nil {
+		trackTopK(tx, *record)
+	}
+	return nil
+}
+
+// deleteRecord removes a record and appends a delete change entry.
+func deleteRecord(tx *bolt.Tx, recordID []byte) error {
+	return removeRecord(tx, recordID, false)
+}
+
+// eraseRecords removes records for subject deletion: besides deleteRecord,
+// their snapshots are stripped from the change log and the delete entries
+// are marked erased so replicas scrub their copies too.
+func eraseRecords(tx *bolt.Tx, recordIDs [][]byte) error {
+	ids := make(map[string]bool, len(recordIDs))
+	for _, id := range recordIDs {
+		if err := removeRecord(tx, id, true); err != nil {
+			return err
+		}
+		ids[string(id)] = true
+	}
+	return scrubChanges(tx, ids)
+}
+
+func removeRecord(tx *bolt.Tx, recordID []byte, erase bool) error {
+	b, existing := findRecord(tx, recordID)
+	if existing == nil {
+		return nil
+	}
+
+	var previous DataRecord
+	if err := json.Unmarshal(existing, &previous); err == nil {
+		trackRecordDelete(tx, previous)
+		for _, ix := range recordIndexes {
+			if err := ix.remove(tx, previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := appendChange(tx, RecordChange{Operation: "delete", RecordID: string(recordID), Erased: erase}); err != nil {
+		return err
+	}
+	if err := removeLedgerEntry(tx, recordID); err != nil {
+		return err
+	}
+	if err := removeProcessingFailure(tx, recordID); err != nil {
+		return err
+	}
+	return b.Delete(recordID)
+}
+
+// scrubChanges drops the record snapshots of the entries for ids.
+func scrubChanges(tx *bolt.Tx, ids map[string]bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	b := tx.Bucket([]byte("changes"))
+	type scrubbed struct {
+		key, value []byte
+	}
+	var updates []scrubbed
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var change RecordChange
+		if err := json.Unmarshal(v, &change); err != nil {
+			return fmt.Errorf("decode change %d: %w", binary.BigEndian.Uint64(k), err)
+		}
+		if change.Record == nil || !ids[change.RecordID] {
+			continue
+		}
+		change.Record = nil
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, scrubbed{append([]byte(nil), k...), data})
+	}
+	for _, u := range updates {
+		if err := b.Put(u.key, u.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateChangesContinuously drops change log entries older than
+// changes.retention or beyond the newest changes.max_entries.
+func truncateChangesContinuously() {
+	ticker := time.NewTicker(viper.GetDuration("changes.truncate_interval"))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var cutoff time.Time
+		if retention := viper.GetDuration("changes.retention"); retention > 0 {
+			cutoff = time.Now().Add(-retention)
+		}
+		removed, err := truncateChanges(cutoff, viper.GetUint64("changes.max_entries"))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to truncate change log")
+			continue
+		}
+		if removed > 0 {
+			logrus.WithField("entries", removed).Info("Truncated change log")
+		}
+	}
+}
+
+// truncateChanges removes the entries written before cutoff and those
+// beyond the newest maxEntries; a zero cutoff or maxEntries disables that
+// bound. It returns how many entries it removed.
+func truncateChanges(cutoff time.Time, maxEntries uint64) (int, error) {
+	removed := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("changes"))
+		var keepFrom uint64
+		if last := b.Sequence(); maxEntries > 0 && last > maxEntries {
+			keepFrom = last - maxEntries + 1
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if binary.BigEndian.Uint64(k) >= keepFrom {
+				if cutoff.IsZero() {
+					break
+				}
+				var change RecordChange
+				if err := json.Unmarshal(v, &change); err == nil && !change.Timestamp.Before(cutoff) {
+					break
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// changesTruncatedError is returned for a since older than the change log
+// keeps: the follower has missed entries.
+type changesTruncatedError struct {
+	since, firstSeq uint64
+}
+
+func (e changesTruncatedError) Error() string {
+	return fmt.Sprintf("change log truncated: oldest entry is %d, since is %d", e.firstSeq, e.since)
+}
+
+func readChanges(since uint64, limit int) ([]RecordChange, uint64, error) {
+	changes := []RecordChange{}
+	var last uint64
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("changes"))
+		last = b.Sequence()
+		oldest := last + 1
+		if k, _ := b.Cursor().First(); k != nil {
+			oldest = binary.BigEndian.Uint64(k)
+		}
+		if oldest > since+1 {
+			return changesTruncatedError{since: since, firstSeq: oldest}
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(sequenceKey(since + 1)); k != nil && len(changes) < limit; k, v = c.Next() {
+			var change RecordChange
+			if err := json.Unmarshal(v, &change); err != nil {
+				return fmt.Errorf("decode change %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+
+	return changes, last, err
+}
+
+func parseChangesQuery(r *http.Request) (uint64, int, error) {
+	var since uint64
+	limit := defaultChangesLimit
+	var err error
+
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid since")
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+	}
+	return since, limit, nil
+}
+
+func getChangesHandler(w http.ResponseWriter, r *http.Request) {
+	since, limit, err := parseChangesQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, last, err := readChanges(since, limit)
+	var truncated changesTruncatedError
+	if errors.As(err, &truncated) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":     err.Error(),
+			"first_seq": truncated.firstSeq,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve changes", http.StatusInternalServerError)
+		return
+	}
+
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Sequence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes":  changes,
+		"next":     next,
+		"last_seq": last,
+	})
+}
+
+// streamChangesHandler tails the change log as Server-Sent Events, using the
+// sequence number as the event ID so clients can resume with Last-Event-ID.
+func streamChangesHandler(w http.ResponseWriter, r *http.Request) {
+	since, limit, err := parseChangesQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if seq, err := strconv.ParseUint(v, 10, 64); err == nil {
+			since = seq
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ticker := time.NewTicker(changesPollInterval)
+	defer ticker.Stop()
+
+	for {
+		changes, _, err := readChanges(since, limit)
+		if err != nil {
+			return
+		}
+		for _, change := range changes {
+			data, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Sequence, change.Operation, data); err != nil {
+				return
+			}
+			since = change.Sequence
+		}
+		if len(changes) > 0 {
+			rc.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func storeTestRecords(t *testing.T, records ...DataRecord) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		for i := range records {
+			if err := putRecord(tx, &records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubjectDeletionScrubsChanges(t *testing.T) {
+	openTestDB(t)
+	loadPrivacyConfig()
+	now := time.Now()
+	storeTestRecords(t,
+		DataRecord{ID: "r1", Type: "event", Timestamp: now, Data: map[string]string{"user_id": "u-42", "email": "a@example.com"}},
+		DataRecord{ID: "r2", Type: "event", Timestamp: now, Data: map[string]string{"user_id": "u-7"}},
+	)
+	// An update leaves a second snapshot of r1 in the log.
+	storeTestRecords(t, DataRecord{ID: "r1", Type: "event", Timestamp: now, Data: map[string]string{"user_id": "u-42", "email": "b@example.com"}})
+
+	w := httptest.NewRecorder()
+	deleteSubjectRecordsHandler(w, httptest.NewRequest("DELETE", "/api/v1/records?subject_id=u-42", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	changes, _, err := readChanges(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Fatalf("got %d changes, want 4", len(changes))
+	}
+	for _, c := range changes {
+		switch {
+		case c.RecordID == "r1" && c.Record != nil:
+			t.Errorf("change %d still holds the erased record: %+v", c.Sequence, c.Record)
+		case c.RecordID == "r2" && c.Record == nil:
+			t.Errorf("change %d of another subject was scrubbed", c.Sequence)
+		}
+	}
+	if last := changes[3]; last.Operation != "delete" || last.RecordID != "r1" || !last.Erased {
+		t.Errorf("last change = %+v, want an erased delete of r1", last)
+	}
+}
+
+func TestApplyErasedDelete(t *testing.T) {
+	openTestDB(t)
+	storeTestRecords(t, DataRecord{ID: "r1", Type: "event", Timestamp: time.Now(), Data: map[string]string{"user_id": "u-42"}})
+
+	if err := applyChanges([]RecordChange{{Sequence: 9, Operation: "delete", RecordID: "r1", Erased: true}}); err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err := readChanges(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0].Record != nil || !changes[1].Erased {
+		t.Errorf("replica change log after an erased delete: %+v", changes)
+	}
+}
+
+func TestTruncateChanges(t *testing.T) {
+	openTestDB(t)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		storeTestRecords(t, DataRecord{ID: string(rune('a' + i)), Type: "event", Timestamp: now})
+	}
+	// Age the first two entries.
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("changes"))
+		for seq := uint64(1); seq <= 2; seq++ {
+			var c RecordChange
+			if err := json.Unmarshal(b.Get(sequenceKey(seq)), &c); err != nil {
+				return err
+			}
+			c.Timestamp = now.Add(-48 * time.Hour)
+			data, _ := json.Marshal(c)
+			if err := b.Put(sequenceKey(seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := truncateChanges(now.Add(-24*time.Hour), 0); err != nil || removed != 2 {
+		t.Fatalf("truncate by age removed %d, %v; want 2", removed, err)
+	}
+	if removed, err := truncateChanges(time.Time{}, 2); err != nil || removed != 1 {
+		t.Fatalf("truncate by count removed %d, %v; want 1", removed, err)
+	}
+
+	if changes, last, err := readChanges(3, 100); err != nil || len(changes) != 2 || changes[0].Sequence != 4 || last != 5 {
+		t.Errorf("readChanges(3) = %d changes, last %d, %v", len(changes), last, err)
+	}
+	w := httptest.NewRecorder()
+	getChangesHandler(w, httptest.NewRequest("GET", "/api/v1/changes?since=1", nil))
+	var body struct {
+		FirstSeq uint64 `json:"first_seq"`
+	}
+	if json.NewDecoder(w.Body).Decode(&body); w.Code != http.StatusGone || body.FirstSeq != 4 {
+		t.Errorf("since below the log: status %d, first_seq %d; want 410 and 4", w.Code, body.FirstSeq)
+	}
+}
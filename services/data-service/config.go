@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/remoteconfig"
+)
+
+// configSources tracks where each setting came from; it backs /admin/config.
+var configSources *remoteconfig.Sources
+
+// loadRemoteConfig merges the document at remote_config.path over config.yaml
+// and keeps polling it. Later changes show in /admin/config and take effect
+// on restart.
+func loadRemoteConfig() {
+	configSources = remoteconfig.NewSources(viper.GetViper())
+	if !viper.GetBool("remote_config.enabled") {
+		return
+	}
+
+	cfg := remoteconfig.Config{
+		Provider: viper.GetString("remote_config.provider"),
+		Endpoint: viper.GetString("remote_config.endpoint"),
+		Path:     viper.GetString("remote_config.path"),
+		Format:   viper.GetString("remote_config.format"),
+		Interval: viper.GetDuration("remote_config.watch_interval"),
+	}
+	fields := logrus.Fields{"provider": cfg.Provider, "endpoint": cfg.Endpoint, "path": cfg.Path}
+
+	if err := configSources.Load(cfg); err != nil {
+		logrus.WithError(err).WithFields(fields).Warn("Could not read remote config, using local config")
+		return
+	}
+	logrus.WithFields(fields).Info("Remote config loaded")
+
+	go configSources.Watch(context.Background(), func(keys []string) {
+		logrus.WithFields(fields).WithField("keys", keys).Warn("Remote config changed, restart to apply")
+	}, func(err error) {
+		logrus.WithError(err).WithFields(fields).Warn("Remote config poll failed")
+	})
+}
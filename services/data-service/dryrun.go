@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// errConfirmationRequired aborts a deletion of more than
+// admin.confirm_threshold records that was not confirmed.
+var errConfirmationRequired = errors.New("confirmation required")
+
+// DeletionPlan describes the records a destructive admin operation removes.
+// It is the response of a ?dry_run=true request, and of a request refused
+// for lack of confirmation.
+type DeletionPlan struct {
+	Operation string `json:"operation"`
+	DryRun    bool   `json:"dry_run"`
+	// Scope is what the operation was asked to remove, e.g. its cutoff.
+	Scope   map[string]string `json:"scope"`
+	Records int               `json:"records"`
+	// Bytes is the stored size of the records.
+	Bytes  int64          `json:"bytes"`
+	Types  map[string]int `json:"types"`
+	Oldest *time.Time     `json:"oldest,omitempty"`
+	Newest *time.Time     `json:"newest,omitempty"`
+
+	// ConfirmationToken is set when the operation removes more than
+	// admin.confirm_threshold records; the request must be repeated with
+	// ?confirm=<token> before ConfirmBy.
+	ConfirmationToken string     `json:"confirmation_token,omitempty"`
+	ConfirmBy         *time.Time `json:"confirm_by,omitempty"`
+}
+
+func newDeletionPlan(operation string, scope map[string]string) DeletionPlan {
+	return DeletionPlan{Operation: operation, Scope: scope, Types: map[string]int{}}
+}
+
+// add counts record, stored as value, in the plan.
+func (p *DeletionPlan) add(record DataRecord, value []byte) {
+	p.Records++
+	p.Bytes += int64(len(value))
+	p.Types[record.Type]++
+	ts := record.Timestamp
+	if p.Oldest == nil || ts.Before(*p.Oldest) {
+		p.Oldest = &ts
+	}
+	if p.Newest == nil || ts.After(*p.Newest) {
+		p.Newest = &ts
+	}
+}
+
+// needsConfirmation reports whether the plan removes more records than
+// admin.confirm_threshold allows without a confirmation token.
+func (p DeletionPlan) needsConfirmation() bool {
+	threshold := viper.GetInt("admin.confirm_threshold")
+	return threshold > 0 && p.Records > threshold
+}
+
+// parseDryRun reads the dry_run query parameter.
+func parseDryRun(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid dry_run %q", v)
+	}
+	return dryRun, nil
+}
+
+// pendingConfirmation is an issued, unredeemed confirmation token.
+type pendingConfirmation struct {
+	operation string
+	scope     string
+	expires   time.Time
+}
+
+var confirmations = struct {
+	sync.Mutex
+	tokens map[string]pendingConfirmation
+}{tokens: make(map[string]pendingConfirmation)}
+
+// confirm issues the plan a token confirming operation on scope, a
+// canonical form of the plan's Scope, for admin.confirm_ttl.
+func (p *DeletionPlan) confirm(scope string) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(viper.GetDuration("admin.confirm_ttl")).UTC()
+
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	for t, c := range confirmations.tokens {
+		if time.Now().After(c.expires) {
+			delete(confirmations.tokens, t)
+		}
+	}
+	confirmations.tokens[token] = pendingConfirmation{operation: p.Operation, scope: scope, expires: expires}
+	p.ConfirmationToken, p.ConfirmBy = token, &expires
+}
+
+// redeemConfirmation uses up token and returns the scope it was issued for.
+func redeemConfirmation(token, operation string) (string, error) {
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	c, ok := confirmations.tokens[token]
+	if !ok || c.operation != operation || time.Now().After(c.expires) {
+		return "", errors.New("unknown or expired confirmation token")
+	}
+	delete(confirmations.tokens, token)
+	return c.scope, nil
+}
+
+// writeDeletionPlan answers a dry run with status 200, or a deletion that
+// needs confirmation with 409 and the token to confirm it.
+func writeDeletionPlan(w http.ResponseWriter, plan DeletionPlan) {
+	status := http.StatusOK
+	if !plan.DryRun {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(plan)
+}
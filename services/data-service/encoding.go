@@ -0,0 +1,54 @@
+package main
+
+import "pipeline/pkg/codec"
+
+// MarshalProto encodes r as the Record message of proto/data.proto.
+func (r DataRecord) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendString(b, 1, r.ID)
+	b = codec.AppendString(b, 2, r.Type)
+	b = codec.AppendStringMap(b, 3, r.Data)
+	b = codec.AppendTimestamp(b, 4, r.Timestamp)
+	b = codec.AppendBool(b, 5, r.Processed)
+	if r.ProcessedAt != nil {
+		b = codec.AppendTimestamp(b, 6, *r.ProcessedAt)
+	}
+	b = codec.AppendUint64(b, 7, r.Sequence)
+	b = codec.AppendString(b, 8, r.TraceID)
+	b = codec.AppendString(b, 9, r.ClaimedBy)
+	if r.LeaseExpiry != nil {
+		b = codec.AppendTimestamp(b, 10, *r.LeaseExpiry)
+	}
+	b = codec.AppendString(b, 11, r.JobID)
+	b = codec.AppendStringMap(b, 12, r.Links)
+	b = codec.AppendString(b, 13, r.OrderID)
+	b = codec.AppendString(b, 14, r.CorrelationID)
+	return b
+}
+
+// MarshalProto encodes j as the Job message.
+func (j ProcessingJob) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendString(b, 1, j.ID)
+	b = codec.AppendString(b, 2, j.Status)
+	b = codec.AppendTimestamp(b, 3, j.StartTime)
+	if j.EndTime != nil {
+		b = codec.AppendTimestamp(b, 4, *j.EndTime)
+	}
+	b = codec.AppendInt64(b, 5, int64(j.Records))
+	b = codec.AppendString(b, 6, j.Error)
+	b = codec.AppendStringMap(b, 7, j.Links)
+	return b
+}
+
+// MarshalProto encodes m as the DataMetrics message.
+func (m DataMetrics) MarshalProto() []byte {
+	var b []byte
+	b = codec.AppendInt64(b, 1, int64(m.TotalRecords))
+	b = codec.AppendInt64(b, 2, int64(m.ProcessedRecords))
+	b = codec.AppendInt64(b, 3, int64(m.PendingRecords))
+	b = codec.AppendDouble(b, 4, m.ProcessingRate)
+	b = codec.AppendInt64(b, 5, m.DataSize)
+	b = codec.AppendInt64(b, 6, m.DatabaseSize)
+	return b
+}
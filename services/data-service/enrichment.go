@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/geoip"
+)
+
+var enrichmentLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_enrichment_lookups_total",
+		Help: "Enrichment lookups by source and result: hit, miss or error",
+	},
+	[]string{"source", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(enrichmentLookups)
+}
+
+// EnrichmentSource is an entry of enrichment.sources: where to look up the
+// value of a record's Key data field and which fields of the result to add
+// to the record.
+type EnrichmentSource struct {
+	Name string `mapstructure:"name"`
+	// Type is static, http or geoip.
+	Type string `mapstructure:"type"`
+	Key  string `mapstructure:"key"`
+	// Fields maps each added data field, after Prefix, to a dotted path in
+	// the looked-up value. Without Fields every scalar top-level field of
+	// the value is added, or a scalar value as the field named Name.
+	Fields map[string]string `mapstructure:"fields"`
+	Prefix string            `mapstructure:"prefix"`
+
+	// Values is the lookup table of a static source. Viper lowercases map
+	// keys, so keys match case-insensitively.
+	Values map[string]interface{} `mapstructure:"values"`
+
+	// URL is the lookup of an http source, with {key} replaced by the
+	// escaped key. A JSON response is the value; 404 is a miss.
+	URL         string            `mapstructure:"url"`
+	Headers     map[string]string `mapstructure:"headers"`
+	Timeout     time.Duration     `mapstructure:"timeout"`
+	CacheTTL    time.Duration     `mapstructure:"cache_ttl"`
+	NegativeTTL time.Duration     `mapstructure:"negative_ttl"`
+	CacheSize   int               `mapstructure:"cache_size"`
+
+	// Database is the MaxMind DB file of a geoip source. Without Fields,
+	// country, city, latitude and longitude are added.
+	Database string `mapstructure:"database"`
+}
+
+// lookuper finds the value of a key; found is false for a miss.
+type lookuper interface {
+	lookup(key string) (value interface{}, found bool, err error)
+}
+
+type enrichmentSource struct {
+	EnrichmentSource
+	lookuper
+}
+
+var (
+	enrichmentSources map[string]*enrichmentSource
+	// enrichmentTypes lists the sources applied to each record type, "*"
+	// those applied to every type.
+	enrichmentTypes map[string][]string
+)
+
+var defaultGeoIPFields = map[string]string{
+	"country":   "country.iso_code",
+	"city":      "city.names.en",
+	"latitude":  "location.latitude",
+	"longitude": "location.longitude",
+}
+
+// loadEnrichmentConfig sets up the sources of the enrichment section. A
+// source that cannot be set up is left out with a warning, as are the
+// sources named under enrichment.types that do not exist.
+func loadEnrichmentConfig() {
+	enrichmentSources, enrichmentTypes = make(map[string]*enrichmentSource), make(map[string][]string)
+	if !viper.GetBool("enrichment.enabled") {
+		return
+	}
+	var sources []EnrichmentSource
+	if err := viper.UnmarshalKey("enrichment.sources", &sources); err != nil {
+		logrus.WithError(err).Warn("Invalid enrichment.sources, enrichment disabled")
+		return
+	}
+	for _, cfg := range sources {
+		cfg := cfg
+		log := logrus.WithFields(logrus.Fields{"source": cfg.Name, "type": cfg.Type})
+		if cfg.Name == "" || cfg.Key == "" {
+			log.Warn("Enrichment source needs a name and a key, skipped")
+			continue
+		}
+		l, err := newLookuper(&cfg)
+		if err != nil {
+			log.WithError(err).Warn("Enrichment source unavailable, skipped")
+			continue
+		}
+		enrichmentSources[cfg.Name] = &enrichmentSource{EnrichmentSource: cfg, lookuper: l}
+	}
+
+	var types map[string][]string
+	if err := viper.UnmarshalKey("enrichment.types", &types); err != nil {
+		logrus.WithError(err).Warn("Invalid enrichment.types, enrichment disabled")
+		return
+	}
+	for recordType, names := range types {
+		for _, name := range names {
+			if enrichmentSources[name] == nil {
+				logrus.WithFields(logrus.Fields{"type": recordType, "source": name}).Warn("Unknown enrichment source, skipped")
+				continue
+			}
+			enrichmentTypes[recordType] = append(enrichmentTypes[recordType], name)
+		}
+	}
+}
+
+func newLookuper(cfg *EnrichmentSource) (lookuper, error) {
+	switch cfg.Type {
+	case "static":
+		return staticLookup(cfg.Values), nil
+	case "http":
+		if !strings.Contains(cfg.URL, "{key}") {
+			return nil, fmt.Errorf("url must contain {key}")
+		}
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = 2 * time.Second
+		}
+		if cfg.CacheTTL == 0 {
+			cfg.CacheTTL = 5 * time.Minute
+		}
+		if cfg.NegativeTTL == 0 {
+			cfg.NegativeTTL = time.Minute
+		}
+		if cfg.CacheSize <= 0 {
+			cfg.CacheSize = 10000
+		}
+		return &httpLookup{
+			cfg:     cfg,
+			client:  &http.Client{Timeout: cfg.Timeout},
+			entries: make(map[string]cachedLookup),
+		}, nil
+	case "geoip":
+		reader, err := geoip.Open(cfg.Database)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.Fields) == 0 {
+			cfg.Fields = defaultGeoIPFields
+		}
+		return geoIPLookup{reader}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected static, http or geoip", cfg.Type)
+	}
+}
+
+type staticLookup map[string]interface{}
+
+func (s staticLookup) lookup(key string) (interface{}, bool, error) {
+	v, ok := s[strings.ToLower(key)]
+	return v, ok, nil
+}
+
+type geoIPLookup struct {
+	reader *geoip.Reader
+}
+
+func (g geoIPLookup) lookup(key string) (interface{}, bool, error) {
+	ip := net.ParseIP(key)
+	if ip == nil {
+		return nil, false, nil
+	}
+	v, err := g.reader.Lookup(ip)
+	return v, v != nil, err
+}
+
+// httpLookup looks keys up with a GET request and caches the answers,
+// misses for NegativeTTL and values for CacheTTL. Errors are not cached.
+type httpLookup struct {
+	cfg    *EnrichmentSource
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]cachedLookup
+}
+
+type cachedLookup struct {
+	value   interface{}
+	found   bool
+	expires time.Time
+}
+
+func (h *httpLookup) lookup(key string) (interface{}, bool, error) {
+	now := time.Now()
+	h.mu.Lock()
+	entry, ok := h.entries[key]
+	h.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, entry.found, nil
+	}
+
+	value, found, err := h.fetch(key)
+	if err != nil {
+		return nil, false, err
+	}
+	ttl := h.cfg.CacheTTL
+	if !found {
+		ttl = h.cfg.NegativeTTL
+	}
+	if ttl > 0 {
+		h.store(key, cachedLookup{value: value, found: found, expires: now.Add(ttl)})
+	}
+	return value, found, nil
+}
+
+// store caches an answer, making room by dropping expired entries, then
+// arbitrary ones, once the cache holds CacheSize entries.
+func (h *httpLookup) store(key string, entry cachedLookup) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size := h.cfg.CacheSize; len(h.entries) >= size {
+		now := time.Now()
+		for k, e := range h.entries {
+			if !now.Before(e.expires) {
+				delete(h.entries, k)
+			}
+		}
+		for k := range h.entries {
+			if len(h.entries) < size {
+				break
+			}
+			delete(h.entries, k)
+		}
+	}
+	h.entries[key] = entry
+}
+
+func (h *httpLookup) fetch(key string) (interface{}, bool, error) {
+	req, err := http.NewRequest("GET", strings.ReplaceAll(h.cfg.URL, "{key}", url.PathEscape(key)), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range h.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, false, fmt.Errorf("lookup returned %s", resp.Status)
+	}
+	var value interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return nil, false, fmt.Errorf("decode lookup response: %w", err)
+	}
+	return value, true, nil
+}
+
+// enrichRecord adds the fields of the sources configured for the record's
+// type, in order, and returns the names of the sources that had its key.
+// Fields the record already has are kept. A failed lookup is logged and
+// leaves the record as it is.
+func enrichRecord(record *DataRecord) []string {
+	names := append(append([]string(nil), enrichmentTypes["*"]...), enrichmentTypes[record.Type]...)
+	var applied []string
+	for _, name := range names {
+		source := enrichmentSources[name]
+		key := record.Data[source.Key]
+		if key == "" {
+			continue
+		}
+		value, found, err := source.lookup(key)
+		switch {
+		case err != nil:
+			enrichmentLookups.WithLabelValues(name, "error").Inc()
+			logrus.WithError(err).WithFields(logrus.Fields{"source": name, "record_id": record.ID}).Warn("Enrichment lookup failed")
+			continue
+		case !found:
+			enrichmentLookups.WithLabelValues(name, "miss").Inc()
+			continue
+		}
+		enrichmentLookups.WithLabelValues(name, "hit").Inc()
+
+		for field, v := range source.fieldsOf(value) {
+			if _, exists := record.Data[source.Prefix+field]; !exists {
+				record.Data[source.Prefix+field] = v
+			}
+		}
+		applied = append(applied, name)
+	}
+	return applied
+}
+
+// fieldsOf selects the fields to add from a looked-up value.
+func (s *enrichmentSource) fieldsOf(value interface{}) map[string]string {
+	fields := make(map[string]string)
+	if len(s.Fields) == 0 {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			if v, ok := enrichmentString(value); ok {
+				fields[s.Name] = v
+			}
+			return fields
+		}
+		for name, v := range m {
+			if v, ok := enrichmentString(v); ok {
+				fields[name] = v
+			}
+		}
+		return fields
+	}
+	for field, path := range s.Fields {
+		if v, ok := enrichmentString(valueAtPath(value, path)); ok {
+			fields[field] = v
+		}
+	}
+	return fields
+}
+
+// valueAtPath follows a dotted path of map keys and array indexes.
+func valueAtPath(value interface{}, path string) interface{} {
+	if path == "" || path == "." {
+		return value
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// enrichmentString formats a scalar as a data field value.
+func enrichmentString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	default:
+		return "", false
+	}
+}
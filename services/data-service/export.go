@@ -0,0 +1,201 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultExportLimit = 1000
+	maxExportLimit     = 10000
+)
+
+var exportContentTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+}
+
+// negotiateExportFormat picks the export format from the format query
+// parameter, falling back to the Accept header and then NDJSON.
+func negotiateExportFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	accept := r.Header.Get("Accept")
+	for format, contentType := range exportContentTypes {
+		if strings.Contains(accept, contentType) {
+			return format
+		}
+	}
+	return "ndjson"
+}
+
+func encodeExportCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func decodeExportCursor(token string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(token)
+}
+
+func exportRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := negotiateExportFormat(r)
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(w, "Unsupported export format", http.StatusBadRequest)
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid from timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid to timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultExportLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxExportLimit {
+			limit = maxExportLimit
+		}
+	}
+
+	var after []byte
+	if token := query.Get("cursor"); token != "" {
+		if after, err = decodeExportCursor(token); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var records []DataRecord
+	var nextCursor string
+	err = db.View(func(tx *bolt.Tx) error {
+		c := newRecordCursor(tx, -1)
+
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if k != nil && string(k) == string(after) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				continue
+			}
+			if !from.IsZero() && record.Timestamp.Before(from) {
+				continue
+			}
+			if !to.IsZero() && record.Timestamp.After(to) {
+				continue
+			}
+			if len(records) == limit {
+				nextCursor = encodeExportCursor([]byte(records[len(records)-1].ID))
+				break
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to export records", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if nextCursor != "" {
+		w.Header().Set("X-Export-Cursor", nextCursor)
+	}
+
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	switch format {
+	case "csv":
+		err = writeRecordsCSV(out, records)
+	default:
+		err = writeRecordsNDJSON(out, records)
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("Record export interrupted")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"format":  format,
+		"records": len(records),
+		"more":    nextCursor != "",
+	}).Info("Records exported")
+}
+
+func writeRecordsNDJSON(w io.Writer, records []DataRecord) error {
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecordsCSV(w io.Writer, records []DataRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "type", "timestamp", "processed", "processed_at", "data"}); err != nil {
+		return err
+	}
+	for _, record := range records {
+		processedAt := ""
+		if record.ProcessedAt != nil {
+			processedAt = record.ProcessedAt.Format(time.RFC3339)
+		}
+		data, err := json.Marshal(record.Data)
+		if err != nil {
+			return err
+		}
+		row := []string{
+			record.ID,
+			record.Type,
+			record.Timestamp.Format(time.RFC3339),
+			strconv.FormatBool(record.Processed),
+			processedAt,
+			string(data),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportRecordsFormats(t *testing.T) {
+	openTestDB(t)
+	storeTestRecords(t, DataRecord{ID: "rec-1", Type: "order", Timestamp: time.Now()})
+
+	for _, tc := range []struct {
+		query, accept string
+		status        int
+		contentType   string
+	}{
+		{"", "", http.StatusOK, "application/x-ndjson"},
+		{"?format=csv", "", http.StatusOK, "text/csv"},
+		{"", "text/csv", http.StatusOK, "text/csv"},
+		{"?format=parquet", "", http.StatusBadRequest, ""},
+		{"?format=xml", "", http.StatusBadRequest, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/records/export"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		exportRecordsHandler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%q (Accept %q) = %d, want %d", tc.query, tc.accept, w.Code, tc.status)
+			continue
+		}
+		if tc.contentType != "" {
+			if got := w.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("%q (Accept %q) Content-Type = %q, want %q", tc.query, tc.accept, got, tc.contentType)
+			}
+			if !strings.Contains(w.Body.String(), "rec-1") {
+				t.Errorf("%q (Accept %q) body lacks the record: %s", tc.query, tc.accept, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+	"pipeline/pkg/workload"
+)
+
+var generatedRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_generated_records_total",
+		Help: "Test records created by generation jobs, by type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(generatedRecords)
+}
+
+// defaultGenerateTypes is the type mix of a generation job that sets none.
+var defaultGenerateTypes = map[string]int{"user_event": 1, "system_log": 1, "metric": 1, "trace": 1}
+
+// GenerateSpec describes the test records a generation job creates: Count
+// records at Rate per second, their types drawn by the weights of Types,
+// each with a random payload of PayloadBytes and a timestamp up to TimeSkew
+// before its creation. Profile names a workload profile that shapes the
+// rate over time and turns a share of the records into error logs.
+// Everything random about the records, their IDs included, is drawn from
+// Seed, so a spec creates the same records each time it runs.
+type GenerateSpec struct {
+	Count        int            `json:"count"`
+	Rate         float64        `json:"rate"`
+	Types        map[string]int `json:"types,omitempty"`
+	PayloadBytes int            `json:"payload_bytes,omitempty"`
+	TimeSkew     string         `json:"time_skew,omitempty"`
+	Profile      string         `json:"profile,omitempty"`
+	Seed         *int64         `json:"seed,omitempty"`
+}
+
+// workloadProfile looks name up among the workload.profiles of the config
+// and the built-in profiles.
+func workloadProfile(name string) (workload.Profile, error) {
+	return workload.Lookup(name, viper.GetStringMapString("workload.profiles"))
+}
+
+// withDefaults fills in what the request left out: 50 records at 10 per
+// second over the past hour, as the generator always created, from a seed
+// picked at random and kept on the job so the run can be repeated.
+func (s GenerateSpec) withDefaults() GenerateSpec {
+	if s.Count == 0 {
+		s.Count = 50
+	}
+	if s.Rate == 0 {
+		s.Rate = 10
+	}
+	if len(s.Types) == 0 {
+		s.Types = defaultGenerateTypes
+	}
+	if s.TimeSkew == "" {
+		s.TimeSkew = "1h"
+	}
+	if s.Seed == nil {
+		seed := mathrand.Int63()
+		s.Seed = &seed
+	}
+	return s
+}
+
+func (s GenerateSpec) validate() error {
+	if limit := viper.GetInt("generate.max_count"); s.Count < 0 || (limit > 0 && s.Count > limit) {
+		return fmt.Errorf("count must be between 1 and generate.max_count (%d)", limit)
+	}
+	if s.Rate < 0 {
+		return errors.New("rate must be positive")
+	}
+	for t, weight := range s.Types {
+		if t == "" || weight <= 0 {
+			return fmt.Errorf("types needs record type names with positive weights, got %q: %d", t, weight)
+		}
+	}
+	if limit := viper.GetInt("generate.max_payload_bytes"); s.PayloadBytes < 0 || s.PayloadBytes > limit {
+		return fmt.Errorf("payload_bytes must be between 0 and generate.max_payload_bytes (%d)", limit)
+	}
+	if s.TimeSkew != "" {
+		if skew, err := time.ParseDuration(s.TimeSkew); err != nil || skew < 0 {
+			return fmt.Errorf("invalid time_skew %q", s.TimeSkew)
+		}
+	}
+	if s.Profile != "" {
+		if _, err := workloadProfile(s.Profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typePicker draws record types by weight.
+type typePicker struct {
+	types []string
+	upTo  []int
+}
+
+func newTypePicker(weights map[string]int) typePicker {
+	var p typePicker
+	for t := range weights {
+		p.types = append(p.types, t)
+	}
+	sort.Strings(p.types)
+	total := 0
+	for _, t := range p.types {
+		total += weights[t]
+		p.upTo = append(p.upTo, total)
+	}
+	return p
+}
+
+func (p typePicker) pick(rng *mathrand.Rand) string {
+	n := rng.Intn(p.upTo[len(p.upTo)-1])
+	i := sort.SearchInts(p.upTo, n+1)
+	return p.types[i]
+}
+
+// generateTestData serves POST /api/v1/generate. It creates a job, queued
+// like any other, that creates test records as the GenerateSpec in the
+// body asks; an empty body creates 50 records.
+func generateTestData(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		GenerateSpec
+		Priority int `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := body.GenerateSpec.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spec := body.GenerateSpec.withDefaults()
+
+	job, err := enqueueJob(ProcessingJob{
+		ID:        uuid.New().String(),
+		Status:    "pending",
+		StartTime: time.Now(),
+		Priority:  body.Priority,
+		Generate:  &spec,
+	})
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	links := jobLinks(r, job)
+	w.Header().Set("Location", links["self"])
+	response.Write(w, r, http.StatusAccepted, job, links)
+}
+
+// generateRecordsJob creates the job's records until done or ctx is
+// cancelled. Records due by the rate, as shaped by the profile, are
+// written together, at most
+// generate.batch_size per write transaction, and progress is stored on the
+// job after every transaction.
+func generateRecordsJob(ctx context.Context, job ProcessingJob) error {
+	log := jobLog(job.ID)
+	spec := *job.Generate
+	skew, _ := time.ParseDuration(spec.TimeSkew)
+	picker := newTypePicker(spec.Types)
+	rng := mathrand.New(mathrand.NewSource(*spec.Seed))
+	batchSize := viper.GetInt("generate.batch_size")
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	var profile *workload.Profile
+	if spec.Profile != "" {
+		p, err := workloadProfile(spec.Profile)
+		if err != nil {
+			return err
+		}
+		profile = &p
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	pacer := workload.NewPacer(profile, spec.Rate, time.Now())
+	generated := 0
+	for {
+		due, errorShare := pacer.Due(time.Now())
+		due = min(spec.Count, due)
+		for generated < due && ctx.Err() == nil {
+			n := min(due-generated, batchSize)
+			records := newTestRecords(rng, n, picker, spec.PayloadBytes, skew, errorShare)
+			err := db.Update(func(tx *bolt.Tx) error {
+				for i := range records {
+					if err := putRecord(tx, &records[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.warn("Failed to save test records", logrus.Fields{"error": err, "generated": generated})
+				return err
+			}
+			for _, record := range records {
+				generatedRecords.WithLabelValues(record.Type).Inc()
+			}
+			dataRecordsTotal.WithLabelValues("pending").Add(float64(n))
+			generated += n
+			updateJob(job.ID, func(job *ProcessingJob) { job.RecordsGenerated = generated })
+			log.log(logrus.DebugLevel, "Generated batch of records", logrus.Fields{"records": n, "remaining": spec.Count - generated})
+		}
+		if generated >= spec.Count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// newTestRecords builds the next n pending test records drawn from rng,
+// errorShare of them system_log records of level error. Timestamps are
+// offsets from now, so only they differ between runs of a seed.
+func newTestRecords(rng *mathrand.Rand, n int, picker typePicker, payloadBytes int, skew time.Duration, errorShare float64) []DataRecord {
+	records := make([]DataRecord, n)
+	for i := range records {
+		record := DataRecord{
+			ID:   uuid.Must(uuid.NewRandomFromReader(rng)).String(),
+			Type: picker.pick(rng),
+			Data: map[string]string{
+				"source":     "generator",
+				"category":   fmt.Sprintf("category_%d", rng.Intn(10)),
+				"priority":   strconv.Itoa(rng.Intn(5) + 1),
+				"session_id": uuid.Must(uuid.NewRandomFromReader(rng)).String(),
+			},
+			Timestamp: time.Now(),
+		}
+		if skew > 0 {
+			record.Timestamp = record.Timestamp.Add(-time.Duration(rng.Int63n(int64(skew))))
+		}
+		if payloadBytes > 0 {
+			payload := make([]byte, (payloadBytes+1)/2)
+			rng.Read(payload)
+			record.Data["payload"] = hex.EncodeToString(payload)[:payloadBytes]
+		}
+		if errorShare > 0 && rng.Float64() < errorShare {
+			record.Type = "system_log"
+			record.Data["level"] = "error"
+			record.Data["message"] = "generated error"
+		}
+		masked := applyMasking(&record)
+		record.Lineage = newLineage("generator", nil, nil, masked, record.Timestamp)
+		records[i] = record
+	}
+	return records
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"data-service/proto/ingestpb"
+)
+
+var grpcRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_grpc_requests_total",
+		Help: "gRPC calls completed, by method and status code",
+	},
+	[]string{"method", "code"},
+)
+
+func init() {
+	prometheus.MustRegister(grpcRequests)
+}
+
+// startGRPCServer listens on grpc.port when grpc.enabled is set. The
+// returned func stops it, cancelling calls in progress and waiting for their
+// handlers to return.
+func startGRPCServer() func() {
+	if !viper.GetBool("grpc.enabled") {
+		return func() {}
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", viper.GetString("grpc.port")))
+	if err != nil {
+		logrus.WithError(err).Fatal("gRPC server failed to start")
+	}
+	// Calls stream for as long as the client keeps them open, so there are
+	// no timeouts beyond the deadline the client sets.
+	srv := grpc.NewServer(
+		grpc.MaxRecvMsgSize(viper.GetInt("grpc.max_message_bytes")),
+		grpc.ChainStreamInterceptor(countGRPCCalls),
+		grpc.WaitForHandlers(true),
+	)
+	ingestpb.RegisterIngestServer(srv, ingestServer{})
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			logrus.WithError(err).Fatal("gRPC server failed")
+		}
+	}()
+
+	logrus.WithField("port", viper.GetString("grpc.port")).Info("Starting gRPC server")
+	return srv.Stop
+}
+
+// countGRPCCalls counts finished calls in data_grpc_requests_total and logs
+// those that failed for a reason other than the client's.
+func countGRPCCalls(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	code := status.Code(err)
+	if code == codes.Unknown || code == codes.Internal {
+		logrus.WithError(err).WithField("method", info.FullMethod).Error("gRPC call failed")
+	}
+	grpcRequests.WithLabelValues(info.FullMethod, code.String()).Inc()
+	return err
+}
+
+// grpcRequest presents the metadata of a call as the headers of an HTTP
+// request, for the helpers shared with the REST handlers that read
+// traceparent, X-Correlation-ID and the gateway's headers.
+func grpcRequest(ctx context.Context) *http.Request {
+	r := (&http.Request{Header: make(http.Header)}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, v := range values {
+			r.Header.Add(key, v)
+		}
+	}
+	return r
+}
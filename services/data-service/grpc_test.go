@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	"data-service/proto/ingestpb"
+)
+
+// dialIngest serves the Ingest service in memory and returns a client.
+func dialIngest(t *testing.T) ingestpb.IngestClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ChainStreamInterceptor(countGRPCCalls))
+	ingestpb.RegisterIngestServer(srv, ingestServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ingestpb.NewIngestClient(conn)
+}
+
+func TestIngestRecordsAcksEveryRecord(t *testing.T) {
+	openTestDB(t)
+	client := dialIngest(t)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-correlation-id", "corr-1")
+	stream, err := client.IngestRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*ingestpb.IngestRecord{
+		{Type: "sensor_reading", Data: map[string]string{"value": "21.5"}},
+		{Type: "sensor_reading", Parents: []string{"missing"}},
+		{Type: "order", OrderId: "o-1"},
+	}
+	for _, r := range records {
+		if err := stream.Send(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+
+	var last *ingestpb.IngestAck
+	for {
+		ack, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = ack
+	}
+	if last == nil {
+		t.Fatal("no ack")
+	}
+	if last.ThroughSequence != 3 || last.TotalAccepted != 2 {
+		t.Errorf("ack through %d, total accepted %d; want 3 and 2", last.ThroughSequence, last.TotalAccepted)
+	}
+	if len(last.Rejected) != 1 || last.Rejected[0].Sequence != 2 {
+		t.Errorf("rejected = %v, want record 2", last.Rejected)
+	}
+
+	stored := map[string]DataRecord{}
+	db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return err
+			}
+			stored[record.Type] = record
+			return nil
+		})
+	})
+	if got := stored["sensor_reading"]; got.Data["value"] != "21.5" || got.CorrelationID != "corr-1" {
+		t.Errorf("stored %+v, want value 21.5 and the correlation id of the metadata", got)
+	}
+	if got := stored["order"]; got.OrderID != "o-1" || got.Data == nil {
+		t.Errorf("stored %+v, want order o-1 with empty data", got)
+	}
+}
+
+func TestIngestRecordsAcksEachBatch(t *testing.T) {
+	openTestDB(t)
+	defer viper.Set("grpc.ingest.batch_size", viper.Get("grpc.ingest.batch_size"))
+	defer viper.Set("grpc.ingest.ack_interval", viper.Get("grpc.ingest.ack_interval"))
+	viper.Set("grpc.ingest.batch_size", 2)
+	viper.Set("grpc.ingest.ack_interval", "50ms")
+	client := dialIngest(t)
+
+	stream, err := client.IngestRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() *ingestpb.IngestAck {
+		t.Helper()
+		ack, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ack
+	}
+
+	// A full batch is acked at once, the rest after the ack interval, so a
+	// client can resume after the last acked sequence while the stream is
+	// still open.
+	for i := 0; i < 3; i++ {
+		if err := stream.Send(&ingestpb.IngestRecord{Type: "event"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ack := recv(); ack.ThroughSequence != 2 || ack.Accepted != 2 {
+		t.Errorf("first ack through %d with %d accepted, want the batch of 2", ack.ThroughSequence, ack.Accepted)
+	}
+	if ack := recv(); ack.ThroughSequence != 3 || ack.Accepted != 1 || ack.TotalAccepted != 3 {
+		t.Errorf("interval ack through %d, %d accepted, %d in total", ack.ThroughSequence, ack.Accepted, ack.TotalAccepted)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is pending, so the stream ends without another ack.
+	if ack, err := stream.Recv(); err != io.EOF {
+		t.Errorf("after close: %v, %v", ack, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"data-service/proto/ingestpb"
+	"pipeline/pkg/telemetry"
+)
+
+var (
+	grpcIngestRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_grpc_ingest_records_total",
+			Help: "Records received on IngestRecords streams, by result",
+		},
+		[]string{"result"},
+	)
+	grpcIngestStreams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_grpc_ingest_streams",
+			Help: "Open IngestRecords streams",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcIngestRecords, grpcIngestStreams)
+}
+
+// ingestServer implements the Ingest service of proto/ingest.proto.
+type ingestServer struct {
+	ingestpb.UnimplementedIngestServer
+}
+
+// pendingRecord is a received record waiting for the next write.
+type pendingRecord struct {
+	sequence uint64
+	record   DataRecord
+	parents  []string
+}
+
+// IngestRecords serves the IngestRecords stream. Records are
+// numbered from 1 in the order they arrive and written in batches of
+// grpc.ingest.batch_size, or whatever arrived within grpc.ingest.ack_interval.
+// Each write is followed by an ack, so a client that loses the stream
+// resends everything after the last ThroughSequence it saw. A record that
+// fails validation is rejected in the ack without ending the stream.
+func (ingestServer) IngestRecords(s ingestpb.Ingest_IngestRecordsServer) error {
+	grpcIngestStreams.Inc()
+	defer grpcIngestStreams.Dec()
+
+	batchSize := max(viper.GetInt("grpc.ingest.batch_size"), 1)
+	ackInterval := viper.GetDuration("grpc.ingest.ack_interval")
+	if ackInterval <= 0 {
+		ackInterval = time.Second
+	}
+
+	ctx := s.Context()
+	r := grpcRequest(ctx)
+
+	type received struct {
+		msg *ingestpb.IngestRecord
+		err error
+	}
+	incoming := make(chan received, batchSize)
+	go func() {
+		defer close(incoming)
+		for {
+			msg, err := s.Recv()
+			select {
+			case incoming <- received{msg, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		sequence uint64
+		pending  []pendingRecord
+		ack      ingestpb.IngestAck
+	)
+	flush := func() error {
+		if sequence == ack.ThroughSequence {
+			return nil
+		}
+		if err := storeIngested(pending, &ack); err != nil {
+			logrus.WithError(err).WithField("records", len(pending)).Error("Failed to store streamed records")
+			return status.Errorf(codes.Unavailable, "failed to store records after sequence %d", ack.ThroughSequence)
+		}
+		ack.ThroughSequence = sequence
+		err := s.Send(&ack)
+		pending, ack.Accepted, ack.Rejected = pending[:0], 0, nil
+		return err
+	}
+
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case in, ok := <-incoming:
+			if !ok {
+				return nil
+			}
+			if in.err == io.EOF {
+				return flush()
+			}
+			if in.err != nil {
+				return in.err
+			}
+			sequence++
+			record, err := streamedRecord(r, in.msg)
+			if err != nil {
+				ack.Rejected = append(ack.Rejected, &ingestpb.Rejection{Sequence: sequence, Error: err.Error()})
+				grpcIngestRecords.WithLabelValues("rejected").Inc()
+			} else {
+				pending = append(pending, pendingRecord{sequence: sequence, record: record, parents: in.msg.Parents})
+			}
+			if len(pending) >= batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// streamedRecord builds the record of a request like createRecordHandler
+// does for a POST body. r carries the metadata of the call.
+func streamedRecord(r *http.Request, req *ingestpb.IngestRecord) (DataRecord, error) {
+	source, err := lineageSource(r, req.Source)
+	if err != nil {
+		return DataRecord{}, err
+	}
+	if ok, _ := ingestionLimiter.allow(source); !ok {
+		return DataRecord{}, errSourceLimited(source)
+	}
+	record := DataRecord{
+		ID:            uuid.New().String(),
+		Type:          req.Type,
+		Data:          req.GetData(),
+		Timestamp:     time.Now(),
+		TraceID:       telemetry.TraceID(r),
+		OrderID:       req.OrderId,
+		CorrelationID: req.CorrelationId,
+	}
+	if record.Data == nil {
+		record.Data = make(map[string]string)
+	}
+	masked := applyMasking(&record)
+	record.Lineage = newLineage(source, req.Parents, appliedTransforms(r), masked, record.Timestamp)
+	if record.OrderID == "" {
+		record.OrderID = record.Data["order_id"]
+	}
+	if record.CorrelationID == "" {
+		record.CorrelationID = r.Header.Get("X-Correlation-ID")
+	}
+	if record.CorrelationID == "" {
+		record.CorrelationID = record.OrderID
+	}
+	for name, value := range map[string]string{"order_id": record.OrderID, "correlation_id": record.CorrelationID} {
+		if err := validateCorrelationKey(name, value); err != nil {
+			return DataRecord{}, err
+		}
+	}
+	return record, nil
+}
+
+// storeIngested writes pending in one transaction, rejecting the records
+// whose parents do not exist into ack.
+func storeIngested(pending []pendingRecord, ack *ingestpb.IngestAck) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	var rejected []*ingestpb.Rejection
+	err := db.Update(func(tx *bolt.Tx) error {
+		rejected = nil
+		for i := range pending {
+			p := &pending[i]
+			if err := checkParents(tx, p.parents); err != nil {
+				rejected = append(rejected, &ingestpb.Rejection{Sequence: p.sequence, Error: err.Error()})
+				continue
+			}
+			if err := putRecord(tx, &p.record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	accepted := uint64(len(pending) - len(rejected))
+	ack.Accepted += accepted
+	ack.TotalAccepted += accepted
+	ack.Rejected = append(ack.Rejected, rejected...)
+	sort.Slice(ack.Rejected, func(i, j int) bool { return ack.Rejected[i].Sequence < ack.Rejected[j].Sequence })
+	grpcIngestRecords.WithLabelValues("accepted").Add(float64(accepted))
+	grpcIngestRecords.WithLabelValues("rejected").Add(float64(len(rejected)))
+	dataRecordsTotal.WithLabelValues("pending").Add(float64(accepted))
+	return nil
+}
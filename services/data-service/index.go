@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxCorrelationKeyLen bounds order_id and correlation_id, which are part of
+// the index keys.
+const maxCorrelationKeyLen = 200
+
+// recordIndex is a secondary index of records by one of their fields. Its
+// bucket holds a key <value>\x00<record ID> per indexed record, so the IDs
+// with a value are a prefix scan in the records' key order. Records with an
+// empty value are not indexed.
+type recordIndex struct {
+	bucket string
+	value  func(DataRecord) string
+}
+
+var (
+	orderIndex       = recordIndex{"order_index", func(r DataRecord) string { return r.OrderID }}
+	correlationIndex = recordIndex{"correlation_index", func(r DataRecord) string { return r.CorrelationID }}
+
+	// recordIndexes are kept up to date by putRecord and deleteRecord.
+	recordIndexes = []recordIndex{orderIndex, correlationIndex, pendingIndex}
+)
+
+func indexKey(value, id string) []byte {
+	return []byte(value + "\x00" + id)
+}
+
+// update moves record's entry from the value of previous, nil for a new
+// record, to its current value.
+func (ix recordIndex) update(tx *bolt.Tx, previous *DataRecord, record DataRecord) error {
+	b := tx.Bucket([]byte(ix.bucket))
+	if b == nil {
+		return nil
+	}
+	value := ix.value(record)
+	if previous != nil {
+		if old := ix.value(*previous); old != "" && old != value {
+			if err := b.Delete(indexKey(old, record.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	return b.Put(indexKey(value, record.ID), nil)
+}
+
+// remove drops the entry of a deleted record.
+func (ix recordIndex) remove(tx *bolt.Tx, record DataRecord) error {
+	b := tx.Bucket([]byte(ix.bucket))
+	if b == nil || ix.value(record) == "" {
+		return nil
+	}
+	return b.Delete(indexKey(ix.value(record), record.ID))
+}
+
+// indexCursor walks the records with one indexed value in key order, like
+// recordCursor walks all of them.
+type indexCursor struct {
+	tx     *bolt.Tx
+	cursor *bolt.Cursor
+	prefix []byte
+}
+
+// cursor returns a cursor over the records whose field is value, or nil if
+// the database predates the index, as a read-only replica's may.
+func (ix recordIndex) cursor(tx *bolt.Tx, value string) *indexCursor {
+	b := tx.Bucket([]byte(ix.bucket))
+	if b == nil {
+		return nil
+	}
+	return &indexCursor{tx: tx, cursor: b.Cursor(), prefix: []byte(value + "\x00")}
+}
+
+func (ic *indexCursor) First() ([]byte, []byte) {
+	return ic.record(ic.cursor.Seek(ic.prefix))
+}
+
+func (ic *indexCursor) Next() ([]byte, []byte) {
+	return ic.record(ic.cursor.Next())
+}
+
+// record resolves an index key to the record it names, skipping entries
+// whose record is gone.
+func (ic *indexCursor) record(k, _ []byte) ([]byte, []byte) {
+	for ; k != nil && bytes.HasPrefix(k, ic.prefix); k, _ = ic.cursor.Next() {
+		id := k[len(ic.prefix):]
+		if _, v := findRecord(ic.tx, id); v != nil {
+			return id, v
+		}
+	}
+	return nil, nil
+}
+
+// validateCorrelationKey checks an order_id or correlation_id of a new
+// record.
+func validateCorrelationKey(name, value string) error {
+	if len(value) > maxCorrelationKeyLen {
+		return fmt.Errorf("%s is longer than %d bytes", name, maxCorrelationKeyLen)
+	}
+	if strings.ContainsRune(value, 0) {
+		return fmt.Errorf("%s may not contain NUL", name)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// payloadData converts a message payload of a streaming source to record
+// data. A JSON object becomes the data, with nested values kept as JSON; any
+// other payload is stored as data.payload, base64-encoded unless it is UTF-8
+// text.
+func payloadData(payload []byte) map[string]string {
+	data := make(map[string]string)
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	switch {
+	case decoder.Decode(&fields) == nil && fields != nil && !decoder.More():
+		for k, v := range fields {
+			data[k] = payloadValue(v)
+		}
+	case utf8.Valid(payload):
+		data["payload"] = string(payload)
+	default:
+		data["payload"] = base64.StdEncoding.EncodeToString(payload)
+		data["payload_encoding"] = "base64"
+	}
+	return data
+}
+
+// payloadValue is the data value of a JSON payload field.
+func payloadValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// ingestedRecord is a pending record received from a streaming source, masked
+// and with its lineage started like a record created over HTTP. Its order ID
+// comes from data.order_id.
+func ingestedRecord(recordType, source string, data map[string]string, received time.Time) (DataRecord, error) {
+	record := DataRecord{
+		ID:        uuid.New().String(),
+		Type:      recordType,
+		Data:      data,
+		Timestamp: received,
+	}
+	masked := applyMasking(&record)
+	record.Lineage = newLineage(source, nil, nil, masked, record.Timestamp)
+	record.OrderID = record.Data["order_id"]
+	record.CorrelationID = record.OrderID
+	if err := validateCorrelationKey("order_id", record.OrderID); err != nil {
+		return record, err
+	}
+	return record, nil
+}
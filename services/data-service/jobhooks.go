@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/signing"
+)
+
+// Headers of job notification deliveries besides the signature. The
+// delivery ID stays the same across retries so receivers can drop
+// duplicates.
+const (
+	headerJobEvent    = "X-Pipeline-Event"
+	headerJobDelivery = "X-Pipeline-Delivery"
+)
+
+var (
+	jobNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_job_notifications_total",
+			Help: "Job notification delivery attempts by target (callback or channel) and result: delivered, retried or failed",
+		},
+		[]string{"target", "result"},
+	)
+	jobNotificationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "data_job_notification_duration_seconds",
+			Help:    "Duration of job notification delivery attempts",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobNotifications, jobNotificationDuration)
+}
+
+// JobNotification is the body POSTed to a job's callback URL and
+// notification channels when it finishes.
+type JobNotification struct {
+	// Event is job.completed, job.failed or job.cancelled.
+	Event           string    `json:"event"`
+	JobID           string    `json:"job_id"`
+	Status          string    `json:"status"`
+	Records         int       `json:"records_processed"`
+	Error           string    `json:"error,omitempty"`
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// Text summarises the job for chat channels.
+	Text  string            `json:"text"`
+	Links map[string]string `json:"links"`
+}
+
+// jobNotifyRequest is the optional body of POST /jobs.
+type jobNotifyRequest struct {
+	CallbackURL string   `json:"callback_url"`
+	Notify      []string `json:"notify"`
+}
+
+// validateJobNotify checks a job's callback URL against
+// jobs.webhooks.allowed_hosts and its channels against
+// jobs.notifications.channels. POST /jobs is not authenticated, so without
+// allowed hosts no callback URL is accepted: the service would otherwise
+// send requests wherever a caller asks, internal addresses included.
+func validateJobNotify(req jobNotifyRequest) error {
+	if req.CallbackURL != "" {
+		u, err := url.Parse(req.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("callback_url must be an absolute http or https URL")
+		}
+		allowed := viper.GetStringSlice("jobs.webhooks.allowed_hosts")
+		if len(allowed) == 0 {
+			return fmt.Errorf("callback_url is disabled: jobs.webhooks.allowed_hosts is empty")
+		}
+		ok := false
+		for _, host := range allowed {
+			ok = ok || strings.EqualFold(host, u.Hostname())
+		}
+		if !ok {
+			return fmt.Errorf("callback_url host %s is not in jobs.webhooks.allowed_hosts", u.Hostname())
+		}
+	}
+	for _, name := range req.Notify {
+		if jobChannelURL(name) == "" {
+			return fmt.Errorf("unknown notification channel %q", name)
+		}
+	}
+	return nil
+}
+
+// jobChannelURL returns the webhook URL of a notification channel. Viper
+// lowercases the channel names, so names match case-insensitively.
+func jobChannelURL(name string) string {
+	return viper.GetStringMapString("jobs.notifications.channels")[strings.ToLower(name)]
+}
+
+// notifyJobFinished delivers job's notification to its callback URL and
+// channels in the background.
+func notifyJobFinished(job ProcessingJob) {
+	if job.CallbackURL == "" && len(job.Notify) == 0 {
+		return
+	}
+	event := "job.completed"
+	if job.Status == "failed" || job.Status == "cancelled" {
+		event = "job." + job.Status
+	}
+	n := JobNotification{
+		Event:     event,
+		JobID:     job.ID,
+		Status:    job.Status,
+		Records:   job.Records,
+		Error:     job.Error,
+		StartTime: job.StartTime.UTC(),
+		EndTime:   job.EndTime.UTC(),
+		Links: map[string]string{
+			"job":     "/api/v1/jobs/" + job.ID,
+			"logs":    "/api/v1/jobs/" + job.ID + "/logs",
+			"records": "/api/v1/records?job_id=" + url.QueryEscape(job.ID),
+		},
+	}
+	n.DurationSeconds = n.EndTime.Sub(n.StartTime).Seconds()
+	n.Text = fmt.Sprintf("Processing job %s %s: %d records in %s", job.ID, job.Status, job.Records, n.EndTime.Sub(n.StartTime).Round(time.Millisecond))
+	if job.Error != "" {
+		n.Text += ": " + job.Error
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		logrus.WithError(err).WithField("job_id", job.ID).Error("Failed to encode job notification")
+		return
+	}
+
+	if job.CallbackURL != "" {
+		fields := logrus.Fields{"target": "callback", "url": redactURL(job.CallbackURL)}
+		go deliverJobNotification(jobLog(job.ID), fields, job.CallbackURL, event, body)
+	}
+	for _, name := range job.Notify {
+		if u := jobChannelURL(name); u != "" {
+			fields := logrus.Fields{"target": "channel", "channel": name}
+			go deliverJobNotification(jobLog(job.ID), fields, u, event, body)
+		}
+	}
+}
+
+// deliverJobNotification POSTs body to target, retrying network errors,
+// 408, 429 and 5xx responses up to jobs.webhooks.max_attempts times with a
+// backoff doubling from jobs.webhooks.retry_backoff. Outcomes go to the
+// job's log with fields, which name the target without its credentials.
+func deliverJobNotification(log jobLog, fields logrus.Fields, targetURL, event string, body []byte) {
+	target := fields["target"].(string)
+	client := &http.Client{Timeout: viper.GetDuration("jobs.webhooks.timeout")}
+	secret := secretValue("jobs.webhooks.secret")
+	if secret == "" {
+		secret = secretValue("request_signing.secret")
+	}
+	delivery := uuid.New().String()
+	attempts := viper.GetInt("jobs.webhooks.max_attempts")
+	backoff := viper.GetDuration("jobs.webhooks.retry_backoff")
+	fields["delivery"] = delivery
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		var retry bool
+		retry, err = postJobNotification(client, targetURL, secret, event, delivery, body)
+		jobNotificationDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+		fields["attempt"] = attempt
+		if err == nil {
+			jobNotifications.WithLabelValues(target, "delivered").Inc()
+			log.info("Job notification delivered", fields)
+			return
+		}
+		if !retry || attempt >= attempts {
+			break
+		}
+		jobNotifications.WithLabelValues(target, "retried").Inc()
+		time.Sleep(backoff << (attempt - 1))
+	}
+	jobNotifications.WithLabelValues(target, "failed").Inc()
+	fields["error"] = err
+	log.warn("Job notification failed", fields)
+}
+
+// postJobNotification makes one delivery attempt and reports whether a
+// failure is worth retrying.
+func postJobNotification(client *http.Client, targetURL, secret, event, delivery string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerJobEvent, event)
+	req.Header.Set(headerJobDelivery, delivery)
+	if secret != "" {
+		signing.Sign(req, body, secret, time.Now())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may hold a token; the error without it is enough.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("callback returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("callback returned %s", resp.Status)
+	}
+}
+
+// redactURL drops the credentials, query and fragment of a URL for logs.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidateJobNotify(t *testing.T) {
+	defer viper.Set("jobs.webhooks.allowed_hosts", viper.Get("jobs.webhooks.allowed_hosts"))
+	defer viper.Set("jobs.notifications.channels", viper.Get("jobs.notifications.channels"))
+	viper.Set("jobs.notifications.channels", map[string]string{"ops": "https://chat.example.com/hooks/ops"})
+
+	// Without allowed hosts no callback is sent anywhere.
+	viper.Set("jobs.webhooks.allowed_hosts", []string{})
+	for _, callback := range []string{"https://reports.example.com/hooks", "http://127.0.0.1:8082/admin", "http://169.254.169.254/latest/meta-data"} {
+		if err := validateJobNotify(jobNotifyRequest{CallbackURL: callback}); err == nil || !strings.Contains(err.Error(), "disabled") {
+			t.Errorf("%s accepted without allowed hosts: %v", callback, err)
+		}
+	}
+	if err := validateJobNotify(jobNotifyRequest{Notify: []string{"OPS"}}); err != nil {
+		t.Errorf("configured channel refused: %v", err)
+	}
+
+	viper.Set("jobs.webhooks.allowed_hosts", []string{"reports.example.com"})
+	cases := map[string]bool{
+		"https://REPORTS.example.com/hooks":      true,
+		"https://reports.example.com:8443/hooks": true,
+		"http://127.0.0.1:8082/admin":            false,
+		"https://reports.example.com.evil/hooks": false,
+		"ftp://reports.example.com/hooks":        false,
+		"/hooks":                                 false,
+	}
+	for callback, ok := range cases {
+		if err := validateJobNotify(jobNotifyRequest{CallbackURL: callback}); (err == nil) != ok {
+			t.Errorf("validateJobNotify(%s) = %v", callback, err)
+		}
+	}
+	if err := validateJobNotify(jobNotifyRequest{Notify: []string{"sales"}}); err == nil {
+		t.Error("unknown channel accepted")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// jobLogsBucket holds a bucket per processing job with the lines logged
+// while it ran, keyed by sequence number, so a job can be diagnosed after
+// the service's own logs have rotated away.
+const jobLogsBucket = "job_logs"
+
+// JobLogEntry is a line of a job's log.
+type JobLogEntry struct {
+	Seq      uint64                 `json:"seq"`
+	Time     time.Time              `json:"time"`
+	Level    string                 `json:"level"`
+	Message  string                 `json:"message"`
+	RecordID string                 `json:"record_id,omitempty"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+// jobLog logs the lines of a job's execution to the service log, with the
+// job's ID, and to the job's log. Lines of processing outside a job, with
+// an empty ID, only go to the service log, at debug level unless they are
+// warnings or errors so periodic processing stays quiet.
+type jobLog string
+
+// log writes a line. A record_id field becomes the entry's RecordID.
+func (l jobLog) log(level logrus.Level, msg string, fields logrus.Fields) {
+	entry := logrus.WithFields(fields)
+	if l == "" {
+		if level > logrus.WarnLevel {
+			level = logrus.DebugLevel
+		}
+		entry.Log(level, msg)
+		return
+	}
+	entry.WithField("job_id", string(l)).Log(level, msg)
+
+	line := JobLogEntry{Time: time.Now().UTC(), Level: level.String(), Message: msg}
+	for k, v := range fields {
+		if k == "record_id" {
+			line.RecordID, _ = v.(string)
+			continue
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		if line.Fields == nil {
+			line.Fields = make(map[string]interface{})
+		}
+		line.Fields[k] = v
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(jobLogsBucket)).CreateBucketIfNotExists([]byte(l))
+		if err != nil {
+			return err
+		}
+		if limit := viper.GetUint64("jobs.log_max_lines"); limit > 0 && b.Sequence() >= limit {
+			return nil
+		}
+		line.Seq, _ = b.NextSequence()
+		v, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		return b.Put(binary.BigEndian.AppendUint64(nil, line.Seq), v)
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("job_id", string(l)).Warn("Failed to write job log")
+	}
+}
+
+func (l jobLog) info(msg string, fields logrus.Fields) { l.log(logrus.InfoLevel, msg, fields) }
+func (l jobLog) warn(msg string, fields logrus.Fields) { l.log(logrus.WarnLevel, msg, fields) }
+
+// pruneJobLogs drops the logs of jobs whose last line is older than
+// jobs.log_retention.
+func pruneJobLogs() error {
+	retention := viper.GetDuration("jobs.log_retention")
+	if retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-retention)
+	return db.Update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(jobLogsBucket))
+		var expired [][]byte
+		err := logs.ForEach(func(k, _ []byte) error {
+			b := logs.Bucket(k)
+			if b == nil {
+				return nil
+			}
+			_, last := b.Cursor().Last()
+			var line JobLogEntry
+			if last == nil || json.Unmarshal(last, &line) != nil || line.Time.Before(cutoff) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := logs.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getJobLogsHandler serves GET /jobs/{id}/logs?level=&record_id=&offset=&limit=,
+// the job's log lines in order. level keeps lines of that level or more
+// severe.
+func getJobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	minLevel := logrus.TraceLevel
+	if v := q.Get("level"); v != "" {
+		if minLevel, err = logrus.ParseLevel(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	recordID := q.Get("record_id")
+
+	lines := []JobLogEntry{}
+	found := false
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobLogsBucket)).Bucket([]byte(jobID))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return b.ForEach(func(k, v []byte) error {
+			var line JobLogEntry
+			if err := json.Unmarshal(v, &line); err != nil {
+				return err
+			}
+			if level, err := logrus.ParseLevel(line.Level); err == nil && level > minLevel {
+				return nil
+			}
+			if recordID == "" || line.RecordID == recordID {
+				lines = append(lines, line)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to read job log", http.StatusInternalServerError)
+		return
+	}
+	if _, exists := getJob(jobID); !exists && !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	lo, hi := page.Bounds(len(lines))
+	response.WriteList(w, r, lines[lo:hi], page, len(lines), response.Links{
+		"job": response.Link(r, apiPath(r, "/jobs/"+jobID)),
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+var (
+	jobQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "data_job_queue_wait_seconds",
+			Help:    "Time processing jobs waited for a free slot before running",
+			Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 15, 30, 60, 300, 900},
+		},
+	)
+	jobQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_job_queue_length",
+			Help: "Processing jobs waiting for a free slot",
+		},
+	)
+	jobsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_jobs_rejected_total",
+			Help: "Processing jobs refused at submission, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobQueueWait, jobQueueLength, jobsRejected)
+}
+
+var errJobQueueFull = errors.New("job queue full")
+
+// jobScheduler runs at most jobs.max_concurrent jobs at a time and queues
+// the others, up to jobs.queue_size. A free slot goes to the queued job
+// with the highest priority, earliest submitted first; with
+// jobs.priority_aging every such period waited counts as one priority
+// level, so low priority jobs are not starved.
+type jobScheduler struct {
+	mu      sync.Mutex
+	running int
+	queue   []queuedJob
+	// cancels holds the cancel functions of the running jobs.
+	cancels map[string]context.CancelFunc
+}
+
+type queuedJob struct {
+	id       string
+	priority int
+	queuedAt time.Time
+}
+
+var jobQueue = &jobScheduler{cancels: make(map[string]context.CancelFunc)}
+
+// submit runs the job now or queues it. It fails with errJobQueueFull when
+// the queue has no room.
+func (s *jobScheduler) submit(id string, priority int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit := viper.GetInt("jobs.queue_size"); len(s.queue) >= limit && !s.hasSlotLocked() {
+		jobsRejected.WithLabelValues("queue_full").Inc()
+		return errJobQueueFull
+	}
+	s.queue = append(s.queue, queuedJob{id: id, priority: priority, queuedAt: time.Now()})
+	s.dispatchLocked()
+	return nil
+}
+
+func (s *jobScheduler) hasSlotLocked() bool {
+	limit := viper.GetInt("jobs.max_concurrent")
+	return limit <= 0 || s.running < limit
+}
+
+// dispatchLocked starts queued jobs while there are free slots.
+func (s *jobScheduler) dispatchLocked() {
+	for len(s.queue) > 0 && s.hasSlotLocked() {
+		next := s.nextLocked(time.Now())
+		job := s.queue[next]
+		s.queue = append(s.queue[:next], s.queue[next+1:]...)
+		s.running++
+		jobQueueWait.Observe(time.Since(job.queuedAt).Seconds())
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancels[job.id] = cancel
+		go func() {
+			defer s.done(job.id)
+			processJob(ctx, job.id)
+		}()
+	}
+	jobQueueLength.Set(float64(len(s.queue)))
+}
+
+// effectivePriority is a queued job's priority raised by one level per
+// jobs.priority_aging waited.
+func effectivePriority(j queuedJob, now time.Time) int {
+	if aging := viper.GetDuration("jobs.priority_aging"); aging > 0 {
+		return j.priority + int(now.Sub(j.queuedAt)/aging)
+	}
+	return j.priority
+}
+
+// nextLocked returns the index of the queued job to run next.
+func (s *jobScheduler) nextLocked(now time.Time) int {
+	best := 0
+	for i := 1; i < len(s.queue); i++ {
+		// The queue is in submission order, so ties keep the earliest.
+		if effectivePriority(s.queue[i], now) > effectivePriority(s.queue[best], now) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (s *jobScheduler) done(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.cancels[id]()
+	delete(s.cancels, id)
+	s.dispatchLocked()
+}
+
+// cancel takes a queued job out of the queue, or asks a running one to
+// stop. It reports which of the two id was, if either.
+func (s *jobScheduler) cancel(id string) (queued, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range s.queue {
+		if j.id == id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			jobQueueLength.Set(float64(len(s.queue)))
+			return true, false
+		}
+	}
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+		return false, true
+	}
+	return false, false
+}
+
+// position returns the place of id in the queue, 1 for the job to run
+// next, or 0 when id is not queued.
+func (s *jobScheduler) position(id string) int {
+	s.mu.Lock()
+	queue := append([]queuedJob(nil), s.queue...)
+	s.mu.Unlock()
+
+	now := time.Now()
+	sort.SliceStable(queue, func(i, j int) bool {
+		return effectivePriority(queue[i], now) > effectivePriority(queue[j], now)
+	})
+	for i, j := range queue {
+		if j.id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// getJob returns job id from memory, marking it used, or else from the
+// archive of finished jobs, where it stays.
+func getJob(id string) (ProcessingJob, bool) {
+	jobsMu.RLock()
+	job, ok := jobs[id]
+	if ok {
+		jobPolicy.Touch(id)
+	}
+	jobsMu.RUnlock()
+	if ok {
+		return job, true
+	}
+	return archivedJob(id)
+}
+
+func putJob(job ProcessingJob) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	jobs[job.ID] = job
+	jobPolicy.Touch(job.ID)
+	if jobPolicy.Occupancy().Full {
+		wakeJobEviction()
+	}
+}
+
+// updateJob applies fn to the stored job id and returns the result, or
+// false if there is no such job in memory. Only finished jobs are archived,
+// and they are not updated.
+func updateJob(id string, fn func(*ProcessingJob)) (ProcessingJob, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	job, ok := jobs[id]
+	if !ok {
+		return job, false
+	}
+	fn(&job)
+	jobs[id] = job
+	jobPolicy.Touch(id)
+	return job, true
+}
+
+// enqueueJob stores a new job and submits it to jobQueue. A job the queue
+// has no room for is dropped with errJobQueueFull.
+func enqueueJob(job ProcessingJob) (ProcessingJob, error) {
+	putJob(job)
+	activeJobs.Inc()
+	if err := jobQueue.submit(job.ID, job.Priority); err != nil {
+		jobsMu.Lock()
+		delete(jobs, job.ID)
+		jobPolicy.Forget(job.ID)
+		jobsMu.Unlock()
+		activeJobs.Dec()
+		return job, err
+	}
+
+	if job.QueuePosition = jobQueue.position(job.ID); job.QueuePosition > 0 {
+		jobLog(job.ID).info("Job queued", logrus.Fields{"priority": job.Priority, "position": job.QueuePosition})
+	}
+	return job, nil
+}
+
+func writeJobQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "10")
+	http.Error(w, "Too many processing jobs queued, try again later", http.StatusTooManyRequests)
+}
+
+// cancelJobHandler serves POST /jobs/{id}/cancel. A queued job is cancelled
+// at once; a running one stops at its next record or batch, so the response
+// may still show it running.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	if _, exists := getJob(jobID); !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	queued, running := jobQueue.cancel(jobID)
+	switch {
+	case queued:
+		now := time.Now()
+		job, _ := updateJob(jobID, func(job *ProcessingJob) {
+			job.Status = "cancelled"
+			job.EndTime = &now
+		})
+		activeJobs.Dec()
+		jobLog(jobID).info("Job cancelled", logrus.Fields{"queued": true})
+		notifyJobFinished(job)
+	case running:
+		jobLog(jobID).info("Job cancellation requested", nil)
+	default:
+		http.Error(w, "Job already finished", http.StatusConflict)
+		return
+	}
+
+	job, _ := getJob(jobID)
+	response.Write(w, r, http.StatusAccepted, job, jobLinks(r, job))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/evict"
+)
+
+// jobsBucket holds the finished jobs evicted from the jobs map, by ID.
+const jobsBucket = "jobs"
+
+// jobPolicy picks the jobs to move from the jobs map to jobsBucket: those
+// unused for jobs.store.ttl, then the least recently used beyond
+// jobs.store.max_entries. Queued and running jobs stay.
+var jobPolicy *evict.Policy
+
+// archivedJob reads job id from jobsBucket.
+func archivedJob(id string) (ProcessingJob, bool) {
+	var job ProcessingJob
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &job)
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("job_id", id).Warn("Failed to read archived job")
+		return job, false
+	}
+	return job, found
+}
+
+// eachArchivedJob calls fn with every job of jobsBucket.
+func eachArchivedJob(fn func(ProcessingJob)) error {
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var job ProcessingJob
+			if json.Unmarshal(v, &job) == nil {
+				fn(job)
+			}
+			return nil
+		})
+	})
+}
+
+// replaceJobs makes list the jobs, in memory, and empties jobsBucket.
+func replaceJobs(list []ProcessingJob) error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(jobsBucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(jobsBucket))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for id := range jobs {
+		jobPolicy.Forget(id)
+	}
+	jobs = make(map[string]ProcessingJob, len(list))
+	for _, job := range list {
+		jobs[job.ID] = job
+		jobPolicy.TouchAt(job.ID, jobLastUsed(job))
+	}
+	jobPolicy.SetArchived(0)
+	return nil
+}
+
+// jobLastUsed is when a job loaded into memory last changed.
+func jobLastUsed(job ProcessingJob) time.Time {
+	if job.EndTime != nil {
+		return *job.EndTime
+	}
+	return job.StartTime
+}
+
+// evictJobs moves the jobs jobPolicy picks to jobsBucket in one
+// transaction, then takes them out of the jobs map.
+func evictJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	victims := jobPolicy.Victims(time.Now(), func(id string) bool {
+		job, ok := jobs[id]
+		return ok && job.Status != "pending" && job.Status != "running"
+	})
+	if len(victims) == 0 {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(jobsBucket))
+		for _, v := range victims {
+			job := jobs[v.ID]
+			job.Links = nil
+			job.QueuePosition = 0
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(v.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to archive jobs, jobs stay in memory")
+		return
+	}
+	for _, v := range victims {
+		delete(jobs, v.ID)
+		jobPolicy.Evicted(v.ID, v.Reason)
+	}
+	logrus.WithFields(logrus.Fields{"evicted": len(victims), "resident": len(jobs)}).Info("Jobs archived")
+}
+
+// evictJobsNow asks the eviction loop for a pass before its next tick, when
+// the jobs map has outgrown jobs.store.max_entries.
+var evictJobsNow = make(chan struct{}, 1)
+
+func wakeJobEviction() {
+	select {
+	case evictJobsNow <- struct{}{}:
+	default:
+	}
+}
+
+// startJobEviction archives finished jobs every jobs.store.interval, and as
+// soon as the jobs map is full, until the returned func is called.
+// Replicas do not run jobs, so they only read the archive.
+func startJobEviction() func() {
+	var store evict.Config
+	if err := viper.UnmarshalKey("jobs.store", &store); err != nil {
+		logrus.WithError(err).Fatal("Invalid jobs.store config")
+	}
+	jobPolicy = evict.New("jobs", store)
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(jobsBucket)); b != nil {
+			jobPolicy.SetArchived(b.Stats().KeyN)
+		}
+		return nil
+	})
+	if isReplica() {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(viper.GetDuration("jobs.store.interval"))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-evictJobsNow:
+			}
+			evictJobs()
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
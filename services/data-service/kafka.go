@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/kafka"
+)
+
+// KafkaTopic is a topic the Kafka consumer ingests and the type of the
+// records its messages become.
+type KafkaTopic struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+}
+
+var (
+	kafkaMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_kafka_messages_total",
+			Help: "Kafka messages consumed, by topic and result",
+		},
+		[]string{"topic", "result"},
+	)
+	kafkaWriteDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "data_kafka_write_duration_seconds",
+			Help:    "Time to store one transaction of consumed Kafka messages",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	kafkaConsumerLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "data_kafka_consumer_lag",
+			Help: "Messages not yet consumed, by assigned topic partition",
+		},
+		[]string{"topic", "partition"},
+	)
+	kafkaConsumerOffset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "data_kafka_consumer_offset",
+			Help: "Next offset to consume, by assigned topic partition",
+		},
+		[]string{"topic", "partition"},
+	)
+
+	kafkaConsumer *kafka.Consumer
+)
+
+func init() {
+	prometheus.MustRegister(kafkaMessages, kafkaWriteDuration, kafkaConsumerLag, kafkaConsumerOffset)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "data_kafka_joined",
+			Help: "Whether the Kafka consumer is a member of its consumer group",
+		},
+		func() float64 {
+			if kafkaJoined() {
+				return 1
+			}
+			return 0
+		},
+	))
+}
+
+func kafkaJoined() bool {
+	return kafkaConsumer != nil && kafkaConsumer.Joined()
+}
+
+// startKafkaIngestion joins kafka.group_id and consumes kafka.topics when
+// kafka.enabled is set, storing every message as a record. The returned func
+// stops it.
+func startKafkaIngestion() func() {
+	if !viper.GetBool("kafka.enabled") {
+		return func() {}
+	}
+
+	var topics []KafkaTopic
+	if err := viper.UnmarshalKey("kafka.topics", &topics); err != nil {
+		logrus.WithError(err).Error("Invalid kafka.topics, Kafka ingestion disabled")
+		return func() {}
+	}
+	types := make(map[string]string, len(topics))
+	names := make([]string, 0, len(topics))
+	for _, t := range topics {
+		if t.Name == "" {
+			logrus.Error("Kafka topic without a name, Kafka ingestion disabled")
+			return func() {}
+		}
+		if t.Type == "" {
+			t.Type = "kafka"
+		}
+		types[t.Name] = t.Type
+		names = append(names, t.Name)
+	}
+	if len(names) == 0 {
+		logrus.Warn("kafka.enabled is set but kafka.topics is empty, Kafka ingestion disabled")
+		return func() {}
+	}
+	startOffset := viper.GetString("kafka.start_offset")
+	if startOffset != "earliest" && startOffset != "latest" {
+		logrus.WithField("start_offset", startOffset).Error("kafka.start_offset must be earliest or latest, Kafka ingestion disabled")
+		return func() {}
+	}
+
+	clientID := viper.GetString("kafka.client_id")
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "data-service-" + host
+	}
+	var tlsConfig *tls.Config
+	if viper.GetBool("kafka.tls") {
+		tlsConfig = &tls.Config{}
+	}
+	kafkaConsumer = kafka.NewConsumer(kafka.Config{
+		Brokers:           viper.GetStringSlice("kafka.brokers"),
+		ClientID:          clientID,
+		GroupID:           viper.GetString("kafka.group_id"),
+		Topics:            names,
+		StartOffset:       startOffset,
+		Username:          viper.GetString("kafka.username"),
+		Password:          viper.GetString("kafka.password"),
+		TLS:               tlsConfig,
+		SessionTimeout:    viper.GetDuration("kafka.session_timeout"),
+		MaxWait:           viper.GetDuration("kafka.max_wait"),
+		MaxBytes:          viper.GetInt32("kafka.max_fetch_bytes"),
+		MaxPartitionBytes: viper.GetInt32("kafka.max_partition_fetch_bytes"),
+		MaxReconnectDelay: viper.GetDuration("kafka.max_reconnect_delay"),
+	})
+
+	batchSize := max(viper.GetInt("kafka.batch_size"), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		kafkaConsumer.Run(ctx, func(batch kafka.Batch) error {
+			if err := storeKafkaMessages(ctx, types, batch.Messages, batchSize); err != nil {
+				return err
+			}
+			kafkaConsumerLag.Reset()
+			kafkaConsumerOffset.Reset()
+			for _, l := range batch.Lag {
+				partition := strconv.Itoa(int(l.Partition))
+				kafkaConsumerLag.WithLabelValues(l.Topic, partition).Set(float64(l.Lag()))
+				kafkaConsumerOffset.WithLabelValues(l.Topic, partition).Set(float64(l.Offset))
+			}
+			return nil
+		}, func(err error) {
+			logrus.WithError(err).WithField("group_id", viper.GetString("kafka.group_id")).Warn("Kafka consumer session ended, rejoining")
+		})
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"brokers":   viper.GetStringSlice("kafka.brokers"),
+		"group_id":  viper.GetString("kafka.group_id"),
+		"client_id": clientID,
+		"topics":    names,
+	}).Info("Kafka ingestion started")
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// storeKafkaMessages stores msgs in transactions of up to batchSize records.
+// A failed transaction is retried until ctx is cancelled, so the offsets of
+// a fetch are committed only once all its records are stored; a crash in
+// between redelivers the fetch and can store some records twice.
+func storeKafkaMessages(ctx context.Context, types map[string]string, msgs []kafka.Message, batchSize int) error {
+	received := time.Now()
+	records := make([]DataRecord, 0, len(msgs))
+	for _, m := range msgs {
+		record, err := kafkaRecord(types[m.Topic], m, received)
+		if err != nil {
+			// Redelivery would not make the message valid.
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"topic":     m.Topic,
+				"partition": m.Partition,
+				"offset":    m.Offset,
+			}).Warn("Dropping invalid Kafka message")
+			kafkaMessages.WithLabelValues(m.Topic, "invalid").Inc()
+			continue
+		}
+		records = append(records, record)
+	}
+
+	for start := 0; start < len(records); start += batchSize {
+		chunk := records[start:min(start+batchSize, len(records))]
+		for {
+			timer := prometheus.NewTimer(kafkaWriteDuration)
+			err := db.Update(func(tx *bolt.Tx) error {
+				for i := range chunk {
+					if err := putRecord(tx, &chunk[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			timer.ObserveDuration()
+			if err == nil {
+				break
+			}
+			logrus.WithError(err).WithField("records", len(chunk)).Error("Failed to store Kafka records, retrying")
+			select {
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+			case <-time.After(time.Second):
+			}
+		}
+		for _, record := range chunk {
+			kafkaMessages.WithLabelValues(record.Data["kafka_topic"], "ingested").Inc()
+		}
+		dataRecordsTotal.WithLabelValues("pending").Add(float64(len(chunk)))
+	}
+	return nil
+}
+
+// kafkaRecord converts a message to a pending record of recordType. data has
+// the message's kafka_topic, kafka_partition and kafka_offset, and its key
+// as kafka_key when it has one, base64-encoded unless it is UTF-8 text.
+func kafkaRecord(recordType string, m kafka.Message, received time.Time) (DataRecord, error) {
+	data := payloadData(m.Value)
+	data["kafka_topic"] = m.Topic
+	data["kafka_partition"] = strconv.Itoa(int(m.Partition))
+	data["kafka_offset"] = strconv.FormatInt(m.Offset, 10)
+	switch {
+	case len(m.Key) == 0:
+	case utf8.Valid(m.Key):
+		data["kafka_key"] = string(m.Key)
+	default:
+		data["kafka_key"] = base64.StdEncoding.EncodeToString(m.Key)
+		data["kafka_key_encoding"] = "base64"
+	}
+	return ingestedRecord(recordType, "kafka:"+m.Topic, data, received)
+}
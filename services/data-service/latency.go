@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+	"pipeline/pkg/tdigest"
+)
+
+// latencyBucket holds a t-digest of processing durations per hour and
+// record type, keyed by the hour's start in Unix seconds (8 bytes,
+// big-endian) followed by the type, so the hours of a window are adjacent.
+const latencyBucket = "latency_digests"
+
+func latencyKey(hour time.Time, recordType string) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(hour.Unix()))
+	return append(key, recordType...)
+}
+
+// recordLatency adds a record's processing duration to the digest of its
+// type for the hour it was processed in. It is called in the transaction
+// that marks the record processed, so each record is counted once. The
+// first duration of an hour also drops the hours past latency.retention.
+func recordLatency(tx *bolt.Tx, recordType string, processedAt time.Time, seconds float64) error {
+	b := tx.Bucket([]byte(latencyBucket))
+	hour := processedAt.Truncate(time.Hour)
+	key := latencyKey(hour, recordType)
+
+	digest := tdigest.New(viper.GetFloat64("latency.compression"))
+	if v := b.Get(key); v != nil {
+		if err := json.Unmarshal(v, digest); err != nil {
+			return fmt.Errorf("decode latency digest: %w", err)
+		}
+	} else if err := pruneLatency(b, processedAt); err != nil {
+		return err
+	}
+	digest.Add(seconds)
+	digest.Compact()
+	v, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
+}
+
+func pruneLatency(b *bolt.Bucket, now time.Time) error {
+	retention := viper.GetDuration("latency.retention")
+	if retention <= 0 {
+		return nil
+	}
+	cutoff := uint64(now.Add(-retention).Truncate(time.Hour).Unix())
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < cutoff; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatencyReport is the response of GET /records/latency.
+type LatencyReport struct {
+	Type        string    `json:"type,omitempty"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Count       int64     `json:"count"`
+	MinSeconds  float64   `json:"min_seconds"`
+	MeanSeconds float64   `json:"mean_seconds"`
+	P50Seconds  float64   `json:"p50_seconds"`
+	P95Seconds  float64   `json:"p95_seconds"`
+	P99Seconds  float64   `json:"p99_seconds"`
+	MaxSeconds  float64   `json:"max_seconds"`
+	// Types lists the record types included.
+	Types []string `json:"types"`
+}
+
+// latencyHandler serves GET /records/latency?type=&window=, processing
+// duration percentiles of the records processed within window (whole
+// hours, default 24h), merged from the stored hourly digests. Without type
+// every record type is included.
+func latencyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	recordType := q.Get("type")
+	window := 24 * time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if retention := viper.GetDuration("latency.retention"); retention > 0 && window > retention {
+		http.Error(w, fmt.Sprintf("window must not exceed latency.retention (%s)", retention), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	from := now.Add(-window).Truncate(time.Hour)
+	merged := tdigest.New(viper.GetFloat64("latency.compression"))
+	types := make(map[string]bool)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(latencyBucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(latencyKey(from, "")); k != nil; k, v = c.Next() {
+			t := string(k[8:])
+			if recordType != "" && t != recordType {
+				continue
+			}
+			var digest tdigest.Digest
+			if err := json.Unmarshal(v, &digest); err != nil {
+				return fmt.Errorf("decode latency digest: %w", err)
+			}
+			merged.Merge(&digest)
+			types[t] = true
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to read latency digests", http.StatusInternalServerError)
+		return
+	}
+
+	report := LatencyReport{Type: recordType, From: from.UTC(), To: now.UTC(), Count: int64(merged.Count), Types: []string{}}
+	for t := range types {
+		report.Types = append(report.Types, t)
+	}
+	sort.Strings(report.Types)
+	if merged.Count > 0 {
+		report.MinSeconds = merged.Min
+		report.MeanSeconds = merged.Mean()
+		report.P50Seconds = merged.Quantile(0.5)
+		report.P95Seconds = merged.Quantile(0.95)
+		report.P99Seconds = merged.Quantile(0.99)
+		report.MaxSeconds = merged.Max
+	}
+	response.Write(w, r, http.StatusOK, report, nil)
+}
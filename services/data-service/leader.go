@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/leader"
+)
+
+// elector decides which replica runs the background loops; nil when
+// leader_election.enabled is false, in which case every instance leads.
+var elector *leader.Elector
+
+// isLeader reports whether this instance should run background processing.
+func isLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+// startLeaderElection campaigns for the processing lease until the returned
+// func is called, which also releases the lease.
+func startLeaderElection() context.CancelFunc {
+	if !viper.GetBool("leader_election.enabled") {
+		return func() {}
+	}
+
+	name := viper.GetString("leader_election.lease_name")
+	var lock leader.Lock
+	switch backend := viper.GetString("leader_election.backend"); backend {
+	case "kubernetes":
+		k8sLock, err := leader.NewKubernetesLock(name, viper.GetString("leader_election.kubernetes.namespace"))
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to set up Kubernetes leader election")
+		}
+		lock = k8sLock
+	case "file":
+		lock = &leader.FileLock{Path: viper.GetString("leader_election.file.path")}
+	default:
+		logrus.WithField("backend", backend).Fatal("Unknown leader_election.backend")
+	}
+
+	identity := viper.GetString("leader_election.identity")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	elector = leader.NewElector(lock, leader.Config{
+		Name:          name,
+		Identity:      identity,
+		LeaseDuration: viper.GetDuration("leader_election.lease_duration"),
+		RenewPeriod:   viper.GetDuration("leader_election.renew_period"),
+		OnChange: func(isLeader bool) {
+			logrus.WithFields(logrus.Fields{
+				"lease":     name,
+				"identity":  identity,
+				"is_leader": isLeader,
+			}).Info("Leadership changed")
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		elector.Run(ctx, func(err error) {
+			logrus.WithError(err).Warn("Leader election failed")
+		})
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ledgerBucket holds one LedgerEntry per processed record, keyed by record
+// ID. An entry is written in the same transaction that marks the record
+// processed, so a record's processing is applied at most once however often
+// it is retried.
+const ledgerBucket = "processing_ledger"
+
+// errAlreadyProcessed is returned when a record's processing was applied by
+// an earlier run, e.g. one that committed just before a crash, or a job
+// racing the processing loop.
+var errAlreadyProcessed = errors.New("record already processed")
+
+// errRecordGone is returned when a record was deleted while it was being
+// processed.
+var errRecordGone = errors.New("record deleted during processing")
+
+var processingLedger = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_processing_ledger_total",
+		Help: "Record processing attempts checked against the idempotency ledger, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(processingLedger)
+}
+
+// LedgerEntry records which processing run applied a record's processing.
+type LedgerEntry struct {
+	RecordID  string    `json:"record_id"`
+	Run       string    `json:"run"`
+	Worker    string    `json:"worker,omitempty"`
+	JobID     string    `json:"job_id,omitempty"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+// ledgerOutcome is the processing_ledger_total outcome of err.
+func ledgerOutcome(err error) string {
+	switch err {
+	case nil:
+		return "applied"
+	case errAlreadyProcessed:
+		return "duplicate"
+	case errRecordGone:
+		return "missing"
+	case errClaimLost:
+		return "claim_lost"
+	}
+	return "error"
+}
+
+// processedBefore reports whether the ledger already has an entry for the
+// record, so a worker can skip it before doing the work.
+func processedBefore(recordID string) bool {
+	found := false
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(ledgerBucket)); b != nil {
+			found = b.Get([]byte(recordID)) != nil
+		}
+		return nil
+	})
+	return found
+}
+
+// recordProcessing adds entry to the ledger in tx. It fails with
+// errAlreadyProcessed if the record has an entry or was stored as processed
+// already, and with errRecordGone if it no longer exists.
+func recordProcessing(tx *bolt.Tx, entry LedgerEntry) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(ledgerBucket))
+	if err != nil {
+		return err
+	}
+	if b.Get([]byte(entry.RecordID)) != nil {
+		return errAlreadyProcessed
+	}
+	_, v := findRecord(tx, []byte(entry.RecordID))
+	if v == nil {
+		return errRecordGone
+	}
+	var current DataRecord
+	if err := json.Unmarshal(v, &current); err != nil {
+		return err
+	}
+	if current.Processed {
+		return errAlreadyProcessed
+	}
+	return putLedgerEntry(b, entry)
+}
+
+func putLedgerEntry(b *bolt.Bucket, entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(entry.RecordID), data)
+}
+
+// removeLedgerEntry drops a deleted record's entry.
+func removeLedgerEntry(tx *bolt.Tx, recordID []byte) error {
+	b := tx.Bucket([]byte(ledgerBucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(recordID)
+}
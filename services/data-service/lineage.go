@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+
+	"pipeline/pkg/propagation"
+	"pipeline/pkg/response"
+)
+
+// appliedTransformsHeader lists the gateway request transforms a proxied
+// request went through, in order. The gateway strips it from client
+// requests.
+const appliedTransformsHeader = "X-Applied-Transforms"
+
+// Lineage limits.
+const (
+	maxParents            = 100
+	defaultLineageDepth   = 5
+	maxLineageDepth       = 20
+	maxLineageAncestors   = 1000
+	maxLineageTransforms  = 20
+	maxLineageSourceBytes = 200
+)
+
+// Lineage is the provenance of a record: where it came from, the records it
+// was derived from and every stage that changed it. It is stored in the
+// record, so it is replicated, archived and erased along with it, but left
+// out of record responses; GET /api/v1/records/{id}/lineage serves it.
+type Lineage struct {
+	Source  string         `json:"source,omitempty"`
+	Parents []string       `json:"parents,omitempty"`
+	Stages  []LineageStage `json:"stages,omitempty"`
+}
+
+// LineageStage is one step of a record's history: a gateway transform,
+// ingestion, masking or processing by a job.
+type LineageStage struct {
+	Stage  string    `json:"stage"`
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// newLineage returns the lineage of a record ingested at at from source,
+// after the given gateway transforms, with the given fields masked.
+func newLineage(source string, parents, transforms, masked []string, at time.Time) *Lineage {
+	l := &Lineage{Source: source, Parents: parents}
+	for _, t := range transforms {
+		l.Stages = append(l.Stages, LineageStage{Stage: "transform", Actor: "api-gateway", Detail: t, At: at})
+	}
+	l.Stages = append(l.Stages, LineageStage{Stage: "ingest", Actor: "data-service", At: at})
+	if len(masked) > 0 {
+		l.Stages = append(l.Stages, LineageStage{Stage: "masking", Actor: "data-service", Detail: strings.Join(masked, ", "), At: at})
+	}
+	return l
+}
+
+// lineageOf returns the lineage of record. Records stored before lineage was
+// tracked get one reconstructed from their fields.
+func lineageOf(record DataRecord) Lineage {
+	if record.Lineage != nil {
+		return *record.Lineage
+	}
+	l := Lineage{Source: "unknown", Stages: []LineageStage{{Stage: "ingest", Actor: "data-service", At: record.Timestamp}}}
+	if record.Processed && record.ProcessedAt != nil {
+		l.Stages = append(l.Stages, LineageStage{Stage: "processing", Detail: jobDetail(record.JobID), At: *record.ProcessedAt})
+	}
+	return l
+}
+
+// jobDetail describes the job of a processing stage; background workers
+// process records outside of jobs.
+func jobDetail(jobID string) string {
+	if jobID == "" {
+		return ""
+	}
+	return "job " + jobID
+}
+
+// addLineageStage appends a stage to record's lineage.
+func addLineageStage(record *DataRecord, stage LineageStage) {
+	if record.Lineage == nil {
+		l := lineageOf(*record)
+		record.Lineage = &l
+	}
+	record.Lineage.Stages = append(record.Lineage.Stages, stage)
+}
+
+// lineageSource names where a new record came from: the source the client
+// declared, else the API key the gateway authenticated it with.
+func lineageSource(r *http.Request, declared string) (string, error) {
+	if len(declared) > maxLineageSourceBytes {
+		return "", fmt.Errorf("source is longer than %d bytes", maxLineageSourceBytes)
+	}
+	if declared != "" {
+		return declared, nil
+	}
+	if key := propagation.FromRequest(r).APIKeyID; key != "" {
+		return "api_key:" + key, nil
+	}
+	return "api", nil
+}
+
+// appliedTransforms reads the gateway transforms r went through.
+func appliedTransforms(r *http.Request) []string {
+	var names []string
+	for _, name := range strings.Split(r.Header.Get(appliedTransformsHeader), ",") {
+		if name = strings.TrimSpace(name); name != "" && len(names) < maxLineageTransforms {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkParents verifies that every parent of a new record is stored or
+// archived.
+func checkParents(tx *bolt.Tx, parents []string) error {
+	if len(parents) > maxParents {
+		return fmt.Errorf("at most %d parents", maxParents)
+	}
+	seen := make(map[string]bool, len(parents))
+	for _, id := range parents {
+		if seen[id] {
+			return fmt.Errorf("duplicate parent %q", id)
+		}
+		seen[id] = true
+		if _, v := findRecord(tx, []byte(id)); v != nil {
+			continue
+		}
+		if tx.Bucket([]byte("archive_manifest")).Get([]byte(id)) != nil {
+			continue
+		}
+		return fmt.Errorf("unknown parent record %q", id)
+	}
+	return nil
+}
+
+// lineageNode is a record's lineage in a lineage response. Ancestors that
+// were deleted or archived are listed as missing.
+type lineageNode struct {
+	RecordID string `json:"record_id"`
+	Type     string `json:"type,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+	Depth    int    `json:"depth"`
+	Missing  bool   `json:"missing,omitempty"`
+	Lineage
+}
+
+// lineageResponse is a record's lineage and that of its ancestors, nearest
+// first, each listed once.
+type lineageResponse struct {
+	Record    lineageNode   `json:"record"`
+	Ancestors []lineageNode `json:"ancestors"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// getRecordLineageHandler serves GET /api/v1/records/{id}/lineage?depth=,
+// walking parents up to depth generations.
+func getRecordLineageHandler(w http.ResponseWriter, r *http.Request) {
+	recordID := mux.Vars(r)["id"]
+	depth := defaultLineageDepth
+	if v := r.URL.Query().Get("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > maxLineageDepth {
+			http.Error(w, fmt.Sprintf("invalid depth %q: must be between 0 and %d", v, maxLineageDepth), http.StatusBadRequest)
+			return
+		}
+		depth = d
+	}
+
+	var result lineageResponse
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		node := func(id string, d int) (lineageNode, error) {
+			_, v := findRecord(tx, []byte(id))
+			if v == nil {
+				return lineageNode{RecordID: id, Depth: d, Missing: true}, nil
+			}
+			var record DataRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return lineageNode{}, err
+			}
+			return lineageNode{RecordID: id, Type: record.Type, JobID: record.JobID, Depth: d, Lineage: lineageOf(record)}, nil
+		}
+
+		root, err := node(recordID, 0)
+		if err != nil || root.Missing {
+			return err
+		}
+		found = true
+		result.Record = root
+		result.Ancestors = []lineageNode{}
+
+		seen := map[string]bool{recordID: true}
+		queue := []lineageNode{root}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			if current.Depth == depth {
+				result.Truncated = result.Truncated || len(current.Parents) > 0
+				continue
+			}
+			for _, parent := range current.Parents {
+				if seen[parent] {
+					continue
+				}
+				if len(result.Ancestors) == maxLineageAncestors {
+					result.Truncated = true
+					return nil
+				}
+				seen[parent] = true
+				ancestor, err := node(parent, current.Depth+1)
+				if err != nil {
+					return err
+				}
+				result.Ancestors = append(result.Ancestors, ancestor)
+				queue = append(queue, ancestor)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to read lineage", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "record not found", http.StatusNotFound)
+		return
+	}
+
+	response.Write(w, r, http.StatusOK, result, response.Links{
+		"self":   response.Link(r, apiPath(r, "/records/"+recordID+"/lineage")),
+		"record": response.Link(r, apiPath(r, "/records/"+recordID)),
+	})
+}
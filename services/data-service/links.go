@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+
+	"pipeline/pkg/response"
+)
+
+// recordLinks links a record to itself, its lineage, the record collection
+// and the job that processed it, if one did, all under the API version of r.
+func recordLinks(r *http.Request, record DataRecord) response.Links {
+	links := response.Links{
+		"self":       response.Link(r, apiPath(r, "/records/"+record.ID)),
+		"lineage":    response.Link(r, apiPath(r, "/records/"+record.ID+"/lineage")),
+		"collection": response.Link(r, apiPath(r, "/records")),
+	}
+	if record.JobID != "" {
+		links["job"] = response.Link(r, apiPath(r, "/jobs/"+record.JobID))
+	}
+	return links
+}
+
+// jobLinks links a job to itself, the job collection and the records it
+// processed, all under the API version of r.
+func jobLinks(r *http.Request, job ProcessingJob) response.Links {
+	return response.Links{
+		"self":       response.Link(r, apiPath(r, "/jobs/"+job.ID)),
+		"collection": response.Link(r, apiPath(r, "/jobs")),
+		"records":    response.Link(r, apiPath(r, "/records?job_id="+url.QueryEscape(job.ID))),
+		"logs":       response.Link(r, apiPath(r, "/jobs/"+job.ID+"/logs")),
+	}
+}
+
+// recordFilter narrows GET /api/v1/records. Zero values match everything;
+// IDs and JobIDs match any of their members.
+type recordFilter struct {
+	IDs       map[string]bool
+	Type      string
+	JobIDs    map[string]bool
+	Processed *bool
+	// OrderID and CorrelationID are served from their indexes.
+	OrderID       string
+	CorrelationID string
+	// Data holds the data.<key>=<value> parameters: records whose data has
+	// every key with that value, e.g. data.order_id links records to an
+	// order.
+	Data map[string]string
+}
+
+func parseRecordFilter(r *http.Request) (recordFilter, error) {
+	q := r.URL.Query()
+	filter := recordFilter{Type: q.Get("type"), OrderID: q.Get("order_id"), CorrelationID: q.Get("correlation_id")}
+	ids, err := response.ParseIDs(r)
+	if err != nil {
+		return filter, err
+	}
+	filter.IDs = ids
+	if jobIDs := q["job_id"]; len(jobIDs) > 0 {
+		filter.JobIDs = make(map[string]bool, len(jobIDs))
+		for _, id := range jobIDs {
+			filter.JobIDs[id] = true
+		}
+	}
+	if v := q.Get("processed"); v != "" {
+		processed, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid processed %q", v)
+		}
+		filter.Processed = &processed
+	}
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, "data.")
+		if !ok {
+			continue
+		}
+		if key == "" || len(values) != 1 {
+			return filter, fmt.Errorf("invalid %s: one value of a named key is expected", param)
+		}
+		if filter.Data == nil {
+			filter.Data = make(map[string]string)
+		}
+		filter.Data[key] = values[0]
+	}
+	return filter, nil
+}
+
+func (f recordFilter) matches(record DataRecord) bool {
+	if f.IDs != nil && !f.IDs[record.ID] {
+		return false
+	}
+	if f.Type != "" && record.Type != f.Type {
+		return false
+	}
+	if f.JobIDs != nil && !f.JobIDs[record.JobID] {
+		return false
+	}
+	if f.OrderID != "" && record.OrderID != f.OrderID {
+		return false
+	}
+	if f.CorrelationID != "" && record.CorrelationID != f.CorrelationID {
+		return false
+	}
+	for key, value := range f.Data {
+		if v, ok := record.Data[key]; !ok || v != value {
+			return false
+		}
+	}
+	return f.Processed == nil || record.Processed == *f.Processed
+}
+
+// keyCursor walks records in key order.
+type keyCursor interface {
+	First() ([]byte, []byte)
+	Next() ([]byte, []byte)
+}
+
+// cursor returns the cheapest cursor over the records f can match: an index
+// when f names an order or correlation ID, otherwise every record.
+func (f recordFilter) cursor(tx *bolt.Tx) keyCursor {
+	if f.CorrelationID != "" {
+		if c := correlationIndex.cursor(tx, f.CorrelationID); c != nil {
+			return c
+		}
+	}
+	if f.OrderID != "" {
+		if c := orderIndex.cursor(tx, f.OrderID); c != nil {
+			return c
+		}
+	}
+	return newRecordCursor(tx, -1)
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,6 +23,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+
+	"pipeline/pkg/apiversion"
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/codec"
+	"pipeline/pkg/response"
+	"pipeline/pkg/telemetry"
 )
 
 type DataRecord struct {
@@ -27,6 +38,25 @@ type DataRecord struct {
 	Timestamp   time.Time         `json:"timestamp"`
 	Processed   bool              `json:"processed"`
 	ProcessedAt *time.Time        `json:"processed_at,omitempty"`
+	Sequence    uint64            `json:"seq,omitempty"`
+	// Priority is the record's processing lane, derived from data.priority
+	// when it is stored.
+	Priority    int               `json:"priority,omitempty"`
+	TraceID     string            `json:"trace_id,omitempty"`
+	ClaimedBy   string            `json:"claimed_by,omitempty"`
+	LeaseExpiry *time.Time        `json:"lease_expiry,omitempty"`
+	JobID       string            `json:"job_id,omitempty"`
+	// OrderID links the record to a business-service order; CorrelationID
+	// groups records of one cross-service flow. Both are indexed.
+	OrderID       string `json:"order_id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Lineage is stored with the record but only served by
+	// /records/{id}/lineage.
+	Lineage *Lineage `json:"lineage,omitempty"`
+
+	// Links is set on records listed in a collection response; it is not
+	// stored.
+	Links map[string]string `json:"links,omitempty"`
 }
 
 type DataMetrics struct {
@@ -35,6 +65,7 @@ type DataMetrics struct {
 	PendingRecords    int     `json:"pending_records"`
 	ProcessingRate    float64 `json:"processing_rate_per_second"`
 	DataSize          int64   `json:"data_size_bytes"`
+	DatabaseSize      int64   `json:"database_size_bytes"`
 }
 
 type ProcessingJob struct {
@@ -44,15 +75,54 @@ type ProcessingJob struct {
 	EndTime   *time.Time `json:"end_time,omitempty"`
 	Records   int       `json:"records_processed"`
 	Error     string    `json:"error,omitempty"`
+
+	// Priority orders the jobs waiting for a free slot, higher first.
+	// QueuePosition is the place of a pending job in that queue.
+	Priority      int `json:"priority,omitempty"`
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	// Reprocess selects the records a reprocessing job resets and
+	// processes again, Deletion those a deletion job deletes.
+	// RecordsMatched is how many they selected; a deletion job's progress
+	// is RecordsDeleted of RecordsMatched.
+	Reprocess      *RecordSelector `json:"reprocess,omitempty"`
+	Deletion       *DeletionFilter `json:"deletion,omitempty"`
+	RecordsMatched int             `json:"records_matched,omitempty"`
+	RecordsDeleted int             `json:"records_deleted,omitempty"`
+
+	// Generate describes the test records a generation job creates; its
+	// progress is RecordsGenerated of Generate.Count.
+	Generate         *GenerateSpec `json:"generate,omitempty"`
+	RecordsGenerated int           `json:"records_generated,omitempty"`
+
+	// CallbackURL and the Notify channels are sent a JobNotification when
+	// the job finishes.
+	CallbackURL string   `json:"callback_url,omitempty"`
+	Notify      []string `json:"notify,omitempty"`
+
+	// Links is set on jobs listed in a collection response.
+	Links map[string]string `json:"links,omitempty"`
 }
 
+// version and commit are set at build time via -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "1.0.0"
+	commit  = "unknown"
+)
+
 var (
 	startTime = time.Now()
 	db        *bolt.DB
-	jobs      = make(map[string]ProcessingJob)
+	// jobs is guarded by jobsMu; see getJob, putJob and updateJob.
+	jobsMu sync.RWMutex
+	jobs   = make(map[string]ProcessingJob)
 
-	// Prometheus metrics
-	httpRequestsTotal = prometheus.NewCounterVec(
+	// Prometheus metrics; histograms are built by registerHistograms once
+	// the bucket configuration has been loaded.
+	httpRequestDuration    *telemetry.LimitedHistogramVec
+	dataProcessingDuration *telemetry.LimitedHistogramVec
+
+	httpRequestsTotal = telemetry.NewLimitedCounterVec(
 		prometheus.CounterOpts{
 			Name: "data_http_requests_total",
 			Help: "Total number of HTTP requests for data service",
@@ -60,15 +130,6 @@ var (
 		[]string{"method", "endpoint", "status"},
 	)
 
-	httpRequestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "data_http_request_duration_seconds",
-			Help:    "HTTP request duration for data service",
-			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
-		},
-		[]string{"method", "endpoint", "status"},
-	)
-
 	dataRecordsTotal = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "data_records_total",
@@ -77,15 +138,6 @@ var (
 		[]string{"status"},
 	)
 
-	dataProcessingDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "data_processing_duration_seconds",
-			Help:    "Time taken to process data records",
-			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30},
-		},
-		[]string{"record_type"},
-	)
-
 	dataSizeBytes = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "data_size_bytes",
@@ -99,77 +151,304 @@ var (
 			Help: "Number of active data processing jobs",
 		},
 	)
+
+	replicaLagChanges = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_replica_lag_changes",
+			Help: "Changes in the writer's feed not yet applied by this replica",
+		},
+	)
+
+	replicaAppliedSequence = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_replica_applied_sequence",
+			Help: "Last writer change sequence applied by this replica",
+		},
+	)
+
+	recordClaims = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_record_claims_total",
+			Help: "Record lease outcomes when processing.claims is enabled",
+		},
+		[]string{"result"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(httpRequestDuration)
 	prometheus.MustRegister(dataRecordsTotal)
-	prometheus.MustRegister(dataProcessingDuration)
 	prometheus.MustRegister(dataSizeBytes)
 	prometheus.MustRegister(activeJobs)
+	prometheus.MustRegister(recordClaims)
+	prometheus.MustRegister(replicaLagChanges)
+	prometheus.MustRegister(replicaAppliedSequence)
 
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 	logrus.SetLevel(logrus.InfoLevel)
 }
 
+// registerHistograms builds and registers the duration histograms using the
+// configured buckets and native histogram settings.
+func registerHistograms() {
+	httpRequestDuration = telemetry.NewLimitedHistogramVec(
+		bootstrap.HistogramSettings(viper.GetViper(), "http_request_duration").Apply(prometheus.HistogramOpts{
+			Name:    "data_http_request_duration_seconds",
+			Help:    "HTTP request duration for data service",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		}),
+		[]string{"method", "endpoint", "status"},
+	)
+	prometheus.MustRegister(httpRequestDuration)
+
+	dataProcessingDuration = telemetry.NewLimitedHistogramVec(
+		bootstrap.HistogramSettings(viper.GetViper(), "processing_duration").Apply(prometheus.HistogramOpts{
+			Name:    "data_processing_duration_seconds",
+			Help:    "Time taken to process data records",
+			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30},
+		}),
+		[]string{"record_type"},
+	)
+	prometheus.MustRegister(dataProcessingDuration)
+}
+
 func main() {
 	loadConfig()
+	applyLogLevel()
+	stopLogShipping := bootstrap.StartLogShipping(viper.GetViper(), "data-service")
+	defer stopLogShipping()
+	telemetry.ConfigureCardinality(viper.GetInt("metrics.cardinality_limit"), func(metric string, labelValues []string) {
+		logrus.WithFields(logrus.Fields{
+			"metric": metric,
+			"labels": labelValues,
+			"limit":  viper.GetInt("metrics.cardinality_limit"),
+		}).Warn("Metric cardinality limit reached, collapsing new label sets into \"other\"")
+	})
+	registerHistograms()
+	loadPrivacyConfig()
+	if err := checkArchiveBackend(); err != nil {
+		logrus.WithError(err).Fatal("Invalid archive config")
+	}
+	loadTopKConfig()
+	loadEnrichmentConfig()
+	loadSLAConfig()
+	loadSourceLimits()
+	telemetry.RegisterBuildInfo(version, commit)
+	telemetry.RegisterFeatureFlags(featureFlags())
+	apdex = bootstrap.NewApdex(viper.GetViper(), "data")
+	requestLogger = bootstrap.NewRequestLogger(viper.GetViper(), "Data service request", contextLogFields)
+
+	stopSinks := bootstrap.StartMetricSinks(viper.GetViper(), "data-service")
+	defer stopSinks()
+	stopRuntime := bootstrap.StartRuntimeMetrics(viper.GetViper())
+	defer stopRuntime()
+	stopProfiling := bootstrap.StartProfiling(viper.GetViper(), "data-service", version)
+	defer stopProfiling()
+	auditor := bootstrap.StartShutdownAudit(viper.GetViper())
 
 	// Initialize database
 	var err error
-	db, err = bolt.Open("data.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err = bolt.Open(databasePath(), 0600, databaseOptions())
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to open database")
 	}
 	defer db.Close()
+	// Audited before the database closes, which waits for the transactions
+	// still open.
+	var drainErr error
+	defer func() {
+		bootstrap.FinishShutdownAudit(auditor, drainErr, db.Stats().OpenTxN)
+	}()
 
-	// Create buckets
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("records"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+	if err := createBuckets(); err != nil && err != bolt.ErrDatabaseReadOnly {
+		logrus.WithError(err).Fatal("Failed to create buckets")
+	}
+
+	if err := buildPendingIndex(); err != nil && err != bolt.ErrDatabaseReadOnly {
+		logrus.WithError(err).Warn("Failed to build pending record index")
+	}
+	if err := loadRecordStats(); err != nil {
+		logrus.WithError(err).Warn("Failed to load record stats")
+	}
+	stopJobEviction := startJobEviction()
+	defer stopJobEviction()
+
+	// Start background data processing; replicas only serve reads.
+	if isReplica() {
+		logrus.WithField("mode", replicaMode()).Info("Running as read-only replica")
+		if replicaMode() == replicaFollow {
+			go followWriter()
+			go truncateChangesContinuously()
+		}
+	} else {
+		stopLeaderElection := startLeaderElection()
+		defer stopLeaderElection()
+
+		stopAnomalyDetection := startAnomalyDetection()
+		defer stopAnomalyDetection()
+
+		go processDataContinuously()
+		if viper.GetBool("archive.enabled") {
+			go archiveContinuously()
+		}
+		if viper.GetBool("metric_tiers.enabled") {
+			go downsampleMetricsContinuously()
 		}
-		_, err = tx.CreateBucketIfNotExists([]byte("jobs"))
+		go refreshViewsContinuously()
+		go quarantineContinuously()
+		go watchSLAsContinuously()
+		go truncateChangesContinuously()
+
+		stopMQTTIngestion := startMQTTIngestion()
+		defer stopMQTTIngestion()
+		stopKafkaIngestion := startKafkaIngestion()
+		defer stopKafkaIngestion()
+		stopSyslogIngestion := startSyslogIngestion()
+		defer stopSyslogIngestion()
+		if viper.GetBool("prom_write.enabled") {
+			stopPromFlush := make(chan struct{})
+			defer close(stopPromFlush)
+			go flushPromWindowsContinuously(stopPromFlush)
+		}
+		if viper.GetBool("otlp_receiver.enabled") {
+			stopTraceFlush := make(chan struct{})
+			defer close(stopTraceFlush)
+			go flushTracesContinuously(stopTraceFlush)
+		}
+		stopGRPCServer := startGRPCServer()
+		defer stopGRPCServer()
+	}
+	if viper.GetBool("processing.reconcile.enabled") {
+		go reconcileContinuously()
+	}
+
+	actors, err := newAuditActors()
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid audit.trusted_proxies config")
+	}
+	auditActors = actors
+	if viper.GetBool("audit.enabled") {
+		recorder, err := newAuditRecorder("data-service")
 		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+			logrus.WithError(err).Fatal("Failed to open audit log")
 		}
-		return nil
-	})
+		auditRecorder = recorder
+	}
+
+	guard, err := bootstrap.NewAccessGuard(viper.GetViper())
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to create buckets")
+		logrus.WithError(err).Fatal("Invalid endpoint_protection config")
 	}
 
-	// Start background data processing
-	go processDataContinuously()
+	signatureVerifier, err := bootstrap.NewSignatureVerifier(viper.GetViper())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid request_signing config")
+	}
+
+	loadShedder := bootstrap.NewLoadShedder(viper.GetViper())
+	defer loadShedder.Close()
 
 	router := mux.NewRouter()
 
 	// Middleware
 	router.Use(loggingMiddleware)
 	router.Use(metricsMiddleware)
+	router.Use(backpressureMiddleware)
+	router.Use(loadShedder.Wrap)
+	if signatureVerifier != nil {
+		router.Use(signatureVerifier.Wrap)
+	}
+	router.Use(auditMiddleware)
+	if isReplica() {
+		router.Use(readOnlyMiddleware)
+	}
 
 	// Routes
 	router.HandleFunc("/", homeHandler).Methods("GET")
 	router.HandleFunc("/health", healthHandler).Methods("GET")
 	router.HandleFunc("/ready", readinessHandler).Methods("GET")
-	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+	router.Handle("/metrics", guard.Wrap(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		// OpenMetrics is required for exemplars to be exposed.
+		EnableOpenMetrics: true,
+	}))).Methods("GET")
+	router.Handle("/admin/config", guard.Wrap(configSources.Handler())).Methods("GET")
+	router.Handle("/admin/log-level", guard.WrapFunc(logLevelHandler)).Methods("GET")
+	router.Handle("/admin/log-level", guard.WrapFunc(setLogLevelHandler)).Methods("PUT")
+	router.Handle("/admin/processing", guard.WrapFunc(processingStateHandler)).Methods("GET")
+	router.Handle("/admin/processing/pause", guard.WrapFunc(pauseProcessingHandler)).Methods("POST")
+	router.Handle("/admin/processing/resume", guard.WrapFunc(resumeProcessingHandler)).Methods("POST")
+	router.Handle("/admin/backup", guard.WrapFunc(backupHandler)).Methods("POST")
+
+	v1, v2, err := newAPIVersions(router)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid api config")
+	}
 
-	// Data endpoints
+	// Data endpoints. v2 serves the same resources without the worker lease
+	// fields; admin endpoints and the change feed are only served under v1.
+	for _, version := range []*apiversion.Version{v1, v2} {
+		api := router.PathPrefix(version.Prefix).Subrouter()
+		api.Use(version.Wrap)
+		api.HandleFunc("/records", createRecordHandler).Methods("POST")
+		api.HandleFunc("/records", getRecordsHandler).Methods("GET")
+		api.HandleFunc("/records/export", exportRecordsHandler).Methods("GET")
+		api.HandleFunc("/records/stats", recordStatsHandler).Methods("GET")
+		api.HandleFunc("/records/topk", topKHandler).Methods("GET")
+		api.HandleFunc("/records/latency", latencyHandler).Methods("GET")
+		api.HandleFunc("/records/{id}", getRecordHandler).Methods("GET")
+		api.HandleFunc("/records/{id}/lineage", getRecordLineageHandler).Methods("GET")
+		api.HandleFunc("/jobs", createJobHandler).Methods("POST")
+		api.HandleFunc("/jobs", getJobsHandler).Methods("GET")
+		api.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+		api.HandleFunc("/jobs/{id}/logs", getJobLogsHandler).Methods("GET")
+		api.HandleFunc("/jobs/{id}/cancel", cancelJobHandler).Methods("POST")
+		api.HandleFunc("/metrics", dataMetricsHandler).Methods("GET")
+	}
 	api := router.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/records", createRecordHandler).Methods("POST")
-	api.HandleFunc("/records", getRecordsHandler).Methods("GET")
-	api.HandleFunc("/records/{id}", getRecordHandler).Methods("GET")
-	api.HandleFunc("/jobs", createJobHandler).Methods("POST")
-	api.HandleFunc("/jobs", getJobsHandler).Methods("GET")
-	api.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
-	api.HandleFunc("/metrics", dataMetricsHandler).Methods("GET")
-	api.HandleFunc("/generate", generateTestData).Methods("POST")
-	api.HandleFunc("/cleanup", cleanupOldRecords).Methods("DELETE")
+	api.Use(v1.Wrap)
+	api.Handle("/records", guard.WrapFunc(deleteRecordsHandler)).Methods("DELETE")
+	api.Handle("/records/reprocess", guard.WrapFunc(reprocessRecordsHandler)).Methods("POST")
+	api.Handle("/generate", guard.WrapFunc(generateTestData)).Methods("POST")
+	api.Handle("/cleanup", guard.WrapFunc(cleanupOldRecords)).Methods("DELETE")
+	api.Handle("/deletions", guard.WrapFunc(getDeletionReportsHandler)).Methods("GET")
+	api.Handle("/archive", guard.WrapFunc(archiveHandler)).Methods("POST")
+	api.Handle("/reconcile", guard.WrapFunc(reconcileHandler)).Methods("POST")
+	api.Handle("/snapshots", guard.WrapFunc(listSnapshotsHandler)).Methods("GET")
+	// Saving, deleting and restoring snapshots replace the service's state,
+	// so without endpoint_protection they are not served at all.
+	if guard.Enabled() {
+		api.Handle("/snapshots/{name}", guard.WrapFunc(createSnapshotHandler)).Methods("PUT")
+		api.Handle("/snapshots/{name}", guard.WrapFunc(deleteSnapshotHandler)).Methods("DELETE")
+		api.Handle("/snapshots/{name}/restore", guard.WrapFunc(restoreSnapshotHandler)).Methods("POST")
+	}
+	api.HandleFunc("/backpressure", backpressureHandler).Methods("GET")
+	api.HandleFunc("/changes", getChangesHandler).Methods("GET")
+	api.HandleFunc("/changes/stream", streamChangesHandler).Methods("GET")
+	if viper.GetBool("prom_write.enabled") {
+		api.HandleFunc("/prom/write", promWriteHandler).Methods("POST")
+	}
+	api.HandleFunc("/traces/slow", slowTracesHandler).Methods("GET")
+	api.HandleFunc("/metrics/query", metricQueryHandler).Methods("GET")
+	api.Handle("/views", guard.WrapFunc(createViewHandler)).Methods("POST")
+	api.HandleFunc("/views", getViewsHandler).Methods("GET")
+	api.HandleFunc("/views/{name}", getViewHandler).Methods("GET")
+	api.Handle("/views/{name}", guard.WrapFunc(deleteViewHandler)).Methods("DELETE")
+	api.Handle("/quarantine", guard.WrapFunc(getQuarantineHandler)).Methods("GET")
+	api.Handle("/quarantine/{id}", guard.WrapFunc(getQuarantinedHandler)).Methods("GET")
+	api.Handle("/quarantine/{id}", guard.WrapFunc(repairQuarantinedHandler)).Methods("PUT")
+	api.Handle("/quarantine/{id}", guard.WrapFunc(deleteQuarantinedHandler)).Methods("DELETE")
+	api.Handle("/quarantine/{id}/requeue", guard.WrapFunc(requeueQuarantinedHandler)).Methods("POST")
+	if viper.GetBool("otlp_receiver.enabled") {
+		// The OTLP/HTTP path, which exporters append to their endpoint.
+		router.HandleFunc("/v1/traces", otlpTracesHandler).Methods("POST")
+	}
+	if auditRecorder != nil {
+		api.Handle("/audit", guard.Wrap(auditRecorder.Handler())).Methods("GET")
+	}
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%s", viper.GetString("port")),
-		Handler:      router,
+		Handler:      auditor.Wrap(router),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -182,23 +461,46 @@ func main() {
 			logrus.WithError(err).Fatal("Server failed to start")
 		}
 	}()
+	stopRegistration := startRegistration()
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// Withdrawn first so the gateway stops routing here while in-flight
+	// requests drain.
+	stopRegistration()
 	logrus.Info("Shutting down data service...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown.drain_timeout"))
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		logrus.WithError(err).Error("Server forced to shutdown")
+	if drainErr = srv.Shutdown(ctx); drainErr != nil {
+		logrus.WithError(drainErr).Error("Server forced to shutdown")
 	}
 
 	logrus.Info("Data service exited")
 }
 
+// createBuckets creates the buckets of the database that do not exist yet.
+func createBuckets() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		names := []string{jobsBucket, "deletion_reports", "archive_manifest", "changes", "replica_state", ledgerBucket, promWindowsBucket, traceStateBucket, metricTiersBucket, latencyBucket, viewsBucket, viewDataBucket, quarantineBucket, jobLogsBucket, failuresBucket}
+		for _, ix := range recordIndexes {
+			names = append(names, ix.bucket)
+		}
+		for i := 0; i < shardCount(); i++ {
+			names = append(names, shardBucketName(i))
+		}
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket %s: %s", name, err)
+			}
+		}
+		return nil
+	})
+}
+
 func loadConfig() {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -207,35 +509,254 @@ func loadConfig() {
 
 	viper.SetDefault("port", "8082")
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("logging.sample_rate", 1.0)
+	viper.SetDefault("logging.slow_threshold", "1s")
+	viper.SetDefault("logging.capture_bodies", false)
+	viper.SetDefault("logging.max_body_bytes", 2048)
+	viper.SetDefault("remote_config.enabled", false)
+	viper.SetDefault("remote_config.provider", "consul")
+	viper.SetDefault("remote_config.endpoint", "http://consul:8500")
+	viper.SetDefault("remote_config.path", "config/data-service")
+	viper.SetDefault("remote_config.format", "yaml")
+	viper.SetDefault("remote_config.watch_interval", "30s")
+	viper.SetDefault("secrets.provider", "env")
+	viper.SetDefault("secrets.refresh_interval", "5m")
+	viper.SetDefault("secrets.vault.mount", "secret")
+	viper.SetDefault("secrets.vault.kubernetes.mount", "kubernetes")
+	viper.BindEnv("secrets.vault.address", "SECRETS_VAULT_ADDRESS", "VAULT_ADDR")
+	viper.BindEnv("secrets.vault.token", "SECRETS_VAULT_TOKEN", "VAULT_TOKEN")
+	viper.BindEnv("secrets.vault.namespace", "SECRETS_VAULT_NAMESPACE", "VAULT_NAMESPACE")
+	viper.SetDefault("leader_election.enabled", false)
+	viper.SetDefault("leader_election.backend", "file")
+	viper.SetDefault("leader_election.lease_name", "data-service-processing")
+	viper.SetDefault("leader_election.lease_duration", "15s")
+	viper.SetDefault("leader_election.renew_period", "5s")
+	viper.SetDefault("leader_election.file.path", "leader.lease")
+	viper.SetDefault("replica.mode", "")
+	viper.SetDefault("replica.path", "replica.db")
+	viper.SetDefault("replica.source", "http://data-service:8082")
+	viper.SetDefault("replica.poll_interval", "1s")
+	viper.SetDefault("changes.retention", "168h")
+	viper.SetDefault("changes.max_entries", 1000000)
+	viper.SetDefault("changes.truncate_interval", "10m")
+	viper.SetDefault("storage.shards", 1)
+	viper.SetDefault("storage.shard_by", "hash")
+	viper.SetDefault("processing.claims.enabled", false)
+	viper.SetDefault("processing.claims.workers", 1)
+	viper.SetDefault("processing.claims.lease_duration", "2m")
+	viper.SetDefault("processing.reconcile.enabled", true)
+	viper.SetDefault("processing.reconcile.interval", "10m")
+	viper.SetDefault("processing.reconcile.confirm_delay", "2s")
+	viper.SetDefault("processing.priorities.max", 5)
+	viper.SetDefault("processing.priorities.weights", map[string]int{})
+	viper.SetDefault("processing.sla.interval", "30s")
+	viper.SetDefault("processing.sla.max_age", map[string]string{})
+	viper.SetDefault("ingestion.source_limits.enabled", false)
+	viper.SetDefault("ingestion.source_limits.default.rate", 0)
+	viper.SetDefault("ingestion.source_limits.default.burst", 0)
+	viper.SetDefault("ingestion.source_limits.sources", []interface{}{})
+	viper.SetDefault("mqtt.enabled", false)
+	viper.SetDefault("mqtt.broker", "tcp://mosquitto:1883")
+	viper.SetDefault("mqtt.client_id", "")
+	viper.SetDefault("mqtt.username", "")
+	viper.SetDefault("mqtt.password", "")
+	viper.SetDefault("mqtt.clean_session", false)
+	viper.SetDefault("mqtt.keep_alive", "30s")
+	viper.SetDefault("mqtt.max_reconnect_delay", "1m")
+	viper.SetDefault("mqtt.max_message_bytes", 262144)
+	viper.SetDefault("mqtt.queue_size", 1000)
+	viper.SetDefault("mqtt.batch_size", 100)
+	viper.SetDefault("kafka.enabled", false)
+	viper.SetDefault("kafka.brokers", []string{"kafka:9092"})
+	viper.SetDefault("kafka.group_id", "data-service")
+	viper.SetDefault("kafka.client_id", "")
+	viper.SetDefault("kafka.start_offset", "latest")
+	viper.SetDefault("kafka.username", "")
+	viper.SetDefault("kafka.password", "")
+	viper.SetDefault("kafka.tls", false)
+	viper.SetDefault("kafka.session_timeout", "30s")
+	viper.SetDefault("kafka.max_wait", "500ms")
+	viper.SetDefault("kafka.max_fetch_bytes", 16777216)
+	viper.SetDefault("kafka.max_partition_fetch_bytes", 1048576)
+	viper.SetDefault("kafka.max_reconnect_delay", "1m")
+	viper.SetDefault("kafka.batch_size", 500)
+	viper.SetDefault("otlp_receiver.enabled", false)
+	viper.SetDefault("otlp_receiver.trace_idle", "10s")
+	viper.SetDefault("otlp_receiver.late_span_window", "5m")
+	viper.SetDefault("otlp_receiver.flush_interval", "5s")
+	viper.SetDefault("otlp_receiver.max_body_bytes", 16777216)
+	viper.SetDefault("syslog.enabled", false)
+	viper.SetDefault("syslog.port", "5514")
+	viper.SetDefault("syslog.max_connections", 100)
+	viper.SetDefault("syslog.max_message_bytes", 65536)
+	viper.SetDefault("syslog.queue_size", 10000)
+	viper.SetDefault("syslog.batch_size", 500)
+	viper.SetDefault("prom_write.enabled", false)
+	viper.SetDefault("prom_write.resolution", "1m")
+	viper.SetDefault("prom_write.grace", "1m")
+	viper.SetDefault("prom_write.flush_interval", "15s")
+	viper.SetDefault("prom_write.max_body_bytes", 33554432)
+	viper.SetDefault("latency.compression", 100)
+	viper.SetDefault("latency.retention", "2160h")
+	viper.SetDefault("jobs.log_retention", "168h")
+	viper.SetDefault("jobs.log_max_lines", 10000)
+	viper.SetDefault("jobs.max_concurrent", 4)
+	viper.SetDefault("jobs.queue_size", 100)
+	viper.SetDefault("jobs.priority_aging", "0s")
+	viper.SetDefault("jobs.store.max_entries", 1000)
+	viper.SetDefault("jobs.store.ttl", "24h")
+	viper.SetDefault("jobs.store.interval", "1m")
+	viper.SetDefault("jobs.webhooks.secret", "")
+	viper.SetDefault("jobs.webhooks.timeout", "10s")
+	viper.SetDefault("jobs.webhooks.max_attempts", 5)
+	viper.SetDefault("jobs.webhooks.retry_backoff", "2s")
+	viper.SetDefault("jobs.webhooks.allowed_hosts", []string{})
+	viper.SetDefault("jobs.notifications.channels", map[string]string{})
+	viper.SetDefault("quarantine.interval", "10s")
+	viper.SetDefault("quarantine.sweep_interval", "24h")
+	viper.SetDefault("enrichment.enabled", false)
+	viper.SetDefault("enrichment.sources", []interface{}{})
+	viper.SetDefault("enrichment.types", map[string][]string{})
+	viper.SetDefault("topk.fields", []string{"category", "session_id"})
+	viper.SetDefault("topk.capacity", 200)
+	viper.SetDefault("topk.slice", "5m")
+	viper.SetDefault("topk.max_window", "24h")
+	viper.SetDefault("metric_tiers.enabled", false)
+	viper.SetDefault("metric_tiers.interval", "1m")
+	viper.SetDefault("metric_tiers.delay", "5m")
+	viper.SetDefault("metric_tiers.retention.raw", "24h")
+	viper.SetDefault("metric_tiers.retention.1m", "168h")
+	viper.SetDefault("metric_tiers.retention.1h", "2160h")
+	viper.SetDefault("metric_tiers.query.raw_max_range", "2h")
+	viper.SetDefault("metric_tiers.query.max_points", 1500)
+	viper.SetDefault("grpc.enabled", false)
+	viper.SetDefault("grpc.port", "50051")
+	viper.SetDefault("grpc.max_message_bytes", 4194304)
+	viper.SetDefault("grpc.ingest.batch_size", 500)
+	viper.SetDefault("grpc.ingest.ack_interval", "1s")
+	viper.SetDefault("api.v1.deprecated_at", "2026-10-17T00:00:00Z")
+	viper.SetDefault("api.v1.sunset", "2027-04-17T00:00:00Z")
+	viper.SetDefault("api.v1.docs_url", "")
+	viper.SetDefault("audit.enabled", true)
+	viper.SetDefault("audit.path", "audit.log")
+	viper.SetDefault("audit.max_summary_bytes", 1024)
+	viper.SetDefault("audit.trusted_proxies", []string{})
+	viper.SetDefault("anomaly.enabled", false)
+	viper.SetDefault("anomaly.interval", "1m")
+	viper.SetDefault("anomaly.alpha", 0.1)
+	viper.SetDefault("anomaly.threshold", 3.0)
+	viper.SetDefault("anomaly.min_samples", 10)
+	viper.SetDefault("anomaly.min_stddev", 5)
+	viper.SetDefault("anomaly.notify.alertmanager_url", "")
+	viper.SetDefault("anomaly.notify.webhook_url", "")
+	viper.SetDefault("anomaly.notify.severity", "warning")
+	viper.SetDefault("log_shipping.enabled", false)
+	viper.SetDefault("log_shipping.backend", "loki")
+	viper.SetDefault("log_shipping.url", "http://loki:3100")
+	viper.SetDefault("log_shipping.index", "pipeline-logs")
+	viper.SetDefault("log_shipping.batch_size", 100)
+	viper.SetDefault("log_shipping.flush_interval", "2s")
+	viper.SetDefault("log_shipping.buffer_size", 10000)
+	viper.SetDefault("log_shipping.max_retries", 3)
+	viper.SetDefault("log_shipping.timeout", "5s")
+	viper.SetDefault("endpoint_protection.allowed_ips", []string{})
+	// Credential keys need defaults so vault: references given only via
+	// environment variables are seen by resolveSecrets.
+	viper.SetDefault("endpoint_protection.bearer_token", "")
+	viper.SetDefault("endpoint_protection.basic_auth.username", "")
+	viper.SetDefault("endpoint_protection.basic_auth.password", "")
+	viper.SetDefault("backpressure.capacity", 10000)
+	viper.SetDefault("backpressure.elevated_at", 0.7)
+	viper.SetDefault("backpressure.overloaded_at", 1.0)
+	viper.SetDefault("profiling.enabled", false)
+	viper.SetDefault("profiling.backend", "pyroscope")
+	viper.SetDefault("profiling.url", "http://pyroscope:4040")
+	viper.SetDefault("profiling.profiles", []string{"cpu", "heap"})
+	viper.SetDefault("profiling.interval", "15s")
+	viper.SetDefault("profiling.timeout", "10s")
+	viper.SetDefault("profiling.tags", map[string]string{})
+	viper.SetDefault("shutdown.drain_timeout", "30s")
+	viper.SetDefault("shutdown.settle", "2s")
+	viper.SetDefault("shutdown.report_path", "shutdown.json")
+	viper.SetDefault("runtime.enabled", true)
+	viper.SetDefault("runtime.interval", "15s")
+	viper.SetDefault("runtime.window", "5m")
+	viper.SetDefault("runtime.thresholds.goroutine_growth", 100)
+	viper.SetDefault("runtime.thresholds.gc_pause_p99", "100ms")
+	viper.SetDefault("runtime.thresholds.sched_latency_p99", "50ms")
+	viper.SetDefault("runtime.thresholds.fd_usage", 0.8)
+	viper.SetDefault("load_shedding.enabled", true)
+	viper.SetDefault("load_shedding.max_in_flight", 100)
+	viper.SetDefault("load_shedding.cpu_threshold", 0.9)
+	viper.SetDefault("load_shedding.low_priority_at", 0.6)
+	viper.SetDefault("load_shedding.normal_priority_at", 0.85)
+	viper.SetDefault("load_shedding.retry_after", "1s")
+	viper.SetDefault("load_shedding.exempt_paths", []string{"/api/v1/changes/stream"})
+	viper.SetDefault("request_signing.enabled", false)
+	viper.SetDefault("request_signing.secret", "")
+	viper.SetDefault("request_signing.max_body_bytes", 10485760)
+	viper.SetDefault("request_signing.previous_secrets", []string{})
+	viper.SetDefault("request_signing.max_skew", "5m")
+	viper.SetDefault("request_signing.exempt_paths", []string{})
+	viper.SetDefault("metrics.apdex.threshold", "250ms")
+	viper.SetDefault("metrics.cardinality_limit", 1000)
+	viper.SetDefault("metrics.native_histograms.enabled", false)
+	viper.SetDefault("metrics.native_histograms.bucket_factor", 1.1)
+	viper.SetDefault("metrics.native_histograms.max_buckets", 160)
+	viper.SetDefault("otlp.enabled", false)
+	viper.SetDefault("otlp.endpoint", "http://otel-collector:4318")
+	viper.SetDefault("otlp.interval", "15s")
+	viper.SetDefault("otlp.timeout", "5s")
+	viper.SetDefault("pushgateway.enabled", false)
+	viper.SetDefault("pushgateway.url", "http://pushgateway:9091")
+	viper.SetDefault("pushgateway.job", "data-service")
+	viper.SetDefault("statsd.enabled", false)
+	viper.SetDefault("statsd.address", "localhost:8125")
+	viper.SetDefault("statsd.prefix", "pipeline.")
+	viper.SetDefault("statsd.dogstatsd", true)
+	viper.SetDefault("statsd.interval", "10s")
+	viper.SetDefault("statsd.metrics", []string{"data_http_requests_total", "data_http_request_duration_seconds", "data_records_total", "data_processing_duration_seconds", "data_active_jobs"})
 	viper.SetDefault("processing_interval", "5s")
 	viper.SetDefault("batch_size", 10)
+	viper.SetDefault("archive.enabled", false)
+	viper.SetDefault("archive.backend", "local")
+	viper.SetDefault("archive.path", "archive")
+	viper.SetDefault("archive.after_days", 7)
+	viper.SetDefault("archive.interval", "1h")
+	viper.SetDefault("admin.confirm_threshold", 10000)
+	viper.SetDefault("admin.confirm_ttl", "5m")
+	viper.SetDefault("admin.delete_batch_size", 500)
+	viper.SetDefault("snapshots.path", "snapshots")
+	viper.SetDefault("generate.max_count", 100000)
+	viper.SetDefault("generate.max_payload_bytes", 65536)
+	viper.SetDefault("generate.batch_size", 500)
+	viper.SetDefault("privacy.subject_fields", []string{"subject_id", "user_id", "session_id"})
+	viper.SetDefault("privacy.hash_salt", "")
+	viper.SetDefault("backup.path", "backups")
+	viper.SetDefault("backup.keep", 7)
+	viper.SetDefault("registration.enabled", false)
+	viper.SetDefault("registration.gateway_url", "http://api-gateway:8080")
+	viper.SetDefault("registration.name", "data-service")
+	viper.SetDefault("registration.url", "http://data-service:8082")
+	viper.SetDefault("registration.health_path", "/health")
+	viper.SetDefault("registration.routes", []string{})
+	viper.SetDefault("registration.interval", "10s")
+	viper.SetDefault("registration.timeout", "5s")
+	viper.SetDefault("registration.token", "")
 
 	if err := viper.ReadInConfig(); err != nil {
 		logrus.WithError(err).Warn("Could not read config file, using defaults")
 	}
 
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
+
+	loadRemoteConfig()
+	resolveSecrets()
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-
-		next.ServeHTTP(wrapped, r)
-
-		duration := time.Since(start)
-
-		logrus.WithFields(logrus.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status":      wrapped.statusCode,
-			"duration":    duration.String(),
-			"user_agent":  r.UserAgent(),
-			"remote_addr": r.RemoteAddr,
-		}).Info("Data service request")
-	})
+	return requestLogger.Wrap(next)
 }
 
 func metricsMiddleware(next http.Handler) http.Handler {
@@ -246,10 +767,13 @@ func metricsMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		duration := time.Since(start).Seconds()
+		elapsed := time.Since(start)
+		duration := elapsed.Seconds()
 
 		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Inc()
-		httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)).Observe(duration)
+		telemetry.ObserveWithExemplar(httpRequestDuration.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", wrapped.statusCode)), duration, telemetry.TraceID(r))
+		apdex.Observe(routeTemplate(r), elapsed, wrapped.statusCode)
+		observeRequestContext(r, fmt.Sprintf("%d", wrapped.statusCode))
 	})
 }
 
@@ -263,24 +787,34 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController so
+// streaming handlers can flush and extend deadlines.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var totalRecords int
 	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		totalRecords = b.Stats().KeyN
+		totalRecords = countRecords(tx)
 		return nil
 	})
+	jobsMu.RLock()
+	activeJobs := len(jobs)
+	jobsMu.RUnlock()
 
 	response := map[string]interface{}{
-		"service":     "Data Service",
-		"version":     "1.0.0",
-		"status":      "running",
-		"timestamp":   time.Now().UTC().Format(time.RFC3339),
-		"uptime":      time.Since(startTime).String(),
-		"records":     totalRecords,
-		"active_jobs": len(jobs),
+		"service":      "Data Service",
+		"version":      version,
+		"status":       "running",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+		"uptime":       time.Since(startTime).String(),
+		"records":      totalRecords,
+		"active_jobs":  activeJobs,
+		"api_versions": apiVersions,
+		"capabilities": capabilities(),
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -293,8 +827,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	dbHealthy := true
 	err := db.View(func(tx *bolt.Tx) error {
 		// Just check if we can access the buckets (read-only operation)
-		b := tx.Bucket([]byte("records"))
-		if b == nil {
+		if tx.Bucket([]byte(recordsBucket)) == nil {
 			return fmt.Errorf("records bucket not found")
 		}
 		return nil
@@ -303,21 +836,55 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		dbHealthy = false
 	}
 
+	// The MQTT listener and Kafka consumer reconnect on their own; a broker
+	// outage is reported but does not make the service unhealthy.
+	checks := map[string]bool{"database": dbHealthy}
+	if viper.GetBool("mqtt.enabled") && !isReplica() {
+		checks["mqtt"] = mqttConnected()
+	}
+	if viper.GetBool("kafka.enabled") && !isReplica() {
+		checks["kafka"] = kafkaJoined()
+	}
+
+	// A backlog past its processing SLA degrades the service but leaves it
+	// serving, so it is not taken out of rotation for it.
+	breaches := currentSLABreaches()
+	if len(processingSLAs) > 0 {
+		checks["processing_sla"] = len(breaches) == 0
+	}
+	// So does a saturated runtime.
+	runtimeStatus, sampled := telemetry.Runtime()
+	saturated := len(runtimeStatus.Saturated) > 0
+	if sampled {
+		checks["runtime"] = !saturated
+	}
+	// And more jobs in memory than jobs.store.max_entries, all of them
+	// queued or running.
+	store := jobPolicy.Occupancy()
+	checks["job_store"] = !store.Full
+
 	healthy := dbHealthy
 	status := "healthy"
 	statusCode := http.StatusOK
 	if !healthy {
 		status = "unhealthy"
 		statusCode = http.StatusServiceUnavailable
+	} else if len(breaches) > 0 || saturated || store.Full {
+		status = "degraded"
 	}
 
 	response := map[string]interface{}{
 		"status":    status,
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 		"uptime":    time.Since(startTime).String(),
-		"checks": map[string]bool{
-			"database": dbHealthy,
-		},
+		"checks":    checks,
+		"job_store": store,
+	}
+	if len(breaches) > 0 {
+		response["sla_breaches"] = breaches
+	}
+	if sampled {
+		response["runtime"] = runtimeStatus
 	}
 
 	w.WriteHeader(statusCode)
@@ -326,6 +893,14 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 
 func readinessHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if !replicaReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "catching_up",
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":    "ready",
@@ -334,25 +909,63 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func createRecordHandler(w http.ResponseWriter, r *http.Request) {
-	var record DataRecord
-	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+	var body struct {
+		DataRecord
+		// Source and Parents start the record's lineage.
+		Source  string   `json:"source"`
+		Parents []string `json:"parents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	record := body.DataRecord
+	source, err := lineageSource(r, body.Source)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if ok, wait := ingestionLimiter.allow(source); !ok {
+		writeSourceLimited(w, source, wait)
+		return
+	}
 
 	record.ID = uuid.New().String()
 	record.Timestamp = time.Now()
 	record.Processed = false
+	record.TraceID = telemetry.TraceID(r)
+	masked := applyMasking(&record)
+	record.Lineage = newLineage(source, body.Parents, appliedTransforms(r), masked, record.Timestamp)
+	// Records about an order carry its ID in data.order_id; the correlation
+	// ID defaults to the client's X-Correlation-ID, then to the order.
+	if record.OrderID == "" {
+		record.OrderID = record.Data["order_id"]
+	}
+	if record.CorrelationID == "" {
+		record.CorrelationID = r.Header.Get("X-Correlation-ID")
+	}
+	if record.CorrelationID == "" {
+		record.CorrelationID = record.OrderID
+	}
+	for name, value := range map[string]string{"order_id": record.OrderID, "correlation_id": record.CorrelationID} {
+		if err := validateCorrelationKey(name, value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		data, err := json.Marshal(record)
-		if err != nil {
-			return err
+	var parentsErr error
+	err = db.Update(func(tx *bolt.Tx) error {
+		if parentsErr = checkParents(tx, body.Parents); parentsErr != nil {
+			return parentsErr
 		}
-		return b.Put([]byte(record.ID), data)
+		return putRecord(tx, &record)
 	})
 
+	if parentsErr != nil {
+		http.Error(w, parentsErr.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to save record", http.StatusInternalServerError)
 		return
@@ -365,24 +978,43 @@ func createRecordHandler(w http.ResponseWriter, r *http.Request) {
 		"type":      record.Type,
 	}).Info("Data record created")
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(record)
+	response.Created(w, r, presentRecord(r, record), recordLinks(r, record))
 }
 
+// getRecordsHandler serves GET
+// /api/v1/records?type=&job_id=&order_id=&correlation_id=&processed=&offset=&limit=,
+// in storage order. Lists by order or correlation ID read the index rather
+// than every record.
 func getRecordsHandler(w http.ResponseWriter, r *http.Request) {
-	var records []DataRecord
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRecordFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		c := b.Cursor()
+	records := []DataRecord{}
+	total := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		c := filter.cursor(tx)
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			var record DataRecord
-			if err := json.Unmarshal(v, &record); err != nil {
-				return err
+			if err := decodeRecord(k, v, &record); err != nil {
+				continue
+			}
+			if !filter.matches(record) {
+				continue
+			}
+			if total >= page.Offset && len(records) < page.Limit {
+				record.Links = recordLinks(r, record)
+				records = append(records, presentRecord(r, record))
 			}
-			records = append(records, record)
+			total++
 		}
 		return nil
 	})
@@ -392,13 +1024,7 @@ func getRecordsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := map[string]interface{}{
-		"records": records,
-		"total":   len(records),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	response.WriteList(w, r, records, page, total, nil)
 }
 
 func getRecordHandler(w http.ResponseWriter, r *http.Request) {
@@ -407,8 +1033,7 @@ func getRecordHandler(w http.ResponseWriter, r *http.Request) {
 
 	var record DataRecord
 	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		data := b.Get([]byte(recordID))
+		_, data := findRecord(tx, []byte(recordID))
 		if data == nil {
 			return fmt.Errorf("record not found")
 		}
@@ -416,72 +1041,125 @@ func getRecordHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
+		if entry, lookupErr := lookupArchiveEntry(recordID); lookupErr == nil && entry != nil {
+			response.WriteResource(w, r, map[string]interface{}{
+				"id":      recordID,
+				"status":  "archived",
+				"archive": entry,
+			}, recordLinks(r, DataRecord{ID: recordID}), entry.ArchivedAt)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(record)
+	modified := record.Timestamp
+	if record.ProcessedAt != nil {
+		modified = *record.ProcessedAt
+	}
+	response.WriteResource(w, r, presentRecord(r, record), recordLinks(r, record), modified)
 }
 
 func createJobHandler(w http.ResponseWriter, r *http.Request) {
-	job := ProcessingJob{
-		ID:        uuid.New().String(),
-		Status:    "pending",
-		StartTime: time.Now(),
-		Records:   0,
+	// The body is optional; without one the job has the default priority
+	// and notifies no one.
+	var body struct {
+		jobNotifyRequest
+		Priority int `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notify := body.jobNotifyRequest
+	if err := validateJobNotify(notify); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	jobs[job.ID] = job
-	activeJobs.Inc()
-
-	// Start job processing in background
-	go processJob(job.ID)
+	job := ProcessingJob{
+		ID:          uuid.New().String(),
+		Status:      "pending",
+		StartTime:   time.Now(),
+		Records:     0,
+		Priority:    body.Priority,
+		CallbackURL: notify.CallbackURL,
+		Notify:      notify.Notify,
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(job)
+	// The job runs in the background once jobs.max_concurrent allows.
+	job, err := enqueueJob(job)
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	response.Created(w, r, job, jobLinks(r, job))
 }
 
+// getJobsHandler serves GET /api/v1/jobs?status=&offset=&limit=, oldest jobs
+// first. Archived jobs are not listed; they are served by ID.
 func getJobsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids, err := response.ParseIDs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+
+	jobsMu.RLock()
 	jobList := make([]ProcessingJob, 0, len(jobs))
 	for _, job := range jobs {
-		jobList = append(jobList, job)
+		if (status == "" || job.Status == status) && (ids == nil || ids[job.ID]) {
+			jobList = append(jobList, job)
+		}
 	}
+	jobsMu.RUnlock()
+	sort.Slice(jobList, func(i, j int) bool {
+		if !jobList[i].StartTime.Equal(jobList[j].StartTime) {
+			return jobList[i].StartTime.Before(jobList[j].StartTime)
+		}
+		return jobList[i].ID < jobList[j].ID
+	})
 
-	response := map[string]interface{}{
-		"jobs":  jobList,
-		"total": len(jobList),
+	lo, hi := page.Bounds(len(jobList))
+	pageJobs := jobList[lo:hi]
+	for i := range pageJobs {
+		pageJobs[i].QueuePosition = jobQueue.position(pageJobs[i].ID)
+		pageJobs[i].Links = jobLinks(r, pageJobs[i])
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	response.WriteList(w, r, pageJobs, page, len(jobList), nil)
 }
 
 func getJobHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	jobID := vars["id"]
 
-	job, exists := jobs[jobID]
+	job, exists := getJob(jobID)
 	if !exists {
 		http.Error(w, "Job not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(job)
+	job.QueuePosition = jobQueue.position(job.ID)
+	response.Write(w, r, http.StatusOK, job, jobLinks(r, job))
 }
 
 func dataMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	var totalRecords, processedRecords, pendingRecords int
+	var databaseSize int64
 
 	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		c := b.Cursor()
+		databaseSize = tx.Size()
+		c := newRecordCursor(tx, -1)
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 			var record DataRecord
-			if err := json.Unmarshal(v, &record); err != nil {
+			if err := decodeRecord(k, v, &record); err != nil {
 				continue
 			}
 			totalRecords++
@@ -505,6 +1183,7 @@ func dataMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		PendingRecords:    pendingRecords,
 		ProcessingRate:    processingRate,
 		DataSize:          dataSize,
+		DatabaseSize:      databaseSize,
 	}
 
 	// Update Prometheus metrics
@@ -512,50 +1191,7 @@ func dataMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	dataRecordsTotal.WithLabelValues("pending").Set(float64(pendingRecords))
 	dataSizeBytes.Set(float64(dataSize))
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
-}
-
-func generateTestData(w http.ResponseWriter, r *http.Request) {
-	go func() {
-		recordTypes := []string{"user_event", "system_log", "metric", "trace"}
-
-		for i := 0; i < 50; i++ {
-			record := DataRecord{
-				ID: uuid.New().String(),
-				Type: recordTypes[rand.Intn(len(recordTypes))],
-				Data: map[string]string{
-					"source":     "generator",
-					"category":   fmt.Sprintf("category_%d", rand.Intn(10)),
-					"priority":   fmt.Sprintf("%d", rand.Intn(5)+1),
-					"session_id": uuid.New().String(),
-				},
-				Timestamp: time.Now().Add(-time.Duration(rand.Intn(3600)) * time.Second),
-				Processed: false,
-			}
-
-			err := db.Update(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("records"))
-				data, err := json.Marshal(record)
-				if err != nil {
-					return err
-				}
-				return b.Put([]byte(record.ID), data)
-			})
-
-			if err != nil {
-				logrus.WithError(err).Error("Failed to save test record")
-			}
-
-			time.Sleep(100 * time.Millisecond)
-		}
-	}()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":   "Test data generation started",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
+	codec.Write(w, r, http.StatusOK, metrics)
 }
 
 func cleanupOldRecords(w http.ResponseWriter, r *http.Request) {
@@ -569,26 +1205,71 @@ func cleanupOldRecords(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var deletedCount int
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		c := b.Cursor()
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A confirmed cleanup uses the cutoff the token was issued for, so the
+	// default cutoff does not move on between the two requests.
+	confirmed := false
+	if token := r.URL.Query().Get("confirm"); token != "" && !dryRun {
+		scope, err := redeemConfirmation(token, "cleanup")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		tokenCutoff, _ := time.Parse(time.RFC3339Nano, scope)
+		if cutoffStr != "" && !tokenCutoff.Equal(cutoffTime) {
+			http.Error(w, "Confirmation token was issued for cutoff "+scope, http.StatusConflict)
+			return
+		}
+		cutoffTime, confirmed = tokenCutoff, true
+	}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	plan := newDeletionPlan("cleanup", map[string]string{"cutoff": cutoffTime.Format(time.RFC3339Nano)})
+	plan.DryRun = dryRun
+	txn := db.Update
+	if dryRun {
+		txn = db.View
+	}
+
+	var deletedCount int
+	err = txn(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		forEachRecord(tx, -1, func(k, v []byte) error {
 			var record DataRecord
-			if err := json.Unmarshal(v, &record); err != nil {
-				continue
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
 			}
-
 			if record.Timestamp.Before(cutoffTime) {
-				if err := b.Delete(k); err == nil {
-					deletedCount++
-				}
+				keys = append(keys, []byte(record.ID))
+				plan.add(record, v)
+			}
+			return nil
+		})
+		if dryRun {
+			return nil
+		}
+		if !confirmed && plan.needsConfirmation() {
+			return errConfirmationRequired
+		}
+
+		for _, k := range keys {
+			if err := deleteRecord(tx, k); err == nil {
+				deletedCount++
 			}
 		}
 		return nil
 	})
 
+	if (err == nil && dryRun) || err == errConfirmationRequired {
+		if plan.needsConfirmation() {
+			plan.confirm(plan.Scope["cutoff"])
+		}
+		writeDeletionPlan(w, plan)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to cleanup records", http.StatusInternalServerError)
 		return
@@ -608,95 +1289,262 @@ func processDataContinuously() {
 	interval, _ := time.ParseDuration(viper.GetString("processing_interval"))
 	batchSize := viper.GetInt("batch_size")
 
+	// With several shards each one gets its own loop(s).
+	shards := []int{-1}
+	if shardCount() > 1 {
+		shards = shards[:0]
+		for i := 0; i < shardCount(); i++ {
+			shards = append(shards, i)
+		}
+	}
+
+	// Workers sharing the backlog through record leases run on every
+	// replica regardless of leadership.
+	workers, leaderOnly := 1, true
+	if claimsEnabled() {
+		workers, leaderOnly = viper.GetInt("processing.claims.workers"), false
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		for i := 0; i < workers; i++ {
+			name := fmt.Sprintf("w%d", i)
+			if shard >= 0 {
+				name = fmt.Sprintf("s%d-%s", shard, name)
+			}
+			wg.Add(1)
+			go func(shard int, worker string) {
+				defer wg.Done()
+				// Labelled so continuous profiles can be narrowed down to the
+				// processing loop, or one of its workers.
+				pprof.Do(context.Background(), pprof.Labels("loop", "processing", "worker", worker), func(context.Context) {
+					processLoop(interval, worker, shard, batchSize, leaderOnly)
+				})
+			}(shard, workerID(name))
+		}
+	}
+	wg.Wait()
+}
+
+// processLoop runs processing batches for one worker until the process exits.
+func processLoop(interval time.Duration, worker string, shard, batchSize int, leaderOnly bool) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		processPendingRecords(batchSize)
+		if (leaderOnly && !isLeader()) || processingPaused() {
+			continue
+		}
+		processPendingRecords(context.Background(), worker, "", shard, batchSize)
 	}
 }
 
-func processPendingRecords(batchSize int) {
-	var records []DataRecord
-
-	// Fetch pending records
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("records"))
-		c := b.Cursor()
+// processPendingRecords processes up to batchSize pending records of a shard
+// (all shards for shard < 0) and returns how many were successfully marked as
+// processed. With processing.claims enabled the records are leased to worker
+// first. jobID names the processing job, if the batch is one, and ctx
+// stops it between records. The error is that of reading or claiming the
+// batch.
+func processPendingRecords(ctx context.Context, worker, jobID string, shard, batchSize int) (int, error) {
+	log := jobLog(jobID)
+	if claimsEnabled() {
+		records, err := claimPendingRecords(worker, shard, batchSize)
+		if err != nil {
+			log.warn("Failed to claim pending records", logrus.Fields{"error": err})
+			return 0, err
+		}
+		log.info("Claimed pending records", logrus.Fields{"records": len(records), "worker": worker})
+		return processRecords(ctx, worker, jobID, records), nil
+	}
 
-		for k, v := c.First(); k != nil && len(records) < batchSize; k, v = c.Next() {
-			var record DataRecord
-			if err := json.Unmarshal(v, &record); err != nil {
-				continue
-			}
+	var records []DataRecord
 
-			if !record.Processed {
-				records = append(records, record)
-			}
-		}
+	// Fetch pending records, higher priority lanes first
+	err := db.View(func(tx *bolt.Tx) error {
+		records = selectPendingRecords(tx, shard, batchSize, func(DataRecord) bool { return true })
 		return nil
 	})
 
-	if err != nil || len(records) == 0 {
-		return
+	if err != nil {
+		log.warn("Failed to read pending records", logrus.Fields{"error": err})
+		return 0, err
+	}
+	log.info("Selected pending records", logrus.Fields{"records": len(records), "worker": worker})
+	if len(records) == 0 {
+		return 0, nil
 	}
+	return processRecords(ctx, worker, jobID, records), nil
+}
 
-	// Process records
+// processRecords processes records as one run. The idempotency ledger makes
+// sure each record's processing is applied, and counted, once: records
+// another run already applied are skipped.
+func processRecords(ctx context.Context, worker, jobID string, records []DataRecord) int {
+	run := uuid.New().String()
+	log := jobLog(jobID)
+	processed := 0
 	for _, record := range records {
+		if ctx.Err() != nil {
+			break
+		}
+		if processedBefore(record.ID) {
+			processingLedger.WithLabelValues("duplicate").Inc()
+			log.info("Record skipped, already processed", logrus.Fields{"record_id": record.ID})
+			continue
+		}
 		start := time.Now()
 
 		// Simulate processing time
 		time.Sleep(time.Duration(rand.Intn(500)+100) * time.Millisecond)
 
+		if record.Data == nil {
+			record.Data = make(map[string]string)
+		}
+		sources := enrichRecord(&record)
+		if len(sources) > 0 {
+			addLineageStage(&record, LineageStage{Stage: "enrichment", Actor: worker, Detail: strings.Join(sources, ", "), At: time.Now()})
+		}
+
 		now := time.Now()
 		record.Processed = true
 		record.ProcessedAt = &now
+		record.ClaimedBy = ""
+		record.LeaseExpiry = nil
+		record.JobID = jobID
+		addLineageStage(&record, LineageStage{Stage: "processing", Actor: worker, Detail: jobDetail(jobID), At: now})
 
 		// Update record in database
-		err = db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("records"))
-			data, err := json.Marshal(record)
-			if err != nil {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if claimsEnabled() {
+				if err := checkClaim(tx, record.ID, worker); err != nil {
+					return err
+				}
+			}
+			entry := LedgerEntry{RecordID: record.ID, Run: run, Worker: worker, JobID: jobID, AppliedAt: now}
+			if err := recordProcessing(tx, entry); err != nil {
 				return err
 			}
-			return b.Put([]byte(record.ID), data)
+			if err := recordLatency(tx, record.Type, now, now.Sub(start).Seconds()); err != nil {
+				return err
+			}
+			return putRecord(tx, &record)
 		})
+		processingLedger.WithLabelValues(ledgerOutcome(err)).Inc()
+		switch {
+		case err == errAlreadyProcessed:
+			log.info("Record skipped, already processed", logrus.Fields{"record_id": record.ID})
+		case err != nil:
+			log.warn("Failed to mark record processed", logrus.Fields{"record_id": record.ID, "type": record.Type, "error": err})
+			if err != errClaimLost && err != errRecordGone {
+				recordProcessingFailure(record.ID, worker, jobID, err)
+			}
+		}
 
 		if err == nil {
 			processingTime := time.Since(start).Seconds()
-			dataProcessingDuration.WithLabelValues(record.Type).Observe(processingTime)
+			telemetry.ObserveWithExemplar(dataProcessingDuration.WithLabelValues(record.Type), processingTime, record.TraceID)
+			observeProcessingDuration(record.Type, processingTime)
 			dataRecordsTotal.WithLabelValues("pending").Dec()
 			dataRecordsTotal.WithLabelValues("processed").Inc()
 
-			logrus.WithFields(logrus.Fields{
-				"record_id":      record.ID,
-				"type":           record.Type,
+			fields := logrus.Fields{
+				"record_id":       record.ID,
+				"type":            record.Type,
 				"processing_time": processingTime,
-			}).Debug("Record processed")
+			}
+			if len(sources) > 0 {
+				fields["enrichment"] = sources
+			}
+			log.log(logrus.DebugLevel, "Record processed", fields)
+			processed++
 		}
 	}
+
+	return processed
 }
 
-func processJob(jobID string) {
-	job, exists := jobs[jobID]
+// processJob runs a job taken from jobQueue until it finishes or ctx is
+// cancelled.
+func processJob(ctx context.Context, jobID string) {
+	job, exists := updateJob(jobID, func(job *ProcessingJob) { job.Status = "running" })
 	if !exists {
 		return
 	}
+	if err := pruneJobLogs(); err != nil {
+		logrus.WithError(err).Warn("Failed to prune job logs")
+	}
+	log := jobLog(jobID)
+	worker := workerID("job-" + jobID)
 
-	job.Status = "running"
-	jobs[jobID] = job
-
-	// Process a batch of records
-	processPendingRecords(20)
+	var processed, matched int
+	var err error
+	kind := "processing"
+	switch {
+	case job.Deletion != nil:
+		kind = "deletion"
+		log.info("Job started", logrus.Fields{"deletion": job.Deletion})
+		err = deleteRecordsJob(ctx, job)
+	case job.Reprocess != nil:
+		kind = "reprocessing"
+		log.info("Job started", logrus.Fields{"reprocess": job.Reprocess})
+		matched, processed, err = reprocessJob(ctx, worker, job)
+	case job.Generate != nil:
+		kind = "generation"
+		log.info("Job started", logrus.Fields{"generate": job.Generate})
+		err = generateRecordsJob(ctx, job)
+	default:
+		log.info("Job started", logrus.Fields{"batch_size": 20})
+		// Process a batch of records
+		processed, err = processPendingRecords(ctx, worker, jobID, -1, 20)
+	}
 
 	// Update job status
-	job.Status = "completed"
 	now := time.Now()
-	job.EndTime = &now
-	job.Records = 20 // Simplified for demo
-
-	jobs[jobID] = job
+	job, _ = updateJob(jobID, func(job *ProcessingJob) {
+		job.Status = "completed"
+		switch {
+		case err != nil:
+			job.Status = "failed"
+			job.Error = err.Error()
+		case ctx.Err() != nil:
+			job.Status = "cancelled"
+		}
+		job.EndTime = &now
+		if job.Deletion == nil && job.Generate == nil {
+			job.Records = processed
+			job.RecordsMatched = matched
+		}
+	})
 	activeJobs.Dec()
 
-	logrus.WithField("job_id", jobID).Info("Job completed")
+	items := job.Records
+	switch {
+	case job.Deletion != nil:
+		items = job.RecordsDeleted
+	case job.Generate != nil:
+		items = job.RecordsGenerated
+	}
+	fields := logrus.Fields{"records": items, "duration_seconds": now.Sub(job.StartTime).Seconds()}
+	switch job.Status {
+	case "failed":
+		fields["error"] = err
+		log.warn("Job failed", fields)
+	case "cancelled":
+		log.info("Job cancelled", fields)
+	default:
+		log.info("Job completed", fields)
+	}
+	notifyJobFinished(job)
+
+	bootstrap.PushJobResult(viper.GetViper(), "data-service", telemetry.JobResult{
+		ID:       job.ID,
+		Kind:     kind,
+		Status:   job.Status,
+		Items:    items,
+		Duration: now.Sub(job.StartTime),
+		EndTime:  now,
+	})
 }
\ No newline at end of file
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.WarnLevel)
+	loadConfig()
+	os.Exit(m.Run())
+}
+
+// openTestDB points db at an empty database with every bucket, closed when
+// the test ends.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = bolt.Open(filepath.Join(t.TempDir(), "data.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := createBuckets(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// metricTiersBucket holds, per tier, the time up to which its records have
+// been rolled up into the next tier.
+const metricTiersBucket = "metric_tiers"
+
+// metricTier is a resolution metric records are kept at. Raw records are
+// single samples: data.metric, data.value and label.<name> labels.
+// Aggregated records are windows as written by prom_write and the
+// downsampler.
+type metricTier struct {
+	name       string
+	resolution time.Duration // 0 for raw samples
+}
+
+var metricTiers = []metricTier{{"raw", 0}, {"1m", time.Minute}, {"1h", time.Hour}}
+
+var (
+	metricRollups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_metric_rollup_windows_total",
+			Help: "Metric windows written by the downsampler, by tier",
+		},
+		[]string{"tier"},
+	)
+	metricExpired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_metric_expired_records_total",
+			Help: "Metric records deleted by tier retention, by tier",
+		},
+		[]string{"tier"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricRollups, metricExpired)
+}
+
+// metricWindow aggregates the samples of one series within one window.
+type metricWindow struct {
+	Labels        map[string]string `json:"labels"`
+	Min           float64           `json:"min"`
+	Max           float64           `json:"max"`
+	Sum           float64           `json:"sum"`
+	Count         int64             `json:"count"`
+	Last          float64           `json:"last"`
+	LastTimestamp int64             `json:"last_timestamp"` // milliseconds
+}
+
+// add adds a sample taken at timestamp, in milliseconds.
+func (w *metricWindow) add(value float64, timestamp int64) {
+	w.merge(metricWindow{Min: value, Max: value, Sum: value, Count: 1, Last: value, LastTimestamp: timestamp})
+}
+
+func (w *metricWindow) merge(o metricWindow) {
+	if o.Count == 0 {
+		return
+	}
+	if w.Count == 0 || o.Min < w.Min {
+		w.Min = o.Min
+	}
+	if w.Count == 0 || o.Max > w.Max {
+		w.Max = o.Max
+	}
+	if w.Count == 0 || o.LastTimestamp >= w.LastTimestamp {
+		w.Last, w.LastTimestamp = o.Last, o.LastTimestamp
+	}
+	// Clamped so that an overflowing sum can still be encoded as JSON.
+	w.Sum = math.Max(-math.MaxFloat64, math.Min(w.Sum+o.Sum, math.MaxFloat64))
+	w.Count += o.Count
+}
+
+// metricWindowRecord is the metric record of a window: data.metric is the
+// series' __name__, its other labels are label.<name>, and min, max, sum,
+// count, avg and last summarise its samples. The record's timestamp is the
+// window start.
+func metricWindowRecord(w metricWindow, start time.Time, resolution time.Duration, source string) (DataRecord, error) {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	data := map[string]string{
+		"metric":       w.Labels["__name__"],
+		"window_start": start.UTC().Format(time.RFC3339),
+		"window_end":   start.Add(resolution).UTC().Format(time.RFC3339),
+		"resolution":   resolution.String(),
+		"min":          format(w.Min),
+		"max":          format(w.Max),
+		"sum":          format(w.Sum),
+		"count":        strconv.FormatInt(w.Count, 10),
+		"avg":          format(w.Sum / float64(w.Count)),
+		"last":         format(w.Last),
+	}
+	for name, value := range w.Labels {
+		if name != "__name__" {
+			data["label."+name] = value
+		}
+	}
+	return ingestedRecord("metric", source, data, start)
+}
+
+// metricSample reads a metric record as a window, returning its tier index
+// or -1 for a metric record that is neither a sample nor a window.
+// Windows finer than an hour belong to the minute tier.
+func metricSample(record DataRecord) (metricWindow, int) {
+	if record.Type != "metric" || record.Data["metric"] == "" {
+		return metricWindow{}, -1
+	}
+	w := metricWindow{Labels: map[string]string{"__name__": record.Data["metric"]}}
+	for k, v := range record.Data {
+		if name, ok := strings.CutPrefix(k, "label."); ok {
+			w.Labels[name] = v
+		}
+	}
+
+	if record.Data["resolution"] == "" {
+		v, err := strconv.ParseFloat(record.Data["value"], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return metricWindow{}, -1
+		}
+		w.add(v, record.Timestamp.UnixMilli())
+		return w, 0
+	}
+	resolution, err := time.ParseDuration(record.Data["resolution"])
+	if err != nil || resolution <= 0 {
+		return metricWindow{}, -1
+	}
+	var errs []error
+	parse := func(key string) float64 {
+		v, err := strconv.ParseFloat(record.Data[key], 64)
+		errs = append(errs, err)
+		return v
+	}
+	w.Min, w.Max, w.Sum, w.Last = parse("min"), parse("max"), parse("sum"), parse("last")
+	w.Count, err = strconv.ParseInt(record.Data["count"], 10, 64)
+	for _, e := range append(errs, err) {
+		if e != nil || w.Count <= 0 {
+			return metricWindow{}, -1
+		}
+	}
+	w.LastTimestamp = record.Timestamp.Add(resolution).UnixMilli()
+	if resolution < time.Hour {
+		return w, 1
+	}
+	return w, 2
+}
+
+// seriesKey identifies a series by its sorted labels.
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// metricTierRetention is how long records of tier i are kept once rolled up.
+func metricTierRetention(i int) time.Duration {
+	return viper.GetDuration("metric_tiers.retention." + metricTiers[i].name)
+}
+
+// metricWatermarks reads the time up to which each tier but the last has
+// been rolled up; zero when it never was.
+func metricWatermarks(tx *bolt.Tx) []time.Time {
+	marks := make([]time.Time, len(metricTiers))
+	b := tx.Bucket([]byte(metricTiersBucket))
+	if b == nil {
+		return marks
+	}
+	for i, tier := range metricTiers[:len(metricTiers)-1] {
+		if v := b.Get([]byte(tier.name)); v != nil {
+			marks[i], _ = time.Parse(time.RFC3339, string(v))
+		}
+	}
+	return marks
+}
+
+func downsampleMetricsContinuously() {
+	interval := viper.GetDuration("metric_tiers.interval")
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		if err := downsampleMetrics(time.Now()); err != nil {
+			logrus.WithError(err).Error("Metric downsampling failed")
+		}
+	}
+}
+
+// downsampleMetrics rolls each tier up into the next for the windows that
+// ended metric_tiers.delay before now, then deletes the rolled-up records
+// older than their tier's retention. Records of the last tier are deleted
+// once older than its retention.
+func downsampleMetrics(now time.Time) error {
+	delay := viper.GetDuration("metric_tiers.delay")
+	return db.Update(func(tx *bolt.Tx) error {
+		marks := metricWatermarks(tx)
+		type windowKey struct {
+			start  int64
+			series string
+		}
+		// One pass reads every tier; later tiers pick up the windows the
+		// earlier ones produce in the same run on the next run.
+		windows := make([]map[windowKey]*metricWindow, len(metricTiers))
+		upTo := make([]time.Time, len(metricTiers))
+		for i := range metricTiers[:len(metricTiers)-1] {
+			windows[i] = make(map[windowKey]*metricWindow)
+			upTo[i] = now.Add(-delay).Truncate(metricTiers[i+1].resolution)
+		}
+		expired := make([][][]byte, len(metricTiers))
+		first := make([]time.Time, len(metricTiers))
+
+		err := forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
+			}
+			w, tier := metricSample(record)
+			if tier < 0 {
+				return nil
+			}
+			ts := record.Timestamp
+			last := tier == len(metricTiers)-1
+			if !last && (first[tier].IsZero() || ts.Before(first[tier])) {
+				first[tier] = ts
+			}
+			rolledUp := last || !marks[tier].IsZero() && ts.Before(marks[tier])
+			if rolledUp {
+				if retention := metricTierRetention(tier); retention > 0 && now.Sub(ts) > retention {
+					expired[tier] = append(expired[tier], append([]byte(nil), k...))
+				}
+				return nil
+			}
+			if !ts.Before(upTo[tier]) {
+				return nil
+			}
+			start := ts.Truncate(metricTiers[tier+1].resolution)
+			key := windowKey{start.UnixMilli(), seriesKey(w.Labels)}
+			if windows[tier][key] == nil {
+				windows[tier][key] = &metricWindow{Labels: w.Labels}
+			}
+			windows[tier][key].merge(w)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		created := 0
+		marksBucket, err := tx.CreateBucketIfNotExists([]byte(metricTiersBucket))
+		if err != nil {
+			return err
+		}
+		for i, tier := range metricTiers[:len(metricTiers)-1] {
+			// Until a tier has records to roll up it has no watermark, so
+			// the first ones are rolled up from the start of their window.
+			if marks[i].IsZero() && (first[i].IsZero() || !first[i].Before(upTo[i])) {
+				continue
+			}
+			if !marks[i].IsZero() && !upTo[i].After(marks[i]) {
+				continue
+			}
+			next := metricTiers[i+1]
+			for key, w := range windows[i] {
+				record, err := metricWindowRecord(*w, time.UnixMilli(key.start), next.resolution, "downsample")
+				if err != nil {
+					return err
+				}
+				if err := putRecord(tx, &record); err != nil {
+					return err
+				}
+				created++
+			}
+			metricRollups.WithLabelValues(next.name).Add(float64(len(windows[i])))
+			if err := marksBucket.Put([]byte(tier.name), []byte(upTo[i].UTC().Format(time.RFC3339))); err != nil {
+				return err
+			}
+		}
+
+		for i, keys := range expired {
+			for _, k := range keys {
+				if err := deleteRecord(tx, k); err != nil {
+					return err
+				}
+			}
+			metricExpired.WithLabelValues(metricTiers[i].name).Add(float64(len(keys)))
+		}
+		dataRecordsTotal.WithLabelValues("pending").Add(float64(created))
+		return nil
+	})
+}
+
+// metricPoint is a window of a queried series.
+type metricPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+	Sum       float64   `json:"sum"`
+	Count     int64     `json:"count"`
+	Last      float64   `json:"last"`
+}
+
+// metricSeries is a queried series.
+type metricSeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []metricPoint     `json:"points"`
+}
+
+// metricQueryResult is the response of GET /api/v1/metrics/query.
+type metricQueryResult struct {
+	Metric     string         `json:"metric"`
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	Resolution string         `json:"resolution"`
+	Series     []metricSeries `json:"series"`
+}
+
+// metricQueryTier picks the finest tier that still holds from and returns
+// at most metric_tiers.query.max_points windows per series over the range.
+// Raw samples are only used for ranges up to metric_tiers.query.raw_max_range.
+func metricQueryTier(from, to, now time.Time) int {
+	maxPoints := max(viper.GetInt("metric_tiers.query.max_points"), 1)
+	for i, tier := range metricTiers {
+		if i == len(metricTiers)-1 {
+			return i
+		}
+		if retention := metricTierRetention(i); retention > 0 && from.Before(now.Add(-retention)) {
+			continue
+		}
+		if tier.resolution == 0 {
+			if to.Sub(from) <= viper.GetDuration("metric_tiers.query.raw_max_range") {
+				return i
+			}
+			continue
+		}
+		if to.Sub(from)/tier.resolution <= time.Duration(maxPoints) {
+			return i
+		}
+	}
+	return len(metricTiers) - 1
+}
+
+// metricQueryHandler serves
+// GET /api/v1/metrics/query?metric=&from=&to=&resolution=auto|raw|1m|1h&label.{name}=,
+// a series' points over a time range at the resolution that suits it.
+// Windows of finer tiers that have not been rolled up yet are aggregated
+// on the fly, so the newest part of a range is not missing.
+func metricQueryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	to, from := now, now.Add(-time.Hour)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	labels := make(map[string]string)
+	for k, v := range q {
+		if name, ok := strings.CutPrefix(k, "label."); ok && len(v) > 0 {
+			labels[name] = v[0]
+		}
+	}
+
+	tier := -1
+	switch res := q.Get("resolution"); res {
+	case "", "auto":
+		tier = metricQueryTier(from, to, now)
+	default:
+		for i, t := range metricTiers {
+			if t.name == res {
+				tier = i
+			}
+		}
+		if tier < 0 {
+			http.Error(w, "resolution must be auto, raw, 1m or 1h", http.StatusBadRequest)
+			return
+		}
+	}
+	resolution := metricTiers[tier].resolution
+
+	type pointKey struct {
+		series string
+		start  int64
+	}
+	points := make(map[pointKey]*metricWindow)
+	seriesLabels := make(map[string]map[string]string)
+	err := db.View(func(tx *bolt.Tx) error {
+		marks := metricWatermarks(tx)
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil || record.Data["metric"] != metric {
+				return nil
+			}
+			if record.Timestamp.Before(from) || !record.Timestamp.Before(to) {
+				return nil
+			}
+			sample, t := metricSample(record)
+			// Finer records count only until they are rolled up, as their
+			// windows then hold them.
+			if t < 0 || t > tier || t < tier && !marks[t].IsZero() && record.Timestamp.Before(marks[t]) {
+				return nil
+			}
+			for name, value := range labels {
+				if sample.Labels[name] != value {
+					return nil
+				}
+			}
+			start := record.Timestamp
+			if resolution > 0 {
+				start = start.Truncate(resolution)
+			}
+			series := seriesKey(sample.Labels)
+			seriesLabels[series] = sample.Labels
+			key := pointKey{series, start.UnixMilli()}
+			if points[key] == nil {
+				points[key] = &metricWindow{}
+			}
+			points[key].merge(sample)
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to query metrics", http.StatusInternalServerError)
+		return
+	}
+
+	bySeries := make(map[string]*metricSeries)
+	for key, p := range points {
+		s := bySeries[key.series]
+		if s == nil {
+			s = &metricSeries{Labels: seriesLabels[key.series]}
+			bySeries[key.series] = s
+		}
+		s.Points = append(s.Points, metricPoint{
+			Timestamp: time.UnixMilli(key.start).UTC(),
+			Min:       p.Min,
+			Max:       p.Max,
+			Avg:       p.Sum / float64(p.Count),
+			Sum:       p.Sum,
+			Count:     p.Count,
+			Last:      p.Last,
+		})
+	}
+	series := make([]metricSeries, 0, len(bySeries))
+	for _, s := range bySeries {
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].Timestamp.Before(s.Points[j].Timestamp) })
+		series = append(series, *s)
+	}
+	sort.Slice(series, func(i, j int) bool { return seriesKey(series[i].Labels) < seriesKey(series[j].Labels) })
+
+	response.Write(w, r, http.StatusOK, metricQueryResult{
+		Metric:     metric,
+		From:       from.UTC(),
+		To:         to.UTC(),
+		Resolution: metricTiers[tier].name,
+		Series:     series,
+	}, nil)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/mqtt"
+)
+
+// MQTTTopic is a subscription of the MQTT listener and the type of the
+// records its messages become.
+type MQTTTopic struct {
+	Filter string `mapstructure:"filter"`
+	QoS    int    `mapstructure:"qos"`
+	Type   string `mapstructure:"type"`
+}
+
+var (
+	mqttMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_mqtt_messages_total",
+			Help: "MQTT messages received, by subscription topic filter and result",
+		},
+		[]string{"topic", "result"},
+	)
+	mqttBackpressureSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_mqtt_backpressure_seconds_total",
+			Help: "Time the MQTT listener stopped reading because the ingestion queue was full, by topic filter",
+		},
+		[]string{"topic"},
+	)
+	mqttQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_mqtt_queue_depth",
+			Help: "MQTT messages received but not yet stored",
+		},
+	)
+
+	mqttSubscriber *mqtt.Subscriber
+)
+
+func init() {
+	prometheus.MustRegister(mqttMessages, mqttBackpressureSeconds, mqttQueueDepth)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "data_mqtt_connected",
+			Help: "Whether the MQTT listener is connected and subscribed",
+		},
+		func() float64 {
+			if mqttConnected() {
+				return 1
+			}
+			return 0
+		},
+	))
+}
+
+func mqttConnected() bool {
+	return mqttSubscriber != nil && mqttSubscriber.Connected()
+}
+
+// mqttMessage is a received message waiting in the ingestion queue.
+type mqttMessage struct {
+	mqtt.Message
+	topic    MQTTTopic
+	received time.Time
+}
+
+// startMQTTIngestion subscribes to the mqtt.topics of mqtt.broker when
+// mqtt.enabled is set and stores every message as a record. The returned
+// func stops it.
+func startMQTTIngestion() func() {
+	if !viper.GetBool("mqtt.enabled") {
+		return func() {}
+	}
+
+	var topics []MQTTTopic
+	if err := viper.UnmarshalKey("mqtt.topics", &topics); err != nil {
+		logrus.WithError(err).Error("Invalid mqtt.topics, MQTT ingestion disabled")
+		return func() {}
+	}
+	subs := make([]mqtt.Subscription, 0, len(topics))
+	for i, t := range topics {
+		if t.Filter == "" || t.QoS < 0 || t.QoS > 2 {
+			logrus.WithFields(logrus.Fields{"filter": t.Filter, "qos": t.QoS}).Error("Invalid MQTT topic, MQTT ingestion disabled")
+			return func() {}
+		}
+		if t.Type == "" {
+			topics[i].Type = "mqtt"
+		}
+		subs = append(subs, mqtt.Subscription{Topic: t.Filter, QoS: byte(t.QoS)})
+	}
+	if len(subs) == 0 {
+		logrus.Warn("mqtt.enabled is set but mqtt.topics is empty, MQTT ingestion disabled")
+		return func() {}
+	}
+
+	clientID := viper.GetString("mqtt.client_id")
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "data-service-" + host
+	}
+	mqttSubscriber = mqtt.NewSubscriber(mqtt.Config{
+		Broker:            viper.GetString("mqtt.broker"),
+		ClientID:          clientID,
+		Username:          viper.GetString("mqtt.username"),
+		Password:          viper.GetString("mqtt.password"),
+		CleanSession:      viper.GetBool("mqtt.clean_session"),
+		KeepAlive:         viper.GetDuration("mqtt.keep_alive"),
+		MaxReconnectDelay: viper.GetDuration("mqtt.max_reconnect_delay"),
+		MaxPacketSize:     viper.GetInt("mqtt.max_message_bytes"),
+		Subscriptions:     subs,
+	})
+
+	queue := make(chan mqttMessage, max(viper.GetInt("mqtt.queue_size"), 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(queue)
+		mqttSubscriber.Run(ctx, func(m mqtt.Message) {
+			enqueueMQTTMessage(queue, mqttMessage{Message: m, topic: matchMQTTTopic(topics, m.Topic), received: time.Now()})
+		}, func(err error) {
+			logrus.WithError(err).WithField("broker", viper.GetString("mqtt.broker")).Warn("MQTT connection lost, reconnecting")
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		storeMQTTMessages(ctx, queue, max(viper.GetInt("mqtt.batch_size"), 1))
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"broker":    viper.GetString("mqtt.broker"),
+		"client_id": clientID,
+		"topics":    len(topics),
+	}).Info("MQTT ingestion started")
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// matchMQTTTopic returns the subscription a message arrived through: the
+// first whose filter matches its topic.
+func matchMQTTTopic(topics []MQTTTopic, topic string) MQTTTopic {
+	for _, t := range topics {
+		if mqtt.Match(t.Filter, topic) {
+			return t
+		}
+	}
+	return topics[0]
+}
+
+// enqueueMQTTMessage queues m for storing. When the queue is full a QoS 0
+// message is dropped, as the broker would not redeliver it anyway, and a
+// QoS 1 or 2 message waits: the listener stops reading, the broker's
+// in-flight window fills and the broker holds further messages back.
+func enqueueMQTTMessage(queue chan<- mqttMessage, m mqttMessage) {
+	defer func() { mqttQueueDepth.Set(float64(len(queue))) }()
+	select {
+	case queue <- m:
+		return
+	default:
+	}
+	if m.QoS == 0 {
+		mqttMessages.WithLabelValues(m.topic.Filter, "dropped").Inc()
+		return
+	}
+	start := time.Now()
+	queue <- m
+	mqttBackpressureSeconds.WithLabelValues(m.topic.Filter).Add(time.Since(start).Seconds())
+}
+
+// storeMQTTMessages stores the queued messages in batches of up to
+// batchSize records per transaction, acknowledging each message once its
+// record is committed. A failed batch is retried until ctx is cancelled;
+// its messages stay unacknowledged, so the broker redelivers them.
+func storeMQTTMessages(ctx context.Context, queue <-chan mqttMessage, batchSize int) {
+	for first := range queue {
+		batch := []mqttMessage{first}
+	fill:
+		for len(batch) < batchSize {
+			select {
+			case m, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			default:
+				break fill
+			}
+		}
+		mqttQueueDepth.Set(float64(len(queue)))
+
+		// Invalid messages are acknowledged too, in order with the others:
+		// redelivery would not make them valid.
+		var records []DataRecord
+		results := make([]string, len(batch))
+		for i, m := range batch {
+			record, err := mqttRecord(m)
+			if err != nil {
+				logrus.WithError(err).WithField("topic", m.Topic).Warn("Dropping invalid MQTT message")
+				results[i] = "invalid"
+				continue
+			}
+			records = append(records, record)
+			results[i] = "ingested"
+		}
+
+		for len(records) > 0 {
+			err := db.Update(func(tx *bolt.Tx) error {
+				for i := range records {
+					if err := putRecord(tx, &records[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err == nil {
+				break
+			}
+			for i, m := range batch {
+				if results[i] == "ingested" {
+					mqttMessages.WithLabelValues(m.topic.Filter, "error").Inc()
+				}
+			}
+			logrus.WithError(err).WithField("records", len(records)).Error("Failed to store MQTT records, retrying")
+			select {
+			case <-ctx.Done():
+				batch = nil
+			case <-time.After(time.Second):
+				continue
+			}
+			break
+		}
+
+		for i, m := range batch {
+			m.Ack()
+			mqttMessages.WithLabelValues(m.topic.Filter, results[i]).Inc()
+		}
+		if batch != nil {
+			dataRecordsTotal.WithLabelValues("pending").Add(float64(len(records)))
+		}
+	}
+}
+
+// mqttRecord converts a message to a pending record of its topic's type.
+// data.mqtt_topic is the topic the message was published to.
+func mqttRecord(m mqttMessage) (DataRecord, error) {
+	data := payloadData(m.Payload)
+	data["mqtt_topic"] = m.Topic
+	return ingestedRecord(m.topic.Type, "mqtt:"+m.topic.Filter, data, m.received)
+}
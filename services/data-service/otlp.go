@@ -0,0 +1,698 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"pipeline/pkg/codec"
+	"pipeline/pkg/response"
+)
+
+// traceStateBucket holds the summaries of traces still receiving spans,
+// keyed by trace ID.
+const traceStateBucket = "trace_state"
+
+// maxTraceServices caps the services kept in a trace's path.
+const maxTraceServices = 32
+
+var (
+	otlpSpans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_otlp_spans_total",
+			Help: "OTLP spans received, by result",
+		},
+		[]string{"result"},
+	)
+	otlpTraces = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_otlp_traces_total",
+			Help: "Trace summary records written, by operation",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(otlpSpans, otlpTraces)
+}
+
+// otlpSpan is the part of a received span a trace summary needs.
+type otlpSpan struct {
+	traceID  string
+	parentID string
+	name     string
+	service  string
+	start    int64 // Unix nanoseconds
+	end      int64
+	failed   bool
+	message  string
+}
+
+// decodeOTLPTraces decodes an ExportTraceServiceRequest. Spans without a
+// valid trace ID are counted in rejected.
+func decodeOTLPTraces(b []byte) (spans []otlpSpan, rejected int, err error) {
+	err = codec.DecodeFields(b, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		// ResourceSpans: the resource may follow its spans on the wire.
+		var service string
+		var scopes [][]byte
+		err := codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				attrs, err := decodeOTLPAttributes(data)
+				if err != nil {
+					return err
+				}
+				service = attrs["service.name"]
+			case num == 2 && typ == protowire.BytesType:
+				scopes = append(scopes, data)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, scope := range scopes {
+			err := codec.DecodeFields(scope, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+				if num != 2 || typ != protowire.BytesType {
+					return nil
+				}
+				span, err := decodeOTLPSpan(data)
+				if err != nil {
+					return err
+				}
+				span.service = service
+				if span.traceID == "" {
+					rejected++
+					return nil
+				}
+				spans = append(spans, span)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return spans, rejected, err
+}
+
+func decodeOTLPSpan(b []byte) (otlpSpan, error) {
+	var span otlpSpan
+	err := codec.DecodeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			span.traceID = otlpID(data, 16)
+		case num == 4 && typ == protowire.BytesType:
+			span.parentID = otlpID(data, 8)
+		case num == 5 && typ == protowire.BytesType:
+			span.name = string(data)
+		case num == 7 && typ == protowire.Fixed64Type:
+			span.start = int64(v)
+		case num == 8 && typ == protowire.Fixed64Type:
+			span.end = int64(v)
+		case num == 15 && typ == protowire.BytesType:
+			return codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+				switch {
+				case num == 2 && typ == protowire.BytesType:
+					span.message = string(data)
+				case num == 3 && typ == protowire.VarintType:
+					span.failed = v == otlpStatusError
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return span, err
+}
+
+// otlpStatusError is STATUS_CODE_ERROR of a span's Status.
+const otlpStatusError = 2
+
+// decodeOTLPAttributes decodes the string attributes of a Resource.
+func decodeOTLPAttributes(b []byte) (map[string]string, error) {
+	attrs := make(map[string]string)
+	err := codec.DecodeFields(b, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var key, value string
+		err := codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				key = string(data)
+			case num == 2 && typ == protowire.BytesType:
+				// AnyValue.string_value
+				return codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+					if num == 1 && typ == protowire.BytesType {
+						value = string(data)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		attrs[key] = value
+		return err
+	})
+	return attrs, err
+}
+
+// otlpID is the hex form of a trace or span ID, "" unless it has size bytes
+// and is not all zero.
+func otlpID(b []byte, size int) string {
+	if len(b) != size {
+		return ""
+	}
+	for _, c := range b {
+		if c != 0 {
+			return hex.EncodeToString(b)
+		}
+	}
+	return ""
+}
+
+// otlpJSONRequest is the JSON encoding of an ExportTraceServiceRequest.
+type otlpJSONRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []struct {
+				Key   string `json:"key"`
+				Value struct {
+					StringValue string `json:"stringValue"`
+				} `json:"value"`
+			} `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID           string       `json:"traceId"`
+				ParentSpanID      string       `json:"parentSpanId"`
+				Name              string       `json:"name"`
+				StartTimeUnixNano otlpJSONUint `json:"startTimeUnixNano"`
+				EndTimeUnixNano   otlpJSONUint `json:"endTimeUnixNano"`
+				Status            struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// otlpJSONUint is a 64-bit integer, which the protobuf JSON mapping sends as
+// a string but some exporters send as a number.
+type otlpJSONUint int64
+
+func (u *otlpJSONUint) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", b)
+	}
+	*u = otlpJSONUint(n)
+	return nil
+}
+
+func decodeOTLPTracesJSON(b []byte) (spans []otlpSpan, rejected int, err error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, 0, err
+	}
+	for _, rs := range req.ResourceSpans {
+		var service string
+		for _, attr := range rs.Resource.Attributes {
+			if attr.Key == "service.name" {
+				service = attr.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				traceID, _ := hex.DecodeString(s.TraceID)
+				parentID, _ := hex.DecodeString(s.ParentSpanID)
+				span := otlpSpan{
+					traceID:  otlpID(traceID, 16),
+					parentID: otlpID(parentID, 8),
+					name:     s.Name,
+					service:  service,
+					start:    int64(s.StartTimeUnixNano),
+					end:      int64(s.EndTimeUnixNano),
+					failed:   s.Status.Code == otlpStatusError,
+					message:  s.Status.Message,
+				}
+				if span.traceID == "" {
+					rejected++
+					continue
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans, rejected, nil
+}
+
+// traceState summarises the spans of a trace received so far.
+type traceState struct {
+	Start        int64  `json:"start"`
+	End          int64  `json:"end"`
+	Spans        int    `json:"spans"`
+	Errors       int    `json:"errors"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	RootService  string `json:"root_service,omitempty"`
+	RootSpan     string `json:"root_span,omitempty"`
+	// Services maps each service to the start of its first span.
+	Services map[string]int64 `json:"services"`
+	LastSeen time.Time        `json:"last_seen"`
+	// Dirty is set while spans have arrived since the record was written.
+	Dirty    bool   `json:"dirty"`
+	RecordID string `json:"record_id,omitempty"`
+}
+
+func (t *traceState) add(s otlpSpan) {
+	if s.service == "" {
+		s.service = "unknown_service"
+	}
+	if s.end < s.start {
+		s.end = s.start
+	}
+	if t.Spans == 0 || s.start < t.Start {
+		t.Start = s.start
+	}
+	if s.end > t.End {
+		t.End = s.end
+	}
+	t.Spans++
+	if s.failed {
+		t.Errors++
+		if t.ErrorMessage == "" {
+			t.ErrorMessage = s.message
+		}
+	}
+	if s.parentID == "" {
+		t.RootService, t.RootSpan = s.service, s.name
+	}
+	if first, ok := t.Services[s.service]; ok && s.start < first {
+		t.Services[s.service] = s.start
+	} else if !ok && len(t.Services) < maxTraceServices {
+		t.Services[s.service] = s.start
+	}
+}
+
+// servicePath lists the trace's services in the order they joined it.
+func (t *traceState) servicePath() []string {
+	path := make([]string, 0, len(t.Services))
+	for service := range t.Services {
+		path = append(path, service)
+	}
+	sort.Slice(path, func(i, j int) bool {
+		if t.Services[path[i]] != t.Services[path[j]] {
+			return t.Services[path[i]] < t.Services[path[j]]
+		}
+		return path[i] < path[j]
+	})
+	return path
+}
+
+// otlpTracesHandler serves POST /v1/traces, the OTLP/HTTP trace export, in
+// its protobuf or JSON encoding. Spans are folded into the summary of their
+// trace, which flushTraceSummaries stores as a trace record once the trace
+// has gone quiet.
+func otlpTracesHandler(w http.ResponseWriter, r *http.Request) {
+	maxBytes := viper.GetInt64("otlp_receiver.max_body_bytes")
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	b, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(b)) > maxBytes {
+		http.Error(w, fmt.Sprintf("Body exceeds %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var spans []otlpSpan
+	var rejected int
+	isJSON := false
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "application/x-protobuf"):
+		spans, rejected, err = decodeOTLPTraces(b)
+	case strings.HasPrefix(ct, "application/json"):
+		isJSON = true
+		spans, rejected, err = decodeOTLPTracesJSON(b)
+	default:
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid ExportTraceServiceRequest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(traceStateBucket))
+		states := make(map[string]*traceState)
+		now := time.Now()
+		for _, span := range spans {
+			state, ok := states[span.traceID]
+			if !ok {
+				state = &traceState{Services: make(map[string]int64)}
+				if v := bucket.Get([]byte(span.traceID)); v != nil {
+					if err := json.Unmarshal(v, state); err != nil {
+						return err
+					}
+				}
+				states[span.traceID] = state
+			}
+			state.add(span)
+			state.LastSeen, state.Dirty = now, true
+		}
+		for traceID, state := range states {
+			v, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(traceID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to store spans")
+		// Exporters retry on 503.
+		http.Error(w, "Failed to store spans", http.StatusServiceUnavailable)
+		return
+	}
+	otlpSpans.WithLabelValues("accepted").Add(float64(len(spans)))
+	otlpSpans.WithLabelValues("rejected").Add(float64(rejected))
+
+	// ExportTraceServiceResponse, with partial_success when spans were
+	// rejected.
+	var message string
+	if rejected > 0 {
+		message = "spans without a valid trace ID were rejected"
+	}
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		resp := map[string]interface{}{}
+		if rejected > 0 {
+			resp["partialSuccess"] = map[string]interface{}{"rejectedSpans": strconv.Itoa(rejected), "errorMessage": message}
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	var out []byte
+	if rejected > 0 {
+		var partial []byte
+		partial = codec.AppendInt64(partial, 1, int64(rejected))
+		partial = codec.AppendString(partial, 2, message)
+		out = codec.AppendMessage(out, 1, partial)
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(out)
+}
+
+// flushTracesContinuously stores quiet traces every otlp_receiver.flush_interval
+// until stop is closed.
+func flushTracesContinuously(stop <-chan struct{}) {
+	interval := viper.GetDuration("otlp_receiver.flush_interval")
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := flushTraceSummaries(); err != nil {
+			logrus.WithError(err).Error("Failed to store trace summaries")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushTraceSummaries writes a trace record for every trace that received
+// no spans for otlp_receiver.trace_idle. Its summary is kept for
+// otlp_receiver.late_span_window afterwards, so spans arriving late update the same
+// record instead of starting another.
+func flushTraceSummaries() error {
+	idle := viper.GetDuration("otlp_receiver.trace_idle")
+	lateWindow := viper.GetDuration("otlp_receiver.late_span_window")
+	created := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		bucket := tx.Bucket([]byte(traceStateBucket))
+		// Collected first: a bucket must not change under its cursor.
+		var expired [][]byte
+		ready := make(map[string]*traceState)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var state traceState
+			if err := json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+			quiet := now.Sub(state.LastSeen)
+			switch {
+			case !state.Dirty && quiet >= idle+lateWindow:
+				expired = append(expired, append([]byte(nil), k...))
+			case state.Dirty && quiet >= idle:
+				ready[string(k)] = &state
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for traceID, state := range ready {
+			isNew, err := storeTraceSummary(tx, traceID, state)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				created++
+			}
+			state.Dirty = false
+			v, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(traceID), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		dataRecordsTotal.WithLabelValues("pending").Add(float64(created))
+	}
+	return err
+}
+
+// storeTraceSummary creates or updates the trace record of state, reporting
+// whether it was created.
+func storeTraceSummary(tx *bolt.Tx, traceID string, state *traceState) (bool, error) {
+	start := time.Unix(0, state.Start)
+	record := DataRecord{ID: state.RecordID}
+	isNew := true
+	if state.RecordID != "" {
+		if _, v := findRecord(tx, []byte(state.RecordID)); v != nil {
+			if err := json.Unmarshal(v, &record); err != nil {
+				return false, err
+			}
+			isNew = false
+		}
+	}
+	if record.ID == "" {
+		record.ID = uuid.New().String()
+	}
+
+	path := state.servicePath()
+	status := "ok"
+	if state.Errors > 0 {
+		status = "error"
+	}
+	durationMs := float64(state.End-state.Start) / float64(time.Millisecond)
+	data := map[string]string{
+		"trace_id":     traceID,
+		"duration_ms":  strconv.FormatFloat(math.Round(durationMs*1000)/1000, 'f', -1, 64),
+		"service_path": strings.Join(path, " > "),
+		"services":     strconv.Itoa(len(path)),
+		"span_count":   strconv.Itoa(state.Spans),
+		"error_count":  strconv.Itoa(state.Errors),
+		"status":       status,
+		"start":        start.UTC().Format(time.RFC3339Nano),
+		"end":          time.Unix(0, state.End).UTC().Format(time.RFC3339Nano),
+	}
+	if state.RootService != "" {
+		data["root_service"] = state.RootService
+		data["root_span"] = state.RootSpan
+	}
+	if state.ErrorMessage != "" {
+		data["error_message"] = state.ErrorMessage
+	}
+
+	if isNew {
+		ingested, err := ingestedRecord("trace", "otlp", data, start)
+		if err != nil {
+			return false, err
+		}
+		ingested.ID = record.ID
+		record = ingested
+	} else {
+		record.Data = data
+		record.Timestamp = start
+		applyMasking(&record)
+	}
+	record.TraceID = traceID
+	if err := putRecord(tx, &record); err != nil {
+		return false, err
+	}
+	state.RecordID = record.ID
+	if isNew {
+		otlpTraces.WithLabelValues("created").Inc()
+	} else {
+		otlpTraces.WithLabelValues("updated").Inc()
+	}
+	return isNew, nil
+}
+
+// traceSummary is a trace record as listed by the slow trace query.
+type traceSummary struct {
+	TraceID     string    `json:"trace_id"`
+	RecordID    string    `json:"record_id"`
+	Start       time.Time `json:"start"`
+	DurationMs  float64   `json:"duration_ms"`
+	RootService string    `json:"root_service,omitempty"`
+	RootSpan    string    `json:"root_span,omitempty"`
+	ServicePath []string  `json:"service_path"`
+	SpanCount   int       `json:"span_count"`
+	ErrorCount  int       `json:"error_count"`
+	Status      string    `json:"status"`
+}
+
+// slowTracesHandler serves
+// GET /api/v1/traces/slow?min_duration=&service=&status=&from=&to=&offset=&limit=,
+// the trace records slowest first.
+func slowTracesHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var minDuration time.Duration
+	if v := q.Get("min_duration"); v != "" {
+		if minDuration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid min_duration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	service, status := q.Get("service"), q.Get("status")
+	if status != "" && status != "ok" && status != "error" {
+		http.Error(w, "status must be ok or error", http.StatusBadRequest)
+		return
+	}
+
+	traces := []traceSummary{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil || record.Type != "trace" {
+				return nil
+			}
+			t := traceSummaryOf(record)
+			switch {
+			case t.DurationMs < float64(minDuration)/float64(time.Millisecond):
+			case !from.IsZero() && t.Start.Before(from):
+			case !to.IsZero() && !t.Start.Before(to):
+			case status != "" && t.Status != status:
+			case service != "" && !containsString(t.ServicePath, service):
+			default:
+				traces = append(traces, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to query traces", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(traces, func(i, j int) bool {
+		if traces[i].DurationMs != traces[j].DurationMs {
+			return traces[i].DurationMs > traces[j].DurationMs
+		}
+		return traces[i].TraceID < traces[j].TraceID
+	})
+	start, end := page.Bounds(len(traces))
+	response.WriteList(w, r, traces[start:end], page, len(traces), nil)
+}
+
+func traceSummaryOf(record DataRecord) traceSummary {
+	t := traceSummary{
+		TraceID:     record.Data["trace_id"],
+		RecordID:    record.ID,
+		Start:       record.Timestamp,
+		RootService: record.Data["root_service"],
+		RootSpan:    record.Data["root_span"],
+		Status:      record.Data["status"],
+	}
+	t.DurationMs, _ = strconv.ParseFloat(record.Data["duration_ms"], 64)
+	t.SpanCount, _ = strconv.Atoi(record.Data["span_count"])
+	t.ErrorCount, _ = strconv.Atoi(record.Data["error_count"])
+	if path := record.Data["service_path"]; path != "" {
+		t.ServicePath = strings.Split(path, " > ")
+	}
+	return t
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
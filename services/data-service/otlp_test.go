@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"pipeline/pkg/codec"
+)
+
+var (
+	testTraceID = mustHex("5b8efff798038103d269b633813fc60c")
+	testRootID  = mustHex("eee19b7ec3c1b174")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+type testSpan struct {
+	traceID, parentID []byte
+	name              string
+	start, end        time.Time
+	status            int64
+	message           string
+}
+
+// encodeOTLPTraces encodes an ExportTraceServiceRequest with one
+// ResourceSpans per service, writing the resource after its spans as the
+// wire format allows.
+func encodeOTLPTraces(spansByService map[string][]testSpan) []byte {
+	var req []byte
+	for service, spans := range spansByService {
+		var scope []byte
+		for _, s := range spans {
+			var span []byte
+			span = codec.AppendMessage(span, 1, s.traceID)
+			span = codec.AppendMessage(span, 2, mustHex("0102030405060708"))
+			if s.parentID != nil {
+				span = codec.AppendMessage(span, 4, s.parentID)
+			}
+			span = codec.AppendString(span, 5, s.name)
+			span = protowire.AppendTag(span, 7, protowire.Fixed64Type)
+			span = protowire.AppendFixed64(span, uint64(s.start.UnixNano()))
+			span = protowire.AppendTag(span, 8, protowire.Fixed64Type)
+			span = protowire.AppendFixed64(span, uint64(s.end.UnixNano()))
+			var status []byte
+			status = codec.AppendString(status, 2, s.message)
+			status = codec.AppendInt64(status, 3, s.status)
+			span = codec.AppendMessage(span, 15, status)
+			scope = codec.AppendMessage(scope, 2, span)
+		}
+
+		var value, attr, resource, resourceSpans []byte
+		value = codec.AppendString(value, 1, service)
+		attr = codec.AppendString(attr, 1, "service.name")
+		attr = codec.AppendMessage(attr, 2, value)
+		resource = codec.AppendMessage(resource, 1, attr)
+		resourceSpans = codec.AppendMessage(resourceSpans, 2, scope)
+		resourceSpans = codec.AppendMessage(resourceSpans, 1, resource)
+		req = codec.AppendMessage(req, 1, resourceSpans)
+	}
+	return req
+}
+
+func TestDecodeOTLPTraces(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	body := encodeOTLPTraces(map[string][]testSpan{
+		"checkout": {
+			{traceID: testTraceID, name: "POST /orders", start: start, end: start.Add(120 * time.Millisecond)},
+			{traceID: make([]byte, 16), name: "zero trace ID", start: start, end: start},
+			{traceID: testTraceID[:8], name: "short trace ID", start: start, end: start},
+		},
+	})
+	spans, rejected, err := decodeOTLPTraces(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected != 2 || len(spans) != 1 {
+		t.Fatalf("decoded %d spans, rejected %d", len(spans), rejected)
+	}
+	want := otlpSpan{
+		traceID: "5b8efff798038103d269b633813fc60c",
+		name:    "POST /orders",
+		service: "checkout",
+		start:   start.UnixNano(),
+		end:     start.Add(120 * time.Millisecond).UnixNano(),
+	}
+	if spans[0] != want {
+		t.Errorf("span = %+v\nwant   %+v", spans[0], want)
+	}
+
+	body = encodeOTLPTraces(map[string][]testSpan{"payments": {
+		{traceID: testTraceID, parentID: testRootID, name: "charge", start: start, end: start, status: otlpStatusError, message: "card declined"},
+	}})
+	spans, _, err = decodeOTLPTraces(body)
+	if err != nil || len(spans) != 1 || spans[0].parentID != "eee19b7ec3c1b174" || !spans[0].failed || spans[0].message != "card declined" {
+		t.Errorf("failed child span = %+v, %v", spans, err)
+	}
+
+	if _, _, err := decodeOTLPTraces(body[:len(body)-3]); err == nil {
+		t.Error("truncated request was accepted")
+	}
+}
+
+func TestDecodeOTLPTracesJSON(t *testing.T) {
+	body := `{"resourceSpans": [{
+		"resource": {"attributes": [{"key": "host.name", "value": {"stringValue": "web-1"}}, {"key": "service.name", "value": {"stringValue": "checkout"}}]},
+		"scopeSpans": [{"spans": [
+			{"traceId": "5b8efff798038103d269b633813fc60c", "name": "POST /orders", "startTimeUnixNano": "1700000000000000000", "endTimeUnixNano": 1700000000120000000},
+			{"traceId": "5b8efff798038103d269b633813fc60c", "parentSpanId": "eee19b7ec3c1b174", "name": "charge", "startTimeUnixNano": "1700000000010000000", "endTimeUnixNano": "1700000000020000000", "status": {"code": 2, "message": "card declined"}},
+			{"traceId": "not hex", "name": "bad"}
+		]}]
+	}]}`
+	spans, rejected, err := decodeOTLPTracesJSON([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected != 1 || len(spans) != 2 {
+		t.Fatalf("decoded %d spans, rejected %d", len(spans), rejected)
+	}
+	if s := spans[0]; s.service != "checkout" || s.end != 1700000000120000000 || s.parentID != "" {
+		t.Errorf("root span = %+v", s)
+	}
+	if s := spans[1]; s.parentID != "eee19b7ec3c1b174" || !s.failed || s.message != "card declined" {
+		t.Errorf("child span = %+v", s)
+	}
+
+	if _, _, err := decodeOTLPTracesJSON([]byte(`{"resourceSpans": [{"scopeSpans": [{"spans": [{"startTimeUnixNano": "-1"}]}]}]}`)); err == nil {
+		t.Error("negative timestamp was accepted")
+	}
+}
+
+func TestOTLPTraceSummaries(t *testing.T) {
+	openTestDB(t)
+	defer viper.Set("otlp_receiver.trace_idle", viper.Get("otlp_receiver.trace_idle"))
+
+	post := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/v1/traces", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		otlpTracesHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("export: %d %s", w.Code, w.Body)
+		}
+		return w
+	}
+	start := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	w := post("application/x-protobuf", encodeOTLPTraces(map[string][]testSpan{
+		"checkout": {
+			{traceID: testTraceID, name: "POST /orders", start: start, end: start.Add(300 * time.Millisecond)},
+			{traceID: make([]byte, 16), name: "rejected", start: start, end: start},
+		},
+	}))
+	// ExportTraceServiceResponse.partial_success.rejected_spans
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte{0x0a}) || !bytes.Contains(w.Body.Bytes(), []byte{0x08, 0x01}) {
+		t.Errorf("response % x, want a partial success of one span", w.Body.Bytes())
+	}
+	w = post("application/json", []byte(`{"resourceSpans": [{"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "payments"}}]},
+		"scopeSpans": [{"spans": [{"traceId": "5b8efff798038103d269b633813fc60c", "parentSpanId": "eee19b7ec3c1b174", "name": "charge",
+			"startTimeUnixNano": "`+strconv.FormatInt(start.Add(50*time.Millisecond).UnixNano(), 10)+`", "endTimeUnixNano": "`+strconv.FormatInt(start.Add(100*time.Millisecond).UnixNano(), 10)+`",
+			"status": {"code": 2, "message": "card declined"}}]}]}]}`))
+	if strings.TrimSpace(w.Body.String()) != "{}" {
+		t.Errorf("JSON response %s", w.Body)
+	}
+
+	traces := func() []DataRecord {
+		var records []DataRecord
+		db.View(func(tx *bolt.Tx) error {
+			return forEachRecord(tx, -1, func(k, v []byte) error {
+				var record DataRecord
+				if decodeRecord(k, v, &record) == nil && record.Type == "trace" {
+					records = append(records, record)
+				}
+				return nil
+			})
+		})
+		return records
+	}
+
+	// The trace is not stored while it may still receive spans.
+	if err := flushTraceSummaries(); err != nil || len(traces()) != 0 {
+		t.Fatalf("flush before the trace went quiet stored %d records, %v", len(traces()), err)
+	}
+	viper.Set("otlp_receiver.trace_idle", "0s")
+	if err := flushTraceSummaries(); err != nil {
+		t.Fatal(err)
+	}
+	records := traces()
+	if len(records) != 1 {
+		t.Fatalf("stored %d trace records", len(records))
+	}
+	want := map[string]string{
+		"trace_id":      "5b8efff798038103d269b633813fc60c",
+		"duration_ms":   "300",
+		"service_path":  "checkout > payments",
+		"span_count":    "2",
+		"error_count":   "1",
+		"status":        "error",
+		"root_service":  "checkout",
+		"root_span":     "POST /orders",
+		"error_message": "card declined",
+	}
+	for k, v := range want {
+		if records[0].Data[k] != v {
+			t.Errorf("%s = %q, want %q", k, records[0].Data[k], v)
+		}
+	}
+
+	// A late span updates the same record.
+	post("application/x-protobuf", encodeOTLPTraces(map[string][]testSpan{
+		"inventory": {{traceID: testTraceID, parentID: testRootID, name: "reserve", start: start.Add(200 * time.Millisecond), end: start.Add(500 * time.Millisecond)}},
+	}))
+	if err := flushTraceSummaries(); err != nil {
+		t.Fatal(err)
+	}
+	updated := traces()
+	if len(updated) != 1 || updated[0].ID != records[0].ID {
+		t.Fatalf("late span left %d records", len(updated))
+	}
+	if d := updated[0].Data; d["span_count"] != "3" || d["duration_ms"] != "500" || d["service_path"] != "checkout > payments > inventory" {
+		t.Errorf("updated summary = %v", d)
+	}
+
+	for query, n := range map[string]int{
+		"?service=inventory":  1,
+		"?status=ok":          0,
+		"?min_duration=400ms": 1,
+		"?min_duration=1s":    0,
+	} {
+		w := httptest.NewRecorder()
+		slowTracesHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/traces/slow"+query, nil))
+		var resp struct {
+			Data []traceSummary `json:"data"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if len(resp.Data) != n {
+			t.Errorf("%s: %d traces, want %d", query, len(resp.Data), n)
+		}
+	}
+}
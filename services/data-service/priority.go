@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var pendingByPriority = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "data_pending_records_by_priority",
+		Help: "Pending records in each priority lane",
+	},
+	[]string{"priority"},
+)
+
+func init() {
+	prometheus.MustRegister(pendingByPriority)
+}
+
+// pendingIndex holds the unprocessed records by priority lane, so batches
+// are picked from the lanes without scanning processed records. Its value
+// is derived from the record's data rather than read from Priority, so
+// records stored before the field existed are indexed the same way.
+var pendingIndex = recordIndex{"pending_index", func(r DataRecord) string {
+	if r.Processed {
+		return ""
+	}
+	return laneKey(recordPriority(r))
+}}
+
+// maxPriority is the highest priority lane; lanes run from 0 to it.
+func maxPriority() int {
+	return max(viper.GetInt("processing.priorities.max"), 0)
+}
+
+// recordPriority is the lane of a record: its data.priority clamped to 0 to
+// maxPriority, 0 when missing or not a number.
+func recordPriority(r DataRecord) int {
+	p, err := strconv.Atoi(strings.TrimSpace(r.Data["priority"]))
+	if err != nil {
+		return 0
+	}
+	return min(max(p, 0), maxPriority())
+}
+
+func laneKey(priority int) string {
+	return fmt.Sprintf("%03d", priority)
+}
+
+// laneWeights reads processing.priorities.weights, lane to weight. Lanes
+// without a weight get 1; an empty map means strict priority.
+func laneWeights() map[int]int {
+	configured := viper.GetStringMapString("processing.priorities.weights")
+	if len(configured) == 0 {
+		return nil
+	}
+	weights := make(map[int]int, maxPriority()+1)
+	for p := 0; p <= maxPriority(); p++ {
+		weights[p] = 1
+	}
+	for lane, value := range configured {
+		p, errP := strconv.Atoi(lane)
+		w, errW := strconv.Atoi(value)
+		if errP != nil || errW != nil || p < 0 || p > maxPriority() || w < 0 {
+			logrus.WithFields(logrus.Fields{"lane": lane, "weight": value}).Warn("Invalid priority weight, ignored")
+			continue
+		}
+		weights[p] = w
+	}
+	return weights
+}
+
+// selectPendingRecords picks up to n pending records of a shard (all shards
+// for shard < 0) that accept takes, higher priority lanes first. With
+// processing.priorities.weights each lane is first offered its weighted
+// share of n, so lower lanes are not starved by a steady stream of higher
+// ones; what the shares leave over goes to the highest lanes with records.
+func selectPendingRecords(tx *bolt.Tx, shard, n int, accept func(DataRecord) bool) []DataRecord {
+	buckets := shardBuckets(tx, shard)
+	index := tx.Bucket([]byte(pendingIndex.bucket))
+	if index == nil || n <= 0 {
+		return nil
+	}
+
+	var records []DataRecord
+	selected := make(map[string]bool)
+	// take adds up to limit records of the lane to records.
+	take := func(priority, limit int) {
+		prefix := []byte(laneKey(priority) + "\x00")
+		c := index.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && limit > 0 && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			id := k[len(prefix):]
+			if selected[string(id)] {
+				continue
+			}
+			var v []byte
+			for _, b := range buckets {
+				if v = b.Get(id); v != nil {
+					break
+				}
+			}
+			var record DataRecord
+			if v == nil || decodeRecord(id, v, &record) != nil || record.Processed || !accept(record) {
+				continue
+			}
+			selected[record.ID] = true
+			records = append(records, record)
+			limit--
+		}
+	}
+
+	if weights := laneWeights(); weights != nil {
+		total := 0
+		for _, w := range weights {
+			total += w
+		}
+		for p := maxPriority(); p >= 0 && total > 0; p-- {
+			if share := (n*weights[p] + total - 1) / total; share > 0 {
+				take(p, min(share, n-len(records)))
+			}
+		}
+	}
+	for p := maxPriority(); p >= 0 && len(records) < n; p-- {
+		take(p, n-len(records))
+	}
+	return records
+}
+
+// pendingIndexLanesKey records the processing.priorities.max the pending
+// index was built with; it has no NUL so lane scans never see it.
+var pendingIndexLanesKey = []byte("lanes")
+
+// buildPendingIndex rebuilds the pending index from the records when it was
+// built for another processing.priorities.max, or not at all, as in
+// databases written before it existed.
+func buildPendingIndex() error {
+	indexed := 0
+	lanes := []byte(strconv.Itoa(maxPriority()))
+	err := db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(pendingIndex.bucket)); b != nil && string(b.Get(pendingIndexLanesKey)) == string(lanes) {
+			return nil
+		}
+		if err := tx.DeleteBucket([]byte(pendingIndex.bucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(pendingIndex.bucket))
+		if err != nil {
+			return err
+		}
+		var pending []DataRecord
+		err = forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil && !record.Processed {
+				pending = append(pending, record)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range pending {
+			if err := pendingIndex.update(tx, nil, record); err != nil {
+				return err
+			}
+		}
+		indexed = len(pending)
+		return b.Put(pendingIndexLanesKey, lanes)
+	})
+	if indexed > 0 {
+		logrus.WithField("records", indexed).Info("Built pending record index")
+	}
+	return err
+}
+
+// setPriorityGauges publishes the lane counts; callers hold statsMu.
+func setPriorityGauges() {
+	for p, n := range laneCounts {
+		pendingByPriority.WithLabelValues(strconv.Itoa(p)).Set(float64(n))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MaskingRule describes how a single data field is masked on ingestion.
+type MaskingRule struct {
+	Field  string `json:"field" mapstructure:"field"`
+	Action string `json:"action" mapstructure:"action"` // "hash" or "redact"
+}
+
+// DeletionReport records a subject deletion. RecordIDs and DeletedCount
+// include the ArchivedCount records erased from archive objects.
+type DeletionReport struct {
+	ID            string    `json:"id"`
+	SubjectHash   string    `json:"subject_hash"`
+	Fields        []string  `json:"fields_checked"`
+	RecordIDs     []string  `json:"record_ids"`
+	DeletedCount  int       `json:"deleted_count"`
+	ArchivedCount int       `json:"archived_count"`
+	RequestedAt   time.Time `json:"requested_at"`
+	RemoteAddr    string    `json:"remote_addr"`
+}
+
+const redactedValue = "[REDACTED]"
+
+var (
+	maskingRules  []MaskingRule
+	subjectFields []string
+)
+
+func loadPrivacyConfig() {
+	maskingRules = nil
+	if err := viper.UnmarshalKey("privacy.masking_rules", &maskingRules); err != nil {
+		logrus.WithError(err).Warn("Invalid privacy.masking_rules, masking disabled")
+		maskingRules = nil
+	}
+	for _, rule := range maskingRules {
+		if rule.Action != "hash" && rule.Action != "redact" {
+			logrus.WithFields(logrus.Fields{
+				"field":  rule.Field,
+				"action": rule.Action,
+			}).Warn("Unknown masking action, field will be redacted")
+		}
+	}
+	subjectFields = viper.GetStringSlice("privacy.subject_fields")
+}
+
+// hashValue returns the salted SHA-256 of a value. It is deterministic so
+// hashed fields can still be matched by a later deletion request.
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(secretValue("privacy.hash_salt") + value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// applyMasking rewrites the record's data fields according to the configured
+// masking rules. It returns the masked fields as "field (action)" for the
+// record's lineage.
+func applyMasking(record *DataRecord) []string {
+	var masked []string
+	for _, rule := range maskingRules {
+		value, ok := record.Data[rule.Field]
+		if !ok {
+			continue
+		}
+		switch rule.Action {
+		case "hash":
+			record.Data[rule.Field] = hashValue(value)
+			masked = append(masked, rule.Field+" (hash)")
+		default:
+			record.Data[rule.Field] = redactedValue
+			masked = append(masked, rule.Field+" (redact)")
+		}
+	}
+	return masked
+}
+
+// referencesSubject reports whether any subject field of the record holds the
+// subject ID, either in clear text or in its hashed form.
+func referencesSubject(record DataRecord, subjectID string) bool {
+	hashed := hashValue(subjectID)
+	for _, field := range subjectFields {
+		value, ok := record.Data[field]
+		if !ok {
+			continue
+		}
+		if value == subjectID || value == hashed {
+			return true
+		}
+	}
+	return false
+}
+
+// erasedSubjects returns the record IDs and subject hashes of every subject
+// deletion report, for restores that must not bring erased records back.
+func erasedSubjects(tx *bolt.Tx) (recordIDs, subjects map[string]bool, err error) {
+	recordIDs, subjects = make(map[string]bool), make(map[string]bool)
+	err = tx.Bucket([]byte("deletion_reports")).ForEach(func(k, v []byte) error {
+		var report DeletionReport
+		if err := json.Unmarshal(v, &report); err != nil {
+			return fmt.Errorf("decode report %s: %w", k, err)
+		}
+		subjects[report.SubjectHash] = true
+		for _, id := range report.RecordIDs {
+			recordIDs[id] = true
+		}
+		return nil
+	})
+	return recordIDs, subjects, err
+}
+
+// referencesErasedSubject reports whether a subject field of record holds
+// one of subjects, the hashes of erased subjects, in plain or hashed form.
+func referencesErasedSubject(record DataRecord, subjects map[string]bool) bool {
+	for _, field := range subjectFields {
+		if value, ok := record.Data[field]; ok && (subjects[value] || subjects[hashValue(value)]) {
+			return true
+		}
+	}
+	return false
+}
+
+func deleteSubjectRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	subjectID := r.URL.Query().Get("subject_id")
+	if subjectID == "" {
+		http.Error(w, "subject_id is required", http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	confirmed := false
+	if token := r.URL.Query().Get("confirm"); token != "" && !dryRun {
+		scope, err := redeemConfirmation(token, "subject_deletion")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if scope != hashValue(subjectID) {
+			http.Error(w, "Confirmation token was issued for another subject", http.StatusConflict)
+			return
+		}
+		confirmed = true
+	}
+
+	report := DeletionReport{
+		ID:          uuid.New().String(),
+		SubjectHash: hashValue(subjectID),
+		Fields:      subjectFields,
+		RecordIDs:   []string{},
+		RequestedAt: time.Now(),
+		RemoteAddr:  r.RemoteAddr,
+	}
+
+	plan := newDeletionPlan("subject_deletion", map[string]string{"subject_hash": report.SubjectHash})
+	plan.DryRun = dryRun
+	txn := db.Update
+	if dryRun {
+		txn = db.View
+	}
+
+	// Taken before the transaction, in the same order as archive runs.
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	err = txn(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		c := newRecordCursor(tx, -1)
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				continue
+			}
+			if referencesSubject(record, subjectID) {
+				keys = append(keys, []byte(record.ID))
+				report.RecordIDs = append(report.RecordIDs, record.ID)
+				plan.add(record, v)
+			}
+		}
+		archived, err := findArchivedSubject(tx, subjectID)
+		if err != nil {
+			return err
+		}
+		for _, match := range archived {
+			for _, record := range match.erased {
+				report.RecordIDs = append(report.RecordIDs, record.ID)
+				report.ArchivedCount++
+				data, _ := json.Marshal(record)
+				plan.add(record, data)
+			}
+		}
+		if dryRun {
+			return nil
+		}
+		if !confirmed && plan.needsConfirmation() {
+			return errConfirmationRequired
+		}
+
+		if err := eraseRecords(tx, keys); err != nil {
+			return err
+		}
+		if err := eraseArchived(tx, archived); err != nil {
+			return err
+		}
+		report.DeletedCount = len(keys) + report.ArchivedCount
+
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("deletion_reports")).Put([]byte(report.ID), data)
+	})
+
+	if (err == nil && dryRun) || err == errConfirmationRequired {
+		if plan.needsConfirmation() {
+			plan.confirm(report.SubjectHash)
+		}
+		writeDeletionPlan(w, plan)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to delete subject records")
+		http.Error(w, "Failed to delete subject records", http.StatusInternalServerError)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"report_id":     report.ID,
+		"subject_hash":  report.SubjectHash,
+		"deleted_count": report.DeletedCount,
+	}).Info("Subject records deleted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func getDeletionReportsHandler(w http.ResponseWriter, r *http.Request) {
+	reports := []DeletionReport{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("deletion_reports")).ForEach(func(k, v []byte) error {
+			var report DeletionReport
+			if err := json.Unmarshal(v, &report); err != nil {
+				return fmt.Errorf("decode report %s: %w", k, err)
+			}
+			reports = append(reports, report)
+			return nil
+		})
+	})
+
+	if err != nil {
+		http.Error(w, "Failed to retrieve deletion reports", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reports": reports,
+		"total":   len(reports),
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"pipeline/pkg/codec"
+)
+
+// promWindowsBucket holds the open downsampling windows of remote-written
+// series, keyed by window start and series.
+const promWindowsBucket = "prom_windows"
+
+var (
+	promWriteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_prom_write_samples_total",
+			Help: "Remote-written samples, by result",
+		},
+		[]string{"result"},
+	)
+	promWriteWindows = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "data_prom_write_windows_total",
+			Help: "Downsampled windows of remote-written series stored as metric records",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(promWriteSamples, promWriteWindows)
+}
+
+// promSeries is a TimeSeries of a remote-write WriteRequest.
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+// decodeWriteRequest decodes the series of a prometheus.WriteRequest.
+// Metadata and exemplars are ignored.
+func decodeWriteRequest(b []byte) ([]promSeries, error) {
+	var series []promSeries
+	err := codec.DecodeFields(b, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		s := promSeries{labels: make(map[string]string)}
+		err := codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, _ uint64, data []byte) error {
+			if typ != protowire.BytesType {
+				return nil
+			}
+			switch num {
+			case 1:
+				name, value, err := codec.DecodeStringMapEntry(data)
+				if err != nil {
+					return err
+				}
+				s.labels[name] = value
+			case 2:
+				var sample promSample
+				err := codec.DecodeFields(data, func(num protowire.Number, typ protowire.Type, v uint64, _ []byte) error {
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						sample.value = math.Float64frombits(v)
+					case num == 2 && typ == protowire.VarintType:
+						sample.timestamp = int64(v)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				s.samples = append(s.samples, sample)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if s.labels["__name__"] == "" {
+			return fmt.Errorf("series without a __name__ label")
+		}
+		series = append(series, s)
+		return nil
+	})
+	return series, err
+}
+
+// promWindowKey orders windows by start, then series.
+func promWindowKey(start int64, labels map[string]string) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := binary.BigEndian.AppendUint64(nil, uint64(start))
+	for _, name := range names {
+		key = append(key, name...)
+		key = append(key, '=')
+		key = append(key, labels[name]...)
+		key = append(key, 0xff)
+	}
+	return key
+}
+
+// promResolution is the width of the downsampling windows and promGrace how
+// long a window stays open for late samples after it ends.
+func promResolution() time.Duration {
+	if d := viper.GetDuration("prom_write.resolution"); d >= time.Second {
+		return d
+	}
+	return time.Minute
+}
+
+func promGrace() time.Duration {
+	return max(viper.GetDuration("prom_write.grace"), 0)
+}
+
+// promWriteHandler serves POST /api/v1/prom/write, the Prometheus
+// remote-write protocol (version 1). Samples are folded into the open
+// windows of their series before the response, so an acknowledged sample
+// survives a restart; samples for windows already stored are dropped.
+func promWriteHandler(w http.ResponseWriter, r *http.Request) {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/x-protobuf") ||
+		strings.Contains(ct, "proto=") && !strings.Contains(ct, "proto=prometheus.WriteRequest") {
+		http.Error(w, "Only remote write 1.0 (prometheus.WriteRequest) is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, "Body must be snappy-compressed", http.StatusUnsupportedMediaType)
+		return
+	}
+	maxBytes := viper.GetInt("prom_write.max_body_bytes")
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBytes {
+		http.Error(w, fmt.Sprintf("Body exceeds %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if body, err = codec.DecodeSnappy(body, maxBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid WriteRequest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resolution := promResolution().Milliseconds()
+	results := make(map[string]int)
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Read inside the transaction so the flusher, which takes the same
+		// time under the same lock, has not stored any window accepted here.
+		now := time.Now()
+		cutoff := now.Add(-promGrace()).UnixMilli()
+		horizon := now.Add(promResolution()).UnixMilli()
+		bucket := tx.Bucket([]byte(promWindowsBucket))
+		windows := make(map[string]*metricWindow)
+		for _, s := range series {
+			for _, sample := range s.samples {
+				start := sample.timestamp - sample.timestamp%resolution
+				switch {
+				case math.IsNaN(sample.value) || math.IsInf(sample.value, 0):
+					// Includes the staleness markers Prometheus sends.
+					results["non_finite"]++
+					continue
+				case start+resolution <= cutoff:
+					results["late"]++
+					continue
+				case start > horizon:
+					results["future"]++
+					continue
+				}
+				key := string(promWindowKey(start, s.labels))
+				window, ok := windows[key]
+				if !ok {
+					window = &metricWindow{Labels: s.labels}
+					if v := bucket.Get([]byte(key)); v != nil {
+						if err := json.Unmarshal(v, window); err != nil {
+							return err
+						}
+					}
+					windows[key] = window
+				}
+				window.add(sample.value, sample.timestamp)
+				results["accepted"]++
+			}
+		}
+		for key, window := range windows {
+			v, err := json.Marshal(window)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to store remote-written samples")
+		// 5xx makes Prometheus retry the request.
+		http.Error(w, "Failed to store samples", http.StatusInternalServerError)
+		return
+	}
+	for result, n := range results {
+		promWriteSamples.WithLabelValues(result).Add(float64(n))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flushPromWindowsContinuously stores the windows that have closed as
+// metric records every prom_write.flush_interval until stop is closed.
+func flushPromWindowsContinuously(stop <-chan struct{}) {
+	interval := viper.GetDuration("prom_write.flush_interval")
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := flushPromWindows(); err != nil {
+			logrus.WithError(err).Error("Failed to store downsampled metric windows")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flushPromWindows converts every window that ended more than
+// prom_write.grace ago into a metric record, in transactions of up to
+// 1000 windows.
+func flushPromWindows() error {
+	resolution := promResolution()
+	for {
+		stored := 0
+		err := db.Update(func(tx *bolt.Tx) error {
+			limit := time.Now().Add(-promGrace()).Add(-resolution).UnixMilli()
+			c := tx.Bucket([]byte(promWindowsBucket)).Cursor()
+			for k, v := c.First(); k != nil && stored < 1000; k, v = c.First() {
+				start := int64(binary.BigEndian.Uint64(k))
+				if start > limit {
+					break
+				}
+				var window metricWindow
+				if err := json.Unmarshal(v, &window); err != nil {
+					return err
+				}
+				record, err := metricWindowRecord(window, time.UnixMilli(start), resolution, "prom_write")
+				if err != nil {
+					return err
+				}
+				if err := putRecord(tx, &record); err != nil {
+					return err
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				stored++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		promWriteWindows.Add(float64(stored))
+		dataRecordsTotal.WithLabelValues("pending").Add(float64(stored))
+		if stored < 1000 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/codec"
+)
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest.
+func encodeWriteRequest(series ...promSeries) []byte {
+	var b []byte
+	for _, s := range series {
+		var ts []byte
+		ts = codec.AppendStringMap(ts, 1, s.labels)
+		for _, sample := range s.samples {
+			var sb []byte
+			sb = codec.AppendDouble(sb, 1, sample.value)
+			sb = codec.AppendInt64(sb, 2, sample.timestamp)
+			ts = codec.AppendMessage(ts, 2, sb)
+		}
+		b = codec.AppendMessage(b, 1, ts)
+	}
+	return b
+}
+
+// snappyLiteral encodes b as a snappy block of literals only.
+func snappyLiteral(b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(b)))
+	for len(b) > 0 {
+		n := min(len(b), 1<<16)
+		out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		out = append(out, b[:n]...)
+		b = b[n:]
+	}
+	return out
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	body := encodeWriteRequest(
+		promSeries{labels: map[string]string{"__name__": "http_requests_total", "job": "api"}, samples: []promSample{{1, 1000}, {2.5, 2000}}},
+		promSeries{labels: map[string]string{"__name__": "up"}, samples: []promSample{{1, 1000}}},
+	)
+	series, err := decodeWriteRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].labels["job"] != "api" || len(series[0].samples) != 2 || series[0].samples[1] != (promSample{2.5, 2000}) {
+		t.Errorf("decoded %+v", series)
+	}
+
+	if _, err := decodeWriteRequest(encodeWriteRequest(promSeries{labels: map[string]string{"job": "api"}})); err == nil {
+		t.Error("series without a name was accepted")
+	}
+	if _, err := decodeWriteRequest(body[:len(body)-1]); err == nil {
+		t.Error("truncated request was accepted")
+	}
+}
+
+func TestPromWriteDownsamplesIntoWindows(t *testing.T) {
+	openTestDB(t)
+	defer viper.Set("prom_write.grace", viper.Get("prom_write.grace"))
+
+	now := time.Now()
+	window := now.Truncate(time.Minute).Add(-time.Minute)
+	body := encodeWriteRequest(promSeries{
+		labels: map[string]string{"__name__": "queue_depth", "queue": "ingest"},
+		samples: []promSample{
+			{3, window.Add(10 * time.Second).UnixMilli()},
+			{5, window.Add(20 * time.Second).UnixMilli()},
+			{math.NaN(), window.Add(30 * time.Second).UnixMilli()},
+			{1, now.Add(-10 * time.Minute).UnixMilli()},
+			{1, now.Add(10 * time.Minute).UnixMilli()},
+		},
+	})
+	post := func(contentType, encoding string, body []byte) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/prom/write", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		promWriteHandler(w, r)
+		return w.Code
+	}
+	if code := post("application/x-protobuf;proto=io.prometheus.write.v2.Request", "snappy", snappyLiteral(body)); code != http.StatusUnsupportedMediaType {
+		t.Errorf("remote write 2.0: %d", code)
+	}
+	if code := post("application/x-protobuf", "", body); code != http.StatusUnsupportedMediaType {
+		t.Errorf("uncompressed body: %d", code)
+	}
+	if code := post("application/x-protobuf", "snappy", body); code != http.StatusBadRequest {
+		t.Errorf("body that is not snappy: %d", code)
+	}
+	if code := post("application/x-protobuf", "snappy", snappyLiteral(body)); code != http.StatusNoContent {
+		t.Fatalf("remote write: %d", code)
+	}
+
+	var windows []metricWindow
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(promWindowsBucket)).ForEach(func(_, v []byte) error {
+			var w metricWindow
+			json.Unmarshal(v, &w)
+			windows = append(windows, w)
+			return nil
+		})
+	})
+	// The NaN, late and future samples are dropped.
+	if len(windows) != 1 || windows[0].Count != 2 || windows[0].Min != 3 || windows[0].Max != 5 || windows[0].Last != 5 {
+		t.Fatalf("open windows = %+v", windows)
+	}
+
+	// With the default grace of a minute the window is still open.
+	if err := flushPromWindows(); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("prom_write.grace", "0s")
+	if err := flushPromWindows(); err != nil {
+		t.Fatal(err)
+	}
+	var stored []DataRecord
+	db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(promWindowsBucket)).Cursor().First(); k != nil {
+			t.Error("window left open after the flush")
+		}
+		return forEachRecord(tx, -1, func(_, v []byte) error {
+			var record DataRecord
+			json.Unmarshal(v, &record)
+			stored = append(stored, record)
+			return nil
+		})
+	})
+	if len(stored) != 1 {
+		t.Fatalf("stored %d records, want one window", len(stored))
+	}
+	data := stored[0].Data
+	if stored[0].Type != "metric" || data["metric"] != "queue_depth" || data["label.queue"] != "ingest" ||
+		data["count"] != "2" || data["avg"] != "4" || data["window_start"] != window.UTC().Format(time.RFC3339) {
+		t.Errorf("stored %+v", stored[0])
+	}
+}
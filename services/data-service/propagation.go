@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"pipeline/pkg/propagation"
+	"pipeline/pkg/telemetry"
+)
+
+// httpRequestsByContext breaks requests down by the tenant and priority the
+// gateway propagated. It is kept apart from data_http_requests_total so the
+// per-endpoint series do not multiply by tenant.
+var httpRequestsByContext = telemetry.NewLimitedCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_http_requests_by_context_total",
+		Help: "HTTP requests by propagated tenant and request priority",
+	},
+	[]string{"tenant", "priority", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsByContext)
+}
+
+// contextLogFields adds the propagated tenant, API key ID and priority to
+// request log entries.
+func contextLogFields(r *http.Request) logrus.Fields {
+	return propagation.FromRequest(r).LogFields()
+}
+
+func observeRequestContext(r *http.Request, status string) {
+	v := propagation.FromRequest(r)
+	httpRequestsByContext.WithLabelValues(v.TenantLabel(), v.PriorityLabel(), status).Inc()
+}
@@ -0,0 +1,158 @@
+// gRPC ingestion API of the data service, served on grpc.port when
+// grpc.enabled is set. The Go code in ingestpb is generated from this file;
+// after changing it, run from services/data-service:
+//
+//   protoc --go_out=. --go_opt=module=data-service \
+//     --go-grpc_out=. --go-grpc_opt=module=data-service proto/ingest.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: proto/ingest.proto
+
+package ingestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Ingest_IngestRecords_FullMethodName = "/pipeline.data.v1.Ingest/IngestRecords"
+)
+
+// IngestClient is the client API for Ingest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngestClient interface {
+	// IngestRecords stores a stream of records. Records are numbered from 1
+	// in the order they are sent, and an IngestAck follows every write: after
+	// a batch fills or once a second while records are pending. A client
+	// that loses the stream resends the records after the last
+	// through_sequence it was acked.
+	IngestRecords(ctx context.Context, opts ...grpc.CallOption) (Ingest_IngestRecordsClient, error)
+}
+
+type ingestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestClient(cc grpc.ClientConnInterface) IngestClient {
+	return &ingestClient{cc}
+}
+
+func (c *ingestClient) IngestRecords(ctx context.Context, opts ...grpc.CallOption) (Ingest_IngestRecordsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Ingest_ServiceDesc.Streams[0], Ingest_IngestRecords_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ingestIngestRecordsClient{stream}
+	return x, nil
+}
+
+type Ingest_IngestRecordsClient interface {
+	Send(*IngestRecord) error
+	Recv() (*IngestAck, error)
+	grpc.ClientStream
+}
+
+type ingestIngestRecordsClient struct {
+	grpc.ClientStream
+}
+
+func (x *ingestIngestRecordsClient) Send(m *IngestRecord) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *ingestIngestRecordsClient) Recv() (*IngestAck, error) {
+	m := new(IngestAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestServer is the server API for Ingest service.
+// All implementations must embed UnimplementedIngestServer
+// for forward compatibility
+type IngestServer interface {
+	// IngestRecords stores a stream of records. Records are numbered from 1
+	// in the order they are sent, and an IngestAck follows every write: after
+	// a batch fills or once a second while records are pending. A client
+	// that loses the stream resends the records after the last
+	// through_sequence it was acked.
+	IngestRecords(Ingest_IngestRecordsServer) error
+	mustEmbedUnimplementedIngestServer()
+}
+
+// UnimplementedIngestServer must be embedded to have forward compatible implementations.
+type UnimplementedIngestServer struct {
+}
+
+func (UnimplementedIngestServer) IngestRecords(Ingest_IngestRecordsServer) error {
+	return status.Errorf(codes.Unimplemented, "method IngestRecords not implemented")
+}
+func (UnimplementedIngestServer) mustEmbedUnimplementedIngestServer() {}
+
+// UnsafeIngestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServer will
+// result in compilation errors.
+type UnsafeIngestServer interface {
+	mustEmbedUnimplementedIngestServer()
+}
+
+func RegisterIngestServer(s grpc.ServiceRegistrar, srv IngestServer) {
+	s.RegisterService(&Ingest_ServiceDesc, srv)
+}
+
+func _Ingest_IngestRecords_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngestServer).IngestRecords(&ingestIngestRecordsServer{stream})
+}
+
+type Ingest_IngestRecordsServer interface {
+	Send(*IngestAck) error
+	Recv() (*IngestRecord, error)
+	grpc.ServerStream
+}
+
+type ingestIngestRecordsServer struct {
+	grpc.ServerStream
+}
+
+func (x *ingestIngestRecordsServer) Send(m *IngestAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *ingestIngestRecordsServer) Recv() (*IngestRecord, error) {
+	m := new(IngestRecord)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Ingest_ServiceDesc is the grpc.ServiceDesc for Ingest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ingest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pipeline.data.v1.Ingest",
+	HandlerType: (*IngestServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestRecords",
+			Handler:       _Ingest_IngestRecords_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/ingest.proto",
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// quarantineBucket holds the stored records that could not be decoded or
+// lack what every record has, keyed by record ID, until they are repaired
+// and requeued or discarded.
+const quarantineBucket = "quarantine"
+
+var (
+	recordsQuarantined = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_records_quarantined_total",
+			Help: "Stored records moved to quarantine, by reason: decode or schema",
+		},
+		[]string{"reason"},
+	)
+	quarantineSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_quarantine_records",
+			Help: "Records in quarantine",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recordsQuarantined, quarantineSize)
+}
+
+// QuarantinedRecord is a stored record value moved out of the records
+// buckets.
+type QuarantinedRecord struct {
+	ID     string `json:"id"`
+	Bucket string `json:"bucket"`
+	// Reason is decode for values that are not a record, schema for
+	// records without their ID, a type or a timestamp.
+	Reason string `json:"reason"`
+	// Error is why the value was quarantined, or why the last repair is
+	// still invalid; it is empty once a repair makes it a valid record.
+	Error string `json:"error"`
+	// Raw is the value, base64-encoded.
+	Raw           []byte         `json:"raw"`
+	QuarantinedAt time.Time      `json:"quarantined_at"`
+	RepairedAt    *time.Time     `json:"repaired_at,omitempty"`
+	Links         response.Links `json:"links,omitempty"`
+}
+
+// errRecordSchema is wrapped by validateRecord's errors for values that
+// decode but are not a valid record.
+var errRecordSchema = errors.New("invalid record")
+
+// validateRecord decodes the value stored under key and checks that it is
+// a record with that ID, a type and a timestamp.
+func validateRecord(key, value []byte) (DataRecord, error) {
+	var record DataRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, err
+	}
+	switch {
+	case record.ID != string(key):
+		return record, fmt.Errorf("%w: id %q does not match key %q", errRecordSchema, record.ID, key)
+	case record.Type == "":
+		return record, fmt.Errorf("%w: missing type", errRecordSchema)
+	case record.Timestamp.IsZero():
+		return record, fmt.Errorf("%w: missing timestamp", errRecordSchema)
+	}
+	return record, nil
+}
+
+func quarantineReason(err error) string {
+	if errors.Is(err, errRecordSchema) {
+		return "schema"
+	}
+	return "decode"
+}
+
+// malformed holds the keys of records scans failed to decode, moved to
+// quarantine by the leader's next quarantine pass.
+var malformed = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// decodeRecord decodes a record met during a scan. A value that does not
+// decode is flagged for quarantine; the scan skips it.
+func decodeRecord(key, value []byte, record *DataRecord) error {
+	err := json.Unmarshal(value, record)
+	if err != nil {
+		malformed.Lock()
+		malformed.keys[string(key)] = true
+		malformed.Unlock()
+	}
+	return err
+}
+
+// quarantineContinuously moves the records scans flagged every
+// quarantine.interval and sweeps all records for invalid ones at start and
+// every quarantine.sweep_interval. Only the leader moves records.
+func quarantineContinuously() {
+	ticker := time.NewTicker(viper.GetDuration("quarantine.interval"))
+	defer ticker.Stop()
+
+	sweepInterval := viper.GetDuration("quarantine.sweep_interval")
+	var lastSweep time.Time
+	for ; ; <-ticker.C {
+		if !isLeader() {
+			continue
+		}
+		sweep := lastSweep.IsZero() || (sweepInterval > 0 && time.Since(lastSweep) >= sweepInterval)
+		moved, err := quarantineRecords(sweep)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to quarantine malformed records")
+			continue
+		}
+		if sweep {
+			lastSweep = time.Now()
+		}
+		if moved > 0 {
+			logrus.WithField("records", moved).Warn("Quarantined malformed records")
+		}
+	}
+}
+
+// quarantineRecords moves the flagged records, or with sweep every record,
+// that are not valid to the quarantine bucket, and returns how many it
+// moved.
+func quarantineRecords(sweep bool) (int, error) {
+	malformed.Lock()
+	flagged := malformed.keys
+	malformed.keys = make(map[string]bool)
+	malformed.Unlock()
+	if !sweep && len(flagged) == 0 {
+		return 0, nil
+	}
+
+	type invalid struct {
+		key, value []byte
+		bucket     string
+		err        error
+	}
+	moved := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		var found []invalid
+		check := func(name, k, v []byte) {
+			if _, err := validateRecord(k, v); err != nil {
+				found = append(found, invalid{
+					key:    append([]byte(nil), k...),
+					value:  append([]byte(nil), v...),
+					bucket: string(name),
+					err:    err,
+				})
+			}
+		}
+		tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			switch {
+			case shardBucketIndex(name) < 0:
+			case sweep:
+				b.ForEach(func(k, v []byte) error {
+					check(name, k, v)
+					return nil
+				})
+			default:
+				for key := range flagged {
+					if v := b.Get([]byte(key)); v != nil {
+						check(name, []byte(key), v)
+					}
+				}
+			}
+			return nil
+		})
+
+		q := tx.Bucket([]byte(quarantineBucket))
+		now := time.Now().UTC()
+		for _, bad := range found {
+			reason := quarantineReason(bad.err)
+			entry, err := json.Marshal(QuarantinedRecord{
+				ID:            string(bad.key),
+				Bucket:        bad.bucket,
+				Reason:        reason,
+				Error:         bad.err.Error(),
+				Raw:           bad.value,
+				QuarantinedAt: now,
+			})
+			if err != nil {
+				return err
+			}
+			if err := q.Put(bad.key, entry); err != nil {
+				return err
+			}
+			if err := deleteRecord(tx, bad.key); err != nil {
+				return err
+			}
+			recordsQuarantined.WithLabelValues(reason).Inc()
+		}
+		moved = len(found)
+		return nil
+	})
+	if err == nil {
+		updateQuarantineSize()
+	} else {
+		// Flag the records again for the next pass.
+		malformed.Lock()
+		for key := range flagged {
+			malformed.keys[key] = true
+		}
+		malformed.Unlock()
+	}
+	return moved, err
+}
+
+// updateQuarantineSize sets data_quarantine_records after the bucket
+// changed.
+func updateQuarantineSize() {
+	db.View(func(tx *bolt.Tx) error {
+		quarantineSize.Set(float64(tx.Bucket([]byte(quarantineBucket)).Stats().KeyN))
+		return nil
+	})
+}
+
+func quarantineLinks(r *http.Request, id string) response.Links {
+	return response.Links{
+		"self":       response.Link(r, apiPath(r, "/quarantine/"+id)),
+		"requeue":    response.Link(r, apiPath(r, "/quarantine/"+id+"/requeue")),
+		"collection": response.Link(r, apiPath(r, "/quarantine")),
+	}
+}
+
+var errNotQuarantined = errors.New("record not in quarantine")
+
+func readQuarantined(tx *bolt.Tx, id string) (QuarantinedRecord, error) {
+	var entry QuarantinedRecord
+	v := tx.Bucket([]byte(quarantineBucket)).Get([]byte(id))
+	if v == nil {
+		return entry, errNotQuarantined
+	}
+	if err := json.Unmarshal(v, &entry); err != nil {
+		return entry, fmt.Errorf("decode quarantined record %s: %w", id, err)
+	}
+	return entry, nil
+}
+
+// getQuarantineHandler serves GET /api/v1/quarantine?reason=&offset=&limit=,
+// the quarantined records in ID order.
+func getQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	entries := []QuarantinedRecord{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(quarantineBucket)).ForEach(func(k, v []byte) error {
+			var entry QuarantinedRecord
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("decode quarantined record %s: %w", k, err)
+			}
+			if reason == "" || entry.Reason == reason {
+				entry.Links = quarantineLinks(r, entry.ID)
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to list quarantined records", http.StatusInternalServerError)
+		return
+	}
+	lo, hi := page.Bounds(len(entries))
+	response.WriteList(w, r, entries[lo:hi], page, len(entries), nil)
+}
+
+// getQuarantinedHandler serves GET /api/v1/quarantine/{id}.
+func getQuarantinedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var entry QuarantinedRecord
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		entry, err = readQuarantined(tx, id)
+		return err
+	})
+	writeQuarantined(w, r, entry, err)
+}
+
+// repairQuarantinedHandler serves PUT /api/v1/quarantine/{id}: the body
+// replaces the quarantined value. The value is kept even when it is still
+// invalid, with the reason in error, so repairs can be made in steps.
+func repairQuarantinedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var entry QuarantinedRecord
+	err = db.Update(func(tx *bolt.Tx) error {
+		if entry, err = readQuarantined(tx, id); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		entry.Raw, entry.RepairedAt, entry.Error = raw, &now, ""
+		if _, err := validateRecord([]byte(id), raw); err != nil {
+			entry.Error = err.Error()
+		}
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(quarantineBucket)).Put([]byte(id), v)
+	})
+	writeQuarantined(w, r, entry, err)
+}
+
+// requeueQuarantinedHandler serves POST /api/v1/quarantine/{id}/requeue,
+// which returns a valid quarantined record to the records as pending so it
+// is processed again. Invalid ones are refused with 422.
+func requeueQuarantinedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var record DataRecord
+	var invalid error
+	err := db.Update(func(tx *bolt.Tx) error {
+		entry, err := readQuarantined(tx, id)
+		if err != nil {
+			return err
+		}
+		if record, invalid = validateRecord([]byte(id), entry.Raw); invalid != nil {
+			return nil
+		}
+		if _, existing := findRecord(tx, []byte(id)); existing != nil {
+			invalid = fmt.Errorf("record %s already exists", id)
+			return nil
+		}
+		record.Processed, record.ProcessedAt = false, nil
+		record.ClaimedBy, record.LeaseExpiry, record.JobID = "", nil, ""
+		addLineageStage(&record, LineageStage{Stage: "requeue", Actor: "data-service", Detail: "from quarantine", At: time.Now()})
+		if err := putRecord(tx, &record); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(quarantineBucket)).Delete([]byte(id))
+	})
+	switch {
+	case err == errNotQuarantined:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Failed to requeue record", http.StatusInternalServerError)
+	case invalid != nil:
+		http.Error(w, invalid.Error(), http.StatusUnprocessableEntity)
+	default:
+		updateQuarantineSize()
+		dataRecordsTotal.WithLabelValues("pending").Inc()
+		response.WriteResource(w, r, presentRecord(r, record), recordLinks(r, record), record.Timestamp)
+	}
+}
+
+// deleteQuarantinedHandler serves DELETE /api/v1/quarantine/{id}, which
+// discards a quarantined record.
+func deleteQuarantinedHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := db.Update(func(tx *bolt.Tx) error {
+		q := tx.Bucket([]byte(quarantineBucket))
+		if q.Get([]byte(id)) == nil {
+			return errNotQuarantined
+		}
+		return q.Delete([]byte(id))
+	})
+	switch {
+	case err == errNotQuarantined:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Failed to discard quarantined record", http.StatusInternalServerError)
+	default:
+		updateQuarantineSize()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeQuarantined(w http.ResponseWriter, r *http.Request, entry QuarantinedRecord, err error) {
+	switch {
+	case err == errNotQuarantined:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "Failed to read quarantined record", http.StatusInternalServerError)
+	default:
+		response.Write(w, r, http.StatusOK, entry, quarantineLinks(r, entry.ID))
+	}
+}
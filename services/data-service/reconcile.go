@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	counterDriftTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_counter_drift_total",
+			Help: "Drift repaired in the in-memory record counters, by counter",
+		},
+		[]string{"counter"},
+	)
+	reconciliationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_reconciliations_total",
+			Help: "Counter reconciliation runs, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(counterDriftTotal, reconciliationsTotal)
+}
+
+// CounterDrift is an in-memory record counter that disagreed with the
+// records stored.
+type CounterDrift struct {
+	Type    string `json:"type"`
+	Counter string `json:"counter"`
+	Counted int    `json:"counted"`
+	Stored  int    `json:"stored"`
+}
+
+type ReconciliationRun struct {
+	Records          int            `json:"records"`
+	Processed        int            `json:"processed"`
+	Pending          int            `json:"pending"`
+	Drift            []CounterDrift `json:"drift"`
+	LedgerBackfilled int            `json:"ledger_backfilled"`
+	LedgerOrphans    int            `json:"ledger_orphans"`
+	RanAt            time.Time      `json:"ran_at"`
+}
+
+// recordCounts are the stored records of one type.
+type recordCounts struct {
+	Total, Pending, Processed int
+}
+
+var reconcileMu sync.Mutex
+
+func reconcileContinuously() {
+	interval, err := time.ParseDuration(viper.GetString("processing.reconcile.interval"))
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := reconcileCounters(); err != nil {
+			logrus.WithError(err).Error("Counter reconciliation failed")
+		}
+	}
+}
+
+// reconcileCounters audits the processing ledger against the records, then
+// compares the in-memory record counters with the records stored and
+// repairs the drift. Counters are updated once a write commits, so a
+// comparison can catch one mid-update: only drift seen unchanged by two
+// passes processing.reconcile.confirm_delay apart is repaired.
+func reconcileCounters() (ReconciliationRun, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	run := ReconciliationRun{RanAt: time.Now(), Drift: []CounterDrift{}}
+	if !isReplica() {
+		var err error
+		if run.LedgerBackfilled, run.LedgerOrphans, err = auditLedger(); err != nil {
+			reconciliationsTotal.WithLabelValues("error").Inc()
+			return run, err
+		}
+	}
+
+	stored, err := storedRecordCounts()
+	if err != nil {
+		reconciliationsTotal.WithLabelValues("error").Inc()
+		return run, err
+	}
+	if drift := counterDrift(stored); len(drift) > 0 {
+		time.Sleep(viper.GetDuration("processing.reconcile.confirm_delay"))
+		if stored, err = storedRecordCounts(); err != nil {
+			reconciliationsTotal.WithLabelValues("error").Inc()
+			return run, err
+		}
+		run.Drift = repairCounters(drift, counterDrift(stored))
+	}
+
+	for _, c := range stored {
+		run.Records += c.Total
+		run.Processed += c.Processed
+		run.Pending += c.Pending
+	}
+	dataRecordsTotal.WithLabelValues("processed").Set(float64(run.Processed))
+	dataRecordsTotal.WithLabelValues("pending").Set(float64(run.Pending))
+
+	result := "ok"
+	if len(run.Drift) > 0 || run.LedgerBackfilled > 0 || run.LedgerOrphans > 0 {
+		result = "repaired"
+		logrus.WithFields(logrus.Fields{
+			"drift":             run.Drift,
+			"ledger_backfilled": run.LedgerBackfilled,
+			"ledger_orphans":    run.LedgerOrphans,
+		}).Warn("Record counters reconciled")
+	}
+	reconciliationsTotal.WithLabelValues(result).Inc()
+	return run, nil
+}
+
+// auditLedger gives every processed record a ledger entry and removes the
+// entries of records that are not processed, so a record's ledger entry
+// exists exactly when it is processed. Records processed before the ledger
+// existed get an entry of run "reconciled".
+func auditLedger() (backfilled, orphans int, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ledgerBucket))
+		if err != nil {
+			return err
+		}
+
+		processed := make(map[string]DataRecord)
+		err = forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err == nil && record.Processed {
+				processed[record.ID] = record
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Write after iterating; modifying the bucket moves the cursor.
+		var stale [][]byte
+		b.ForEach(func(k, _ []byte) error {
+			if _, ok := processed[string(k)]; ok {
+				delete(processed, string(k))
+			} else {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, record := range processed {
+			entry := LedgerEntry{RecordID: record.ID, Run: "reconciled", JobID: record.JobID, AppliedAt: time.Now()}
+			if record.ProcessedAt != nil {
+				entry.AppliedAt = *record.ProcessedAt
+			}
+			if err := putLedgerEntry(b, entry); err != nil {
+				return err
+			}
+		}
+		backfilled, orphans = len(processed), len(stale)
+		return nil
+	})
+	return backfilled, orphans, err
+}
+
+func storedRecordCounts() (map[string]recordCounts, error) {
+	counts := make(map[string]recordCounts)
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
+			}
+			c := counts[record.Type]
+			c.Total++
+			if record.Processed {
+				c.Processed++
+			} else {
+				c.Pending++
+			}
+			counts[record.Type] = c
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// counterDrift compares the in-memory counters with stored, sorted by type
+// and counter.
+func counterDrift(stored map[string]recordCounts) []CounterDrift {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	types := make(map[string]bool)
+	for t := range stored {
+		types[t] = true
+	}
+	for t := range typeStats {
+		types[t] = true
+	}
+
+	var drift []CounterDrift
+	for t := range types {
+		s := stored[t]
+		var c typeCounters
+		if counted, ok := typeStats[t]; ok {
+			c = *counted
+		}
+		for _, pair := range []struct {
+			counter         string
+			counted, stored int
+		}{
+			{"total", c.Total, s.Total},
+			{"pending", c.Pending, s.Pending},
+			{"processed", c.Processed, s.Processed},
+		} {
+			if pair.counted != pair.stored {
+				drift = append(drift, CounterDrift{Type: t, Counter: pair.counter, Counted: pair.counted, Stored: pair.stored})
+			}
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Type != drift[j].Type {
+			return drift[i].Type < drift[j].Type
+		}
+		return drift[i].Counter < drift[j].Counter
+	})
+	return drift
+}
+
+// repairCounters corrects the drift of second that first saw too, by the
+// same amount, and returns it.
+func repairCounters(first, second []CounterDrift) []CounterDrift {
+	seen := make(map[CounterDrift]bool, len(first))
+	for _, d := range first {
+		seen[d] = true
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	confirmed := []CounterDrift{}
+	for _, d := range second {
+		if !seen[d] {
+			continue
+		}
+		c := countersFor(d.Type)
+		diff := d.Stored - d.Counted
+		switch d.Counter {
+		case "total":
+			c.Total += diff
+		case "pending":
+			c.Pending += diff
+		case "processed":
+			c.Processed += diff
+		}
+		if diff < 0 {
+			diff = -diff
+		}
+		counterDriftTotal.WithLabelValues(d.Counter).Add(float64(diff))
+		confirmed = append(confirmed, d)
+	}
+	return confirmed
+}
+
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	run, err := reconcileCounters()
+	if err != nil {
+		logrus.WithError(err).Error("Counter reconciliation failed")
+		http.Error(w, "Failed to reconcile counters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/registration"
+)
+
+// startRegistration registers the service with the API gateway when
+// registration is enabled and renews it every registration.interval. The
+// returned func withdraws the registration.
+func startRegistration() func() {
+	if !viper.GetBool("registration.enabled") {
+		return func() {}
+	}
+	instance := registration.Instance{
+		Name:       viper.GetString("registration.name"),
+		URL:        viper.GetString("registration.url"),
+		HealthPath: viper.GetString("registration.health_path"),
+		Routes:     viper.GetStringSlice("registration.routes"),
+	}
+	logrus.WithFields(logrus.Fields{
+		"gateway": viper.GetString("registration.gateway_url"),
+		"url":     instance.URL,
+	}).Info("Registering with the API gateway")
+	return registration.Start(registration.Config{
+		GatewayURL: viper.GetString("registration.gateway_url"),
+		Token:      viper.GetString("registration.token"),
+		Interval:   viper.GetDuration("registration.interval"),
+		Timeout:    viper.GetDuration("registration.timeout"),
+		Instance:   instance,
+		OnError: func(err error) {
+			logrus.WithError(err).Warn("Registration with the API gateway failed")
+		},
+	})
+}
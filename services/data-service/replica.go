@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/changefeed"
+)
+
+// Replica modes. A follower keeps its own database in sync by tailing the
+// writer's change feed; a snapshot replica serves a backup copy opened
+// read-only. Bolt locks the file exclusively while the writer has it open, so
+// replicas never share the writer's data.db.
+const (
+	replicaFollow   = "follow"
+	replicaSnapshot = "snapshot"
+)
+
+// replicaCaughtUp is set once a follower has applied the whole change feed.
+var replicaCaughtUp atomic.Bool
+
+func replicaMode() string {
+	return viper.GetString("replica.mode")
+}
+
+func isReplica() bool {
+	return replicaMode() != ""
+}
+
+// databasePath returns the Bolt file for the configured mode.
+func databasePath() string {
+	if isReplica() {
+		return viper.GetString("replica.path")
+	}
+	return "data.db"
+}
+
+func databaseOptions() *bolt.Options {
+	return &bolt.Options{Timeout: 1 * time.Second, ReadOnly: replicaMode() == replicaSnapshot}
+}
+
+// readOnlyMiddleware rejects mutating requests on replicas.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Read-only replica", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// replicaReady reports whether the replica can serve reads.
+func replicaReady() bool {
+	return replicaMode() != replicaFollow || replicaCaughtUp.Load()
+}
+
+// followWriter applies the writer's change feed to the local database. The
+// last applied upstream sequence is stored with the data so restarts resume.
+func followWriter() {
+	source := strings.TrimRight(viper.GetString("replica.source"), "/")
+	interval := viper.GetDuration("replica.poll_interval")
+	if interval <= 0 {
+		interval = time.Second
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: bootstrap.SignedTransport(viper.GetViper(), nil)}
+
+	applied, err := replicaAppliedSeq()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to read replica state")
+	}
+	logrus.WithFields(logrus.Fields{"source": source, "since": applied}).Info("Following writer change feed")
+
+	for {
+		var batch struct {
+			Changes []RecordChange `json:"changes"`
+			LastSeq uint64         `json:"last_seq"`
+		}
+		err := changefeed.FetchJSON(client, fmt.Sprintf("%s/api/v1/changes?since=%d&limit=%d", source, applied, defaultChangesLimit), &batch)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to fetch changes from writer")
+			time.Sleep(interval)
+			continue
+		}
+
+		if len(batch.Changes) > 0 {
+			if err := applyChanges(batch.Changes); err != nil {
+				logrus.WithError(err).Error("Failed to apply changes")
+				time.Sleep(interval)
+				continue
+			}
+			applied = batch.Changes[len(batch.Changes)-1].Sequence
+		}
+
+		lag := float64(0)
+		if batch.LastSeq > applied {
+			lag = float64(batch.LastSeq - applied)
+		}
+		replicaLagChanges.Set(lag)
+		replicaAppliedSequence.Set(float64(applied))
+		if lag == 0 && !replicaCaughtUp.Load() {
+			replicaCaughtUp.Store(true)
+			logrus.WithField("seq", applied).Info("Replica caught up with writer")
+		}
+
+		// Keep draining without waiting while a backlog remains.
+		if len(batch.Changes) < defaultChangesLimit {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func applyChanges(changes []RecordChange) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			switch change.Operation {
+			case "create", "update":
+				if change.Record == nil {
+					continue
+				}
+				record := *change.Record
+				if err := putRecord(tx, &record); err != nil {
+					return err
+				}
+			case "delete":
+				remove := deleteRecord
+				if change.Erased {
+					remove = func(tx *bolt.Tx, id []byte) error { return eraseRecords(tx, [][]byte{id}) }
+				}
+				if err := remove(tx, []byte(change.RecordID)); err != nil {
+					return err
+				}
+			}
+		}
+		last := changes[len(changes)-1].Sequence
+		return tx.Bucket([]byte("replica_state")).Put([]byte("applied_seq"), []byte(strconv.FormatUint(last, 10)))
+	})
+}
+
+// replicaAppliedSeq returns the last applied upstream sequence. A replica
+// that has not applied any yet starts from the change sequence of its own
+// database, which for a copy of a writer backup is where the backup was
+// taken.
+func replicaAppliedSeq() (uint64, error) {
+	var seq uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("replica_state")).Get([]byte("applied_seq"))
+		if v == nil {
+			seq = tx.Bucket([]byte("changes")).Sequence()
+			return nil
+		}
+		var err error
+		seq, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	return seq, err
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+)
+
+// failuresBucket holds a ProcessingFailure per record whose processing
+// failed, keyed by record ID. An entry stays until the record is reset for
+// reprocessing or deleted, so records that failed and were later retried
+// can still be selected.
+const failuresBucket = "processing_failures"
+
+var recordsReprocessed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_records_reprocessed_total",
+		Help: "Records reset to pending for reprocessing, by type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(recordsReprocessed)
+}
+
+// ProcessingFailure is the last failed attempt to process a record.
+type ProcessingFailure struct {
+	RecordID string    `json:"record_id"`
+	Error    string    `json:"error"`
+	Worker   string    `json:"worker,omitempty"`
+	JobID    string    `json:"job_id,omitempty"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// RecordSelector picks the records of a reprocessing job. From and To bound
+// the record timestamps, both inclusive; FailedOnly keeps records with a
+// ProcessingFailure.
+type RecordSelector struct {
+	Type       string     `json:"type,omitempty"`
+	From       *time.Time `json:"from,omitempty"`
+	To         *time.Time `json:"to,omitempty"`
+	FailedOnly bool       `json:"failed_only,omitempty"`
+}
+
+func (s RecordSelector) validate() error {
+	if s.Type == "" && s.From == nil && s.To == nil && !s.FailedOnly {
+		return errors.New("selector matches every record; set type, from, to or failed_only")
+	}
+	if s.From != nil && s.To != nil && s.To.Before(*s.From) {
+		return errors.New("to is before from")
+	}
+	return nil
+}
+
+func (s RecordSelector) matches(record DataRecord) bool {
+	if s.Type != "" && record.Type != s.Type {
+		return false
+	}
+	if s.From != nil && record.Timestamp.Before(*s.From) {
+		return false
+	}
+	return s.To == nil || !record.Timestamp.After(*s.To)
+}
+
+// recordProcessingFailure keeps err as the record's last processing failure.
+func recordProcessingFailure(recordID, worker, jobID string, err error) {
+	failure := ProcessingFailure{RecordID: recordID, Error: err.Error(), Worker: worker, JobID: jobID, FailedAt: time.Now().UTC()}
+	data, err := json.Marshal(failure)
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(failuresBucket)).Put([]byte(recordID), data)
+		})
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("record_id", recordID).Warn("Failed to record processing failure")
+	}
+}
+
+// removeProcessingFailure drops a deleted record's failure.
+func removeProcessingFailure(tx *bolt.Tx, recordID []byte) error {
+	b := tx.Bucket([]byte(failuresBucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(recordID)
+}
+
+// reprocessRecordsHandler serves POST /api/v1/records/reprocess. It creates
+// a job that resets the records matching the selector in the body to
+// pending, dropping their ledger entries and failures, and processes them
+// again, e.g. to backfill after a processor bug was fixed.
+func reprocessRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RecordSelector
+		jobNotifyRequest
+		Priority int `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selector := body.RecordSelector
+	if err := selector.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateJobNotify(body.jobNotifyRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Records created while the job waits in the queue are not part of
+	// the backfill.
+	if selector.To == nil {
+		now := time.Now().UTC()
+		selector.To = &now
+	}
+
+	job := ProcessingJob{
+		ID:          uuid.New().String(),
+		Status:      "pending",
+		StartTime:   time.Now(),
+		Priority:    body.Priority,
+		Reprocess:   &selector,
+		CallbackURL: body.CallbackURL,
+		Notify:      body.Notify,
+	}
+	job, err := enqueueJob(job)
+	if err != nil {
+		writeJobQueueFull(w)
+		return
+	}
+	response.Created(w, r, job, jobLinks(r, job))
+}
+
+// reprocessJob resets the records matching the job's selector and processes
+// them in batches of batch_size until ctx is cancelled. It returns how many
+// records were reset and how many were processed.
+func reprocessJob(ctx context.Context, worker string, job ProcessingJob) (int, int, error) {
+	log := jobLog(job.ID)
+	matched, err := resetRecords(*job.Reprocess, job.ID)
+	if err != nil {
+		log.warn("Failed to reset records for reprocessing", logrus.Fields{"error": err})
+		return 0, 0, err
+	}
+	log.info("Records reset for reprocessing", logrus.Fields{"records": matched})
+
+	batchSize := viper.GetInt("batch_size")
+	if batchSize <= 0 {
+		batchSize = 20
+	}
+	processed := 0
+	for ctx.Err() == nil {
+		records, err := jobRecords(worker, job.ID, batchSize)
+		if err != nil {
+			log.warn("Failed to read records to reprocess", logrus.Fields{"error": err})
+			return matched, processed, err
+		}
+		if len(records) == 0 {
+			return matched, processed, nil
+		}
+		n := processRecords(ctx, worker, job.ID, records)
+		processed += n
+		// Records that keep failing stay pending for the processing loop.
+		if n == 0 {
+			return matched, processed, nil
+		}
+	}
+	return matched, processed, nil
+}
+
+// resetRecords marks the records selected as pending again and sets them
+// aside for jobID. It returns how many records it reset.
+func resetRecords(selector RecordSelector, jobID string) (int, error) {
+	var matched []DataRecord
+	wasProcessed := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		failures := tx.Bucket([]byte(failuresBucket))
+		collect := func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil && selector.matches(record) {
+				matched = append(matched, record)
+			}
+			return nil
+		}
+		var err error
+		if selector.FailedOnly {
+			err = failures.ForEach(func(k, _ []byte) error {
+				if _, v := findRecord(tx, k); v != nil {
+					return collect(k, v)
+				}
+				return nil
+			})
+		} else {
+			err = forEachRecord(tx, -1, collect)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Write after iterating; modifying the buckets moves the cursors.
+		now := time.Now()
+		for i := range matched {
+			record := &matched[i]
+			if record.Processed {
+				wasProcessed++
+			}
+			record.Processed, record.ProcessedAt = false, nil
+			record.ClaimedBy, record.LeaseExpiry = "", nil
+			record.JobID = jobID
+			addLineageStage(record, LineageStage{Stage: "reprocess", Actor: "data-service", Detail: jobDetail(jobID), At: now})
+			if err := putRecord(tx, record); err != nil {
+				return err
+			}
+			if err := removeLedgerEntry(tx, []byte(record.ID)); err != nil {
+				return err
+			}
+			if err := failures.Delete([]byte(record.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range matched {
+		recordsReprocessed.WithLabelValues(record.Type).Inc()
+	}
+	dataRecordsTotal.WithLabelValues("processed").Sub(float64(wasProcessed))
+	dataRecordsTotal.WithLabelValues("pending").Add(float64(wasProcessed))
+	return len(matched), nil
+}
+
+// jobRecords returns up to batchSize pending records set aside for jobID.
+// With processing.claims enabled they are leased to worker like
+// claimPendingRecords does.
+func jobRecords(worker, jobID string, batchSize int) ([]DataRecord, error) {
+	var records []DataRecord
+	err := db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		err := forEachRecord(tx, -1, func(k, v []byte) error {
+			if len(records) >= batchSize {
+				return nil
+			}
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil || record.Processed || record.JobID != jobID {
+				return nil
+			}
+			if claimsEnabled() {
+				switch {
+				case record.ClaimedBy == "":
+					recordClaims.WithLabelValues("claimed").Inc()
+				case record.LeaseExpiry != nil && now.After(*record.LeaseExpiry):
+					recordClaims.WithLabelValues("reclaimed").Inc()
+				case record.ClaimedBy == worker:
+				default:
+					recordClaims.WithLabelValues("contended").Inc()
+					return nil
+				}
+			}
+			records = append(records, record)
+			return nil
+		})
+		if err != nil || !claimsEnabled() {
+			return err
+		}
+
+		expiry := now.Add(viper.GetDuration("processing.claims.lease_duration"))
+		for i := range records {
+			records[i].ClaimedBy = worker
+			records[i].LeaseExpiry = &expiry
+			if err := putRecord(tx, &records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return records, err
+}
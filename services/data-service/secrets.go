@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/secrets"
+)
+
+// secretStore holds the secrets referenced by the config and refreshes them;
+// nil when nothing is referenced.
+var secretStore *secrets.Store
+
+// resolveSecrets replaces every vault:<path>#<field> config value with the
+// secret it references and keeps refreshing them in secretStore.
+func resolveSecrets() {
+	secretStore = bootstrap.ResolveSecrets(viper.GetViper(), func(key string) {
+		logrus.WithField("key", key).Info("Secret rotated")
+	})
+}
+
+// secretValue returns the current value of a setting read per request, which
+// picks up rotated secrets. Settings read once keep their startup value.
+func secretValue(key string) string {
+	if value, ok := secretStore.Get(key); ok {
+		return value
+	}
+	return viper.GetString(key)
+}
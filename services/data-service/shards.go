@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+)
+
+// recordsBucket is shard 0; further shards are records_1, records_2, ... so
+// an unsharded database is a valid single-shard one.
+const recordsBucket = "records"
+
+// shardCount returns the configured number of record shards.
+func shardCount() int {
+	if n := viper.GetInt("storage.shards"); n > 1 {
+		return n
+	}
+	return 1
+}
+
+func shardBucketName(shard int) string {
+	if shard == 0 {
+		return recordsBucket
+	}
+	return recordsBucket + "_" + strconv.Itoa(shard)
+}
+
+// shardBucketIndex parses a record bucket name, returning -1 for other
+// buckets.
+func shardBucketIndex(name []byte) int {
+	if string(name) == recordsBucket {
+		return 0
+	}
+	suffix, ok := strings.CutPrefix(string(name), recordsBucket+"_")
+	if !ok {
+		return -1
+	}
+	i, err := strconv.Atoi(suffix)
+	if err != nil || i <= 0 {
+		return -1
+	}
+	return i
+}
+
+// shardOf places a new record by type or by ID hash (storage.shard_by).
+func shardOf(record *DataRecord) int {
+	n := shardCount()
+	if n == 1 {
+		return 0
+	}
+	key := record.ID
+	if viper.GetString("storage.shard_by") == "type" {
+		key = record.Type
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// shardBuckets returns the record buckets handled by shard, or all of them
+// for shard < 0. Buckets left over from a larger shard count are assigned by
+// index modulo the current count so their records are still processed.
+func shardBuckets(tx *bolt.Tx, shard int) []*bolt.Bucket {
+	n := shardCount()
+	type indexed struct {
+		index  int
+		bucket *bolt.Bucket
+	}
+	var found []indexed
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if i := shardBucketIndex(name); i >= 0 && (shard < 0 || i%n == shard) {
+			found = append(found, indexed{i, b})
+		}
+		return nil
+	})
+	sort.Slice(found, func(a, b int) bool { return found[a].index < found[b].index })
+
+	buckets := make([]*bolt.Bucket, len(found))
+	for i, f := range found {
+		buckets[i] = f.bucket
+	}
+	return buckets
+}
+
+// findRecord returns the bucket holding id and its value, or nil if absent.
+func findRecord(tx *bolt.Tx, id []byte) (*bolt.Bucket, []byte) {
+	for _, b := range shardBuckets(tx, -1) {
+		if v := b.Get(id); v != nil {
+			return b, v
+		}
+	}
+	return nil, nil
+}
+
+// forEachRecord calls fn for every record in the given shard (all shards
+// for shard < 0). Order is per bucket; use newRecordCursor for key order.
+// fn must not modify the buckets.
+func forEachRecord(tx *bolt.Tx, shard int, fn func(k, v []byte) error) error {
+	for _, b := range shardBuckets(tx, shard) {
+		if err := b.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countRecords returns the number of records across all shards.
+func countRecords(tx *bolt.Tx) int {
+	total := 0
+	for _, b := range shardBuckets(tx, -1) {
+		total += b.Stats().KeyN
+	}
+	return total
+}
+
+// recordCursor merges the cursors of several shards into one ordered by key,
+// so listings and export cursors behave the same as with a single bucket.
+type recordCursor struct {
+	cursors []*bolt.Cursor
+	keys    [][]byte
+	values  [][]byte
+	current int
+}
+
+func newRecordCursor(tx *bolt.Tx, shard int) *recordCursor {
+	rc := &recordCursor{current: -1}
+	for _, b := range shardBuckets(tx, shard) {
+		rc.cursors = append(rc.cursors, b.Cursor())
+	}
+	rc.keys = make([][]byte, len(rc.cursors))
+	rc.values = make([][]byte, len(rc.cursors))
+	return rc
+}
+
+func (rc *recordCursor) First() ([]byte, []byte) {
+	for i, c := range rc.cursors {
+		rc.keys[i], rc.values[i] = c.First()
+	}
+	return rc.pick()
+}
+
+func (rc *recordCursor) Seek(seek []byte) ([]byte, []byte) {
+	for i, c := range rc.cursors {
+		rc.keys[i], rc.values[i] = c.Seek(seek)
+	}
+	return rc.pick()
+}
+
+func (rc *recordCursor) Next() ([]byte, []byte) {
+	if rc.current < 0 {
+		return nil, nil
+	}
+	i := rc.current
+	rc.keys[i], rc.values[i] = rc.cursors[i].Next()
+	return rc.pick()
+}
+
+func (rc *recordCursor) pick() ([]byte, []byte) {
+	rc.current = -1
+	for i, k := range rc.keys {
+		if k != nil && (rc.current < 0 || bytes.Compare(k, rc.keys[rc.current]) < 0) {
+			rc.current = i
+		}
+	}
+	if rc.current < 0 {
+		return nil, nil
+	}
+	return rc.keys[rc.current], rc.values[rc.current]
+}
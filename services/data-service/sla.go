@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	slaBreaches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_processing_sla_breached_total",
+			Help: "Times the oldest pending record of a type became older than its processing SLA",
+		},
+		[]string{"type"},
+	)
+	oldestPendingAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "data_oldest_pending_age_seconds",
+			Help: "Age of the oldest pending record by type, 0 when none is pending",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(slaBreaches, oldestPendingAge)
+}
+
+// SLABreach is a record type whose oldest pending record has waited longer
+// than the type's processing.sla.max_age.
+type SLABreach struct {
+	Type             string    `json:"type"`
+	MaxAge           string    `json:"max_age"`
+	OldestPendingAge string    `json:"oldest_pending_age"`
+	Since            time.Time `json:"since"`
+}
+
+var (
+	// processingSLAs is the max time-to-process of each record type with
+	// an SLA, loaded by loadSLAConfig.
+	processingSLAs map[string]time.Duration
+
+	// slaState holds the breaches found by the last check.
+	slaMu    sync.Mutex
+	slaState = make(map[string]SLABreach)
+)
+
+// loadSLAConfig reads processing.sla.max_age; types with an invalid
+// duration are skipped.
+func loadSLAConfig() {
+	processingSLAs = make(map[string]time.Duration)
+	for recordType, value := range viper.GetStringMapString("processing.sla.max_age") {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			logrus.WithFields(logrus.Fields{"type": recordType, "max_age": value}).Warn("Invalid processing SLA, skipped")
+			continue
+		}
+		processingSLAs[recordType] = d
+		slaBreaches.WithLabelValues(recordType)
+	}
+}
+
+// watchSLAsContinuously checks the oldest pending record of each type
+// every processing.sla.interval.
+func watchSLAsContinuously() {
+	ticker := time.NewTicker(viper.GetDuration("processing.sla.interval"))
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		if err := checkProcessingSLAs(time.Now()); err != nil {
+			logrus.WithError(err).Error("Failed to check processing SLAs")
+		}
+	}
+}
+
+// checkProcessingSLAs updates the oldest pending age gauges and the
+// breaches. A breach is counted once, when it starts, and lasts until the
+// type's oldest pending record is within its SLA again.
+func checkProcessingSLAs(now time.Time) error {
+	oldest, err := oldestPendingByType()
+	if err != nil {
+		return err
+	}
+
+	statsMu.Lock()
+	for recordType := range typeStats {
+		if _, ok := oldest[recordType]; !ok {
+			oldestPendingAge.WithLabelValues(recordType).Set(0)
+		}
+	}
+	statsMu.Unlock()
+	for recordType, ts := range oldest {
+		oldestPendingAge.WithLabelValues(recordType).Set(now.Sub(ts).Seconds())
+	}
+
+	slaMu.Lock()
+	defer slaMu.Unlock()
+	for recordType, maxAge := range processingSLAs {
+		ts, pending := oldest[recordType]
+		age := now.Sub(ts)
+		if !pending || age <= maxAge {
+			if _, ok := slaState[recordType]; ok {
+				logrus.WithField("type", recordType).Info("Processing SLA met again")
+				delete(slaState, recordType)
+			}
+			continue
+		}
+		breach, ok := slaState[recordType]
+		if !ok {
+			breach = SLABreach{Type: recordType, MaxAge: maxAge.String(), Since: now}
+			slaBreaches.WithLabelValues(recordType).Inc()
+			logrus.WithFields(logrus.Fields{
+				"type":               recordType,
+				"max_age":            maxAge.String(),
+				"oldest_pending_age": age.Round(time.Second).String(),
+			}).Warn("Processing SLA breached")
+		}
+		breach.OldestPendingAge = age.Round(time.Second).String()
+		slaState[recordType] = breach
+	}
+	return nil
+}
+
+// currentSLABreaches returns the breaches found by the last check, by type.
+func currentSLABreaches() []SLABreach {
+	slaMu.Lock()
+	defer slaMu.Unlock()
+
+	breaches := make([]SLABreach, 0, len(slaState))
+	for _, breach := range slaState {
+		breaches = append(breaches, breach)
+	}
+	sort.Slice(breaches, func(i, j int) bool { return breaches[i].Type < breaches[j].Type })
+	return breaches
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var snapshotRestores = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_snapshot_restores_total",
+		Help: "State snapshot restores, by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(snapshotRestores)
+}
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// errJobsActive refuses a restore while jobs are queued or running, as
+// they would go on writing the records being restored.
+var errJobsActive = errors.New("jobs are queued or running")
+
+// StateSnapshot is a named copy of the records, their processing ledger
+// entries and the finished jobs, kept under snapshots.path so a demo
+// environment can be reset to it.
+type StateSnapshot struct {
+	Name      string          `json:"name"`
+	CreatedAt time.Time       `json:"created_at"`
+	Records   []DataRecord    `json:"records"`
+	Ledger    []LedgerEntry   `json:"ledger"`
+	Jobs      []ProcessingJob `json:"jobs"`
+}
+
+// SnapshotInfo describes a stored snapshot.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Records   int       `json:"records"`
+	Jobs      int       `json:"jobs"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// SnapshotRestore reports what a restore changed.
+type SnapshotRestore struct {
+	SnapshotInfo
+	RecordsCreated   int `json:"records_created"`
+	RecordsUpdated   int `json:"records_updated"`
+	RecordsDeleted   int `json:"records_deleted"`
+	RecordsUnchanged int `json:"records_unchanged"`
+	// RecordsErased counts snapshot records left out because a subject
+	// deletion erased them after the snapshot was saved.
+	RecordsErased int `json:"records_erased"`
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(viper.GetString("snapshots.path"), name+".json")
+}
+
+func (s StateSnapshot) info(bytes int64) SnapshotInfo {
+	return SnapshotInfo{Name: s.Name, CreatedAt: s.CreatedAt, Records: len(s.Records), Jobs: len(s.Jobs), Bytes: bytes}
+}
+
+func readStateSnapshot(name string) (StateSnapshot, int64, error) {
+	var snapshot StateSnapshot
+	data, err := os.ReadFile(snapshotPath(name))
+	if err != nil {
+		return snapshot, 0, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, 0, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	return snapshot, int64(len(data)), nil
+}
+
+// takeStateSnapshot copies the current state, archived jobs included.
+// Queued and running jobs are left out: they would not be running after a
+// restore.
+func takeStateSnapshot(name string) (StateSnapshot, error) {
+	snapshot := StateSnapshot{Name: name, CreatedAt: time.Now().UTC(), Records: []DataRecord{}, Ledger: []LedgerEntry{}, Jobs: []ProcessingJob{}}
+	err := db.View(func(tx *bolt.Tx) error {
+		err := forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil {
+				snapshot.Records = append(snapshot.Records, record)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(ledgerBucket)).ForEach(func(k, v []byte) error {
+			var entry LedgerEntry
+			if json.Unmarshal(v, &entry) == nil {
+				snapshot.Ledger = append(snapshot.Ledger, entry)
+			}
+			return nil
+		})
+	})
+
+	jobsMu.RLock()
+	for _, job := range jobs {
+		if job.Status != "pending" && job.Status != "running" {
+			snapshot.Jobs = append(snapshot.Jobs, job)
+		}
+	}
+	if err == nil {
+		err = eachArchivedJob(func(job ProcessingJob) {
+			snapshot.Jobs = append(snapshot.Jobs, job)
+		})
+	}
+	jobsMu.RUnlock()
+	sort.Slice(snapshot.Jobs, func(i, j int) bool { return snapshot.Jobs[i].StartTime.Before(snapshot.Jobs[j].StartTime) })
+	return snapshot, err
+}
+
+// sameRecord reports whether a and b are stored alike but for their change
+// sequence, which every write renews.
+func sameRecord(a, b DataRecord) bool {
+	a.Sequence, b.Sequence = 0, 0
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(x) == string(y)
+}
+
+// restoreStateSnapshot makes the stored records, their ledger entries and
+// the job list those of snapshot in a single transaction. Records are
+// written through putRecord and deleteRecord, so the indexes, counters and
+// change feed follow and rollups and replicas catch up on their own.
+// Records of subjects deleted since the snapshot was saved are left out.
+func restoreStateSnapshot(snapshot StateSnapshot) (SnapshotRestore, error) {
+	result := SnapshotRestore{SnapshotInfo: snapshot.info(0)}
+	jobsMu.RLock()
+	for _, job := range jobs {
+		if job.Status == "pending" || job.Status == "running" {
+			jobsMu.RUnlock()
+			return result, errJobsActive
+		}
+	}
+	jobsMu.RUnlock()
+
+	ledger := make(map[string]LedgerEntry, len(snapshot.Ledger))
+	for _, entry := range snapshot.Ledger {
+		ledger[entry.RecordID] = entry
+	}
+
+	processed, pending := 0, 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		erasedIDs, erasedHashes, err := erasedSubjects(tx)
+		if err != nil {
+			return err
+		}
+		var records []DataRecord
+		wanted := make(map[string]DataRecord, len(snapshot.Records))
+		for _, record := range snapshot.Records {
+			if erasedIDs[record.ID] || referencesErasedSubject(record, erasedHashes) {
+				result.RecordsErased++
+				continue
+			}
+			records = append(records, record)
+			wanted[record.ID] = record
+		}
+
+		current := make(map[string]DataRecord)
+		var unreadable [][]byte
+		err = forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) != nil {
+				unreadable = append(unreadable, append([]byte(nil), k...))
+				return nil
+			}
+			current[record.ID] = record
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Write after iterating; modifying the buckets moves the cursors.
+		for _, k := range unreadable {
+			if err := deleteRecord(tx, k); err != nil {
+				return err
+			}
+			result.RecordsDeleted++
+		}
+		for id := range current {
+			if _, ok := wanted[id]; ok {
+				continue
+			}
+			if err := deleteRecord(tx, []byte(id)); err != nil {
+				return err
+			}
+			result.RecordsDeleted++
+		}
+		for _, record := range records {
+			existing, ok := current[record.ID]
+			if ok && sameRecord(existing, record) {
+				result.RecordsUnchanged++
+				continue
+			}
+			if err := putRecord(tx, &record); err != nil {
+				return err
+			}
+			if ok {
+				result.RecordsUpdated++
+			} else {
+				result.RecordsCreated++
+			}
+			if err := removeLedgerEntry(tx, []byte(record.ID)); err != nil {
+				return err
+			}
+			if entry, ok := ledger[record.ID]; ok {
+				data, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+				if err := tx.Bucket([]byte(ledgerBucket)).Put([]byte(record.ID), data); err != nil {
+					return err
+				}
+			}
+			if err := removeProcessingFailure(tx, []byte(record.ID)); err != nil {
+				return err
+			}
+		}
+
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if decodeRecord(k, v, &record) == nil {
+				if record.Processed {
+					processed++
+				} else {
+					pending++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return result, err
+	}
+	dataRecordsTotal.WithLabelValues("processed").Set(float64(processed))
+	dataRecordsTotal.WithLabelValues("pending").Set(float64(pending))
+
+	// The snapshot's jobs are loaded into memory, and the eviction loop
+	// archives them again as it sees fit.
+	return result, replaceJobs(snapshot.Jobs)
+}
+
+// listSnapshotsHandler serves GET /api/v1/snapshots, the stored snapshots
+// by name.
+func listSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(viper.GetString("snapshots.path"))
+	if err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Error("Failed to list snapshots")
+		http.Error(w, "Failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+	list := []SnapshotInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !snapshotNamePattern.MatchString(name) {
+			continue
+		}
+		snapshot, bytes, err := readStateSnapshot(name)
+		if err != nil {
+			logrus.WithError(err).WithField("snapshot", name).Warn("Skipping unreadable snapshot")
+			continue
+		}
+		list = append(list, snapshot.info(bytes))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// createSnapshotHandler serves PUT /api/v1/snapshots/{name}, saving the
+// current state under name, replacing an older snapshot of that name.
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "name must be 1-64 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	snapshot, err := takeStateSnapshot(name)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read state for snapshot")
+		http.Error(w, "Failed to take snapshot", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = os.MkdirAll(viper.GetString("snapshots.path"), 0700)
+	}
+	status := http.StatusCreated
+	if _, statErr := os.Stat(snapshotPath(name)); statErr == nil {
+		status = http.StatusOK
+	}
+	if err == nil {
+		// Written beside the old snapshot and renamed over it, so a failed
+		// write never leaves a partial one.
+		tmp := snapshotPath(name) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, snapshotPath(name))
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to write snapshot")
+		http.Error(w, "Failed to write snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	info := snapshot.info(int64(len(data)))
+	logrus.WithFields(logrus.Fields{"snapshot": name, "records": info.Records, "jobs": info.Jobs}).Info("State snapshot written")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(info)
+}
+
+// restoreSnapshotHandler serves POST /api/v1/snapshots/{name}/restore.
+func restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	snapshot, bytes, err := readStateSnapshot(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to read snapshot")
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := restoreStateSnapshot(snapshot)
+	if err == errJobsActive {
+		snapshotRestores.WithLabelValues("refused").Inc()
+		http.Error(w, "Jobs are queued or running; cancel them or wait before restoring", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		snapshotRestores.WithLabelValues("error").Inc()
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to restore snapshot")
+		http.Error(w, "Failed to restore snapshot", http.StatusInternalServerError)
+		return
+	}
+	result.Bytes = bytes
+	snapshotRestores.WithLabelValues("ok").Inc()
+	logrus.WithFields(logrus.Fields{
+		"snapshot":  name,
+		"created":   result.RecordsCreated,
+		"updated":   result.RecordsUpdated,
+		"deleted":   result.RecordsDeleted,
+		"unchanged": result.RecordsUnchanged,
+	}).Info("State snapshot restored")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// deleteSnapshotHandler serves DELETE /api/v1/snapshots/{name}.
+func deleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	err := os.Remove(snapshotPath(name))
+	if os.IsNotExist(err) {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to delete snapshot")
+		http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRestoreSkipsErasedSubjects(t *testing.T) {
+	openTestDB(t)
+	loadPrivacyConfig()
+	now := time.Now()
+	r1 := DataRecord{ID: "r1", Type: "event", Timestamp: now, Data: map[string]string{"user_id": "u-42"}}
+	r2 := DataRecord{ID: "r2", Type: "event", Timestamp: now, Data: map[string]string{"user_id": "u-7"}}
+	// r3 was not stored when the subject was deleted, but belongs to it.
+	r3 := DataRecord{ID: "r3", Type: "event", Timestamp: now, Data: map[string]string{"session_id": hashValue("u-42")}}
+	storeTestRecords(t, r1, r2)
+	stopJobEviction := startJobEviction()
+	defer stopJobEviction()
+
+	w := httptest.NewRecorder()
+	deleteSubjectRecordsHandler(w, httptest.NewRequest("DELETE", "/api/v1/records?subject_id=u-42", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("subject deletion: %d %s", w.Code, w.Body.String())
+	}
+
+	result, err := restoreStateSnapshot(StateSnapshot{Name: "before", CreatedAt: now, Records: []DataRecord{r1, r2, r3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RecordsErased != 2 || result.RecordsUnchanged != 1 || result.RecordsCreated != 0 {
+		t.Errorf("restore result = %+v, want 2 erased and r2 unchanged", result)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for _, id := range []string{"r1", "r3"} {
+			if _, v := findRecord(tx, []byte(id)); v != nil {
+				t.Errorf("erased record %s was restored", id)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/telemetry"
+)
+
+// sourceIngestion counts records offered by each lineage source over HTTP
+// and gRPC, by whether its rate limit let them in.
+var sourceIngestion = telemetry.NewLimitedCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_source_records_total",
+		Help: "Records offered by each source over HTTP and gRPC, by result: accepted or rejected",
+	},
+	[]string{"source", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(sourceIngestion)
+}
+
+// SourceLimit is the ingestion rate, in records per second, and burst one
+// source is allowed. A rate of 0 is unlimited.
+type SourceLimit struct {
+	Source string  `mapstructure:"source" json:"source"`
+	Rate   float64 `mapstructure:"rate" json:"rate"`
+	Burst  int     `mapstructure:"burst" json:"burst"`
+}
+
+// tokenBucket allows rate tokens a second, up to burst at once.
+type tokenBucket struct {
+	limit  SourceLimit
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token, or returns how long until one is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	burst := float64(max(b.limit.Burst, 1))
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// sourceLimiter keeps a token bucket per listed source. Sources without a
+// limit of their own share a single bucket of ingestion.source_limits.default,
+// so a client cannot get a fresh burst by making up source names.
+type sourceLimiter struct {
+	mu       sync.Mutex
+	limits   map[string]SourceLimit
+	fallback SourceLimit
+	buckets  map[string]*tokenBucket
+	shared   *tokenBucket
+}
+
+var ingestionLimiter *sourceLimiter
+
+// loadSourceLimits reads ingestion.source_limits; it leaves
+// ingestionLimiter nil when disabled.
+func loadSourceLimits() {
+	ingestionLimiter = nil
+	if !viper.GetBool("ingestion.source_limits.enabled") {
+		return
+	}
+	l := &sourceLimiter{
+		limits:  make(map[string]SourceLimit),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if err := viper.UnmarshalKey("ingestion.source_limits.default", &l.fallback); err != nil {
+		logrus.WithError(err).Warn("Invalid ingestion.source_limits.default, sources without a limit are unlimited")
+	}
+	var limits []SourceLimit
+	if err := viper.UnmarshalKey("ingestion.source_limits.sources", &limits); err != nil {
+		logrus.WithError(err).Warn("Invalid ingestion.source_limits.sources, ignored")
+	}
+	for _, limit := range limits {
+		if limit.Source == "" || limit.Rate < 0 {
+			logrus.WithField("source", limit.Source).Warn("Source limit needs a source and a rate of at least 0, skipped")
+			continue
+		}
+		l.limits[limit.Source] = limit
+	}
+	ingestionLimiter = l
+}
+
+// allow takes one record of source from its bucket. It returns false and
+// how long to wait when the source is over its limit. A nil limiter allows
+// everything.
+func (l *sourceLimiter) allow(source string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, listed := l.limits[source]
+	if !listed {
+		limit = l.fallback
+	}
+	if limit.Rate <= 0 {
+		sourceIngestion.WithLabelValues(source, "accepted").Inc()
+		return true, 0
+	}
+	now := time.Now()
+	b := l.shared
+	if listed {
+		b = l.buckets[source]
+	}
+	if b == nil {
+		b = &tokenBucket{limit: limit, tokens: float64(max(limit.Burst, 1)), last: now}
+		if listed {
+			l.buckets[source] = b
+		} else {
+			l.shared = b
+		}
+	}
+	allowed, wait := b.take(now)
+	if allowed {
+		sourceIngestion.WithLabelValues(source, "accepted").Inc()
+	} else {
+		sourceIngestion.WithLabelValues(source, "rejected").Inc()
+	}
+	return allowed, wait
+}
+
+// errSourceLimited is the error of a record turned away by its source's
+// rate limit.
+func errSourceLimited(source string) error {
+	return fmt.Errorf("source %q is over its ingestion rate limit", source)
+}
+
+// writeSourceLimited answers a record creation turned away by its source's
+// rate limit.
+func writeSourceLimited(w http.ResponseWriter, source string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	http.Error(w, errSourceLimited(source).Error(), http.StatusTooManyRequests)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceLimiterSharesFallbackBucket(t *testing.T) {
+	l := &sourceLimiter{
+		limits:   map[string]SourceLimit{"importer": {Source: "importer", Rate: 1, Burst: 2}, "trusted": {Source: "trusted"}},
+		fallback: SourceLimit{Rate: 1, Burst: 3},
+		buckets:  make(map[string]*tokenBucket),
+	}
+
+	// Made-up source names draw from the same default bucket.
+	for i, source := range []string{"a", "b", "c"} {
+		if ok, _ := l.allow(source); !ok {
+			t.Fatalf("record %d from %s rejected within the default burst", i+1, source)
+		}
+	}
+	ok, wait := l.allow("d")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("fourth unlisted record: allowed %v, wait %v; want rejected for up to 1s", ok, wait)
+	}
+
+	// Listed sources keep their own bucket.
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("importer"); !ok {
+			t.Fatalf("importer record %d rejected within its burst", i+1)
+		}
+	}
+	if ok, _ := l.allow("importer"); ok {
+		t.Error("importer allowed beyond its burst")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("trusted"); !ok {
+			t.Fatal("unlimited source rejected")
+		}
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("%d per-source buckets, want only importer's", len(l.buckets))
+	}
+}
+
+func TestNilSourceLimiterAllows(t *testing.T) {
+	var l *sourceLimiter
+	if ok, _ := l.allow("anything"); !ok {
+		t.Error("nil limiter rejected a record")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// typeCounters are the incremental per-record-type counters. They are seeded
+// from the database on startup and kept current by putRecord/deleteRecord.
+type typeCounters struct {
+	Total             int
+	Pending           int
+	Processed         int
+	ProcessedSinceUp  int
+	ProcessingSeconds float64
+	Observations      int
+}
+
+type RecordTypeStats struct {
+	Type                  string  `json:"type"`
+	Total                 int     `json:"total"`
+	Pending               int     `json:"pending"`
+	Processed             int     `json:"processed"`
+	OldestPendingAge      string  `json:"oldest_pending_age,omitempty"`
+	OldestPendingSeconds  float64 `json:"oldest_pending_seconds"`
+	ProcessingRate        float64 `json:"processing_rate_per_second"`
+	AvgProcessingDuration float64 `json:"avg_processing_duration_seconds"`
+}
+
+var (
+	statsMu   sync.Mutex
+	typeStats = make(map[string]*typeCounters)
+	// laneCounts are the pending records of each priority lane.
+	laneCounts = make(map[int]int)
+)
+
+func countersFor(recordType string) *typeCounters {
+	c, ok := typeStats[recordType]
+	if !ok {
+		c = &typeCounters{}
+		typeStats[recordType] = c
+	}
+	return c
+}
+
+func loadRecordStats() error {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	typeStats = make(map[string]*typeCounters)
+	laneCounts = make(map[int]int)
+	defer setPriorityGauges()
+	return db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
+			}
+			c := countersFor(record.Type)
+			c.Total++
+			if record.Processed {
+				c.Processed++
+			} else {
+				c.Pending++
+				laneCounts[recordPriority(record)]++
+			}
+			return nil
+		})
+	})
+}
+
+// trackRecordWrite updates the counters once tx commits. previous is nil for
+// newly created records.
+func trackRecordWrite(tx *bolt.Tx, previous *DataRecord, record DataRecord) {
+	tx.OnCommit(func() {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+
+		if previous != nil {
+			c := countersFor(previous.Type)
+			c.Total--
+			if previous.Processed {
+				c.Processed--
+			} else {
+				c.Pending--
+				laneCounts[recordPriority(*previous)]--
+			}
+		}
+
+		c := countersFor(record.Type)
+		c.Total++
+		if record.Processed {
+			c.Processed++
+			if previous != nil && !previous.Processed {
+				c.ProcessedSinceUp++
+			}
+		} else {
+			c.Pending++
+			laneCounts[recordPriority(record)]++
+		}
+		setPriorityGauges()
+	})
+}
+
+func trackRecordDelete(tx *bolt.Tx, previous DataRecord) {
+	tx.OnCommit(func() {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+
+		c := countersFor(previous.Type)
+		c.Total--
+		if previous.Processed {
+			c.Processed--
+		} else {
+			c.Pending--
+			laneCounts[recordPriority(previous)]--
+			setPriorityGauges()
+		}
+	})
+}
+
+func observeProcessingDuration(recordType string, seconds float64) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	c := countersFor(recordType)
+	c.ProcessingSeconds += seconds
+	c.Observations++
+}
+
+// oldestPendingByType scans the record shards for the oldest unprocessed
+// record of each type; age cannot be tracked incrementally.
+func oldestPendingByType() (map[string]time.Time, error) {
+	oldest := make(map[string]time.Time)
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil || record.Processed {
+				return nil
+			}
+			if ts, ok := oldest[record.Type]; !ok || record.Timestamp.Before(ts) {
+				oldest[record.Type] = record.Timestamp
+			}
+			return nil
+		})
+	})
+	return oldest, err
+}
+
+func recordStatsHandler(w http.ResponseWriter, r *http.Request) {
+	oldest, err := oldestPendingByType()
+	if err != nil {
+		http.Error(w, "Failed to compute record stats", http.StatusInternalServerError)
+		return
+	}
+
+	uptime := time.Since(startTime).Seconds()
+	stats := []RecordTypeStats{}
+
+	statsMu.Lock()
+	for recordType, c := range typeStats {
+		if c.Total == 0 && c.Observations == 0 {
+			continue
+		}
+		s := RecordTypeStats{
+			Type:           recordType,
+			Total:          c.Total,
+			Pending:        c.Pending,
+			Processed:      c.Processed,
+			ProcessingRate: float64(c.ProcessedSinceUp) / uptime,
+		}
+		if c.Observations > 0 {
+			s.AvgProcessingDuration = c.ProcessingSeconds / float64(c.Observations)
+		}
+		if ts, ok := oldest[recordType]; ok {
+			age := time.Since(ts)
+			s.OldestPendingAge = age.Round(time.Second).String()
+			s.OldestPendingSeconds = age.Seconds()
+		}
+		stats = append(stats, s)
+	}
+	statsMu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].OldestPendingSeconds > stats[j].OldestPendingSeconds
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"types":     stats,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/syslog"
+)
+
+// syslogRecordType is the type of the records syslog messages become.
+const syslogRecordType = "system_log"
+
+var (
+	syslogMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "data_syslog_messages_total",
+			Help: "Syslog messages received, by result",
+		},
+		[]string{"result"},
+	)
+	syslogConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_syslog_connections",
+			Help: "Open syslog TCP connections",
+		},
+	)
+	syslogQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "data_syslog_queue_depth",
+			Help: "Syslog messages received but not yet stored",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(syslogMessages, syslogConnections, syslogQueueDepth)
+}
+
+// syslogMessage is a received message waiting in the ingestion queue.
+type syslogMessage struct {
+	syslog.Message
+	peer     string
+	received time.Time
+}
+
+// startSyslogIngestion listens for syslog over TCP on syslog.port when
+// syslog.enabled is set and stores every message as a system_log record.
+// The returned func stops it, storing the messages already received.
+func startSyslogIngestion() func() {
+	if !viper.GetBool("syslog.enabled") {
+		return func() {}
+	}
+
+	addr := fmt.Sprintf(":%s", viper.GetString("syslog.port"))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logrus.WithError(err).WithField("port", viper.GetString("syslog.port")).Error("Failed to listen for syslog, syslog ingestion disabled")
+		return func() {}
+	}
+
+	maxSize := max(viper.GetInt("syslog.max_message_bytes"), 480)
+	slots := make(chan struct{}, max(viper.GetInt("syslog.max_connections"), 1))
+	queue := make(chan syslogMessage, max(viper.GetInt("syslog.queue_size"), 1))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]bool)
+		wg    sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logrus.WithError(err).Error("Syslog listener failed")
+				}
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			default:
+				logrus.WithField("peer", conn.RemoteAddr().String()).Warn("Too many syslog connections, closing")
+				conn.Close()
+				continue
+			}
+			mu.Lock()
+			conns[conn] = true
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				readSyslogConn(ctx, conn, maxSize, queue)
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+				<-slots
+			}()
+		}
+	}()
+
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		storeSyslogMessages(ctx, queue, max(viper.GetInt("syslog.batch_size"), 1))
+	}()
+
+	logrus.WithField("port", viper.GetString("syslog.port")).Info("Syslog ingestion started")
+	return func() {
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+		close(queue)
+		// Store what is queued, giving up instead of retrying a failed write.
+		cancel()
+		<-stored
+	}
+}
+
+// readSyslogConn queues the messages of one connection until it closes.
+// Syslog over TCP has no acknowledgements, so a full queue is pushed back
+// on the sender by not reading.
+func readSyslogConn(ctx context.Context, conn net.Conn, maxSize int, queue chan<- syslogMessage) {
+	syslogConnections.Inc()
+	defer syslogConnections.Dec()
+
+	peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	r := syslog.NewReader(conn, maxSize)
+	for {
+		b, err := r.Next()
+		if err == syslog.ErrTooLong {
+			syslogMessages.WithLabelValues("too_long").Inc()
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+				logrus.WithError(err).WithField("peer", peer).Debug("Syslog connection closed")
+			}
+			return
+		}
+		received := time.Now()
+		m, err := syslog.Parse(b, received)
+		if err != nil {
+			logrus.WithError(err).WithField("peer", peer).Warn("Dropping invalid syslog message")
+			syslogMessages.WithLabelValues("invalid").Inc()
+			continue
+		}
+		select {
+		case queue <- syslogMessage{Message: m, peer: peer, received: received}:
+		case <-ctx.Done():
+			return
+		}
+		syslogQueueDepth.Set(float64(len(queue)))
+	}
+}
+
+// storeSyslogMessages stores the queued messages in batches of up to
+// batchSize records per transaction until the queue is closed. A failed
+// batch is retried until ctx is cancelled, then dropped.
+func storeSyslogMessages(ctx context.Context, queue <-chan syslogMessage, batchSize int) {
+	for first := range queue {
+		batch := []syslogMessage{first}
+	fill:
+		for len(batch) < batchSize {
+			select {
+			case m, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			default:
+				break fill
+			}
+		}
+		syslogQueueDepth.Set(float64(len(queue)))
+
+		records := make([]DataRecord, 0, len(batch))
+		for _, m := range batch {
+			record, err := syslogRecord(m)
+			if err != nil {
+				logrus.WithError(err).WithField("peer", m.peer).Warn("Dropping invalid syslog message")
+				syslogMessages.WithLabelValues("invalid").Inc()
+				continue
+			}
+			records = append(records, record)
+		}
+
+		for len(records) > 0 {
+			err := db.Update(func(tx *bolt.Tx) error {
+				for i := range records {
+					if err := putRecord(tx, &records[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err == nil {
+				syslogMessages.WithLabelValues("ingested").Add(float64(len(records)))
+				dataRecordsTotal.WithLabelValues("pending").Add(float64(len(records)))
+				break
+			}
+			logrus.WithError(err).WithField("records", len(records)).Error("Failed to store syslog records, retrying")
+			select {
+			case <-ctx.Done():
+				syslogMessages.WithLabelValues("error").Add(float64(len(records)))
+				records = nil
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// syslogRecord converts a message to a pending system_log record. data has
+// the parsed header fields, the message text and each structured data
+// parameter as sd.<id>.<name>.
+func syslogRecord(m syslogMessage) (DataRecord, error) {
+	data := map[string]string{
+		"message":       m.Message.Message,
+		"facility":      syslog.FacilityName(m.Facility),
+		"severity":      syslog.SeverityName(m.Severity),
+		"syslog_format": m.Format,
+		"syslog_peer":   m.peer,
+	}
+	for name, value := range map[string]string{
+		"hostname": m.Hostname,
+		"app_name": m.AppName,
+		"proc_id":  m.ProcID,
+		"msg_id":   m.MsgID,
+	} {
+		if value != "" {
+			data[name] = value
+		}
+	}
+	if !m.Timestamp.IsZero() {
+		data["log_timestamp"] = m.Timestamp.Format(time.RFC3339Nano)
+	}
+	for id, params := range m.StructuredData {
+		for name, value := range params {
+			data["sd."+id+"."+name] = value
+		}
+	}
+	return ingestedRecord(syslogRecordType, "syslog:"+m.peer, data, m.received)
+}
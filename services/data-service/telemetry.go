@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/httplog"
+	"pipeline/pkg/telemetry"
+)
+
+// apdex classifies requests into Apdex zones; it is set up in main.
+var apdex *telemetry.Apdex
+
+// requestLogger backs loggingMiddleware; it is set up in main.
+var requestLogger *httplog.Logger
+
+// routeTemplate returns the mux path template of the matched route so per-route
+// series stay bounded; unmatched requests are grouped together.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unmatched"
+}
+
+// featureFlags lists the optional features exported as service_feature_enabled.
+func featureFlags() map[string]bool {
+	return map[string]bool{
+		"otlp_export":       viper.GetBool("otlp.enabled"),
+		"statsd":            viper.GetBool("statsd.enabled"),
+		"pushgateway":       viper.GetBool("pushgateway.enabled"),
+		"native_histograms": viper.GetBool("metrics.native_histograms.enabled"),
+		"anomaly_detection": viper.GetBool("anomaly.enabled"),
+		"archive":           viper.GetBool("archive.enabled"),
+		"pii_masking":       len(maskingRules) > 0,
+		"leader_election":   viper.GetBool("leader_election.enabled"),
+		"read_replica":      viper.GetString("replica.mode") != "",
+	}
+}
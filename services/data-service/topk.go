@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/response"
+	"pipeline/pkg/topk"
+)
+
+// fieldTopK holds a windowed heavy-hitter sketch per data field listed in
+// topk.fields. It is written once by loadTopKConfig and only read after.
+var fieldTopK map[string]*topk.Windowed
+
+func loadTopKConfig() {
+	fieldTopK = make(map[string]*topk.Windowed)
+	capacity := max(viper.GetInt("topk.capacity"), 1)
+	for _, field := range viper.GetStringSlice("topk.fields") {
+		fieldTopK[field] = topk.NewWindowed(capacity, viper.GetDuration("topk.slice"), viper.GetDuration("topk.max_window"))
+	}
+}
+
+// trackTopK counts a created record's tracked fields once tx commits, at
+// the time it was ingested. Records without the field are not counted.
+func trackTopK(tx *bolt.Tx, record DataRecord) {
+	if len(fieldTopK) == 0 {
+		return
+	}
+	tx.OnCommit(func() {
+		now := time.Now()
+		for field, sketch := range fieldTopK {
+			if value, ok := record.Data[field]; ok {
+				sketch.Add(value, now)
+			}
+		}
+	})
+}
+
+// TopKResult is the response of GET /records/topk.
+type TopKResult struct {
+	Field string      `json:"field"`
+	From  time.Time   `json:"from"`
+	To    time.Time   `json:"to"`
+	Total uint64      `json:"total"`
+	Items []topk.Item `json:"items"`
+}
+
+// topKHandler serves GET /records/topk?field=&window=&k=, the most frequent
+// values of a tracked data field among the records ingested within window,
+// from the sketches kept by trackTopK rather than a scan of the records.
+// Counts are upper bounds; count-error is a lower bound.
+func topKHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	field := q.Get("field")
+	sketch, ok := fieldTopK[field]
+	if !ok {
+		tracked := make([]string, 0, len(fieldTopK))
+		for name := range fieldTopK {
+			tracked = append(tracked, name)
+		}
+		sort.Strings(tracked)
+		http.Error(w, fmt.Sprintf("field must be one of the tracked fields: %s", strings.Join(tracked, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	window := time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if window > sketch.Retention() {
+		http.Error(w, fmt.Sprintf("window must not exceed topk.max_window (%s)", sketch.Retention()), http.StatusBadRequest)
+		return
+	}
+	k := 10
+	if v := q.Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "k must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+
+	now := time.Now()
+	items, total, from := sketch.Top(k, window, now)
+	response.Write(w, r, http.StatusOK, TopKResult{
+		Field: field,
+		From:  from.UTC(),
+		To:    now.UTC(),
+		Total: total,
+		Items: items,
+	}, nil)
+}
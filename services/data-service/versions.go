@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/apiversion"
+	"pipeline/pkg/response"
+)
+
+// newAPIVersions returns the versions of the data API: v1, deprecated once
+// api.v1.deprecated_at is set, and v2, which leaves the worker lease fields
+// out of records.
+func newAPIVersions(router *mux.Router) (v1, v2 *apiversion.Version, err error) {
+	v1 = &apiversion.Version{
+		Name:      "v1",
+		Prefix:    "/api/v1",
+		DocsURL:   viper.GetString("api.v1.docs_url"),
+		Successor: successorIn(router, "/api/v1", "/api/v2"),
+		RouteFunc: routeTemplate,
+	}
+	if v1.Deprecated, err = configTime("api.v1.deprecated_at"); err != nil {
+		return nil, nil, err
+	}
+	if v1.Sunset, err = configTime("api.v1.sunset"); err != nil {
+		return nil, nil, err
+	}
+	v2 = &apiversion.Version{Name: "v2", Prefix: "/api/v2", RouteFunc: routeTemplate}
+	return v1, v2, nil
+}
+
+// apiVersions are the API versions the service serves, reported on / so
+// callers such as the gateway can check they are compatible with it.
+var apiVersions = []string{"v1", "v2"}
+
+// capabilities lists the features the service offers with its current
+// config, reported on / next to apiVersions.
+func capabilities() []string {
+	caps := []string{"records", "jobs", "lineage", "views", "backpressure"}
+	for capability, key := range map[string]string{
+		"archive":       "archive.enabled",
+		"enrichment":    "enrichment.enabled",
+		"grpc_ingest":   "grpc.enabled",
+		"kafka":         "kafka.enabled",
+		"metric_tiers":  "metric_tiers.enabled",
+		"mqtt":          "mqtt.enabled",
+		"otlp_receiver": "otlp_receiver.enabled",
+		"remote_write":  "prom_write.enabled",
+		"syslog":        "syslog.enabled",
+	} {
+		if viper.GetBool(key) {
+			caps = append(caps, capability)
+		}
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// configTime reads an optional RFC 3339 time from the config.
+func configTime(key string) (time.Time, error) {
+	v := viper.GetString(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// successorIn returns an apiversion Successor func: the path of a request
+// under to instead of from, if router serves it.
+func successorIn(router *mux.Router, from, to string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		rest, ok := strings.CutPrefix(r.URL.Path, from)
+		if !ok {
+			return ""
+		}
+		successor := *r
+		u := *r.URL
+		u.Path, u.RawPath = to+rest, ""
+		successor.URL = &u
+		if !router.Match(&successor, &mux.RouteMatch{}) {
+			return ""
+		}
+		return response.Link(r, u.Path)
+	}
+}
+
+// apiPath returns path, e.g. "/records", under the API version r was served
+// by.
+func apiPath(r *http.Request, path string) string {
+	version := apiversion.FromRequest(r)
+	if version == "" {
+		version = "v1"
+	}
+	return "/api/" + version + path
+}
+
+func isV2(r *http.Request) bool {
+	return apiversion.FromRequest(r) == "v2"
+}
+
+// presentRecord returns record as the API version of r represents it. The
+// lease fields are internal to the workers and not part of v2; lineage is
+// served on its own.
+func presentRecord(r *http.Request, record DataRecord) DataRecord {
+	record.Lineage = nil
+	if isV2(r) {
+		record.ClaimedBy = ""
+		record.LeaseExpiry = nil
+	}
+	return record
+}
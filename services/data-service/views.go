@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"pipeline/pkg/response"
+)
+
+// viewsBucket holds the materialized view definitions by name and
+// viewDataBucket a bucket per view with its groups, keyed by the JSON array
+// of their group-by values, and its members, the contribution of each
+// matching record, by record ID and by group.
+const (
+	viewsBucket    = "views"
+	viewDataBucket = "view_data"
+)
+
+var (
+	viewGroupsKey  = []byte("groups")
+	viewMembersKey = []byte("members")
+	viewByGroupKey = []byte("by_group")
+
+	viewNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	viewOps         = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+	errViewNotFound = errors.New("view not found")
+	errViewExists   = errors.New("view already exists")
+)
+
+var viewChanges = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "data_view_changes_total",
+		Help: "Record changes applied to materialized views, by view",
+	},
+	[]string{"view"},
+)
+
+func init() {
+	prometheus.MustRegister(viewChanges)
+}
+
+// ViewFilter selects the records a view aggregates, like the type,
+// processed and data.<key> parameters of GET /records.
+type ViewFilter struct {
+	Type      string            `json:"type,omitempty"`
+	Processed *bool             `json:"processed,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// ViewAggregation is a value computed per group. count counts the group's
+// records, or with a field the records where it is numeric; sum, avg, min
+// and max aggregate a numeric data field and skip records without one.
+type ViewAggregation struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Field string `json:"field,omitempty"`
+}
+
+// MaterializedView is a named aggregation of records kept up to date from
+// the change feed every RefreshInterval.
+type MaterializedView struct {
+	Name   string     `json:"name"`
+	Filter ViewFilter `json:"filter"`
+	// GroupBy names the data fields records are grouped by; records
+	// missing one are grouped under "".
+	GroupBy         []string          `json:"group_by"`
+	Aggregations    []ViewAggregation `json:"aggregations"`
+	RefreshInterval string            `json:"refresh_interval"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	// Sequence is the last change of the feed applied to the view.
+	Sequence uint64 `json:"sequence"`
+	// LagChanges is how many changes the view is behind, when read.
+	LagChanges uint64 `json:"lag_changes"`
+	// Links is set on views listed in a collection response.
+	Links response.Links `json:"links,omitempty"`
+}
+
+func (v *MaterializedView) validate() error {
+	if !viewNamePattern.MatchString(v.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+	if len(v.Aggregations) == 0 {
+		return fmt.Errorf("at least one aggregation is required")
+	}
+	names := make(map[string]bool)
+	for _, agg := range v.Aggregations {
+		switch {
+		case agg.Name == "":
+			return fmt.Errorf("aggregations need a name")
+		case names[agg.Name]:
+			return fmt.Errorf("duplicate aggregation %q", agg.Name)
+		case !viewOps[agg.Op]:
+			return fmt.Errorf("aggregation %q: op must be count, sum, avg, min or max", agg.Name)
+		case agg.Op != "count" && agg.Field == "":
+			return fmt.Errorf("aggregation %q: %s needs a field", agg.Name, agg.Op)
+		}
+		names[agg.Name] = true
+	}
+	if v.RefreshInterval == "" {
+		v.RefreshInterval = "1m"
+	}
+	if d, err := time.ParseDuration(v.RefreshInterval); err != nil || d < time.Second {
+		return fmt.Errorf("refresh_interval must be a duration of at least 1s")
+	}
+	return nil
+}
+
+func (v MaterializedView) refreshInterval() time.Duration {
+	d, _ := time.ParseDuration(v.RefreshInterval)
+	return d
+}
+
+func (v MaterializedView) recordFilter() recordFilter {
+	return recordFilter{Type: v.Filter.Type, Processed: v.Filter.Processed, Data: v.Filter.Data}
+}
+
+// viewAggState is an aggregation of one group. Min and Max are Stale when
+// a record holding one of them left the group, until they are recomputed
+// from the group's members.
+type viewAggState struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Stale bool    `json:"stale,omitempty"`
+}
+
+type viewGroup struct {
+	Group   map[string]string        `json:"group"`
+	Records int64                    `json:"records"`
+	Aggs    map[string]*viewAggState `json:"aggs"`
+}
+
+// viewMember is what a record contributes to its group: the numeric value
+// of each aggregation's field it has.
+type viewMember struct {
+	Group  string             `json:"group"`
+	Values map[string]float64 `json:"values"`
+}
+
+// ViewRow is a group of a view with its aggregated values; a value is null
+// when no record of the group has its field.
+type ViewRow struct {
+	Group   map[string]string   `json:"group"`
+	Records int64               `json:"records"`
+	Values  map[string]*float64 `json:"values"`
+}
+
+func (g viewGroup) row(view MaterializedView) ViewRow {
+	row := ViewRow{Group: g.Group, Records: g.Records, Values: make(map[string]*float64)}
+	for _, agg := range view.Aggregations {
+		state := g.Aggs[agg.Name]
+		var value *float64
+		set := func(v float64) { value = &v }
+		switch {
+		case agg.Op == "count" && agg.Field == "":
+			set(float64(g.Records))
+		case agg.Op == "count":
+			set(float64(state.Count))
+		case state.Count == 0:
+		case agg.Op == "sum":
+			set(state.Sum)
+		case agg.Op == "avg":
+			set(state.Sum / float64(state.Count))
+		case agg.Op == "min":
+			set(state.Min)
+		case agg.Op == "max":
+			set(state.Max)
+		}
+		row.Values[agg.Name] = value
+	}
+	return row
+}
+
+// viewData is a view's buckets within a transaction.
+type viewData struct {
+	view                     MaterializedView
+	groups, members, byGroup *bolt.Bucket
+	// stale collects the groups whose min or max must be recomputed.
+	stale map[string]bool
+}
+
+func openViewData(tx *bolt.Tx, view MaterializedView) (*viewData, error) {
+	b, err := tx.Bucket([]byte(viewDataBucket)).CreateBucketIfNotExists([]byte(view.Name))
+	if err != nil {
+		return nil, err
+	}
+	d := &viewData{view: view, stale: make(map[string]bool)}
+	for _, nested := range []struct {
+		key    []byte
+		bucket **bolt.Bucket
+	}{{viewGroupsKey, &d.groups}, {viewMembersKey, &d.members}, {viewByGroupKey, &d.byGroup}} {
+		if *nested.bucket, err = b.CreateBucketIfNotExists(nested.key); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func memberByGroupKey(group, recordID string) []byte {
+	return append(append([]byte(group), 0), recordID...)
+}
+
+// apply makes the view reflect the current version of a record: nil when
+// it was deleted.
+func (d *viewData) apply(recordID string, record *DataRecord) error {
+	if err := d.retract(recordID); err != nil {
+		return err
+	}
+	if record == nil || !d.view.recordFilter().matches(*record) {
+		return nil
+	}
+
+	values := make([]string, len(d.view.GroupBy))
+	labels := make(map[string]string, len(d.view.GroupBy))
+	for i, field := range d.view.GroupBy {
+		values[i] = record.Data[field]
+		labels[field] = values[i]
+	}
+	key, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	member := viewMember{Group: string(key), Values: make(map[string]float64)}
+	for _, agg := range d.view.Aggregations {
+		if agg.Field == "" {
+			continue
+		}
+		if v, err := strconv.ParseFloat(record.Data[agg.Field], 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			member.Values[agg.Name] = v
+		}
+	}
+
+	group, err := d.group(member.Group)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		group = &viewGroup{Group: labels, Aggs: make(map[string]*viewAggState)}
+		for _, agg := range d.view.Aggregations {
+			group.Aggs[agg.Name] = &viewAggState{}
+		}
+	}
+	group.Records++
+	for name, v := range member.Values {
+		state := group.Aggs[name]
+		if state.Count == 0 || v < state.Min {
+			state.Min = v
+		}
+		if state.Count == 0 || v > state.Max {
+			state.Max = v
+		}
+		state.Count++
+		state.Sum += v
+	}
+	if err := d.putGroup(member.Group, group); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	if err := d.members.Put([]byte(recordID), data); err != nil {
+		return err
+	}
+	return d.byGroup.Put(memberByGroupKey(member.Group, recordID), data)
+}
+
+// retract removes what a record contributed to the view, if anything.
+func (d *viewData) retract(recordID string) error {
+	data := d.members.Get([]byte(recordID))
+	if data == nil {
+		return nil
+	}
+	var member viewMember
+	if err := json.Unmarshal(data, &member); err != nil {
+		return err
+	}
+	if err := d.members.Delete([]byte(recordID)); err != nil {
+		return err
+	}
+	if err := d.byGroup.Delete(memberByGroupKey(member.Group, recordID)); err != nil {
+		return err
+	}
+
+	group, err := d.group(member.Group)
+	if err != nil || group == nil {
+		return err
+	}
+	group.Records--
+	if group.Records <= 0 {
+		delete(d.stale, member.Group)
+		return d.groups.Delete([]byte(member.Group))
+	}
+	for name, v := range member.Values {
+		state := group.Aggs[name]
+		state.Count--
+		state.Sum -= v
+		if v <= state.Min || v >= state.Max {
+			state.Stale = true
+			d.stale[member.Group] = true
+		}
+	}
+	return d.putGroup(member.Group, group)
+}
+
+func (d *viewData) group(key string) (*viewGroup, error) {
+	data := d.groups.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	var group viewGroup
+	if err := json.Unmarshal(data, &group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (d *viewData) putGroup(key string, group *viewGroup) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return d.groups.Put([]byte(key), data)
+}
+
+// recomputeStale rebuilds the min and max of the groups a retraction left
+// stale from their members.
+func (d *viewData) recomputeStale() error {
+	for key := range d.stale {
+		group, err := d.group(key)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			continue
+		}
+		stale := make(map[string]bool)
+		for name, state := range group.Aggs {
+			if state.Stale {
+				stale[name] = true
+				state.Min, state.Max, state.Stale = 0, 0, false
+			}
+		}
+		seen := make(map[string]bool)
+		prefix := memberByGroupKey(key, "")
+		c := d.byGroup.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var member viewMember
+			if err := json.Unmarshal(v, &member); err != nil {
+				return err
+			}
+			for name, value := range member.Values {
+				if !stale[name] {
+					continue
+				}
+				state := group.Aggs[name]
+				if !seen[name] || value < state.Min {
+					state.Min = value
+				}
+				if !seen[name] || value > state.Max {
+					state.Max = value
+				}
+				seen[name] = true
+			}
+		}
+		if err := d.putGroup(key, group); err != nil {
+			return err
+		}
+	}
+	d.stale = make(map[string]bool)
+	return nil
+}
+
+func loadView(tx *bolt.Tx, name string) (MaterializedView, error) {
+	var view MaterializedView
+	data := tx.Bucket([]byte(viewsBucket)).Get([]byte(name))
+	if data == nil {
+		return view, errViewNotFound
+	}
+	return view, json.Unmarshal(data, &view)
+}
+
+func saveView(tx *bolt.Tx, view MaterializedView) error {
+	view.LagChanges, view.Links = 0, nil
+	data, err := json.Marshal(view)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(viewsBucket)).Put([]byte(view.Name), data)
+}
+
+// buildView creates a view and aggregates every existing record into it,
+// in one transaction so that it continues from the change feed exactly
+// where the records it read left off.
+func buildView(view MaterializedView) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := loadView(tx, view.Name); err == nil {
+			return errViewExists
+		}
+		d, err := openViewData(tx, view)
+		if err != nil {
+			return err
+		}
+		err = forEachRecord(tx, -1, func(k, v []byte) error {
+			var record DataRecord
+			if err := decodeRecord(k, v, &record); err != nil {
+				return nil
+			}
+			return d.apply(record.ID, &record)
+		})
+		if err != nil {
+			return err
+		}
+		view.Sequence = tx.Bucket([]byte("changes")).Sequence()
+		view.RefreshedAt = time.Now()
+		return saveView(tx, view)
+	})
+}
+
+// refreshView applies the changes made since the view's last refresh, in
+// transactions of up to 1000 changes.
+func refreshView(name string) error {
+	for {
+		applied := 0
+		err := db.Update(func(tx *bolt.Tx) error {
+			view, err := loadView(tx, name)
+			if err != nil {
+				return err
+			}
+			d, err := openViewData(tx, view)
+			if err != nil {
+				return err
+			}
+			c := tx.Bucket([]byte("changes")).Cursor()
+			for k, v := c.Seek(sequenceKey(view.Sequence + 1)); k != nil && applied < 1000; k, v = c.Next() {
+				var change RecordChange
+				if err := json.Unmarshal(v, &change); err != nil {
+					return fmt.Errorf("decode change: %w", err)
+				}
+				if err := d.apply(change.RecordID, change.Record); err != nil {
+					return err
+				}
+				view.Sequence = change.Sequence
+				applied++
+			}
+			if err := d.recomputeStale(); err != nil {
+				return err
+			}
+			view.RefreshedAt = time.Now()
+			return saveView(tx, view)
+		})
+		if err != nil {
+			return err
+		}
+		viewChanges.WithLabelValues(name).Add(float64(applied))
+		if applied < 1000 {
+			return nil
+		}
+	}
+}
+
+// refreshViewsContinuously refreshes each view once its refresh interval
+// has passed since the last refresh.
+func refreshViewsContinuously() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !isLeader() {
+			continue
+		}
+		var due []string
+		db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(viewsBucket)).ForEach(func(k, v []byte) error {
+				var view MaterializedView
+				if err := json.Unmarshal(v, &view); err == nil && time.Since(view.RefreshedAt) >= view.refreshInterval() {
+					due = append(due, view.Name)
+				}
+				return nil
+			})
+		})
+		for _, name := range due {
+			if err := refreshView(name); err != nil && err != errViewNotFound {
+				logrus.WithError(err).WithField("view", name).Error("Failed to refresh materialized view")
+			}
+		}
+	}
+}
+
+func viewLinks(r *http.Request, view MaterializedView) response.Links {
+	return response.Links{
+		"self":       response.Link(r, apiPath(r, "/views/"+view.Name)),
+		"collection": response.Link(r, apiPath(r, "/views")),
+	}
+}
+
+// withLag sets how far view is behind the change feed of tx.
+func withLag(tx *bolt.Tx, view MaterializedView) MaterializedView {
+	if last := tx.Bucket([]byte("changes")).Sequence(); last > view.Sequence {
+		view.LagChanges = last - view.Sequence
+	}
+	return view
+}
+
+// createViewHandler serves POST /api/v1/views. The view is built from the
+// existing records before the response.
+func createViewHandler(w http.ResponseWriter, r *http.Request) {
+	var view MaterializedView
+	if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := view.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.CreatedAt = time.Now()
+	view.Sequence, view.LagChanges, view.Links = 0, 0, nil
+	if err := buildView(view); err != nil {
+		if err == errViewExists {
+			http.Error(w, fmt.Sprintf("View %q already exists", view.Name), http.StatusConflict)
+			return
+		}
+		logrus.WithError(err).WithField("view", view.Name).Error("Failed to build materialized view")
+		http.Error(w, "Failed to build view", http.StatusInternalServerError)
+		return
+	}
+	db.View(func(tx *bolt.Tx) error {
+		view, _ = loadView(tx, view.Name)
+		return nil
+	})
+	response.Created(w, r, view, viewLinks(r, view))
+}
+
+// getViewsHandler serves GET /api/v1/views, the view definitions by name.
+func getViewsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := response.ParsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	views := []MaterializedView{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(viewsBucket)).ForEach(func(k, v []byte) error {
+			var view MaterializedView
+			if err := json.Unmarshal(v, &view); err != nil {
+				return err
+			}
+			view = withLag(tx, view)
+			view.Links = viewLinks(r, view)
+			views = append(views, view)
+			return nil
+		})
+	})
+	if err != nil {
+		http.Error(w, "Failed to list views", http.StatusInternalServerError)
+		return
+	}
+	lo, hi := page.Bounds(len(views))
+	response.WriteList(w, r, views[lo:hi], page, len(views), nil)
+}
+
+// ViewResult is a view with its rows.
+type ViewResult struct {
+	MaterializedView
+	Rows []ViewRow `json:"rows"`
+}
+
+// getViewHandler serves GET /api/v1/views/{name}?refresh=&group.{field}=,
+// the view's rows ordered by group. refresh=true first applies the changes
+// made since the last refresh.
+func getViewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	q := r.URL.Query()
+	if refresh, _ := strconv.ParseBool(q.Get("refresh")); refresh {
+		if err := refreshView(name); err != nil && err != errViewNotFound {
+			logrus.WithError(err).WithField("view", name).Error("Failed to refresh materialized view")
+			http.Error(w, "Failed to refresh view", http.StatusInternalServerError)
+			return
+		}
+	}
+	groupFilter := make(map[string]string)
+	for param, values := range q {
+		if field, ok := strings.CutPrefix(param, "group."); ok && len(values) > 0 {
+			groupFilter[field] = values[0]
+		}
+	}
+
+	var result ViewResult
+	err := db.View(func(tx *bolt.Tx) error {
+		view, err := loadView(tx, name)
+		if err != nil {
+			return err
+		}
+		result = ViewResult{MaterializedView: withLag(tx, view), Rows: []ViewRow{}}
+		b := tx.Bucket([]byte(viewDataBucket)).Bucket([]byte(name))
+		if b == nil || b.Bucket(viewGroupsKey) == nil {
+			return nil
+		}
+		return b.Bucket(viewGroupsKey).ForEach(func(k, v []byte) error {
+			var group viewGroup
+			if err := json.Unmarshal(v, &group); err != nil {
+				return err
+			}
+			for field, value := range groupFilter {
+				if group.Group[field] != value {
+					return nil
+				}
+			}
+			result.Rows = append(result.Rows, group.row(view))
+			return nil
+		})
+	})
+	if err == errViewNotFound {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read view", http.StatusInternalServerError)
+		return
+	}
+	response.Write(w, r, http.StatusOK, result, viewLinks(r, result.MaterializedView))
+}
+
+// deleteViewHandler serves DELETE /api/v1/views/{name}.
+func deleteViewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := loadView(tx, name); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(viewDataBucket)).DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket([]byte(viewsBucket)).Delete([]byte(name))
+	})
+	if err == errViewNotFound {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete view", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
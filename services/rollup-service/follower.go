@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/changefeed"
+)
+
+// changesLimit matches the data service's default page size.
+const changesLimit = 500
+
+// caughtUp is set once the whole change feed has been folded in.
+var caughtUp atomic.Bool
+
+// followChanges tails the data service change feed and folds each batch into
+// the rollups. The applied sequence is stored with the rollups so restarts
+// resume where they stopped.
+func followChanges() {
+	source := strings.TrimRight(viper.GetString("source.url"), "/")
+	interval := viper.GetDuration("source.poll_interval")
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: bootstrap.SignedTransport(viper.GetViper(), nil)}
+
+	applied, err := appliedSeq()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to read rollup state")
+	}
+	logrus.WithFields(logrus.Fields{"source": source, "since": applied}).Info("Following data service change feed")
+
+	for {
+		var batch struct {
+			Changes []change `json:"changes"`
+			LastSeq uint64   `json:"last_seq"`
+		}
+		err := changefeed.FetchJSON(client, fmt.Sprintf("%s/api/v1/changes?since=%d&limit=%d", source, applied, changesLimit), &batch)
+		var truncated changefeed.TruncatedError
+		if errors.As(err, &truncated) {
+			// The changes are gone for good; count what is left.
+			logrus.WithFields(logrus.Fields{"since": applied, "first_seq": truncated.FirstSeq}).Warn("Change feed truncated, skipping to its oldest change")
+			applied = truncated.FirstSeq - 1
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to fetch changes from data service")
+			time.Sleep(interval)
+			continue
+		}
+
+		if len(batch.Changes) > 0 {
+			if err := applyChanges(batch.Changes); err != nil {
+				logrus.WithError(err).Error("Failed to apply changes to rollups")
+				time.Sleep(interval)
+				continue
+			}
+			applied = batch.Changes[len(batch.Changes)-1].Sequence
+		}
+
+		lag := float64(0)
+		if batch.LastSeq > applied {
+			lag = float64(batch.LastSeq - applied)
+		}
+		lagChanges.Set(lag)
+		appliedSequence.Set(float64(applied))
+		if lag == 0 && !caughtUp.Load() {
+			caughtUp.Store(true)
+			logrus.WithField("seq", applied).Info("Rollups caught up with data service")
+		}
+
+		// Keep draining without waiting while a backlog remains.
+		if len(batch.Changes) < changesLimit {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/changefeed"
+)
+
+var forecastSecondsToLimit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rollup_forecast_seconds_to_limit",
+		Help: "Projected seconds until a resource exceeds its configured limit; +Inf when it is not growing",
+	},
+	[]string{"resource"},
+)
+
+func init() {
+	prometheus.MustRegister(forecastSecondsToLimit)
+}
+
+// Forecast statuses.
+const (
+	forecastOK       = "ok"
+	forecastWarning  = "warning"
+	forecastExceeded = "exceeded"
+)
+
+// ResourceForecast projects one resource against its limit.
+type ResourceForecast struct {
+	Current         float64    `json:"current"`
+	Limit           float64    `json:"limit"`
+	GrowthPerSecond float64    `json:"growth_per_second"`
+	ExceedsAt       *time.Time `json:"exceeds_at,omitempty"`
+	SecondsToLimit  *float64   `json:"seconds_to_limit,omitempty"`
+	Status          string     `json:"status"`
+}
+
+// Forecast is served by /api/v1/forecast.
+type Forecast struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Lookback    string    `json:"lookback"`
+	Resolution  string    `json:"resolution"`
+	Rates       struct {
+		Ingest     float64 `json:"ingest_per_second"`
+		Processing float64 `json:"processing_per_second"`
+		Deletion   float64 `json:"deletion_per_second"`
+	} `json:"rates"`
+	PendingRecords ResourceForecast  `json:"pending_records"`
+	DatabaseSize   *ResourceForecast `json:"database_size_bytes,omitempty"`
+	// Errors lists inputs that could not be read, e.g. an unreachable data
+	// service for the database size.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// computeForecast projects the pending backlog and the data service's Bolt
+// file size forward at the rates seen over forecast.lookback.
+func computeForecast(now time.Time) (*Forecast, error) {
+	lookback := viper.GetDuration("forecast.lookback")
+	if lookback <= 0 {
+		lookback = 6 * time.Hour
+	}
+	// Coarser rollups for long lookbacks keep the scan short.
+	res := resolutions[1]
+	if lookback > 48*time.Hour {
+		res = resolutions[2]
+	}
+
+	points, err := queryRollups(res, now.Add(-lookback), now, "", math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forecast{GeneratedAt: now.UTC(), Lookback: lookback.String(), Resolution: res.Name}
+	var created, processed, deleted int64
+	for _, p := range points {
+		created += p.Created
+		processed += p.Processed
+		deleted += p.Deleted
+	}
+	// The oldest window may be partial, so rates use the covered span.
+	span := lookback.Seconds()
+	if len(points) > 0 {
+		if covered := now.Sub(points[0].Start).Seconds(); covered < span {
+			span = covered
+		}
+	}
+	if span > 0 {
+		f.Rates.Ingest = float64(created) / span
+		f.Rates.Processing = float64(processed) / span
+		f.Rates.Deletion = float64(deleted) / span
+	}
+
+	var pending int64
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		pending, err = readCounter(tx, "pending")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.PendingRecords = project(now, float64(pending), viper.GetFloat64("forecast.limits.pending_records"), f.Rates.Ingest-f.Rates.Processing)
+
+	if limit := viper.GetFloat64("forecast.limits.database_size_bytes"); limit > 0 {
+		size, records, err := fetchDatabaseSize()
+		if err != nil {
+			f.Errors = append(f.Errors, "database size: "+err.Error())
+		} else {
+			// Bolt reuses freed pages but never shrinks the file, so only
+			// net record growth adds to its size.
+			growth := 0.0
+			if records > 0 {
+				growth = math.Max(f.Rates.Ingest-f.Rates.Deletion, 0) * float64(size) / float64(records)
+			}
+			sizeForecast := project(now, float64(size), limit, growth)
+			f.DatabaseSize = &sizeForecast
+		}
+	}
+	return f, nil
+}
+
+func project(now time.Time, current, limit, growth float64) ResourceForecast {
+	rf := ResourceForecast{Current: current, Limit: limit, GrowthPerSecond: growth, Status: forecastOK}
+	switch {
+	case limit <= 0:
+	case current >= limit:
+		rf.Status = forecastExceeded
+		zero := 0.0
+		rf.SecondsToLimit = &zero
+		at := now.UTC()
+		rf.ExceedsAt = &at
+	case growth > 0:
+		seconds := (limit - current) / growth
+		at := now.Add(time.Duration(seconds * float64(time.Second))).UTC()
+		rf.SecondsToLimit = &seconds
+		rf.ExceedsAt = &at
+		if seconds <= viper.GetDuration("forecast.warning_horizon").Seconds() {
+			rf.Status = forecastWarning
+		}
+	}
+	return rf
+}
+
+// fetchDatabaseSize reads the Bolt file size and record count from the data
+// service.
+func fetchDatabaseSize() (int64, int64, error) {
+	var metrics struct {
+		TotalRecords int64 `json:"total_records"`
+		DatabaseSize int64 `json:"database_size_bytes"`
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: bootstrap.SignedTransport(viper.GetViper(), nil)}
+	url := strings.TrimRight(viper.GetString("source.url"), "/") + "/api/v1/metrics"
+	if err := changefeed.FetchJSON(client, url, &metrics); err != nil {
+		return 0, 0, err
+	}
+	return metrics.DatabaseSize, metrics.TotalRecords, nil
+}
+
+func getForecastHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := computeForecast(time.Now())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to compute forecast")
+		http.Error(w, "Failed to compute forecast", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// forecastContinuously refreshes the forecast gauges and logs when a resource
+// enters or leaves the warning horizon.
+func forecastContinuously() {
+	interval := viper.GetDuration("forecast.interval")
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	statuses := make(map[string]string)
+	for range ticker.C {
+		if !caughtUp.Load() {
+			continue
+		}
+		f, err := computeForecast(time.Now())
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to compute forecast")
+			continue
+		}
+
+		resources := map[string]*ResourceForecast{"pending_records": &f.PendingRecords}
+		if f.DatabaseSize != nil {
+			resources["database_size_bytes"] = f.DatabaseSize
+		}
+
+		for name, rf := range resources {
+			seconds := math.Inf(1)
+			if rf.SecondsToLimit != nil {
+				seconds = *rf.SecondsToLimit
+			}
+			forecastSecondsToLimit.WithLabelValues(name).Set(seconds)
+
+			previous, seen := statuses[name]
+			if previous != rf.Status && (seen || rf.Status != forecastOK) {
+				entry := logrus.WithFields(logrus.Fields{
+					"resource": name,
+					"status":   rf.Status,
+					"current":  rf.Current,
+					"limit":    rf.Limit,
+				})
+				if rf.ExceedsAt != nil {
+					entry = entry.WithField("exceeds_at", rf.ExceedsAt.Format(time.RFC3339))
+				}
+				switch rf.Status {
+				case forecastOK:
+					entry.Info("Capacity forecast back within limits")
+				case forecastWarning:
+					entry.Warn("Capacity forecast approaching limit")
+				default:
+					entry.Warn("Capacity limit exceeded")
+				}
+			}
+			statuses[name] = rf.Status
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/httplog"
+	"pipeline/pkg/telemetry"
+)
+
+// version and commit are set at build time via -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "1.0.0"
+	commit  = "unknown"
+)
+
+var (
+	startTime     = time.Now()
+	db            *bolt.DB
+	requestLogger *httplog.Logger
+
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rollup_http_requests_total",
+			Help: "Total number of HTTP requests for rollup service",
+		},
+		[]string{"method", "endpoint", "status"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rollup_http_request_duration_seconds",
+			Help:    "HTTP request duration for rollup service",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"method", "endpoint", "status"},
+	)
+
+	changesApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rollup_changes_applied_total",
+			Help: "Data service changes folded into rollups by operation",
+		},
+		[]string{"op"},
+	)
+
+	appliedSequence = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rollup_applied_sequence",
+			Help: "Last data service change sequence folded into rollups",
+		},
+	)
+
+	lagChanges = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rollup_lag_changes",
+			Help: "Changes in the data service feed not yet folded into rollups",
+		},
+	)
+
+	orderEventsApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rollup_order_events_applied_total",
+			Help: "Business service order events folded into order rollups by type",
+		},
+		[]string{"type"},
+	)
+
+	lagOrderEvents = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rollup_lag_order_events",
+			Help: "Events in the business service order log not yet folded into order rollups",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(changesApplied)
+	prometheus.MustRegister(appliedSequence)
+	prometheus.MustRegister(lagChanges)
+	prometheus.MustRegister(orderEventsApplied)
+	prometheus.MustRegister(lagOrderEvents)
+
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.SetLevel(logrus.InfoLevel)
+}
+
+func main() {
+	loadConfig()
+	telemetry.RegisterBuildInfo(version, commit)
+	stopRuntime := bootstrap.StartRuntimeMetrics(viper.GetViper())
+	defer stopRuntime()
+	stopProfiling := bootstrap.StartProfiling(viper.GetViper(), "rollup-service", version)
+	defer stopProfiling()
+	auditor := bootstrap.StartShutdownAudit(viper.GetViper())
+	requestLogger = bootstrap.NewRequestLogger(viper.GetViper(), "Rollup service request", nil)
+
+	if level, err := logrus.ParseLevel(viper.GetString("log_level")); err == nil {
+		logrus.SetLevel(level)
+	}
+
+	// Initialize database
+	var err error
+	db, err = bolt.Open(viper.GetString("storage.path"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to open database")
+	}
+	defer db.Close()
+	// Audited before the database closes, which waits for the transactions
+	// still open.
+	var drainErr error
+	defer func() {
+		bootstrap.FinishShutdownAudit(auditor, drainErr, db.Stats().OpenTxN)
+	}()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		names := []string{stateBucket, recordsBucket, orderStatesBucket}
+		for _, res := range resolutions {
+			names = append(names, res.bucket(), res.ordersBucket())
+		}
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket %s: %s", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create buckets")
+	}
+
+	if err := seedPendingCount(); err != nil {
+		logrus.WithError(err).Fatal("Failed to count pending records")
+	}
+
+	go followChanges()
+	if viper.GetString("business.url") != "" {
+		go followOrders()
+	}
+	go pruneContinuously()
+	go forecastContinuously()
+
+	guard, err := bootstrap.NewAccessGuard(viper.GetViper())
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid endpoint_protection config")
+	}
+
+	loadShedder := bootstrap.NewLoadShedder(viper.GetViper())
+	defer loadShedder.Close()
+
+	router := mux.NewRouter()
+
+	// Middleware
+	router.Use(loggingMiddleware)
+	router.Use(metricsMiddleware)
+	router.Use(loadShedder.Wrap)
+
+	// Routes
+	router.HandleFunc("/", homeHandler).Methods("GET")
+	router.HandleFunc("/health", healthHandler).Methods("GET")
+	router.HandleFunc("/ready", readinessHandler).Methods("GET")
+	router.Handle("/metrics", guard.Wrap(promhttp.Handler())).Methods("GET")
+
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/rollups", getRollupsHandler).Methods("GET")
+	api.HandleFunc("/rollups/orders", getOrderRollupsHandler).Methods("GET")
+	api.HandleFunc("/forecast", getForecastHandler).Methods("GET")
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%s", viper.GetString("port")),
+		Handler:      auditor.Wrap(router),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	logrus.WithField("port", viper.GetString("port")).Info("Starting Rollup Service")
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Fatal("Server failed to start")
+		}
+	}()
+
+	// Graceful shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logrus.Info("Shutting down rollup service...")
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown.drain_timeout"))
+	defer cancel()
+
+	if drainErr = srv.Shutdown(ctx); drainErr != nil {
+		logrus.WithError(drainErr).Error("Server forced to shutdown")
+	}
+
+	logrus.Info("Rollup service exited")
+}
+
+func loadConfig() {
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath("./config")
+
+	viper.SetDefault("port", "8085")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("logging.sample_rate", 1.0)
+	viper.SetDefault("logging.slow_threshold", "1s")
+	viper.SetDefault("logging.capture_bodies", false)
+	viper.SetDefault("logging.max_body_bytes", 2048)
+	viper.SetDefault("source.url", "http://data-service:8082")
+	viper.SetDefault("source.poll_interval", "5s")
+	viper.SetDefault("business.url", "http://business-service:8081")
+	viper.SetDefault("business.poll_interval", "5s")
+	viper.SetDefault("storage.path", "rollups.db")
+	viper.SetDefault("rollups.retention.1m", "48h")
+	viper.SetDefault("rollups.retention.5m", "336h")
+	viper.SetDefault("rollups.retention.1h", "2160h")
+	viper.SetDefault("rollups.prune_interval", "1h")
+	viper.SetDefault("rollups.latency_buckets", []float64{0.5, 1, 5, 10, 30, 60, 300, 900})
+	viper.SetDefault("rollups.max_points", 5000)
+	viper.SetDefault("forecast.lookback", "6h")
+	viper.SetDefault("forecast.interval", "5m")
+	viper.SetDefault("forecast.warning_horizon", "24h")
+	viper.SetDefault("forecast.limits.pending_records", 10000)
+	viper.SetDefault("forecast.limits.database_size_bytes", 1073741824)
+	viper.SetDefault("endpoint_protection.allowed_ips", []string{})
+	viper.SetDefault("endpoint_protection.bearer_token", "")
+	viper.SetDefault("endpoint_protection.basic_auth.username", "")
+	viper.SetDefault("endpoint_protection.basic_auth.password", "")
+	viper.SetDefault("profiling.enabled", false)
+	viper.SetDefault("profiling.backend", "pyroscope")
+	viper.SetDefault("profiling.url", "http://pyroscope:4040")
+	viper.SetDefault("profiling.profiles", []string{"cpu", "heap"})
+	viper.SetDefault("profiling.interval", "15s")
+	viper.SetDefault("profiling.timeout", "10s")
+	viper.SetDefault("profiling.tags", map[string]string{})
+	viper.SetDefault("shutdown.drain_timeout", "30s")
+	viper.SetDefault("shutdown.settle", "2s")
+	viper.SetDefault("shutdown.report_path", "shutdown.json")
+	viper.SetDefault("runtime.enabled", true)
+	viper.SetDefault("runtime.interval", "15s")
+	viper.SetDefault("runtime.window", "5m")
+	viper.SetDefault("runtime.thresholds.goroutine_growth", 100)
+	viper.SetDefault("runtime.thresholds.gc_pause_p99", "100ms")
+	viper.SetDefault("runtime.thresholds.sched_latency_p99", "50ms")
+	viper.SetDefault("runtime.thresholds.fd_usage", 0.8)
+	viper.SetDefault("load_shedding.enabled", true)
+	viper.SetDefault("load_shedding.max_in_flight", 100)
+	viper.SetDefault("load_shedding.cpu_threshold", 0.9)
+	viper.SetDefault("load_shedding.low_priority_at", 0.6)
+	viper.SetDefault("load_shedding.normal_priority_at", 0.85)
+	viper.SetDefault("load_shedding.retry_after", "1s")
+	viper.SetDefault("load_shedding.exempt_paths", []string{})
+	viper.SetDefault("request_signing.enabled", false)
+	viper.SetDefault("request_signing.secret", "")
+	viper.SetDefault("request_signing.max_body_bytes", 10485760)
+
+	if err := viper.ReadInConfig(); err != nil {
+		logrus.WithError(err).Warn("Could not read config file, using defaults")
+	}
+
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return requestLogger.Wrap(next)
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(wrapped, r)
+
+		endpoint := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				endpoint = tpl
+			}
+		}
+		status := fmt.Sprintf("%d", wrapped.statusCode)
+		httpRequestsTotal.WithLabelValues(r.Method, endpoint, status).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, endpoint, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	applied, _ := appliedSeq()
+	ordersApplied, _ := appliedOrderSeq()
+	names := make([]string, len(resolutions))
+	for i, res := range resolutions {
+		names[i] = res.Name
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":     "Rollup Service",
+		"version":     version,
+		"status":      "running",
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"uptime":      time.Since(startTime).String(),
+		"source":      viper.GetString("source.url"),
+		"applied_seq": applied,
+		"business":    viper.GetString("business.url"),
+		"orders_seq":  ordersApplied,
+		"resolutions": names,
+	})
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status := "healthy"
+	statusCode := http.StatusOK
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(stateBucket)) == nil {
+			return fmt.Errorf("state bucket not found")
+		}
+		return nil
+	})
+	// A saturated runtime degrades the service but keeps it in rotation.
+	runtimeStatus, sampled := telemetry.Runtime()
+	if err != nil {
+		status = "unhealthy"
+		statusCode = http.StatusServiceUnavailable
+	} else if len(runtimeStatus.Saturated) > 0 {
+		status = "degraded"
+	}
+
+	response := map[string]interface{}{
+		"status":    status,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"database":  err == nil,
+	}
+	if sampled {
+		response["runtime"] = runtimeStatus
+	}
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// readinessHandler reports ready once the change feed has been drained, so
+// dashboards are not pointed at a service still replaying history.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !caughtUp.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":    "catching_up",
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "ready",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
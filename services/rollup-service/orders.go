@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"pipeline/pkg/bootstrap"
+	"pipeline/pkg/changefeed"
+)
+
+// orderStatesBucket keeps the status and amount of every live order so a
+// status change can be counted once and credited with the order's revenue.
+const orderStatesBucket = "order_states"
+
+// ordersBucket holds the order rollups of res.
+func (r resolution) ordersBucket() string {
+	return "orders_" + r.Name
+}
+
+// OrderRollup aggregates the business service's orders within one window.
+// An order is counted as completed or failed in the window it reached that
+// status, and its revenue with its completion.
+type OrderRollup struct {
+	Start     time.Time `json:"start"`
+	Created   int64     `json:"created"`
+	Completed int64     `json:"completed"`
+	Failed    int64     `json:"failed"`
+	Revenue   float64   `json:"revenue"`
+}
+
+// OrderRollupPoint is an order rollup as served by the API.
+type OrderRollupPoint struct {
+	OrderRollup
+	End time.Time `json:"end"`
+}
+
+// orderState is what the service remembers about each live order.
+type orderState struct {
+	Status string  `json:"status"`
+	Amount float64 `json:"amount"`
+}
+
+// orderEvent mirrors the business-service order event log entry.
+type orderEvent struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	OrderID   string    `json:"order_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Order     *struct {
+		Quantity int     `json:"quantity"`
+		Price    float64 `json:"price"`
+		Status   string  `json:"status"`
+	} `json:"order,omitempty"`
+	To string `json:"to,omitempty"`
+}
+
+// followOrders tails the business service order event log and folds each
+// batch into the order rollups, the way followChanges does for records.
+func followOrders() {
+	source := strings.TrimRight(viper.GetString("business.url"), "/")
+	interval := viper.GetDuration("business.poll_interval")
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: bootstrap.SignedTransport(viper.GetViper(), nil)}
+
+	applied, err := appliedOrderSeq()
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to read rollup state")
+	}
+	logrus.WithFields(logrus.Fields{"source": source, "since": applied}).Info("Following business service order events")
+
+	for {
+		var batch struct {
+			Events  []orderEvent `json:"events"`
+			LastSeq uint64       `json:"last_seq"`
+		}
+		err := changefeed.FetchJSON(client, fmt.Sprintf("%s/api/v1/order-events?since=%d&limit=%d", source, applied, changesLimit), &batch)
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to fetch order events from business service")
+			time.Sleep(interval)
+			continue
+		}
+
+		if len(batch.Events) > 0 {
+			if err := applyOrderEvents(batch.Events); err != nil {
+				logrus.WithError(err).Error("Failed to apply order events to rollups")
+				time.Sleep(interval)
+				continue
+			}
+			applied = batch.Events[len(batch.Events)-1].Seq
+		}
+
+		lag := float64(0)
+		if batch.LastSeq > applied {
+			lag = float64(batch.LastSeq - applied)
+		}
+		lagOrderEvents.Set(lag)
+
+		if len(batch.Events) < changesLimit {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// applyOrderEvents folds a batch of order events into every resolution and
+// stores the last sequence in the same transaction.
+func applyOrderEvents(events []orderEvent) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		states := tx.Bucket([]byte(orderStatesBucket))
+		for _, e := range events {
+			var previous *orderState
+			if v := states.Get([]byte(e.OrderID)); v != nil {
+				previous = &orderState{}
+				if err := json.Unmarshal(v, previous); err != nil {
+					previous = nil
+				}
+			}
+
+			var state orderState
+			switch e.Type {
+			case "OrderCreated":
+				if e.Order == nil {
+					continue
+				}
+				state = orderState{Status: e.Order.Status, Amount: float64(e.Order.Quantity) * e.Order.Price}
+				if previous == nil {
+					if err := bumpOrders(tx, e.Timestamp, func(r *OrderRollup) { r.Created++ }); err != nil {
+						return err
+					}
+				}
+			case "StatusChanged":
+				if previous == nil {
+					continue
+				}
+				state = orderState{Status: e.To, Amount: previous.Amount}
+			case "OrderDeleted":
+				if err := states.Delete([]byte(e.OrderID)); err != nil {
+					return err
+				}
+				orderEventsApplied.WithLabelValues(e.Type).Inc()
+				continue
+			default:
+				continue
+			}
+
+			if previous == nil || previous.Status != state.Status {
+				var err error
+				switch state.Status {
+				case "completed":
+					err = bumpOrders(tx, e.Timestamp, func(r *OrderRollup) {
+						r.Completed++
+						r.Revenue += state.Amount
+					})
+				case "failed":
+					err = bumpOrders(tx, e.Timestamp, func(r *OrderRollup) { r.Failed++ })
+				}
+				if err != nil {
+					return err
+				}
+			}
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := states.Put([]byte(e.OrderID), data); err != nil {
+				return err
+			}
+			orderEventsApplied.WithLabelValues(e.Type).Inc()
+		}
+		last := events[len(events)-1].Seq
+		return tx.Bucket([]byte(stateBucket)).Put([]byte("orders_applied_seq"), []byte(strconv.FormatUint(last, 10)))
+	})
+}
+
+// bumpOrders updates the order rollup containing at in every resolution.
+func bumpOrders(tx *bolt.Tx, at time.Time, fn func(*OrderRollup)) error {
+	for _, res := range resolutions {
+		b := tx.Bucket([]byte(res.ordersBucket()))
+		start := at.UTC().Truncate(res.Window)
+		key := rollupKey(start, "")
+
+		rollup := OrderRollup{Start: start}
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &rollup); err != nil {
+				return fmt.Errorf("decode order rollup %s %s: %w", res.Name, start.Format(time.RFC3339), err)
+			}
+		}
+		fn(&rollup)
+
+		data, err := json.Marshal(rollup)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliedOrderSeq() (uint64, error) {
+	var seq uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(stateBucket)).Get([]byte("orders_applied_seq"))
+		if v == nil {
+			return nil
+		}
+		var err error
+		seq, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	return seq, err
+}
+
+// queryOrderRollups returns the order rollups of res with from <= start < to.
+func queryOrderRollups(res resolution, from, to time.Time, limit int) ([]OrderRollupPoint, error) {
+	points := []OrderRollupPoint{}
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(res.ordersBucket())).Cursor()
+		end := uint64(to.Unix())
+		for k, v := c.Seek(rollupKey(from.UTC().Truncate(res.Window), "")); k != nil && len(points) < limit; k, v = c.Next() {
+			if binary.BigEndian.Uint64(k[:8]) >= end {
+				break
+			}
+			var rollup OrderRollup
+			if err := json.Unmarshal(v, &rollup); err != nil {
+				return err
+			}
+			points = append(points, OrderRollupPoint{OrderRollup: rollup, End: rollup.Start.Add(res.Window)})
+		}
+		return nil
+	})
+	return points, err
+}
+
+// getOrderRollupsHandler serves GET /api/v1/rollups/orders?resolution=5m&from=&to=
+// with the same defaults as getRollupsHandler.
+func getOrderRollupsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	name := q.Get("resolution")
+	if name == "" {
+		name = "5m"
+	}
+	res, ok := findResolution(name)
+	if !ok {
+		http.Error(w, "resolution must be one of 1m, 5m, 1h", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * res.Window)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	limit := viper.GetInt("rollups.max_points")
+	points, err := queryOrderRollups(res, from, to, limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query order rollups")
+		http.Error(w, "Failed to query order rollups", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resolution": res.Name,
+		"from":       from.UTC().Format(time.RFC3339),
+		"to":         to.UTC().Format(time.RFC3339),
+		"rollups":    points,
+		"truncated":  len(points) >= limit,
+	})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	stateBucket = "state"
+	// recordsBucket keeps the type and processed flag of every live record so
+	// deletes can be attributed to a type and a processed update is only
+	// counted on its first transition.
+	recordsBucket = "records"
+)
+
+// resolution is one rollup granularity, stored in its own bucket.
+type resolution struct {
+	Name   string
+	Window time.Duration
+}
+
+var resolutions = []resolution{
+	{Name: "1m", Window: time.Minute},
+	{Name: "5m", Window: 5 * time.Minute},
+	{Name: "1h", Window: time.Hour},
+}
+
+func (r resolution) bucket() string {
+	return "rollups_" + r.Name
+}
+
+func (r resolution) retention() time.Duration {
+	return viper.GetDuration("rollups.retention." + r.Name)
+}
+
+func findResolution(name string) (resolution, bool) {
+	for _, res := range resolutions {
+		if res.Name == name {
+			return res, true
+		}
+	}
+	return resolution{}, false
+}
+
+// Rollup aggregates the changes of one record type within one window.
+type Rollup struct {
+	Start     time.Time `json:"start"`
+	Type      string    `json:"type"`
+	Created   int64     `json:"created"`
+	Updated   int64     `json:"updated"`
+	Processed int64     `json:"processed"`
+	Deleted   int64     `json:"deleted"`
+	// Latency is the distribution of ingest-to-processed time in seconds.
+	Latency Histogram `json:"processing_latency"`
+}
+
+// Histogram holds non-cumulative bucket counts: Counts[i] covers values up
+// to Bounds[i], and the extra last entry everything above.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  int64     `json:"count"`
+}
+
+func (h *Histogram) observe(bounds []float64, value float64) {
+	if len(h.Counts) != len(bounds)+1 {
+		h.Bounds = bounds
+		h.Counts = make([]int64, len(bounds)+1)
+	}
+	h.Counts[sort.SearchFloat64s(h.Bounds, value)]++
+	h.Sum += value
+	h.Count++
+}
+
+// RollupPoint is a rollup as served by the API, with per-second rates.
+type RollupPoint struct {
+	Rollup
+	End   time.Time          `json:"end"`
+	Rates map[string]float64 `json:"rates_per_second"`
+}
+
+// recordState is what the service remembers about each live record.
+type recordState struct {
+	Type      string `json:"type"`
+	Processed bool   `json:"processed"`
+}
+
+// change mirrors the data-service change feed entry.
+type change struct {
+	Sequence  uint64    `json:"seq"`
+	Operation string    `json:"op"`
+	RecordID  string    `json:"record_id"`
+	Record    *record   `json:"record,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type record struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Timestamp   time.Time  `json:"timestamp"`
+	Processed   bool       `json:"processed"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+}
+
+func latencyBuckets() []float64 {
+	bounds := []float64{}
+	for _, v := range viper.GetStringSlice("rollups.latency_buckets") {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			bounds = append(bounds, f)
+		}
+	}
+	sort.Float64s(bounds)
+	return bounds
+}
+
+// rollupKey orders rollups by window start, then type.
+func rollupKey(start time.Time, recordType string) []byte {
+	key := make([]byte, 8, 8+len(recordType))
+	binary.BigEndian.PutUint64(key, uint64(start.Unix()))
+	return append(key, recordType...)
+}
+
+// applyChanges folds a batch of changes into every resolution and stores the
+// last sequence in the same transaction, so a restart never double counts.
+func applyChanges(changes []change) error {
+	bounds := latencyBuckets()
+	return db.Update(func(tx *bolt.Tx) error {
+		states := tx.Bucket([]byte(recordsBucket))
+		pending, err := readCounter(tx, "pending")
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			var previous *recordState
+			if v := states.Get([]byte(c.RecordID)); v != nil {
+				previous = &recordState{}
+				if err := json.Unmarshal(v, previous); err != nil {
+					previous = nil
+				}
+			}
+
+			switch c.Operation {
+			case "create", "update":
+				if c.Record == nil {
+					continue
+				}
+				state := recordState{Type: c.Record.Type, Processed: c.Record.Processed}
+				wasPending := previous != nil && !previous.Processed
+				if !state.Processed && !wasPending {
+					pending++
+				} else if state.Processed && wasPending {
+					pending--
+				}
+				if previous == nil {
+					if err := bump(tx, c.Timestamp, state.Type, func(r *Rollup) { r.Created++ }); err != nil {
+						return err
+					}
+				} else {
+					if err := bump(tx, c.Timestamp, state.Type, func(r *Rollup) { r.Updated++ }); err != nil {
+						return err
+					}
+				}
+				if state.Processed && (previous == nil || !previous.Processed) {
+					at := c.Timestamp
+					if c.Record.ProcessedAt != nil {
+						at = *c.Record.ProcessedAt
+					}
+					latency := at.Sub(c.Record.Timestamp).Seconds()
+					if err := bump(tx, at, state.Type, func(r *Rollup) {
+						r.Processed++
+						if latency >= 0 {
+							r.Latency.observe(bounds, latency)
+						}
+					}); err != nil {
+						return err
+					}
+				}
+				data, err := json.Marshal(state)
+				if err != nil {
+					return err
+				}
+				if err := states.Put([]byte(c.RecordID), data); err != nil {
+					return err
+				}
+			case "delete":
+				recordType := "unknown"
+				if previous != nil {
+					recordType = previous.Type
+					if !previous.Processed {
+						pending--
+					}
+				}
+				if err := bump(tx, c.Timestamp, recordType, func(r *Rollup) { r.Deleted++ }); err != nil {
+					return err
+				}
+				if err := states.Delete([]byte(c.RecordID)); err != nil {
+					return err
+				}
+			}
+			changesApplied.WithLabelValues(c.Operation).Inc()
+		}
+		if err := writeCounter(tx, "pending", pending); err != nil {
+			return err
+		}
+		last := changes[len(changes)-1].Sequence
+		return tx.Bucket([]byte(stateBucket)).Put([]byte("applied_seq"), []byte(strconv.FormatUint(last, 10)))
+	})
+}
+
+func readCounter(tx *bolt.Tx, name string) (int64, error) {
+	v := tx.Bucket([]byte(stateBucket)).Get([]byte(name))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(v), 10, 64)
+}
+
+func writeCounter(tx *bolt.Tx, name string, value int64) error {
+	return tx.Bucket([]byte(stateBucket)).Put([]byte(name), []byte(strconv.FormatInt(value, 10)))
+}
+
+// seedPendingCount counts unprocessed records for databases written before
+// the pending counter was kept.
+func seedPendingCount() error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(stateBucket)).Get([]byte("pending")) != nil {
+			return nil
+		}
+		var pending int64
+		err := tx.Bucket([]byte(recordsBucket)).ForEach(func(k, v []byte) error {
+			var state recordState
+			if err := json.Unmarshal(v, &state); err == nil && !state.Processed {
+				pending++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return writeCounter(tx, "pending", pending)
+	})
+}
+
+// bump updates the rollup of recordType containing at in every resolution.
+func bump(tx *bolt.Tx, at time.Time, recordType string, fn func(*Rollup)) error {
+	for _, res := range resolutions {
+		b := tx.Bucket([]byte(res.bucket()))
+		start := at.UTC().Truncate(res.Window)
+		key := rollupKey(start, recordType)
+
+		rollup := Rollup{Start: start, Type: recordType}
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &rollup); err != nil {
+				return fmt.Errorf("decode rollup %s %s: %w", res.Name, start.Format(time.RFC3339), err)
+			}
+		}
+		fn(&rollup)
+
+		data, err := json.Marshal(rollup)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliedSeq() (uint64, error) {
+	var seq uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(stateBucket)).Get([]byte("applied_seq"))
+		if v == nil {
+			return nil
+		}
+		var err error
+		seq, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	return seq, err
+}
+
+// queryRollups returns the rollups of res with from <= start < to, optionally
+// limited to one record type.
+func queryRollups(res resolution, from, to time.Time, recordType string, limit int) ([]RollupPoint, error) {
+	points := []RollupPoint{}
+	seconds := res.Window.Seconds()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(res.bucket())).Cursor()
+		end := uint64(to.Unix())
+		for k, v := c.Seek(rollupKey(from.UTC().Truncate(res.Window), "")); k != nil && len(points) < limit; k, v = c.Next() {
+			if binary.BigEndian.Uint64(k[:8]) >= end {
+				break
+			}
+			if recordType != "" && string(k[8:]) != recordType {
+				continue
+			}
+			var rollup Rollup
+			if err := json.Unmarshal(v, &rollup); err != nil {
+				return err
+			}
+			points = append(points, RollupPoint{
+				Rollup: rollup,
+				End:    rollup.Start.Add(res.Window),
+				Rates: map[string]float64{
+					"created":   float64(rollup.Created) / seconds,
+					"processed": float64(rollup.Processed) / seconds,
+					"deleted":   float64(rollup.Deleted) / seconds,
+				},
+			})
+		}
+		return nil
+	})
+	return points, err
+}
+
+// getRollupsHandler serves GET /api/v1/rollups?resolution=5m&from=&to=&type=.
+// from and to are RFC3339 timestamps; to defaults to now and from to 24
+// windows before to.
+func getRollupsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	name := q.Get("resolution")
+	if name == "" {
+		name = "5m"
+	}
+	res, ok := findResolution(name)
+	if !ok {
+		http.Error(w, "resolution must be one of 1m, 5m, 1h", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * res.Window)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	limit := viper.GetInt("rollups.max_points")
+	points, err := queryRollups(res, from, to, q.Get("type"), limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query rollups")
+		http.Error(w, "Failed to query rollups", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resolution": res.Name,
+		"from":       from.UTC().Format(time.RFC3339),
+		"to":         to.UTC().Format(time.RFC3339),
+		"rollups":    points,
+		"truncated":  len(points) >= limit,
+	})
+}
+
+// pruneContinuously drops record and order rollups older than each
+// resolution's retention.
+func pruneContinuously() {
+	interval := viper.GetDuration("rollups.prune_interval")
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, res := range resolutions {
+			for _, bucket := range []string{res.bucket(), res.ordersBucket()} {
+				removed, err := pruneRollups(bucket, res, time.Now().Add(-res.retention()))
+				if err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{"resolution": res.Name, "bucket": bucket}).Error("Failed to prune rollups")
+					continue
+				}
+				if removed > 0 {
+					logrus.WithFields(logrus.Fields{"resolution": res.Name, "bucket": bucket, "removed": removed}).Info("Pruned expired rollups")
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// pruneRollups drops the rollups in bucket, one of res's buckets, that
+// start before before.
+func pruneRollups(bucket string, res resolution, before time.Time) (int, error) {
+	if res.retention() <= 0 {
+		return 0, nil
+	}
+	removed := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k[:8])) < before.Unix(); k, _ = c.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}